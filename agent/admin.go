@@ -0,0 +1,254 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * The admin server is an opt-in local HTTP server for debugging an agent
+ * without the API, e.g. a hung agent on an isolated box.  Config.Admin is
+ * where it listens: unix:<socket> or a localhost port like localhost:9001.
+ * It serves:
+ *
+ *   /status            Same as the Status cmd: all status, or
+ *   /status/<service>  one service's status ("agent" for the agent)
+ *   /configs           Same as the GetAllConfigs cmd
+ *   /instances         Instances by name, e.g. mysql-1, DSNs redacted
+ *   /cmd               POST a proto.Cmd, reply is its proto.Reply
+ *   /debug/pprof/      net/http/pprof (goroutine, heap, profile, etc.)
+ *
+ * Status and configs have DSNs, so requests are authenticated by LocalAuth:
+ * see pct/localauth.go.  The handlers except /cmd don't use the cmd or status
+ * handler goroutines, so they work even when those are blocked.  Cmds are
+ * handled one at a time with cmds from the API, see Agent.LocalCmd.  The
+ * percona-agent subcommands (bin/percona-agent/cli.go) use the admin server.
+ */
+
+type Admin struct {
+	agent  *Agent
+	auth   *pct.LocalAuth
+	logger *pct.Logger
+	// --
+	listener net.Listener
+	mux      *sync.Mutex
+}
+
+// InstanceLister lists instances for the admin server.  The instance manager
+// implements it, like InstanceGroups.
+type InstanceLister interface {
+	Instances() map[string]*json.RawMessage
+}
+
+type AdminConfigs struct {
+	Configs []proto.AgentConfig
+	Errors  []string `json:",omitempty"`
+}
+
+func NewAdmin(agent *Agent, auth *pct.LocalAuth, logger *pct.Logger) *Admin {
+	a := &Admin{
+		agent:  agent,
+		auth:   auth,
+		logger: logger,
+		mux:    &sync.Mutex{},
+	}
+	return a
+}
+
+// ParseAdminAddr returns the network and address of Config.Admin, or an
+// error if it's not a Unix socket or a loopback TCP address.
+func ParseAdminAddr(addr string) (string, string, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		socket := strings.TrimPrefix(addr, "unix:")
+		if socket == "" {
+			return "", "", errors.New("Invalid admin address " + addr + ": no socket file")
+		}
+		return "unix", socket, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", errors.New("Invalid admin address " + addr + ": expected unix:<socket> or localhost:<port>")
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return "", "", errors.New("Invalid admin address " + addr + ": host must be localhost or a loopback IP")
+		}
+	}
+	return "tcp", addr, nil
+}
+
+// Start listens on addr and serves in a goroutine until Stop is called.
+func (a *Admin) Start(addr string) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.listener != nil {
+		return pct.ServiceIsRunningError{Service: "admin"}
+	}
+
+	network, address, err := ParseAdminAddr(addr)
+	if err != nil {
+		return err
+	}
+	l, err := a.auth.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	a.listener = l
+
+	go func() {
+		// Serve returns an error when Stop closes the listener.
+		err := http.Serve(l, a.Handler())
+		a.mux.Lock()
+		running := a.listener == l
+		a.mux.Unlock()
+		if running {
+			a.logger.Error("Admin server stopped: ", err)
+		}
+	}()
+
+	a.logger.Info("Admin server listening on " + addr)
+	return nil
+}
+
+func (a *Admin) Stop() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.listener == nil {
+		return nil
+	}
+	err := a.listener.Close() // also removes a Unix socket
+	a.listener = nil
+	a.logger.Info("Admin server stopped")
+	return err
+}
+
+// Handler returns the admin server handler wrapped by LocalAuth.Handler.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.status)
+	mux.HandleFunc("/status/", a.status)
+	mux.HandleFunc("/configs", a.configs)
+	mux.HandleFunc("/instances", a.instances)
+	mux.HandleFunc("/cmd", a.cmd)
+	// Not pprof's init() handlers: they're on http.DefaultServeMux.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	return a.auth.Handler(mux)
+}
+
+// --------------------------------------------------------------------------
+
+func (a *Admin) status(w http.ResponseWriter, r *http.Request) {
+	service := strings.Trim(strings.TrimPrefix(r.URL.Path, "/status"), "/")
+	var status map[string]string
+	switch service {
+	case "":
+		status = a.agent.AllStatus()
+	case "agent":
+		status = a.agent.Status()
+	default:
+		manager, ok := a.agent.services[service]
+		if !ok || manager == nil {
+			http.Error(w, pct.UnknownServiceError{Service: service}.Error(), http.StatusNotFound)
+			return
+		}
+		status = manager.Status()
+	}
+	a.reply(w, status)
+}
+
+func (a *Admin) configs(w http.ResponseWriter, r *http.Request) {
+	configs, errs := a.agent.AllConfigs()
+	reply := AdminConfigs{
+		Configs: configs,
+	}
+	for _, err := range errs {
+		reply.Errors = append(reply.Errors, err.Error())
+	}
+	a.reply(w, reply)
+}
+
+func (a *Admin) instances(w http.ResponseWriter, r *http.Request) {
+	lister, ok := a.agent.services["instance"].(InstanceLister)
+	if !ok {
+		http.Error(w, "Instance manager does not list instances", http.StatusNotImplemented)
+		return
+	}
+	bytes, err := json.MarshalIndent(lister.Instances(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.write(w, []byte(pct.RedactDSNs(string(bytes))))
+}
+
+func (a *Admin) cmd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST a proto.Cmd", http.StatusMethodNotAllowed)
+		return
+	}
+	cmd := &proto.Cmd{}
+	if err := json.NewDecoder(r.Body).Decode(cmd); err != nil {
+		http.Error(w, "Invalid cmd: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cmd.Ts.IsZero() {
+		cmd.Ts = time.Now().UTC()
+	}
+	a.agent.configMux.RLock()
+	cmd.AgentUuid = a.agent.config.AgentUuid
+	a.agent.configMux.RUnlock()
+	a.logger.Info("Local cmd: ", cmd)
+	reply := a.agent.LocalCmd(cmd)
+	if reply == nil {
+		reply = cmd.Reply(nil) // no reply, e.g. Reconnect
+	}
+	a.reply(w, reply)
+}
+
+func (a *Admin) reply(w http.ResponseWriter, v interface{}) {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.write(w, bytes)
+}
+
+func (a *Admin) write(w http.ResponseWriter, bytes []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+	w.Write([]byte("\n"))
+}
@@ -21,17 +21,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
-	pctCmd "github.com/percona/percona-agent/pct/cmd"
 )
 
 // REV="$(git rev-parse HEAD)"
@@ -45,8 +40,11 @@ const (
 	CMD_QUEUE_SIZE    = 10
 	STATUS_QUEUE_SIZE = 10
 	MAX_ERRORS        = 3
+	LOCAL_CMD_WAIT    = 10 * time.Second
 )
 
+var ErrNoExec = errors.New("Agent built without remote exec (noexec)")
+
 type Agent struct {
 	config    *Config
 	configMux *sync.RWMutex
@@ -55,11 +53,14 @@ type Agent struct {
 	client    pct.WebsocketClient
 	api       pct.APIConnector
 	services  map[string]pct.ServiceManager
-	updater   *pct.Updater
 	keepalive *time.Ticker
+	history   *CmdHistory
+	pause     *pause
+	pauseMux  *sync.Mutex
 	// --
 	cmdSync        *pct.SyncChan
 	cmdChan        chan *proto.Cmd
+	localChan      chan *localCmd
 	cmdHandlerSync *pct.SyncChan
 	//
 	statusSync        *pct.SyncChan
@@ -76,10 +77,12 @@ func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client p
 		logger:    logger,
 		client:    client,
 		services:  services,
-		updater:   pct.NewUpdater(logger, api, pct.PublicKey, os.Args[0], VERSION),
+		history:   NewCmdHistory(CMD_HISTORY_SIZE),
+		pauseMux:  &sync.Mutex{},
 		// --
-		status:     pct.NewStatus([]string{"agent", "agent-cmd-handler"}),
+		status:     pct.NewStatus([]string{"agent", "agent-cmd-handler", "agent-pause"}),
 		cmdChan:    make(chan *proto.Cmd, CMD_QUEUE_SIZE),
+		localChan:  make(chan *localCmd),
 		statusChan: make(chan *proto.Cmd, STATUS_QUEUE_SIZE),
 	}
 	return agent
@@ -137,6 +140,7 @@ func (agent *Agent) Run() error {
 
 		select {
 		case cmd := <-cmdChan: // from API
+			agent.history.Received(cmd)
 			if cmd.Cmd == "Abort" {
 				panic(cmd)
 			}
@@ -144,39 +148,9 @@ func (agent *Agent) Run() error {
 			case "Restart":
 				logger.Debug("cmd:restart")
 				agent.status.UpdateRe("agent", "Restarting", cmd)
-
-				// Secure the start-lock file.  This lets us start our self but
-				// wait until this process has exited, at which time the start-lock
-				// is removed and the 2nd self continues starting.
-				if err := pct.MakeStartLock(); err != nil {
-					agent.reply(cmd.Reply(nil, err))
+				if !agent.restart(cmd) {
 					continue
 				}
-
-				// Start our self with the same args this process was started with.
-				cwd, err := os.Getwd()
-				if err != nil {
-					agent.reply(cmd.Reply(nil, err))
-				}
-				comment := fmt.Sprintf(
-					"This script was created by percona-agent in response to this Restart command:\n"+
-						"# %s\n"+
-						"# It is safe to delete.", cmd)
-				sh := fmt.Sprintf("#!/bin/sh\n# %s\ncd %s\n%s %s >> %s/percona-agent.log 2>&1 &\n",
-					comment,
-					cwd,
-					os.Args[0],
-					strings.Join(os.Args[1:len(os.Args)], " "),
-					pct.Basedir.Path(),
-				)
-				startScript := pct.Basedir.File("start-script")
-				if err := ioutil.WriteFile(startScript, []byte(sh), os.FileMode(0754)); err != nil {
-					agent.reply(cmd.Reply(nil, err))
-				}
-				logger.Debug("Restart:sh")
-				self := pctCmd.Factory.Make(startScript)
-				output, err := self.Run()
-				agent.reply(cmd.Reply(output, err))
 				logger.Debug("Restart:done")
 				return nil
 			case "Stop":
@@ -184,18 +158,18 @@ func (agent *Agent) Run() error {
 				logger.Info("Stopping", cmd)
 				agent.status.UpdateRe("agent", "Stopping", cmd)
 				agent.stop()
-				agent.reply(cmd.Reply(nil))
+				agent.replyTo(cmd, cmd.Reply(nil))
 				logger.Info("Stopped", cmd)
 				agent.status.UpdateRe("agent", "Stopped", cmd)
 				return nil
-			case "Status":
+			case "Status", "History", "Heartbeat":
 				logger.Debug("cmd:status")
 				agent.status.UpdateRe("agent", "Queueing", cmd)
 				select {
 				case agent.statusChan <- cmd: // to statusHandler
 				default:
 					err := pct.QueueFullError{Cmd: cmd.Cmd, Name: "statusQueue", Size: STATUS_QUEUE_SIZE}
-					agent.reply(cmd.Reply(nil, err))
+					agent.replyTo(cmd, cmd.Reply(nil, err))
 				}
 			default:
 				logger.Debug("cmd")
@@ -204,7 +178,7 @@ func (agent *Agent) Run() error {
 				case agent.cmdChan <- cmd: // to cmdHandler
 				default:
 					err := pct.QueueFullError{Cmd: cmd.Cmd, Name: "cmdQueue", Size: CMD_QUEUE_SIZE}
-					agent.reply(cmd.Reply(nil, err))
+					agent.replyTo(cmd, cmd.Reply(nil, err))
 				}
 			}
 		case <-agent.cmdHandlerSync.CrashChan:
@@ -266,6 +240,7 @@ func (agent *Agent) stop() {
 	agent.status.UpdateRe("agent", "Stopping cmdHandler", cmd)
 	agent.cmdHandlerSync.Stop()
 	agent.cmdHandlerSync.Wait()
+	agent.stopPause()
 
 	for service, manager := range agent.services {
 		if service == "log" {
@@ -284,6 +259,22 @@ func (agent *Agent) stop() {
 	agent.statusHandlerSync.Wait()
 }
 
+// @goroutine[0]
+func (agent *Agent) handoff() {
+	h := pct.NewHandoff()
+	for service, manager := range agent.services {
+		if m, ok := manager.(pct.StateHandoff); ok {
+			agent.logger.Info("Handing off " + service)
+			if err := m.Handoff(h); err != nil {
+				agent.logger.Warn("Cannot hand off "+service+":", err)
+			}
+		}
+	}
+	if err := pct.SaveHandoff(h); err != nil {
+		agent.logger.Warn("Cannot save handoff:", err)
+	}
+}
+
 func LoadConfig() ([]byte, error) {
 	config := &Config{}
 	if err := pct.Basedir.ReadConfig("agent", config); err != nil {
@@ -358,50 +349,19 @@ func (agent *Agent) cmdHandler() {
 
 		select {
 		case cmd := <-agent.cmdChan:
-			agent.status.UpdateRe("agent-cmd-handler", "Handling", cmd)
-
-			// Handle the cmd in a separate goroutine so if it gets stuck it won't affect us.
-			go func() {
-				var reply *proto.Reply
-				defer func() {
-					if err := recover(); err != nil {
-						agent.logger.Error(fmt.Sprintf("Command %s crashed: %s", cmd, err))
-						reply = cmd.Reply(nil, fmt.Errorf("%s", err))
-					}
-					cmdReply <- reply
-				}()
-				if cmd.Service == "agent" {
-					reply = agent.Handle(cmd)
-				} else {
-					if manager, ok := agent.services[cmd.Service]; ok {
-						reply = manager.Handle(cmd)
-					} else {
-						reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
-					}
-				}
-			}()
-
-			// Wait for the cmd to complete.
-			var timeout <-chan time.Time
-			if cmd.Cmd == "Update" {
-				timeout = time.After(5 * time.Minute)
-			} else {
-				timeout = time.After(20 * time.Second)
-			}
-			var reply *proto.Reply
-			select {
-			case reply = <-cmdReply:
-				// todo: instrument cmd exec time
-			case <-timeout:
-				reply = cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
-			}
+			reply := agent.exec(cmd, cmdReply)
 
 			// Reply to cmd.
+			agent.history.Replied(cmd, reply)
 			if reply != nil {
 				agent.reply(reply)
 			} else {
 				agent.logger.Info(cmd, "executed, no reply")
 			}
+		case lc := <-agent.localChan: // from LocalCmd()
+			reply := agent.exec(lc.cmd, cmdReply)
+			agent.history.Replied(lc.cmd, reply)
+			lc.reply <- reply
 		case <-agent.cmdHandlerSync.StopChan: // from stop()
 			agent.cmdHandlerSync.Graceful()
 			return
@@ -409,7 +369,89 @@ func (agent *Agent) cmdHandler() {
 	}
 }
 
+// exec handles the cmd and returns its reply, or a timeout error.
+// cmdHandler:@goroutine[1]
+func (agent *Agent) exec(cmd *proto.Cmd, cmdReply chan *proto.Reply) *proto.Reply {
+	agent.status.UpdateRe("agent-cmd-handler", "Handling", cmd)
+
+	// Handle the cmd in a separate goroutine so if it gets stuck it won't affect us.
+	go func() {
+		var reply *proto.Reply
+		defer func() {
+			if err := recover(); err != nil {
+				agent.logger.Error(fmt.Sprintf("Command %s crashed: %s", cmd, err))
+				reply = cmd.Reply(nil, fmt.Errorf("%s", err))
+			}
+			cmdReply <- reply
+		}()
+		if cmd.Service == "agent" {
+			reply = agent.Handle(cmd)
+		} else {
+			if err := agent.paused(cmd.Service, cmd.Cmd); err != nil {
+				reply = cmd.Reply(nil, err)
+			} else if manager, ok := agent.services[cmd.Service]; ok {
+				reply = manager.Handle(cmd)
+			} else {
+				reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
+			}
+		}
+	}()
+
+	// Wait for the cmd to complete.
+	var timeout <-chan time.Time
+	if cmd.Cmd == "Update" || cmd.Cmd == "GroupCmd" || cmd.Cmd == "Reload" {
+		timeout = time.After(5 * time.Minute)
+	} else {
+		timeout = time.After(20 * time.Second)
+	}
+	var reply *proto.Reply
+	select {
+	case reply = <-cmdReply:
+		// todo: instrument cmd exec time
+	case <-timeout:
+		reply = cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
+	}
+	return reply
+}
+
+// A localCmd is a cmd from the admin server (see admin.go), i.e. from a
+// local user, not the API.  It's handled like cmds from the API, one at a
+// time, but the reply is returned to the user instead of sent to the API.
+type localCmd struct {
+	cmd   *proto.Cmd
+	reply chan *proto.Reply
+}
+
+// LocalCmd handles the cmd like cmds from the API and returns its reply.  It
+// waits LOCAL_CMD_WAIT for the cmd handler, which handles one cmd at a time.
+func (agent *Agent) LocalCmd(cmd *proto.Cmd) *proto.Reply {
+	agent.history.Received(cmd)
+	lc := &localCmd{
+		cmd:   cmd,
+		reply: make(chan *proto.Reply, 1),
+	}
+	select {
+	case agent.localChan <- lc:
+	case <-time.After(LOCAL_CMD_WAIT):
+		reply := cmd.Reply(nil, pct.CmdTimeoutError{Cmd: cmd.Cmd})
+		agent.history.Replied(cmd, reply)
+		return reply
+	}
+	return <-lc.reply
+}
+
+// replyTo records the reply in the cmd history and sends it.
+func (agent *Agent) replyTo(cmd *proto.Cmd, reply *proto.Reply) {
+	agent.history.Replied(cmd, reply)
+	agent.reply(reply)
+}
+
 func (agent *Agent) reply(reply *proto.Reply) {
+	// Replies can have DSNs, e.g. GetConfig data or connection errors.
+	reply.Error = pct.RedactDSNs(reply.Error)
+	if len(reply.Data) > 0 {
+		reply.Data = []byte(pct.RedactDSNs(string(reply.Data)))
+	}
 	select {
 	case agent.client.SendChan() <- reply:
 		// SendChan is buffered so this should be very quick.
@@ -443,10 +485,22 @@ func (agent *Agent) Handle(cmd *proto.Cmd) *proto.Reply {
 		data, errs = agent.handleGetAllConfigs(cmd)
 	case "SetConfig":
 		data, errs = agent.handleSetConfig(cmd)
+	case "Reload":
+		data, errs = agent.handleReload(cmd)
+	case "Pause":
+		data, errs = agent.handlePause(cmd)
+	case "Resume":
+		data, errs = agent.handleResume(cmd)
 	case "Update":
 		data, errs = agent.handleUpdate(cmd)
 	case "Version":
 		data, errs = agent.handleVersion(cmd)
+	case "Capabilities":
+		data, errs = agent.handleCapabilities(cmd)
+	case "GetCmdHistory":
+		data, errs = agent.handleGetCmdHistory(cmd)
+	case "GroupCmd":
+		data, err = agent.handleGroupCmd(cmd)
 	case "Reconnect":
 		/*
 			Reconnect is a special case: there's no reply because we can't
@@ -493,6 +547,9 @@ func (agent *Agent) handleStartService(cmd *proto.Cmd) (interface{}, error) {
 	if !ok {
 		return nil, pct.UnknownServiceError{Service: s.Name}
 	}
+	if err := agent.paused(s.Name, "StartService"); err != nil {
+		return nil, err
+	}
 
 	// Start the service.
 	if err := m.Start(); err != nil {
@@ -534,6 +591,11 @@ func (agent *Agent) handleGetConfig(cmd *proto.Cmd) (interface{}, []error) {
 
 // Handle:@goroutine[3]
 func (agent *Agent) handleGetAllConfigs(cmd *proto.Cmd) (interface{}, []error) {
+	return agent.AllConfigs()
+}
+
+// AllConfigs returns the agent config and the configs of all services.
+func (agent *Agent) AllConfigs() ([]proto.AgentConfig, []error) {
 	configs, errs := agent.GetConfig()
 	for service, manager := range agent.services {
 		if manager == nil { // should not happen
@@ -609,20 +671,56 @@ func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	return &finalConfig, errs
 }
 
+// Handle:@goroutine[3]
+func (agent *Agent) handleReload(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Reload", cmd)
+	agent.logger.Info(cmd)
+	return agent.Reload()
+}
+
+// Reload re-reads the services' configs from the basedir and applies the
+// changes, for services that implement pct.ConfigReloader.  It returns the
+// services reloaded.  Paused services are not reloaded because they're
+// stopped, so every config would look new and its tool would be started;
+// they read their configs when resumed.  The agent config is not reloaded:
+// changing it requires SetConfig or a restart.
+func (agent *Agent) Reload() ([]string, []error) {
+	names := make([]string, 0, len(agent.services))
+	for name := range agent.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reloaded := []string{}
+	errs := []error{}
+	for _, name := range names {
+		r, ok := agent.services[name].(pct.ConfigReloader)
+		if !ok {
+			continue
+		}
+		if err := agent.paused(name, "StartService"); err != nil {
+			agent.logger.Info("Not reloading " + name + ": " + err.Error())
+			continue
+		}
+		agent.status.Update("agent-cmd-handler", "Reloading "+name)
+		for _, err := range r.Reload() {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+		}
+		reloaded = append(reloaded, name)
+	}
+	return reloaded, errs
+}
+
 func (agent *Agent) handleVersion(cmd *proto.Cmd) (interface{}, []error) {
 	v := &proto.Version{
 		Running:  VERSION + REL,
 		Revision: REVISION,
 	}
-	bin, err := filepath.Abs(os.Args[0])
-	if err != nil {
-		return v, []error{err}
-	}
-	out, err := exec.Command(bin, "-version").Output()
+	installed, err := installedVersion(v.Running)
 	if err != nil {
 		return v, []error{err}
 	}
-	v.Installed = strings.TrimSpace(string(out))
+	v.Installed = installed
 	return v, nil
 }
 
@@ -630,11 +728,14 @@ func (agent *Agent) handleVersion(cmd *proto.Cmd) (interface{}, []error) {
 func (agent *Agent) handleUpdate(cmd *proto.Cmd) (interface{}, []error) {
 	agent.status.UpdateRe("agent-cmd-handler", "Update", cmd)
 	agent.logger.Info(cmd)
+	if !REMOTE_EXEC {
+		return nil, []error{ErrNoExec}
+	}
 	version := string(cmd.Data)
 	if version == "" {
 		return nil, []error{fmt.Errorf("Invalid version: '%s'", version)}
 	}
-	err := agent.updater.Update(version)
+	err := agent.update(version)
 	return nil, []error{err}
 }
 
@@ -658,18 +759,26 @@ func (agent *Agent) statusHandler() {
 	for {
 		select {
 		case cmd := <-agent.statusChan:
-			switch cmd.Service {
-			case "":
-				replyChan <- cmd.Reply(agent.AllStatus())
-			case "agent":
-				replyChan <- cmd.Reply(agent.Status())
+			var reply *proto.Reply
+			switch {
+			case cmd.Cmd == "Heartbeat":
+				reply = cmd.Reply(agent.Heartbeat())
+			case cmd.Cmd == "History":
+				// Data is the optional name of the cmd to get, e.g. "SetConfig".
+				reply = cmd.Reply(agent.history.Entries(string(cmd.Data)))
+			case cmd.Service == "":
+				reply = cmd.Reply(agent.AllStatus())
+			case cmd.Service == "agent":
+				reply = cmd.Reply(agent.Status())
 			default:
 				if manager, ok := agent.services[cmd.Service]; ok {
-					replyChan <- cmd.Reply(manager.Status())
+					reply = cmd.Reply(manager.Status())
 				} else {
-					replyChan <- cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
+					reply = cmd.Reply(nil, pct.UnknownServiceError{Service: cmd.Service})
 				}
 			}
+			agent.history.Replied(cmd, reply)
+			replyChan <- reply
 		case <-agent.statusHandlerSync.StopChan:
 			agent.statusHandlerSync.Graceful()
 			return
@@ -679,7 +788,25 @@ func (agent *Agent) statusHandler() {
 
 // statusHandler:@goroutine[2]
 func (agent *Agent) Status() map[string]string {
-	return agent.status.Merge(agent.client.Status())
+	status := agent.status.Merge(agent.client.Status())
+	status["agent-cmd-last"] = agent.history.Last()
+	return status
+}
+
+// Heartbeat returns when each tool last collected and sent data, i.e. the
+// *-last-collected and *-last-sent keys of AllStatus, so the API knows whether
+// data is flowing, not just whether the agent is alive.  It's the reply to the
+// Heartbeat cmd; the keepalive Pong has no data because the API doesn't expect
+// any.
+// statusHandler:@goroutine[2]
+func (agent *Agent) Heartbeat() map[string]string {
+	heartbeat := make(map[string]string)
+	for k, v := range agent.AllStatus() {
+		if pct.IsLastTs(k) {
+			heartbeat[k] = v
+		}
+	}
+	return heartbeat
 }
 
 // statusHandler:@goroutine[2]
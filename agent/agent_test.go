@@ -19,18 +19,23 @@ package agent_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/agent"
 	"github.com/percona/percona-agent/pct"
-	pctCmd "github.com/percona/percona-agent/pct/cmd"
 	"github.com/percona/percona-agent/qan"
 	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -232,6 +237,24 @@ func (s *AgentTestSuite) TestStatus(t *C) {
 	// Didn't ask for all or agent, so we don't get it.
 	_, ok = got["agent"]
 	t.Check(ok, Equals, false)
+
+	/**
+	 * Get the heartbeat: only the last collected and sent keys of all status.
+	 */
+	statusCmd = &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Cmd:     "Heartbeat",
+		Service: "agent",
+	}
+	s.sendChan <- statusCmd
+	got = test.WaitStatusReply(s.recvChan)
+	t.Assert(got, NotNil)
+	for k := range got {
+		t.Check(pct.IsLastTs(k), Equals, true, Commentf(k))
+	}
+	_, ok = got["agent"]
+	t.Check(ok, Equals, false)
 }
 
 func (s *AgentTestSuite) TestStatusAfterConnFail(t *C) {
@@ -602,6 +625,33 @@ func (s *AgentTestSuite) TestGetVersion(t *C) {
 	t.Check(version.Running, Equals, agent.VERSION)
 }
 
+func (s *AgentTestSuite) TestCapabilities(t *C) {
+	s.services["mm"].Caps = []string{"monitor:mysql", "monitor:server"}
+	defer func() { s.services["mm"].Caps = nil }()
+
+	cmd := &proto.Cmd{
+		Ts:      time.Now(),
+		User:    "daniel",
+		Cmd:     "Capabilities",
+		Service: "agent",
+	}
+	s.sendChan <- cmd
+
+	got := test.WaitReply(s.recvChan)
+	t.Assert(len(got), Equals, 1)
+	t.Assert(got[0].Error, Equals, "")
+	caps := &agent.Capabilities{}
+	err := json.Unmarshal(got[0].Data, caps)
+	t.Assert(err, IsNil)
+	t.Check(caps.Version, Equals, agent.VERSION)
+	t.Check(caps.OS, Equals, runtime.GOOS)
+	t.Check(caps.Protocols, DeepEquals, pct.ProtocolVersions)
+	t.Check(caps.DataContentTypes, DeepEquals, pct.DataContentTypes)
+	t.Check(caps.Services["mm"], DeepEquals, []string{"monitor:mysql", "monitor:server"})
+	t.Check(caps.Services["qan"], HasLen, 0)
+	t.Check(caps.Features, NotNil)
+}
+
 func (s *AgentTestSuite) TestSetConfigApiKey(t *C) {
 	newConfig := *s.config
 	newConfig.ApiKey = "101"
@@ -761,6 +811,7 @@ func (s *AgentTestSuite) TestKeepalive(t *C) {
 		t.Fatal("No Pong recieved")
 	}
 	t.Check(reply[0].Cmd, Equals, "Pong")
+	t.Check(reply[0].Data, HasLen, 0)
 
 	// Disconnect and keepalives should stop.
 	connectChan := make(chan bool)
@@ -783,66 +834,667 @@ func (s *AgentTestSuite) TestKeepalive(t *C) {
 	t.Check(reply[0].Cmd, Equals, "Pong")
 }
 
-func (s *AgentTestSuite) TestRestart(t *C) {
-	// Stop the default agnet.  We need our own to check its return value.
-	s.TearDownTest(t)
+func (s *AgentTestSuite) TestCmdToService(t *C) {
+	cmd := &proto.Cmd{
+		Service: "mm",
+		Cmd:     "Hello",
+	}
+	s.sendChan <- cmd
 
-	cmdFactory := &mock.CmdFactory{}
-	pctCmd.Factory = cmdFactory
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	t.Check(reply[0].Cmd, Equals, "Hello")
 
-	defer func() {
-		os.Remove(pct.Basedir.File("start-lock"))
-		os.Remove(pct.Basedir.File("start-script"))
-	}()
+	t.Assert(s.services["mm"].Cmds, HasLen, 1)
+	t.Check(s.services["mm"].Cmds[0].Cmd, Equals, "Hello")
+}
 
-	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap)
-	doneChan := make(chan error, 1)
-	go func() {
-		doneChan <- newAgent.Run()
-	}()
+func (s *AgentTestSuite) TestCmdHistory(t *C) {
+	// Two cmds: one succeeds, one fails.
+	s.sendChan <- &proto.Cmd{
+		Id:      1,
+		User:    "daniel",
+		Service: "mm",
+		Cmd:     "Hello",
+		Data:    []byte(`{"DSN":"user:pass@tcp(db1:3306)/"}`),
+	}
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
 
-	cmd := &proto.Cmd{
+	s.sendChan <- &proto.Cmd{
+		Id:      2,
+		User:    "daniel",
 		Service: "agent",
-		Cmd:     "Restart",
+		Cmd:     "Foo",
 	}
-	s.sendChan <- cmd
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+
+	// History cmds aren't kept in the history.
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "History"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Assert(reply[0].Error, Equals, "")
+	history := []agent.CmdHistoryEntry{}
+	err := json.Unmarshal(reply[0].Data, &history)
+	t.Assert(err, IsNil)
+	t.Assert(history, HasLen, 2)
+
+	t.Check(history[0].Id, Equals, uint(1))
+	t.Check(history[0].User, Equals, "daniel")
+	t.Check(history[0].Service, Equals, "mm")
+	t.Check(history[0].Cmd, Equals, "Hello")
+	t.Check(history[0].Data, Equals, `{"DSN":"user:`+pct.HIDDEN_PASSWORD+`@tcp(db1:3306)/"}`)
+	t.Check(history[0].Status, Equals, agent.CMD_OK)
+	t.Check(history[0].Replied.IsZero(), Equals, false)
+
+	t.Check(history[1].Cmd, Equals, "Foo")
+	t.Check(history[1].Status, Equals, agent.CMD_ERROR)
+	t.Check(history[1].Error, Equals, "Unknown command: Foo")
+
+	// Only one cmd.
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "History", Data: []byte("Hello")}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	history = []agent.CmdHistoryEntry{}
+	err = json.Unmarshal(reply[0].Data, &history)
+	t.Assert(err, IsNil)
+	t.Assert(history, HasLen, 1)
+	t.Check(history[0].Cmd, Equals, "Hello")
 
-	replies := test.WaitReply(s.recvChan)
-	t.Assert(replies, HasLen, 1)
-	t.Check(replies[0].Error, Equals, "")
+	// Agent status shows the last cmd.
+	status := s.agent.Status()
+	t.Check(strings.HasPrefix(status["agent-cmd-last"], "agent Foo at "), Equals, true)
+	t.Check(strings.HasSuffix(status["agent-cmd-last"], ": Error: Unknown command: Foo"), Equals, true)
+}
 
-	var err error
-	select {
-	case err = <-doneChan:
-	case <-time.After(2 * time.Second):
-		t.Fatal("Agent did not restart")
+func (s *AgentTestSuite) TestGetCmdHistory(t *C) {
+	// Rotate every write and keep 5 old files, so the audit log has only
+	// the last 6 lines: received and replied lines for the last 3 cmds.
+	auditFile := filepath.Join(s.tmpDir, agent.CMD_AUDIT_FILE)
+	defer func() {
+		files, _ := filepath.Glob(auditFile + "*")
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s.agent.SetCmdAuditLog(agent.NewCmdAuditLog(s.logger, auditFile, 1, 5))
+
+	for i := 1; i <= 4; i++ {
+		s.sendChan <- &proto.Cmd{
+			Id:        uint(i),
+			User:      "daniel",
+			AgentUuid: "123",
+			Service:   "mm",
+			Cmd:       "Hello",
+		}
+		reply := test.WaitReply(s.recvChan)
+		t.Assert(reply, HasLen, 1)
 	}
+	t.Check(test.FileExists(auditFile+".5"), Equals, true)
+	t.Check(test.FileExists(auditFile+".6"), Equals, false)
 
-	// Agent should return without an error.
-	t.Check(err, IsNil)
+	// The received line of the GetCmdHistory cmd rotates out the received
+	// line of cmd 2, but its replied line is still returned.
+	s.sendChan <- &proto.Cmd{Id: 5, Service: "agent", Cmd: "GetCmdHistory", Data: []byte(`{"Service":"mm"}`)}
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Assert(reply[0].Error, Equals, "")
+	history := []agent.CmdHistoryEntry{}
+	err := json.Unmarshal(reply[0].Data, &history)
+	t.Assert(err, IsNil)
+	t.Assert(history, HasLen, 3)
+	t.Check(history[0].Id, Equals, uint(2))
+	t.Check(history[0].Status, Equals, agent.CMD_OK)
+	t.Check(history[2].Id, Equals, uint(4))
+	t.Check(history[2].User, Equals, "daniel")
+	t.Check(history[2].AgentUuid, Equals, "123")
+	t.Check(history[2].Status, Equals, agent.CMD_OK)
+
+	// The GetCmdHistory cmds are audited, too.  The one being handled has
+	// been received but not replied to, so it's still running.
+	s.sendChan <- &proto.Cmd{Id: 6, Service: "agent", Cmd: "GetCmdHistory", Data: []byte(`{"Limit":2}`)}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Assert(reply[0].Error, Equals, "")
+	history = []agent.CmdHistoryEntry{}
+	err = json.Unmarshal(reply[0].Data, &history)
+	t.Assert(err, IsNil)
+	t.Assert(history, HasLen, 2)
+	t.Check(history[0].Id, Equals, uint(5))
+	t.Check(history[0].Cmd, Equals, "GetCmdHistory")
+	t.Check(history[0].Status, Equals, agent.CMD_OK)
+	t.Check(history[1].Id, Equals, uint(6))
+	t.Check(history[1].Status, Equals, agent.CMD_RUNNING)
+
+	// Status cmds aren't kept in the history, but they're audited.
+	s.agent.SetCmdAuditLog(agent.NewCmdAuditLog(s.logger, auditFile, agent.CMD_AUDIT_FILE_SIZE, 1))
+	s.sendChan <- &proto.Cmd{Id: 7, Service: "agent", Cmd: "Status"}
+	test.WaitStatusReply(s.recvChan)
+	s.sendChan <- &proto.Cmd{Id: 8, Service: "agent", Cmd: "GetCmdHistory", Data: []byte(`{"Cmd":"Status"}`)}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Assert(reply[0].Error, Equals, "")
+	history = []agent.CmdHistoryEntry{}
+	err = json.Unmarshal(reply[0].Data, &history)
+	t.Assert(err, IsNil)
+	t.Assert(history, HasLen, 1)
+	t.Check(history[0].Id, Equals, uint(7))
+	t.Check(history[0].Status, Equals, agent.CMD_OK)
+	t.Check(history[0].Reply, Equals, "")
+}
 
-	// Agent should create the start-lock file and start-script.
-	t.Check(pct.FileExists(pct.Basedir.File("start-lock")), Equals, true)
-	t.Check(pct.FileExists(pct.Basedir.File("start-script")), Equals, true)
+type instanceGroups struct {
+	*mock.MockServiceManager
+	members map[string][]uint
+}
 
-	// Agent should make a command to run the start-script.
-	t.Assert(cmdFactory.Cmds, HasLen, 1)
-	t.Check(cmdFactory.Cmds[0].Name, Equals, pct.Basedir.File("start-script"))
-	t.Check(cmdFactory.Cmds[0].Args, IsNil)
+func (g *instanceGroups) Members(group string) (string, []uint, error) {
+	ids, ok := g.members[group]
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown group: %s", group)
+	}
+	return "mysql", ids, nil
 }
 
-func (s *AgentTestSuite) TestCmdToService(t *C) {
-	cmd := &proto.Cmd{
-		Service: "mm",
-		Cmd:     "Hello",
+func (s *AgentTestSuite) TestGroupCmd(t *C) {
+	readyChan := make(chan bool, 1)
+	readyChan <- true // Stop() immediately in TearDownTest
+	s.servicesMap["instance"] = &instanceGroups{
+		MockServiceManager: mock.NewMockServiceManager("instance", readyChan, s.traceChan),
+		members: map[string][]uint{
+			"cluster-x-replicas": []uint{2, 3},
+			"empty":              []uint{},
+		},
 	}
-	s.sendChan <- cmd
 
+	data, _ := json.Marshal(agent.GroupCmd{
+		Group: "cluster-x-replicas",
+		Cmd: proto.Cmd{
+			Service: "mm",
+			Cmd:     "StartService",
+			Data:    []byte(`{"Service":"mysql","InstanceId":0,"Collect":1,"Report":60}`),
+		},
+	})
+	s.sendChan <- &proto.Cmd{Id: 1, User: "daniel", Service: "agent", Cmd: "GroupCmd", Data: data}
 	reply := test.WaitReply(s.recvChan)
 	t.Assert(reply, HasLen, 1)
 	t.Check(reply[0].Error, Equals, "")
-	t.Check(reply[0].Cmd, Equals, "Hello")
+	got := []agent.GroupReply{}
+	err := json.Unmarshal(reply[0].Data, &got)
+	t.Assert(err, IsNil)
+	t.Assert(got, HasLen, 2)
+	t.Check(got[0].InstanceId, Equals, uint(2))
+	t.Check(got[0].Error, Equals, "")
+	t.Check(got[1].InstanceId, Equals, uint(3))
+
+	// The cmd is run once per instance, its config set to the instance.
+	cmds := s.services["mm"].Cmds
+	t.Assert(cmds, HasLen, 2)
+	for i, id := range []uint{2, 3} {
+		t.Check(cmds[i].Id, Equals, uint(1))
+		t.Check(cmds[i].User, Equals, "daniel")
+		t.Check(cmds[i].Cmd, Equals, "StartService")
+		config := map[string]interface{}{}
+		err := json.Unmarshal(cmds[i].Data, &config)
+		t.Assert(err, IsNil)
+		t.Check(config["Service"], Equals, "mysql")
+		t.Check(config["InstanceId"], Equals, float64(id))
+		t.Check(config["Collect"], Equals, float64(1))
+		t.Check(config["Report"], Equals, float64(60))
+	}
+
+	// No members, no cmds.
+	data, _ = json.Marshal(agent.GroupCmd{Group: "empty", Cmd: proto.Cmd{Service: "mm", Cmd: "StopService"}})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "GroupCmd", Data: data}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	t.Check(s.services["mm"].Cmds, HasLen, 2)
 
-	t.Assert(s.services["mm"].Cmds, HasLen, 1)
-	t.Check(s.services["mm"].Cmds[0].Cmd, Equals, "Hello")
+	// Unknown group and agent cmds are errors.
+	data, _ = json.Marshal(agent.GroupCmd{Group: "foo", Cmd: proto.Cmd{Service: "mm", Cmd: "StopService"}})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "GroupCmd", Data: data}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "Unknown group: foo")
+
+	data, _ = json.Marshal(agent.GroupCmd{Group: "empty", Cmd: proto.Cmd{Service: "agent", Cmd: "Restart"}})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "GroupCmd", Data: data}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Not(Equals), "")
+}
+
+type reloader struct {
+	*mock.MockServiceManager
+	reloaded bool
+	errs     []error
+}
+
+func (r *reloader) Reload() []error {
+	r.reloaded = true
+	return r.errs
+}
+
+func (s *AgentTestSuite) TestReload(t *C) {
+	readyChan := make(chan bool, 2)
+	readyChan <- true // Stop() immediately in TearDownTest
+	readyChan <- true
+	log := &reloader{MockServiceManager: mock.NewMockServiceManager("log", readyChan, s.traceChan)}
+	data := &reloader{
+		MockServiceManager: mock.NewMockServiceManager("data", readyChan, s.traceChan),
+		errs:               []error{fmt.Errorf("Invalid config")},
+	}
+	s.servicesMap["log"] = log
+	s.servicesMap["data"] = data
+
+	// Only services that implement pct.ConfigReloader are reloaded; the
+	// mock mm and qan managers don't.
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Reload"}
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "data: Invalid config")
+	got := []string{}
+	err := json.Unmarshal(reply[0].Data, &got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []string{"data", "log"})
+	t.Check(log.reloaded, Equals, true)
+	t.Check(data.reloaded, Equals, true)
+	t.Check(s.services["mm"].Cmds, HasLen, 0)
+}
+
+func (s *AgentTestSuite) TestReloadPaused(t *C) {
+	readyChan := make(chan bool, 3)
+	readyChan <- true // Stop() by Pause
+	readyChan <- true // Start() by Resume
+	readyChan <- true // Stop() in TearDownTest
+	sysconfig := &reloader{MockServiceManager: mock.NewMockServiceManager("sysconfig", readyChan, s.traceChan)}
+	s.servicesMap["sysconfig"] = sysconfig
+
+	s.readyChan <- true
+	s.readyChan <- true
+	data, _ := json.Marshal(agent.Pause{Duration: 3600})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Pause", Data: data}
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+
+	// A paused service isn't reloaded, else its tools would be started.
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Reload"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	got := []string{}
+	err := json.Unmarshal(reply[0].Data, &got)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 0)
+	t.Check(sysconfig.reloaded, Equals, false)
+
+	// It's reloaded once resumed.
+	s.readyChan <- true
+	s.readyChan <- true
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Resume"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Reload"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	got = []string{}
+	err = json.Unmarshal(reply[0].Data, &got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []string{"sysconfig"})
+	t.Check(sysconfig.reloaded, Equals, true)
+	test.DrainTraceChan(s.traceChan)
+}
+
+func (s *AgentTestSuite) TestPause(t *C) {
+	// Invalid durations.
+	for _, d := range []uint{0, 86401} {
+		data, _ := json.Marshal(agent.Pause{Duration: d})
+		s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Pause", Data: data}
+		reply := test.WaitReply(s.recvChan)
+		t.Assert(reply, HasLen, 1)
+		t.Check(reply[0].Error, Matches, "Invalid pause duration.*")
+	}
+
+	// Pause stops mm and qan (the agent has no sysconfig).
+	s.readyChan <- true
+	s.readyChan <- true
+	data, _ := json.Marshal(agent.Pause{Duration: 3600})
+	s.sendChan <- &proto.Cmd{User: "daniel", Service: "agent", Cmd: "Pause", Data: data}
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	got := []string{}
+	err := json.Unmarshal(reply[0].Data, &got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []string{"mm", "qan"})
+	t.Check(s.services["mm"].IsRunningVal, Equals, false)
+	t.Check(s.agent.Status()["agent-pause"], Matches, "Paused mm, qan until .+ by daniel")
+
+	// Paused tools can't be started.
+	s.sendChan <- &proto.Cmd{Service: "mm", Cmd: "StartService", Data: []byte("{}")}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Matches, "mm service is paused until .+")
+	t.Check(s.services["mm"].Cmds, HasLen, 0)
+
+	// Resume starts them again.
+	s.readyChan <- true
+	s.readyChan <- true
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Resume"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	t.Check(s.services["mm"].IsRunningVal, Equals, true)
+	t.Check(s.agent.Status()["agent-pause"], Equals, "")
+	test.DrainTraceChan(s.traceChan)
+
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Resume"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "Agent is not paused")
+
+	// Pauses are bounded: tools are resumed automatically.
+	s.readyChan <- true
+	s.readyChan <- true
+	data, _ = json.Marshal(agent.Pause{Duration: 1})
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Pause", Data: data}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Check(reply[0].Error, Equals, "")
+	s.readyChan <- true
+	s.readyChan <- true
+	for i := 0; i < 30 && s.agent.Status()["agent-pause"] != ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Check(s.agent.Status()["agent-pause"], Equals, "")
+	t.Check(s.services["mm"].IsRunningVal, Equals, true)
+	test.DrainTraceChan(s.traceChan)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Admin server test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type AdminTestSuite struct {
+	tmpDir    string
+	logger    *pct.Logger
+	agent     *agent.Agent
+	mm        *mock.MockServiceManager
+	client    *mock.WebsocketClient
+	sendChan  chan *proto.Cmd
+	recvChan  chan *proto.Reply
+	readyChan chan bool
+	traceChan chan string
+}
+
+// mockInstances is an instance manager that implements agent.InstanceLister.
+type mockInstances struct {
+	*mock.MockServiceManager
+	instances map[string]*json.RawMessage
+}
+
+func (m *mockInstances) Instances() map[string]*json.RawMessage {
+	return m.instances
+}
+
+func rawJSON(s string) *json.RawMessage {
+	raw := json.RawMessage(s)
+	return &raw
+}
+
+var _ = Suite(&AdminTestSuite{})
+
+func (s *AdminTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test")
+	t.Assert(err, IsNil)
+
+	s.logger = pct.NewLogger(make(chan *proto.LogEntry, 100), "admin-test")
+
+	s.sendChan = make(chan *proto.Cmd, 5)
+	s.recvChan = make(chan *proto.Reply, 5)
+	s.client = mock.NewWebsocketClient(s.sendChan, s.recvChan, nil, nil)
+
+	// Status() sends to traceChan, Stop() waits for readyChan.
+	s.readyChan = make(chan bool, 1)
+	s.traceChan = make(chan string, 100)
+	s.mm = mock.NewMockServiceManager("mm", s.readyChan, s.traceChan)
+	services := map[string]pct.ServiceManager{
+		"mm": s.mm,
+	}
+	config := &agent.Config{AgentUuid: "abc-123-def", Keepalive: 3600}
+	s.agent = agent.NewAgent(config, s.logger, nil, s.client, services)
+}
+
+func (s *AdminTestSuite) TearDownTest(t *C) {
+	test.DrainTraceChan(s.traceChan)
+	test.DrainTraceChan(s.client.TraceChan)
+}
+
+func (s *AdminTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *AdminTestSuite) get(h http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func (s *AdminTestSuite) post(h http.Handler, path string, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "http://localhost"+path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func (s *AdminTestSuite) TestParseAdminAddr(t *C) {
+	valid := map[string][2]string{
+		"unix:/var/run/agent.sock": {"unix", "/var/run/agent.sock"},
+		"localhost:9001":           {"tcp", "localhost:9001"},
+		"127.0.0.1:9001":           {"tcp", "127.0.0.1:9001"},
+		"[::1]:9001":               {"tcp", "[::1]:9001"},
+	}
+	for addr, expect := range valid {
+		network, address, err := agent.ParseAdminAddr(addr)
+		t.Check(err, IsNil, Commentf(addr))
+		t.Check(network, Equals, expect[0], Commentf(addr))
+		t.Check(address, Equals, expect[1], Commentf(addr))
+	}
+	for _, addr := range []string{"", "unix:", "9001", ":9001", "0.0.0.0:9001", "10.1.1.1:9001", "db1:9001"} {
+		_, _, err := agent.ParseAdminAddr(addr)
+		t.Check(err, NotNil, Commentf(addr))
+	}
+}
+
+func (s *AdminTestSuite) TestHandler(t *C) {
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{})
+	t.Assert(err, IsNil)
+	h := agent.NewAdmin(s.agent, auth, s.logger).Handler()
+
+	// /status is the same as the Status cmd: the agent and all services.
+	w := s.get(h, "/status", nil)
+	t.Assert(w.Code, Equals, http.StatusOK)
+	t.Check(w.Header().Get("Content-Type"), Equals, "application/json")
+	status := map[string]string{}
+	t.Assert(json.Unmarshal(w.Body.Bytes(), &status), IsNil)
+	_, ok := status["agent"]
+	t.Check(ok, Equals, true)
+	_, ok = status["mm"]
+	t.Check(ok, Equals, true)
+
+	w = s.get(h, "/status/mm", nil)
+	t.Assert(w.Code, Equals, http.StatusOK)
+	status = map[string]string{}
+	t.Assert(json.Unmarshal(w.Body.Bytes(), &status), IsNil)
+	_, ok = status["mm"]
+	t.Check(ok, Equals, true)
+	_, ok = status["agent"]
+	t.Check(ok, Equals, false)
+
+	w = s.get(h, "/status/foo", nil)
+	t.Check(w.Code, Equals, http.StatusNotFound)
+
+	// /configs is the same as the GetAllConfigs cmd.
+	w = s.get(h, "/configs", nil)
+	t.Assert(w.Code, Equals, http.StatusOK)
+	configs := agent.AdminConfigs{}
+	t.Assert(json.Unmarshal(w.Body.Bytes(), &configs), IsNil)
+	t.Check(configs.Errors, HasLen, 0)
+	services := []string{}
+	for _, config := range configs.Configs {
+		services = append(services, config.InternalService)
+	}
+	sort.Strings(services)
+	t.Check(services, DeepEquals, []string{"agent", "mm"})
+
+	w = s.get(h, "/debug/pprof/goroutine?debug=1", nil)
+	t.Check(w.Code, Equals, http.StatusOK)
+	t.Check(strings.Contains(w.Body.String(), "goroutine profile"), Equals, true)
+}
+
+func (s *AdminTestSuite) TestToken(t *C) {
+	tokenFile := filepath.Join(s.tmpDir, "token")
+	err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600)
+	t.Assert(err, IsNil)
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{TokenFile: tokenFile})
+	t.Assert(err, IsNil)
+	h := agent.NewAdmin(s.agent, auth, s.logger).Handler()
+
+	w := s.get(h, "/status", nil)
+	t.Check(w.Code, Equals, http.StatusUnauthorized)
+	w = s.get(h, "/debug/pprof/", map[string]string{"Authorization": "Bearer wrong"})
+	t.Check(w.Code, Equals, http.StatusUnauthorized)
+	w = s.get(h, "/status", map[string]string{"Authorization": "Bearer secret"})
+	t.Check(w.Code, Equals, http.StatusOK)
+}
+
+func (s *AdminTestSuite) TestUnixSocket(t *C) {
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{})
+	t.Assert(err, IsNil)
+	admin := agent.NewAdmin(s.agent, auth, s.logger)
+
+	socket := filepath.Join(s.tmpDir, "admin.sock")
+	err = admin.Start("unix:" + socket)
+	t.Assert(err, IsNil)
+	err = admin.Start("unix:" + socket)
+	t.Check(err, FitsTypeOf, pct.ServiceIsRunningError{})
+
+	info, err := os.Stat(socket)
+	t.Assert(err, IsNil)
+	t.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://admin/status/agent")
+	t.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(strings.Contains(string(body), `"agent":`), Equals, true)
+
+	err = admin.Stop()
+	t.Check(err, IsNil)
+	t.Check(pct.FileExists(socket), Equals, false)
+	err = admin.Stop()
+	t.Check(err, IsNil)
+}
+
+func (s *AdminTestSuite) TestInstances(t *C) {
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{})
+	t.Assert(err, IsNil)
+
+	// The instance manager must implement agent.InstanceLister.
+	h := agent.NewAdmin(s.agent, auth, s.logger).Handler()
+	w := s.get(h, "/instances", nil)
+	t.Check(w.Code, Equals, http.StatusNotImplemented)
+
+	services := map[string]pct.ServiceManager{
+		"instance": &mockInstances{
+			MockServiceManager: mock.NewMockServiceManager("instance", nil, s.traceChan),
+			instances: map[string]*json.RawMessage{
+				"server-1": rawJSON(`{"Hostname":"db1"}`),
+				"mysql-1":  rawJSON(`{"Hostname":"db1","DSN":"percona:secret@tcp(127.0.0.1:3306)/"}`),
+			},
+		},
+	}
+	a := agent.NewAgent(&agent.Config{}, s.logger, nil, s.client, services)
+	h = agent.NewAdmin(a, auth, s.logger).Handler()
+	w = s.get(h, "/instances", nil)
+	t.Assert(w.Code, Equals, http.StatusOK)
+	t.Check(strings.Contains(w.Body.String(), "secret"), Equals, false)
+	instances := map[string]map[string]string{}
+	t.Assert(json.Unmarshal(w.Body.Bytes(), &instances), IsNil)
+	t.Check(instances, HasLen, 2)
+	t.Check(instances["server-1"]["Hostname"], Equals, "db1")
+	t.Check(instances["mysql-1"]["DSN"], Equals, "percona:"+pct.HIDDEN_PASSWORD+"@tcp(127.0.0.1:3306)/")
+}
+
+func (s *AdminTestSuite) TestCmd(t *C) {
+	// Local cmds are handled by the agent's cmd handler, so run the agent.
+	doneChan := make(chan bool, 1)
+	go func() {
+		s.agent.Run()
+		doneChan <- true
+	}()
+	defer func() {
+		s.readyChan <- true                   // mm.Stop() immediately
+		s.sendChan <- &proto.Cmd{Cmd: "Stop"} // tell agent to stop itself
+		select {
+		case <-doneChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Agent didn't respond to Stop cmd")
+		}
+	}()
+
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{})
+	t.Assert(err, IsNil)
+	h := agent.NewAdmin(s.agent, auth, s.logger).Handler()
+
+	w := s.get(h, "/cmd", nil)
+	t.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+	w = s.post(h, "/cmd", "{bad json")
+	t.Check(w.Code, Equals, http.StatusBadRequest)
+
+	// Cmds for services are handled by their manager.
+	w = s.post(h, "/cmd", `{"User":"root (percona-agent CLI)","Service":"mm","Cmd":"GetConfig"}`)
+	t.Assert(w.Code, Equals, http.StatusOK)
+	reply := &proto.Reply{}
+	t.Assert(json.Unmarshal(w.Body.Bytes(), reply), IsNil)
+	t.Check(reply.Cmd, Equals, "GetConfig")
+	t.Check(reply.Error, Equals, "")
+	t.Assert(s.mm.Cmds, HasLen, 1)
+	t.Check(s.mm.Cmds[0].User, Equals, "root (percona-agent CLI)")
+	t.Check(s.mm.Cmds[0].AgentUuid, Equals, "abc-123-def")
+	t.Check(s.mm.Cmds[0].Ts.IsZero(), Equals, false)
+
+	// Errors are in the reply, like cmds from the API.
+	w = s.post(h, "/cmd", `{"Service":"foo","Cmd":"GetConfig"}`)
+	t.Assert(w.Code, Equals, http.StatusOK)
+	reply = &proto.Reply{}
+	t.Assert(json.Unmarshal(w.Body.Bytes(), reply), IsNil)
+	t.Check(reply.Error, Not(Equals), "")
+
+	// Local cmds aren't sent to the API.
+	select {
+	case reply := <-s.recvChan:
+		t.Errorf("Reply sent to API: %+v", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
 }
@@ -0,0 +1,249 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	CMD_AUDIT_FILE      = "cmd-audit.log"
+	CMD_AUDIT_FILE_SIZE = 10 * 1024 * 1024 // bytes, rotated when larger
+	CMD_AUDIT_FILES     = 5                // rotated files to keep: .1 (newest) to .5
+)
+
+/**
+ * CmdAuditLog is the append-only local log of every cmd the agent handled,
+ * one JSON CmdHistoryEntry per line: a CMD_RUNNING entry when the cmd is
+ * received, then the full entry when it's replied to.  Read merges the two,
+ * so a cmd that never replied, e.g. because it crashed the agent, is
+ * returned as CMD_RUNNING.  Unlike CmdHistory, which is in memory and lost on restart, it answers
+ * "what remote cmds modified this agent?" for security reviews, so it has
+ * who sent the cmd (User and AgentUuid from the cmd), the reply status, and
+ * the duration.  Cmd and reply data is truncated and redacted like in the
+ * history.  When the file is larger than its max size, it's rotated like
+ * logrotate: file.1 is the newest old file, and the oldest is removed.
+ * Agent cmd GetCmdHistory queries it (see CmdHistoryQuery).
+ */
+type CmdAuditLog struct {
+	logger   *pct.Logger
+	file     string
+	maxSize  int64
+	maxFiles int
+	mux      *sync.Mutex
+}
+
+// A CmdHistoryQuery is the optional data of agent cmd GetCmdHistory.  Zero
+// values match all entries.
+type CmdHistoryQuery struct {
+	Since   time.Time // entries received at or after
+	User    string
+	Service string
+	Cmd     string
+	Limit   int // newest entries to return, default CMD_HISTORY_SIZE
+}
+
+func NewCmdAuditLog(logger *pct.Logger, file string, maxSize int64, maxFiles int) *CmdAuditLog {
+	l := &CmdAuditLog{
+		logger:   logger,
+		file:     file,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		mux:      &sync.Mutex{},
+	}
+	return l
+}
+
+// Write appends the entry to the log, rotating it first if needed.  Errors
+// are logged, too, because the history can't return them to the cmd sender.
+func (l *CmdAuditLog) Write(e CmdHistoryEntry) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	err := l.write(e)
+	if err != nil {
+		l.logger.Error(fmt.Sprintf("Cannot write cmd %d (%s %s) to %s: %s", e.Id, e.Service, e.Cmd, l.file, err))
+	}
+	return err
+}
+
+// Read returns entries matching the query, oldest first.  Lines that aren't
+// valid JSON, e.g. if the agent crashed while writing, are skipped.
+func (l *CmdAuditLog) Read(q CmdHistoryQuery) ([]CmdHistoryEntry, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = CMD_HISTORY_SIZE
+	}
+
+	// Open the files, oldest first, while they can't be rotated, then read
+	// them without the lock so reading doesn't block writing.  Open files
+	// are still read if they're rotated.
+	files := []*os.File{}
+	defer func() {
+		for _, fh := range files {
+			fh.Close()
+		}
+	}()
+	l.mux.Lock()
+	for n := l.maxFiles; n >= 0; n-- {
+		fh, err := os.Open(l.rotatedFile(n))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			l.mux.Unlock()
+			return nil, err
+		}
+		files = append(files, fh)
+	}
+	l.mux.Unlock()
+
+	// Replied entries replace their received entry, which is found by the
+	// cmd id and when it was received.  Entries that fall off the limit are
+	// dropped, so index is offset by the number dropped.
+	type key struct {
+		id       uint
+		received int64 // UnixNano
+	}
+	entries := []CmdHistoryEntry{}
+	index := make(map[key]int)
+	dropped := 0
+	for _, fh := range files {
+		r := bufio.NewReader(fh)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			var e CmdHistoryEntry
+			if json.Unmarshal(line, &e) == nil && q.match(e) {
+				k := key{e.Id, e.Received.UnixNano()}
+				if i, ok := index[k]; ok && i >= dropped {
+					entries[i-dropped] = e
+					delete(index, k)
+				} else {
+					if e.Status == CMD_RUNNING {
+						index[k] = dropped + len(entries)
+					}
+					entries = append(entries, e)
+					if len(entries) > limit {
+						entries = entries[1:]
+						dropped++
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (q CmdHistoryQuery) match(e CmdHistoryEntry) bool {
+	if !q.Since.IsZero() && e.Received.Before(q.Since) {
+		return false
+	}
+	if q.User != "" && e.User != q.User {
+		return false
+	}
+	if q.Service != "" && e.Service != q.Service {
+		return false
+	}
+	if q.Cmd != "" && e.Cmd != q.Cmd {
+		return false
+	}
+	return true
+}
+
+func (l *CmdAuditLog) write(e CmdHistoryEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if fi, err := os.Stat(l.file); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	fh, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(line); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+func (l *CmdAuditLog) rotate() error {
+	if err := os.Remove(l.rotatedFile(l.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := l.maxFiles - 1; n >= 0; n-- {
+		if err := os.Rename(l.rotatedFile(n), l.rotatedFile(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatedFile returns the name of the nth rotated file, or the current file
+// if n is zero.
+func (l *CmdAuditLog) rotatedFile(n int) string {
+	if n == 0 {
+		return l.file
+	}
+	return fmt.Sprintf("%s.%d", l.file, n)
+}
+
+// SetCmdAuditLog sets the log to which every cmd is written and from which
+// cmd GetCmdHistory reads.
+func (agent *Agent) SetCmdAuditLog(audit *CmdAuditLog) {
+	agent.history.SetAuditLog(audit)
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleGetCmdHistory(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "GetCmdHistory", cmd)
+	audit := agent.history.AuditLog()
+	if audit == nil {
+		return nil, []error{fmt.Errorf("Cmd audit log is not enabled")}
+	}
+	q := CmdHistoryQuery{}
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &q); err != nil {
+			return nil, []error{err}
+		}
+	}
+	entries, err := audit.Read(q)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return entries, nil
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"runtime"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Capabilities is the reply data of agent cmd Capabilities: what this agent
+// build and host can do, so the API can offer only configs the agent accepts.
+type Capabilities struct {
+	Version          string
+	Revision         string
+	OS               string              // runtime.GOOS
+	Arch             string              // runtime.GOARCH
+	GoVersion        string              // runtime.Version()
+	Protocols        []int               // pct.ProtocolVersions
+	Protocol         int                 // negotiated, 0 if not connected
+	DataContentTypes []string            // pct.DataContentTypes
+	Services         map[string][]string // keyed on service, see pct.CapabilityReporter
+	Features         []string            // see pct.RegisterFeature
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleCapabilities(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Capabilities", cmd)
+	c := &Capabilities{
+		Version:          VERSION + REL,
+		Revision:         REVISION,
+		OS:               runtime.GOOS,
+		Arch:             runtime.GOARCH,
+		GoVersion:        runtime.Version(),
+		Protocols:        pct.ProtocolVersions,
+		DataContentTypes: pct.DataContentTypes,
+		Services:         make(map[string][]string),
+		Features:         pct.Features(),
+	}
+	if agent.api != nil {
+		c.Protocol = agent.api.ProtocolVersion()
+	}
+	for service, manager := range agent.services {
+		caps := []string{}
+		if r, ok := manager.(pct.CapabilityReporter); ok {
+			caps = r.Capabilities()
+		}
+		c.Services[service] = caps
+	}
+	return c, nil
+}
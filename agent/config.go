@@ -17,6 +17,10 @@
 
 package agent
 
+import (
+	"github.com/percona/percona-agent/pct"
+)
+
 const (
 	DEFAULT_API_HOSTNAME = "cloud-api.percona.com"
 	DEFAULT_KEEPALIVE    = 76
@@ -30,4 +34,6 @@ type Config struct {
 	Keepalive   uint
 	Links       map[string]string `json:",omitempty"`
 	PidFile     string
+	LocalAuth   *pct.LocalAuthConfig `json:",omitempty"` // local endpoints, see pct/localauth.go
+	Admin       string               `json:",omitempty"` // local admin server: unix:<socket> or localhost:<port>, see admin.go
 }
@@ -0,0 +1,105 @@
+// +build !noexec
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	pctCmd "github.com/percona/percona-agent/pct/cmd"
+)
+
+// REMOTE_EXEC is false in agents built with tag noexec, which refuse cmds that
+// run programs (Restart and Update), see noexec.go.  Everything that runs
+// programs is in this file so noexec agents don't have the code at all.
+const REMOTE_EXEC = true
+
+func init() {
+	pct.RegisterFeature("remote-exec")
+}
+
+// restart starts a new agent which waits for this one to exit, and replies
+// to the cmd.  It returns false if the new agent wasn't started.
+// Run:@goroutine[0]
+func (agent *Agent) restart(cmd *proto.Cmd) bool {
+	// Secure the start-lock file.  This lets us start our self but
+	// wait until this process has exited, at which time the start-lock
+	// is removed and the 2nd self continues starting.
+	if err := pct.MakeStartLock(); err != nil {
+		agent.replyTo(cmd, cmd.Reply(nil, err))
+		return false
+	}
+
+	// Hand off tool state to the new agent so it resumes where we
+	// stop, e.g. QAN doesn't lose the current interval.
+	agent.handoff()
+
+	// Start our self with the same args this process was started with.
+	cwd, err := os.Getwd()
+	if err != nil {
+		agent.replyTo(cmd, cmd.Reply(nil, err))
+	}
+	comment := fmt.Sprintf(
+		"This script was created by percona-agent in response to this Restart command:\n"+
+			"# %s\n"+
+			"# It is safe to delete.", cmd)
+	sh := fmt.Sprintf("#!/bin/sh\n# %s\ncd %s\n%s %s >> %s/percona-agent.log 2>&1 &\n",
+		comment,
+		cwd,
+		os.Args[0],
+		strings.Join(os.Args[1:len(os.Args)], " "),
+		pct.Basedir.StatePath(),
+	)
+	startScript := pct.Basedir.File("start-script")
+	if err := ioutil.WriteFile(startScript, []byte(sh), os.FileMode(0754)); err != nil {
+		agent.replyTo(cmd, cmd.Reply(nil, err))
+	}
+	agent.logger.Debug("Restart:sh")
+	self := pctCmd.Factory.Make(startScript)
+	output, err := self.Run()
+	agent.replyTo(cmd, cmd.Reply(output, err))
+	return true
+}
+
+// installedVersion returns the version of the installed binary, which is
+// newer than the running version after an Update.
+func installedVersion(running string) (string, error) {
+	bin, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(bin, "-version").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// update replaces the installed binary with the given version, see pct.Updater.
+func (agent *Agent) update(version string) error {
+	updater := pct.NewUpdater(agent.logger, agent.api, pct.PublicKey, os.Args[0], VERSION)
+	return updater.Update(version)
+}
@@ -0,0 +1,84 @@
+// +build !noexec
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent_test
+
+import (
+	"os"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/pct"
+	pctCmd "github.com/percona/percona-agent/pct/cmd"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Tests of cmds that run programs, which agents built with tag noexec don't
+// have, see noexec_test.go.
+
+func (s *AgentTestSuite) TestRestart(t *C) {
+	// Stop the default agnet.  We need our own to check its return value.
+	s.TearDownTest(t)
+
+	cmdFactory := &mock.CmdFactory{}
+	pctCmd.Factory = cmdFactory
+
+	defer func() {
+		os.Remove(pct.Basedir.File("start-lock"))
+		os.Remove(pct.Basedir.File("start-script"))
+	}()
+
+	newAgent := agent.NewAgent(s.config, s.logger, s.api, s.client, s.servicesMap)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- newAgent.Run()
+	}()
+
+	cmd := &proto.Cmd{
+		Service: "agent",
+		Cmd:     "Restart",
+	}
+	s.sendChan <- cmd
+
+	replies := test.WaitReply(s.recvChan)
+	t.Assert(replies, HasLen, 1)
+	t.Check(replies[0].Error, Equals, "")
+
+	var err error
+	select {
+	case err = <-doneChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Agent did not restart")
+	}
+
+	// Agent should return without an error.
+	t.Check(err, IsNil)
+
+	// Agent should create the start-lock file and start-script.
+	t.Check(pct.FileExists(pct.Basedir.File("start-lock")), Equals, true)
+	t.Check(pct.FileExists(pct.Basedir.File("start-script")), Equals, true)
+
+	// Agent should make a command to run the start-script.
+	t.Assert(cmdFactory.Cmds, HasLen, 1)
+	t.Check(cmdFactory.Cmds[0].Name, Equals, pct.Basedir.File("start-script"))
+	t.Check(cmdFactory.Cmds[0].Args, IsNil)
+}
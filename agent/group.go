@@ -0,0 +1,125 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+// GroupCmd is the data of agent cmd GroupCmd: run Cmd once for every instance
+// in Group, e.g. qan StartService for all replicas of a cluster.  Cmd.Data is
+// an instance config (it has Service and InstanceId fields) which is copied and
+// set to each instance.
+type GroupCmd struct {
+	Group string
+	Cmd   proto.Cmd
+}
+
+// GroupReply is the reply of one instance of a GroupCmd.  The GroupCmd reply
+// data is a list of these, in instance ID order.
+type GroupReply struct {
+	InstanceId uint
+	Error      string          `json:",omitempty"`
+	Data       json.RawMessage `json:",omitempty"`
+}
+
+// InstanceGroups expands an instance group to its service and instance IDs.
+// The instance manager implements it; the agent can't import the instance
+// package because it imports this package.
+type InstanceGroups interface {
+	Members(group string) (string, []uint, error)
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleGroupCmd(cmd *proto.Cmd) (interface{}, error) {
+	agent.status.UpdateRe("agent-cmd-handler", "GroupCmd", cmd)
+	agent.logger.Info(cmd)
+
+	g := &GroupCmd{}
+	if err := json.Unmarshal(cmd.Data, g); err != nil {
+		return nil, err
+	}
+	if g.Cmd.Service == "agent" || g.Cmd.Cmd == "GroupCmd" {
+		return nil, errors.New("GroupCmd cannot run agent cmds")
+	}
+	m, ok := agent.services[g.Cmd.Service]
+	if !ok {
+		return nil, pct.UnknownServiceError{Service: g.Cmd.Service}
+	}
+	if err := agent.paused(g.Cmd.Service, g.Cmd.Cmd); err != nil {
+		return nil, err
+	}
+	groups, ok := agent.services["instance"].(InstanceGroups)
+	if !ok {
+		return nil, errors.New("Instance manager does not support groups")
+	}
+	service, ids, err := groups.Members(g.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := []GroupReply{}
+	for _, id := range ids {
+		r := GroupReply{InstanceId: id}
+		data, err := instanceData(g.Cmd.Data, service, id)
+		if err != nil {
+			r.Error = err.Error()
+			replies = append(replies, r)
+			continue
+		}
+		c := &proto.Cmd{
+			Id:        cmd.Id,
+			Ts:        cmd.Ts,
+			User:      cmd.User,
+			AgentUuid: cmd.AgentUuid,
+			Service:   g.Cmd.Service,
+			Cmd:       g.Cmd.Cmd,
+			Data:      data,
+		}
+		agent.status.UpdateRe("agent-cmd-handler", fmt.Sprintf("GroupCmd %s %s-%d", g.Group, service, id), c)
+		if reply := m.Handle(c); reply != nil {
+			r.Error = reply.Error
+			r.Data = reply.Data
+		}
+		replies = append(replies, r)
+	}
+	agent.logger.Info(fmt.Sprintf("Ran %s %s for %d instances in group %s",
+		g.Cmd.Service, g.Cmd.Cmd, len(ids), g.Group))
+	return replies, nil
+}
+
+// instanceData sets the Service and InstanceId fields of the JSON object data,
+// keeping all other fields as-is.
+func instanceData(data []byte, service string, id uint) ([]byte, error) {
+	fields := map[string]*json.RawMessage{} // pointers, see pct.Handoff
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+	}
+	serviceJSON, _ := json.Marshal(service)
+	idJSON, _ := json.Marshal(id)
+	fields["Service"] = (*json.RawMessage)(&serviceJSON)
+	fields["InstanceId"] = (*json.RawMessage)(&idJSON)
+	return json.Marshal(fields)
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	CMD_HISTORY_SIZE      = 100  // cmds
+	CMD_HISTORY_DATA_SIZE = 1024 // bytes of cmd and reply data to keep
+)
+
+// Cmd states in CmdHistoryEntry.Status:
+const (
+	CMD_RUNNING  = "Running"
+	CMD_OK       = "OK"
+	CMD_ERROR    = "Error"
+	CMD_NO_REPLY = "No reply"
+)
+
+// A CmdHistoryEntry is one cmd received from the API and its reply.
+type CmdHistoryEntry struct {
+	Id        uint
+	User      string
+	AgentUuid string
+	Service   string
+	Cmd       string
+	Data      string    // truncated and redacted
+	Received  time.Time // when the agent received the cmd
+	Replied   time.Time // zero until the cmd is done
+	Duration  float64   // seconds
+	Status    string    // CMD_* state
+	Error     string
+	Reply     string // reply data, truncated and redacted
+}
+
+/**
+ * CmdHistory keeps the last CMD_HISTORY_SIZE cmds and replies so users can
+ * see what the agent received and did without API-side logs, e.g. "did the
+ * agent get that SetConfig?".  Cmd and reply data is truncated so the
+ * history stays small, and DSN passwords are redacted like in replies.
+ * Status, History, and Heartbeat cmds are not kept because they're polled frequently and
+ * don't change anything.  Every cmd, including those, is also written to the
+ * audit log, if set: once when it's received, so cmds that hang or crash the
+ * agent (e.g. Abort) are recorded, and again when it's replied to.
+ */
+type CmdHistory struct {
+	size    int
+	entries []*CmdHistoryEntry
+	running map[*proto.Cmd]*CmdHistoryEntry
+	audit   *CmdAuditLog
+	mux     *sync.Mutex
+}
+
+func NewCmdHistory(size int) *CmdHistory {
+	h := &CmdHistory{
+		size:    size,
+		entries: []*CmdHistoryEntry{},
+		running: make(map[*proto.Cmd]*CmdHistoryEntry),
+		mux:     &sync.Mutex{},
+	}
+	return h
+}
+
+// SetAuditLog sets the log to which replied cmds are written.
+func (h *CmdHistory) SetAuditLog(audit *CmdAuditLog) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.audit = audit
+}
+
+// AuditLog returns the audit log, or nil if not set.
+func (h *CmdHistory) AuditLog() *CmdAuditLog {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.audit
+}
+
+// Received adds the cmd to the history, unless it's a polled cmd, and writes
+// it to the audit log.
+func (h *CmdHistory) Received(cmd *proto.Cmd) {
+	h.mux.Lock()
+	e := &CmdHistoryEntry{
+		Id:        cmd.Id,
+		User:      cmd.User,
+		AgentUuid: cmd.AgentUuid,
+		Service:   cmd.Service,
+		Cmd:       cmd.Cmd,
+		Data:      historyData(cmd.Data),
+		Received:  time.Now().UTC(),
+		Status:    CMD_RUNNING,
+	}
+	if !polledCmd(cmd.Cmd) {
+		if len(h.entries) == h.size {
+			delete(h.running, h.runningCmd(h.entries[0]))
+			h.entries = h.entries[1:]
+		}
+		h.entries = append(h.entries, e)
+	}
+	h.running[cmd] = e
+	entry, audit := *e, h.audit
+	h.mux.Unlock()
+
+	// Write outside the lock so file I/O doesn't block status and history.
+	if audit != nil {
+		audit.Write(entry)
+	}
+}
+
+// Replied records the cmd reply, or CMD_NO_REPLY if reply is nil.  It does
+// nothing if the cmd isn't in the history.
+func (h *CmdHistory) Replied(cmd *proto.Cmd, reply *proto.Reply) {
+	h.mux.Lock()
+	e, ok := h.running[cmd]
+	if !ok {
+		h.mux.Unlock()
+		return
+	}
+	delete(h.running, cmd)
+	e.Replied = time.Now().UTC()
+	e.Duration = e.Replied.Sub(e.Received).Seconds()
+	switch {
+	case reply == nil:
+		e.Status = CMD_NO_REPLY
+	case reply.Error != "":
+		e.Status = CMD_ERROR
+		e.Error = pct.RedactDSNs(reply.Error)
+	default:
+		e.Status = CMD_OK
+	}
+	if reply != nil && !polledCmd(cmd.Cmd) {
+		e.Reply = historyData(reply.Data) // status is too large to be useful
+	}
+	entry, audit := *e, h.audit
+	h.mux.Unlock()
+
+	// Write outside the lock so file I/O doesn't block status and history.
+	if audit != nil {
+		audit.Write(entry)
+	}
+}
+
+// Entries returns copies of the history entries, oldest first.  If cmd is
+// not empty, only entries for that cmd are returned.
+func (h *CmdHistory) Entries(cmd string) []CmdHistoryEntry {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	entries := []CmdHistoryEntry{}
+	for _, e := range h.entries {
+		if cmd != "" && e.Cmd != cmd {
+			continue
+		}
+		entries = append(entries, *e)
+	}
+	return entries
+}
+
+// Last returns a one-line description of the last cmd for agent status.
+func (h *CmdHistory) Last() string {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.entries) == 0 {
+		return ""
+	}
+	e := h.entries[len(h.entries)-1]
+	last := fmt.Sprintf("%s %s at %s: %s", e.Service, e.Cmd, pct.TimeString(e.Received), e.Status)
+	if e.Error != "" {
+		last += ": " + e.Error
+	}
+	return last
+}
+
+func (h *CmdHistory) runningCmd(e *CmdHistoryEntry) *proto.Cmd {
+	for cmd, r := range h.running {
+		if r == e {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// polledCmd returns true for cmds that are polled frequently and don't change
+// anything, so they're only written to the audit log.
+func polledCmd(cmd string) bool {
+	return cmd == "Status" || cmd == "History" || cmd == "Heartbeat"
+}
+
+func historyData(data []byte) string {
+	s := pct.RedactDSNs(string(data))
+	if len(s) > CMD_HISTORY_DATA_SIZE {
+		s = s[0:CMD_HISTORY_DATA_SIZE] + fmt.Sprintf("... (%d bytes)", len(s))
+	}
+	return s
+}
@@ -0,0 +1,45 @@
+// +build noexec
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+// Built with tag noexec: the agent doesn't run programs, so it can't restart
+// or update itself remotely.  This file must not import os/exec or pct/cmd,
+// see exec.go.
+const REMOTE_EXEC = false
+
+// Run:@goroutine[0]
+func (agent *Agent) restart(cmd *proto.Cmd) bool {
+	agent.replyTo(cmd, cmd.Reply(nil, ErrNoExec))
+	return false
+}
+
+// installedVersion returns the running version because the installed binary
+// can't be run.
+func installedVersion(running string) (string, error) {
+	return running, nil
+}
+
+func (agent *Agent) update(version string) error {
+	return ErrNoExec
+}
@@ -0,0 +1,98 @@
+// +build noexec
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent_test
+
+import (
+	"encoding/json"
+	"go/build"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+// Tests of agents built with tag noexec, see exec_test.go for the others.
+
+func (s *AgentTestSuite) TestNoExecCmds(t *C) {
+	for _, cmd := range []string{"Restart", "Update"} {
+		s.sendChan <- &proto.Cmd{Service: "agent", Cmd: cmd, Data: []byte("1.0.14")}
+		reply := test.WaitReply(s.recvChan)
+		t.Assert(reply, HasLen, 1)
+		t.Check(reply[0].Error, Equals, agent.ErrNoExec.Error(), Commentf(cmd))
+	}
+
+	// The installed binary can't be run, so it's the running one.
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Version"}
+	reply := test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	t.Assert(reply[0].Error, Equals, "")
+	version := &proto.Version{}
+	t.Assert(json.Unmarshal(reply[0].Data, version), IsNil)
+	t.Check(version.Installed, Equals, version.Running)
+
+	s.sendChan <- &proto.Cmd{Service: "agent", Cmd: "Capabilities"}
+	reply = test.WaitReply(s.recvChan)
+	t.Assert(reply, HasLen, 1)
+	caps := &agent.Capabilities{}
+	t.Assert(json.Unmarshal(reply[0].Data, caps), IsNil)
+	for _, f := range caps.Features {
+		t.Check(f, Not(Equals), "remote-exec")
+	}
+}
+
+func (s *AgentTestSuite) TestNoExecImports(t *C) {
+	// No package of the agent built with tag noexec may import a package
+	// that runs programs.
+	ctx := build.Default
+	ctx.BuildTags = append(ctx.BuildTags, "noexec")
+	forbidden := map[string]bool{
+		"os/exec": true,
+		"github.com/percona/percona-agent/pct/cmd": true,
+	}
+	seen := map[string]bool{}
+	var walk func(path, importer string)
+	walk = func(path, importer string) {
+		if path == "C" {
+			return // cgo
+		}
+		if forbidden[path] {
+			t.Errorf("%s imports %s", importer, path)
+			return
+		}
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		pkg, err := ctx.Import(path, "", 0)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			return
+		}
+		if pkg.Goroot {
+			return // std packages are not ours
+		}
+		for _, imp := range pkg.Imports {
+			walk(imp, path)
+		}
+	}
+	walk("github.com/percona/percona-agent/bin/percona-agent", "")
+	t.Check(seen["github.com/percona/percona-agent/agent"], Equals, true)
+}
@@ -0,0 +1,192 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * Pause quiesces the agent, e.g. during upgrades and load tests: the tools
+ * that collect and spool data (PAUSE_SERVICES) are stopped for a bounded
+ * duration, then started again automatically, or by Resume.  Stopping a tool
+ * doesn't remove its configs and starting it reads them again, so tools
+ * resume with the same configs.  While paused, StartService for a paused
+ * tool fails, else the API reconciling configs would undo the pause.
+ * Pausing again changes the duration.  A pause doesn't survive an agent
+ * restart because tools are started when the agent starts.
+ */
+
+var PAUSE_SERVICES = []string{"mm", "qan", "sysconfig"}
+
+const (
+	PAUSE_MAX        = 24 * time.Hour
+	AUTO_RESUME_USER = "agent (auto-resume)"
+)
+
+// Pause is the data of agent cmd Pause.
+type Pause struct {
+	Duration uint // seconds, at most PAUSE_MAX
+}
+
+type pause struct {
+	until    time.Time
+	user     string
+	services []string // paused, i.e. stopped
+	timer    *time.Timer
+}
+
+// ServiceIsPausedError is returned for StartService while the tool is paused.
+type ServiceIsPausedError struct {
+	Service string
+	Until   time.Time
+}
+
+func (e ServiceIsPausedError) Error() string {
+	return fmt.Sprintf("%s service is paused until %s", e.Service, e.Until.Format(time.RFC3339))
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handlePause(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Pause", cmd)
+	agent.logger.Info(cmd)
+
+	p := &Pause{}
+	if err := json.Unmarshal(cmd.Data, p); err != nil {
+		return nil, []error{err}
+	}
+	d := time.Duration(p.Duration) * time.Second
+	if d <= 0 || d > PAUSE_MAX {
+		return nil, []error{fmt.Errorf("Invalid pause duration: %ds: must be > 0 and <= %s", p.Duration, PAUSE_MAX)}
+	}
+
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+
+	errs := []error{}
+	if agent.pause == nil {
+		agent.pause = &pause{
+			services: []string{},
+		}
+		for _, service := range PAUSE_SERVICES {
+			m, ok := agent.services[service]
+			if !ok {
+				continue
+			}
+			agent.logger.Info("Pausing " + service)
+			if err := m.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("Cannot pause %s: %s", service, err))
+				continue
+			}
+			agent.pause.services = append(agent.pause.services, service)
+		}
+	} else {
+		agent.pause.timer.Stop()
+	}
+
+	// Resume like the user would, so it's serialized with other cmds and
+	// recorded in the cmd history.
+	agent.pause.until = time.Now().UTC().Add(d)
+	agent.pause.user = cmd.User
+	agent.pause.timer = time.AfterFunc(d, func() {
+		agent.LocalCmd(&proto.Cmd{
+			Ts:        time.Now().UTC(),
+			User:      AUTO_RESUME_USER,
+			AgentUuid: cmd.AgentUuid,
+			Service:   "agent",
+			Cmd:       "Resume",
+		})
+	})
+	agent.updatePauseStatus()
+
+	return agent.pause.services, errs
+}
+
+// Handle:@goroutine[3]
+func (agent *Agent) handleResume(cmd *proto.Cmd) (interface{}, []error) {
+	agent.status.UpdateRe("agent-cmd-handler", "Resume", cmd)
+	agent.logger.Info(cmd)
+
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+
+	if agent.pause == nil {
+		return nil, []error{errors.New("Agent is not paused")}
+	}
+	if cmd.User == AUTO_RESUME_USER && time.Now().UTC().Before(agent.pause.until) {
+		// The timer fired while the agent was paused again.
+		return nil, nil
+	}
+	agent.pause.timer.Stop()
+
+	errs := []error{}
+	for _, service := range agent.pause.services {
+		agent.logger.Info("Resuming " + service)
+		if err := agent.services[service].Start(); err != nil {
+			errs = append(errs, fmt.Errorf("Cannot resume %s: %s", service, err))
+		}
+	}
+	services := agent.pause.services
+	agent.pause = nil
+	agent.updatePauseStatus()
+
+	return services, errs
+}
+
+// paused returns a ServiceIsPausedError if the cmd starts a paused service.
+func (agent *Agent) paused(service, cmd string) error {
+	if cmd != "StartService" {
+		return nil
+	}
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+	if agent.pause == nil {
+		return nil
+	}
+	for _, paused := range agent.pause.services {
+		if paused == service {
+			return ServiceIsPausedError{Service: service, Until: agent.pause.until}
+		}
+	}
+	return nil
+}
+
+// stopPause stops the auto-resume when the agent stops.
+func (agent *Agent) stopPause() {
+	agent.pauseMux.Lock()
+	defer agent.pauseMux.Unlock()
+	if agent.pause != nil {
+		agent.pause.timer.Stop()
+	}
+}
+
+// Caller must lock pauseMux.
+func (agent *Agent) updatePauseStatus() {
+	if agent.pause == nil {
+		agent.status.Update("agent-pause", "")
+		return
+	}
+	agent.status.Update("agent-pause", fmt.Sprintf("Paused %s until %s by %s",
+		strings.Join(agent.pause.services, ", "), agent.pause.until.Format(time.RFC3339), agent.pause.user))
+}
@@ -0,0 +1,357 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package alert_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/alert"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Hook gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ManagerTestSuite struct {
+	tmpDir   string
+	logChan  chan *proto.LogEntry
+	logger   *pct.Logger
+	dataChan chan interface{}
+	spool    *mock.Spooler
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "alert-test")
+	s.dataChan = make(chan interface{}, 10)
+	s.spool = mock.NewSpooler(s.dataChan)
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func report(ts int64, threadsRunning float64) *mm.Report {
+	return &mm.Report{
+		Ts:       time.Unix(ts, 0).UTC(),
+		Duration: 60,
+		Stats: []*mm.InstanceStats{
+			{
+				ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+				Stats: map[string]*mm.Stats{
+					"mysql/threads_running": {Cnt: 60, Avg: threadsRunning, Max: threadsRunning},
+				},
+			},
+		},
+	}
+}
+
+// waitAlert returns the next alert spooled by the "api" action.
+func (s *ManagerTestSuite) waitAlert() *alert.Alert {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case v := <-s.dataChan:
+			if a, ok := v.(*alert.Alert); ok {
+				return a
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func (s *ManagerTestSuite) TestRule(t *C) {
+	webhookChan := make(chan *alert.Alert, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := &alert.Alert{}
+		json.NewDecoder(r.Body).Decode(a)
+		webhookChan <- a
+	}))
+	defer server.Close()
+
+	config := &alert.Config{
+		Webhook: server.URL,
+		Rules: []alert.Rule{
+			{
+				Name:      "busy",
+				Service:   "mysql",
+				Metric:    "mysql/threads_running",
+				Op:        ">",
+				Threshold: 10,
+				Duration:  120,
+				Actions:   []string{"log", "webhook", "api"},
+			},
+		},
+	}
+	err := pct.Basedir.WriteConfig("alert", config)
+	t.Assert(err, IsNil)
+
+	m := alert.NewManager(s.logger, s.spool)
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Busy for the 1st minute isn't long enough, but 2 minutes is.
+	s.spool.Write("mm", report(1420070400, 20))
+	s.spool.Write("mm", report(1420070460, 20))
+	a := s.waitAlert()
+	t.Assert(a, NotNil)
+	t.Check(a.State, Equals, alert.ALERT_FIRING)
+	t.Check(a.Ts, Equals, time.Unix(1420070460, 0).UTC())
+	t.Check(a.Value, Equals, float64(20))
+	select {
+	case a := <-webhookChan:
+		t.Check(a.Rule, Equals, "busy")
+		t.Check(a.State, Equals, alert.ALERT_FIRING)
+	case <-time.After(2 * time.Second):
+		t.Error("No webhook")
+	}
+	t.Check(test.WaitStatus(1, m, "alert", "Running (1 rules, 1 firing)"), Equals, true)
+
+	// It keeps firing, but it fires only once.
+	s.spool.Write("mm", report(1420070520, 30))
+	s.spool.Write("mm", report(1420070580, 5))
+	a = s.waitAlert()
+	t.Assert(a, NotNil)
+	t.Check(a.State, Equals, alert.ALERT_RESOLVED)
+	t.Check(a.Ts, Equals, time.Unix(1420070580, 0).UTC())
+	t.Check(a.Value, Equals, float64(5))
+}
+
+func (s *ManagerTestSuite) TestChannels(t *C) {
+	// PagerDuty fails the first event, so it's retried.
+	pdChan := make(chan map[string]interface{}, 10)
+	pdFail := make(chan bool, 1)
+	pdFail <- true
+	pd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-pdFail:
+			w.WriteHeader(503)
+			return
+		default:
+		}
+		event := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&event)
+		pdChan <- event
+		w.WriteHeader(202)
+	}))
+	defer pd.Close()
+
+	webhookChan := make(chan map[string]string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		webhookChan <- body
+	}))
+	defer webhook.Close()
+
+	config := &alert.Config{
+		Channels: []alert.Channel{
+			{
+				Name:      "chat",
+				Type:      "webhook",
+				URL:       webhook.URL,
+				Body:      `{"text": {{json .String}}, "state": "{{.State}}"}`,
+				RateLimit: 1,
+			},
+			{
+				Name:       "pd",
+				Type:       "pagerduty",
+				URL:        pd.URL,
+				RoutingKey: "abc123",
+			},
+		},
+		Rules: []alert.Rule{
+			{
+				Name:      "busy",
+				Metric:    "mysql/threads_running",
+				Op:        ">",
+				Threshold: 10,
+				Actions:   []string{"chat", "pd"},
+			},
+		},
+	}
+	err := pct.Basedir.WriteConfig("alert", config)
+	t.Assert(err, IsNil)
+
+	m := alert.NewManager(s.logger, s.spool)
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	s.spool.Write("mm", report(1420070400, 20))
+	select {
+	case body := <-webhookChan:
+		t.Check(body["text"], Equals, "Alert busy firing: mysql-1 mysql/threads_running avg 20 > 10")
+		t.Check(body["state"], Equals, alert.ALERT_FIRING)
+	case <-time.After(2 * time.Second):
+		t.Error("No webhook")
+	}
+	var trigger map[string]interface{}
+	select {
+	case trigger = <-pdChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("No PagerDuty event")
+	}
+	t.Check(pdFail, HasLen, 0)
+	t.Check(trigger["routing_key"], Equals, "abc123")
+	t.Check(trigger["event_action"], Equals, "trigger")
+	t.Check(trigger["dedup_key"], Matches, "percona-agent/.+/busy/mysql-1")
+	payload, _ := trigger["payload"].(map[string]interface{})
+	t.Assert(payload, NotNil)
+	t.Check(payload["severity"], Equals, alert.DEFAULT_SEVERITY)
+	t.Check(payload["summary"], Equals, "Alert busy firing: mysql-1 mysql/threads_running avg 20 > 10")
+	t.Check(payload["timestamp"], Equals, "2015-01-01T00:00:00Z")
+
+	// Resolves aren't rate limited, so both channels get it.  PagerDuty's
+	// has the same dedup key to resolve the incident.
+	s.spool.Write("mm", report(1420070460, 5))
+	select {
+	case resolve := <-pdChan:
+		t.Check(resolve["event_action"], Equals, "resolve")
+		t.Check(resolve["dedup_key"], Equals, trigger["dedup_key"])
+	case <-time.After(2 * time.Second):
+		t.Error("No PagerDuty resolve")
+	}
+	select {
+	case body := <-webhookChan:
+		t.Check(body["state"], Equals, alert.ALERT_RESOLVED)
+	case <-time.After(2 * time.Second):
+		t.Error("No webhook resolve")
+	}
+
+	// The webhook is rate limited to 1 alert/hour, so only PagerDuty gets
+	// the rule firing again.
+	s.spool.Write("mm", report(1420070520, 20))
+	select {
+	case trigger = <-pdChan:
+		t.Check(trigger["event_action"], Equals, "trigger")
+	case <-time.After(2 * time.Second):
+		t.Error("No PagerDuty event")
+	}
+	t.Check(test.WaitStatus(1, m, "alert-channel-chat", "2 sent, 0 failed, 1 rate limited"), Equals, true)
+	t.Check(test.WaitStatus(1, m, "alert-channel-pd", "3 sent, 0 failed, 0 rate limited"), Equals, true)
+	select {
+	case body := <-webhookChan:
+		t.Errorf("Webhook not rate limited: %v", body)
+	default:
+	}
+}
+
+func (s *ManagerTestSuite) TestSetConfig(t *C) {
+	m := alert.NewManager(s.logger, s.spool)
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Invalid op.
+	config := &alert.Config{Rules: []alert.Rule{{Name: "r1", Metric: "mysql/threads_running", Op: "=>"}}}
+	data, _ := json.Marshal(config)
+	reply := m.Handle(&proto.Cmd{Cmd: "SetConfig", Service: "alert", Data: data})
+	t.Check(reply.Error, Matches, ".+invalid Op.+")
+
+	// Webhook action without a webhook.
+	config.Rules[0].Op = ">="
+	config.Rules[0].Actions = []string{"webhook"}
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Cmd: "SetConfig", Service: "alert", Data: data})
+	t.Check(reply.Error, Matches, ".+no Webhook")
+
+	// Webhook channel with a body template that doesn't make valid JSON.
+	config.Rules[0].Actions = []string{"chat"}
+	config.Channels = []alert.Channel{{Name: "chat", Type: "webhook", URL: "http://localhost", Body: `{"text": {{.Rule}}}`}}
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Cmd: "SetConfig", Service: "alert", Data: data})
+	t.Check(reply.Error, Matches, "Channel chat: Body is not valid JSON.+")
+
+	// PagerDuty channel without a routing key.
+	config.Channels = []alert.Channel{{Name: "chat", Type: "pagerduty"}}
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Cmd: "SetConfig", Service: "alert", Data: data})
+	t.Check(reply.Error, Equals, "Channel chat: no RoutingKey")
+	config.Channels = nil
+
+	// Defaults are set and the config is saved.
+	config.Rules[0].Actions = nil
+	data, _ = json.Marshal(config)
+	reply = m.Handle(&proto.Cmd{Cmd: "SetConfig", Service: "alert", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	got := &alert.Config{}
+	err = pct.Basedir.ReadConfig("alert", got)
+	t.Assert(err, IsNil)
+	t.Check(got.Rules[0].Stat, Equals, alert.DEFAULT_STAT)
+	t.Check(got.Rules[0].Actions, DeepEquals, []string{"log"})
+}
+
+func (s *ManagerTestSuite) TestSetConfigResolves(t *C) {
+	config := &alert.Config{
+		Rules: []alert.Rule{
+			{
+				Name:      "busy",
+				Metric:    "mysql/threads_running",
+				Op:        ">",
+				Threshold: 10,
+				Actions:   []string{"api"},
+			},
+		},
+	}
+	err := pct.Basedir.WriteConfig("alert", config)
+	t.Assert(err, IsNil)
+
+	m := alert.NewManager(s.logger, s.spool)
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	s.spool.Write("mm", report(1420070400, 20))
+	a := s.waitAlert()
+	t.Assert(a, NotNil)
+	t.Check(a.State, Equals, alert.ALERT_FIRING)
+
+	// Removing the rule resolves it, else it would never resolve.
+	data, _ := json.Marshal(&alert.Config{})
+	reply := m.Handle(&proto.Cmd{Cmd: "SetConfig", Service: "alert", Data: data})
+	t.Assert(reply.Error, Equals, "")
+	a = s.waitAlert()
+	t.Assert(a, NotNil)
+	t.Check(a.Rule, Equals, "busy")
+	t.Check(a.State, Equals, alert.ALERT_RESOLVED)
+	t.Check(a.InstanceId, Equals, uint(1))
+}
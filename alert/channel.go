@@ -0,0 +1,405 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	CHANNEL_QUEUE        = 100 // alerts, more are dropped
+	CHANNEL_RETRIES      = 3
+	DEFAULT_RATE_LIMIT   = 30 // alerts per hour
+	DEFAULT_SEVERITY     = "warning"
+	PAGERDUTY_EVENTS_URL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+/**
+ * A channel notifies an external system of alerts.  Channels are configured
+ * in Config.Channels, and a rule's action can be the name of a channel.  Each
+ * Channel.Type has a notifier (see notifiers) that sends one alert:
+ *
+ *   webhook    POST the alert as JSON to URL, or the JSON that Body, a Go
+ *              text/template executed with the Alert, makes, e.g.
+ *              {"text": {{json .String}}}
+ *   pagerduty  trigger and resolve PagerDuty incidents with the Events API v2,
+ *              one incident per rule and instance
+ *
+ * Each channel has a queue and sends alerts one at a time so a slow or down
+ * endpoint doesn't block the rules.  A failed send is retried CHANNEL_RETRIES
+ * times with a pct.Backoff, then the alert is dropped; 4xx errors other than
+ * 429 are not retried because the endpoint will never accept the alert.  A
+ * channel sends at most RateLimit alerts per hour; more are dropped so a
+ * flapping rule doesn't page someone all night.
+ */
+
+type Channel struct {
+	Name       string // unique, rule actions refer to the channel by name
+	Type       string // webhook or pagerduty
+	URL        string // webhook URL, or Events API URL (default PAGERDUTY_EVENTS_URL)
+	Body       string // webhook: template of JSON body (default Alert as JSON)
+	RoutingKey string // pagerduty: integration key of the service
+	Severity   string // pagerduty: critical, error, warning (default), info
+	RateLimit  uint   // alerts per hour (default DEFAULT_RATE_LIMIT)
+}
+
+type notifier interface {
+	// notify sends the alert and returns whether retrying can succeed if
+	// there's an error.
+	notify(alert *Alert) (bool, error)
+}
+
+var notifiers = map[string]func(c *Channel, client *http.Client) (notifier, error){
+	"webhook":   newWebhook,
+	"pagerduty": newPagerDuty,
+}
+
+var severities = map[string]bool{
+	"critical": true,
+	"error":    true,
+	"warning":  true,
+	"info":     true,
+}
+
+// Validate sets defaults and returns an error if the channel is invalid.
+func (c *Channel) Validate() error {
+	if c.Name == "" {
+		return errors.New("Channel has no Name")
+	}
+	if _, ok := notifiers[c.Type]; !ok {
+		return errors.New("Channel " + c.Name + " has invalid Type: " + c.Type)
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = DEFAULT_RATE_LIMIT
+	}
+	if c.Type == "pagerduty" {
+		if c.URL == "" {
+			c.URL = PAGERDUTY_EVENTS_URL
+		}
+		if c.Severity == "" {
+			c.Severity = DEFAULT_SEVERITY
+		}
+		if !severities[c.Severity] {
+			return errors.New("Channel " + c.Name + " has invalid Severity: " + c.Severity)
+		}
+	}
+	if _, err := notifiers[c.Type](c, nil); err != nil {
+		return errors.New("Channel " + c.Name + ": " + err.Error())
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Channel
+/////////////////////////////////////////////////////////////////////////////
+
+type channel struct {
+	name     string
+	logger   *pct.Logger
+	notifier notifier
+	limit    int
+	// --
+	queue   chan *Alert
+	backoff *pct.Backoff
+	sync    *pct.SyncChan
+	mux     *sync.Mutex // guards recent and the counters
+	recent  []time.Time // alerts queued in the last hour, for the rate limit
+	sent    uint
+	failed  uint
+	limited uint
+}
+
+func newChannel(logger *pct.Logger, c *Channel, client *http.Client) (*channel, error) {
+	n, err := notifiers[c.Type](c, client)
+	if err != nil {
+		return nil, err
+	}
+	ch := &channel{
+		name:     c.Name,
+		logger:   logger,
+		notifier: n,
+		limit:    int(c.RateLimit),
+		// --
+		queue:   make(chan *Alert, CHANNEL_QUEUE),
+		backoff: pct.NewBackoff(time.Minute),
+		sync:    pct.NewSyncChan(),
+		mux:     &sync.Mutex{},
+		recent:  []time.Time{},
+	}
+	return ch, nil
+}
+
+func (c *channel) Start() {
+	go c.run()
+}
+
+func (c *channel) Stop() {
+	c.sync.Stop()
+	c.sync.Wait()
+}
+
+// Notify queues the alert to send unless the channel has reached its rate
+// limit.  Resolved alerts are not rate limited, else a channel could be left
+// with alerts that fired but never resolved.  It does not block.
+func (c *channel) Notify(alert *Alert) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	limited := alert.State != ALERT_RESOLVED
+	if limited {
+		hourAgo := time.Now().Add(-time.Hour)
+		for len(c.recent) > 0 && c.recent[0].Before(hourAgo) {
+			c.recent = c.recent[1:]
+		}
+		if len(c.recent) >= c.limit {
+			c.limited++
+			c.logger.Warn(fmt.Sprintf("Alert %s not sent to channel %s: rate limit %d/hour reached", alert.Rule, c.name, c.limit))
+			return
+		}
+	}
+
+	select {
+	case c.queue <- alert:
+		if limited {
+			c.recent = append(c.recent, time.Now())
+		}
+	default:
+		c.failed++
+		c.logger.Warn(fmt.Sprintf("Alert %s not sent to channel %s: queue full", alert.Rule, c.name))
+	}
+}
+
+func (c *channel) Status() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return fmt.Sprintf("%d sent, %d failed, %d rate limited", c.sent, c.failed, c.limited)
+}
+
+func (c *channel) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			c.logger.Error("Alert channel "+c.name+" crashed: ", err)
+		}
+		c.sync.Done()
+	}()
+	for {
+		select {
+		case alert := <-c.queue:
+			if !c.send(alert) {
+				return // stopped while retrying
+			}
+		case <-c.sync.StopChan:
+			return
+		}
+	}
+}
+
+// send sends the alert, retrying with backoff until it's sent, rejected, or
+// CHANNEL_RETRIES fail.  It returns false if stopped while waiting to retry.
+func (c *channel) send(alert *Alert) bool {
+	for try := 0; ; try++ {
+		retry, err := c.notifier.notify(alert)
+		if err == nil {
+			c.backoff.Success()
+			c.mux.Lock()
+			c.sent++
+			c.mux.Unlock()
+			return true
+		}
+		if !retry || try == CHANNEL_RETRIES {
+			c.mux.Lock()
+			c.failed++
+			c.mux.Unlock()
+			c.logger.Warn(fmt.Sprintf("Alert %s not sent to channel %s: %s", alert.Rule, c.name, err))
+			return true
+		}
+		wait := c.backoff.Wait()
+		c.logger.Debug(fmt.Sprintf("send:%s:%s:retry in %s", c.name, err, wait))
+		select {
+		case <-time.After(wait):
+		case <-c.sync.StopChan:
+			return false
+		}
+	}
+}
+
+// post POSTs the JSON body and returns whether retrying can succeed if
+// there's an error.
+func post(client *http.Client, addr string, body []byte) (bool, error) {
+	resp, err := client.Post(addr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err // don't log the URL, it can have a secret token
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode/100 != 4 || resp.StatusCode == 429, err // 429 = Too Many Requests
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Webhook
+/////////////////////////////////////////////////////////////////////////////
+
+type webhook struct {
+	url    string
+	body   *template.Template
+	client *http.Client
+}
+
+var templateFuncs = template.FuncMap{
+	// json quotes and escapes values for the JSON body, e.g. {{json .Rule}}.
+	"json": func(v interface{}) (string, error) {
+		bytes, err := json.Marshal(v)
+		return string(bytes), err
+	},
+}
+
+func newWebhook(c *Channel, client *http.Client) (notifier, error) {
+	if c.URL == "" {
+		return nil, errors.New("no URL")
+	}
+	w := &webhook{
+		url:    c.URL,
+		client: client,
+	}
+	if c.Body != "" {
+		t, err := template.New(c.Name).Funcs(templateFuncs).Parse(c.Body)
+		if err != nil {
+			return nil, err
+		}
+		w.body = t
+		// Catch bad fields and invalid JSON now, not when the alert fires.
+		if _, err := w.makeBody(&Alert{State: ALERT_FIRING}); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *webhook) notify(alert *Alert) (bool, error) {
+	body, err := w.makeBody(alert)
+	if err != nil {
+		return false, err
+	}
+	return post(w.client, w.url, body)
+}
+
+func (w *webhook) makeBody(alert *Alert) ([]byte, error) {
+	if w.body == nil {
+		return json.Marshal(alert)
+	}
+	var buf bytes.Buffer
+	if err := w.body.Execute(&buf, alert); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		return nil, fmt.Errorf("Body is not valid JSON: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// PagerDuty
+/////////////////////////////////////////////////////////////////////////////
+
+type pagerDuty struct {
+	url        string
+	routingKey string
+	severity   string
+	source     string
+	client     *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"` // trigger or resolve
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string `json:"summary"`
+	Source        string `json:"source"`
+	Severity      string `json:"severity"`
+	Timestamp     string `json:"timestamp"`
+	Component     string `json:"component"`
+	CustomDetails *Alert `json:"custom_details"`
+}
+
+func newPagerDuty(c *Channel, client *http.Client) (notifier, error) {
+	if c.RoutingKey == "" {
+		return nil, errors.New("no RoutingKey")
+	}
+	source, _ := os.Hostname()
+	p := &pagerDuty{
+		url:        c.URL,
+		routingKey: c.RoutingKey,
+		severity:   c.Severity,
+		source:     source,
+		client:     client,
+	}
+	return p, nil
+}
+
+func (p *pagerDuty) notify(alert *Alert) (bool, error) {
+	// Same dedup key for both events so resolve closes the incident.
+	event := &pagerDutyEvent{
+		RoutingKey: p.routingKey,
+		DedupKey:   fmt.Sprintf("percona-agent/%s/%s/%s-%d", p.source, alert.Rule, alert.Service, alert.InstanceId),
+	}
+	if alert.State == ALERT_FIRING {
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{
+			Summary:       alert.String(),
+			Source:        p.source,
+			Severity:      p.severity,
+			Timestamp:     alert.Ts.UTC().Format(time.RFC3339),
+			Component:     fmt.Sprintf("%s-%d", alert.Service, alert.InstanceId),
+			CustomDetails: alert,
+		}
+	} else {
+		event.EventAction = "resolve"
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	return post(p.client, p.url, body)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package alert
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	DEFAULT_STAT    = "avg"
+	WEBHOOK_TIMEOUT = 5 // seconds
+)
+
+/**
+ * alert is one agent-wide tool, so this config has every rule.  Rules are
+ * evaluated against each mm report (see Manager.Write), so the shortest
+ * Duration is effectively the report interval, usually 60s.
+ *
+ * Webhook predates Channels: it's the same as a webhook channel named
+ * "webhook" with the default Body.
+ */
+
+type Config struct {
+	Rules    []Rule
+	Channels []Channel // see channel.go
+	Webhook  string    // URL to POST alerts to for rules with action "webhook"
+}
+
+type Rule struct {
+	Name       string   // unique, identifies the rule in alerts
+	Service    string   // e.g. "mysql", "" = any
+	InstanceId uint     // 0 = any instance of Service
+	Metric     string   // mm metric name, e.g. mysql/threads_running
+	Stat       string   // cnt, min, pct5, avg, med, pct95, max (default avg)
+	Op         string   // >, >=, <, <=, ==, !=
+	Threshold  float64  // the metric stat is compared to this
+	Duration   uint     // seconds the condition must hold to fire, 0 = first report
+	Actions    []string // "log" (default), "api", or a channel name
+}
+
+var ops = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Validate sets defaults and returns an error if a rule or channel is invalid.
+func (c *Config) Validate() error {
+	channels := map[string]bool{}
+	for i := range c.Channels {
+		ch := &c.Channels[i]
+		if err := ch.Validate(); err != nil {
+			return err
+		}
+		if ch.Name == "log" || ch.Name == "api" {
+			return errors.New("Channel " + ch.Name + " has reserved Name")
+		}
+		if channels[ch.Name] {
+			return errors.New("Duplicate channel: " + ch.Name)
+		}
+		channels[ch.Name] = true
+	}
+	if c.Webhook != "" {
+		if channels["webhook"] {
+			return errors.New("Duplicate channel: webhook (Webhook is set)")
+		}
+		channels["webhook"] = true
+	}
+
+	names := map[string]bool{}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("Rule %d has no Name", i+1)
+		}
+		if names[r.Name] {
+			return errors.New("Duplicate rule: " + r.Name)
+		}
+		names[r.Name] = true
+		if r.Metric == "" {
+			return errors.New("Rule " + r.Name + " has no Metric")
+		}
+		if r.Stat == "" {
+			r.Stat = DEFAULT_STAT
+		}
+		if _, ok := statValue(nil, r.Stat); !ok {
+			return errors.New("Rule " + r.Name + " has invalid Stat: " + r.Stat)
+		}
+		if _, ok := ops[r.Op]; !ok {
+			return errors.New("Rule " + r.Name + " has invalid Op: " + r.Op)
+		}
+		if len(r.Actions) == 0 {
+			r.Actions = []string{"log"}
+		}
+		for _, action := range r.Actions {
+			switch {
+			case action == "log" || action == "api" || channels[action]:
+			case action == "webhook":
+				return errors.New("Rule " + r.Name + " has action webhook but there's no Webhook")
+			default:
+				return errors.New("Rule " + r.Name + " has invalid action: " + action)
+			}
+		}
+	}
+	return nil
+}
+
+// AllChannels returns Channels plus the webhook channel for Webhook, if set.
+func (c *Config) AllChannels() []Channel {
+	if c.Webhook == "" {
+		return c.Channels
+	}
+	webhook := Channel{
+		Name:      "webhook",
+		Type:      "webhook",
+		URL:       c.Webhook,
+		RateLimit: DEFAULT_RATE_LIMIT,
+	}
+	return append(append([]Channel{}, c.Channels...), webhook)
+}
@@ -0,0 +1,488 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+	REPORT_QUEUE   = 10 // mm reports, more are dropped
+)
+
+/**
+ * The alert manager evaluates Config.Rules against every mm report and fires
+ * each rule's actions when the rule triggers, then again when it resolves.
+ * Reports come from the data spooler: the manager is a spooler Tap, so it
+ * sees every report as it's spooled, before it's sent to the API.
+ *
+ * A rule triggers for an instance when the metric stat compared to the
+ * threshold is true for Duration seconds, i.e. in consecutive reports, and
+ * resolves in the first report that it's false.  Reports without the metric
+ * don't change the rule's state.  The actions are:
+ *
+ *   log      log entry: warning when firing, info when resolved
+ *   api      spool the Alert as "alert" data which is sent to the API
+ *   <name>   notify the channel, see channel.go; "webhook" is Config.Webhook
+ */
+
+type Alert struct {
+	Rule       string
+	State      string // ALERT_FIRING or ALERT_RESOLVED
+	Ts         time.Time
+	Service    string
+	InstanceId uint
+	Metric     string
+	Stat       string
+	Op         string
+	Value      float64
+	Threshold  float64
+}
+
+func (a *Alert) String() string {
+	return fmt.Sprintf("Alert %s %s: %s-%d %s %s %g %s %g",
+		a.Rule, a.State, a.Service, a.InstanceId, a.Metric, a.Stat, a.Value, a.Op, a.Threshold)
+}
+
+type ruleState struct {
+	since  time.Time // condition true since this report, zero if false
+	firing bool
+	alert  *Alert // last firing alert, to resolve if the rule is removed
+}
+
+type Manager struct {
+	logger  *pct.Logger
+	spooler data.Spooler
+	// --
+	config     *Config
+	running    bool
+	mux        *sync.Mutex // guards config, running, state, and channels
+	state      map[string]*ruleState
+	channels   map[string]*channel
+	reportChan chan *mm.Report
+	sync       *pct.SyncChan
+	status     *pct.Status
+	client     *http.Client
+}
+
+func NewManager(logger *pct.Logger, spooler data.Spooler) *Manager {
+	m := &Manager{
+		logger:  logger,
+		spooler: spooler,
+		// --
+		mux:        &sync.Mutex{},
+		state:      make(map[string]*ruleState),
+		channels:   make(map[string]*channel),
+		reportChan: make(chan *mm.Report, REPORT_QUEUE),
+		sync:       pct.NewSyncChan(),
+		status:     pct.NewStatus([]string{"alert"}),
+		client:     &http.Client{Timeout: WEBHOOK_TIMEOUT * time.Second},
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[0]
+func (m *Manager) Start() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.running {
+		return pct.ServiceIsRunningError{Service: "alert"}
+	}
+
+	spooler, ok := m.spooler.(data.TappedSpooler)
+	if !ok {
+		return errors.New("Data spooler does not support alerts")
+	}
+
+	config := &Config{}
+	if err := pct.Basedir.ReadConfig("alert", config); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	channels, err := m.makeChannels(config)
+	if err != nil {
+		return err
+	}
+	m.config = config
+	m.channels = channels
+	for _, ch := range channels {
+		ch.Start()
+	}
+
+	go m.run()
+	spooler.SetTap("alert", m)
+	m.running = true
+
+	m.logger.Info("Started")
+	m.status.Update("alert", fmt.Sprintf("Running (%d rules, 0 firing)", len(config.Rules)))
+	return nil
+}
+
+// @goroutine[0]
+func (m *Manager) Stop() error {
+	m.mux.Lock()
+	if !m.running {
+		m.mux.Unlock()
+		return nil
+	}
+	m.running = false
+	channels := m.channels
+	m.channels = make(map[string]*channel)
+	m.mux.Unlock()
+
+	// Don't hold mux while stopping because run() needs it.
+	m.spooler.(data.TappedSpooler).SetTap("alert", nil)
+	m.sync.Stop()
+	m.sync.Wait()
+	m.sync = pct.NewSyncChan()
+	m.stopChannels(channels)
+	m.logger.Info("Stopped")
+	m.status.Update("alert", "Stopped")
+	return nil
+}
+
+// @goroutine[0]
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	m.status.UpdateRe("alert", "Handling", cmd)
+	defer m.updateStatus()
+
+	switch cmd.Cmd {
+	case "SetConfig":
+		// proto.Cmd[Service:alert, Cmd:SetConfig, Data:alert.Config]
+		newConfig := &Config{}
+		if err := json.Unmarshal(cmd.Data, newConfig); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := newConfig.Validate(); err != nil {
+			return cmd.Reply(nil, err)
+		}
+
+		channels, err := m.makeChannels(newConfig)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+
+		// New rules start with no state, so first resolve rules that are
+		// firing, with the old rules and channels, else they never resolve.
+		for _, alert := range m.resolveAll() {
+			m.fire(alert)
+		}
+
+		m.mux.Lock()
+		m.config = newConfig
+		m.state = make(map[string]*ruleState)
+		oldChannels := m.channels
+		m.channels = channels
+		running := m.running
+		if running {
+			for _, ch := range channels {
+				ch.Start()
+			}
+		}
+		m.mux.Unlock()
+		if running {
+			m.stopChannels(oldChannels) // else they were never started
+		}
+
+		// Write the new config.  If this fails, agent will use old config if restarted.
+		if err := pct.Basedir.WriteConfig("alert", newConfig); err != nil {
+			return cmd.Reply(newConfig, errors.New("alert.WriteConfig:"+err.Error()))
+		}
+		return cmd.Reply(newConfig)
+	case "GetConfig":
+		config, errs := m.GetConfig()
+		return cmd.Reply(config, errs...)
+	default:
+		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+	}
+}
+
+// @goroutine[0]
+func (m *Manager) Status() map[string]string {
+	status := m.status.All()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for name, ch := range m.channels {
+		status["alert-channel-"+name] = ch.Status()
+	}
+	return status
+}
+
+// @goroutine[0]
+func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.config == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(m.config)
+	if err != nil {
+		return nil, []error{err}
+	}
+	// Configs are always returned as array of AgentConfig resources.
+	config := proto.AgentConfig{
+		InternalService: "alert",
+		// no external service
+		Config:  string(bytes),
+		Running: m.running,
+	}
+	return []proto.AgentConfig{config}, nil
+}
+
+// Reload applies changes to alert.conf with SetConfig.  See pct.ConfigReloader.
+func (m *Manager) Reload() []error {
+	return pct.ReloadConfig(m, "alert")
+}
+
+// Write queues an mm report to evaluate the rules against.  Other data is
+// ignored.  It's called by the spooler (it's a data.Tap) and must not block.
+func (m *Manager) Write(service string, v interface{}) {
+	report, ok := v.(*mm.Report)
+	if service != "mm" || !ok {
+		return
+	}
+	select {
+	case m.reportChan <- report:
+	default:
+		m.logger.Warn("Alert queue full, dropped mm report for", report.Ts)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[1]
+func (m *Manager) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Alert evaluator crashed: ", err)
+		}
+		m.sync.Done()
+	}()
+	for {
+		select {
+		case report := <-m.reportChan:
+			for _, alert := range m.evaluate(report) {
+				m.fire(alert)
+			}
+			m.updateStatus()
+		case <-m.sync.StopChan:
+			return
+		}
+	}
+}
+
+// evaluate updates the rules' state for the report and returns the alerts
+// for rules that triggered or resolved.
+// @goroutine[1]
+func (m *Manager) evaluate(report *mm.Report) []*Alert {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	alerts := []*Alert{}
+	end := report.Ts.Add(time.Duration(report.Duration) * time.Second)
+	for i := range m.config.Rules {
+		r := &m.config.Rules[i]
+		for _, is := range report.Stats {
+			if (r.Service != "" && r.Service != is.Service) || (r.InstanceId != 0 && r.InstanceId != is.InstanceId) {
+				continue
+			}
+			stats, ok := is.Stats[r.Metric]
+			if !ok {
+				continue
+			}
+			val, _ := statValue(stats, r.Stat)
+			key := fmt.Sprintf("%s/%s-%d", r.Name, is.Service, is.InstanceId)
+			s, ok := m.state[key]
+			if !ok {
+				s = &ruleState{}
+				m.state[key] = s
+			}
+			alert := &Alert{
+				Rule:       r.Name,
+				Ts:         report.Ts,
+				Service:    is.Service,
+				InstanceId: is.InstanceId,
+				Metric:     r.Metric,
+				Stat:       r.Stat,
+				Op:         r.Op,
+				Value:      val,
+				Threshold:  r.Threshold,
+			}
+			if ops[r.Op](val, r.Threshold) {
+				if s.since.IsZero() {
+					s.since = report.Ts
+				}
+				if !s.firing && end.Sub(s.since) >= time.Duration(r.Duration)*time.Second {
+					s.firing = true
+					s.alert = alert
+					alert.State = ALERT_FIRING
+					alerts = append(alerts, alert)
+				}
+			} else {
+				s.since = time.Time{}
+				if s.firing {
+					s.firing = false
+					s.alert = nil
+					alert.State = ALERT_RESOLVED
+					alerts = append(alerts, alert)
+				}
+			}
+		}
+	}
+	return alerts
+}
+
+// resolveAll returns resolved alerts for all firing rules and resets their
+// state.
+func (m *Manager) resolveAll() []*Alert {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	alerts := []*Alert{}
+	now := time.Now().UTC()
+	for _, s := range m.state {
+		if !s.firing || s.alert == nil {
+			continue
+		}
+		alert := *s.alert
+		alert.State = ALERT_RESOLVED
+		alert.Ts = now
+		alerts = append(alerts, &alert)
+		s.since = time.Time{}
+		s.firing = false
+		s.alert = nil
+	}
+	return alerts
+}
+
+// fire does the rule's actions for the alert.
+// @goroutine[1]
+func (m *Manager) fire(alert *Alert) {
+	var actions []string
+	m.mux.Lock()
+	for _, r := range m.config.Rules {
+		if r.Name == alert.Rule {
+			actions = r.Actions
+			break
+		}
+	}
+	channels := m.channels
+	m.mux.Unlock()
+
+	for _, action := range actions {
+		switch action {
+		case "log":
+			if alert.State == ALERT_FIRING {
+				m.logger.Warn(alert.String())
+			} else {
+				m.logger.Info(alert.String())
+			}
+		case "api":
+			if err := m.spooler.Write("alert", alert); err != nil {
+				m.logger.Warn("Alert", alert.Rule, "spool:", err)
+			}
+		default:
+			if ch, ok := channels[action]; ok {
+				ch.Notify(alert)
+			}
+		}
+	}
+}
+
+// makeChannels makes but does not start the config's channels.  Channels are
+// started only while the manager is running, so only those are stopped.
+func (m *Manager) makeChannels(config *Config) (map[string]*channel, error) {
+	channels := make(map[string]*channel)
+	for _, c := range config.AllChannels() {
+		logger := pct.NewLogger(m.logger.LogChan(), "alert-channel-"+c.Name)
+		ch, err := newChannel(logger, &c, m.client)
+		if err != nil {
+			return nil, errors.New("Channel " + c.Name + ": " + err.Error())
+		}
+		channels[c.Name] = ch
+	}
+	return channels, nil
+}
+
+func (m *Manager) stopChannels(channels map[string]*channel) {
+	for _, ch := range channels {
+		ch.Stop()
+	}
+}
+
+func (m *Manager) updateStatus() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.running {
+		return
+	}
+	firing := 0
+	for _, s := range m.state {
+		if s.firing {
+			firing++
+		}
+	}
+	m.status.Update("alert", fmt.Sprintf("Running (%d rules, %d firing)", len(m.config.Rules), firing))
+}
+
+// statValue returns the stat's value, and false if the stat is invalid.
+// If s is nil, it only checks that the stat is valid.
+func statValue(s *mm.Stats, stat string) (float64, bool) {
+	if s == nil {
+		s = &mm.Stats{}
+	}
+	switch stat {
+	case "cnt":
+		return float64(s.Cnt), true
+	case "min":
+		return s.Min, true
+	case "pct5":
+		return s.Pct5, true
+	case "avg":
+		return s.Avg, true
+	case "med":
+		return s.Med, true
+	case "pct95":
+		return s.Pct95, true
+	case "max":
+		return s.Max, true
+	}
+	return 0, false
+}
@@ -0,0 +1,367 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package auditlog_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/auditlog"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Hook gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+/////////////////////////////////////////////////////////////////////////////
+// Parser test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ParserTestSuite struct {
+}
+
+var _ = Suite(&ParserTestSuite{})
+
+func (s *ParserTestSuite) TestJSON(t *C) {
+	lines := []string{
+		`{"audit_record":{"name":"Query","record":"4_2015-01-02T10:00:00","timestamp":"2015-01-02T10:04:05 UTC","command_class":"select","connection_id":"7","status":0,"sqltext":"SELECT * FROM t WHERE id = 5","user":"app[app] @ localhost []","host":"localhost","os_user":"","ip":"","db":"test"}}`,
+		``,
+		`not a record`,
+		`{"audit_record":{"name":"Quit","record":"5_2015-01-02T10:00:00","timestamp":"2015-01-02T10:04:06 UTC","connection_id":"7","status":0,"user":"app","priv_user":"app","os_login":"","proxy_user":"","host":"localhost","ip":"","db":"test"}}`,
+	}
+	events, n, bad := auditlog.Parse(auditlog.FORMAT_JSON, lines)
+	t.Check(bad, Equals, uint(1))
+	t.Check(n, Equals, int64(len(lines[0])+len(lines[1])+len(lines[2])+len(lines[3])+4))
+	t.Assert(events, HasLen, 2)
+	t.Check(events[0], DeepEquals, auditlog.Event{
+		Name:         "Query",
+		Record:       "4_2015-01-02T10:00:00",
+		Ts:           time.Date(2015, 1, 2, 10, 4, 5, 0, time.UTC),
+		CommandClass: "select",
+		ConnectionId: "7",
+		SqlText:      "SELECT * FROM t WHERE id = 5",
+		User:         "app[app] @ localhost []",
+		Host:         "localhost",
+		Db:           "test",
+	})
+	t.Check(events[1].Name, Equals, "Quit")
+	t.Check(events[1].Ts, Equals, time.Date(2015, 1, 2, 10, 4, 6, 0, time.UTC))
+}
+
+func (s *ParserTestSuite) TestNew(t *C) {
+	lines := []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<AUDIT>`,
+		`<AUDIT_RECORD>`,
+		`  <NAME>Query</NAME>`,
+		`  <RECORD>4_2015-01-02T10:00:00</RECORD>`,
+		`  <TIMESTAMP>2015-01-02T10:04:05 UTC</TIMESTAMP>`,
+		`  <COMMAND_CLASS>drop_table</COMMAND_CLASS>`,
+		`  <CONNECTION_ID>7</CONNECTION_ID>`,
+		`  <STATUS>1051</STATUS>`,
+		`  <SQLTEXT>DROP TABLE t WHERE a &lt; 1</SQLTEXT>`,
+		`  <USER>root[root] @ localhost []</USER>`,
+		`  <HOST>localhost</HOST>`,
+		`  <OS_USER></OS_USER>`,
+		`  <IP></IP>`,
+		`  <DB>test</DB>`,
+		`</AUDIT_RECORD>`,
+		`<AUDIT_RECORD>`,
+		`  <NAME>Quit</NAME>`,
+	}
+	events, n, bad := auditlog.Parse(auditlog.FORMAT_NEW, lines)
+	t.Check(bad, Equals, uint(0))
+	t.Assert(events, HasLen, 1)
+	t.Check(events[0].Name, Equals, "Query")
+	t.Check(events[0].Ts, Equals, time.Date(2015, 1, 2, 10, 4, 5, 0, time.UTC))
+	t.Check(events[0].CommandClass, Equals, "drop_table")
+	t.Check(events[0].Status, Equals, 1051)
+	t.Check(events[0].SqlText, Equals, "DROP TABLE t WHERE a < 1")
+	t.Check(events[0].Db, Equals, "test")
+
+	// The last record isn't complete, so it isn't consumed.
+	end := int64(0)
+	for _, line := range lines[0:16] {
+		end += int64(len(line)) + 1
+	}
+	t.Check(n, Equals, end)
+
+	// A record cut by a crash is bad, the next one is ok.
+	events, _, bad = auditlog.Parse(auditlog.FORMAT_NEW, []string{
+		`<AUDIT_RECORD>`,
+		`  <NAME>Quit</NAME>`,
+		`<AUDIT_RECORD>`,
+		`  <NAME>Connect</NAME>`,
+		`</AUDIT_RECORD>`,
+	})
+	t.Check(bad, Equals, uint(1))
+	t.Assert(events, HasLen, 1)
+	t.Check(events[0].Name, Equals, "Connect")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Tailer test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type TailerTestSuite struct {
+	tmpDir   string
+	logChan  chan *proto.LogEntry
+	logger   *pct.Logger
+	dataChan chan interface{}
+	spool    *mock.Spooler
+	clock    *mock.Clock
+}
+
+var _ = Suite(&TailerTestSuite{})
+
+func (s *TailerTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "auditlog-mysql-1")
+	s.dataChan = make(chan interface{}, 10)
+	s.spool = mock.NewSpooler(s.dataChan)
+	s.clock = mock.NewClock()
+}
+
+func (s *TailerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func appendFile(t *C, file string, lines string) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	t.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteString(lines)
+	t.Assert(err, IsNil)
+}
+
+func record(n int, name, class, sql string) string {
+	return `{"audit_record":{"name":"` + name + `","record":"` + strconv.Itoa(n) + `_2015-01-02T10:00:00","timestamp":"2015-01-02T10:04:05 UTC","command_class":"` + class + `","connection_id":"7","status":0,"sqltext":"` + sql + `","user":"app","host":"localhost","os_user":"","ip":"","db":"test"}}` + "\n"
+}
+
+func (s *TailerTestSuite) waitReport() *auditlog.Report {
+	select {
+	case v := <-s.dataChan:
+		r, _ := v.(*auditlog.Report)
+		return r
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
+
+func (s *TailerTestSuite) TestTail(t *C) {
+	file := filepath.Join(s.tmpDir, "audit.log")
+	posFile := filepath.Join(s.tmpDir, "auditlog-mysql-1.json")
+	appendFile(t, file, record(1, "Query", "select", "SELECT 1 -- old, not sent"))
+
+	config := auditlog.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		Events:          []string{"query"},
+		Redact:          true,
+	}
+	t.Assert(config.Validate(), IsNil)
+	tickChan := make(chan time.Time)
+	source := func() (string, string, error) { return file, auditlog.FORMAT_JSON, nil }
+	tailer := auditlog.NewTailer(s.logger, config, source, tickChan, s.spool, posFile)
+	tailer.Start()
+
+	// 1st tick: start at the end of the file.
+	now := time.Date(2015, 1, 2, 10, 5, 0, 0, time.UTC)
+	tickChan <- now
+	appendFile(t, file, record(2, "Query", "select", "SELECT * FROM t WHERE id = 5")+
+		record(3, "Connect", "", "")+
+		record(4, "Query", "drop_table", "DROP TABLE t"))
+
+	// 2nd tick: the queries, not the connect, with literals redacted.
+	tickChan <- now.Add(10 * time.Second)
+	got := s.waitReport()
+	t.Assert(got, NotNil)
+	t.Check(got.ServiceInstance, DeepEquals, config.ServiceInstance)
+	t.Check(got.File, Equals, file)
+	t.Assert(got.Events, HasLen, 2)
+	t.Check(got.Events[0].Record, Equals, "2_2015-01-02T10:00:00")
+	t.Check(got.Events[0].SqlText, Equals, "select * from t where id = ?")
+	t.Check(got.Events[1].CommandClass, Equals, "drop_table")
+	t.Check(test.WaitStatus(1, tailer, "auditlog-mysql-1", "Idle"), Equals, true)
+	t.Check(tailer.Status()["auditlog-mysql-1-events"], Equals, "2 sent, 1 filtered, 0 bad")
+
+	// The spool doesn't take the report, so the events are read again.
+	appendFile(t, file, record(5, "Query", "insert", "INSERT INTO t VALUES (1)"))
+	s.spool.WriteErr = errors.New("timeout")
+	tickChan <- now.Add(20 * time.Second)
+	t.Check(test.WaitStatus(1, tailer, "auditlog-mysql-1", "Idle (error: Cannot spool 1 events from "+file+", will read them again: timeout)"), Equals, true)
+	s.spool.WriteErr = nil
+	tickChan <- now.Add(30 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Events, HasLen, 1)
+	t.Check(got.Events[0].Record, Equals, "5_2015-01-02T10:00:00")
+	tailer.Stop()
+
+	// Events written while the tailer is stopped aren't lost: it starts
+	// where it stopped.
+	appendFile(t, file, record(6, "Query", "delete", "DELETE FROM t"))
+	tailer = auditlog.NewTailer(s.logger, config, source, tickChan, s.spool, posFile)
+	tailer.Start()
+	defer tailer.Stop()
+	tickChan <- now.Add(40 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Events, HasLen, 1)
+	t.Check(got.Events[0].Record, Equals, "6_2015-01-02T10:00:00")
+
+	// Rotate the log: the rest of the old file is read, then the new one.
+	appendFile(t, file, record(7, "Query", "update", "UPDATE t SET a = 1"))
+	err := os.Rename(file, file+".1")
+	t.Assert(err, IsNil)
+	appendFile(t, file, record(8, "Query", "update", "UPDATE t SET a = 2"))
+	tickChan <- now.Add(50 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Events, HasLen, 1)
+	t.Check(got.Events[0].Record, Equals, "7_2015-01-02T10:00:00")
+	t.Check(got.File, Equals, file+".1")
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Events, HasLen, 1)
+	t.Check(got.Events[0].Record, Equals, "8_2015-01-02T10:00:00")
+
+	t.Check(test.WaitStatus(1, tailer, "auditlog-mysql-1", "Idle"), Equals, true)
+	t.Check(tailer.Status()["auditlog-mysql-1-last-collected"], Matches, "at 2015-01-02 10:05:50 UTC.*")
+}
+
+func (s *TailerTestSuite) TestPartialSpool(t *C) {
+	file := filepath.Join(s.tmpDir, "partial.log")
+	posFile := filepath.Join(s.tmpDir, "partial.json")
+	appendFile(t, file, "")
+
+	config := auditlog.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+	}
+	t.Assert(config.Validate(), IsNil)
+	tickChan := make(chan time.Time)
+	source := func() (string, string, error) { return file, auditlog.FORMAT_JSON, nil }
+	tailer := auditlog.NewTailer(s.logger, config, source, tickChan, s.spool, posFile)
+	tailer.Start()
+	defer tailer.Stop()
+
+	now := time.Date(2015, 1, 2, 10, 5, 0, 0, time.UTC)
+	tickChan <- now
+	records := ""
+	for i := 1; i <= auditlog.MAX_EVENTS+1; i++ {
+		records += record(i, "Query", "select", "SELECT 1")
+	}
+	appendFile(t, file, records)
+
+	// The spool takes the first report but not the second, so only the
+	// events of the second are read again.
+	s.spool.WriteErr = errors.New("timeout")
+	s.spool.WriteOk = 1
+	tickChan <- now.Add(10 * time.Second)
+	got := s.waitReport()
+	t.Assert(got, NotNil)
+	t.Check(got.Events, HasLen, auditlog.MAX_EVENTS)
+	t.Check(test.WaitStatus(1, tailer, "auditlog-mysql-1", "Idle (error: Cannot spool 1 events from "+file+", will read them again: timeout)"), Equals, true)
+	s.spool.WriteErr = nil
+	tickChan <- now.Add(20 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Events, HasLen, 1)
+	t.Check(got.Events[0].Record, Equals, strconv.Itoa(auditlog.MAX_EVENTS+1)+"_2015-01-02T10:00:00")
+	t.Check(test.WaitStatus(1, tailer, "auditlog-mysql-1", "Idle"), Equals, true)
+	t.Check(tailer.Status()["auditlog-mysql-1-events"], Equals, "1001 sent, 0 filtered, 0 bad")
+}
+
+func (s *TailerTestSuite) TestConfig(t *C) {
+	config := auditlog.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		Format:          "json",
+	}
+	t.Check(config.Validate(), IsNil)
+	t.Check(config.Format, Equals, auditlog.FORMAT_JSON)
+	t.Check(config.Interval, Equals, uint(auditlog.DEFAULT_INTERVAL))
+
+	config.Format = "csv"
+	t.Check(config.Validate(), ErrorMatches, "Audit log format CSV is not supported.+")
+}
+
+func (s *TailerTestSuite) TestManager(t *C) {
+	file := filepath.Join(s.tmpDir, "manager.log")
+	appendFile(t, file, "")
+
+	im := instance.NewRepo(s.logger, pct.Basedir.Dir("config"), nil)
+	m := auditlog.NewManager(s.logger, s.clock, s.spool, im, &mock.ConnectionFactory{})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Only MySQL instances.
+	cmd := &proto.Cmd{
+		Service: "auditlog",
+		Cmd:     "StartService",
+		Data:    []byte(`{"Service":"server","InstanceId":1}`),
+	}
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Matches, "Invalid auditlog.Config: Service must be mysql.+")
+
+	cmd.Data = []byte(`{"Service":"mysql","InstanceId":1,"File":"` + file + `","Format":"JSON"}`)
+	reply = m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{auditlog.DEFAULT_INTERVAL})
+	t.Check(pct.FileExists(pct.Basedir.ConfigFile("auditlog-mysql-1")), Equals, true)
+	t.Check(m.Status()["auditlog-mysql-1"], Not(Equals), "")
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].ExternalService, DeepEquals, proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+
+	// Re-sending the same config succeeds without restarting it.
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, HasLen, 1)
+
+	// Stopping it removes its config and position.
+	posFile := filepath.Join(pct.Basedir.Dir("history"), "auditlog-mysql-1.json")
+	appendFile(t, posFile, "{}")
+	cmd.Cmd = "StopService"
+	reply = m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+	t.Check(s.clock.Removed, HasLen, 1)
+	t.Check(pct.FileExists(pct.Basedir.ConfigFile("auditlog-mysql-1")), Equals, false)
+	t.Check(pct.FileExists(posFile), Equals, false)
+	_, ok := m.Status()["auditlog-mysql-1"]
+	t.Check(ok, Equals, false)
+}
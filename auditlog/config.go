@@ -0,0 +1,83 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package auditlog
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+const (
+	FORMAT_JSON = "JSON"
+	FORMAT_NEW  = "NEW"
+	// --
+	DEFAULT_INTERVAL = 10   // seconds
+	MAX_EVENTS       = 1000 // per report, more events are sent in more reports
+)
+
+type Config struct {
+	proto.ServiceInstance
+	File     string   // audit log, "" = @@audit_log_file (relative to @@datadir)
+	Format   string   // FORMAT_JSON or FORMAT_NEW, "" = @@audit_log_format
+	Interval uint     // how often to read new events (seconds)
+	Events   []string // send only these events (NAME), e.g. Query, Connect; none = all
+	Commands []string // send only these command classes, e.g. drop_table; none = all
+	Redact   bool     // replace literals in SQL text with ?, e.g. a = ?
+}
+
+// Validate sets defaults and returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	if c.Service != "mysql" {
+		return errors.New("Service must be mysql, got '" + c.Service + "'")
+	}
+	if c.InstanceId == 0 {
+		return errors.New("InstanceId must be > 0")
+	}
+	c.Format = strings.ToUpper(c.Format)
+	if c.Format != "" {
+		if err := validFormat(c.Format); err != nil {
+			return err
+		}
+	}
+	if c.Interval == 0 {
+		c.Interval = DEFAULT_INTERVAL
+	}
+	return nil
+}
+
+// validFormat returns an error if the audit log format, e.g. the value of
+// @@audit_log_format, isn't one the tailer can parse.
+func validFormat(format string) error {
+	switch format {
+	case FORMAT_JSON, FORMAT_NEW:
+		return nil
+	case "OLD", "CSV":
+		return errors.New("Audit log format " + format + " is not supported, set audit_log_format to JSON or NEW")
+	}
+	return errors.New("Invalid audit log format: " + format)
+}
+
+func (c Config) Instance() proto.ServiceInstance {
+	return c.ServiceInstance
+}
+
+func (c Config) TickInterval() uint {
+	return c.Interval
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package auditlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/mysqllog"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+// NewManager returns the auditlog manager: a mysqllog.Manager of audit log
+// tailers, one per MySQL instance.  Its tailers save their position, e.g. in
+// history/auditlog-mysql-1.json, which StopService removes.
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, im *instance.Repo, connFactory mysql.ConnectionFactory) *mysqllog.Manager {
+	f := &factory{
+		spool:       spool,
+		im:          im,
+		connFactory: connFactory,
+	}
+	return mysqllog.NewLogManager("auditlog", logger, clock, im, f)
+}
+
+// RemovePosition removes the position of the instance's tailer, e.g. mysql-1,
+// when the instance is removed.  It returns false if there was none.
+func RemovePosition(instanceName string) (bool, error) {
+	return mysqllog.RemovePosition("auditlog-" + instanceName)
+}
+
+// factory makes the audit log tailers of the auditlog manager.
+type factory struct {
+	spool       data.Spooler
+	im          *instance.Repo
+	connFactory mysql.ConnectionFactory
+}
+
+func (f *factory) Make(logger *pct.Logger, data []byte, tickChan chan time.Time) (*mysqllog.Tailer, error) {
+	config := Config{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.New("Invalid auditlog.Config: " + err.Error())
+	}
+	source, err := f.sourceFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	posFile := mysqllog.PositionFile(logger.Service())
+	return NewTailer(logger, config, source, tickChan, f.spool, posFile), nil
+}
+
+// sourceFunc returns a func that returns the audit log and its format:
+// Config.File and Config.Format, else @@audit_log_file and @@audit_log_format,
+// which are got every interval because they can change (a restart).
+func (f *factory) sourceFunc(config Config) (func() (string, string, error), error) {
+	if config.File != "" && config.Format != "" {
+		file, format := config.File, config.Format
+		return func() (string, string, error) { return file, format, nil }, nil
+	}
+
+	mysqlInstance := proto.MySQLInstance{}
+	if err := f.im.Get(config.Service, config.InstanceId, &mysqlInstance); err != nil {
+		return nil, fmt.Errorf("Cannot get MySQL instance from repo: %s", err)
+	}
+	mysqlConn := f.connFactory.Make(mysqlInstance.DSN)
+	source := func() (string, string, error) {
+		if err := mysqlConn.Connect(1); err != nil {
+			return "", "", err
+		}
+		defer mysqlConn.Close()
+		file, format := config.File, config.Format
+		if file == "" {
+			if strings.ToUpper(mysqlConn.GetGlobalVarString("audit_log_handler")) == "SYSLOG" {
+				return "", "", errors.New("MySQL writes the audit log to syslog (audit_log_handler=SYSLOG), set it to FILE")
+			}
+			file = mysqlConn.GetGlobalVarString("audit_log_file")
+			if file == "" {
+				return "", "", errors.New("The audit_log plugin is not installed (audit_log_file is not set)")
+			}
+			// audit_log_file is relative to the datadir by default: audit.log.
+			if !path.IsAbs(file) {
+				file = path.Join(mysqlConn.GetGlobalVarString("datadir"), file)
+			}
+		}
+		if format == "" {
+			format = strings.ToUpper(mysqlConn.GetGlobalVarString("audit_log_format"))
+			if err := validFormat(format); err != nil {
+				return "", "", err
+			}
+		}
+		return file, format, nil
+	}
+	return source, nil
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package auditlog
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_SQL_LEN = 8192 // bytes, longer SQL text is cut
+)
+
+/**
+ * The Percona Server audit log plugin writes one record per event.  In JSON
+ * format (audit_log_format=JSON), every record is one line:
+ *
+ *   {"audit_record":{"name":"Query","record":"4_2015-01-02T10:04:05","timestamp":"2015-01-02T10:04:05 UTC",...}}
+ *
+ * In the new XML format (audit_log_format=NEW), every element of a record is
+ * one line:
+ *
+ *   <AUDIT_RECORD>
+ *     <NAME>Query</NAME>
+ *     <RECORD>4_2015-01-02T10:04:05</RECORD>
+ *     <TIMESTAMP>2015-01-02T10:04:05 UTC</TIMESTAMP>
+ *     ...
+ *   </AUDIT_RECORD>
+ *
+ * between <AUDIT> and </AUDIT>.  The record is unique per server (the first
+ * part is a counter, the second the time the log was opened), so it can be
+ * used to dedupe events sent twice.
+ */
+
+type Event struct {
+	Name         string    // e.g. Query, Connect, Quit
+	Record       string    // unique id, e.g. 4_2015-01-02T10:04:05
+	Ts           time.Time // UTC
+	CommandClass string    `json:",omitempty"` // e.g. select, drop_table
+	ConnectionId string    `json:",omitempty"`
+	Status       int       // MySQL error code, 0 = success
+	SqlText      string    `json:",omitempty"`
+	User         string    `json:",omitempty"`
+	Host         string    `json:",omitempty"`
+	OsUser       string    `json:",omitempty"`
+	Ip           string    `json:",omitempty"`
+	Db           string    `json:",omitempty"`
+}
+
+// record is an audit log record in either format.
+type record struct {
+	Name         string `json:"name" xml:"NAME"`
+	Record       string `json:"record" xml:"RECORD"`
+	Timestamp    string `json:"timestamp" xml:"TIMESTAMP"`
+	CommandClass string `json:"command_class" xml:"COMMAND_CLASS"`
+	ConnectionId string `json:"connection_id" xml:"CONNECTION_ID"`
+	Status       int    `json:"status" xml:"STATUS"`
+	SqlText      string `json:"sqltext" xml:"SQLTEXT"`
+	User         string `json:"user" xml:"USER"`
+	Host         string `json:"host" xml:"HOST"`
+	OsUser       string `json:"os_user" xml:"OS_USER"`
+	Ip           string `json:"ip" xml:"IP"`
+	Db           string `json:"db" xml:"DB"`
+}
+
+func (r record) event() Event {
+	e := Event{
+		Name:         r.Name,
+		Record:       r.Record,
+		CommandClass: r.CommandClass,
+		ConnectionId: r.ConnectionId,
+		Status:       r.Status,
+		SqlText:      r.SqlText,
+		User:         r.User,
+		Host:         r.Host,
+		OsUser:       r.OsUser,
+		Ip:           r.Ip,
+		Db:           r.Db,
+	}
+	if ts, err := time.Parse("2006-01-02T15:04:05 MST", r.Timestamp); err == nil {
+		e.Ts = ts.UTC()
+	}
+	if len(e.SqlText) > MAX_SQL_LEN {
+		e.SqlText = e.SqlText[0:MAX_SQL_LEN]
+	}
+	return e
+}
+
+/**
+ * Parse returns the events of the complete records in the lines, which don't
+ * have the trailing newline, and the number of bytes of the lines up to the
+ * end of the last complete record, i.e. where to read the next lines from.
+ * A new format record that isn't complete, e.g. because the plugin is still
+ * writing it, isn't consumed.  Lines that aren't valid records are skipped and
+ * counted as bad.
+ */
+func Parse(format string, lines []string) (events []Event, n int64, bad uint) {
+	events, _, n, bad = parse(format, lines)
+	return events, n, bad
+}
+
+// parse is Parse that also returns where each event's record ends in the
+// lines, so a tailer can continue after the last one it sent.
+func parse(format string, lines []string) (events []Event, ends []int64, n int64, bad uint) {
+	events = []Event{}
+	ends = []int64{}
+	var pos int64
+	var buf []string // lines of the new format record being read
+	for _, line := range lines {
+		pos += int64(len(line)) + 1 // newline
+		line = strings.TrimSpace(line)
+
+		switch format {
+		case FORMAT_JSON:
+			if line == "" {
+				n = pos
+				continue
+			}
+			v := struct {
+				Record record `json:"audit_record"`
+			}{}
+			if err := json.Unmarshal([]byte(line), &v); err != nil || v.Record.Name == "" {
+				bad++
+			} else {
+				events = append(events, v.Record.event())
+				ends = append(ends, pos)
+			}
+			n = pos
+		case FORMAT_NEW:
+			if strings.HasPrefix(line, "<AUDIT_RECORD>") {
+				if buf != nil {
+					bad++ // record cut by a crash
+				}
+				buf = []string{}
+			} else if buf == nil {
+				// <?xml ...?>, <AUDIT>, </AUDIT>, or the rest of a record
+				// cut by a crash.
+				n = pos
+				continue
+			}
+			buf = append(buf, line)
+			if !strings.HasSuffix(line, "</AUDIT_RECORD>") {
+				continue
+			}
+			r := record{}
+			if err := xml.Unmarshal([]byte(strings.Join(buf, "\n")), &r); err != nil || r.Name == "" {
+				bad++
+			} else {
+				events = append(events, r.event())
+				ends = append(ends, pos)
+			}
+			buf = nil
+			n = pos
+		}
+	}
+	return events, ends, n, bad
+}
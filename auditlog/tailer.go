@@ -0,0 +1,159 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package auditlog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/go-mysql/query"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mysqllog"
+	"github.com/percona/percona-agent/pct"
+)
+
+// A Report is new events of an audit log, spooled as "auditlog" data.
+type Report struct {
+	proto.ServiceInstance
+	Ts     time.Time // UTC
+	File   string
+	Events []Event
+}
+
+/**
+ * auditLog is the mysqllog.Log of an audit log tailer.  It spools the events
+ * that match Config.Events and Config.Commands, at most MAX_EVENTS per report.
+ * Audit trails shouldn't have gaps, so the tailer has a position file: the
+ * position is saved after the reports are spooled, and the tailer continues
+ * there when it's started again.  If the spool doesn't take a report, the
+ * position is saved after the last report it took, and the records after it
+ * are read again next interval, so events can be sent twice but not lost;
+ * Event.Record is unique, so they can be deduped.
+ */
+type auditLog struct {
+	config Config
+	source func() (string, string, error) // audit log file and format
+	spool  data.Spooler
+	// --
+	name     string
+	format   string // of the file source returned
+	events   map[string]bool
+	commands map[string]bool
+	sent     uint64
+	filtered uint64
+	bad      uint64
+	status   *pct.Status
+}
+
+// NewTailer returns a tailer that sends the events of the audit log returned
+// by source, and saves its position in posFile ("" = don't save it).
+func NewTailer(logger *pct.Logger, config Config, source func() (string, string, error), tickChan chan time.Time, spool data.Spooler, posFile string) *mysqllog.Tailer {
+	name := logger.Service()
+	log := &auditLog{
+		config: config,
+		source: source,
+		spool:  spool,
+		// --
+		name:     name,
+		events:   make(map[string]bool),
+		commands: make(map[string]bool),
+		status:   pct.NewStatus([]string{name + "-events"}),
+	}
+	for _, e := range config.Events {
+		log.events[strings.ToLower(e)] = true
+	}
+	for _, c := range config.Commands {
+		log.commands[strings.ToLower(c)] = true
+	}
+	log.updateStatus()
+	return mysqllog.NewLogTailer(logger, config, log, tickChan, posFile)
+}
+
+func (l *auditLog) Source() (string, error) {
+	file, format, err := l.source()
+	if err != nil {
+		return "", err
+	}
+	l.format = format
+	return file, nil
+}
+
+// Send spools the events that match the config.  It returns the number of bytes
+// up to the end of the last record spooled, or the last complete record if all
+// were spooled.
+func (l *auditLog) Send(now time.Time, file string, lines []string, eof bool) (int64, error) {
+	defer l.updateStatus()
+	events, ends, n, bad := parse(l.format, lines)
+	l.bad += uint64(bad)
+
+	var done int64 // bytes of the records spooled or filtered
+	matched := []Event{}
+	matchedEnds := []int64{}
+	for i, e := range events {
+		if !l.match(e) {
+			l.filtered++
+			if len(matched) == 0 {
+				done = ends[i]
+			}
+			continue
+		}
+		if l.config.Redact && e.SqlText != "" {
+			e.SqlText = query.Fingerprint(e.SqlText)
+		}
+		matched = append(matched, e)
+		matchedEnds = append(matchedEnds, ends[i])
+	}
+	for i := 0; i < len(matched); i += MAX_EVENTS {
+		end := i + MAX_EVENTS
+		if end > len(matched) {
+			end = len(matched)
+		}
+		report := &Report{
+			ServiceInstance: l.config.ServiceInstance,
+			Ts:              now.UTC(),
+			File:            file,
+			Events:          matched[i:end],
+		}
+		if err := l.spool.Write("auditlog", report); err != nil {
+			return done, fmt.Errorf("Cannot spool %d events from %s, will read them again: %s", len(matched)-i, file, err)
+		}
+		l.sent += uint64(end - i)
+		done = matchedEnds[end-1]
+	}
+	return n, nil
+}
+
+func (l *auditLog) Status() map[string]string {
+	return l.status.All()
+}
+
+func (l *auditLog) match(e Event) bool {
+	if len(l.events) > 0 && !l.events[strings.ToLower(e.Name)] {
+		return false
+	}
+	if len(l.commands) > 0 && !l.commands[strings.ToLower(e.CommandClass)] {
+		return false
+	}
+	return true
+}
+
+func (l *auditLog) updateStatus() {
+	l.status.Update(l.name+"-events", fmt.Sprintf("%d sent, %d filtered, %d bad", l.sent, l.filtered, l.bad))
+}
@@ -23,6 +23,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
 	"io/ioutil"
 	golog "log"
 	"net/http"
@@ -94,6 +95,8 @@ func (cli *Cli) doCmd(args []string) {
 		cli.send(args)
 	case "info":
 		cli.info(args)
+	case "estimate":
+		cli.estimate(args)
 	default:
 		fmt.Println("Unknown command: " + args[0])
 		return
@@ -104,7 +107,7 @@ func (cli *Cli) doCmd(args []string) {
 }
 
 func (cli *Cli) help() {
-	fmt.Printf("Commands:\n  connect\n  agent\n  status\n  ?\n\n")
+	fmt.Printf("Commands:\n  connect\n  agent\n  status\n  estimate\n  ?\n\n")
 	fmt.Printf("Prompt:\n  agent@api>\n  Use 'connect' command to connect to API, then 'agent' command to set agent.\n\n")
 	fmt.Printf("CTRL-C to exit\n\n")
 }
@@ -373,6 +376,61 @@ func (cli *Cli) info(args []string) {
 	}
 }
 
+func (cli *Cli) estimate(args []string) {
+	if !cli.connected {
+		fmt.Println("Not connected to API.  Use 'connect' command.")
+		return
+	}
+	if cli.agentUuid == "" {
+		fmt.Println("Agent UUID not set.  Use 'agent' command.")
+		return
+	}
+	if len(args) != 2 {
+		fmt.Printf("ERROR: Invalid number of args: got %d, expected 2\n", len(args))
+		fmt.Println("Usage: estimate config-file")
+		fmt.Println("Exmaple: estimate mm-mysql-1.conf")
+		return
+	}
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	cmd := &proto.Cmd{
+		Ts:        time.Now(),
+		User:      "percona-agent-cli",
+		AgentUuid: cli.agentUuid,
+		Cmd:       "EstimateMetrics",
+		Service:   "mm",
+		Data:      data,
+	}
+	reply, err := cli.Put(cli.agentLinks["self"]+"/cmd", cmd)
+	if err != nil {
+		golog.Println(err)
+		return
+	}
+	if reply.Error != "" {
+		fmt.Printf("ERROR: %s\n", reply.Error)
+		return
+	}
+	e := &mm.Estimate{}
+	if err := json.Unmarshal(reply.Data, e); err != nil {
+		fmt.Printf("Invalid reply: %s\n", err)
+		return
+	}
+	for _, g := range e.Groups {
+		interval := g.Interval
+		if interval < e.Collect {
+			interval = e.Collect
+		}
+		fmt.Printf("  %-24s %8d every %ds  %s\n", g.Name, g.Metrics, interval, g.Note)
+	}
+	fmt.Printf("%d metrics, %d values per %ds report\n", e.Metrics, e.Values, e.Report)
+	for _, note := range e.Notes {
+		fmt.Println("Note: " + note)
+	}
+}
+
 func (cli *Cli) Get(url string) []byte {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
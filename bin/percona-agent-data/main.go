@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
+	pctData "github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/mm"
 	"github.com/percona/percona-agent/qan"
 	"io/ioutil"
@@ -42,6 +43,12 @@ func main() {
 			fmt.Println(err)
 			continue
 		}
+		version, content, err := pctData.DecodeSpoolFile(content)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("Version: %d\n", version)
 		data := &proto.Data{}
 		if err := json.Unmarshal(content, data); err != nil {
 			fmt.Println(err)
@@ -0,0 +1,310 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+/**
+ * percona-agent-fixtures records real mm collections from a live server and
+ * writes them as test/mm/metrics fixtures: <name>-1.json, <name>-2.json, etc.
+ * and the report the aggregator makes from them, <name>r.json.  It uses the
+ * monitor config and instances in an agent basedir, e.g. for a MySQL monitor:
+ *
+ *   percona-agent-fixtures -basedir /usr/local/percona/percona-agent \
+ *     -service mysql -instance-id 1 -name c006
+ *
+ * Collections are normalized so fixtures are stable and don't leak details of
+ * the server: timestamps start at 2009-11-10 23:00:00 (like c001), instance ID
+ * is 1, the hostname in metric names is "host1", numbers are rounded, and
+ * metrics are sorted by name.  All collections are in the first report
+ * interval, so a test sends another collection with Ts >= 1257894000+Report
+ * to make the aggregator report.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/monitor"
+	mrmsMonitor "github.com/percona/percona-agent/mrms/monitor"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FIXTURE_TS          = 1257894000 // 2009-11-10 23:00:00 UTC
+	FIXTURE_INSTANCE_ID = 1
+	FIXTURE_HOSTNAME    = "host1"
+)
+
+var (
+	flagBasedir     string
+	flagService     string
+	flagInstanceId  uint
+	flagConfig      string
+	flagName        string
+	flagOut         string
+	flagCollections uint
+	flagPrecision   uint
+	flagDebug       bool
+)
+
+func init() {
+	flag.StringVar(&flagBasedir, "basedir", pct.DEFAULT_BASEDIR, "Agent basedir with instances and mm configs")
+	flag.StringVar(&flagService, "service", "mysql", "Service to monitor: mysql, server, etc.")
+	flag.UintVar(&flagInstanceId, "instance-id", 1, "Service instance ID")
+	flag.StringVar(&flagConfig, "config", "", "mm config file (default: <basedir>/config/mm-<service>-<instance-id>.conf)")
+	flag.StringVar(&flagName, "name", "", "Fixture name, e.g. c006")
+	flag.StringVar(&flagOut, "out", "test/mm/metrics", "Output dir")
+	flag.UintVar(&flagCollections, "collections", 3, "Number of collections")
+	flag.UintVar(&flagPrecision, "precision", 3, "Round numbers to this many decimals")
+	flag.BoolVar(&flagDebug, "debug", false, "Print all log entries, not only warnings and errors")
+}
+
+func main() {
+	flag.Parse()
+	if flagName == "" || len(flag.Args()) != 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if err := pct.Basedir.Init(flagBasedir); err != nil {
+		return err
+	}
+	logChan := make(chan *proto.LogEntry, 100)
+	go printLog(logChan)
+
+	// Load the mm config like the mm manager does for StartService.
+	if flagConfig == "" {
+		flagConfig = pct.Basedir.ConfigFile(fmt.Sprintf("mm-%s-%d", flagService, flagInstanceId))
+	}
+	configData, err := ioutil.ReadFile(flagConfig)
+	if err != nil {
+		return err
+	}
+	config := &mm.Config{}
+	if err := json.Unmarshal(configData, config); err != nil {
+		return err
+	}
+	if err := config.ApplyProfile(); err != nil {
+		return err
+	}
+	if config.Collect == 0 || config.Report == 0 {
+		return errors.New("Collect and Report must be > 0")
+	}
+	if flagCollections == 0 || flagCollections*config.Collect > config.Report {
+		return fmt.Errorf("%d collections every %ds don't fit in the %ds report interval",
+			flagCollections, config.Collect, config.Report)
+	}
+
+	// Make the monitor.
+	repo := instance.NewRepo(pct.NewLogger(logChan, "instance-repo"), pct.Basedir.Dir("config"), nil)
+	if err := repo.Init(); err != nil {
+		return err
+	}
+	mrm := mrmsMonitor.NewMonitor(pct.NewLogger(logChan, "mrms-monitor"), &mysql.RealConnectionFactory{})
+	factory := monitor.NewFactory(logChan, repo, mrm)
+	m, err := factory.Make(flagService, flagInstanceId, configData)
+	if err != nil {
+		return err
+	}
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	if err := m.Start(tickChan, collectionChan); err != nil {
+		return err
+	}
+	defer m.Stop()
+
+	// Collect, normalize, and write the collections.
+	hostname, _ := os.Hostname()
+	collections := []*mm.Collection{}
+	for i := uint(0); len(collections) < int(flagCollections); i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(config.Collect) * time.Second)
+		}
+		if i >= 2*flagCollections {
+			return fmt.Errorf("Got only %d of %d collections", len(collections), flagCollections)
+		}
+		tickChan <- time.Now()
+		select {
+		case c := <-collectionChan:
+			n := len(collections)
+			Normalize(c, FIXTURE_TS+int64(n)*int64(config.Collect), hostname, flagPrecision)
+			file := filepath.Join(flagOut, fmt.Sprintf("%s-%d.json", flagName, n+1))
+			if err := ioutil.WriteFile(file, FormatCollection(c), 0644); err != nil {
+				return err
+			}
+			fmt.Println(file)
+			collections = append(collections, c)
+		case <-time.After(time.Duration(config.Collect)*time.Second + 5*time.Second):
+			// Some monitors don't send the first collection, e.g. when
+			// they need two values to compute rates.
+			fmt.Println("No collection for tick", i+1)
+		}
+	}
+
+	// Aggregate the collections and write the report.
+	report, err := aggregate(logChan, config, collections)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(flagOut, flagName+"r.json")
+	if err := ioutil.WriteFile(file, append(bytes, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Println(file)
+	return nil
+}
+
+// Normalize sets the collection's timestamp and instance ID to fixture values,
+// replaces the hostname in metric names, rounds numbers, and sorts metrics by
+// name.
+func Normalize(c *mm.Collection, ts int64, hostname string, precision uint) {
+	c.Ts = ts
+	c.InstanceId = FIXTURE_INSTANCE_ID
+	p := math.Pow10(int(precision))
+	for i := range c.Metrics {
+		if hostname != "" {
+			c.Metrics[i].Name = strings.Replace(c.Metrics[i].Name, hostname, FIXTURE_HOSTNAME, -1)
+		}
+		c.Metrics[i].Number = math.Floor(c.Metrics[i].Number*p+0.5) / p
+	}
+	sort.Sort(ByName(c.Metrics))
+	for i := range c.Events {
+		c.Events[i].Ts = ts
+		if hostname != "" {
+			c.Events[i].Message = strings.Replace(c.Events[i].Message, hostname, FIXTURE_HOSTNAME, -1)
+		}
+	}
+}
+
+// FormatCollection formats the collection like the hand-written fixtures: one
+// metric per line, no empty String values.
+func FormatCollection(c *mm.Collection) []byte {
+	type metric struct {
+		Name   string
+		Type   string
+		Number float64
+		String string `json:",omitempty"`
+	}
+	lines := []string{}
+	for _, m := range c.Metrics {
+		bytes, _ := json.Marshal(metric{m.Name, m.Type, m.Number, m.String})
+		lines = append(lines, "    "+string(bytes))
+	}
+	out := fmt.Sprintf("{\n  \"Service\":%q,\n  \"InstanceId\":%d,\n  \"Ts\":%d,\n  \"Metrics\":[\n%s\n  ]",
+		c.Service, c.InstanceId, c.Ts, strings.Join(lines, ",\n"))
+	if len(c.Events) > 0 {
+		lines = []string{}
+		for _, e := range c.Events {
+			bytes, _ := json.Marshal(e)
+			lines = append(lines, "    "+string(bytes))
+		}
+		out += fmt.Sprintf(",\n  \"Events\":[\n%s\n  ]", strings.Join(lines, ",\n"))
+	}
+	return []byte(out + "\n}\n")
+}
+
+func aggregate(logChan chan *proto.LogEntry, config *mm.Config, collections []*mm.Collection) (*mm.Report, error) {
+	derived, err := mm.MakeDerivedMetrics(config.Derived)
+	if err != nil {
+		return nil, err
+	}
+	si := proto.ServiceInstance{Service: config.Service, InstanceId: FIXTURE_INSTANCE_ID}
+	spool := &reportSpooler{reportChan: make(chan *mm.Report, 1)}
+	collectionChan := make(chan *mm.Collection, len(collections)+1)
+	a := mm.NewAggregator(pct.NewLogger(logChan, "mm-ag"), int64(config.Report), collectionChan, spool)
+	a.SetDerived(si, derived)
+	a.SetPercentiles(si, config.Percentiles)
+	a.SetAnomaly(si, config.AnomalySigma, config.AnomalyWindow)
+	a.Start()
+	defer a.Stop()
+
+	for _, c := range collections {
+		collectionChan <- c
+	}
+	// The first collection of the next interval makes the aggregator report.
+	collectionChan <- &mm.Collection{ServiceInstance: si, Ts: FIXTURE_TS + int64(config.Report)}
+
+	select {
+	case report := <-spool.reportChan:
+		return report, nil
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("Timeout waiting for report")
+	}
+}
+
+func printLog(logChan chan *proto.LogEntry) {
+	for entry := range logChan {
+		if flagDebug || entry.Level <= proto.LOG_WARNING {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", entry.Service, entry.Msg)
+		}
+	}
+}
+
+type ByName []mm.Metric
+
+func (a ByName) Len() int           { return len(a) }
+func (a ByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// reportSpooler is a data.Spooler that only receives the aggregator's report.
+type reportSpooler struct {
+	reportChan chan *mm.Report
+}
+
+func (s *reportSpooler) Start(sz data.Serializer) error   { return nil }
+func (s *reportSpooler) Stop() error                      { return nil }
+func (s *reportSpooler) Status() map[string]string        { return nil }
+func (s *reportSpooler) Files() <-chan string             { return nil }
+func (s *reportSpooler) CancelFiles()                     {}
+func (s *reportSpooler) Read(file string) ([]byte, error) { return nil, nil }
+func (s *reportSpooler) Remove(file string) error         { return nil }
+func (s *reportSpooler) Reject(file string) error         { return nil }
+func (s *reportSpooler) Purge(now time.Time, limits proto.DataSpoolLimits) (int, map[string][]string) {
+	return 0, nil
+}
+
+func (s *reportSpooler) Write(service string, v interface{}) error {
+	if report, ok := v.(*mm.Report); ok {
+		select {
+		case s.reportChan <- report:
+		default:
+		}
+	}
+	return nil
+}
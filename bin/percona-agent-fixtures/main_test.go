@@ -0,0 +1,69 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type FixturesTestSuite struct{}
+
+var _ = Suite(&FixturesTestSuite{})
+
+func (s *FixturesTestSuite) TestNormalize(t *C) {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 12},
+		Ts:              1420070400,
+		Metrics: []mm.Metric{
+			{Name: "mysql/status/threads_running", Type: "gauge", Number: 3},
+			{Name: "db42.example.com/load", Type: "gauge", Number: 0.123456},
+			{Name: "mysql/status/bytes_sent", Type: "counter", Number: 1234567890},
+			{Name: "mysql/version", Type: "string", String: "5.6.22"},
+		},
+		Events: []mm.Event{
+			{Ts: 1420070401, Type: "mysql/checksum/diff", Level: mm.EVENT_WARNING, Message: "db42.example.com: t1"},
+		},
+	}
+	Normalize(c, FIXTURE_TS, "db42.example.com", 3)
+
+	t.Check(c.Ts, Equals, int64(FIXTURE_TS))
+	t.Check(c.InstanceId, Equals, uint(FIXTURE_INSTANCE_ID))
+	t.Check(c.Metrics, DeepEquals, []mm.Metric{
+		{Name: "host1/load", Type: "gauge", Number: 0.123},
+		{Name: "mysql/status/bytes_sent", Type: "counter", Number: 1234567890},
+		{Name: "mysql/status/threads_running", Type: "gauge", Number: 3},
+		{Name: "mysql/version", Type: "string", String: "5.6.22"},
+	})
+	t.Check(c.Events[0].Ts, Equals, int64(FIXTURE_TS))
+	t.Check(c.Events[0].Message, Equals, "host1: t1")
+
+	// The formatted fixture is a collection like the hand-written ones.
+	data := FormatCollection(c)
+	t.Check(string(data[:60]), Equals, "{\n  \"Service\":\"mysql\",\n  \"InstanceId\":1,\n  \"Ts\":1257894000,\n")
+	got := &mm.Collection{}
+	err := json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, c)
+}
@@ -64,6 +64,9 @@ func (a *Api) CreateServerInstance(si *proto.ServerInstance) (*proto.ServerInsta
 	}
 	// Create new instance, if it already exist then just use it
 	// todo: better handling of duplicate instance
+	if err := limitError(resp, "https://cloud.percona.com"); err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
 		return nil, fmt.Errorf("Failed to create server instance (status code %d)", resp.StatusCode)
 	}
@@ -127,6 +130,8 @@ func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance
 		if resp.StatusCode != http.StatusOK {
 			return nil, fmt.Errorf("Failed to update MySQL instance (status code %d)", resp.StatusCode)
 		}
+	} else if err := limitError(resp, "https://cloud.percona.com"); err != nil {
+		return nil, err
 	} else if resp.StatusCode != http.StatusCreated {
 		return nil, fmt.Errorf("Failed to create MySQL instance (status code %d)", resp.StatusCode)
 	}
@@ -172,12 +177,8 @@ func (a *Api) CreateAgent(agent *proto.Agent) (*proto.Agent, error) {
 
 	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusConflict {
 		// agent was created or already exist - either is ok, continue
-	} else if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-Percona-Agents-Limit") != "" {
-		return nil, fmt.Errorf(
-			"Maximum number of %s agents exceeded.\n"+
-				"Go to https://cloud.percona.com/agents and remove unused agents or contact Percona to increase limit.",
-			resp.Header.Get("X-Percona-Agents-Limit"),
-		)
+	} else if err := limitError(resp, "https://cloud.percona.com/agents"); err != nil {
+		return nil, err
 	} else {
 		return nil, fmt.Errorf("Failed to create agent instance (status code %d)", resp.StatusCode)
 	}
@@ -370,3 +371,18 @@ func (a *Api) GetQanConfig(mi *proto.MySQLInstance) (*proto.AgentConfig, error)
 	}
 	return agentConfig, nil
 }
+
+// limitError returns an error telling the user what to do if the API refused
+// to create a resource because the account limit was reached, else nil.
+func limitError(resp *http.Response, url string) error {
+	if resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+	apiErr := pct.CheckLimitHeaders(resp)
+	if apiErr == nil {
+		return nil
+	}
+	limitErr := apiErr.Err.(pct.LimitError)
+	return fmt.Errorf("%s.\nGo to %s and remove unused %s or contact Percona to increase limit.",
+		limitErr, url, limitErr.Resource)
+}
@@ -22,10 +22,10 @@ import (
 	"github.com/mewpkg/gopass"
 	"github.com/percona/percona-agent/agent"
 	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
 	"log"
 	"math/rand"
 	"os/exec"
-	"os/user"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -291,6 +291,10 @@ func (i *Installer) getDSNFromUser(dsn *mysql.DSN) error {
 }
 
 func (i *Installer) autodetectDSN(dsn *mysql.DSN) error {
+	// With several mysqld on the host, the mysql client defaults are only
+	// for one of them, so use the one given by -mysqld-group.
+	i.detectMysqld(dsn)
+
 	params := []string{}
 	if i.flags.String["mysql-defaults-file"] != "" {
 		params = append(params, "--defaults-file="+i.flags.String["mysql-defaults-file"])
@@ -327,9 +331,8 @@ func (i *Installer) autodetectDSN(dsn *mysql.DSN) error {
 		dsn.Socket = autoDSN.Socket
 	}
 	if dsn.Username == "" {
-		user, err := user.Current()
-		if err == nil {
-			dsn.Username = user.Username
+		if username, err := pct.CurrentUser(); err == nil {
+			dsn.Username = username
 		}
 	}
 	if i.flags.Bool["debug"] {
@@ -338,6 +341,40 @@ func (i *Installer) autodetectDSN(dsn *mysql.DSN) error {
 	return nil
 }
 
+func (i *Installer) detectMysqld(dsn *mysql.DSN) {
+	if dsn.Socket != "" || dsn.Hostname != "" {
+		return // -mysql-socket or -mysql-host
+	}
+	all, err := mysql.DiscoverMysqld("/proc", mysql.DefaultOptionFiles)
+	if err != nil {
+		if i.flags.Bool["debug"] {
+			log.Printf("Error discovering mysqld: %v", err)
+		}
+		return
+	}
+	group := i.flags.String["mysqld-group"]
+	if group == "" {
+		if len(all) > 1 {
+			fmt.Printf("Found %d mysqld on this host:\n", len(all))
+			for _, m := range all {
+				fmt.Printf("  [%s] %s (pid %d)\n", m.Group, m.DSN().To(), m.Pid)
+			}
+			fmt.Println("Use -mysqld-group to choose one, else the MySQL client defaults are used")
+		}
+		return
+	}
+	for _, m := range all {
+		if m.Group == group {
+			mDSN := m.DSN()
+			dsn.Socket = mDSN.Socket
+			dsn.Hostname = mDSN.Hostname
+			dsn.Port = mDSN.Port
+			return
+		}
+	}
+	fmt.Printf("No mysqld running with option group [%s]\n", group)
+}
+
 func ParseMySQLDefaults(output string) *mysql.DSN {
 	var re *regexp.Regexp
 	var result []string // Result of FindStringSubmatch
@@ -395,7 +432,7 @@ func (i *Installer) verifyMySQLConnection(dsn mysql.DSN) (err error) {
 		return err
 	}
 	if i.flags.Bool["debug"] {
-		log.Printf("verifyMySQLConnection: %#v %s\n", dsn, dsnString)
+		log.Printf("verifyMySQLConnection: %s\n", pct.RedactDSN(dsnString))
 	}
 	conn := mysql.NewConnection(dsnString)
 	if err := conn.Connect(1); err != nil {
@@ -59,6 +59,7 @@ var (
 	flagMySQLHost               string
 	flagMySQLPort               string
 	flagMySQLSocket             string
+	flagMySQLDGroup             string
 	flagMySQLMaxUserConnections int64
 )
 
@@ -90,6 +91,7 @@ func init() {
 	flag.StringVar(&flagMySQLHost, "mysql-host", "", "MySQL host")
 	flag.StringVar(&flagMySQLPort, "mysql-port", "", "MySQL port")
 	flag.StringVar(&flagMySQLSocket, "mysql-socket", "", "MySQL socket file")
+	flag.StringVar(&flagMySQLDGroup, "mysqld-group", "", "Option group of the mysqld to install for if there are several, e.g. mysqld2 (mysqld_multi) or mysqld@2 (systemd)")
 	flag.Int64Var(&flagMySQLMaxUserConnections, "mysql-max-user-connections", 5, "Max number of MySQL connections")
 }
 
@@ -148,6 +150,7 @@ func main() {
 			"mysql-host":          flagMySQLHost,
 			"mysql-port":          flagMySQLPort,
 			"mysql-socket":        flagMySQLSocket,
+			"mysqld-group":        flagMySQLDGroup,
 		},
 		Int64: map[string]int64{
 			"mysql-max-user-connections": flagMySQLMaxUserConnections,
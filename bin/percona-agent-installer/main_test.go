@@ -662,6 +662,42 @@ func (s *MainTestSuite) TestInstallFailsOnAgentsLimit(t *C) {
 	s.expectConfigs([]string{}, t)
 	s.expectMysqlUserNotExists(t)
 }
+func (s *MainTestSuite) TestInstallFailsOnOSLimit(t *C) {
+	// Register required api handlers
+	s.fakeApi.AppendPing()
+	s.fakeApi.AppendAgents(s.agent)
+	s.fakeApi.AppendAgentsUuid(s.agent)
+	s.fakeApi.AppendLimit("/instances/server", "OS", 1)
+
+	cmd := exec.Command(
+		s.bin,
+		"-basedir="+pct.Basedir.Path(),
+		"-api-host="+s.fakeApi.URL(),
+		"-mysql-defaults-file="+test.RootDir+"/installer/my.cnf-root_user",
+		"-api-key="+s.apiKey,
+	)
+
+	cmdTest := cmdtest.NewCmdTest(cmd)
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
+	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
+
+	t.Check(cmdTest.ReadLine(), Equals, "Maximum number of 1 OS instances exceeded.\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Go to https://cloud.percona.com and remove unused OS instances or contact Percona to increase limit.\n")
+	t.Check(cmdTest.ReadLine(), Equals, "") // No more data
+
+	err := cmd.Wait()
+	t.Check(err, ErrorMatches, "exit status 1")
+
+	s.expectConfigs([]string{}, t)
+	s.expectMysqlUserNotExists(t)
+}
+
 func (s *MainTestSuite) TestInstallWorksWithExistingMySQLInstanceAndInstanceIsUpdated(t *C) {
 	// Register required api handlers
 	s.fakeApi.AppendPing()
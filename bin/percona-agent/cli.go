@@ -0,0 +1,377 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * Subcommands query and change the running agent through its admin server
+ * (see agent/admin.go), so it must be enabled with Admin in the agent config:
+ *
+ *   percona-agent status [service]          Status, like the Status cmd
+ *   percona-agent config get [tool]         Configs, like GetAllConfigs
+ *   percona-agent config set <tool> <file>  Set the tool config from a JSON
+ *                                           file, or - for stdin
+ *   percona-agent list-instances            Instances, DSNs redacted
+ *   percona-agent pause <duration>          Pause tools, e.g. pause 30m
+ *   percona-agent resume                    Resume paused tools
+ *
+ * The admin server address is the agent config Admin, or -admin.  If the
+ * agent config has LocalAuth.TokenFile, the token is sent, so the user must
+ * be able to read it.  Admin servers with TLS aren't supported.
+ *
+ * Config set is the SetConfig cmd for tools that have it (SET_CONFIG_TOOLS).
+ * Other tools, like mm and qan, are configured by starting them, so it's
+ * StartService with the config, which restarts the tool if the config
+ * changed.  Cmds are sent as the current user.
+ */
+
+var SET_CONFIG_TOOLS = map[string]bool{
+	"agent": true,
+	"log":   true,
+	"data":  true,
+	"alert": true,
+}
+
+var subcommands = map[string]func(*adminClient, []string) error{
+	"status":         cliStatus,
+	"config":         cliConfig,
+	"list-instances": cliListInstances,
+	"pause":          cliPause,
+	"resume":         cliResume,
+}
+
+const ADMIN_TIMEOUT = 30 * time.Second // longer than cmd timeout (20s)
+
+func isSubcommand(name string) bool {
+	_, ok := subcommands[name]
+	return ok
+}
+
+func runSubcommand(args []string) error {
+	if flagStateDir != "" {
+		if err := pct.Basedir.InitReadOnly(flagBasedir, flagStateDir); err != nil {
+			return err
+		}
+	} else if err := pct.Basedir.Init(flagBasedir); err != nil {
+		return err
+	}
+	client, err := newAdminClient(flagAdmin)
+	if err != nil {
+		return err
+	}
+	return subcommands[args[0]](client, args[1:])
+}
+
+// --------------------------------------------------------------------------
+
+type adminClient struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func newAdminClient(addr string) (*adminClient, error) {
+	config := &agent.Config{}
+	configErr := pct.Basedir.ReadConfig("agent", config)
+	if addr == "" {
+		if configErr != nil {
+			return nil, fmt.Errorf("Cannot read agent config: %s", configErr)
+		}
+		addr = config.Admin
+	}
+	if addr == "" {
+		return nil, errors.New("Admin server is not enabled: set Admin in the agent config, e.g. unix:" +
+			pct.Basedir.File("admin.sock") + ", and restart the agent")
+	}
+	network, address, err := agent.ParseAdminAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &adminClient{}
+	if config.LocalAuth != nil {
+		if config.LocalAuth.TLSCert != "" && network == "tcp" {
+			return nil, errors.New("Admin server with TLS is not supported, use a Unix socket")
+		}
+		if config.LocalAuth.TokenFile != "" {
+			token, err := ioutil.ReadFile(config.LocalAuth.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read admin token: %s", err)
+			}
+			c.token = strings.TrimSpace(string(token))
+		}
+	}
+
+	transport := &http.Transport{}
+	if network == "unix" {
+		transport.Dial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", address)
+		}
+		c.url = "http://admin"
+	} else {
+		c.url = "http://" + address
+	}
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   ADMIN_TIMEOUT,
+	}
+	return c, nil
+}
+
+func (c *adminClient) do(method, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to agent admin server: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Agent admin server: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *adminClient) get(path string, v interface{}) error {
+	return c.do("GET", path, nil, v)
+}
+
+func (c *adminClient) cmd(cmd *proto.Cmd) (*proto.Reply, error) {
+	username, err := pct.CurrentUser()
+	if err != nil {
+		username = fmt.Sprintf("uid %d", os.Getuid())
+	}
+	cmd.Ts = time.Now().UTC()
+	cmd.User = username + " (percona-agent CLI)"
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	reply := &proto.Reply{}
+	if err := c.do("POST", "/cmd", data, reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return reply, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// --------------------------------------------------------------------------
+
+func cliStatus(c *adminClient, args []string) error {
+	path := "/status"
+	switch len(args) {
+	case 0:
+	case 1:
+		path += "/" + args[0]
+	default:
+		return errors.New("Usage: percona-agent status [service]")
+	}
+	status := map[string]string{}
+	if err := c.get(path, &status); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(status))
+	for k := range status {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", k, status[k])
+	}
+	return w.Flush()
+}
+
+func cliConfig(c *adminClient, args []string) error {
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "get":
+		tool := ""
+		if len(args) == 2 {
+			tool = args[1]
+		}
+		return cliConfigGet(c, tool)
+	case len(args) == 3 && args[0] == "set":
+		return cliConfigSet(c, args[1], args[2])
+	}
+	return errors.New("Usage: percona-agent config get [tool] | config set <tool> <file|->")
+}
+
+func cliConfigGet(c *adminClient, tool string) error {
+	configs := agent.AdminConfigs{}
+	if err := c.get("/configs", &configs); err != nil {
+		return err
+	}
+	n := 0
+	for _, config := range configs.Configs {
+		if tool != "" && config.InternalService != tool {
+			continue
+		}
+		n++
+		name := config.InternalService
+		if config.ExternalService.Service != "" {
+			name += fmt.Sprintf(" %s-%d", config.ExternalService.Service, config.ExternalService.InstanceId)
+		}
+		if !config.Running {
+			name += " (not running)"
+		}
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, []byte(config.Config), "", "  "); err != nil {
+			pretty.Reset()
+			pretty.WriteString(config.Config)
+		}
+		fmt.Printf("%s\n%s\n", name, pretty.String())
+	}
+	for _, err := range configs.Errors {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+	if tool != "" && n == 0 {
+		return errors.New("No config for " + tool)
+	}
+	return nil
+}
+
+func cliConfigSet(c *adminClient, tool, file string) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("Invalid %s config: %s", tool, err)
+	}
+
+	cmd := &proto.Cmd{
+		Service: tool,
+		Cmd:     "StartService",
+		Data:    data,
+	}
+	if SET_CONFIG_TOOLS[tool] {
+		cmd.Cmd = "SetConfig"
+	}
+	if _, err := c.cmd(cmd); err != nil {
+		return err
+	}
+	fmt.Printf("%s config set\n", tool)
+	return nil
+}
+
+func cliListInstances(c *adminClient, args []string) error {
+	if len(args) > 0 {
+		return errors.New("Usage: percona-agent list-instances")
+	}
+	instances := map[string]json.RawMessage{}
+	if err := c.get("/instances", &instances); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, instances[name]); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\n", name, compact.String())
+	}
+	return w.Flush()
+}
+
+func cliPause(c *adminClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: percona-agent pause <duration>, e.g. 30m")
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(agent.Pause{Duration: uint(d.Seconds())})
+	if err != nil {
+		return err
+	}
+	reply, err := c.cmd(&proto.Cmd{
+		Service: "agent",
+		Cmd:     "Pause",
+		Data:    data,
+	})
+	if err != nil {
+		return err
+	}
+	services := []string{}
+	if err := json.Unmarshal(reply.Data, &services); err != nil {
+		return err
+	}
+	fmt.Printf("Paused %s for %s\n", strings.Join(services, ", "), d)
+	return nil
+}
+
+func cliResume(c *adminClient, args []string) error {
+	if len(args) > 0 {
+		return errors.New("Usage: percona-agent resume")
+	}
+	reply, err := c.cmd(&proto.Cmd{
+		Service: "agent",
+		Cmd:     "Resume",
+	})
+	if err != nil {
+		return err
+	}
+	services := []string{}
+	if err := json.Unmarshal(reply.Data, &services); err != nil {
+		return err
+	}
+	fmt.Printf("Resumed %s\n", strings.Join(services, ", "))
+	return nil
+}
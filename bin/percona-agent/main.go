@@ -25,7 +25,7 @@ import (
 	golog "log"
 	"os"
 	"os/signal"
-	"os/user"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
@@ -42,26 +42,21 @@ import (
 	mrmsMonitor "github.com/percona/percona-agent/mrms/monitor"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
-	pctCmd "github.com/percona/percona-agent/pct/cmd"
-	"github.com/percona/percona-agent/qan"
-	qanFactory "github.com/percona/percona-agent/qan/factory"
-	"github.com/percona/percona-agent/qan/perfschema"
-	"github.com/percona/percona-agent/qan/slowlog"
-	"github.com/percona/percona-agent/query"
 	"github.com/percona/percona-agent/sysconfig"
 	sysconfigMonitor "github.com/percona/percona-agent/sysconfig/monitor"
-	"github.com/percona/percona-agent/sysinfo"
-	mysqlSysinfo "github.com/percona/percona-agent/sysinfo/mysql"
-	systemSysinfo "github.com/percona/percona-agent/sysinfo/system"
 	"github.com/percona/percona-agent/ticker"
 )
 
 var (
-	flagPing    bool
-	flagStatus  bool
-	flagBasedir string
-	flagPidFile string
-	flagVersion bool
+	flagPing     bool
+	flagStatus   bool
+	flagBasedir  string
+	flagStateDir string
+	flagPidFile  string
+	flagVersion  bool
+	flagFixPerm  bool
+	flagInsecure bool
+	flagAdmin    string
 )
 
 func init() {
@@ -71,11 +66,19 @@ func init() {
 	flag.BoolVar(&flagPing, "ping", false, "Ping API")
 	flag.BoolVar(&flagStatus, "status", false, "Agent status")
 	flag.StringVar(&flagBasedir, "basedir", pct.DEFAULT_BASEDIR, "Agent basedir")
+	flag.StringVar(&flagStateDir, "state-dir", "", "Writable dir for configs, data, and state if basedir is read-only")
 	flag.StringVar(&flagPidFile, "pidfile", agent.DEFAULT_PIDFILE, "PID file")
 	flag.BoolVar(&flagVersion, "version", false, "Print version")
+	flag.BoolVar(&flagFixPerm, "fix-permissions", false, "Remove group/other permissions from agent files")
+	flag.BoolVar(&flagInsecure, "insecure-permissions", false, "Run even if config files with credentials are world-readable")
+	flag.StringVar(&flagAdmin, "admin", "", "Admin server address for subcommands (default: agent config Admin)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [status [service] | config get [tool] | config set <tool> <file|-> | list-instances | pause <duration> | resume]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	// We don't accept any possitional arguments
-	if len(flag.Args()) != 0 {
+	// The only possitional arguments are subcommands, see cli.go
+	if len(flag.Args()) != 0 && !isSubcommand(flag.Arg(0)) {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -92,12 +95,40 @@ func run() error {
 		fmt.Println(version)
 		return nil
 	}
+	if len(flag.Args()) > 0 {
+		return runSubcommand(flag.Args())
+	}
 	golog.Printf("Running %s pid %d\n", version, os.Getpid())
 
-	if err := pct.Basedir.Init(flagBasedir); err != nil {
+	if flagStateDir != "" {
+		if err := pct.Basedir.InitReadOnly(flagBasedir, flagStateDir); err != nil {
+			return err
+		}
+		golog.Printf("Basedir %s is read-only, writing to %s\n", pct.Basedir.Path(), pct.Basedir.StatePath())
+	} else if err := pct.Basedir.Init(flagBasedir); err != nil {
 		return err
 	}
 
+	/**
+	 * File permissions: configs have the API key and DSN passwords.
+	 */
+
+	logConfig := &log.Config{}
+	if err := pct.Basedir.ReadConfig("log", logConfig); err != nil {
+		return fmt.Errorf("Invalid log config: %s", err)
+	}
+	permProblems, err := pct.Basedir.CheckPermissions(logConfig.File, flagFixPerm)
+	if err != nil {
+		return fmt.Errorf("Cannot check file permissions: %s", err)
+	}
+	for _, p := range permProblems {
+		golog.Println("Insecure permissions:", p)
+		if p.Fatal() && !flagInsecure {
+			return fmt.Errorf("%s is world-readable but has credentials; fix permissions, "+
+				"run with -fix-permissions, or run with -insecure-permissions", p.Path)
+		}
+	}
+
 	// Start-lock file is used to let agent1 self-update, create start-lock,
 	// start updated agent2, exit cleanly, then agent2 starts.  agent1 may
 	// not use a PID file, so this special file is required.
@@ -107,6 +138,13 @@ func run() error {
 	// NOTE: This must run last, and defer if LIFO, so it must be declared first.
 	defer os.Remove(pct.Basedir.File("start-lock"))
 
+	// If the previous agent restarted us, it handed off tool state so tools
+	// resume where it stopped.
+	handoff, err := pct.LoadHandoff()
+	if err != nil {
+		golog.Println("Cannot load handoff from previous agent:", err)
+	}
+
 	/**
 	 * Agent config (require API key and agent UUID)
 	 */
@@ -219,6 +257,18 @@ func run() error {
 		return fmt.Errorf("Error starting logmanager: %s\n", err)
 	}
 
+	// Report permission problems found at startup now that they can be sent.
+	if len(permProblems) > 0 {
+		permLogger := pct.NewLogger(logChan, "agent-perms")
+		for _, p := range permProblems {
+			if p.Fixed {
+				permLogger.Info("Fixed insecure permissions:", p)
+			} else {
+				permLogger.Warn("Insecure permissions:", p)
+			}
+		}
+	}
+
 	/**
 	 * MRMS (MySQL Restart Monitoring Service)
 	 */
@@ -264,10 +314,26 @@ func run() error {
 		hostname,
 		dataClient,
 	)
+	dataManager.SetAPI(api)
+	dataManager.SetFallback(client.NewHTTPSClient(pct.NewLogger(logChan, "data-https"), api, "data-https", headers))
 	if err := dataManager.Start(); err != nil {
 		return fmt.Errorf("Error starting data manager: %s\n", err)
 	}
 
+	// Name spooled data for the instance UUID, see data.InstanceSpooler.
+	if spool, ok := dataManager.Spooler().(data.InstanceSpooler); ok {
+		spool.SetInstanceUUID(itManager.Repo().UUID)
+	}
+
+	// Report agent events as mm reports, see pct.SendEvent.
+	eventLogger := pct.NewLogger(logChan, "event")
+	eventSpool := dataManager.Spooler()
+	pct.SetEventSink(func(e pct.Event) {
+		if err := eventSpool.Write("mm", mm.EventReport(e)); err != nil {
+			eventLogger.Warn("Cannot spool event " + e.Type + ": " + err.Error())
+		}
+	})
+
 	/**
 	 * Collecct/report ticker (master clock)
 	 */
@@ -279,14 +345,26 @@ func run() error {
 	 * Metric and system config monitors
 	 */
 
+	// Queues between goroutines reported by the agent self-metrics monitor.
+	mmFactory := mmMonitor.NewFactory(logChan, itManager.Repo(), mrm)
+	mmFactory.AddQueue("log", func() int { return len(logChan) })
+	mmFactory.AddQueue("log_buffered", logManager.Relay().Buffered)
+	if spool, ok := dataManager.Spooler().(data.QueueSpooler); ok {
+		mmFactory.AddQueue("data_spool", func() int { reports, _ := spool.Queued(); return reports })
+		mmFactory.AddQueue("data_spool_files", func() int { _, files := spool.Queued(); return int(files) })
+	}
+
 	mmManager := mm.NewManager(
 		pct.NewLogger(logChan, "mm"),
-		mmMonitor.NewFactory(logChan, itManager.Repo(), mrm),
+		mmFactory,
 		clock,
 		dataManager.Spooler(),
 		itManager.Repo(),
 		mrm,
 	)
+	if handoff != nil {
+		mmManager.Resume(handoff)
+	}
 	if err := mmManager.Start(); err != nil {
 		return fmt.Errorf("Error starting mm manager: %s\n", err)
 	}
@@ -303,85 +381,52 @@ func run() error {
 	}
 
 	/**
-	 * Query service (real-time EXPLAIN, SHOW CREATE TABLE, etc.)
+	 * Optional tools (qan, query, sysinfo), see tools.go
 	 */
 
-	queryManager := query.NewManager(
-		pct.NewLogger(logChan, "query"),
-		itManager.Repo(),
-		&mysql.RealConnectionFactory{},
-	)
-	if err := queryManager.Start(); err != nil {
-		return fmt.Errorf("Error starting query manager: %s\n", err)
-	}
-
-	/**
-	 * Query Analytics
-	 */
-
-	qanManager := qan.NewManager(
-		pct.NewLogger(logChan, "qan"),
-		clock,
-		itManager.Repo(),
-		mrm,
-		connFactory,
-		qanFactory.NewRealAnalyzerFactory(
-			logChan,
-			qanFactory.NewRealIntervalIterFactory(logChan),
-			slowlog.NewRealWorkerFactory(logChan),
-			perfschema.NewRealWorkerFactory(logChan),
-			dataManager.Spooler(),
-			clock,
-		),
-	)
-
-	if err := qanManager.Start(); err != nil {
-		return fmt.Errorf("Error starting qan manager: %s\n", err)
-	}
-
-	/**
-	 * Sysinfo
-	 */
-	sysinfoManager := sysinfo.NewManager(
-		pct.NewLogger(logChan, "sysinfo"),
-	)
-
-	// MySQL Sysinfo
-	mysqlSysinfoService := mysqlSysinfo.NewMySQL(
-		pct.NewLogger(logChan, "sysinfo-mysql"),
-		itManager.Repo(),
-	)
-	if err := sysinfoManager.RegisterService("MySQLSummary", mysqlSysinfoService); err != nil {
-		return fmt.Errorf("Error registering Mysql Sysinfo service: %s\n", err)
+	env := &toolEnv{
+		logChan:     logChan,
+		connFactory: connFactory,
+		repo:        itManager.Repo(),
+		mrm:         mrm,
+		spooler:     dataManager.Spooler(),
+		clock:       clock,
+		handoff:     handoff,
+	}
+	toolManagers := make(map[string]pct.ServiceManager)
+	for _, t := range tools {
+		m, err := t.start(env)
+		if err != nil {
+			return fmt.Errorf("Error starting %s manager: %s\n", t.service, err)
+		}
+		toolManagers[t.service] = m
 	}
 
-	// System Sysinfo
-	systemSysinfoService := systemSysinfo.NewSystem(
-		pct.NewLogger(logChan, "sysinfo-system"),
-	)
-	if err := sysinfoManager.RegisterService("SystemSummary", systemSysinfoService); err != nil {
-		return fmt.Errorf("Error registering System Sysinfo service: %s\n", err)
+	// Purge the data and state of instances when they're removed, see purge.go.
+	if spool, ok := dataManager.Spooler().(data.InstanceSpooler); ok {
+		itManager.AddRemoveHook(purgeData(spool))
 	}
-
-	// Start Sysinfo manager
-	if err := sysinfoManager.Start(); err != nil {
-		return fmt.Errorf("Error starting Sysinfo manager: %s\n", err)
+	itManager.AddRemoveHook(purgeLatest)
+	itManager.AddRemoveHook(purgeSLA)
+	for _, t := range tools {
+		if t.purge != nil {
+			itManager.AddRemoveHook(t.purge)
+		}
 	}
 
 	/**
 	 * Signal handler
 	 */
 
-	// Generally the agent has a crash-only design, but QAN is so far the only service
-	// which reconfigures MySQL: it enables the slow log, sets long_query_time, etc.
-	// It's not terrible to leave slow log on, but it's nicer to turn it off.
+	// Generally the agent has a crash-only design, but some tools reconfigure
+	// MySQL, so stop them before exiting (see tool.stopOnSignal).
 	sigChan := make(chan os.Signal, 1)
 	stopChan := make(chan error, 2)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		sig := <-sigChan
 		golog.Printf("Caught %s signal, shutting down...\n", sig)
-		stopChan <- qanManager.Stop()
+		stopChan <- stopTools(toolManagers)
 	}()
 
 	/**
@@ -393,25 +438,36 @@ func run() error {
 		golog.Fatal(err)
 	}
 
-	// The official list of services known to the agent.  Adding a new service
+	// Replies to cmds received before the link went down are queued on disk
+	// and sent after reconnecting, else the API never gets them.
+	replyQueue, err := client.NewReplyQueue(filepath.Join(pct.Basedir.Dir("queue"), "agent-ws"), client.DEFAULT_REPLY_QUEUE_SIZE)
+	if err != nil {
+		golog.Fatal(err)
+	}
+	cmdClient.QueueReplies(replyQueue)
+
+	// The official list of services known to the agent.  Adding a core service
 	// requires a manager, starting the manager as above, and adding the manager
-	// to this map.
+	// to this map.  Optional services are tools, see tools.go.
 	services := map[string]pct.ServiceManager{
 		"log":       logManager,
 		"data":      dataManager,
-		"qan":       qanManager,
 		"mm":        mmManager,
 		"instance":  itManager,
 		"mrms":      mrmsManager,
 		"sysconfig": sysconfigManager,
-		"query":     queryManager,
-		"sysinfo":   sysinfoManager,
 	}
-
-	// Set the global pct/cmd.Factory, used for the Restart cmd.
-	pctCmd.Factory = &pctCmd.RealCmdFactory{}
+	for service, m := range toolManagers {
+		services[service] = m
+	}
 
 	agentLogger := pct.NewLogger(logChan, "agent")
+	cmdAudit := agent.NewCmdAuditLog(
+		agentLogger,
+		filepath.Join(pct.Basedir.Dir("history"), agent.CMD_AUDIT_FILE),
+		agent.CMD_AUDIT_FILE_SIZE,
+		agent.CMD_AUDIT_FILES,
+	)
 
 	agent := agent.NewAgent(
 		agentConfig,
@@ -420,6 +476,9 @@ func run() error {
 		cmdClient,
 		services,
 	)
+	agent.SetCmdAuditLog(cmdAudit)
+
+	admin := startAdmin(agentConfig, agent, agentLogger)
 
 	/**
 	 * Run agent, wait for it to stop, signal, or crash.
@@ -442,8 +501,8 @@ func run() error {
 	agentRunning := true
 	statusSigChan := make(chan os.Signal, 1)
 	signal.Notify(statusSigChan, syscall.SIGUSR1) // kill -USER1 PID
-	reconnectSigChan := make(chan os.Signal, 1)
-	signal.Notify(reconnectSigChan, syscall.SIGHUP) // kill -HUP PID
+	reloadSigChan := make(chan os.Signal, 1)
+	signal.Notify(reloadSigChan, syscall.SIGHUP) // kill -HUP PID
 	for agentRunning {
 		select {
 		case stopErr = <-stopChan: // agent or signal
@@ -453,24 +512,68 @@ func run() error {
 		case <-statusSigChan:
 			status := agent.AllStatus()
 			golog.Printf("Status: %+v\n", status)
-		case <-reconnectSigChan:
-			u, _ := user.Current()
-			cmd := &proto.Cmd{
-				Ts:        time.Now().UTC(),
-				User:      u.Username + " (SIGHUP)",
-				AgentUuid: agentConfig.AgentUuid,
-				Service:   "agent",
-				Cmd:       "Reconnect",
-			}
-			agent.Handle(cmd)
+		case <-reloadSigChan:
+			// Reload configs changed on disk, then reconnect as before.  It can
+			// take minutes, so do it in the background to keep handling signals
+			// and stopChan; LocalCmd serializes it with other cmds.
+			go func() {
+				username, err := pct.CurrentUser()
+				if err != nil {
+					username = fmt.Sprintf("uid %d", os.Getuid())
+				}
+				cmd := &proto.Cmd{
+					Ts:        time.Now().UTC(),
+					User:      username + " (SIGHUP)",
+					AgentUuid: agentConfig.AgentUuid,
+					Service:   "agent",
+					Cmd:       "Reload",
+				}
+				reply := agent.LocalCmd(cmd)
+				if reply.Error != "" {
+					golog.Println("Reload: " + reply.Error)
+				}
+				cmd = &proto.Cmd{
+					Ts:        time.Now().UTC(),
+					User:      username + " (SIGHUP)",
+					AgentUuid: agentConfig.AgentUuid,
+					Service:   "agent",
+					Cmd:       "Reconnect",
+				}
+				agent.Handle(cmd)
+			}()
 		}
 	}
 
-	qanManager.Stop()           // see Signal handler ^
+	if admin != nil {
+		admin.Stop()
+	}
+	stopTools(toolManagers)     // see Signal handler ^
 	time.Sleep(2 * time.Second) // wait for final replies and log entries
 	return stopErr
 }
 
+// startAdmin starts the admin server if it's configured.  It's opt-in, and the
+// agent runs without it if it fails to start.
+func startAdmin(agentConfig *agent.Config, a *agent.Agent, logger *pct.Logger) *agent.Admin {
+	if agentConfig.Admin == "" {
+		return nil
+	}
+	localAuthConfig := pct.LocalAuthConfig{}
+	if agentConfig.LocalAuth != nil {
+		localAuthConfig = *agentConfig.LocalAuth
+	}
+	localAuth, err := pct.NewLocalAuth(localAuthConfig)
+	if err == nil {
+		admin := agent.NewAdmin(a, localAuth, logger)
+		if err = admin.Start(agentConfig.Admin); err == nil {
+			return admin
+		}
+	}
+	golog.Println("Cannot start admin server:", err)
+	logger.Warn("Cannot start admin server:", err)
+	return nil
+}
+
 func ConnectAPI(agentConfig *agent.Config, retry int) (*pct.API, error) {
 	golog.Println("ApiHostname: " + agentConfig.ApiHostname)
 	golog.Println("ApiKey: " + agentConfig.ApiKey)
@@ -488,7 +591,7 @@ func ConnectAPI(agentConfig *agent.Config, retry int) (*pct.API, error) {
 			golog.Println(err)
 			continue
 		}
-		golog.Println("Connected to API")
+		golog.Printf("Connected to API (protocol v%d)\n", api.ProtocolVersion())
 		return api, nil // success
 	}
 
@@ -0,0 +1,71 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	mysqlMonitor "github.com/percona/percona-agent/mm/mysql"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * When the API removes an instance, the instance manager calls these hooks
+ * and the tools' purge hooks (see tool.purge) so nothing is kept, or sent,
+ * for an instance that no longer exists: its spooled data is moved to the
+ * trash (see data.InstanceSpooler), and its latest reports and tool state
+ * are removed.  The instance manager sends an event summarizing what was
+ * removed, see pct.SendEvent.
+ */
+
+// purgeData returns a hook that moves the spooled data of removed instances
+// to the trash.
+func purgeData(spool data.InstanceSpooler) instance.RemoveHook {
+	return func(service string, id uint, uuid string) ([]string, error) {
+		n, bytes := spool.PurgeInstance(uuid)
+		if n == 0 {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%d data files (%s) moved to trash", n, pct.Bytes(bytes))}, nil
+	}
+}
+
+// purgeLatest removes the latest reports of removed instances.
+func purgeLatest(service string, id uint, uuid string) ([]string, error) {
+	tools, err := pct.Basedir.RemoveLatest(proto.ServiceInstance{Service: service, InstanceId: id})
+	if len(tools) == 0 {
+		return nil, err
+	}
+	return []string{"latest " + strings.Join(tools, ", ") + " reports"}, err
+}
+
+// purgeSLA removes the SLA accounting of removed MySQL instances.
+func purgeSLA(service string, id uint, uuid string) ([]string, error) {
+	if service != "mysql" {
+		return nil, nil
+	}
+	removed, err := mysqlMonitor.RemoveSLA(id)
+	if !removed {
+		return nil, err
+	}
+	return []string{"SLA accounting"}, err
+}
@@ -0,0 +1,59 @@
+// +build !noauditlog
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/auditlog"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Audit log service (tail and send Percona Server audit log events)
+func init() {
+	registerTool(tool{
+		service: "auditlog",
+		start:   startAuditLog,
+		purge:   purgeAuditLog,
+	})
+}
+
+// purgeAuditLog removes the audit log position of a removed instance.
+func purgeAuditLog(service string, id uint, uuid string) ([]string, error) {
+	removed, err := auditlog.RemovePosition(fmt.Sprintf("%s-%d", service, id))
+	if !removed {
+		return nil, err
+	}
+	return []string{"audit log position"}, err
+}
+
+func startAuditLog(env *toolEnv) (pct.ServiceManager, error) {
+	auditlogManager := auditlog.NewManager(
+		pct.NewLogger(env.logChan, "auditlog"),
+		env.clock,
+		env.spooler,
+		env.repo,
+		env.connFactory,
+	)
+	if err := auditlogManager.Start(); err != nil {
+		return nil, err
+	}
+	return auditlogManager, nil
+}
@@ -0,0 +1,47 @@
+// +build !nomysqllog
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"github.com/percona/percona-agent/mysqllog"
+	"github.com/percona/percona-agent/pct"
+)
+
+// MySQL error log service (tail and send error log entries)
+func init() {
+	registerTool(tool{
+		service: "mysqllog",
+		start:   startMySQLLog,
+	})
+}
+
+func startMySQLLog(env *toolEnv) (pct.ServiceManager, error) {
+	mysqllogManager := mysqllog.NewManager(
+		pct.NewLogger(env.logChan, "mysqllog"),
+		env.clock,
+		env.spooler,
+		env.repo,
+		env.connFactory,
+	)
+	if err := mysqllogManager.Start(); err != nil {
+		return nil, err
+	}
+	return mysqllogManager, nil
+}
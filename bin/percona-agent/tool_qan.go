@@ -0,0 +1,80 @@
+// +build !noqan
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
+	qanFactory "github.com/percona/percona-agent/qan/factory"
+	"github.com/percona/percona-agent/qan/perfschema"
+	"github.com/percona/percona-agent/qan/slowlog"
+)
+
+func init() {
+	registerTool(tool{
+		service: "qan",
+		start:   startQAN,
+		// Generally the agent has a crash-only design, but QAN is so far the
+		// only service which reconfigures MySQL: it enables the slow log, sets
+		// long_query_time, etc.  It's not terrible to leave slow log on, but
+		// it's nicer to turn it off.
+		stopOnSignal: true,
+		purge:        purgeQAN,
+	})
+}
+
+// purgeQAN removes the QAN history of a removed MySQL instance.
+func purgeQAN(service string, id uint, uuid string) ([]string, error) {
+	if service != "mysql" {
+		return nil, nil
+	}
+	n, err := qan.RemoveHistory(id)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("QAN history (%d reports)", n)}, nil
+}
+
+func startQAN(env *toolEnv) (pct.ServiceManager, error) {
+	qanManager := qan.NewManager(
+		pct.NewLogger(env.logChan, "qan"),
+		env.clock,
+		env.repo,
+		env.mrm,
+		env.connFactory,
+		qanFactory.NewRealAnalyzerFactory(
+			env.logChan,
+			qanFactory.NewRealIntervalIterFactory(env.logChan),
+			slowlog.NewRealWorkerFactory(env.logChan),
+			perfschema.NewRealWorkerFactory(env.logChan),
+			env.spooler,
+			env.clock,
+		),
+	)
+	if env.handoff != nil {
+		qanManager.Resume(env.handoff)
+	}
+	if err := qanManager.Start(); err != nil {
+		return nil, err
+	}
+	return qanManager, nil
+}
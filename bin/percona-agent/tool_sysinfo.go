@@ -0,0 +1,65 @@
+// +build !noexec
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/sysinfo"
+	mysqlSysinfo "github.com/percona/percona-agent/sysinfo/mysql"
+	systemSysinfo "github.com/percona/percona-agent/sysinfo/system"
+)
+
+// Sysinfo runs pt-summary and pt-mysql-summary, so it's excluded by noexec.
+func init() {
+	registerTool(tool{
+		service: "sysinfo",
+		start:   startSysinfo,
+	})
+}
+
+func startSysinfo(env *toolEnv) (pct.ServiceManager, error) {
+	sysinfoManager := sysinfo.NewManager(
+		pct.NewLogger(env.logChan, "sysinfo"),
+	)
+
+	// MySQL Sysinfo
+	mysqlSysinfoService := mysqlSysinfo.NewMySQL(
+		pct.NewLogger(env.logChan, "sysinfo-mysql"),
+		env.repo,
+	)
+	if err := sysinfoManager.RegisterService("MySQLSummary", mysqlSysinfoService); err != nil {
+		return nil, fmt.Errorf("Error registering Mysql Sysinfo service: %s", err)
+	}
+
+	// System Sysinfo
+	systemSysinfoService := systemSysinfo.NewSystem(
+		pct.NewLogger(env.logChan, "sysinfo-system"),
+	)
+	if err := sysinfoManager.RegisterService("SystemSummary", systemSysinfoService); err != nil {
+		return nil, fmt.Errorf("Error registering System Sysinfo service: %s", err)
+	}
+
+	if err := sysinfoManager.Start(); err != nil {
+		return nil, err
+	}
+	return sysinfoManager, nil
+}
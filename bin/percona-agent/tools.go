@@ -0,0 +1,89 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package main
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mrms"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+/**
+ * Optional tools are compiled in by tool_*.go files with build tags so
+ * distributions can build minimal agents for security-sensitive environments,
+ * e.g. a metrics-only agent that can't run programs remotely:
+ *
+ *   go build -tags "noqan noquery noexec"
+ *
+ *   noalert     Threshold alerts on mm metrics (alert)
+ *   noauditlog  Percona Server audit log collection (auditlog)
+ *   nomysqllog  MySQL error log tailing (mysqllog)
+ *   noqan       Query Analytics (qan)
+ *   noquery     Real-time EXPLAIN, table info, etc. (query)
+ *   noexec      Everything that runs programs: sysinfo (pt-summary, etc.),
+ *               the agent Restart and Update cmds (see agent/exec.go), and
+ *               MySQL socket detection with netstat (see mysql/netstat.go).
+ *               No package in a noexec build imports os/exec or pct/cmd.
+ *
+ * The core services (log, data, instance, mrms, mm, sysconfig) are always
+ * compiled in.  Each tool file registers its tool in an init() func, and run()
+ * starts the tools after the core services.  The API learns which services a
+ * build has from the agent Capabilities cmd.
+ */
+
+// toolEnv is what tools need from the core services.
+type toolEnv struct {
+	logChan     chan *proto.LogEntry
+	connFactory mysql.ConnectionFactory
+	repo        *instance.Repo
+	mrm         mrms.Monitor
+	spooler     data.Spooler
+	clock       ticker.Manager
+	handoff     *pct.Handoff // nil if none
+}
+
+type tool struct {
+	service      string
+	start        func(env *toolEnv) (pct.ServiceManager, error)
+	stopOnSignal bool                // stop before exiting, e.g. qan undoes MySQL changes
+	purge        instance.RemoveHook // remove tool state of removed instances, optional
+}
+
+var tools = []tool{}
+
+func registerTool(t tool) {
+	tools = append(tools, t)
+}
+
+// stopTools stops the managers of tools that must be stopped before the agent
+// exits, and returns the last error.
+func stopTools(managers map[string]pct.ServiceManager) error {
+	var lastErr error
+	for _, t := range tools {
+		if m, ok := managers[t.service]; ok && t.stopOnSignal {
+			if err := m.Stop(); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
@@ -18,14 +18,21 @@
 package client_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/client"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -138,10 +145,15 @@ func (s *TestSuite) TestSend(t *C) {
 	t.Check(conn, NotNil)
 
 	// Status should report connected to the proper link.
+	logBytes, _ := json.Marshal(logEntry)
+	stats := fmt.Sprintf("sent 1 msgs (%s), recv 0 msgs (0), 0 reconnects", pct.Bytes(uint64(len(logBytes))))
 	status := ws.Status()
 	t.Check(status, DeepEquals, map[string]string{
-		"ws":      "Connected " + URL,
-		"ws-link": URL,
+		"ws":            "Connected " + URL,
+		"ws-link":       URL,
+		"ws-stats":      stats,
+		"ws-last-error": "",
+		"ws-api-error":  "",
 	})
 
 	ws.Disconnect()
@@ -155,8 +167,11 @@ func (s *TestSuite) TestSend(t *C) {
 	// Status should report disconnected and still the proper link.
 	status = ws.Status()
 	t.Check(status, DeepEquals, map[string]string{
-		"ws":      "Disconnected",
-		"ws-link": URL,
+		"ws":            "Disconnected",
+		"ws-link":       URL,
+		"ws-stats":      stats,
+		"ws-last-error": "",
+		"ws-api-error":  "",
 	})
 }
 
@@ -531,3 +546,276 @@ func (s *TestSuite) TestCloseTimeout(t *C) {
 	err = ws.Disconnect()
 	t.Check(err, IsNil)
 }
+
+func (s *TestSuite) TestStats(t *C) {
+	/**
+	 * Client should count msgs and bytes sent and received, reconnects,
+	 * and the last error.
+	 */
+
+	ws, err := client.NewWebsocketClient(s.logger, s.api, "agent", nil)
+	t.Assert(err, IsNil)
+
+	ws.Start()
+	defer ws.Stop()
+	defer ws.Disconnect()
+
+	ws.Connect()
+	c := <-mock.ClientConnectChan
+	<-ws.ConnectChan() // connect ack
+
+	cmd := &proto.Cmd{
+		User: "daniel",
+		Ts:   time.Now(),
+		Cmd:  "Status",
+	}
+	c.SendChan <- cmd
+	got := test.WaitCmd(ws.RecvChan())
+	t.Assert(len(got), Equals, 1)
+
+	reply := cmd.Reply(nil, nil)
+	ws.SendChan() <- reply
+	data := test.WaitData(c.RecvChan)
+	t.Assert(len(data), Equals, 1)
+
+	// Bytes are counted as sent, not decoded.
+	protoData, _ := json.Marshal(&proto.Data{
+		ContentEncoding: "gzip",
+		Data:            make([]byte, 100),
+	})
+	err = ws.SendBytes(protoData, 5)
+	t.Assert(err, IsNil)
+	data = test.WaitData(c.RecvChan)
+	t.Assert(len(data), Equals, 1)
+
+	cmdBytes, _ := json.Marshal(cmd)
+	replyBytes, _ := json.Marshal(reply)
+	status := ws.Status()
+	t.Check(status["ws-stats"], Equals, fmt.Sprintf("sent 2 msgs (%s), recv 1 msgs (%s), 0 reconnects",
+		pct.Bytes(uint64(len(replyBytes)+len(protoData))), pct.Bytes(uint64(len(cmdBytes)))))
+	t.Check(status["ws-last-error"], Equals, "")
+
+	// Disconnect and reconnect.
+	mock.DisconnectClient(c)
+	<-ws.ConnectChan() // disconnect ack
+	ws.Connect()
+	c = <-mock.ClientConnectChan
+	<-ws.ConnectChan() // connect ack
+
+	status = ws.Status()
+	t.Check(status["ws-stats"], Matches, ".+, 1 reconnects")
+	t.Check(status["ws-last-error"], Matches, "at .+: .+") // EOF due to disconnect
+}
+
+func (s *TestSuite) TestHTTPSClient(t *C) {
+	/**
+	 * HTTPS client POSTs data to the data-https link, chunked,
+	 * and returns the API response, or the HTTP status if the response isn't
+	 * a proto.Response (e.g. proxy error).
+	 */
+
+	type post struct {
+		apiKey  string
+		chunked bool
+		body    []byte
+	}
+	postChan := make(chan post, 1)
+	code := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		postChan <- post{r.Header.Get("X-Percona-API-Key"), chunked, body}
+		if code != 200 {
+			http.Error(w, "Bad Gateway", code)
+			return
+		}
+		w.Write([]byte(`{"Code":200}`))
+	}))
+	defer server.Close()
+
+	// The websocket data link isn't a POST link.
+	links := map[string]string{"data": "ws" + strings.TrimPrefix(server.URL, "http") + "/data"}
+	api := mock.NewAPI("http://localhost", server.URL, "apikey", "uuid", links)
+	c := client.NewHTTPSClient(s.logger, api, "data-https", nil)
+	err := c.ConnectOnce(5)
+	t.Check(err, NotNil)
+
+	links["data-https"] = server.URL + "/data"
+	api = mock.NewAPI("http://localhost", server.URL, "apikey", "uuid", links)
+	c = client.NewHTTPSClient(s.logger, api, "data-https", nil)
+
+	err = c.SendBytes([]byte("data"), 5)
+	t.Check(err, NotNil) // not connected
+
+	err = c.ConnectOnce(5)
+	t.Assert(err, IsNil)
+	err = c.SendBytes([]byte("data"), 5)
+	t.Assert(err, IsNil)
+	p := <-postChan
+	t.Check(p.apiKey, Equals, "apikey")
+	t.Check(p.chunked, Equals, true)
+	t.Check(string(p.body), Equals, "data")
+	resp := &proto.Response{}
+	err = c.Recv(resp, 5)
+	t.Assert(err, IsNil)
+	t.Check(resp.Code, Equals, uint(200))
+
+	// Only one response per send.
+	err = c.Recv(resp, 5)
+	t.Check(err, NotNil)
+
+	code = 502
+	err = c.SendBytes([]byte("data"), 5)
+	t.Assert(err, IsNil)
+	<-postChan
+	resp = &proto.Response{}
+	err = c.Recv(resp, 5)
+	t.Assert(err, IsNil)
+	t.Check(resp.Code, Equals, uint(502))
+	t.Check(resp.Error, Equals, "Bad Gateway")
+
+	err = c.DisconnectOnce()
+	t.Check(err, IsNil)
+
+	status := c.Status()
+	t.Check(status["ws-link"], Equals, server.URL+"/data")
+	t.Check(status["ws-stats"], Matches, `sent 2 msgs \(.+\), recv 2 msgs \(.+\), 0 reconnects`)
+}
+
+func (s *TestSuite) TestReplyDuringDisconnect(t *C) {
+	/**
+	 * Replies sent while the client is disconnected should be queued on disk
+	 * and sent after reconnecting, even by a new client (i.e. agent restart).
+	 */
+
+	tmpDir, err := ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	queue, err := client.NewReplyQueue(tmpDir, 0)
+	t.Assert(err, IsNil)
+
+	ws, err := client.NewWebsocketClient(s.logger, s.api, "agent", nil)
+	t.Assert(err, IsNil)
+	ws.QueueReplies(queue)
+	ws.Start()
+
+	ws.Connect()
+	c := <-mock.ClientConnectChan
+	<-ws.ConnectChan() // connect ack
+
+	cmd := &proto.Cmd{
+		Id:   7,
+		User: "daniel",
+		Ts:   time.Now(),
+		Cmd:  "Status",
+	}
+	c.SendChan <- cmd
+	got := test.WaitCmd(ws.RecvChan())
+	t.Assert(len(got), Equals, 1)
+
+	// API goes away before the agent replies.
+	mock.DisconnectClient(c)
+	<-ws.ConnectChan() // disconnect ack
+
+	ws.SendChan() <- cmd.Reply(nil, nil)
+	for i := 0; i < 10 && queue.Len() == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Assert(queue.Len(), Equals, 1)
+	ws.Stop()
+
+	// New client with the same queue dir, like after an agent restart.
+	queue, err = client.NewReplyQueue(tmpDir, 0)
+	t.Assert(err, IsNil)
+	t.Check(queue.Len(), Equals, 1)
+
+	ws, err = client.NewWebsocketClient(s.logger, s.api, "agent", nil)
+	t.Assert(err, IsNil)
+	ws.QueueReplies(queue)
+	ws.Start()
+	defer ws.Stop()
+	defer ws.Disconnect()
+
+	ws.Connect()
+	c = <-mock.ClientConnectChan
+	<-ws.ConnectChan() // connect ack
+
+	// Queued reply is sent first, with the original cmd id.
+	data := test.WaitData(c.RecvChan)
+	t.Assert(len(data), Equals, 1)
+	m := data[0].(map[string]interface{})
+	t.Check(m["Id"], Equals, float64(7))
+	t.Check(m["Cmd"], Equals, "Status")
+	t.Check(queue.Len(), Equals, 0)
+
+	// New replies are sent as usual.
+	ws.SendChan() <- cmd.Reply(nil, nil)
+	data = test.WaitData(c.RecvChan)
+	t.Assert(len(data), Equals, 1)
+	t.Check(queue.Len(), Equals, 0)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// ReplyQueue test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ReplyQueueTestSuite struct {
+	tmpDir string
+}
+
+var _ = Suite(&ReplyQueueTestSuite{})
+
+func (s *ReplyQueueTestSuite) SetUpTest(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *ReplyQueueTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ReplyQueueTestSuite) TestOrder(t *C) {
+	queue, err := client.NewReplyQueue(s.tmpDir, 2)
+	t.Assert(err, IsNil)
+
+	reply, err := queue.Peek()
+	t.Check(err, IsNil)
+	t.Check(reply, IsNil)
+
+	t.Assert(queue.Push(&proto.Reply{Id: 1, Cmd: "Status"}), IsNil)
+	t.Assert(queue.Push(&proto.Reply{Id: 2, Cmd: "Version"}), IsNil)
+	t.Check(queue.Push(&proto.Reply{Id: 3, Cmd: "Status"}), Equals, client.ErrReplyQueueFull)
+	t.Check(queue.Len(), Equals, 2)
+
+	// Replies are reloaded in order.
+	queue, err = client.NewReplyQueue(s.tmpDir, 2)
+	t.Assert(err, IsNil)
+	t.Assert(queue.Len(), Equals, 2)
+
+	reply, err = queue.Peek()
+	t.Assert(err, IsNil)
+	t.Check(reply.Id, Equals, uint(1))
+	t.Check(queue.Remove(), IsNil)
+
+	t.Assert(queue.Push(&proto.Reply{Id: 3, Cmd: "Status"}), IsNil)
+
+	reply, err = queue.Peek()
+	t.Assert(err, IsNil)
+	t.Check(reply.Id, Equals, uint(2))
+	t.Check(queue.Remove(), IsNil)
+
+	reply, err = queue.Peek()
+	t.Assert(err, IsNil)
+	t.Check(reply.Id, Equals, uint(3))
+	t.Check(queue.Remove(), IsNil)
+
+	t.Check(queue.Len(), Equals, 0)
+	files, _ := ioutil.ReadDir(s.tmpDir)
+	t.Check(files, HasLen, 0)
+}
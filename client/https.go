@@ -0,0 +1,247 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * HTTPSClient sends data with HTTPS POST instead of a websocket.  Many
+ * corporate proxies kill long-lived websockets but let plain HTTPS through,
+ * so data/sender falls back to this client when it can't connect the data
+ * websocket, see data.Sender.SetFallback.  Each SendBytes is one POST with a
+ * chunked body to the API data link, and the next Recv returns the response
+ * to it.  The link is an agent link of its own, e.g. "data-https", because
+ * the API serves POST uploads apart from the websocket; if the API doesn't
+ * have it, ConnectOnce fails.  There's no connection to keep, so ConnectOnce
+ * only resolves the link.
+ */
+type HTTPSClient struct {
+	logger  *pct.Logger
+	api     pct.APIConnector
+	link    string
+	headers map[string]string
+	// --
+	client *http.Client
+	url    string
+	code   int    // HTTP status of the last POST...
+	body   []byte // ...and its response, for Recv
+	mux    *sync.Mutex
+	status *pct.Status
+	name   string
+	stats  *wsStats
+}
+
+func NewHTTPSClient(logger *pct.Logger, api pct.APIConnector, link string, headers map[string]string) *HTTPSClient {
+	name := logger.Service()
+	stats := newWsStats()
+	dial := func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return wireConn{conn, stats}, nil
+	}
+	c := &HTTPSClient{
+		logger:  logger,
+		api:     api,
+		link:    link,
+		headers: headers,
+		// --
+		client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, Dial: dial}},
+		mux:    new(sync.Mutex),
+		status: pct.NewStatus([]string{name, name + "-link", name + "-stats", name + "-last-error"}),
+		name:   name,
+		stats:  stats,
+	}
+	return c
+}
+
+func (c *HTTPSClient) ConnectOnce(timeout uint) error {
+	c.logger.Debug("ConnectOnce:call")
+	defer c.logger.Debug("ConnectOnce:return")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	link, err := c.postLink()
+	if err != nil {
+		c.stats.error(err)
+		c.status.Update(c.name, "Error: "+err.Error())
+		return err
+	}
+	if strings.HasPrefix(link, "https://localhost:8443") {
+		// Test uses mock server with a self-signed cert, like WebsocketClient.
+		c.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	c.url = link
+	c.code = 0
+	c.body = nil
+	c.stats.connected()
+	c.status.Update(c.name, "Ready "+link)
+	return nil
+}
+
+func (c *HTTPSClient) DisconnectOnce() error {
+	c.logger.Debug("DisconnectOnce:call")
+	defer c.logger.Debug("DisconnectOnce:return")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.client.Transport.(*http.Transport).CloseIdleConnections()
+	c.url = ""
+	c.status.Update(c.name, "Disconnected")
+	return nil
+}
+
+func (c *HTTPSClient) SendBytes(data []byte, timeout uint) error {
+	c.logger.DebugOffline("SendBytes:call")
+	defer c.logger.DebugOffline("SendBytes:return")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.url == "" {
+		return errors.New("Not connected")
+	}
+	c.code = 0
+	c.body = nil
+
+	// NopCloser hides the length from http.NewRequest so the body is sent
+	// chunked, which proxies that limit request size handle better.
+	req, err := http.NewRequest("POST", c.url, ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Percona-API-Key", c.api.ApiKey())
+	protocol, err := pct.NewProtocol(c.api.ProtocolVersion())
+	if err != nil {
+		return err
+	}
+	req.Header.Set(pct.PROTOCOL_HEADER, fmt.Sprintf("%d", protocol.Version()))
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	c.client.Timeout = time.Duration(timeout) * time.Second
+	c.status.Update(c.name, "Sending")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.stats.error(err)
+		c.status.Update(c.name, "Error: "+err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.stats.error(err)
+		c.status.Update(c.name, "Error: "+err.Error())
+		return err
+	}
+	c.stats.sent(len(data))
+	c.stats.recv(len(body))
+	c.code = resp.StatusCode
+	c.body = body
+	c.status.Update(c.name, "Ready "+c.url)
+	return nil
+}
+
+// Recv returns the API response to the last SendBytes.  If data is a
+// proto.Response and the body isn't one, e.g. a proxy error page, the HTTP
+// status code and body are returned as the response code and error.
+func (c *HTTPSClient) Recv(data interface{}, timeout uint) error {
+	c.logger.DebugOffline("Recv:call")
+	defer c.logger.DebugOffline("Recv:return")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.code == 0 {
+		return errors.New("No response, SendBytes not called or failed")
+	}
+	code, body := c.code, c.body
+	c.code = 0
+	c.body = nil
+
+	err := json.Unmarshal(body, data)
+	resp, ok := data.(*proto.Response)
+	if !ok {
+		return err
+	}
+	if err != nil {
+		resp.Code = uint(code)
+		resp.Error = strings.TrimSpace(string(body))
+	} else if resp.Code == 0 {
+		resp.Code = uint(code)
+	}
+	return nil
+}
+
+// WireBytes returns the bytes written to the network since the agent started,
+// see WebsocketStats.
+func (c *HTTPSClient) WireBytes() uint64 {
+	return c.stats.get().WireBytes
+}
+
+func (c *HTTPSClient) Status() map[string]string {
+	link, err := c.postLink()
+	if err != nil {
+		link = err.Error()
+	}
+	c.status.Update(c.name+"-link", link)
+	stats := c.stats.get()
+	c.status.Update(c.name+"-stats", stats.String())
+	if stats.LastError != "" {
+		c.status.Update(c.name+"-last-error", fmt.Sprintf("at %s: %s", pct.TimeString(stats.LastErrorTs), stats.LastError))
+	}
+	return c.status.All()
+}
+
+// postLink returns the URL to POST data to.
+func (c *HTTPSClient) postLink() (string, error) {
+	link := c.api.AgentLink(c.link)
+	if link == "" {
+		return "", fmt.Errorf("No %s link", c.link)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid %s link: %s", c.link, link)
+	}
+	return link, nil
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	DEFAULT_REPLY_QUEUE_SIZE = 100
+	REPLY_FILE_SUFFIX        = ".json"
+)
+
+var ErrReplyQueueFull = errors.New("reply queue is full")
+
+/**
+ * ReplyQueue holds Replies that could not be sent because the websocket was
+ * down.  Each Reply is written as-is (with the original Cmd Id) to its own
+ * file named by the time it was queued, so the queue survives an agent
+ * restart and replies are resent in order after reconnecting.  The queue
+ * does not drop replies when it's full: Push returns ErrReplyQueueFull and
+ * the caller decides what to do (older replies are more likely to matter to
+ * an API still waiting on them).
+ */
+type ReplyQueue struct {
+	dir     string
+	maxSize int
+	// --
+	files  []string
+	lastTs int64
+	mux    *sync.Mutex
+}
+
+func NewReplyQueue(dir string, maxSize int) (*ReplyQueue, error) {
+	if err := pct.MakeDir(dir); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = DEFAULT_REPLY_QUEUE_SIZE
+	}
+	q := &ReplyQueue{
+		dir:     dir,
+		maxSize: maxSize,
+		files:   []string{},
+		mux:     new(sync.Mutex),
+	}
+
+	// Load replies queued before a restart.  File names are zero-padded
+	// nanosecond timestamps so sorting them by name sorts them by time.
+	files, err := filepath.Glob(filepath.Join(dir, "*"+REPLY_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	q.files = files
+	if len(files) > 0 {
+		last := strings.TrimSuffix(filepath.Base(files[len(files)-1]), REPLY_FILE_SUFFIX)
+		fmt.Sscanf(last, "%d", &q.lastTs)
+	}
+	return q, nil
+}
+
+// Push writes the reply to the end of the queue.
+func (q *ReplyQueue) Push(reply *proto.Reply) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.files) >= q.maxSize {
+		return ErrReplyQueueFull
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	// Two replies can be queued in the same nanosecond (or the clock can go
+	// back), so make sure each file name sorts after the previous one.
+	ts := time.Now().UnixNano()
+	if ts <= q.lastTs {
+		ts = q.lastTs + 1
+	}
+	file := filepath.Join(q.dir, fmt.Sprintf("%020d%s", ts, REPLY_FILE_SUFFIX))
+
+	// Write then rename so a crash never leaves a partial reply in the queue.
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	q.lastTs = ts
+	q.files = append(q.files, file)
+	return nil
+}
+
+// Peek returns the oldest reply without removing it from the queue, or nil
+// if the queue is empty.
+func (q *ReplyQueue) Peek() (*proto.Reply, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.files) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(q.files[0])
+	if err != nil {
+		return nil, err
+	}
+	reply := &proto.Reply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return nil, fmt.Errorf("Invalid queued reply %s: %s", q.files[0], err)
+	}
+	return reply, nil
+}
+
+// Remove removes the oldest reply, i.e. the one returned by Peek.
+func (q *ReplyQueue) Remove() error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.files) == 0 {
+		return nil
+	}
+	err := pct.RemoveFile(q.files[0])
+	q.files = q.files[1:]
+	return err
+}
+
+func (q *ReplyQueue) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.files)
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+// WebsocketStats are the totals for one websocket client (channel) since
+// the agent started.  Bytes are as sent, i.e. compressed if the data is:
+// the compression ratio is in the data ledger, counted by the serializer.
+// WireBytes also counts the framing (websocket frames, or HTTP headers and
+// TLS for HTTPSClient), so it's what the agent really writes to the network.
+type WebsocketStats struct {
+	SentMsgs    uint64
+	SentBytes   uint64
+	WireBytes   uint64
+	RecvMsgs    uint64
+	RecvBytes   uint64
+	Connects    uint64
+	Reconnects  uint64 // Connects - 1, if > 0
+	LastError   string
+	LastErrorTs time.Time
+}
+
+func (s WebsocketStats) String() string {
+	return fmt.Sprintf("sent %d msgs (%s), recv %d msgs (%s), %d reconnects",
+		s.SentMsgs, pct.Bytes(s.SentBytes), s.RecvMsgs, pct.Bytes(s.RecvBytes), s.Reconnects)
+}
+
+type wsStats struct {
+	stats WebsocketStats
+	mux   *sync.Mutex
+}
+
+func newWsStats() *wsStats {
+	s := &wsStats{
+		mux: new(sync.Mutex),
+	}
+	return s
+}
+
+func (s *wsStats) sent(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stats.SentMsgs++
+	s.stats.SentBytes += uint64(n)
+}
+
+func (s *wsStats) wrote(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stats.WireBytes += uint64(n)
+}
+
+func (s *wsStats) recv(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stats.RecvMsgs++
+	s.stats.RecvBytes += uint64(n)
+}
+
+func (s *wsStats) connected() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stats.Connects++
+	if s.stats.Connects > 1 {
+		s.stats.Reconnects++
+	}
+}
+
+func (s *wsStats) error(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stats.LastError = err.Error()
+	s.stats.LastErrorTs = time.Now()
+}
+
+func (s *wsStats) get() WebsocketStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.stats
+}
+
+// wireConn counts the bytes written to the connection in WireBytes.
+type wireConn struct {
+	net.Conn
+	stats *wsStats
+}
+
+func (c wireConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.wrote(n)
+	return n, err
+}
@@ -20,6 +20,7 @@ package client
 import (
 	"code.google.com/p/go.net/websocket"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
@@ -42,7 +43,8 @@ type WebsocketClient struct {
 	// --
 	conn      *websocket.Conn
 	connected bool
-	mux       *sync.Mutex // guard conn and connected
+	protocol  pct.Protocol
+	mux       *sync.Mutex // guard conn, connected, and protocol
 	// --
 	started     bool
 	recvChan    chan *proto.Cmd
@@ -54,6 +56,9 @@ type WebsocketClient struct {
 	recvSync    *pct.SyncChan
 	status      *pct.Status
 	name        string
+	queue       *ReplyQueue
+	stats       *wsStats
+	apiErrors   *pct.APIErrorReporter
 }
 
 func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, headers map[string]string) (*WebsocketClient, error) {
@@ -64,8 +69,9 @@ func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, h
 		link:    link,
 		headers: headers,
 		// --
-		mux:  new(sync.Mutex),
-		conn: nil,
+		mux:      new(sync.Mutex),
+		conn:     nil,
+		protocol: nil,
 		// --
 		recvChan:    make(chan *proto.Cmd, RECV_BUFFER_SIZE),
 		sendChan:    make(chan *proto.Reply, SEND_BUFFER_SIZE),
@@ -74,12 +80,21 @@ func NewWebsocketClient(logger *pct.Logger, api pct.APIConnector, link string, h
 		backoff:     pct.NewBackoff(5 * time.Minute),
 		sendSync:    pct.NewSyncChan(),
 		recvSync:    pct.NewSyncChan(),
-		status:      pct.NewStatus([]string{name, name + "-link"}),
+		status:      pct.NewStatus([]string{name, name + "-link", name + "-stats", name + "-last-error"}),
 		name:        name,
+		stats:       newWsStats(),
+		apiErrors:   pct.NewAPIErrorReporter(logger, name, pct.DEFAULT_API_ERROR_REPORT_INTERVAL),
 	}
 	return c, nil
 }
 
+// QueueReplies makes send() queue replies that cannot be sent while the
+// websocket is down and resend them after reconnecting.  It must be called
+// before Start().
+func (c *WebsocketClient) QueueReplies(queue *ReplyQueue) {
+	c.queue = queue
+}
+
 func (c *WebsocketClient) Start() {
 	// Start send() and recv() goroutines, but they wait for successful Connect().
 	if !c.started {
@@ -111,10 +126,13 @@ func (c *WebsocketClient) Connect() {
 		time.Sleep(c.backoff.Wait())
 
 		if err := c.ConnectOnce(10); err != nil {
-			c.logger.Warn(err)
+			c.apiErrors.Report(0, err)
+			c.stats.error(err)
 			continue
 		}
 		c.backoff.Success()
+		c.apiErrors.Success()
+		c.stats.connected()
 
 		// Start/resume send() and recv() goroutines if Start() was called.
 		if c.started {
@@ -143,6 +161,14 @@ func (c *WebsocketClient) ConnectOnce(timeout uint) error {
 		return err
 	}
 	config.Header.Add("X-Percona-API-Key", c.api.ApiKey())
+
+	// Speak the protocol version negotiated when the API connected.
+	protocol, err := pct.NewProtocol(c.api.ProtocolVersion())
+	if err != nil {
+		return err
+	}
+	config.Header.Add(pct.PROTOCOL_HEADER, fmt.Sprintf("%d", protocol.Version()))
+
 	if c.headers != nil {
 		for k, v := range c.headers {
 			config.Header.Add(k, v)
@@ -157,7 +183,8 @@ func (c *WebsocketClient) ConnectOnce(timeout uint) error {
 
 	c.conn = conn
 	c.connected = true
-	c.status.Update(c.name, "Connected "+link)
+	c.protocol = protocol
+	c.status.Update(c.name, fmt.Sprintf("Connected %s (protocol v%d)", link, protocol.Version()))
 
 	return nil
 }
@@ -200,7 +227,7 @@ func (c *WebsocketClient) dialTimeout(config *websocket.Config, timeout uint) (w
 		return nil, &websocket.DialError{config, err}
 	}
 
-	ws, err = websocket.NewClient(config, conn)
+	ws, err = websocket.NewClient(config, wireConn{conn, c.stats})
 	if err != nil {
 		return nil, err
 	}
@@ -293,14 +320,42 @@ func (c *WebsocketClient) send() {
 		}
 	}()
 
+	// While disconnected, replies are queued if there's a queue, else they
+	// wait in sendChan (which blocks the agent once the chan is full).
+	var queueChan chan *proto.Reply
+	if c.queue != nil {
+		queueChan = c.sendChan
+	}
+
 	for {
 		// Wait to start (connect) or be told to stop.
 		c.logger.DebugOffline("send:wait:start")
-		select {
-		case <-c.sendSync.StartChan:
-			c.sendSync.StartChan <- true
-		case <-c.sendSync.StopChan:
-			return
+	WAIT_LOOP:
+		for {
+			select {
+			case <-c.sendSync.StartChan:
+				c.sendSync.StartChan <- true
+				break WAIT_LOOP
+			case reply := <-queueChan:
+				c.logger.DebugOffline("send:queue:", reply)
+				c.queueReply(reply)
+			case <-c.sendSync.StopChan:
+				c.queueReplies()
+				return
+			}
+		}
+
+		// Resend replies queued while disconnected before new replies.
+		if err := c.sendQueued(); err != nil {
+			c.logger.DebugOffline("send:err:", err)
+			c.stats.error(err)
+			select {
+			case c.errChan <- err:
+			default:
+			}
+			c.logger.DebugOffline("send:Disconnect")
+			c.Disconnect()
+			continue
 		}
 
 	SEND_LOOP:
@@ -310,8 +365,10 @@ func (c *WebsocketClient) send() {
 			case reply := <-c.sendChan:
 				// Got Reply from agent, send to API.
 				c.logger.DebugOffline("send:reply:", reply)
-				if err := c.Send(reply, 10); err != nil {
+				if err := c.sendReply(reply, 10); err != nil {
 					c.logger.DebugOffline("send:err:", err)
+					c.queueReply(reply)
+					c.stats.error(err)
 					select {
 					case c.errChan <- err:
 					default:
@@ -320,6 +377,7 @@ func (c *WebsocketClient) send() {
 				}
 			case <-c.sendSync.StopChan:
 				c.logger.DebugOffline("send:stop")
+				c.queueReplies()
 				return
 			}
 		}
@@ -329,6 +387,56 @@ func (c *WebsocketClient) send() {
 	}
 }
 
+func (c *WebsocketClient) queueReply(reply *proto.Reply) {
+	if c.queue == nil {
+		return
+	}
+	if err := c.queue.Push(reply); err != nil {
+		c.logger.Warn(fmt.Sprintf("Lost reply to %s cmd: %s", reply.Cmd, err))
+	}
+}
+
+func (c *WebsocketClient) queueReplies() {
+	// Queue replies not sent yet so they're sent after the agent restarts.
+	if c.queue == nil {
+		return
+	}
+	for {
+		select {
+		case reply := <-c.sendChan:
+			c.queueReply(reply)
+		default:
+			return
+		}
+	}
+}
+
+func (c *WebsocketClient) sendQueued() error {
+	if c.queue == nil {
+		return nil
+	}
+	for c.queue.Len() > 0 {
+		reply, err := c.queue.Peek()
+		if err != nil {
+			// Can't resend it, and it will never become valid, so drop it.
+			c.logger.Warn(err)
+			if err := c.queue.Remove(); err != nil {
+				c.logger.Warn(err)
+			}
+			continue
+		}
+		c.logger.DebugOffline("send:queued:", reply)
+		if err := c.sendReply(reply, 10); err != nil {
+			return err // reply stays queued
+		}
+		if err := c.queue.Remove(); err != nil {
+			// The reply was sent, it's only resent if the agent restarts.
+			c.logger.Warn(err)
+		}
+	}
+	return nil
+}
+
 func (c *WebsocketClient) recv() {
 	/**
 	 * Receive Cmd from API, forward to agent.
@@ -365,9 +473,10 @@ func (c *WebsocketClient) recv() {
 			}
 
 			// Wait for Cmd from API.
-			cmd := &proto.Cmd{}
-			if err := c.Recv(cmd, 0); err != nil {
+			cmd, err := c.recvCmd()
+			if err != nil {
 				c.logger.DebugOffline("recv:err:", err)
+				c.stats.error(err)
 				select {
 				case c.errChan <- err:
 				default:
@@ -403,7 +512,42 @@ func (c *WebsocketClient) Send(data interface{}, timeout uint) error {
 	} else {
 		c.conn.SetWriteDeadline(time.Time{})
 	}
-	return websocket.JSON.Send(c.conn, data)
+	// Same as websocket.JSON.Send() but we need the size for stats.
+	msg, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := websocket.Message.Send(c.conn, string(msg)); err != nil {
+		return err
+	}
+	c.stats.sent(len(msg))
+	return nil
+}
+
+// sendReply sends a reply encoded with the negotiated protocol.
+func (c *WebsocketClient) sendReply(reply *proto.Reply, timeout uint) error {
+	msg, err := c.protocol.EncodeReply(reply)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	if err := websocket.Message.Send(c.conn, string(msg)); err != nil {
+		return err
+	}
+	c.stats.sent(len(msg))
+	return nil
+}
+
+// recvCmd waits for a cmd and decodes it with the negotiated protocol.
+func (c *WebsocketClient) recvCmd() (*proto.Cmd, error) {
+	c.conn.SetReadDeadline(time.Time{})
+	var msg []byte
+	if err := websocket.Message.Receive(c.conn, &msg); err != nil {
+		return nil, err
+	}
+	c.stats.recv(len(msg))
+	return c.protocol.DecodeCmd(msg)
 }
 
 func (c *WebsocketClient) SendBytes(data []byte, timeout uint) error {
@@ -415,7 +559,11 @@ func (c *WebsocketClient) SendBytes(data []byte, timeout uint) error {
 		c.conn.SetWriteDeadline(time.Time{})
 	}
 	defer c.conn.SetWriteDeadline(time.Time{})
-	return websocket.Message.Send(c.conn, data)
+	if err := websocket.Message.Send(c.conn, data); err != nil {
+		return err
+	}
+	c.stats.sent(len(data))
+	return nil
 }
 
 func (c *WebsocketClient) Recv(data interface{}, timeout uint) error {
@@ -427,7 +575,13 @@ func (c *WebsocketClient) Recv(data interface{}, timeout uint) error {
 	} else {
 		c.conn.SetReadDeadline(time.Time{})
 	}
-	return websocket.JSON.Receive(c.conn, data)
+	// Same as websocket.JSON.Receive() but we need the size for stats.
+	var msg []byte
+	if err := websocket.Message.Receive(c.conn, &msg); err != nil {
+		return err
+	}
+	c.stats.recv(len(msg))
+	return json.Unmarshal(msg, data)
 }
 
 func (c *WebsocketClient) ConnectChan() chan bool {
@@ -442,9 +596,20 @@ func (c *WebsocketClient) Conn() *websocket.Conn {
 	return c.conn
 }
 
+// WireBytes returns the bytes written to the network since the agent started,
+// see WebsocketStats.
+func (c *WebsocketClient) WireBytes() uint64 {
+	return c.stats.get().WireBytes
+}
+
 func (c *WebsocketClient) Status() map[string]string {
 	c.status.Update(c.name+"-link", c.api.AgentLink(c.link))
-	return c.status.All()
+	stats := c.stats.get()
+	c.status.Update(c.name+"-stats", stats.String())
+	if stats.LastError != "" {
+		c.status.Update(c.name+"-last-error", fmt.Sprintf("at %s: %s", pct.TimeString(stats.LastErrorTs), stats.LastError))
+	}
+	return c.status.Merge(c.apiErrors.Status())
 }
 
 func (c *WebsocketClient) notifyConnect(state bool) {
@@ -0,0 +1,42 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * With Config.RequireAck, the sender removes a spool file only when the API
+ * acks it: a 2xx response with the SHA-256 (see Checksum) of the upload the
+ * API ingested.  A plain 200 only means the upload arrived, and a network
+ * reset between the API reading and ingesting it loses the data.  A missing
+ * or wrong checksum is a nack: the files are kept and resent, and a file that
+ * is nacked MAX_NACKS times is moved to the trash (not removed) so one bad
+ * file can't block the rest.  Files sent but not acked, e.g. Recv timeout,
+ * are resent until they are acked.
+ */
+
+const MAX_NACKS = 5
+
+// An Ack is the API response to an upload: a proto.Response plus, from an API
+// that acks uploads, the checksum of the upload.
+type Ack struct {
+	proto.Response
+	Checksum string `json:",omitempty"`
+}
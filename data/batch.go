@@ -0,0 +1,72 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+/**
+ * A batch sends many spool files in one upload instead of one websocket
+ * message and ack per file, which saves round trips on agents that report
+ * every minute over WAN links.  Files are batched only if the API accepts
+ * pct.CONTENT_TYPE_BATCH (see pct/protocol.go) and Config.BatchBytes is set,
+ * else every file is sent alone like old agents do.  A batch is a JSON array
+ * of the files' payloads, which are JSON-encoded proto.Data, so it's no bigger
+ * than the files sent alone, and the API tells a batch from a single file by
+ * its first byte.  The payloads are already compressed (Config.Encoding
+ * "gzip", the default), so a batch isn't compressed again.
+ *
+ * The API acks a batch as a whole (with Config.RequireAck, the checksum of
+ * the batch).  If it rejects a batch (4xx), the files
+ * are sent alone so only the bad ones are removed.  Config.BatchAge holds
+ * files until BatchBytes are spooled or BatchAge seconds have passed since
+ * the last send, so batches are fuller.
+ */
+
+// EncodeBatch returns the batch of the payloads.
+func EncodeBatch(payloads [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, payload := range payloads {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(payload)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// DecodeBatch returns the payloads in a batch made by EncodeBatch.
+func DecodeBatch(data []byte) ([][]byte, error) {
+	if len(data) == 0 || data[0] != '[' {
+		return nil, errors.New("not a batch")
+	}
+	raw := []json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, len(raw))
+	for i := range raw {
+		payloads[i] = []byte(raw[i])
+	}
+	return payloads, nil
+}
@@ -30,8 +30,26 @@ const (
 )
 
 type Config struct {
-	Encoding     string
+	Encoding     string // "" (JSON), "gzip" (JSON), "msgpack", or "msgpack-gzip", see serializer.go
 	SendInterval uint
 	Blackhole    bool // don't send if true
 	Limits       proto.DataSpoolLimits
+	Quota        uint64 // max bytes spooled, low priority data evicted first, 0 = Limits only
+	RequireAck   bool   // remove files only when the API acks their checksum, see Ack
+	BatchBytes   uint   // send files in batches up to this size if the API accepts them, see batch.go
+	BatchAge     uint   // seconds to hold files for a batch, 0 = send every SendInterval
+	Encrypt      bool   // encrypt spool files, see crypt.go
+	EncryptKey   string // "file" (default): <basedir>/spool.key, "api-key": derived from API key
+	Mirror       string // also write reports as JSON lines to this file or unix:<socket>, see mirror.go
+	// --
+	Graphite         string   // also send mm metrics to this Carbon host:port, see graphite.go
+	GraphiteTemplate string   // metric path, default DEFAULT_GRAPHITE_TEMPLATE
+	GraphiteStats    []string // stats to send, e.g. "avg", "max", "pct99", default "avg"
+	// --
+	InfluxDB      string // also send mm metrics to this InfluxDB write URL, see influxdb.go
+	InfluxDBBatch uint   // max lines per write, default DEFAULT_INFLUXDB_BATCH
+	// --
+	OpenTSDB      string   // also send mm metrics to this OpenTSDB URL, see opentsdb.go
+	OpenTSDBBatch uint     // max points per put, default DEFAULT_OPENTSDB_BATCH
+	OpenTSDBStats []string // stats to send, tagged stat=<stat>, default "avg"
 }
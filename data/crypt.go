@@ -0,0 +1,133 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/**
+ * Spool files can be encrypted at rest (Config.Encrypt) because QAN data has
+ * query text with literal values which can be sensitive.  An encrypted spool
+ * file is ENCRYPTED_SPOOL_HEADER, a 12 byte nonce, and the AES-256-GCM sealed
+ * spool file (header and payload, see spoolfile.go).  The spooler encrypts in
+ * run() and decrypts in Read(), so the sender and everything else see plain
+ * spool files.  The key is random, in <basedir>/spool.key, or derived from the
+ * API key (Config.EncryptKey="api-key") so a reinstalled agent can still read
+ * the spool.  Plain files are read as-is, so encryption can be enabled with
+ * data in the spool.  A file that can't be decrypted (no key or wrong key) is
+ * returned as-is and DecodeSpoolFile fails with ErrSpoolKey, so the sender
+ * moves it to the trash.
+ */
+
+const (
+	ENCRYPTED_SPOOL_HEADER = "#percona-agent-spool-aes-256-gcm\n"
+	SPOOL_KEY_SIZE         = 32 // AES-256
+)
+
+var ErrSpoolKey = errors.New("cannot decrypt spool file: no key or wrong key")
+
+// EncryptedSpooler is a Spooler that can encrypt spool files.
+type EncryptedSpooler interface {
+	Spooler
+	SetEncryption(key []byte, encrypt bool) error
+}
+
+func newSpoolCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSpoolFile returns the encrypted spool file.
+func EncryptSpoolFile(aead cipher.AEAD, file []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(ENCRYPTED_SPOOL_HEADER)+len(nonce)+len(file)+aead.Overhead())
+	out = append(out, ENCRYPTED_SPOOL_HEADER...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, file, []byte(ENCRYPTED_SPOOL_HEADER)), nil
+}
+
+// DecryptSpoolFile returns the decrypted spool file, or the file as-is if
+// it's not encrypted.  aead can be nil if there's no key.
+func DecryptSpoolFile(aead cipher.AEAD, file []byte) ([]byte, error) {
+	if !IsEncryptedSpoolFile(file) {
+		return file, nil
+	}
+	if aead == nil {
+		return nil, ErrSpoolKey
+	}
+	sealed := file[len(ENCRYPTED_SPOOL_HEADER):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrSpoolKey
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(ENCRYPTED_SPOOL_HEADER))
+	if err != nil {
+		return nil, ErrSpoolKey
+	}
+	return plain, nil
+}
+
+func IsEncryptedSpoolFile(file []byte) bool {
+	return bytes.HasPrefix(file, []byte(ENCRYPTED_SPOOL_HEADER))
+}
+
+// LoadSpoolKey returns the hex-encoded key in the file, or makes a random key
+// and saves it in the file if it doesn't exist.
+func LoadSpoolKey(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != SPOOL_KEY_SIZE {
+			return nil, errors.New("Invalid spool key in " + file)
+		}
+		return key, nil
+	}
+	key := make([]byte, SPOOL_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ApiKeySpoolKey returns the spool key derived from the API key.
+func ApiKeySpoolKey(apiKey string) []byte {
+	sum := sha256.Sum256([]byte("percona-agent spool key:" + apiKey))
+	return sum[:]
+}
@@ -18,14 +18,19 @@
 package data_test
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -136,12 +141,15 @@ func (s *DiskvSpoolerTestSuite) TestSpoolData(t *C) {
 	}
 
 	// data is proto.Data[ metadata, Data: proto.LogEntry[...] ]
-	data, err := spool.Read(gotFiles[0])
+	file, err := spool.Read(gotFiles[0])
 	if err != nil {
 		t.Error(err)
 	}
+	version, payload, err := data.DecodeSpoolFile(file)
+	t.Assert(err, IsNil)
+	t.Check(version, Equals, data.SPOOL_VERSION)
 	protoData := &proto.Data{}
-	if err := json.Unmarshal(data, protoData); err != nil {
+	if err := json.Unmarshal(payload, protoData); err != nil {
 		t.Fatal(err)
 	}
 	t.Check(protoData.Service, Equals, "log")
@@ -214,6 +222,8 @@ func (s *DiskvSpoolerTestSuite) TestSpoolGzipData(t *C) {
 		t.Fatal("1st file has data")
 	}
 
+	_, gotData, err = data.DecodeSpoolFile(gotData)
+	t.Assert(err, IsNil)
 	protoData := &proto.Data{}
 	if err := json.Unmarshal(gotData, protoData); err != nil {
 		t.Fatal(err)
@@ -270,6 +280,8 @@ func (s *DiskvSpoolerTestSuite) TestSpoolGzipData(t *C) {
 		t.Fatal("2nd file has data")
 	}
 
+	_, gotData, err = data.DecodeSpoolFile(gotData)
+	t.Assert(err, IsNil)
 	protoData = &proto.Data{}
 	if err := json.Unmarshal(gotData, protoData); err != nil {
 		t.Fatal(err)
@@ -379,7 +391,7 @@ func (s *DiskvSpoolerTestSuite) TestSpoolLimits(t *C) {
 
 	limits := proto.DataSpoolLimits{
 		MaxAge:   10,   // seconds
-		MaxSize:  1024, // bytes
+		MaxSize:  2048, // bytes
 		MaxFiles: 2,
 	}
 
@@ -414,6 +426,11 @@ func (s *DiskvSpoolerTestSuite) TestSpoolLimits(t *C) {
 	t.Check(removed["size"], HasLen, 0)
 	t.Assert(removed["files"], HasLen, 1) // here it is
 
+	// Purged bytes are reported apart from evicted bytes, and what's left
+	// is still spooled.
+	status := spool.Status()
+	t.Check(status["data-spooler-log"], Matches, `\d+\.\d\d B spooled, 0 evicted, \d+\.\d\d B purged`)
+
 	// Find out how large the files are so we can purge based on MaxSize.
 	totalSize := 0
 	for file := range spool.Files() {
@@ -461,7 +478,7 @@ func (s *DiskvSpoolerTestSuite) TestSpoolLimits(t *C) {
 	// Finally, test that the auto-purge works by sending a tick manually.
 	limits = proto.DataSpoolLimits{
 		MaxAge:   10,   // seconds
-		MaxSize:  1024, // bytes
+		MaxSize:  2048, // bytes
 		MaxFiles: 2,
 	}
 	spool = data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", limits)
@@ -485,6 +502,311 @@ func (s *DiskvSpoolerTestSuite) TestSpoolLimits(t *C) {
 	t.Assert(files, HasLen, 2)
 }
 
+func (s *DiskvSpoolerTestSuite) TestQuota(t *C) {
+	sz := data.NewJsonSerializer()
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	t.Assert(spool, NotNil)
+
+	// Files are about 1.6k, so 2 fit in the quota and a 3rd makes the
+	// spooler evict one.
+	spool.SetQuota(4000)
+	err := spool.Start(sz)
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+
+	payload := strings.Repeat("x", 1000)
+	for _, service := range []string{"mm", "qan", "mm", "qan", "qan"} {
+		err := spool.Write(service, payload)
+		t.Assert(err, IsNil)
+		time.Sleep(10 * time.Millisecond) // unique file ts
+	}
+
+	// Oldest mm is evicted first, then the newer mm, then oldest qan, so the
+	// 2 newest qan files are left.
+	var status map[string]string
+	for i := 0; i < 20; i++ {
+		status = spool.Status()
+		if !strings.Contains(status["data-spooler-qan"], " 0 evicted") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	files := []string{}
+	for file := range spool.Files() {
+		files = append(files, file)
+	}
+	t.Assert(files, HasLen, 2)
+	t.Check(strings.HasPrefix(files[0], "qan_"), Equals, true)
+	t.Check(strings.HasPrefix(files[1], "qan_"), Equals, true)
+
+	// Spooled is what's in the spool now: mm files were all evicted.
+	t.Check(status["data-spooler-mm"], Matches, `0 spooled, \d.\d\d kB evicted, 0 purged`)
+	t.Check(status["data-spooler-qan"], Matches, `\d.\d\d kB spooled, 1.\d\d kB evicted, 0 purged`)
+}
+
+func (s *DiskvSpoolerTestSuite) TestPurgeInstance(t *C) {
+	sz := data.NewJsonSerializer()
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	t.Assert(spool, NotNil)
+	spool.SetInstanceUUID(func(service string, id uint) string {
+		return fmt.Sprintf("uuid-%s-%d", service, id)
+	})
+	err := spool.Start(sz)
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+
+	// Reports from one instance embed proto.ServiceInstance.
+	type report struct {
+		proto.ServiceInstance
+		Msg string
+	}
+	err = spool.Write("qan", &report{proto.ServiceInstance{Service: "mysql", InstanceId: 1}, "one"})
+	t.Assert(err, IsNil)
+	err = spool.Write("qan", report{proto.ServiceInstance{Service: "mysql", InstanceId: 2}, "two"})
+	t.Assert(err, IsNil)
+	err = spool.Write("mm", "many instances")
+	t.Assert(err, IsNil)
+	files := test.WaitFiles(s.dataDir, 3)
+	t.Assert(files, HasLen, 3)
+
+	names := []string{}
+	for file := range spool.Files() {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	t.Check(names[0], Matches, `mm_\d+`)
+	t.Check(names[1], Matches, `qan_\d+_uuid-mysql-1`)
+	t.Check(names[2], Matches, `qan_\d+_uuid-mysql-2`)
+
+	n, size := spool.PurgeInstance("uuid-mysql-1")
+	t.Check(n, Equals, 1)
+	t.Check(size > 0, Equals, true)
+
+	names = []string{}
+	for file := range spool.Files() {
+		names = append(names, file)
+	}
+	t.Check(names, HasLen, 2)
+	trash, _ := filepath.Glob(path.Join(s.trashDir, "data", "qan_*_uuid-mysql-1"))
+	t.Check(trash, HasLen, 1)
+
+	// Data of the purged instance written late is dropped.
+	err = spool.Write("qan", &report{proto.ServiceInstance{Service: "mysql", InstanceId: 1}, "late"})
+	t.Assert(err, IsNil)
+	err = spool.Write("qan", &report{proto.ServiceInstance{Service: "mysql", InstanceId: 2}, "two again"})
+	t.Assert(err, IsNil)
+	files = test.WaitFiles(s.dataDir, 3)
+	t.Check(files, HasLen, 3)
+	late, _ := filepath.Glob(path.Join(s.dataDir, "qan_*_uuid-mysql-1"))
+	t.Check(late, HasLen, 0)
+
+	// Nothing left to purge.
+	n, _ = spool.PurgeInstance("uuid-mysql-1")
+	t.Check(n, Equals, 0)
+}
+
+func (s *DiskvSpoolerTestSuite) TestEncrypt(t *C) {
+	key, err := data.LoadSpoolKey(path.Join(s.basedir, "spool.key"))
+	t.Assert(err, IsNil)
+	t.Check(key, HasLen, data.SPOOL_KEY_SIZE)
+
+	// Same key next time.
+	key2, err := data.LoadSpoolKey(path.Join(s.basedir, "spool.key"))
+	t.Assert(err, IsNil)
+	t.Check(key2, DeepEquals, key)
+
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	err = spool.SetEncryption(key, true)
+	t.Assert(err, IsNil)
+	err = spool.Start(data.NewJsonSerializer())
+	t.Assert(err, IsNil)
+
+	logEntry := &proto.LogEntry{
+		Ts:      time.Now(),
+		Level:   1,
+		Service: "qan",
+		Msg:     "SELECT * FROM users WHERE ssn='078-05-1120'",
+	}
+	spool.Write("log", logEntry)
+	files := test.WaitFiles(s.dataDir, 1)
+	t.Assert(files, HasLen, 1)
+
+	// The file on disk is encrypted...
+	onDisk, err := ioutil.ReadFile(path.Join(s.dataDir, files[0].Name()))
+	t.Assert(err, IsNil)
+	t.Check(data.IsEncryptedSpoolFile(onDisk), Equals, true)
+	t.Check(bytes.Contains(onDisk, []byte(`"Service":"log"`)), Equals, false)
+
+	// ...but the spooler reads it decrypted.
+	file, err := spool.Read(files[0].Name())
+	t.Assert(err, IsNil)
+	_, payload, err := data.DecodeSpoolFile(file)
+	t.Assert(err, IsNil)
+	protoData := &proto.Data{}
+	err = json.Unmarshal(payload, protoData)
+	t.Assert(err, IsNil)
+	t.Check(bytes.Contains(protoData.Data, []byte("078-05-1120")), Equals, true)
+	spool.Stop()
+
+	// Without the key, the file can't be decoded so the sender rejects it.
+	spool = data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	err = spool.Start(data.NewJsonSerializer())
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+	file, err = spool.Read(files[0].Name())
+	t.Assert(err, IsNil)
+	_, _, err = data.DecodeSpoolFile(file)
+	t.Check(err, Equals, data.ErrSpoolKey)
+
+	// Or with the wrong key.
+	err = spool.SetEncryption(data.ApiKeySpoolKey("123"), false)
+	t.Assert(err, IsNil)
+	file, err = spool.Read(files[0].Name())
+	t.Assert(err, IsNil)
+	_, _, err = data.DecodeSpoolFile(file)
+	t.Check(err, Equals, data.ErrSpoolKey)
+}
+
+func (s *DiskvSpoolerTestSuite) TestEncryptPurgeAndEvict(t *C) {
+	key := data.ApiKeySpoolKey("123")
+	sz := data.NewJsonSerializer()
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	err := spool.SetEncryption(key, true)
+	t.Assert(err, IsNil)
+	err = spool.Start(sz)
+	t.Assert(err, IsNil)
+	payload := strings.Repeat("x", 1000)
+	for i := 0; i < 3; i++ {
+		spool.Write("mm", payload)
+		time.Sleep(10 * time.Millisecond) // unique file ts
+	}
+	files := test.WaitFiles(s.dataDir, 3)
+	t.Assert(files, HasLen, 3)
+	spool.Stop()
+
+	// After a restart the spooler hasn't read any file, so purging and
+	// evicting must size the encrypted files without decrypting them.
+	spool = data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	err = spool.SetEncryption(key, true)
+	t.Assert(err, IsNil)
+	err = spool.Start(sz)
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+
+	doneChan := make(chan int, 1)
+	go func() {
+		n, _ := spool.Purge(time.Now().UTC(), proto.DataSpoolLimits{MaxAge: 3600, MaxSize: 1024 * 1024, MaxFiles: 2})
+		doneChan <- n
+	}()
+	select {
+	case n := <-doneChan:
+		t.Check(n, Equals, 1)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Purge of encrypted files deadlocked")
+	}
+
+	// Files are about 1.6k encrypted, so 2 fit in the quota and a 3rd
+	// makes the spooler evict one.
+	spool.SetQuota(4000)
+	err = spool.Write("mm", payload)
+	t.Assert(err, IsNil)
+	var status map[string]string
+	for i := 0; i < 20; i++ {
+		status = spool.Status()
+		if !strings.Contains(status["data-spooler-mm"], " 0 evicted") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Check(status["data-spooler-mm"], Matches, `\d.\d\d kB spooled, 1.\d\d kB evicted, .+`)
+
+	// The spooler still works.
+	err = spool.Write("mm", payload)
+	t.Check(err, IsNil)
+}
+
+func (s *DiskvSpoolerTestSuite) TestMirror(t *C) {
+	spool := data.NewDiskvSpooler(s.logger, s.dataDir, s.trashDir, "localhost", s.limits)
+	err := spool.Start(data.NewJsonGzipSerializer())
+	t.Assert(err, IsNil)
+	defer spool.Stop()
+
+	// Mirror to a file.
+	mirrorFile := path.Join(s.basedir, "mirror.json")
+	mirror := data.NewMirror(s.logger, mirrorFile, "localhost")
+	err = mirror.Start()
+	t.Assert(err, IsNil)
+	spool.SetTap("mirror", mirror)
+
+	logEntry := &proto.LogEntry{
+		Ts:      time.Now(),
+		Level:   1,
+		Service: "mm",
+		Msg:     "hello",
+	}
+	spool.Write("log", logEntry)
+	spool.Write("log", logEntry)
+	files := test.WaitFiles(s.dataDir, 2)
+	t.Assert(files, HasLen, 2)
+	mirror.Stop()
+
+	// Reports are mirrored as JSON lines, not gzipped like the spool files.
+	content, err := ioutil.ReadFile(mirrorFile)
+	t.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	t.Assert(lines, HasLen, 2)
+	entry := &data.MirrorEntry{}
+	err = json.Unmarshal([]byte(lines[0]), entry)
+	t.Assert(err, IsNil)
+	t.Check(entry.Service, Equals, "log")
+	t.Check(entry.Hostname, Equals, "localhost")
+	t.Assert(entry.Data, NotNil)
+	gotLogEntry := &proto.LogEntry{}
+	err = json.Unmarshal(*entry.Data, gotLogEntry)
+	t.Assert(err, IsNil)
+	t.Check(gotLogEntry.Msg, Equals, "hello")
+
+	// Mirror to a Unix socket.
+	socket := path.Join(s.basedir, "mirror.sock")
+	listener, err := net.Listen("unix", socket)
+	t.Assert(err, IsNil)
+	defer listener.Close()
+
+	mirror = data.NewMirror(s.logger, "unix:"+socket, "localhost")
+	err = mirror.Start()
+	t.Assert(err, IsNil)
+	spool.SetTap("mirror", mirror)
+	spool.Write("log", logEntry)
+
+	conn, err := listener.Accept()
+	t.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	t.Assert(err, IsNil)
+	entry = &data.MirrorEntry{}
+	err = json.Unmarshal(line, entry)
+	t.Assert(err, IsNil)
+	t.Check(entry.Service, Equals, "log")
+
+	// The status is updated after the line is written, so wait for it.
+	var status string
+	for i := 0; i < 20; i++ {
+		status = mirror.Status()["data-mirror"]
+		if strings.HasPrefix(status, "Mirroring to unix:") && strings.Contains(status, "(1 written") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Check(status, Matches, `Mirroring to unix:.+ \(1 written, 0 dropped\)`)
+
+	spool.SetTap("mirror", nil)
+	mirror.Stop()
+
+	t.Check(data.ValidateMirror("relative/file"), NotNil)
+	t.Check(data.ValidateMirror("unix:/var/run/agent.sock"), IsNil)
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Sender test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -753,6 +1075,46 @@ func (s *SenderTestSuite) TestRecvErrors(t *C) {
 	})
 }
 
+func (s *SenderTestSuite) TestAuthError(t *C) {
+	/**
+	 * 401 means the API key is bad, not the file, so files are kept, and
+	 * the error is reported as an auth error.
+	 */
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"file1", "file2"}
+	spool.DataOut = map[string][]byte{
+		"file1": []byte("file1"),
+		"file2": []byte("file2"),
+	}
+
+	sender := data.NewSender(s.logger, s.client)
+	err := sender.Start(spool, s.tickerChan, 5, false)
+	t.Assert(err, IsNil)
+
+	s.tickerChan <- time.Now()
+
+	got := test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+
+	select {
+	case s.respChan <- &proto.Response{Code: 401, Error: "Invalid API key"}:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Sender receives prot.Response after sending data")
+	}
+
+	if !test.WaitStatusPrefix(data.MAX_SEND_ERRORS*data.CONNECT_ERROR_WAIT, sender, "data-sender", "Idle") {
+		t.Fatal("Timeout waiting for data-sender status=Idle")
+	}
+
+	t.Check(len(spool.DataOut), Equals, 2)
+	t.Check(len(spool.RejectedFiles), Equals, 0)
+	status := sender.Status()
+	t.Check(status["data-sender-api-error"], Matches, "auth at .+: 401 response to file1: Invalid API key .+")
+
+	err = sender.Stop()
+	t.Assert(err, IsNil)
+}
+
 func (s *SenderTestSuite) Test500Error(t *C) {
 	spool := mock.NewSpooler(nil)
 	spool.FilesOut = []string{"file1", "file2", "file3"}
@@ -855,6 +1217,434 @@ func (s *SenderTestSuite) TestBadFiles(t *C) {
 	t.Check(len(spool.RejectedFiles), Equals, 0)
 }
 
+func (s *SenderTestSuite) TestSpoolVersions(t *C) {
+	slow001, err := ioutil.ReadFile(sample + "slow001.json")
+	t.Assert(err, IsNil)
+
+	// v1 files, written by agents before spool files had a header, and
+	// current files send the same data.  A file from a newer agent is
+	// rejected, not sent or removed.
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"v1", "current", "v99"}
+	spool.DataOut = map[string][]byte{
+		"v1":      slow001,
+		"current": data.EncodeSpoolFile(slow001),
+		"v99":     append([]byte("#percona-agent-spool 99\n"), slow001...),
+	}
+
+	sender := data.NewSender(s.logger, s.client)
+	err = sender.Start(spool, s.tickerChan, 5, false)
+	t.Assert(err, IsNil)
+
+	doneChan := make(chan bool, 1)
+	sentChan := make(chan []byte, 3)
+	go func() {
+		for {
+			select {
+			case bytes := <-s.dataChan:
+				sentChan <- bytes
+			case <-doneChan:
+				return
+			}
+			select {
+			case s.respChan <- &proto.Response{Code: 200}:
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	s.tickerChan <- time.Now()
+
+	if !test.WaitStatusPrefix(5, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+
+	doneChan <- true
+	err = sender.Stop()
+	t.Assert(err, IsNil)
+
+	t.Assert(sentChan, HasLen, 2)
+	t.Check(<-sentChan, DeepEquals, slow001)
+	t.Check(<-sentChan, DeepEquals, slow001)
+	t.Check(spool.RejectedFiles, DeepEquals, []string{"v99"})
+	t.Check(len(spool.DataOut), Equals, 0)
+}
+
+func (s *SenderTestSuite) TestDecodeSpoolFile(t *C) {
+	version, payload, err := data.DecodeSpoolFile(data.EncodeSpoolFile([]byte("{}")))
+	t.Check(err, IsNil)
+	t.Check(version, Equals, data.SPOOL_VERSION)
+	t.Check(string(payload), Equals, "{}")
+
+	version, payload, err = data.DecodeSpoolFile([]byte("{}"))
+	t.Check(err, IsNil)
+	t.Check(version, Equals, 1)
+	t.Check(string(payload), Equals, "{}")
+
+	_, _, err = data.DecodeSpoolFile([]byte("#percona-agent-spool 99\n{}"))
+	t.Check(err, Equals, data.SpoolVersionError{Version: 99})
+
+	_, _, err = data.DecodeSpoolFile([]byte("#percona-agent-spool x\n{}"))
+	t.Check(err, NotNil)
+
+	// v2 files have no checksum.
+	version, payload, err = data.DecodeSpoolFile([]byte("#percona-agent-spool 2\n{}"))
+	t.Check(err, IsNil)
+	t.Check(version, Equals, 2)
+	t.Check(string(payload), Equals, "{}")
+
+	// A file corrupted on disk doesn't match its checksum.
+	file := data.EncodeSpoolFile([]byte(`{"a":1}`))
+	file[len(file)-2] = '2'
+	_, _, err = data.DecodeSpoolFile(file)
+	t.Check(err, Equals, data.SpoolChecksumError{
+		Header:  data.Checksum([]byte(`{"a":1}`)),
+		Payload: data.Checksum([]byte(`{"a":2}`)),
+	})
+}
+
+func (s *SenderTestSuite) TestFallback(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"file1"}
+	spool.DataOut = map[string][]byte{"file1": []byte("file1")}
+
+	fallbackDataChan := make(chan []byte, 5)
+	fallbackRespChan := make(chan interface{})
+	fallback := mock.NewDataClient(fallbackDataChan, fallbackRespChan)
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetFallback(fallback)
+	err := sender.Start(spool, s.tickerChan, 60, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+	t.Check(sender.Status()["data-sender-transport"], Equals, "websocket, fallback ready")
+
+	// Websocket can't connect, so the sender gives up this run...
+	s.client.ConnectError = io.EOF
+	defer func() { s.client.ConnectError = nil }()
+	s.tickerChan <- time.Now()
+	if !test.WaitStatusPrefix(data.MAX_SEND_ERRORS*data.CONNECT_ERROR_WAIT, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+	t.Check(len(spool.DataOut), Equals, 1)
+	t.Check(sender.Status()["data-sender-transport"], Matches, "fallback since .+, websocket failed 3 times")
+
+	// ...and sends with the fallback next run.
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(fallbackDataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, []byte("file1"))
+	fallbackRespChan <- &proto.Response{Code: 200}
+	got = test.WaitBytes(s.dataChan)
+	t.Check(got, HasLen, 0)
+
+	trace := test.DrainTraceChan(fallback.TraceChan)
+	t.Check(trace, DeepEquals, []string{
+		"ConnectOnce",
+		"SendBytes",
+		"Recv",
+		"DisconnectOnce",
+	})
+}
+
+func (s *SenderTestSuite) TestFallbackSendErrors(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"file1"}
+	spool.DataOut = map[string][]byte{"file1": []byte("file1")}
+
+	fallbackDataChan := make(chan []byte, 5)
+	fallbackRespChan := make(chan interface{})
+	fallback := mock.NewDataClient(fallbackDataChan, fallbackRespChan)
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetFallback(fallback)
+	err := sender.Start(spool, s.tickerChan, 60, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	// Websocket connects but a proxy kills it once data flows, so every
+	// send fails and the sender gives up this run...
+	doneChan := make(chan bool)
+	go func() {
+		for {
+			select {
+			case s.client.RecvError <- io.EOF:
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+	s.tickerChan <- time.Now()
+	if !test.WaitStatusPrefix(data.MAX_SEND_ERRORS*data.CONNECT_ERROR_WAIT, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+	doneChan <- true
+	test.WaitBytes(s.dataChan)
+	t.Check(len(spool.DataOut), Equals, 1)
+	t.Check(sender.Status()["data-sender-transport"], Matches, "fallback since .+, websocket failed 3 times")
+
+	// ...and sends with the fallback next run.
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(fallbackDataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, []byte("file1"))
+	fallbackRespChan <- &proto.Response{Code: 200}
+	if !test.WaitStatusPrefix(5, sender, "data-sender", "Idle") {
+		t.Fatal("Timeout waiting for data-sender status=Idle")
+	}
+	t.Check(len(spool.DataOut), Equals, 0)
+}
+
+// wireClient is a data client that writes 10 bytes of framing per message.
+type wireClient struct {
+	*mock.DataClient
+	wireBytes uint64
+}
+
+func (c *wireClient) SendBytes(data []byte, timeout uint) error {
+	c.wireBytes += uint64(len(data)) + 10
+	return c.DataClient.SendBytes(data, timeout)
+}
+
+func (c *wireClient) WireBytes() uint64 {
+	return c.wireBytes
+}
+
+func (s *SenderTestSuite) TestLedger(t *C) {
+	tmpDir, err := ioutil.TempDir("/tmp", "percona-agent-data-sender-test")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(tmpDir)
+	ledger := data.NewLedger(s.logger, path.Join(tmpDir, "ledger.json"))
+
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"mm_1", "qan_2"}
+	spool.DataOut = map[string][]byte{"mm_1": []byte("mm data"), "qan_2": []byte("qan data")}
+
+	// The ledger accounts the bytes the transport wrote, not the file size.
+	sender := data.NewSender(s.logger, &wireClient{DataClient: s.client})
+	sender.SetLedger(ledger)
+	err = sender.Start(spool, s.tickerChan, 5, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	s.tickerChan <- time.Now()
+	for i := 0; i < 2; i++ {
+		test.WaitBytes(s.dataChan)
+		s.respChan <- &proto.Response{Code: 200}
+	}
+
+	// The sender accounts a file after the API acks it.
+	var days []data.LedgerDay
+	for i := 0; i < 20; i++ {
+		days = ledger.Days()
+		if len(days) == 1 && days[0].Services["qan"] != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Assert(days, HasLen, 1)
+	t.Check(*days[0].Services["mm"], Equals, data.LedgerEntry{SentFiles: 1, SentBytes: 17})
+	t.Check(*days[0].Services["qan"], Equals, data.LedgerEntry{SentFiles: 1, SentBytes: 18})
+}
+
+func (s *SenderTestSuite) TestRequireAck(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"file1", "file2"}
+	spool.DataOut = map[string][]byte{"file1": []byte("file1"), "file2": []byte("file2")}
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetRequireAck(true)
+	err := sender.Start(spool, s.tickerChan, 60, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	// API acks file1 but responds to file2 without a checksum (e.g. old API),
+	// so file2 is kept and resent.
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	s.respChan <- &data.Ack{Response: proto.Response{Code: 200}, Checksum: data.Checksum([]byte("file1"))}
+	got = test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0], DeepEquals, []byte("file2"))
+	s.respChan <- &data.Ack{Response: proto.Response{Code: 200}}
+
+	// Sender reconnects and resends file2, and the API acks it this time.
+	select {
+	case resent := <-s.dataChan:
+		t.Check(resent, DeepEquals, []byte("file2"))
+	case <-time.After(2 * data.CONNECT_ERROR_WAIT * time.Second):
+		t.Fatal("Timeout waiting for file2 to be resent")
+	}
+	t.Check(sender.Status()["data-sender-resend"], Equals, "1 files")
+	s.respChan <- &data.Ack{Response: proto.Response{Code: 200}, Checksum: data.Checksum([]byte("file2"))}
+
+	if !test.WaitStatusPrefix(5, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+	t.Check(len(spool.DataOut), Equals, 0)
+	t.Check(spool.RejectedFiles, HasLen, 0)
+	t.Check(sender.Status()["data-sender-resend"], Equals, "0 files")
+}
+
+func (s *SenderTestSuite) TestPruneResend(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut = []string{"file1"}
+	spool.DataOut = map[string][]byte{"file1": []byte("file1")}
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetRequireAck(true)
+	err := sender.Start(spool, s.tickerChan, 60, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	// API doesn't ack file1, so it's queued to resend, then fails when
+	// it's resent, so it's still queued after this run.
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	s.respChan <- &data.Ack{Response: proto.Response{Code: 200}}
+	select {
+	case <-s.dataChan:
+	case <-time.After(2 * data.CONNECT_ERROR_WAIT * time.Second):
+		t.Fatal("Timeout waiting for file1 to be resent")
+	}
+	s.respChan <- &data.Ack{Response: proto.Response{Code: 503}}
+	if !test.WaitStatusPrefix(5, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+	t.Check(sender.Status()["data-sender-resend"], Equals, "1 files")
+
+	// Spooler purges file1, so the next run unqueues it.
+	spool.FilesOut = []string{}
+	s.tickerChan <- time.Now()
+	if !test.WaitStatusPrefix(5, sender, "data-sender-resend", "0 files") {
+		t.Error("Timeout waiting for data-sender-resend 0 files, got ", sender.Status()["data-sender-resend"])
+	}
+}
+
+// batchFiles returns spool files whose payloads are JSON, like real ones.
+func batchFiles(names ...string) ([]string, map[string][]byte) {
+	files := map[string][]byte{}
+	for _, name := range names {
+		files[name] = []byte(`{"Service":"` + name + `"}`) // 18 bytes
+	}
+	return names, files
+}
+
+func (s *SenderTestSuite) TestBatch(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut, spool.DataOut = batchFiles("mm_1", "mm_2", "mm_3")
+
+	// mm_1 and mm_2 fit in 40 bytes, mm_3 doesn't so it's sent alone.
+	accepted := []string{pct.CONTENT_TYPE_JSON, pct.CONTENT_TYPE_BATCH}
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetBatch(40, 0, func() []string { return accepted })
+	err := sender.Start(spool, s.tickerChan, 5, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	payloads, err := data.DecodeBatch(got[0])
+	t.Assert(err, IsNil)
+	t.Check(payloads, DeepEquals, [][]byte{[]byte(`{"Service":"mm_1"}`), []byte(`{"Service":"mm_2"}`)})
+	s.respChan <- &proto.Response{Code: 200}
+	got = test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(string(got[0]), Equals, `{"Service":"mm_3"}`)
+	s.respChan <- &proto.Response{Code: 200}
+	if !test.WaitStatusPrefix(5, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+	t.Check(spool.DataOut, HasLen, 0)
+
+	// An API that doesn't accept batches gets every file alone.
+	spool.FilesOut, spool.DataOut = batchFiles("mm_4", "mm_5")
+	accepted = []string{pct.CONTENT_TYPE_JSON}
+	s.tickerChan <- time.Now()
+	for _, file := range spool.FilesOut {
+		got = test.WaitBytes(s.dataChan)
+		t.Assert(got, HasLen, 1)
+		t.Check(string(got[0]), Equals, `{"Service":"`+file+`"}`)
+		s.respChan <- &proto.Response{Code: 200}
+	}
+}
+
+func (s *SenderTestSuite) TestBatchRejected(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut, spool.DataOut = batchFiles("mm_1", "mm_2", "mm_3")
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetBatch(100, 0, func() []string { return []string{pct.CONTENT_TYPE_BATCH} })
+	err := sender.Start(spool, s.tickerChan, 5, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	// The API rejects the batch because mm_2 is bad, so the files are sent
+	// alone and only mm_2 is removed as bad.
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	payloads, err := data.DecodeBatch(got[0])
+	t.Assert(err, IsNil)
+	t.Check(payloads, HasLen, 3)
+	s.respChan <- &proto.Response{Code: 400}
+	for i, code := range []uint{200, 400, 200} {
+		got = test.WaitBytes(s.dataChan)
+		t.Assert(got, HasLen, 1)
+		t.Check(string(got[0]), Equals, fmt.Sprintf(`{"Service":"mm_%d"}`, i+1))
+		s.respChan <- &proto.Response{Code: code}
+	}
+	if !test.WaitStatusPrefix(5, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+	t.Check(spool.DataOut, HasLen, 0)
+	t.Check(sender.Status()["data-sender-last"], Matches, ".+ 3 files.+ 1 bad.*")
+}
+
+func (s *SenderTestSuite) TestHoldBatch(t *C) {
+	spool := mock.NewSpooler(nil)
+	spool.FilesOut, spool.DataOut = batchFiles("mm_1")
+
+	sender := data.NewSender(s.logger, s.client)
+	sender.SetBatch(40, 3600, func() []string { return []string{pct.CONTENT_TYPE_BATCH} })
+	err := sender.Start(spool, s.tickerChan, 5, false)
+	t.Assert(err, IsNil)
+	defer sender.Stop()
+
+	// Nothing has been sent yet, so the first tick sends.
+	s.tickerChan <- time.Now()
+	got := test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	t.Check(string(got[0]), Equals, `{"Service":"mm_1"}`)
+	s.respChan <- &proto.Response{Code: 200}
+	if !test.WaitStatusPrefix(5, sender, "data-sender-last", "at") {
+		t.Fatal("Timeout waiting for data-sender-last status")
+	}
+
+	// Then files are held until 40 bytes are spooled or it's been 1h since
+	// the last send.
+	spool.FilesOut, spool.DataOut = batchFiles("mm_2")
+	s.tickerChan <- time.Now()
+	got = test.WaitBytes(s.dataChan)
+	t.Check(got, HasLen, 0)
+
+	spool.FilesOut, spool.DataOut = batchFiles("mm_2", "mm_3", "mm_4")
+	s.tickerChan <- time.Now()
+	got = test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	payloads, err := data.DecodeBatch(got[0])
+	t.Assert(err, IsNil)
+	t.Check(payloads, HasLen, 2)
+	s.respChan <- &proto.Response{Code: 200}
+	got = test.WaitBytes(s.dataChan)
+	t.Assert(got, HasLen, 1)
+	s.respChan <- &proto.Response{Code: 200}
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Manager test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,199 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const DEFAULT_GRAPHITE_TEMPLATE = "percona.{hostname}.{metric}.{stat}"
+
+/**
+ * Graphite forwards mm reports to a Carbon server using its plaintext protocol
+ * ("path value timestamp\n" over TCP) so shops with Graphite dashboards can
+ * graph agent metrics too.  It's a sink, see sink.go.
+ *
+ * Metric paths are made from Config.GraphiteTemplate by replacing {hostname},
+ * {service}, {instance} (ID), {metric}, and {stat}.  A metric name like
+ * mysql/status/Threads_running becomes mysql.status.Threads_running; dots and
+ * spaces in other values become underscores so each is one path node.  One
+ * value is sent for every stat in Config.GraphiteStats: cnt, min, pct5, avg,
+ * med, pct95, max, or pctN for extra percentiles (mm Config.Percentiles).
+ * The lines of a report are one batch.
+ */
+type Graphite struct {
+	*sink
+	addr     string // host:port
+	template string
+	stats    []string
+	hostname string
+	// --
+	conn net.Conn
+}
+
+var graphiteNode = strings.NewReplacer(".", "_", " ", "_", "/", "_")
+var graphiteMetric = strings.NewReplacer("/", ".", " ", "_")
+
+func NewGraphite(logger *pct.Logger, addr, template string, stats []string, hostname string) *Graphite {
+	if template == "" {
+		template = DEFAULT_GRAPHITE_TEMPLATE
+	}
+	if len(stats) == 0 {
+		stats = []string{"avg"}
+	}
+	g := &Graphite{
+		addr:     addr,
+		template: template,
+		stats:    stats,
+		hostname: hostname,
+	}
+	g.sink = newSink("Graphite", "lines", logger, g)
+	return g
+}
+
+// ValidateGraphite returns an error if addr isn't host:port, the template has
+// no {metric}, or a stat is unknown.
+func ValidateGraphite(addr, template string, stats []string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return errors.New("Invalid Graphite address: " + err.Error())
+	}
+	if template != "" && !strings.Contains(template, "{metric}") {
+		return errors.New("GraphiteTemplate has no {metric}: " + template)
+	}
+	for _, stat := range stats {
+		if !validStat(stat) {
+			return errors.New("Invalid GraphiteStats stat: " + stat)
+		}
+	}
+	return nil
+}
+
+func (g *Graphite) Start() error {
+	if err := ValidateGraphite(g.addr, g.template, g.stats); err != nil {
+		return err
+	}
+	return g.start(g.addr)
+}
+
+// --------------------------------------------------------------------------
+
+func (g *Graphite) batches(ts time.Time, instances []InstanceMetricStats) []sinkBatch {
+	var buf bytes.Buffer
+	n := uint(0)
+	unixTs := strconv.FormatInt(ts.Unix(), 10)
+	hostname := graphiteNode.Replace(g.hostname)
+	for _, is := range instances {
+		instance := strconv.FormatUint(uint64(is.InstanceId), 10)
+		for metric, stats := range is.Stats {
+			if stats.Cnt == 0 {
+				continue // string metric, or no values
+			}
+			for _, stat := range g.stats {
+				val, ok := stats.value(stat)
+				if !ok {
+					continue
+				}
+				path := strings.NewReplacer(
+					"{hostname}", hostname,
+					"{service}", graphiteNode.Replace(is.Service),
+					"{instance}", instance,
+					"{metric}", graphiteMetric.Replace(metric),
+					"{stat}", stat,
+				).Replace(g.template)
+				buf.WriteString(path + " " + strconv.FormatFloat(val, 'f', -1, 64) + " " + unixTs + "\n")
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return []sinkBatch{{buf.Bytes(), n}}
+}
+
+// validStat returns true if the stat is a fixed stat like "avg", or pctN for
+// an extra percentile N > 0 and < 100 formatted like mm Stats.Pct keys, e.g.
+// pct99 or pct99.9 but not pct99.0.
+func validStat(stat string) bool {
+	if _, ok := (MetricStats{}).value(stat); ok {
+		return true
+	}
+	if !strings.HasPrefix(stat, "pct") {
+		return false
+	}
+	n := strings.TrimPrefix(stat, "pct")
+	p, err := strconv.ParseFloat(n, 64)
+	if err != nil || p <= 0 || p >= 100 {
+		return false
+	}
+	return strconv.FormatFloat(p, 'f', -1, 64) == n
+}
+
+func (s MetricStats) value(stat string) (float64, bool) {
+	switch stat {
+	case "cnt":
+		return float64(s.Cnt), true
+	case "min":
+		return s.Min, true
+	case "pct5":
+		return s.Pct5, true
+	case "avg":
+		return s.Avg, true
+	case "med":
+		return s.Med, true
+	case "pct95":
+		return s.Pct95, true
+	case "max":
+		return s.Max, true
+	}
+	if strings.HasPrefix(stat, "pct") {
+		val, ok := s.Pct[strings.TrimPrefix(stat, "pct")]
+		return val, ok
+	}
+	return 0, false
+}
+
+func (g *Graphite) write(batch sinkBatch) (uint, bool, error) {
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.addr, 5*time.Second)
+		if err != nil {
+			return 0, true, err
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := g.conn.Write(batch.data); err != nil {
+		g.close() // reconnect next time
+		return 0, true, err
+	}
+	return 0, false, nil
+}
+
+func (g *Graphite) close() {
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data_test
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type GraphiteTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&GraphiteTestSuite{})
+
+func (s *GraphiteTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "graphite_test")
+}
+
+func (s *GraphiteTestSuite) TestSend(t *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer listener.Close()
+
+	g := data.NewGraphite(
+		s.logger,
+		listener.Addr().String(),
+		"agent.{hostname}.{service}-{instance}.{metric}.{stat}",
+		[]string{"avg", "max", "pct99"},
+		"db1.example.com",
+	)
+	err = g.Start()
+	t.Assert(err, IsNil)
+	defer g.Stop()
+
+	report := &mm.Report{
+		Ts:       time.Unix(1420070400, 0).UTC(),
+		Duration: 60,
+		Stats: []*mm.InstanceStats{
+			{
+				ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 3},
+				Stats: map[string]*mm.Stats{
+					"mysql/status/Threads_running": {Cnt: 60, Avg: 2.5, Max: 10, Pct: map[string]float64{"99": 9}},
+					"mysql/status/version":         {}, // string metric, not sent
+				},
+			},
+		},
+	}
+
+	// Only mm reports are sent.
+	g.Write("qan", report)
+	g.Write("mm", report)
+
+	conn, err := listener.Accept()
+	t.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	got := []string{}
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		t.Assert(err, IsNil)
+		got = append(got, strings.TrimSpace(line))
+	}
+	sort.Strings(got)
+	t.Check(got, DeepEquals, []string{
+		"agent.db1_example_com.mysql-3.mysql.status.Threads_running.avg 2.5 1420070400",
+		"agent.db1_example_com.mysql-3.mysql.status.Threads_running.max 10 1420070400",
+		"agent.db1_example_com.mysql-3.mysql.status.Threads_running.pct99 9 1420070400",
+	})
+
+	// Nothing else was sent, e.g. for the qan report or string metric.
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = r.ReadString('\n')
+	t.Check(err, NotNil)
+}
+
+func (s *GraphiteTestSuite) TestValidate(t *C) {
+	t.Check(data.ValidateGraphite("graphite:2003", "", nil), IsNil)
+	t.Check(data.ValidateGraphite("graphite:2003", "{hostname}.{metric}", []string{"med", "pct5", "pct99.9"}), IsNil)
+	t.Check(data.ValidateGraphite("graphite", "", nil), NotNil)
+	t.Check(data.ValidateGraphite("graphite:2003", "{hostname}.{stat}", nil), NotNil)
+	t.Check(data.ValidateGraphite("graphite:2003", "", []string{"mean"}), NotNil)
+	t.Check(data.ValidateGraphite("graphite:2003", "", []string{"pct0"}), NotNil)
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type InfluxDBTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&InfluxDBTestSuite{})
+
+func (s *InfluxDBTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "influxdb_test")
+}
+
+func (s *InfluxDBTestSuite) TestSend(t *C) {
+	// The first write fails, so it's retried.
+	type write struct {
+		query string
+		body  string
+	}
+	writes := make(chan write, 10)
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			fail = false
+			http.Error(w, "timeout", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		writes <- write{r.URL.RawQuery, string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	f := data.NewInfluxDB(s.logger, server.URL+"/write?db=percona", 1, "db1.example.com")
+	err := f.Start()
+	t.Assert(err, IsNil)
+	defer f.Stop()
+
+	report := &mm.Report{
+		Ts:       time.Unix(1420070400, 0).UTC(),
+		Duration: 60,
+		Stats: []*mm.InstanceStats{
+			{
+				ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 3},
+				Stats: map[string]*mm.Stats{
+					"mysql/status/Threads_running": {Cnt: 60, Avg: 2.5, Max: 10, Pct: map[string]float64{"99": 9}},
+					"mysql/innodb/buffer pool":     {Cnt: 1, Avg: 1, Max: 1},
+					"mysql/status/version":         {}, // string metric, not sent
+				},
+			},
+		},
+	}
+
+	// Only mm reports are sent, one line per write (batch=1).
+	f.Write("qan", report)
+	f.Write("mm", report)
+
+	got := []write{}
+	for i := 0; i < 2; i++ {
+		select {
+		case w := <-writes:
+			got = append(got, w)
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for InfluxDB write")
+		}
+	}
+	t.Check(got, DeepEquals, []write{
+		{"db=percona&precision=s", `mysql,host=db1.example.com,instance=3,metric=innodb/buffer\ pool cnt=1i,min=0,pct5=0,avg=1,med=0,pct95=0,max=1 1420070400`},
+		{"db=percona&precision=s", "mysql,host=db1.example.com,instance=3,metric=status/Threads_running cnt=60i,min=0,pct5=0,avg=2.5,med=0,pct95=0,max=10,pct99=9 1420070400"},
+	})
+
+	select {
+	case w := <-writes:
+		t.Errorf("Unexpected write: %+v", w)
+	case <-time.After(200 * time.Millisecond):
+	}
+	t.Check(f.Status()["data-influxdb"], Equals, "Sending (2 lines sent, 0 dropped)")
+}
+
+func (s *InfluxDBTestSuite) TestQueueFull(t *C) {
+	// Not started, so nothing drains the queue.
+	f := data.NewInfluxDB(s.logger, "http://localhost:8086/write?db=percona", 0, "db1.example.com")
+	report := &mm.Report{Ts: time.Unix(1420070400, 0).UTC(), Duration: 60}
+	for i := 0; i < data.SINK_QUEUE+2; i++ {
+		f.Write("mm", report)
+	}
+	t.Check(f.Status()["data-influxdb"], Equals, "InfluxDB queue full, dropping reports (0 lines sent, 0 dropped, 2 reports dropped)")
+}
+
+func (s *InfluxDBTestSuite) TestValidate(t *C) {
+	t.Check(data.ValidateInfluxDB("http://localhost:8086/write?db=percona"), IsNil)
+	t.Check(data.ValidateInfluxDB("https://u:p@influx/write?db=percona"), IsNil)
+	t.Check(data.ValidateInfluxDB("localhost:8086"), NotNil)
+	t.Check(data.ValidateInfluxDB("http://localhost:8086/write"), NotNil)
+}
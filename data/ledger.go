@@ -0,0 +1,243 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	LEDGER_DAYS          = 31 // days of entries to keep
+	LEDGER_SAVE_INTERVAL = 60 // seconds, min between saves on Add
+)
+
+/**
+ * The ledger accounts for the data the agent spools and sends, per UTC day
+ * and per service, so customers can verify how much bandwidth the agent uses
+ * and we can see which tool is writing more data than it should, e.g. because
+ * of runaway query or metric cardinality, before the link or the API notices.
+ * RawBytes is the size of the data before compression, see RawSizer, so
+ * RawBytes / SpooledBytes is the compression ratio.  The ledger is small, at
+ * most LEDGER_DAYS days, and saved to a local file so it survives restarts.
+ */
+
+type LedgerEntry struct {
+	Docs         uint64 // reports written to the spooler
+	RawBytes     uint64 // serialized, before compression
+	SpooledBytes uint64 // spool files, after compression and encryption
+	SentFiles    uint64 // spool files the API accepted
+	SentBytes    uint64 // written to the network for SentFiles, see WireCounter
+}
+
+func (e *LedgerEntry) add(n LedgerEntry) {
+	e.Docs += n.Docs
+	e.RawBytes += n.RawBytes
+	e.SpooledBytes += n.SpooledBytes
+	e.SentFiles += n.SentFiles
+	e.SentBytes += n.SentBytes
+}
+
+func (e LedgerEntry) String() string {
+	ratio := "-"
+	if e.SpooledBytes > 0 {
+		ratio = fmt.Sprintf("%.1fx", float64(e.RawBytes)/float64(e.SpooledBytes))
+	}
+	perDoc := uint64(0)
+	if e.Docs > 0 {
+		perDoc = e.RawBytes / e.Docs
+	}
+	return fmt.Sprintf("%d docs, %s raw (%s/doc), %s spooled (%s), %d files %s sent",
+		e.Docs, pct.Bytes(e.RawBytes), pct.Bytes(perDoc), pct.Bytes(e.SpooledBytes), ratio, e.SentFiles, pct.Bytes(e.SentBytes))
+}
+
+type LedgerDay struct {
+	Day      string                  // YYYY-MM-DD, UTC
+	Services map[string]*LedgerEntry // keyed on service, e.g. mm
+}
+
+// Total returns the sum of the day's service entries.
+func (d *LedgerDay) Total() LedgerEntry {
+	total := LedgerEntry{}
+	for _, e := range d.Services {
+		total.add(*e)
+	}
+	return total
+}
+
+type Ledger struct {
+	logger *pct.Logger
+	file   string
+	// --
+	days  []*LedgerDay // oldest first
+	saved time.Time
+	mux   *sync.Mutex
+}
+
+func NewLedger(logger *pct.Logger, file string) *Ledger {
+	l := &Ledger{
+		logger: logger,
+		file:   file,
+		// --
+		days: []*LedgerDay{},
+		mux:  &sync.Mutex{},
+	}
+	return l
+}
+
+// Load reads the ledger file, if any.  A missing file is not an error: the
+// ledger starts empty.
+func (l *Ledger) Load() error {
+	data, err := ioutil.ReadFile(l.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	days := []*LedgerDay{}
+	if err := json.Unmarshal(data, &days); err != nil {
+		return fmt.Errorf("Invalid data ledger %s: %s", l.file, err)
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.days = days
+	l.trim()
+	return nil
+}
+
+// Save writes the ledger file.
+func (l *Ledger) Save() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.save()
+}
+
+// Add adds n to the service's entry for the UTC day of ts, and saves the
+// ledger if it hasn't been saved in the last LEDGER_SAVE_INTERVAL seconds.
+func (l *Ledger) Add(service string, ts time.Time, n LedgerEntry) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	day := ts.UTC().Format("2006-01-02")
+	var d *LedgerDay
+	for i := len(l.days) - 1; i >= 0; i-- {
+		if l.days[i].Day == day {
+			d = l.days[i]
+			break
+		}
+	}
+	if d == nil {
+		d = &LedgerDay{
+			Day:      day,
+			Services: make(map[string]*LedgerEntry),
+		}
+		l.days = append(l.days, d)
+		sort.Sort(ledgerDays(l.days))
+		l.trim()
+	}
+	e, ok := d.Services[service]
+	if !ok {
+		e = &LedgerEntry{}
+		d.Services[service] = e
+	}
+	e.add(n)
+
+	if time.Now().Sub(l.saved) >= LEDGER_SAVE_INTERVAL*time.Second {
+		if err := l.save(); err != nil {
+			l.logger.Warn("Cannot save data ledger: ", err)
+		}
+	}
+}
+
+// Days returns a copy of the days in the ledger, oldest first.
+func (l *Ledger) Days() []LedgerDay {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	days := make([]LedgerDay, len(l.days))
+	for i, d := range l.days {
+		days[i] = LedgerDay{
+			Day:      d.Day,
+			Services: make(map[string]*LedgerEntry, len(d.Services)),
+		}
+		for service, e := range d.Services {
+			c := *e
+			days[i].Services[service] = &c
+		}
+	}
+	return days
+}
+
+// Status returns the totals and per-service entries for the current UTC day.
+func (l *Ledger) Status() map[string]string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	status := map[string]string{}
+	today := time.Now().UTC().Format("2006-01-02")
+	if len(l.days) == 0 || l.days[len(l.days)-1].Day != today {
+		status["data-ledger"] = "today: " + LedgerEntry{}.String()
+		return status
+	}
+	d := l.days[len(l.days)-1]
+	status["data-ledger"] = "today: " + d.Total().String()
+	for service, e := range d.Services {
+		status["data-ledger-"+service] = "today: " + e.String()
+	}
+	return status
+}
+
+func (l *Ledger) trim() {
+	if len(l.days) > LEDGER_DAYS {
+		l.days = l.days[len(l.days)-LEDGER_DAYS:]
+	}
+}
+
+func (l *Ledger) save() error {
+	l.saved = time.Now()
+	data, err := json.Marshal(l.days)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(l.file), filepath.Base(l.file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) // fails after the rename, that's ok
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), l.file)
+}
+
+type ledgerDays []*LedgerDay
+
+func (a ledgerDays) Len() int           { return len(a) }
+func (a ledgerDays) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ledgerDays) Less(i, j int) bool { return a[i].Day < a[j].Day }
@@ -0,0 +1,171 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+type LedgerTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+	tmpDir  string
+}
+
+var _ = Suite(&LedgerTestSuite{})
+
+func (s *LedgerTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "data_test")
+
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-data-ledger-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *LedgerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *LedgerTestSuite) TestLedger(t *C) {
+	file := path.Join(s.tmpDir, "ledger.json")
+	l := data.NewLedger(s.logger, file)
+
+	// No file yet, that's ok.
+	t.Assert(l.Load(), IsNil)
+	t.Check(l.Days(), HasLen, 0)
+	t.Check(l.Status()["data-ledger"], Equals, "today: 0 docs, 0 raw (0/doc), 0 spooled (-), 0 files 0 sent")
+
+	now := time.Now().UTC()
+	yesterday := now.Add(-24 * time.Hour)
+	l.Add("mm", yesterday, data.LedgerEntry{Docs: 1, RawBytes: 1000})
+	l.Add("mm", now, data.LedgerEntry{Docs: 1, RawBytes: 4000})
+	l.Add("mm", now, data.LedgerEntry{SpooledBytes: 1500})
+	l.Add("qan", now, data.LedgerEntry{Docs: 2, RawBytes: 3000, SpooledBytes: 1500})
+	l.Add("mm", now, data.LedgerEntry{SentFiles: 1, SentBytes: 1500})
+
+	days := l.Days()
+	t.Assert(days, HasLen, 2)
+	t.Check(days[0].Day, Equals, yesterday.Format("2006-01-02"))
+	t.Check(*days[0].Services["mm"], Equals, data.LedgerEntry{Docs: 1, RawBytes: 1000})
+	t.Check(days[1].Day, Equals, now.Format("2006-01-02"))
+	t.Check(*days[1].Services["mm"], Equals, data.LedgerEntry{Docs: 1, RawBytes: 4000, SpooledBytes: 1500, SentFiles: 1, SentBytes: 1500})
+	t.Check(days[1].Total(), Equals, data.LedgerEntry{Docs: 3, RawBytes: 7000, SpooledBytes: 3000, SentFiles: 1, SentBytes: 1500})
+
+	// Days is a copy.
+	days[1].Services["mm"].Docs = 100
+	t.Check(l.Days()[1].Services["mm"].Docs, Equals, uint64(1))
+
+	// Status is today only.
+	status := l.Status()
+	t.Check(status["data-ledger"], Equals, "today: 3 docs, 7.00 kB raw (2.33 kB/doc), 3.00 kB spooled (2.3x), 1 files 1.50 kB sent")
+	t.Check(status["data-ledger-mm"], Equals, "today: 1 docs, 4.00 kB raw (4.00 kB/doc), 1.50 kB spooled (2.7x), 1 files 1.50 kB sent")
+	t.Check(status["data-ledger-qan"], Equals, "today: 2 docs, 3.00 kB raw (1.50 kB/doc), 1.50 kB spooled (2.0x), 0 files 0 sent")
+
+	// The ledger survives a restart.
+	t.Assert(l.Save(), IsNil)
+	l2 := data.NewLedger(s.logger, file)
+	t.Assert(l2.Load(), IsNil)
+	t.Check(l2.Days(), DeepEquals, l.Days())
+
+	// Only the last LEDGER_DAYS days are kept.
+	for i := 0; i < data.LEDGER_DAYS+5; i++ {
+		l2.Add("mm", now.Add(time.Duration(-i)*24*time.Hour), data.LedgerEntry{Docs: 1})
+	}
+	days = l2.Days()
+	t.Assert(days, HasLen, data.LEDGER_DAYS)
+	t.Check(days[0].Day, Equals, now.Add(time.Duration(-(data.LEDGER_DAYS-1))*24*time.Hour).Format("2006-01-02"))
+	t.Check(days[data.LEDGER_DAYS-1].Day, Equals, now.Format("2006-01-02"))
+
+	// A bad ledger file is an error.
+	ioutil.WriteFile(file, []byte("not json"), 0644)
+	err := l2.Load()
+	t.Check(err, NotNil)
+}
+
+func (s *LedgerTestSuite) TestSpoolAndSend(t *C) {
+	dataDir := path.Join(s.tmpDir, "data")
+	trashDir := path.Join(s.tmpDir, "trash")
+	limits := proto.DataSpoolLimits{
+		MaxAge:   data.DEFAULT_DATA_MAX_AGE,
+		MaxSize:  data.DEFAULT_DATA_MAX_SIZE,
+		MaxFiles: data.DEFAULT_DATA_MAX_FILES,
+	}
+	l := data.NewLedger(s.logger, path.Join(s.tmpDir, "spool-ledger.json"))
+
+	// The gzip serializer reports the raw size of the data, so the ledger
+	// has the compression ratio.
+	sz := data.NewJsonGzipSerializer()
+	spool := data.NewDiskvSpooler(s.logger, dataDir, trashDir, "localhost", limits)
+	spool.SetLedger(l)
+	t.Assert(spool.Start(sz), IsNil)
+	defer spool.Stop()
+
+	msg := strings.Repeat("hello world ", 1000)
+	spool.Write("log", &proto.LogEntry{Service: "mm", Msg: msg})
+
+	var e data.LedgerEntry
+	for i := 0; i < 50; i++ {
+		if days := l.Days(); len(days) == 1 && days[0].Services["log"].SpooledBytes > 0 {
+			e = *days[0].Services["log"]
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Check(e.Docs, Equals, uint64(1))
+	t.Check(e.RawBytes > uint64(len(msg)), Equals, true)
+	t.Check(e.SpooledBytes > 0 && e.SpooledBytes < e.RawBytes/10, Equals, true)
+
+	// The sender accounts the files the API accepts.
+	dataChan := make(chan []byte, 5)
+	respChan := make(chan interface{})
+	client := mock.NewDataClient(dataChan, respChan)
+	tickerChan := make(chan time.Time, 1)
+	sender := data.NewSender(s.logger, client)
+	sender.SetLedger(l)
+	t.Assert(sender.Start(spool, tickerChan, 5, false), IsNil)
+
+	tickerChan <- time.Now()
+	sent := test.WaitBytes(dataChan)
+	t.Assert(sent, HasLen, 1)
+	select {
+	case respChan <- &proto.Response{Code: 200}:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Sender receives prot.Response after sending data")
+	}
+	t.Assert(sender.Stop(), IsNil)
+
+	e = *l.Days()[0].Services["log"]
+	t.Check(e.SentFiles, Equals, uint64(1))
+	t.Check(e.SentBytes, Equals, uint64(len(sent[0])))
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,6 +35,8 @@ type Manager struct {
 	trashDir string
 	hostname string
 	client   pct.WebsocketClient
+	fallback Transport
+	api      pct.APIConnector
 	// --
 	config  *Config
 	running bool
@@ -41,7 +44,13 @@ type Manager struct {
 	sz      Serializer
 	spooler Spooler
 	sender  *Sender
+	mirror  *Mirror // nil if no Config.Mirror
 	status  *pct.Status
+	ledger  *Ledger
+	// --
+	graphite *Graphite // nil if no Config.Graphite
+	influxdb *InfluxDB // nil if no Config.InfluxDB
+	opentsdb *OpenTSDB // nil if no Config.OpenTSDB
 }
 
 func NewManager(logger *pct.Logger, dataDir, trashDir, hostname string, client pct.WebsocketClient) *Manager {
@@ -58,6 +67,19 @@ func NewManager(logger *pct.Logger, dataDir, trashDir, hostname string, client p
 	return m
 }
 
+// SetFallback sets the transport the sender uses when the websocket client
+// cannot connect, see Sender.SetFallback.  Call it before Start.
+func (m *Manager) SetFallback(fallback Transport) {
+	m.fallback = fallback
+}
+
+// SetAPI sets the API connector to derive the spool key from the API key, see
+// Config.EncryptKey, and to get the data content types the API accepts, see
+// Config.Encoding.  Call it before Start.
+func (m *Manager) SetAPI(api pct.APIConnector) {
+	m.api = api
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Interface
 /////////////////////////////////////////////////////////////////////////////
@@ -92,11 +114,19 @@ func (m *Manager) Start() error {
 	}
 
 	// Make data serializer/encoder, e.g. T{} -> gzip -> []byte.
-	sz, err := makeSerializer(config.Encoding)
+	sz, err := m.makeSerializer(config.Encoding)
 	if err != nil {
 		return err
 	}
 
+	// Load the ledger of data spooled and sent per day.  It's only for
+	// accounting, so a bad ledger file is not fatal.
+	ledger := NewLedger(m.logger, pct.Basedir.File("data-ledger"))
+	if err := ledger.Load(); err != nil {
+		m.logger.Warn(err)
+	}
+	m.ledger = ledger
+
 	// Make persistent (disk-back) key-value cache and start data spooler.
 	m.status.Update("data", "Starting spooler")
 	spooler := NewDiskvSpooler(
@@ -106,10 +136,39 @@ func (m *Manager) Start() error {
 		m.hostname,
 		config.Limits,
 	)
+	spooler.SetQuota(config.Quota)
+	spooler.SetLedger(ledger)
+	key, err := m.spoolKey(config)
+	if err != nil {
+		return err
+	}
+	if err := spooler.SetEncryption(key, config.Encrypt); err != nil {
+		return err
+	}
 	if err := spooler.Start(sz); err != nil {
 		return err
 	}
 	m.spooler = spooler
+	if config.Mirror != "" {
+		if err := m.setMirror(config.Mirror); err != nil {
+			return err
+		}
+	}
+	if config.Graphite != "" {
+		if err := m.setGraphite(config); err != nil {
+			return err
+		}
+	}
+	if config.InfluxDB != "" {
+		if err := m.setInfluxDB(config); err != nil {
+			return err
+		}
+	}
+	if config.OpenTSDB != "" {
+		if err := m.setOpenTSDB(config); err != nil {
+			return err
+		}
+	}
 
 	// Start data sender.
 	m.status.Update("data", "Starting sender")
@@ -117,6 +176,12 @@ func (m *Manager) Start() error {
 		pct.NewLogger(m.logger.LogChan(), "data-sender"),
 		m.client,
 	)
+	sender.SetRequireAck(config.RequireAck)
+	sender.SetBatch(config.BatchBytes, config.BatchAge, m.dataContentTypes)
+	sender.SetLedger(ledger)
+	if m.fallback != nil {
+		sender.SetFallback(m.fallback)
+	}
 	if err := sender.Start(m.spooler, time.Tick(time.Duration(config.SendInterval)*time.Second), config.SendInterval, config.Blackhole); err != nil {
 		return err
 	}
@@ -136,6 +201,21 @@ func (m *Manager) Stop() error {
 
 	m.status.Update("data", "Stopping spooler")
 	m.spooler.Stop()
+	if m.mirror != nil {
+		m.mirror.Stop()
+	}
+	if m.graphite != nil {
+		m.graphite.Stop()
+	}
+	if m.influxdb != nil {
+		m.influxdb.Stop()
+	}
+	if m.opentsdb != nil {
+		m.opentsdb.Stop()
+	}
+	if err := m.ledger.Save(); err != nil {
+		m.logger.Warn("Cannot save data ledger: ", err)
+	}
 
 	m.logger.Info("data", "Stopped")
 	m.status.Update("data", "Stopped")
@@ -163,13 +243,50 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	case "Purge":
 		removed, errs := m.handlePurge(cmd)
 		return cmd.Reply(removed, errs...)
+	case "GetLedger":
+		return cmd.Reply(m.ledger.Days())
 	default:
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
 }
 
 func (m *Manager) Status() map[string]string {
-	return m.status.Merge(m.client.Status(), m.spooler.Status(), m.sender.Status())
+	m.mux.Lock()
+	mirror := m.mirror
+	graphite := m.graphite
+	influxdb := m.influxdb
+	opentsdb := m.opentsdb
+	m.mux.Unlock()
+	others := []map[string]string{m.client.Status(), m.spooler.Status(), m.sender.Status(), m.ledger.Status()}
+	if mirror != nil {
+		others = append(others, mirror.Status())
+	}
+	if graphite != nil {
+		others = append(others, graphite.Status())
+	}
+	if influxdb != nil {
+		others = append(others, influxdb.Status())
+	}
+	if opentsdb != nil {
+		others = append(others, opentsdb.Status())
+	}
+	return m.status.Merge(others...)
+}
+
+// Capabilities returns the Config.Encoding values and optional features the
+// manager supports, for agent cmd Capabilities.
+func (m *Manager) Capabilities() []string {
+	return []string{
+		"encoding:",
+		"encoding:gzip",
+		"encoding:msgpack",
+		"encoding:msgpack-gzip",
+		"encrypt",
+		"graphite",
+		"influxdb",
+		"mirror",
+		"opentsdb",
+	}
 }
 
 func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
@@ -191,6 +308,11 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return []proto.AgentConfig{config}, nil
 }
 
+// Reload applies changes to data.conf with SetConfig.  See pct.ConfigReloader.
+func (m *Manager) Reload() []error {
+	return pct.ReloadConfig(m, "data")
+}
+
 func (m *Manager) Spooler() Spooler {
 	return m.spooler
 }
@@ -200,7 +322,9 @@ func (m *Manager) Sender() *Sender {
 }
 
 func (m *Manager) validateConfig(config *Config) error {
-	if config.Encoding != "" && config.Encoding != "gzip" {
+	switch config.Encoding {
+	case "", "gzip", "msgpack", "msgpack-gzip":
+	default:
 		return errors.New("Invalid data encoding: " + config.Encoding)
 	}
 
@@ -215,6 +339,40 @@ func (m *Manager) validateConfig(config *Config) error {
 		config.SendInterval = DEFAULT_DATA_SEND_INTERVAL
 	}
 
+	if config.BatchAge > 0 && config.BatchBytes == 0 {
+		return errors.New("BatchAge requires BatchBytes")
+	} else if config.BatchAge > 3600 {
+		return errors.New("BatchAge must be <= 3600 (1 hour)")
+	}
+
+	if config.EncryptKey != "" && config.EncryptKey != "file" && config.EncryptKey != "api-key" {
+		return errors.New("Invalid EncryptKey: " + config.EncryptKey)
+	}
+
+	if config.Mirror != "" {
+		if err := ValidateMirror(config.Mirror); err != nil {
+			return err
+		}
+	}
+
+	if config.Graphite != "" {
+		if err := ValidateGraphite(config.Graphite, config.GraphiteTemplate, config.GraphiteStats); err != nil {
+			return err
+		}
+	}
+
+	if config.InfluxDB != "" {
+		if err := ValidateInfluxDB(config.InfluxDB); err != nil {
+			return err
+		}
+	}
+
+	if config.OpenTSDB != "" {
+		if err := ValidateOpenTSDB(config.OpenTSDB, config.OpenTSDBStats); err != nil {
+			return err
+		}
+	}
+
 	// as of 1.0.13
 	if config.Limits.MaxAge == 0 {
 		config.Limits.MaxAge = DEFAULT_DATA_MAX_AGE
@@ -249,12 +407,18 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	 * Data sender
 	 */
 
-	if newConfig.SendInterval != finalConfig.SendInterval {
+	if newConfig.SendInterval != finalConfig.SendInterval || newConfig.RequireAck != finalConfig.RequireAck ||
+		newConfig.BatchBytes != finalConfig.BatchBytes || newConfig.BatchAge != finalConfig.BatchAge {
 		m.sender.Stop()
+		m.sender.SetRequireAck(newConfig.RequireAck)
+		m.sender.SetBatch(newConfig.BatchBytes, newConfig.BatchAge, m.dataContentTypes)
 		if err := m.sender.Start(m.spooler, time.Tick(time.Duration(newConfig.SendInterval)*time.Second), newConfig.SendInterval, newConfig.Blackhole); err != nil {
 			errs = append(errs, err)
 		} else {
 			finalConfig.SendInterval = newConfig.SendInterval
+			finalConfig.RequireAck = newConfig.RequireAck
+			finalConfig.BatchBytes = newConfig.BatchBytes
+			finalConfig.BatchAge = newConfig.BatchAge
 		}
 	}
 
@@ -262,8 +426,73 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	 * Data spooler
 	 */
 
+	if newConfig.Quota != finalConfig.Quota {
+		if spooler, ok := m.spooler.(QuotaSpooler); ok {
+			spooler.SetQuota(newConfig.Quota)
+			finalConfig.Quota = newConfig.Quota
+		} else {
+			errs = append(errs, errors.New("Data spooler does not support Quota"))
+		}
+	}
+
+	if newConfig.Encrypt != finalConfig.Encrypt || newConfig.EncryptKey != finalConfig.EncryptKey {
+		if spooler, ok := m.spooler.(EncryptedSpooler); ok {
+			key, err := m.spoolKey(newConfig)
+			if err == nil {
+				err = spooler.SetEncryption(key, newConfig.Encrypt)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				finalConfig.Encrypt = newConfig.Encrypt
+				finalConfig.EncryptKey = newConfig.EncryptKey
+			}
+		} else {
+			errs = append(errs, errors.New("Data spooler does not support Encrypt"))
+		}
+	}
+
+	if newConfig.Mirror != finalConfig.Mirror {
+		if err := m.setMirror(newConfig.Mirror); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.Mirror = newConfig.Mirror
+		}
+	}
+
+	if newConfig.Graphite != finalConfig.Graphite || newConfig.GraphiteTemplate != finalConfig.GraphiteTemplate ||
+		strings.Join(newConfig.GraphiteStats, ",") != strings.Join(finalConfig.GraphiteStats, ",") {
+		if err := m.setGraphite(newConfig); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.Graphite = newConfig.Graphite
+			finalConfig.GraphiteTemplate = newConfig.GraphiteTemplate
+			finalConfig.GraphiteStats = newConfig.GraphiteStats
+		}
+	}
+
+	if newConfig.InfluxDB != finalConfig.InfluxDB || newConfig.InfluxDBBatch != finalConfig.InfluxDBBatch {
+		if err := m.setInfluxDB(newConfig); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.InfluxDB = newConfig.InfluxDB
+			finalConfig.InfluxDBBatch = newConfig.InfluxDBBatch
+		}
+	}
+
+	if newConfig.OpenTSDB != finalConfig.OpenTSDB || newConfig.OpenTSDBBatch != finalConfig.OpenTSDBBatch ||
+		strings.Join(newConfig.OpenTSDBStats, ",") != strings.Join(finalConfig.OpenTSDBStats, ",") {
+		if err := m.setOpenTSDB(newConfig); err != nil {
+			errs = append(errs, err)
+		} else {
+			finalConfig.OpenTSDB = newConfig.OpenTSDB
+			finalConfig.OpenTSDBBatch = newConfig.OpenTSDBBatch
+			finalConfig.OpenTSDBStats = newConfig.OpenTSDBStats
+		}
+	}
+
 	if newConfig.Encoding != finalConfig.Encoding {
-		sz, err := makeSerializer(newConfig.Encoding)
+		sz, err := m.makeSerializer(newConfig.Encoding)
 		if err != nil {
 			errs = append(errs, err)
 		} else {
@@ -285,17 +514,162 @@ func (m *Manager) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	return m.config, errs
 }
 
-func makeSerializer(encoding string) (Serializer, error) {
+// setMirror replaces the mirror, if any, with one to dest, or none if dest
+// is "".  The caller must hold m.mux.
+func (m *Manager) setMirror(dest string) error {
+	spooler, ok := m.spooler.(TappedSpooler)
+	if !ok {
+		return errors.New("Data spooler does not support Mirror")
+	}
+	var mirror *Mirror
+	if dest != "" {
+		mirror = NewMirror(pct.NewLogger(m.logger.LogChan(), "data-mirror"), dest, m.hostname)
+		if err := mirror.Start(); err != nil {
+			return err
+		}
+		spooler.SetTap("mirror", mirror)
+	} else {
+		spooler.SetTap("mirror", nil)
+	}
+	if m.mirror != nil {
+		m.mirror.Stop()
+	}
+	m.mirror = mirror
+	return nil
+}
+
+// setGraphite replaces the Graphite forwarder, if any, with one for the config,
+// or none if Config.Graphite is "".  The caller must hold m.mux.
+func (m *Manager) setGraphite(config *Config) error {
+	spooler, ok := m.spooler.(TappedSpooler)
+	if !ok {
+		return errors.New("Data spooler does not support Graphite")
+	}
+	var graphite *Graphite
+	if config.Graphite != "" {
+		graphite = NewGraphite(
+			pct.NewLogger(m.logger.LogChan(), "data-graphite"),
+			config.Graphite,
+			config.GraphiteTemplate,
+			config.GraphiteStats,
+			m.hostname,
+		)
+		if err := graphite.Start(); err != nil {
+			return err
+		}
+		spooler.SetTap("graphite", graphite)
+	} else {
+		spooler.SetTap("graphite", nil)
+	}
+	if m.graphite != nil {
+		m.graphite.Stop()
+	}
+	m.graphite = graphite
+	return nil
+}
+
+// setInfluxDB replaces the InfluxDB writer, if any, with one for the config,
+// or none if Config.InfluxDB is "".  The caller must hold m.mux.
+func (m *Manager) setInfluxDB(config *Config) error {
+	spooler, ok := m.spooler.(TappedSpooler)
+	if !ok {
+		return errors.New("Data spooler does not support InfluxDB")
+	}
+	var influxdb *InfluxDB
+	if config.InfluxDB != "" {
+		influxdb = NewInfluxDB(
+			pct.NewLogger(m.logger.LogChan(), "data-influxdb"),
+			config.InfluxDB,
+			config.InfluxDBBatch,
+			m.hostname,
+		)
+		if err := influxdb.Start(); err != nil {
+			return err
+		}
+		spooler.SetTap("influxdb", influxdb)
+	} else {
+		spooler.SetTap("influxdb", nil)
+	}
+	if m.influxdb != nil {
+		m.influxdb.Stop()
+	}
+	m.influxdb = influxdb
+	return nil
+}
+
+// setOpenTSDB replaces the OpenTSDB writer, if any, with one for the config,
+// or none if Config.OpenTSDB is "".  The caller must hold m.mux.
+func (m *Manager) setOpenTSDB(config *Config) error {
+	spooler, ok := m.spooler.(TappedSpooler)
+	if !ok {
+		return errors.New("Data spooler does not support OpenTSDB")
+	}
+	var opentsdb *OpenTSDB
+	if config.OpenTSDB != "" {
+		opentsdb = NewOpenTSDB(
+			pct.NewLogger(m.logger.LogChan(), "data-opentsdb"),
+			config.OpenTSDB,
+			config.OpenTSDBBatch,
+			config.OpenTSDBStats,
+			m.hostname,
+		)
+		if err := opentsdb.Start(); err != nil {
+			return err
+		}
+		spooler.SetTap("opentsdb", opentsdb)
+	} else {
+		spooler.SetTap("opentsdb", nil)
+	}
+	if m.opentsdb != nil {
+		m.opentsdb.Stop()
+	}
+	m.opentsdb = opentsdb
+	return nil
+}
+
+// spoolKey returns the spool key for the config, or nil if spool files were
+// never encrypted with a key file.  The key is loaded even if Encrypt is false
+// so files encrypted before are still read.
+func (m *Manager) spoolKey(config *Config) ([]byte, error) {
+	if config.EncryptKey == "api-key" {
+		if m.api == nil {
+			return nil, errors.New("No API key to derive spool key from")
+		}
+		return ApiKeySpoolKey(m.api.ApiKey()), nil
+	}
+	keyFile := pct.Basedir.File("spool-key")
+	if !config.Encrypt && !pct.FileExists(keyFile) {
+		return nil, nil
+	}
+	return LoadSpoolKey(keyFile)
+}
+
+// makeSerializer returns the serializer for Config.Encoding.  msgpack is used
+// only if the API accepts it, else JSON with the same compression.
+func (m *Manager) makeSerializer(encoding string) (Serializer, error) {
 	switch encoding {
 	case "":
 		return NewJsonSerializer(), nil
 	case "gzip":
 		return NewJsonGzipSerializer(), nil
+	case "msgpack":
+		return NewNegotiatedSerializer(NewMsgpackSerializer(), NewJsonSerializer(), m.dataContentTypes), nil
+	case "msgpack-gzip":
+		return NewNegotiatedSerializer(NewMsgpackGzipSerializer(), NewJsonGzipSerializer(), m.dataContentTypes), nil
 	default:
 		return nil, errors.New("Unknown encoding: " + encoding)
 	}
 }
 
+// dataContentTypes returns the content types the API accepts, only JSON if
+// there's no API (e.g. tests).
+func (m *Manager) dataContentTypes() []string {
+	if m.api == nil {
+		return []string{pct.CONTENT_TYPE_JSON}
+	}
+	return m.api.DataContentTypes()
+}
+
 func (m *Manager) handlePurge(cmd *proto.Cmd) (interface{}, []error) {
 	limits := proto.DataSpoolLimits{}
 	if len(cmd.Data) > 0 {
@@ -0,0 +1,204 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const MIRROR_QUEUE = 100 // entries, more are dropped
+
+/**
+ * A Mirror writes every report spooled, before it's serialized, as one line
+ * of JSON to a local file or Unix socket (Config.Mirror) so users can feed
+ * agent data to their own pipelines (ELK, Kafka, etc.) while it's still sent
+ * to the API.  Lines are MirrorEntry.  The file is opened for every line, so
+ * it can be rotated (renamed or removed) any time.  The socket is a stream
+ * socket the mirror connects to, and reconnects to after errors.
+ *
+ * Reports are queued so a slow reader doesn't slow the spooler, and dropped
+ * if the queue is full.  The API is the authority: the mirror never blocks or
+ * fails a Write.
+ */
+type Mirror struct {
+	logger   *pct.Logger
+	dest     string // file or unix:<socket>
+	hostname string
+	// --
+	entryChan chan []byte
+	sync      *pct.SyncChan
+	status    *pct.Status
+	conn      net.Conn
+	written   uint
+	dropped   uint
+	running   bool
+}
+
+type MirrorEntry struct {
+	Service  string
+	Hostname string
+	Created  time.Time // UTC
+	Data     *json.RawMessage
+}
+
+func NewMirror(logger *pct.Logger, dest, hostname string) *Mirror {
+	m := &Mirror{
+		logger:   logger,
+		dest:     dest,
+		hostname: hostname,
+		// --
+		entryChan: make(chan []byte, MIRROR_QUEUE),
+		sync:      pct.NewSyncChan(),
+		status:    pct.NewStatus([]string{"data-mirror"}),
+	}
+	return m
+}
+
+// ValidateMirror returns an error if dest isn't an absolute file path or
+// unix:<absolute socket path>.
+func ValidateMirror(dest string) error {
+	if !filepath.IsAbs(strings.TrimPrefix(dest, "unix:")) {
+		return errors.New("Mirror must be an absolute file path or unix:<absolute socket path>: " + dest)
+	}
+	return nil
+}
+
+func (m *Mirror) Start() error {
+	if m.running {
+		return pct.ServiceIsRunningError{Service: "data-mirror"}
+	}
+	if err := ValidateMirror(m.dest); err != nil {
+		return err
+	}
+	m.status.Update("data-mirror", "Mirroring to "+m.dest)
+	go m.run()
+	m.running = true
+	m.logger.Info("Mirroring to " + m.dest)
+	return nil
+}
+
+func (m *Mirror) Stop() {
+	if !m.running {
+		return
+	}
+	m.sync.Stop()
+	m.sync.Wait()
+	m.running = false
+	m.logger.Info("Stopped mirroring to " + m.dest)
+}
+
+func (m *Mirror) Status() map[string]string {
+	return m.status.All()
+}
+
+// Write queues the report to be written.  It's called by the spooler and
+// must not block.
+func (m *Mirror) Write(service string, data interface{}) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		m.logger.Warn("Cannot mirror "+service+" data: ", err)
+		return
+	}
+	line, err := json.Marshal(MirrorEntry{
+		Service:  service,
+		Hostname: m.hostname,
+		Created:  time.Now().UTC(),
+		Data:     (*json.RawMessage)(&bytes),
+	})
+	if err != nil {
+		m.logger.Warn("Cannot mirror "+service+" data: ", err)
+		return
+	}
+	select {
+	case m.entryChan <- append(line, '\n'):
+	default:
+		m.logger.Debug("Mirror queue full, dropped " + service + " data")
+		m.status.Update("data-mirror", "Mirror queue full, dropping data")
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (m *Mirror) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Data mirror crashed: ", err)
+		}
+		if m.conn != nil {
+			m.conn.Close()
+			m.conn = nil
+		}
+		m.status.Update("data-mirror", "Stopped")
+		m.sync.Done()
+	}()
+	for {
+		select {
+		case line := <-m.entryChan:
+			if err := m.write(line); err != nil {
+				m.dropped++
+				m.status.Update("data-mirror", fmt.Sprintf("Error mirroring to %s: %s (%d written, %d dropped)",
+					m.dest, err, m.written, m.dropped))
+				m.logger.Debug(err)
+			} else {
+				m.written++
+				m.status.Update("data-mirror", fmt.Sprintf("Mirroring to %s (%d written, %d dropped)",
+					m.dest, m.written, m.dropped))
+			}
+		case <-m.sync.StopChan:
+			return
+		}
+	}
+}
+
+func (m *Mirror) write(line []byte) error {
+	if strings.HasPrefix(m.dest, "unix:") {
+		if m.conn == nil {
+			conn, err := net.DialTimeout("unix", strings.TrimPrefix(m.dest, "unix:"), 2*time.Second)
+			if err != nil {
+				return err
+			}
+			m.conn = conn
+		}
+		m.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		if _, err := m.conn.Write(line); err != nil {
+			m.conn.Close()
+			m.conn = nil // reconnect next time
+			return err
+		}
+		return nil
+	}
+
+	file, err := os.OpenFile(m.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,441 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+ * MarshalMsgpack encodes v as MessagePack (http://msgpack.org) the way
+ * json.Marshal encodes it as JSON, so the API decodes either to the same
+ * values: structs are maps keyed on field name or json tag name (with
+ * omitempty and "-"), embedded structs' fields are promoted, map keys must be
+ * strings and are sorted, and types that implement json.Marshaler (e.g.
+ * time.Time, json.RawMessage) are encoded as the value of their JSON.  The
+ * difference is []byte, which is encoded as bin, not a base64 string.
+ *
+ * It's smaller and faster than JSON for big QAN reports because numbers and
+ * field names aren't formatted as text.  Only encoding is needed: the agent
+ * never reads back the data it sends.
+ */
+func MarshalMsgpack(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+type msgpackEncoder struct {
+	bytes.Buffer
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf(new(json.Marshaler)).Elem()
+	jsonNumberType    = reflect.TypeOf(json.Number(""))
+)
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.WriteByte(0xc0) // nil
+		return nil
+	}
+
+	// Encode types with custom JSON as their JSON value.  Like encoding/json,
+	// use the pointer method if the value is addressable.
+	if v.Type() == jsonNumberType {
+		return e.encodeNumber(json.Number(v.String()))
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(v.Type()).Implements(jsonMarshalerType) {
+		v = v.Addr()
+	}
+	if v.Type().Implements(jsonMarshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			e.WriteByte(0xc0)
+			return nil
+		}
+		return e.encodeJSON(v.Interface().(json.Marshaler))
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.WriteByte(0xc3)
+		} else {
+			e.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.WriteByte(0xca)
+		e.writeUint32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.WriteByte(0xcb)
+		e.writeUint64(math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.WriteByte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBin(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.writeLen(v.Len(), 0x90, 16, 0xdc)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.WriteByte(0xc0)
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New("msgpack: unsupported map key type: " + v.Type().Key().String())
+		}
+		keys := v.MapKeys()
+		names := make([]string, len(keys))
+		byName := make(map[string]reflect.Value, len(keys))
+		for i, k := range keys {
+			names[i] = k.String()
+			byName[names[i]] = k
+		}
+		sort.Strings(names)
+		e.writeLen(len(names), 0x80, 16, 0xde)
+		for _, name := range names {
+			e.encodeString(name)
+			if err := e.encode(v.MapIndex(byName[name])); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.WriteByte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return errors.New("msgpack: unsupported type: " + v.Type().String())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	fields := structFields(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+FIELDS:
+	for _, f := range fields {
+		fv := v
+		for _, i := range f.index {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue FIELDS // nil embedded struct
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(i)
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		names = append(names, f.name)
+		values = append(values, fv)
+	}
+	e.writeLen(len(names), 0x80, 16, 0xde)
+	for i := range names {
+		e.encodeString(names[i])
+		if err := e.encode(values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeJSON(m json.Marshaler) error {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber() // don't round big ints through float64
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	return e.encode(reflect.ValueOf(v))
+}
+
+func (e *msgpackEncoder) encodeNumber(n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		e.encodeInt(i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		e.encodeUint(u)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return err
+	}
+	e.WriteByte(0xcb)
+	e.writeUint64(math.Float64bits(f))
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.WriteByte(byte(i)) // negative fixint
+	case i >= math.MinInt8:
+		e.WriteByte(0xd0)
+		e.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		e.WriteByte(0xd1)
+		e.writeUint16(uint16(i))
+	case i >= math.MinInt32:
+		e.WriteByte(0xd2)
+		e.writeUint32(uint32(i))
+	default:
+		e.WriteByte(0xd3)
+		e.writeUint64(uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u < 128:
+		e.WriteByte(byte(u)) // positive fixint
+	case u <= math.MaxUint8:
+		e.WriteByte(0xcc)
+		e.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		e.WriteByte(0xcd)
+		e.writeUint16(uint16(u))
+	case u <= math.MaxUint32:
+		e.WriteByte(0xce)
+		e.writeUint32(uint32(u))
+	default:
+		e.WriteByte(0xcf)
+		e.writeUint64(u)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.WriteByte(0xd9)
+		e.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		e.WriteByte(0xda)
+		e.writeUint16(uint16(n))
+	default:
+		e.WriteByte(0xdb)
+		e.writeUint32(uint32(n))
+	}
+	e.WriteString(s)
+}
+
+func (e *msgpackEncoder) encodeBin(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.WriteByte(0xc4)
+		e.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		e.WriteByte(0xc5)
+		e.writeUint16(uint16(n))
+	default:
+		e.WriteByte(0xc6)
+		e.writeUint32(uint32(n))
+	}
+	e.Write(b)
+}
+
+// writeLen writes an array or map header: fix | n if n < fixMax, else the
+// 16-bit type (and the 32-bit type, which is the next byte) and n.
+func (e *msgpackEncoder) writeLen(n int, fix byte, fixMax int, type16 byte) {
+	switch {
+	case n < fixMax:
+		e.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		e.WriteByte(type16)
+		e.writeUint16(uint16(n))
+	default:
+		e.WriteByte(type16 + 1)
+		e.writeUint32(uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) writeUint16(u uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], u)
+	e.Write(b[:])
+}
+
+func (e *msgpackEncoder) writeUint32(u uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], u)
+	e.Write(b[:])
+}
+
+func (e *msgpackEncoder) writeUint64(u uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], u)
+	e.Write(b[:])
+}
+
+// --------------------------------------------------------------------------
+
+type msgpackField struct {
+	name      string
+	index     []int // field index path, through embedded structs
+	omitEmpty bool
+}
+
+type byIndex []msgpackField
+
+func (a byIndex) Len() int      { return len(a) }
+func (a byIndex) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byIndex) Less(i, j int) bool {
+	for k, x := range a[i].index {
+		if k >= len(a[j].index) {
+			return false
+		}
+		if x != a[j].index[k] {
+			return x < a[j].index[k]
+		}
+	}
+	return len(a[i].index) < len(a[j].index)
+}
+
+var (
+	fieldsMux   = &sync.Mutex{}
+	fieldsCache = make(map[reflect.Type][]msgpackField)
+)
+
+// structFields returns the fields that encoding/json encodes for the struct
+// type, in the same order.  A field hides fields of the same name in structs
+// it's embedded with.  They're cached because reports are the same few types.
+func structFields(t reflect.Type) []msgpackField {
+	fieldsMux.Lock()
+	defer fieldsMux.Unlock()
+	if fields, ok := fieldsCache[t]; ok {
+		return fields
+	}
+	all := []msgpackField{}
+	addFields(t, nil, &all)
+	fields := []msgpackField{}
+	depth := make(map[string]int)
+	for _, f := range all {
+		if d, ok := depth[f.name]; ok && d <= len(f.index) {
+			continue
+		}
+		depth[f.name] = len(f.index)
+	}
+	for _, f := range all {
+		if depth[f.name] == len(f.index) {
+			fields = append(fields, f)
+			depth[f.name] = -1 // only the first at that depth
+		}
+	}
+	sort.Sort(byIndex(fields))
+	fieldsCache[t] = fields
+	return fields
+}
+
+func addFields(t reflect.Type, index []int, fields *[]msgpackField) {
+	if len(index) > 10 {
+		return // embedding loop through pointers
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if c := strings.Index(tag, ","); c >= 0 {
+			name, opts = tag[:c], tag[c+1:]
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			addFields(ft, fieldIndex, fields)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		*fields = append(*fields, msgpackField{
+			name:      name,
+			index:     fieldIndex,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	DEFAULT_OPENTSDB_BATCH = 50 // points per put, OpenTSDB recommends < 50
+	OPENTSDB_TIMEOUT       = 10 * time.Second
+)
+
+/**
+ * OpenTSDB puts mm reports to an OpenTSDB server using its HTTP API
+ * (/api/put).  Like Graphite and InfluxDB, it's a sink, see sink.go.
+ *
+ * Metric name components db.<name>, t.<name>, and idx.<name> become tags,
+ * the other components make the metric, so mysql/db.shop/t.orders/idx.PRIMARY/rows_read
+ * from instance 1 becomes metric mysql.rows_read with tags
+ *
+ *   host=db1 instance=1 db=shop table=orders index=PRIMARY stat=avg
+ *
+ * One point is sent for every stat in Config.OpenTSDBStats, tagged with
+ * the stat.  Points are put in batches of Config.OpenTSDBBatch.  4xx errors
+ * aren't retried: OpenTSDB rejected some or all points, which are counted as
+ * dropped.
+ */
+type OpenTSDB struct {
+	*sink
+	url      string
+	batch    int
+	stats    []string
+	hostname string
+	// --
+	client *http.Client
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type openTSDBSummary struct {
+	Failed  uint `json:"failed"`
+	Success uint `json:"success"`
+}
+
+var openTSDBTags = map[string]string{
+	"db.":  "db",
+	"t.":   "table",
+	"idx.": "index",
+}
+
+func NewOpenTSDB(logger *pct.Logger, url string, batch uint, stats []string, hostname string) *OpenTSDB {
+	if batch == 0 {
+		batch = DEFAULT_OPENTSDB_BATCH
+	}
+	if len(stats) == 0 {
+		stats = []string{"avg"}
+	}
+	o := &OpenTSDB{
+		url:      url,
+		batch:    int(batch),
+		stats:    stats,
+		hostname: hostname,
+		// --
+		client: &http.Client{Timeout: OPENTSDB_TIMEOUT},
+	}
+	o.sink = newSink("OpenTSDB", "points", logger, o)
+	return o
+}
+
+// ValidateOpenTSDB returns an error if the URL isn't http(s) or a stat is
+// unknown.
+func ValidateOpenTSDB(serverURL string, stats []string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return errors.New("Invalid OpenTSDB URL: " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Invalid OpenTSDB URL: expected http or https: " + serverURL)
+	}
+	for _, stat := range stats {
+		if !validStat(stat) {
+			return errors.New("Invalid OpenTSDBStats stat: " + stat)
+		}
+	}
+	return nil
+}
+
+func (o *OpenTSDB) Start() error {
+	if err := ValidateOpenTSDB(o.url, o.stats); err != nil {
+		return err
+	}
+
+	// Put to /api/put by default, with a summary to count failed points.
+	u, _ := url.Parse(o.url)
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api/put"
+	}
+	q := u.Query()
+	q.Set("summary", "true")
+	u.RawQuery = q.Encode()
+	o.url = u.String()
+
+	return o.start(u.Host)
+}
+
+// --------------------------------------------------------------------------
+
+func (o *OpenTSDB) batches(ts time.Time, instances []InstanceMetricStats) []sinkBatch {
+	points := o.points(ts, instances)
+	batches := []sinkBatch{}
+	for len(points) > 0 {
+		n := o.batch
+		if n > len(points) {
+			n = len(points)
+		}
+		body, err := json.Marshal(points[:n])
+		if err != nil {
+			o.logger.Warn("Cannot encode OpenTSDB points: ", err)
+		} else {
+			batches = append(batches, sinkBatch{body, uint(n)})
+		}
+		points = points[n:]
+	}
+	return batches
+}
+
+func (o *OpenTSDB) points(ts time.Time, instances []InstanceMetricStats) []openTSDBPoint {
+	points := []openTSDBPoint{}
+	unixTs := ts.Unix()
+	for _, is := range instances {
+		for name, stats := range is.Stats {
+			if stats.Cnt == 0 {
+				continue // string metric, or no values
+			}
+			metric, tags := openTSDBMetric(name)
+			if o.hostname != "" {
+				tags["host"] = openTSDBSanitize(o.hostname)
+			}
+			tags["instance"] = strconv.FormatUint(uint64(is.InstanceId), 10)
+			for _, stat := range o.stats {
+				val, ok := stats.value(stat)
+				if !ok {
+					continue
+				}
+				pointTags := make(map[string]string, len(tags)+1)
+				for k, v := range tags {
+					pointTags[k] = v
+				}
+				pointTags["stat"] = stat
+				points = append(points, openTSDBPoint{metric, unixTs, val, pointTags})
+			}
+		}
+	}
+	return points
+}
+
+// openTSDBMetric returns the metric and tags for an mm metric name.
+func openTSDBMetric(name string) (string, map[string]string) {
+	tags := map[string]string{}
+	parts := []string{}
+	for _, part := range strings.Split(name, "/") {
+		isTag := false
+		for prefix, tag := range openTSDBTags {
+			if strings.HasPrefix(part, prefix) && len(part) > len(prefix) {
+				tags[tag] = openTSDBSanitize(part[len(prefix):])
+				isTag = true
+				break
+			}
+		}
+		if !isTag {
+			parts = append(parts, openTSDBSanitize(part))
+		}
+	}
+	return strings.Join(parts, "."), tags
+}
+
+// openTSDBSanitize replaces characters OpenTSDB doesn't allow in metrics and
+// tag values: only letters, digits, -, _, ., and / are allowed.
+func openTSDBSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// write puts the points and returns how many were put if some were rejected
+// (4xx), and whether retrying can succeed if there's an error.
+func (o *OpenTSDB) write(batch sinkBatch) (uint, bool, error) {
+	resp, err := o.client.Post(o.url, "application/json", bytes.NewReader(batch.data))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err // don't log the URL, it can have a password
+		}
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return 0, false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 4 || resp.StatusCode == 429 { // 429 = Too Many Requests
+		return 0, true, fmt.Errorf("%s", resp.Status)
+	}
+	summary := openTSDBSummary{}
+	json.Unmarshal(msg, &summary) // 0 success if not a summary
+	if summary.Success > batch.n {
+		summary.Success = batch.n
+	}
+	return summary.Success, false, fmt.Errorf("%s: %d of %d points failed", resp.Status, batch.n-summary.Success, batch.n)
+}
+
+func (o *OpenTSDB) close() {
+	// Nothing to close, the http.Client keeps idle connections.
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type OpenTSDBTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&OpenTSDBTestSuite{})
+
+func (s *OpenTSDBTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "opentsdb_test")
+}
+
+type openTSDBTestPoint struct {
+	Metric    string
+	Timestamp int64
+	Value     float64
+	Tags      map[string]string
+}
+
+type openTSDBTestPoints []openTSDBTestPoint
+
+func (p openTSDBTestPoints) Len() int      { return len(p) }
+func (p openTSDBTestPoints) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p openTSDBTestPoints) Less(i, j int) bool {
+	if p[i].Metric != p[j].Metric {
+		return p[i].Metric < p[j].Metric
+	}
+	return p[i].Tags["stat"] < p[j].Tags["stat"]
+}
+
+func (s *OpenTSDBTestSuite) TestSend(t *C) {
+	// The 2nd put is rejected: 1 point fails.
+	puts := make(chan openTSDBTestPoints, 10)
+	n := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Check(r.URL.Path, Equals, "/api/put")
+		t.Check(r.URL.Query().Get("summary"), Equals, "true")
+		points := openTSDBTestPoints{}
+		json.NewDecoder(r.Body).Decode(&points)
+		puts <- points
+		n++
+		if n == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"failed":1,"success":1}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	o := data.NewOpenTSDB(s.logger, server.URL, 2, []string{"avg", "max"}, "db1.example.com")
+	err := o.Start()
+	t.Assert(err, IsNil)
+	defer o.Stop()
+
+	report := &mm.Report{
+		Ts:       time.Unix(1420070400, 0).UTC(),
+		Duration: 60,
+		Stats: []*mm.InstanceStats{
+			{
+				ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 3},
+				Stats: map[string]*mm.Stats{
+					"mysql/threads_running":                        {Cnt: 60, Avg: 2.5, Max: 10},
+					"mysql/db.shop/t.orders/idx.PRIMARY/rows_read": {Cnt: 1, Avg: 7, Max: 7},
+					"mysql/version":                                {}, // string metric, not sent
+				},
+			},
+		},
+	}
+	o.Write("qan", report)
+	o.Write("mm", report)
+
+	got := openTSDBTestPoints{}
+	for i := 0; i < 2; i++ {
+		select {
+		case points := <-puts:
+			t.Check(points, HasLen, 2) // batch
+			got = append(got, points...)
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for OpenTSDB put")
+		}
+	}
+	sort.Sort(got)
+	tags := func(stat string, extra ...string) map[string]string {
+		m := map[string]string{"host": "db1.example.com", "instance": "3", "stat": stat}
+		for i := 0; i < len(extra); i += 2 {
+			m[extra[i]] = extra[i+1]
+		}
+		return m
+	}
+	t.Check(got, DeepEquals, openTSDBTestPoints{
+		{"mysql.rows_read", 1420070400, 7, tags("avg", "db", "shop", "table", "orders", "index", "PRIMARY")},
+		{"mysql.rows_read", 1420070400, 7, tags("max", "db", "shop", "table", "orders", "index", "PRIMARY")},
+		{"mysql.threads_running", 1420070400, 2.5, tags("avg")},
+		{"mysql.threads_running", 1420070400, 10, tags("max")},
+	})
+
+	select {
+	case points := <-puts:
+		t.Errorf("Unexpected put: %+v", points)
+	case <-time.After(200 * time.Millisecond):
+	}
+	t.Check(o.Status()["data-opentsdb"], Equals, "Error: 400 Bad Request: 1 of 2 points failed (3 points sent, 1 dropped)")
+}
+
+func (s *OpenTSDBTestSuite) TestValidate(t *C) {
+	t.Check(data.ValidateOpenTSDB("http://localhost:4242", nil), IsNil)
+	t.Check(data.ValidateOpenTSDB("https://tsdb/api/put", []string{"avg", "pct99"}), IsNil)
+	t.Check(data.ValidateOpenTSDB("localhost:4242", nil), NotNil)
+	t.Check(data.ValidateOpenTSDB("http://localhost:4242", []string{"mean"}), NotNil)
+	t.Check(data.ValidateOpenTSDB("http://localhost:4242", []string{"pct100"}), NotNil)
+	t.Check(data.ValidateOpenTSDB("http://localhost:4242", []string{"pct99.0"}), NotNil)
+	t.Check(data.ValidateOpenTSDB("http://localhost:4242", []string{"pctile"}), NotNil)
+}
@@ -21,38 +21,62 @@ import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
+	"strings"
 	"time"
 )
 
 const (
 	MAX_SEND_ERRORS    = 3
 	CONNECT_ERROR_WAIT = 3
+	FALLBACK_AFTER     = 3  // consecutive websocket connect or send errors, then use fallback
+	FALLBACK_RETRY     = 10 // send runs on fallback, then try websocket again
 )
 
 type Sender struct {
 	logger *pct.Logger
-	client pct.WebsocketClient
+	client Transport
 	// --
 	spool      Spooler
 	tickerChan <-chan time.Time
 	timeout    uint
 	blackhole  bool
+	requireAck bool
+	resend     map[string]uint // files sent but not acked => nacks
+	batchBytes uint            // Config.BatchBytes, see batch.go
+	batchAge   uint            // Config.BatchAge
+	accepted   func() []string // data content types the API accepts
+	lastRun    time.Time       // last send run, for batchAge
 	sync       *pct.SyncChan
 	status     *pct.Status
+	apiErrors  *pct.APIErrorReporter
+	sent       *pct.LastTs // keyed on service, e.g. mm-last-sent
+	ledger     *Ledger     // nil if none
+	// --
+	fallback      Transport
+	transport     Transport // client or fallback, for the current send run
+	onFallback    bool
+	fallbackSince time.Time
+	fallbackRuns  uint // since websocket was last tried
+	wsErrors      uint // consecutive websocket connect or send errors
 	// --
 	lastStats  *SenderStats
 	dailyStats *SenderStats
 }
 
-func NewSender(logger *pct.Logger, client pct.WebsocketClient) *Sender {
+func NewSender(logger *pct.Logger, client Transport) *Sender {
 	s := &Sender{
 		logger:     logger,
 		client:     client,
+		resend:     make(map[string]uint),
+		sent:       pct.NewLastTs(pct.LAST_SENT),
 		sync:       pct.NewSyncChan(),
-		status:     pct.NewStatus([]string{"data-sender", "data-sender-last", "data-sender-1d"}),
+		status:     pct.NewStatus([]string{"data-sender", "data-sender-transport", "data-sender-resend", "data-sender-last", "data-sender-1d"}),
+		apiErrors:  pct.NewAPIErrorReporter(logger, "data-sender", pct.DEFAULT_API_ERROR_REPORT_INTERVAL),
 		lastStats:  NewSenderStats(0),
 		dailyStats: NewSenderStats(24 * time.Hour),
 	}
+	s.updateTransportStatus()
+	s.updateResendStatus()
 	return s
 }
 
@@ -66,6 +90,39 @@ func (s *Sender) Start(spool Spooler, tickerChan <-chan time.Time, timeout uint,
 	return nil
 }
 
+// SetRequireAck makes the sender remove files only when the API acks them,
+// see Ack and Config.RequireAck.  Call it before Start.
+func (s *Sender) SetRequireAck(require bool) {
+	s.requireAck = require
+}
+
+// SetBatch sets the max bytes of files to send in one upload and the max
+// seconds to hold files for a batch, see batch.go.  Files are batched only
+// if accepted returns pct.CONTENT_TYPE_BATCH.  Call it before Start.
+func (s *Sender) SetBatch(maxBytes, maxAge uint, accepted func() []string) {
+	s.batchBytes = maxBytes
+	s.batchAge = maxAge
+	s.accepted = accepted
+}
+
+// SetLedger sets the ledger to account sent data in.  Call it before Start.
+func (s *Sender) SetLedger(ledger *Ledger) {
+	s.ledger = ledger
+}
+
+/**
+ * SetFallback sets the transport to use when the websocket client fails to
+ * connect or send FALLBACK_AFTER times in a row, e.g. because a proxy blocks
+ * websockets or kills them once data flows.  While on the fallback, the
+ * sender uses the websocket again every FALLBACK_RETRY send runs and goes
+ * back to it if that run sends without error, else the run continues on the
+ * fallback.  Call it before Start.
+ */
+func (s *Sender) SetFallback(fallback Transport) {
+	s.fallback = fallback
+	s.updateTransportStatus()
+}
+
 func (s *Sender) Stop() error {
 	s.sync.Stop()
 	s.sync.Wait()
@@ -76,7 +133,10 @@ func (s *Sender) Stop() error {
 }
 
 func (s *Sender) Status() map[string]string {
-	return s.status.Merge(s.client.Status())
+	if s.fallback == nil {
+		return s.status.Merge(s.client.Status(), s.apiErrors.Status(), s.sent.Status())
+	}
+	return s.status.Merge(s.client.Status(), s.fallback.Status(), s.apiErrors.Status(), s.sent.Status())
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -102,7 +162,11 @@ func (s *Sender) run() {
 	s.status.Update("data-sender", "Idle")
 	for {
 		select {
-		case <-s.tickerChan:
+		case now := <-s.tickerChan:
+			if s.holdBatch(now) {
+				s.logger.Debug("send:hold batch")
+				continue
+			}
 			s.send()
 		case <-s.sync.StopChan:
 			s.sync.Graceful()
@@ -115,12 +179,15 @@ func (s *Sender) send() {
 	s.logger.Debug("send:call")
 	defer s.logger.Debug("send:return")
 
+	s.transport = s.pickTransport()
+	s.lastRun = time.Now()
+
 	sent := SentInfo{}
 	defer func() {
 		sent.End = time.Now()
 
 		s.status.Update("data-sender", "Disconnecting")
-		s.client.DisconnectOnce()
+		s.transport.DisconnectOnce()
 
 		// Stats for this run.
 		s.lastStats.Sent(sent)
@@ -157,9 +224,10 @@ func (s *Sender) send() {
 		if sent.Errs > 0 {
 			time.Sleep(CONNECT_ERROR_WAIT * time.Second)
 		}
-		if err := s.client.ConnectOnce(10); err != nil {
+		if err := s.transport.ConnectOnce(10); err != nil {
 			sent.Errs++
-			s.logger.Warn("Cannot connect to API: ", err)
+			s.apiErrors.Report(0, err)
+			s.wsError()
 			continue // retry
 		}
 		s.logger.Debug("send:connected")
@@ -168,9 +236,11 @@ func (s *Sender) send() {
 		if err := s.sendAllFiles(startTime, &sent); err != nil {
 			sent.Errs++
 			s.logger.Warn(err)
-			s.client.DisconnectOnce()
+			s.transport.DisconnectOnce()
+			s.wsError()
 			continue // error sending files, re-connect and try again
 		}
+		s.wsOk()
 		return // success or API error, either way, stop sending
 	}
 }
@@ -178,8 +248,13 @@ func (s *Sender) send() {
 func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
 	s.status.Update("data-sender", "Running")
 	defer s.spool.CancelFiles()
+	inSpool := make(map[string]bool)
+	batching := s.batching()
+	batch := []sendFile{}
+	batchSize := uint(0)
 	for file := range s.spool.Files() {
 		s.logger.Debug("send:" + file)
+		inSpool[file] = true
 
 		// Check runtime, don't send forever.
 		runTime := time.Now().Sub(startTime).Seconds()
@@ -195,6 +270,21 @@ func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
 			return fmt.Errorf("spool.Read: %s", err)
 		}
 
+		if len(data) > 0 {
+			version, payload, err := DecodeSpoolFile(data)
+			if err != nil {
+				// Keep the file in the trash in case a newer agent can send it.
+				s.spool.Reject(file)
+				s.logger.Warn(fmt.Sprintf("Rejected %s: %s", file, err))
+				sent.BadFiles++
+				continue // next file
+			}
+			if version < SPOOL_VERSION {
+				s.logger.Debug(fmt.Sprintf("send:%s:version:%d", file, version))
+			}
+			data = payload
+		}
+
 		if s.blackhole {
 			s.status.Update("data-sender", "Removing "+file+" (blackhole)")
 			s.spool.Remove(file)
@@ -208,45 +298,291 @@ func (s *Sender) sendAllFiles(startTime time.Time, sent *SentInfo) error {
 			continue // next file
 		}
 
-		// todo: number/time/rate limit so we dont DDoS API
-		s.status.Update("data-sender", "Sending "+file)
-		t0 := time.Now()
-		if err := s.client.SendBytes(data, s.timeout); err != nil {
-			return fmt.Errorf("Sending %s: %s", file, err)
+		if batching {
+			// Send the batch if this file doesn't fit, then start the next
+			// batch with this file.
+			if len(batch) > 0 && batchSize+uint(len(data)) > s.batchBytes {
+				if stop, err := s.sendBatch(batch, sent); stop || err != nil {
+					return err
+				}
+				batch, batchSize = []sendFile{}, 0
+			}
+			batch = append(batch, sendFile{file, data})
+			batchSize += uint(len(data))
+			continue // next file
 		}
-		sent.SendTime += time.Now().Sub(t0).Seconds()
-		sent.Bytes += uint64(len(data))
 
-		s.status.Update("data-sender", "Waiting for API to ack "+file)
-		resp := &proto.Response{}
-		if err := s.client.Recv(resp, 5); err != nil {
-			return fmt.Errorf("Waiting for API to ack %s: %s", file, err)
+		if stop, err := s.upload(file, []sendFile{{file, data}}, data, sent); stop || err != nil {
+			return err
+		}
+	}
+	if len(batch) > 0 {
+		if stop, err := s.sendBatch(batch, sent); stop || err != nil {
+			return err
 		}
-		s.logger.Debug(fmt.Sprintf("send:resp:%+v", resp.Code))
+	}
+	// Files queued to resend that weren't in the spool were purged or evicted.
+	s.pruneResend(inSpool)
+	return nil // success
+}
 
-		switch {
-		case resp.Code >= 500:
-			// API had problem, try sending files again later.
-			sent.ApiErrs++
-			return nil // don't warn about API errors
-		case resp.Code >= 400:
-			// File is bad, remove it.
-			s.status.Update("data-sender", "Removing "+file)
-			s.spool.Remove(file)
-			s.logger.Warn(fmt.Sprintf("Removed %s because API returned %d: %s", file, resp.Code, resp.Error))
-			sent.Files++
-			sent.BadFiles++
-		case resp.Code >= 300:
-			// This shouldn't happen.
-			return fmt.Errorf("Recieved unhandled response code from API: %d: %s", resp.Code, resp.Error)
-		case resp.Code >= 200:
-			s.status.Update("data-sender", "Removing "+file)
-			s.spool.Remove(file)
+// A spool file to send: its name and payload.
+type sendFile struct {
+	name string
+	data []byte
+}
+
+// batching returns true if files are sent in batches, see batch.go.
+func (s *Sender) batching() bool {
+	if s.batchBytes == 0 || s.accepted == nil || s.blackhole {
+		return false
+	}
+	for _, t := range s.accepted() {
+		if t == pct.CONTENT_TYPE_BATCH {
+			return true
+		}
+	}
+	return false
+}
+
+// holdBatch returns true if the send run at now should wait for more files
+// to batch: the last run was less than the batch age ago and fewer than the
+// batch bytes are spooled, if the spooler knows.
+func (s *Sender) holdBatch(now time.Time) bool {
+	if s.batchAge == 0 || !s.batching() {
+		return false
+	}
+	if now.Sub(s.lastRun) >= time.Duration(s.batchAge)*time.Second {
+		return false
+	}
+	if spool, ok := s.spool.(SizeSpooler); ok && spool.Size() >= uint64(s.batchBytes) {
+		return false
+	}
+	return true
+}
+
+// sendBatch sends the files in one upload.  A single file is sent alone.
+func (s *Sender) sendBatch(files []sendFile, sent *SentInfo) (bool, error) {
+	if len(files) == 1 {
+		return s.upload(files[0].name, files, files[0].data, sent)
+	}
+	payloads := make([][]byte, len(files))
+	for i, f := range files {
+		payloads[i] = f.data
+	}
+	name := fmt.Sprintf("batch of %d files", len(files))
+	return s.upload(name, files, EncodeBatch(payloads), sent)
+}
+
+// upload sends the data of the files, which is a batch if there's more than
+// one file, and removes the files if the API accepts it.  It returns true if
+// the sender should stop sending, e.g. on API error.
+func (s *Sender) upload(name string, files []sendFile, data []byte, sent *SentInfo) (bool, error) {
+	// todo: number/time/rate limit so we dont DDoS API
+	s.status.Update("data-sender", "Sending "+name)
+	wireBytes := uint64(len(data))
+	wc, counting := s.transport.(WireCounter)
+	var wire0 uint64
+	if counting {
+		wire0 = wc.WireBytes()
+	}
+	t0 := time.Now()
+	if err := s.transport.SendBytes(data, s.timeout); err != nil {
+		return false, fmt.Errorf("Sending %s: %s", name, err)
+	}
+	sent.SendTime += time.Now().Sub(t0).Seconds()
+	sent.Bytes += uint64(len(data))
+	if counting {
+		wireBytes = wc.WireBytes() - wire0
+	}
+
+	s.status.Update("data-sender", "Waiting for API to ack "+name)
+	resp := &proto.Response{}
+	var ack *Ack
+	var v interface{} = resp
+	if s.requireAck {
+		ack = &Ack{}
+		v = ack
+	}
+	if err := s.transport.Recv(v, 5); err != nil {
+		for _, f := range files {
+			s.unacked(f.name)
+		}
+		return false, fmt.Errorf("Waiting for API to ack %s: %s", name, err)
+	}
+	if ack != nil {
+		resp = &ack.Response
+	}
+	s.logger.Debug(fmt.Sprintf("send:resp:%+v", resp.Code))
+
+	switch {
+	case resp.Code >= 500:
+		// API had problem, try sending files again later.
+		sent.ApiErrs++
+		s.apiErrors.Report(int(resp.Code), fmt.Errorf("%d response to %s: %s", resp.Code, name, resp.Error))
+		return true, nil // reported
+	case resp.Code == 401 || resp.Code == 402 || resp.Code == 403 || resp.Code == 429:
+		// The file is ok but the API won't take it (bad API key, quota,
+		// rate limit), so keep it and try again later.
+		sent.ApiErrs++
+		s.apiErrors.Report(int(resp.Code), fmt.Errorf("%d response to %s: %s", resp.Code, name, resp.Error))
+		return true, nil // reported
+	case resp.Code >= 400 && len(files) > 1:
+		// One of the files is bad.  Send them alone so only bad files are
+		// removed.
+		s.logger.Warn(fmt.Sprintf("API returned %d to %s, sending its files alone: %s", resp.Code, name, resp.Error))
+		for _, f := range files {
+			if stop, err := s.upload(f.name, []sendFile{f}, f.data, sent); stop || err != nil {
+				return stop, err
+			}
+		}
+	case resp.Code >= 400:
+		// File is bad, remove it.
+		s.status.Update("data-sender", "Removing "+name)
+		s.spool.Remove(name)
+		delete(s.resend, name)
+		s.updateResendStatus()
+		s.logger.Warn(fmt.Sprintf("Removed %s because API returned %d: %s", name, resp.Code, resp.Error))
+		sent.Files++
+		sent.BadFiles++
+	case resp.Code >= 300:
+		// This shouldn't happen.
+		return false, fmt.Errorf("Recieved unhandled response code from API: %d: %s", resp.Code, resp.Error)
+	case resp.Code >= 200:
+		if ack != nil {
+			if sum := Checksum(data); ack.Checksum != sum {
+				for _, f := range files {
+					s.nacked(f.name, sent)
+				}
+				return false, fmt.Errorf("API did not ack %s: checksum %q, expected %q", name, ack.Checksum, sum)
+			}
+		}
+		s.apiErrors.Success()
+		s.status.Update("data-sender", "Removing "+name)
+		now := time.Now()
+		for _, f := range files {
+			s.spool.Remove(f.name)
+			delete(s.resend, f.name)
+			// Data file names are service_nanoUnixTs, see DiskvSpooler.ts().
+			if i := strings.Index(f.name, "_"); i > 0 {
+				s.sent.Mark(f.name[0:i], now)
+				if s.ledger != nil {
+					// A batch's wire bytes are split by file size.
+					bytes := wireBytes * uint64(len(f.data)) / uint64(len(data))
+					s.ledger.Add(f.name[0:i], now, LedgerEntry{SentFiles: 1, SentBytes: bytes})
+				}
+			}
 			sent.Files++
-		default:
-			// This shouldn't happen.
-			return fmt.Errorf("Recieved unknown response code from API: %d: %s", resp.Code, resp.Error)
 		}
+		s.updateResendStatus()
+	default:
+		// This shouldn't happen.
+		return false, fmt.Errorf("Recieved unknown response code from API: %d: %s", resp.Code, resp.Error)
+	}
+	return false, nil
+}
+
+// unacked queues a file sent without a response to resend.  It's still in
+// the spool, so the next send run, or retry in this run, resends it.
+func (s *Sender) unacked(file string) {
+	if _, ok := s.resend[file]; !ok {
+		s.resend[file] = 0
+	}
+	s.updateResendStatus()
+}
+
+// nacked queues a file that the API did not ack to resend, or moves it to
+// the trash after MAX_NACKS.
+func (s *Sender) nacked(file string, sent *SentInfo) {
+	s.resend[file]++
+	if s.resend[file] >= MAX_NACKS {
+		s.spool.Reject(file)
+		delete(s.resend, file)
+		s.logger.Warn(fmt.Sprintf("Rejected %s because API did not ack it %d times", file, MAX_NACKS))
+		sent.BadFiles++
+	}
+	s.updateResendStatus()
+}
+
+// pruneResend unqueues files to resend that are no longer in the spool.
+func (s *Sender) pruneResend(inSpool map[string]bool) {
+	for file := range s.resend {
+		if !inSpool[file] {
+			delete(s.resend, file)
+		}
+	}
+	s.updateResendStatus()
+}
+
+func (s *Sender) updateResendStatus() {
+	s.status.Update("data-sender-resend", fmt.Sprintf("%d files", len(s.resend)))
+}
+
+// pickTransport returns the transport for the next send run: the websocket
+// client unless the sender is on the fallback.  Every FALLBACK_RETRY runs on
+// the fallback, it tries the websocket for one run, see wsOk and wsError.
+func (s *Sender) pickTransport() Transport {
+	if s.fallback == nil || !s.onFallback {
+		return s.client
+	}
+	s.fallbackRuns++
+	if s.fallbackRuns < FALLBACK_RETRY {
+		return s.fallback
+	}
+	s.fallbackRuns = 0
+	s.logger.Debug("send:trying websocket")
+	return s.client
+}
+
+// wsError counts a websocket connect or send error and switches to the
+// fallback transport if there are too many in a row.  If the sender is
+// trying the websocket while on the fallback, the rest of the run uses the
+// fallback.
+func (s *Sender) wsError() {
+	if s.transport != s.client {
+		return // fallback error, reported like any other
+	}
+	s.wsErrors++
+	if s.fallback == nil {
+		return
+	}
+	if s.onFallback {
+		s.logger.Debug("send:websocket still fails")
+		s.transport = s.fallback
+		return
+	}
+	if s.wsErrors < FALLBACK_AFTER {
+		return
+	}
+	s.logger.Warn(fmt.Sprintf("Websocket failed %d times, using fallback transport", s.wsErrors))
+	s.onFallback = true
+	s.fallbackSince = time.Now()
+	s.fallbackRuns = 0
+	s.updateTransportStatus()
+}
+
+// wsOk resets the websocket errors after a send run without errors, and
+// stops using the fallback transport if the run used the websocket.
+func (s *Sender) wsOk() {
+	if s.transport != s.client {
+		return
+	}
+	s.wsErrors = 0
+	if s.onFallback {
+		s.logger.Info("Websocket works again, stopped using fallback transport")
+		s.onFallback = false
+		s.updateTransportStatus()
+	}
+}
+
+func (s *Sender) updateTransportStatus() {
+	switch {
+	case s.fallback == nil:
+		s.status.Update("data-sender-transport", "websocket")
+	case s.onFallback:
+		s.status.Update("data-sender-transport", fmt.Sprintf("fallback since %s, websocket failed %d times",
+			pct.TimeString(s.fallbackSince), s.wsErrors))
+	default:
+		s.status.Update("data-sender-transport", "websocket, fallback ready")
 	}
-	return nil // success
 }
@@ -21,28 +21,54 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"io"
+
+	"github.com/percona/percona-agent/pct"
 )
 
 type Serializer interface {
 	ToBytes(data interface{}) ([]byte, error)
 	Encoding() string
+	ContentType() string
 	Concurrent() bool
 }
 
+// A RawSizer is a Serializer that compresses the data, so RawSize returns
+// the size of the data the last ToBytes serialized before it was compressed,
+// see Ledger.
+type RawSizer interface {
+	RawSize() int
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
 type JsonGzipSerializer struct {
 	e *json.Encoder
+	c *countWriter
 	g *gzip.Writer
 	b *bytes.Buffer
 }
 
 func NewJsonGzipSerializer() *JsonGzipSerializer {
-	b := &bytes.Buffer{}    // 4. buffer
-	g := gzip.NewWriter(b)  // 3. gzip
-	e := json.NewEncoder(g) // 2. encode
+	b := &bytes.Buffer{}    // 5. buffer
+	g := gzip.NewWriter(b)  // 4. gzip
+	c := &countWriter{w: g} // 3. count
+	e := json.NewEncoder(c) // 2. encode
 	// ....................... 1. data
 
 	s := &JsonGzipSerializer{
 		e: e,
+		c: c,
 		g: g,
 		b: b,
 	}
@@ -52,6 +78,7 @@ func NewJsonGzipSerializer() *JsonGzipSerializer {
 func (s *JsonGzipSerializer) ToBytes(data interface{}) ([]byte, error) {
 	s.b.Reset()
 	s.g.Reset(s.b)
+	s.c.n = 0
 	if err := s.e.Encode(data); err != nil {
 		return nil, err
 	}
@@ -63,10 +90,18 @@ func (s *JsonGzipSerializer) Encoding() string {
 	return "gzip"
 }
 
+func (s *JsonGzipSerializer) ContentType() string {
+	return pct.CONTENT_TYPE_JSON
+}
+
 func (s *JsonGzipSerializer) Concurrent() bool {
 	return false
 }
 
+func (s *JsonGzipSerializer) RawSize() int {
+	return s.c.n
+}
+
 // --------------------------------------------------------------------------
 
 type JsonSerializer struct {
@@ -85,6 +120,144 @@ func (s *JsonSerializer) Encoding() string {
 	return ""
 }
 
+func (s *JsonSerializer) ContentType() string {
+	return pct.CONTENT_TYPE_JSON
+}
+
 func (s *JsonSerializer) Concurrent() bool {
 	return true
 }
+
+// --------------------------------------------------------------------------
+
+type MsgpackGzipSerializer struct {
+	g *gzip.Writer
+	b *bytes.Buffer
+	n int // RawSize
+}
+
+func NewMsgpackGzipSerializer() *MsgpackGzipSerializer {
+	b := &bytes.Buffer{}
+	s := &MsgpackGzipSerializer{
+		g: gzip.NewWriter(b),
+		b: b,
+	}
+	return s
+}
+
+func (s *MsgpackGzipSerializer) ToBytes(data interface{}) ([]byte, error) {
+	msg, err := MarshalMsgpack(data)
+	if err != nil {
+		return nil, err
+	}
+	s.n = len(msg)
+	s.b.Reset()
+	s.g.Reset(s.b)
+	if _, err := s.g.Write(msg); err != nil {
+		return nil, err
+	}
+	s.g.Close()
+	return s.b.Bytes(), nil
+}
+
+func (s *MsgpackGzipSerializer) Encoding() string {
+	return "gzip"
+}
+
+func (s *MsgpackGzipSerializer) ContentType() string {
+	return pct.CONTENT_TYPE_MSGPACK
+}
+
+func (s *MsgpackGzipSerializer) Concurrent() bool {
+	return false
+}
+
+func (s *MsgpackGzipSerializer) RawSize() int {
+	return s.n
+}
+
+// --------------------------------------------------------------------------
+
+type MsgpackSerializer struct {
+}
+
+func NewMsgpackSerializer() *MsgpackSerializer {
+	s := &MsgpackSerializer{}
+	return s
+}
+
+func (s *MsgpackSerializer) ToBytes(data interface{}) ([]byte, error) {
+	return MarshalMsgpack(data)
+}
+
+func (s *MsgpackSerializer) Encoding() string {
+	return ""
+}
+
+func (s *MsgpackSerializer) ContentType() string {
+	return pct.CONTENT_TYPE_MSGPACK
+}
+
+func (s *MsgpackSerializer) Concurrent() bool {
+	return true
+}
+
+// --------------------------------------------------------------------------
+
+/**
+ * A NegotiatedSerializer uses the preferred serializer if the API accepts its
+ * content type, else the fallback, which should be JSON because every API
+ * accepts it.  The API says which types it accepts when the agent connects,
+ * which is after the data manager starts and again when it reconnects, so
+ * it's checked for every ToBytes.  Encoding and ContentType are those of the
+ * serializer the last ToBytes used, so it's never concurrent.
+ */
+type NegotiatedSerializer struct {
+	preferred Serializer
+	fallback  Serializer
+	accepted  func() []string
+	current   Serializer
+	n         int // RawSize if current isn't a RawSizer
+}
+
+func NewNegotiatedSerializer(preferred, fallback Serializer, accepted func() []string) *NegotiatedSerializer {
+	s := &NegotiatedSerializer{
+		preferred: preferred,
+		fallback:  fallback,
+		accepted:  accepted,
+		current:   fallback,
+	}
+	return s
+}
+
+func (s *NegotiatedSerializer) ToBytes(data interface{}) ([]byte, error) {
+	s.current = s.fallback
+	for _, t := range s.accepted() {
+		if t == s.preferred.ContentType() {
+			s.current = s.preferred
+			break
+		}
+	}
+	b, err := s.current.ToBytes(data)
+	s.n = len(b)
+	return b, err
+}
+
+func (s *NegotiatedSerializer) Encoding() string {
+	return s.current.Encoding()
+}
+
+func (s *NegotiatedSerializer) ContentType() string {
+	return s.current.ContentType()
+}
+
+func (s *NegotiatedSerializer) Concurrent() bool {
+	return false
+}
+
+func (s *NegotiatedSerializer) RawSize() int {
+	if rs, ok := s.current.(RawSizer); ok {
+		return rs.RawSize()
+	}
+	return s.n
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type SerializerTestSuite struct {
+}
+
+var _ = Suite(&SerializerTestSuite{})
+
+type msgpackInner struct {
+	Service    string
+	InstanceId uint
+}
+
+type msgpackReport struct {
+	msgpackInner
+	Ts    time.Time
+	Count int `json:"count"`
+	Neg   int64
+	Skip  string `json:"-"`
+	Empty string `json:",omitempty"`
+	Float float64
+	Bin   []byte
+	List  []string
+	Map   map[string]uint64
+	Nil   *msgpackInner
+	Raw   *json.RawMessage
+}
+
+// fixstr returns s as a msgpack fixstr.
+func fixstr(s string) string {
+	return string([]byte{0xa0 | byte(len(s))}) + s
+}
+
+func (s *SerializerTestSuite) TestMsgpack(t *C) {
+	raw := json.RawMessage(`{"x":[1,2.5]}`)
+	v := &msgpackReport{
+		msgpackInner: msgpackInner{"mysql", 1},
+		Ts:           time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+		Count:        300,
+		Neg:          -2,
+		Skip:         "x",
+		Float:        1.5,
+		Bin:          []byte{1, 2},
+		List:         []string{"a"},
+		Map:          map[string]uint64{"b": 70000, "a": 1},
+		Raw:          &raw,
+	}
+	got, err := data.MarshalMsgpack(v)
+	t.Assert(err, IsNil)
+
+	// Same fields in the same order as JSON, embedded fields first.
+	expect := "\x8b" +
+		fixstr("Service") + fixstr("mysql") +
+		fixstr("InstanceId") + "\x01" +
+		fixstr("Ts") + "\xb4" + "2015-01-02T03:04:05Z" +
+		fixstr("count") + "\xcd\x01\x2c" +
+		fixstr("Neg") + "\xfe" +
+		fixstr("Float") + "\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00" +
+		fixstr("Bin") + "\xc4\x02\x01\x02" +
+		fixstr("List") + "\x91" + fixstr("a") +
+		fixstr("Map") + "\x82" + fixstr("a") + "\x01" + fixstr("b") + "\xce\x00\x01\x11\x70" +
+		fixstr("Nil") + "\xc0" +
+		fixstr("Raw") + "\x81" + fixstr("x") + "\x92\x01\xcb\x40\x04\x00\x00\x00\x00\x00\x00"
+	t.Check(got, DeepEquals, []byte(expect))
+
+	// Maps need string keys, like JSON.
+	_, err = data.MarshalMsgpack(map[int]string{1: "a"})
+	t.Check(err, NotNil)
+}
+
+func (s *SerializerTestSuite) TestNegotiated(t *C) {
+	accepted := []string{pct.CONTENT_TYPE_JSON}
+	sz := data.NewNegotiatedSerializer(data.NewMsgpackGzipSerializer(), data.NewJsonGzipSerializer(),
+		func() []string { return accepted })
+	v := map[string]int{"a": 1}
+
+	// API accepts only JSON: JSON, gzipped.
+	got, err := sz.ToBytes(v)
+	t.Assert(err, IsNil)
+	t.Check(sz.ContentType(), Equals, pct.CONTENT_TYPE_JSON)
+	t.Check(sz.Encoding(), Equals, "gzip")
+	t.Check(string(gunzip(t, got)), Equals, "{\"a\":1}\n")
+
+	// API accepts msgpack: msgpack, gzipped.
+	accepted = []string{pct.CONTENT_TYPE_MSGPACK, pct.CONTENT_TYPE_JSON}
+	got, err = sz.ToBytes(v)
+	t.Assert(err, IsNil)
+	t.Check(sz.ContentType(), Equals, pct.CONTENT_TYPE_MSGPACK)
+	t.Check(sz.Encoding(), Equals, "gzip")
+	t.Check(gunzip(t, got), DeepEquals, []byte("\x81"+fixstr("a")+"\x01"))
+}
+
+func gunzip(t *C, b []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	t.Assert(err, IsNil)
+	out, err := ioutil.ReadAll(r)
+	t.Assert(err, IsNil)
+	return out
+}
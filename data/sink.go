@@ -0,0 +1,235 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+const SINK_QUEUE = 10 // reports, more are dropped
+
+/**
+ * Graphite, InfluxDB, and OpenTSDB are sinks: spooler Taps that send the
+ * metric stats of mm reports to a time series database, in addition to the
+ * API, or instead of it with Config.Blackhole.  What they share is a sink:
+ * Write queues the report and returns; the sink goroutine gets the stats
+ * (MetricReport), has the sinkWriter make them into batches of lines or
+ * points, and sends each batch, retrying with a pct.Backoff until it's sent
+ * or rejected.  While retrying, new reports wait in a queue of SINK_QUEUE;
+ * more are dropped.  Rejected lines or points and dropped reports are counted
+ * in the status.
+ */
+
+// A MetricReport is a report of metric stats: an mm.Report, which sinks
+// type-assert to this because the data package can't import mm.
+type MetricReport interface {
+	MetricStats() (time.Time, []InstanceMetricStats)
+}
+
+// InstanceMetricStats are the metric stats of one instance, keyed on metric
+// name, e.g. mysql/status/Threads_running.
+type InstanceMetricStats struct {
+	Service    string
+	InstanceId uint
+	Stats      map[string]MetricStats
+}
+
+// MetricStats are the stats of one metric, like mm.Stats.  Cnt is zero for
+// string metrics.
+type MetricStats struct {
+	Cnt   int
+	Min   float64
+	Pct5  float64
+	Avg   float64
+	Med   float64
+	Pct95 float64
+	Max   float64
+	Pct   map[string]float64 // extra percentiles, keyed on percentile, e.g. "99"
+}
+
+// A sinkBatch is what a sink sends at once: a payload of n lines or points.
+type sinkBatch struct {
+	data []byte
+	n    uint
+}
+
+// A sinkWriter makes and sends batches for a sink.  It's only used by the
+// sink goroutine.
+type sinkWriter interface {
+	// batches returns the batches to send for the stats of a report at ts.
+	batches(ts time.Time, stats []InstanceMetricStats) []sinkBatch
+
+	// write sends the batch.  If there's an error, retry is whether retrying
+	// can succeed, and sent is how many lines or points were accepted anyway.
+	write(batch sinkBatch) (sent uint, retry bool, err error)
+
+	// close closes connections when the sink stops.
+	close()
+}
+
+type sink struct {
+	name   string // e.g. Graphite
+	unit   string // lines or points
+	logger *pct.Logger
+	writer sinkWriter
+	// --
+	reportChan chan MetricReport
+	backoff    *pct.Backoff
+	sync       *pct.SyncChan
+	status     *pct.Status
+	statusName string      // e.g. data-graphite
+	mux        *sync.Mutex // guards the counts, see update
+	sent       uint
+	dropped    uint // lines or points rejected
+	full       uint // reports dropped because the queue is full
+	running    bool
+}
+
+func newSink(name, unit string, logger *pct.Logger, writer sinkWriter) *sink {
+	statusName := "data-" + strings.ToLower(name)
+	s := &sink{
+		name:   name,
+		unit:   unit,
+		logger: logger,
+		writer: writer,
+		// --
+		reportChan: make(chan MetricReport, SINK_QUEUE),
+		backoff:    pct.NewBackoff(time.Minute),
+		sync:       pct.NewSyncChan(),
+		status:     pct.NewStatus([]string{statusName}),
+		statusName: statusName,
+		mux:        &sync.Mutex{},
+	}
+	return s
+}
+
+// start starts sending to the destination, e.g. host:port.
+func (s *sink) start(dest string) error {
+	if s.running {
+		return pct.ServiceIsRunningError{Service: s.statusName}
+	}
+	s.status.Update(s.statusName, "Sending to "+dest)
+	go s.run()
+	s.running = true
+	s.logger.Info("Sending metrics to " + s.name + " at " + dest)
+	return nil
+}
+
+func (s *sink) Stop() {
+	if !s.running {
+		return
+	}
+	s.sync.Stop()
+	s.sync.Wait()
+	s.running = false
+	s.logger.Info("Stopped sending metrics to " + s.name)
+}
+
+func (s *sink) Status() map[string]string {
+	return s.status.All()
+}
+
+// Write queues an mm report to be sent.  Other data is ignored.  It's called
+// by the spooler and must not block.
+func (s *sink) Write(service string, data interface{}) {
+	if service != "mm" {
+		return
+	}
+	report, ok := data.(MetricReport)
+	if !ok {
+		return
+	}
+	select {
+	case s.reportChan <- report:
+	default:
+		s.logger.Debug(s.name + " queue full, dropped mm report")
+		s.update(s.name+" queue full, dropping reports", 0, 0, 1)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+// update updates the status and the counts.  It's called by Write and run,
+// so the counts are guarded by s.mux.
+func (s *sink) update(msg string, sent, dropped, full uint) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sent += sent
+	s.dropped += dropped
+	s.full += full
+	status := fmt.Sprintf("%s (%d %s sent, %d dropped", msg, s.sent, s.unit, s.dropped)
+	if s.full > 0 {
+		status += fmt.Sprintf(", %d reports dropped", s.full)
+	}
+	s.status.Update(s.statusName, status+")")
+}
+
+func (s *sink) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logger.Error(s.name+" sender crashed: ", err)
+		}
+		s.writer.close()
+		s.status.Update(s.statusName, "Stopped")
+		s.sync.Done()
+	}()
+	for {
+		select {
+		case report := <-s.reportChan:
+			ts, stats := report.MetricStats()
+			for _, batch := range s.writer.batches(ts, stats) {
+				if !s.send(batch) {
+					return // stopped while retrying
+				}
+			}
+		case <-s.sync.StopChan:
+			return
+		}
+	}
+}
+
+// send sends the batch, retrying with backoff until it's sent or rejected.
+// It returns false if stopped while waiting to retry.
+func (s *sink) send(batch sinkBatch) bool {
+	for {
+		sent, retry, err := s.writer.write(batch)
+		if err == nil {
+			s.backoff.Success()
+			s.update("Sending", batch.n, 0, 0)
+			return true
+		}
+		if !retry {
+			s.logger.Warn(s.name+" rejected", batch.n-sent, s.unit+":", err)
+			s.update("Error: "+err.Error(), sent, batch.n-sent, 0)
+			return true
+		}
+		wait := s.backoff.Wait()
+		s.logger.Debug(err)
+		s.update(fmt.Sprintf("Error: %s, retry in %s", err, wait), 0, 0, 0)
+		select {
+		case <-time.After(wait):
+		case <-s.sync.StopChan:
+			return false
+		}
+	}
+}
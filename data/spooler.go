@@ -18,11 +18,14 @@
 package data
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,6 +38,36 @@ import (
 
 var ErrSpoolTimeout = errors.New("Timeout spooling data")
 
+/**
+ * When the agent is offline for a long time the spool fills up.  With a quota
+ * (Config.Quota), files are evicted as soon as the spool is over quota instead
+ * of at the next purge, and by priority: oldest files of low priority services
+ * first.  Metrics are reported every minute and one more or less is a gap in
+ * a graph, but every QAN report has queries that aren't in any other report.
+ * Services not listed have DEFAULT_SPOOL_PRIORITY.  Status reports per service
+ * the bytes in the spool, and the bytes evicted (quota) and purged (limits,
+ * see purge()) since the agent started.
+ */
+var SpoolPriority = map[string]int{
+	"mm":        0,
+	"sysconfig": 0, // the next one has the same data
+}
+
+const DEFAULT_SPOOL_PRIORITY = 1 // qan, log, etc.
+
+/**
+ * Data files are named service_nanoUnixTs, or service_nanoUnixTs_uuid if the
+ * data is from one instance: a report that embeds proto.ServiceInstance, like
+ * a QAN report, e.g. qan_1414012345000000000_<UUID of mysql-1>.  The UUID,
+ * not the instance id, because ids are reused, see instance.Repo.  When an
+ * instance is removed, PurgeInstance moves its files to the trash and drops
+ * its data still waiting to be spooled, so data for an instance that no
+ * longer exists isn't sent, or kept, forever.  mm reports have many
+ * instances, so they're not named for any.
+ */
+
+const PURGE_INSTANCE_TIMEOUT = 5 * time.Second // waiting for run() to spool
+
 type Spooler interface {
 	Start(Serializer) error
 	Stop() error
@@ -48,6 +81,51 @@ type Spooler interface {
 	Purge(time.Time, proto.DataSpoolLimits) (int, map[string][]string)
 }
 
+// QuotaSpooler is a Spooler that evicts data over a quota, see SpoolPriority.
+type QuotaSpooler interface {
+	Spooler
+	SetQuota(bytes uint64)
+}
+
+// A Tap gets every report queued by a spooler, once, e.g. a Mirror.  Write
+// must not block.
+type Tap interface {
+	Write(service string, data interface{})
+}
+
+// TappedSpooler is a Spooler that writes reports to taps too.
+type TappedSpooler interface {
+	Spooler
+	SetTap(name string, tap Tap) // nil removes the tap
+}
+
+// QueueSpooler is a Spooler that reports how much data is waiting, e.g. for
+// agent self-metrics.
+type QueueSpooler interface {
+	Spooler
+	Queued() (reports int, files uint) // waiting to be written, to be sent
+}
+
+// SizeSpooler is a Spooler that reports the bytes of its files, e.g. for
+// the sender to hold files for a batch.
+type SizeSpooler interface {
+	Spooler
+	Size() uint64
+}
+
+// InstanceSpooler is a Spooler that can purge the data of one instance.
+type InstanceSpooler interface {
+	Spooler
+	SetInstanceUUID(uuid func(service string, id uint) string) // e.g. instance.Repo.UUID
+	PurgeInstance(uuid string) (files int, bytes uint64)
+}
+
+// spoolData is data written, waiting to be spooled.
+type spoolData struct {
+	data     *proto.Data
+	instance string // UUID, or "" if not from one instance
+}
+
 // http://godoc.org/github.com/peterbourgon/diskv
 type DiskvSpooler struct {
 	logger   *pct.Logger
@@ -57,7 +135,7 @@ type DiskvSpooler struct {
 	limits   proto.DataSpoolLimits
 	// --
 	sz           Serializer
-	dataChan     chan *proto.Data
+	dataChan     chan spoolData
 	sync         *pct.SyncChan
 	cache        *diskv.Diskv
 	status       *pct.Status
@@ -69,6 +147,19 @@ type DiskvSpooler struct {
 	fileSize     map[string]int
 	cancelChan   chan struct{}
 	purgeChan    chan time.Time
+	quota        uint64
+	spooled      map[string]uint64 // bytes in the spool, keyed on service
+	evicted      map[string]uint64 // bytes, keyed on service
+	purgedBytes  map[string]uint64 // bytes, keyed on service
+	aead         cipher.AEAD       // nil if no key, see crypt.go
+	encrypt      bool
+	instanceUUID func(service string, id uint) string
+	purged       map[string]bool // instance UUIDs
+	barrier      chan chan struct{}
+	// --
+	taps    map[string]Tap // keyed on name, e.g. "mirror"
+	tapsMux *sync.Mutex
+	ledger  *Ledger // nil if none
 }
 
 func NewDiskvSpooler(logger *pct.Logger, dataDir, trashDir, hostname string, limits proto.DataSpoolLimits) *DiskvSpooler {
@@ -79,11 +170,19 @@ func NewDiskvSpooler(logger *pct.Logger, dataDir, trashDir, hostname string, lim
 		hostname: hostname,
 		limits:   limits,
 		// --
-		dataChan: make(chan *proto.Data, DEFAULT_DATA_MAX_FILES),
-		sync:     pct.NewSyncChan(),
-		status:   pct.NewStatus([]string{"data-spooler", "data-spooler-count", "data-spooler-size", "data-spooler-oldest"}),
-		mux:      new(sync.Mutex),
-		fileSize: make(map[string]int),
+		dataChan:    make(chan spoolData, DEFAULT_DATA_MAX_FILES),
+		barrier:     make(chan chan struct{}),
+		sync:        pct.NewSyncChan(),
+		status:      pct.NewStatus([]string{"data-spooler", "data-spooler-count", "data-spooler-size", "data-spooler-oldest"}),
+		mux:         new(sync.Mutex),
+		fileSize:    make(map[string]int),
+		spooled:     make(map[string]uint64),
+		evicted:     make(map[string]uint64),
+		purged:      make(map[string]bool),
+		purgedBytes: make(map[string]uint64),
+		// --
+		taps:    make(map[string]Tap),
+		tapsMux: new(sync.Mutex),
 	}
 	return s
 }
@@ -143,10 +242,81 @@ func (s *DiskvSpooler) Status() map[string]string {
 	s.status.Update("data-spooler-count", fmt.Sprintf("%d", s.count))
 	s.status.Update("data-spooler-size", pct.Bytes(s.size))
 	s.status.Update("data-spooler-oldest", fmt.Sprintf("%s", time.Unix(0, s.oldest).UTC()))
-	return s.status.All()
+	services := make(map[string]string)
+	for _, m := range []map[string]uint64{s.spooled, s.evicted, s.purgedBytes} {
+		for service := range m {
+			services["data-spooler-"+service] = fmt.Sprintf("%s spooled, %s evicted, %s purged",
+				pct.Bytes(s.spooled[service]), pct.Bytes(s.evicted[service]), pct.Bytes(s.purgedBytes[service]))
+		}
+	}
+	return s.status.Merge(services)
+}
+
+// Queued returns the number of reports waiting to be written to disk and the
+// number of files spooled and not yet sent.
+func (s *DiskvSpooler) Queued() (int, uint) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.dataChan), s.count
+}
+
+// Size returns the bytes of the files in the spool.
+func (s *DiskvSpooler) Size() uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.size
+}
+
+// SetQuota sets the max bytes of spooled data, or no quota if zero.  If the
+// spool is over quota, files are evicted by SpoolPriority.
+func (s *DiskvSpooler) SetQuota(quota uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.quota = quota
+	if s.quota > 0 && s.size > s.quota && s.cache != nil {
+		s.evict()
+	}
+}
+
+// SetEncryption sets the key to decrypt spool files, or no key if nil, and
+// whether to encrypt new spool files, see crypt.go.
+func (s *DiskvSpooler) SetEncryption(key []byte, encrypt bool) error {
+	if encrypt && key == nil {
+		return errors.New("Spool encryption requires a key")
+	}
+	var aead cipher.AEAD
+	if key != nil {
+		var err error
+		if aead, err = newSpoolCipher(key); err != nil {
+			return err
+		}
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.aead = aead
+	s.encrypt = encrypt
+	return nil
+}
+
+// SetTap sets the named tap to write reports to, or removes it if tap is nil.
+func (s *DiskvSpooler) SetTap(name string, tap Tap) {
+	s.tapsMux.Lock()
+	defer s.tapsMux.Unlock()
+	if tap == nil {
+		delete(s.taps, name)
+	} else {
+		s.taps[name] = tap
+	}
+}
+
+// SetLedger sets the ledger to account spooled data in.  Call it before Start.
+func (s *DiskvSpooler) SetLedger(ledger *Ledger) {
+	s.ledger = ledger
 }
 
 func (s *DiskvSpooler) Write(service string, data interface{}) error {
+	instance := s.dataInstance(data)
+
 	/**
 	 * This method is shared: multiple goroutines call it to write data.
 	 * If the data serializer (sz) is not concurrent, then we serialize
@@ -172,20 +342,42 @@ func (s *DiskvSpooler) Write(service string, data interface{}) error {
 		Created:         time.Now().UTC(),
 		Hostname:        s.hostname,
 		Service:         service,
-		ContentType:     "application/json",
+		ContentType:     s.sz.ContentType(),
 		ContentEncoding: s.sz.Encoding(),
 		Data:            encodedData,
 	}
 
 	// Write data to disk.
 	select {
-	case s.dataChan <- protoData:
+	case s.dataChan <- spoolData{protoData, instance}:
 	case <-time.After(100 * time.Millisecond):
 		// Let caller decide what to do.
 		s.logger.Debug("write:timeout")
 		return ErrSpoolTimeout
 	}
 
+	if s.ledger != nil {
+		raw := len(encodedData)
+		if rs, ok := s.sz.(RawSizer); ok {
+			raw = rs.RawSize()
+		}
+		s.ledger.Add(service, protoData.Created, LedgerEntry{Docs: 1, RawBytes: uint64(raw)})
+	}
+
+	// Tap the data only once it's queued, else a report the caller retries
+	// after ErrSpoolTimeout is tapped again.  Taps don't block.  The taps
+	// have their own mutex because mux is held while writing if the sz
+	// isn't concurrent.
+	s.tapsMux.Lock()
+	taps := make([]Tap, 0, len(s.taps))
+	for _, tap := range s.taps {
+		taps = append(taps, tap)
+	}
+	s.tapsMux.Unlock()
+	for _, tap := range taps {
+		tap.Write(service, data)
+	}
+
 	return nil
 }
 
@@ -204,7 +396,18 @@ func (s *DiskvSpooler) Read(file string) ([]byte, error) {
 	bytes, err := s.cache.Read(file)
 	// Cache file size because we expect caller to call Remove() next.
 	s.fileSize[file] = len(bytes)
-	return bytes, err
+	if err != nil || !IsEncryptedSpoolFile(bytes) {
+		return bytes, err
+	}
+	s.mux.Lock()
+	aead := s.aead
+	s.mux.Unlock()
+	plain, err := DecryptSpoolFile(aead, bytes)
+	if err != nil {
+		s.logger.Warn(file + ": " + err.Error())
+		return bytes, nil // DecodeSpoolFile rejects it
+	}
+	return plain, nil
 }
 
 func (s *DiskvSpooler) Remove(file string) error {
@@ -225,6 +428,56 @@ func (s *DiskvSpooler) Reject(file string) error {
 	return nil
 }
 
+// SetInstanceUUID sets the func that returns the UUID of an instance, or ""
+// if it's unknown, to name the data files of the instance.  Without it, data
+// files aren't named for any instance.
+func (s *DiskvSpooler) SetInstanceUUID(uuid func(service string, id uint) string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.instanceUUID = uuid
+}
+
+// PurgeInstance moves the data files of the instance to the trash like
+// rejected files, and returns how many and their size.  Data of the instance
+// waiting to be spooled, or written later, is dropped.
+func (s *DiskvSpooler) PurgeInstance(uuid string) (int, uint64) {
+	if uuid == "" {
+		return 0, 0
+	}
+	s.mux.Lock()
+	s.purged[uuid] = true
+	s.mux.Unlock()
+
+	// Wait for run() to finish spooling what it has, which may be data of
+	// the instance.  It drops the data of the instance after that.
+	done := make(chan struct{})
+	select {
+	case s.barrier <- done:
+		<-done
+	case <-time.After(PURGE_INSTANCE_TIMEOUT):
+		s.logger.Warn("Timeout waiting for the spooler to purge instance " + uuid)
+	}
+
+	n := 0
+	bytes := uint64(0)
+	for key := range s.cache.Keys(nil) {
+		if s.instance(key) != uuid {
+			continue
+		}
+		info, err := os.Stat(path.Join(s.dataDir, key))
+		if err != nil {
+			continue // sent
+		}
+		if err := s.Reject(key); err != nil {
+			s.logger.Warn("Cannot purge", key, ":", err)
+			continue
+		}
+		n++
+		bytes += uint64(info.Size())
+	}
+	return n, bytes
+}
+
 func (s *DiskvSpooler) Purge(now time.Time, limits proto.DataSpoolLimits) (int, map[string][]string) {
 	return s.purge(now, limits)
 }
@@ -264,9 +517,20 @@ func (s *DiskvSpooler) run() {
 	for {
 		s.status.Update("data-spooler", "Idle")
 		select {
-		case protoData := <-s.dataChan:
+		case d := <-s.dataChan:
+			protoData := d.data
 			ts := protoData.Created.UnixNano()
 			key := fmt.Sprintf("%s_%d", protoData.Service, ts)
+			if d.instance != "" {
+				s.mux.Lock()
+				purged := s.purged[d.instance]
+				s.mux.Unlock()
+				if purged {
+					s.logger.Debug("run:purged:" + key)
+					continue
+				}
+				key += "_" + d.instance
+			}
 			s.logger.Debug("run:spool:" + key)
 			s.status.Update("data-spooler", "Spooling "+key)
 
@@ -275,18 +539,36 @@ func (s *DiskvSpooler) run() {
 				s.logger.Error(err)
 				continue
 			}
+			bytes = EncodeSpoolFile(bytes)
+			s.mux.Lock()
+			aead, encrypt := s.aead, s.encrypt
+			s.mux.Unlock()
+			if encrypt {
+				if bytes, err = EncryptSpoolFile(aead, bytes); err != nil {
+					s.logger.Error(err)
+					continue
+				}
+			}
 
 			if err := s.cache.Write(key, bytes); err != nil {
 				s.logger.Error(err)
+			} else if s.ledger != nil {
+				s.ledger.Add(protoData.Service, protoData.Created, LedgerEntry{SpooledBytes: uint64(len(bytes))})
 			}
 
 			s.mux.Lock()
 			s.count++
 			s.size += uint64(len(bytes))
+			s.spooled[protoData.Service] += uint64(len(bytes))
 			if ts < s.oldest {
 				s.oldest = ts
 			}
+			if s.quota > 0 && s.size > s.quota {
+				s.evict()
+			}
 			s.mux.Unlock()
+		case done := <-s.barrier:
+			close(done) // nothing being spooled, see PurgeInstance
 		case <-purgeChan:
 			n, removed := s.purge(time.Now().UTC(), s.limits)
 			if n == 0 {
@@ -318,8 +600,8 @@ func (s *DiskvSpooler) run() {
 }
 
 func (*DiskvSpooler) ts(key string) (int64, error) {
-	parts := strings.Split(key, "_") // service_nanoUnixTs
-	if len(parts) != 2 {
+	parts := strings.Split(key, "_") // service_nanoUnixTs[_instance]
+	if len(parts) != 2 && len(parts) != 3 {
 		return 0, fmt.Errorf("Invalid data file name: '%s'", key)
 	}
 	ts, err := strconv.ParseInt(parts[1], 10, 64)
@@ -329,6 +611,48 @@ func (*DiskvSpooler) ts(key string) (int64, error) {
 	return ts, nil
 }
 
+// service returns the service of a valid data file name, see ts().
+func (*DiskvSpooler) service(key string) string {
+	return key[0:strings.Index(key, "_")]
+}
+
+// instance returns the instance of a valid data file name, or "" if none.
+func (*DiskvSpooler) instance(key string) string {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+// dataInstance returns the instance UUID of data that embeds
+// proto.ServiceInstance, see SetInstanceUUID, else "".
+func (s *DiskvSpooler) dataInstance(data interface{}) string {
+	s.mux.Lock()
+	instanceUUID := s.instanceUUID
+	s.mux.Unlock()
+	if instanceUUID == nil {
+		return ""
+	}
+	v := reflect.Indirect(reflect.ValueOf(data))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName("ServiceInstance")
+	if !f.IsValid() {
+		return ""
+	}
+	si, ok := f.Interface().(proto.ServiceInstance)
+	if !ok || si.Service == "" || si.InstanceId == 0 {
+		return ""
+	}
+	uuid := instanceUUID(si.Service, si.InstanceId)
+	if strings.Contains(uuid, "_") {
+		return ""
+	}
+	return uuid
+}
+
 func (s *DiskvSpooler) purge(now time.Time, limits proto.DataSpoolLimits) (int, map[string][]string) {
 	s.logger.Debug("purge:call")
 	defer s.logger.Debug("purge:return")
@@ -385,19 +709,63 @@ func (s *DiskvSpooler) purge(now time.Time, limits proto.DataSpoolLimits) (int,
 		} else {
 			continue // keep file
 		}
+		size := s.size
 		s.remove(file, false) // false=we've already locked mux
+		s.purgedBytes[s.service(file)] += size - s.size
 		n++
 	}
 
 	return n, removed
 }
 
+// evict removes files until the spool is within the quota: files of low
+// priority services first, oldest first.  The file just spooled can be
+// evicted if all others have higher priority.
+func (s *DiskvSpooler) evict() {
+	//
+	// XXX Caller must guard with mux!
+	//
+	files := spoolFiles{}
+	for key := range s.cache.Keys(nil) {
+		ts, err := s.ts(key)
+		if err != nil {
+			continue // purge removes it
+		}
+		service := s.service(key)
+		priority, ok := SpoolPriority[service]
+		if !ok {
+			priority = DEFAULT_SPOOL_PRIORITY
+		}
+		files = append(files, spoolFile{key, service, priority, ts})
+	}
+	sort.Sort(files)
+
+	n := 0
+	bytes := uint64(0)
+	for _, f := range files {
+		if s.size <= s.quota {
+			break
+		}
+		size := s.size
+		if err := s.remove(f.key, false); err != nil { // false=caller locked mux
+			s.logger.Warn("Cannot evict", f.key, ":", err)
+			continue
+		}
+		s.evicted[f.service] += size - s.size
+		bytes += size - s.size
+		n++
+	}
+	s.logger.Warn(fmt.Sprintf("Evicted %d data files (%s) to keep the spool under the %s quota",
+		n, pct.Bytes(bytes), pct.Bytes(s.quota)))
+}
+
 func (s *DiskvSpooler) updateStats() {
 	//
 	// XXX Caller must guard with mux!
 	//
 	s.count = 0
 	s.size = 0
+	s.spooled = make(map[string]uint64)
 	s.oldest = time.Now().UTC().UnixNano()
 	for key := range s.Files() {
 		data, err := s.cache.Read(key)
@@ -417,14 +785,18 @@ func (s *DiskvSpooler) updateStats() {
 		}
 		s.count++
 		s.size += uint64(len(data))
+		s.spooled[s.service(key)] += uint64(len(data))
 	}
 }
 
 func (s *DiskvSpooler) remove(file string, lock bool) error {
 	size, ok := s.fileSize[file]
 	if !ok {
-		data, _ := s.Read(file)
-		size = len(data)
+		// Not Read(): it locks mux to decrypt, and purge() and evict()
+		// call this with mux locked.
+		if fi, err := os.Stat(path.Join(s.dataDir, file)); err == nil {
+			size = int(fi.Size())
+		}
 	}
 	// Don't lock mutex yet in case this takes awhile (it shouldn't):
 	if err := s.cache.Erase(file); err != nil && !os.IsNotExist(err) {
@@ -436,8 +808,31 @@ func (s *DiskvSpooler) remove(file string, lock bool) error {
 	}
 	s.count--
 	s.size -= uint64(size)
+	if service := s.service(file); s.spooled[service] >= uint64(size) {
+		s.spooled[service] -= uint64(size)
+	} else {
+		s.spooled[service] = 0
+	}
 	if ok {
 		delete(s.fileSize, file)
 	}
 	return nil
 }
+
+type spoolFile struct {
+	key      string
+	service  string
+	priority int
+	ts       int64
+}
+
+type spoolFiles []spoolFile
+
+func (a spoolFiles) Len() int      { return len(a) }
+func (a spoolFiles) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a spoolFiles) Less(i, j int) bool {
+	if a[i].priority != a[j].priority {
+		return a[i].priority < a[j].priority
+	}
+	return a[i].ts < a[j].ts
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Spool files outlive the agent that wrote them: data spooled while the API
+ * is unreachable must still be sent after the agent is upgraded, or
+ * downgraded.  So every spool file starts with a version header line:
+ *
+ *   #percona-agent-spool 3 <SHA-256 of payload, hex>
+ *   {"Created":"...","Service":"mm",...}
+ *
+ * followed by the payload for that version.  Since version 3, the header has
+ * the payload checksum so a file corrupted on disk is rejected, not sent.
+ * Version 1 files, written before there was a header, are the payload alone,
+ * a JSON-encoded proto.Data; they can't start with # so there's no ambiguity.
+ * To change the format, bump SPOOL_VERSION and add a decoder which converts
+ * the previous version's payload to what the sender sends.  Files with a
+ * version newer than this agent knows are rejected (moved to the trash, not
+ * removed) so an upgrade can still send them.
+ */
+
+const (
+	SPOOL_VERSION = 3
+	spoolHeader   = "#percona-agent-spool "
+)
+
+type SpoolVersionError struct {
+	Version int
+}
+
+func (e SpoolVersionError) Error() string {
+	return fmt.Sprintf("spool file version %d is newer than supported version %d", e.Version, SPOOL_VERSION)
+}
+
+type SpoolChecksumError struct {
+	Header  string
+	Payload string
+}
+
+func (e SpoolChecksumError) Error() string {
+	return fmt.Sprintf("spool file checksum %s does not match payload checksum %s", e.Header, e.Payload)
+}
+
+// spoolDecoders convert a payload of each version to the bytes to send.
+var spoolDecoders = map[int]func([]byte) ([]byte, error){
+	1: decodeSpoolV1,
+	2: decodeSpoolV1, // v2 only added the header
+	3: decodeSpoolV1, // v3 only added the checksum to the header
+}
+
+func decodeSpoolV1(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// Checksum returns the hex SHA-256 of the data: the spool file checksum of a
+// payload, and what the API acks for an upload, see Ack.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// EncodeSpoolFile returns the contents of a spool file for the payload.
+func EncodeSpoolFile(payload []byte) []byte {
+	header := spoolHeader + strconv.Itoa(SPOOL_VERSION) + " " + Checksum(payload) + "\n"
+	file := make([]byte, 0, len(header)+len(payload))
+	file = append(file, header...)
+	return append(file, payload...)
+}
+
+// DecodeSpoolFile returns the version of a spool file and the bytes to send.
+// It returns a SpoolVersionError if the version is newer than this agent's,
+// a SpoolChecksumError if the payload doesn't match the header checksum, or
+// ErrSpoolKey if the file is still encrypted, see crypt.go.
+func DecodeSpoolFile(file []byte) (int, []byte, error) {
+	version := 1
+	payload := file
+	checksum := ""
+	if IsEncryptedSpoolFile(file) {
+		return 0, nil, ErrSpoolKey // spooler couldn't decrypt it
+	}
+	if bytes.HasPrefix(file, []byte(spoolHeader)) {
+		eol := bytes.IndexByte(file, '\n')
+		if eol < 0 {
+			return 0, nil, fmt.Errorf("spool file header has no newline")
+		}
+		fields := strings.Fields(string(file[len(spoolHeader):eol]))
+		if len(fields) == 0 {
+			return 0, nil, fmt.Errorf("spool file header has no version")
+		}
+		v, err := strconv.Atoi(fields[0])
+		if err != nil || v < 1 {
+			return 0, nil, fmt.Errorf("invalid spool file version: %q", fields[0])
+		}
+		version = v
+		if len(fields) > 1 {
+			checksum = fields[1]
+		}
+		payload = file[eol+1:]
+	}
+	decode, ok := spoolDecoders[version]
+	if !ok {
+		return version, nil, SpoolVersionError{version}
+	}
+	if version >= 3 {
+		if sum := Checksum(payload); sum != checksum {
+			return version, nil, SpoolChecksumError{Header: checksum, Payload: sum}
+		}
+	}
+	data, err := decode(payload)
+	return version, data, err
+}
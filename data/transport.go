@@ -0,0 +1,39 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package data
+
+/**
+ * A Transport sends data files to the API and receives the API response to
+ * each.  The data websocket client (pct.WebsocketClient) is the primary
+ * transport; client.HTTPSClient is the fallback for networks that block
+ * websockets, see Sender.SetFallback.
+ */
+type Transport interface {
+	ConnectOnce(timeout uint) error
+	DisconnectOnce() error
+	SendBytes(data []byte, timeout uint) error // send proto.Data
+	Recv(data interface{}, timeout uint) error // recv proto.Response
+	Status() map[string]string
+}
+
+// A WireCounter is a Transport that counts the bytes it writes to the network,
+// framing included, so the ledger accounts what's really sent.  For other
+// transports, the ledger accounts the size of the files sent.
+type WireCounter interface {
+	WireBytes() uint64
+}
@@ -29,8 +29,8 @@ if [ "$KERNEL" != "Linux" -a "$KERNEL" != "Darwin" ]; then
 fi
 
 PLATFORM=`uname -m`
-if [ "$PLATFORM" != "x86_64" -a "$PLATFORM" != "i686" -a "$PLATFORM" != "i386" ]; then
-   error "$BIN supports only x86_64 and i686 platforms; detected $PLATFORM"
+if [ "$PLATFORM" != "x86_64" -a "$PLATFORM" != "i686" -a "$PLATFORM" != "i386" -a "$PLATFORM" != "aarch64" ]; then
+   error "$BIN supports only x86_64, i686, and aarch64 platforms; detected $PLATFORM"
 fi
 
 echo "Detected $KERNEL $PLATFORM"
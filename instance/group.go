@@ -0,0 +1,160 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const GROUPS_CONFIG = "groups" // config/groups.conf
+
+/**
+ * Instance groups let one command target many instances, e.g. "all replicas
+ * of cluster X", instead of the API sending the same command once per instance.
+ * Instances are labeled and given a parent locally (the API instances have
+ * neither), then a group selects the instances of one service that have all
+ * its labels and, if set, its parent.  Groups are expanded when a command
+ * runs, so instances added or relabeled later are included.
+ */
+type Group struct {
+	Service string   // of member instances, e.g. "mysql"
+	Labels  []string // members have all these labels
+	Parent  uint     // members have this parent instance ID, 0 = any
+}
+
+type Groups struct {
+	Labels map[string][]string // keyed on instance name, e.g. "mysql-2"
+	Parent map[string]uint     // keyed on instance name, e.g. replica => master ID
+	Group  map[string]Group    // keyed on group name
+}
+
+func (g Groups) Validate() error {
+	for name, group := range g.Group {
+		if _, ok := proto.ExternalService[group.Service]; !ok {
+			return fmt.Errorf("Group %s: invalid service: %s", name, group.Service)
+		}
+		if len(group.Labels) == 0 && group.Parent == 0 {
+			return fmt.Errorf("Group %s: no labels or parent", name)
+		}
+	}
+	return nil
+}
+
+// SetGroups replaces all labels, parents, and groups, and saves them in the
+// config dir.
+func (r *Repo) SetGroups(g Groups) error {
+	r.logger.Debug("SetGroups:call")
+	defer r.logger.Debug("SetGroups:return")
+
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if err := pct.Basedir.WriteConfig(GROUPS_CONFIG, g); err != nil {
+		return err
+	}
+	r.groups = g
+	r.logger.Info(fmt.Sprintf("Set %d groups", len(g.Group)))
+	return nil
+}
+
+func (r *Repo) Groups() Groups {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.groups
+}
+
+// Members returns the service and instance IDs, in ascending order, of the
+// instances in the group.  A group can be empty.
+func (r *Repo) Members(name string) (string, []uint, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	group, ok := r.groups.Group[name]
+	if !ok {
+		return "", nil, errors.New("Unknown group: " + name)
+	}
+
+	ids := instanceIds{}
+	for it, _ := range r.it {
+		service, id, err := splitName(it)
+		if err != nil || service != group.Service {
+			continue
+		}
+		if group.Parent != 0 && r.groups.Parent[it] != group.Parent {
+			continue
+		}
+		if !hasLabels(r.groups.Labels[it], group.Labels) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	return group.Service, ids, nil
+}
+
+func (r *Repo) loadGroups() error {
+	g := Groups{}
+	file := r.configDir + "/" + GROUPS_CONFIG + ".conf"
+	data, err := pct.Basedir.ReadConfigFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &g); err != nil {
+			return errors.New(file + ":" + err.Error())
+		}
+		if err := g.Validate(); err != nil {
+			return errors.New(file + ":" + err.Error())
+		}
+		r.logger.Info("Loaded " + file)
+	}
+	r.mux.Lock()
+	r.groups = g
+	r.mux.Unlock()
+	return nil
+}
+
+func hasLabels(have, want []string) bool {
+WANT:
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				continue WANT
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type instanceIds []uint
+
+func (a instanceIds) Len() int           { return len(a) }
+func (a instanceIds) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a instanceIds) Less(i, j int) bool { return a[i] < a[j] }
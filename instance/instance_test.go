@@ -19,9 +19,11 @@ package instance_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/percona/cloud-protocol/proto/v1"
@@ -151,8 +153,54 @@ func (s *RepoTestSuite) TestAddRemove(t *C) {
 		t.Error(diff)
 	}
 
+	// The instance has a UUID, and keeps it when it's loaded again.
+	uuid := im.UUID("mysql", 1)
+	t.Check(uuid, Matches, `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+	im2 := instance.NewRepo(s.logger, s.configDir, s.api)
+	err = im2.Init()
+	t.Assert(err, IsNil)
+	t.Check(im2.UUID("mysql", 1), Equals, uuid)
+
 	im.Remove("mysql", 1)
 	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+	t.Check(test.FileExists(s.configDir+"/mysql-1.uuid"), Equals, false)
+	t.Check(im.UUID("mysql", 1), Equals, "")
+
+	// Another instance with the same id has another UUID.
+	err = im.Add("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+	t.Check(im.UUID("mysql", 1), Not(Equals), "")
+	t.Check(im.UUID("mysql", 1), Not(Equals), uuid)
+	im.Remove("mysql", 1)
+}
+
+func (s *RepoTestSuite) TestInstances(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	mysqlIt := &proto.MySQLInstance{
+		Id:       1,
+		Hostname: "db1",
+		DSN:      "user:secret@tcp(127.0.0.1:3306)/",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, data, false)
+	t.Assert(err, IsNil)
+	defer im.Remove("mysql", 1)
+
+	// Instances must encode as JSON objects, not base64 strings, else the
+	// admin server can't redact their DSNs.
+	data, err = json.Marshal(im.Instances())
+	t.Assert(err, IsNil)
+	redacted := pct.RedactDSNs(string(data))
+	t.Check(strings.Contains(redacted, "secret"), Equals, false)
+	got := map[string]*proto.MySQLInstance{}
+	err = json.Unmarshal([]byte(redacted), &got)
+	t.Assert(err, IsNil)
+	t.Assert(got["mysql-1"], NotNil)
+	t.Check(got["mysql-1"].Hostname, Equals, "db1")
+	t.Check(got["mysql-1"].DSN, Equals, "user:"+pct.HIDDEN_PASSWORD+"@tcp(127.0.0.1:3306)/")
 }
 
 func (s *RepoTestSuite) TestErrors(t *C) {
@@ -178,6 +226,97 @@ func (s *RepoTestSuite) TestErrors(t *C) {
 	t.Assert(err, NotNil)
 }
 
+func (s *RepoTestSuite) TestGroups(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	for id := uint(1); id <= 4; id++ {
+		data, err := json.Marshal(&proto.MySQLInstance{Id: id, DSN: "user:host@tcp:(127.0.0.1:3306)"})
+		t.Assert(err, IsNil)
+		err = im.Add("mysql", id, data, true)
+		t.Assert(err, IsNil)
+	}
+	data, err := json.Marshal(&proto.ServerInstance{Hostname: "db1"})
+	t.Assert(err, IsNil)
+	err = im.Add("server", 1, data, true)
+	t.Assert(err, IsNil)
+
+	// Cluster X: mysql-1 is the master of replicas mysql-2 and mysql-3.
+	// mysql-4 is a replica of mysql-1 but not in the cluster.
+	groups := instance.Groups{
+		Labels: map[string][]string{
+			"mysql-1":  []string{"cluster-x"},
+			"mysql-2":  []string{"cluster-x", "backup"},
+			"mysql-3":  []string{"cluster-x"},
+			"server-1": []string{"cluster-x"},
+		},
+		Parent: map[string]uint{
+			"mysql-2": 1,
+			"mysql-3": 1,
+			"mysql-4": 1,
+		},
+		Group: map[string]instance.Group{
+			"cluster-x":          {Service: "mysql", Labels: []string{"cluster-x"}},
+			"cluster-x-replicas": {Service: "mysql", Labels: []string{"cluster-x"}, Parent: 1},
+			"cluster-x-backup":   {Service: "mysql", Labels: []string{"cluster-x", "backup"}},
+			"replicas-of-1":      {Service: "mysql", Parent: 1},
+			"servers":            {Service: "server", Labels: []string{"cluster-x"}},
+			"nobody":             {Service: "mysql", Labels: []string{"foo"}},
+		},
+	}
+	err = im.SetGroups(groups)
+	t.Assert(err, IsNil)
+	t.Check(test.FileExists(s.configDir+"/groups.conf"), Equals, true)
+
+	expect := map[string][]uint{
+		"cluster-x":          []uint{1, 2, 3},
+		"cluster-x-replicas": []uint{2, 3},
+		"cluster-x-backup":   []uint{2},
+		"replicas-of-1":      []uint{2, 3, 4},
+		"servers":            []uint{1},
+		"nobody":             []uint{},
+	}
+	for name, ids := range expect {
+		service, got, err := im.Members(name)
+		t.Check(err, IsNil)
+		t.Check(service, Equals, groups.Group[name].Service)
+		t.Check(got, DeepEquals, ids, Commentf(name))
+	}
+
+	_, _, err = im.Members("foo")
+	t.Check(err, NotNil)
+
+	// Groups are loaded on init.
+	im = instance.NewRepo(s.logger, s.configDir, s.api)
+	err = im.Init()
+	t.Assert(err, IsNil)
+	service, got, err := im.Members("cluster-x-replicas")
+	t.Check(err, IsNil)
+	t.Check(service, Equals, "mysql")
+	t.Check(got, DeepEquals, []uint{2, 3})
+
+	// A group must have a valid service and labels or a parent.
+	err = im.SetGroups(instance.Groups{Group: map[string]instance.Group{"x": {Service: "foo", Parent: 1}}})
+	t.Check(err, NotNil)
+	err = im.SetGroups(instance.Groups{Group: map[string]instance.Group{"x": {Service: "mysql"}}})
+	t.Check(err, NotNil)
+	t.Check(im.Groups().Group, HasLen, len(groups.Group))
+
+	// groups.conf can have ${NAME} variables like other config files.
+	os.Setenv("PCT_TEST_GROUP_SERVICE", "mysql")
+	defer os.Unsetenv("PCT_TEST_GROUP_SERVICE")
+	err = ioutil.WriteFile(s.configDir+"/groups.conf",
+		[]byte(`{"Parent":{"mysql-2":1},"Group":{"replicas-of-1":{"Service":"${PCT_TEST_GROUP_SERVICE}","Parent":1}}}`), 0600)
+	t.Assert(err, IsNil)
+	im = instance.NewRepo(s.logger, s.configDir, s.api)
+	err = im.Init()
+	t.Assert(err, IsNil)
+	service, got, err = im.Members("replicas-of-1")
+	t.Check(err, IsNil)
+	t.Check(service, Equals, "mysql")
+	t.Check(got, DeepEquals, []uint{2})
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Manager test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -338,3 +477,48 @@ func (s *ManagerTestSuite) TestHandleAdd(t *C) {
 	t.Assert(len(is), Equals, 1)
 	t.Assert(is[0].Id, Equals, uint(9))
 }
+
+func (s *ManagerTestSuite) TestHandleRemove(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm)
+	t.Assert(m, NotNil)
+
+	purged := []string{}
+	uuids := []string{}
+	m.AddRemoveHook(func(service string, id uint, uuid string) ([]string, error) {
+		purged = append(purged, fmt.Sprintf("%s-%d", service, id))
+		uuids = append(uuids, uuid)
+		return []string{"3 data files"}, nil
+	})
+	m.AddRemoveHook(func(service string, id uint, uuid string) ([]string, error) {
+		return nil, nil // nothing to remove
+	})
+
+	serverData, err := json.Marshal(&proto.ServerInstance{Hostname: "host1"})
+	t.Assert(err, IsNil)
+	serviceData, err := json.Marshal(&proto.ServiceInstance{
+		Service:    "server",
+		InstanceId: 3,
+		Instance:   serverData,
+	})
+	t.Assert(err, IsNil)
+	reply := m.Handle(&proto.Cmd{Cmd: "Add", Service: "instance", Data: serviceData})
+	t.Assert(reply.Error, Equals, "")
+
+	// Hooks are called after the instance is removed, and the reply is
+	// what they removed.
+	reply = m.Handle(&proto.Cmd{Cmd: "Remove", Service: "instance", Data: serviceData})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(purged, DeepEquals, []string{"server-3"})
+	t.Assert(uuids, HasLen, 1)
+	t.Check(uuids[0], Not(Equals), "")
+	removed := []string{}
+	err = json.Unmarshal(reply.Data, &removed)
+	t.Assert(err, IsNil)
+	t.Check(removed, DeepEquals, []string{"3 data files"})
+
+	// Hooks aren't called if the instance isn't removed.
+	reply = m.Handle(&proto.Cmd{Cmd: "Remove", Service: "instance", Data: serviceData})
+	t.Check(reply.Error, Not(Equals), "")
+	t.Check(purged, HasLen, 1)
+}
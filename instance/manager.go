@@ -22,6 +22,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/percona/percona-agent/agent"
 
@@ -35,6 +37,14 @@ import (
 
 type empty struct{}
 
+const DEFAULT_LIMIT_RETRY_INTERVAL = 15 * time.Minute
+
+// A RemoveHook is called after an instance is removed from the repo to purge
+// or archive what the agent has for it: spooled data, tool state, etc.  uuid
+// is the instance UUID, see Repo.UUID.  It returns what it removed, e.g.
+// "3 data files (1.2 MB)", if anything.
+type RemoveHook func(service string, id uint, uuid string) ([]string, error)
+
 type Manager struct {
 	logger    *pct.Logger
 	configDir string
@@ -47,6 +57,10 @@ type Manager struct {
 	mrmChans       map[string]<-chan bool
 	mrmsGlobalChan chan string
 	agentConfig    *agent.Config
+	limited        map[uint]*proto.MySQLInstance // not updated due to API limit
+	limitMux       *sync.Mutex
+	limitRetry     time.Duration
+	removeHooks    []RemoveHook
 }
 
 func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm mrms.Monitor) *Manager {
@@ -56,11 +70,14 @@ func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm
 		configDir: configDir,
 		api:       api,
 		// --
-		status:         pct.NewStatus([]string{"instance", "instance-repo", "instance-mrms"}),
+		status:         pct.NewStatus([]string{"instance", "instance-repo", "instance-mrms", "instance-limit"}),
 		repo:           repo,
 		mrm:            mrm,
 		mrmChans:       make(map[string]<-chan bool),
 		mrmsGlobalChan: make(chan string, 100), // monitor up to 100 instances
+		limited:        make(map[uint]*proto.MySQLInstance),
+		limitMux:       new(sync.Mutex),
+		limitRetry:     DEFAULT_LIMIT_RETRY_INTERVAL,
 	}
 	return m
 }
@@ -89,14 +106,16 @@ func (m *Manager) Start() error {
 			m.logger.Error("Cannot add instance to the monitor:", err)
 			continue
 		}
-		safeDSN := mysql.HideDSNPassword(instance.DSN)
+		safeDSN := pct.RedactDSN(instance.DSN)
 		m.status.Update("instance", "Getting info "+safeDSN)
 		if err := GetMySQLInfo(instance); err != nil {
 			m.logger.Warn(fmt.Sprintf("Failed to get MySQL info %s: %s", safeDSN, err))
 			continue
 		}
 		m.status.Update("instance", "Updating info "+safeDSN)
-		m.pushInstanceInfo(instance)
+		if err := m.updateInstanceInfo(instance); err != nil {
+			m.logger.Warn(err)
+		}
 		// Store the channel to be able to remove it from mrms
 		m.mrmChans[instance.DSN] = ch
 	}
@@ -115,6 +134,18 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.status.UpdateRe("instance", "Handling", cmd)
 	defer m.status.Update("instance", "Running")
 
+	// Group cmds don't have a service instance.
+	switch cmd.Cmd {
+	case "SetGroups":
+		g := Groups{}
+		if err := json.Unmarshal(cmd.Data, &g); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		return cmd.Reply(nil, m.repo.SetGroups(g))
+	case "GetGroups":
+		return cmd.Reply(m.repo.Groups())
+	}
+
 	it := &proto.ServiceInstance{}
 	if err := json.Unmarshal(cmd.Data, it); err != nil {
 		return cmd.Reply(nil, err)
@@ -144,7 +175,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			}
 			m.mrmChans[iit.DSN] = ch
 
-			safeDSN := mysql.HideDSNPassword(iit.DSN)
+			safeDSN := pct.RedactDSN(iit.DSN)
 			m.status.Update("instance", "Getting info "+safeDSN)
 			if err := GetMySQLInfo(iit); err != nil {
 				m.logger.Warn(fmt.Sprintf("Failed to get MySQL info %s: %s", safeDSN, err))
@@ -152,7 +183,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			}
 
 			m.status.Update("instance", "Updating info "+safeDSN)
-			err = m.pushInstanceInfo(iit)
+			err = m.updateInstanceInfo(iit)
 			if err != nil {
 				m.logger.Error(err)
 				return cmd.Reply(nil, nil)
@@ -172,8 +203,12 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 				m.mrm.Remove(iit.DSN, m.mrmChans[iit.DSN])
 			}
 		}
-		err := m.repo.Remove(it.Service, it.InstanceId)
-		return cmd.Reply(nil, err)
+		uuid := m.repo.UUID(it.Service, it.InstanceId)
+		if err := m.repo.Remove(it.Service, it.InstanceId); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		removed := m.purge(it.Service, it.InstanceId, uuid)
+		return cmd.Reply(removed)
 	case "GetInfo":
 		info, err := m.handleGetInfo(it.Service, it.Instance)
 		return cmd.Reply(info, err)
@@ -182,6 +217,12 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	}
 }
 
+// AddRemoveHook adds a hook called when an instance is removed.  Hooks aren't
+// guarded, so add them before the agent handles cmds.
+func (m *Manager) AddRemoveHook(hook RemoveHook) {
+	m.removeHooks = append(m.removeHooks, hook)
+}
+
 func (m *Manager) Status() map[string]string {
 	m.status.Update("instance-repo", strings.Join(m.repo.List(), " "))
 	return m.status.All()
@@ -191,6 +232,16 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return nil, nil
 }
 
+// Members implements agent.InstanceGroups.
+func (m *Manager) Members(group string) (string, []uint, error) {
+	return m.repo.Members(group)
+}
+
+// Instances implements agent.InstanceLister.
+func (m *Manager) Instances() map[string]*json.RawMessage {
+	return m.repo.Instances()
+}
+
 func (m *Manager) Repo() *Repo {
 	return m.repo
 }
@@ -285,11 +336,16 @@ func (m *Manager) monitorInstancesRestart(ch chan string) {
 		return
 	}
 
+	// Instances not updated because of an API limit are retried periodically
+	// because the limit can be raised, or other instances removed, any time.
+	retryTicker := time.NewTicker(m.limitRetry)
+	defer retryTicker.Stop()
+
 	for {
 		m.status.Update("instance-mrms", "Idle")
 		select {
 		case dsn := <-ch:
-			safeDSN := mysql.HideDSNPassword(dsn)
+			safeDSN := pct.RedactDSN(dsn)
 			m.logger.Debug("mrms:restart:" + safeDSN)
 			m.status.Update("instance-mrms", "Updating "+safeDSN)
 
@@ -305,12 +361,14 @@ func (m *Manager) monitorInstancesRestart(ch chan string) {
 					break
 				}
 				m.status.Update("instance-mrms", "Updating info "+safeDSN)
-				err := m.pushInstanceInfo(instance)
+				err := m.updateInstanceInfo(instance)
 				if err != nil {
 					m.logger.Warn(err)
 				}
 				break
 			}
+		case <-retryTicker.C:
+			m.retryLimited()
 		}
 	}
 }
@@ -332,8 +390,87 @@ func (m *Manager) pushInstanceInfo(instance *proto.MySQLInstance) error {
 	if body == nil {
 		body = []byte{}
 	}
+	if resp != nil && resp.StatusCode == 403 {
+		if apiErr := pct.CheckLimitHeaders(resp); apiErr != nil {
+			return apiErr
+		}
+	}
 	if resp != nil && resp.StatusCode != 200 {
 		return fmt.Errorf("Failed to PUT: %d, %s", resp.StatusCode, string(body))
 	}
 	return nil
 }
+
+// updateInstanceInfo pushes the instance info to the API and, if an API limit
+// blocks it, remembers the instance so retryLimited() can push it later.
+func (m *Manager) updateInstanceInfo(instance *proto.MySQLInstance) error {
+	err := m.pushInstanceInfo(instance)
+
+	m.limitMux.Lock()
+	defer m.limitMux.Unlock()
+
+	_, wasLimited := m.limited[instance.Id]
+	if apiErr, ok := err.(*pct.APIError); ok && apiErr.Category == pct.API_ERROR_LIMIT {
+		m.limited[instance.Id] = instance
+		m.status.Update("instance-limit", fmt.Sprintf("%s: MySQL instance %d not updated, retry every %s",
+			apiErr.Err, instance.Id, m.limitRetry))
+		if !wasLimited {
+			// Logged as error so it's visible in the API, not only locally.
+			m.logger.Error(fmt.Sprintf("Cannot update MySQL instance %d: %s", instance.Id, apiErr))
+		}
+		return nil // reported
+	}
+
+	if err == nil && wasLimited {
+		delete(m.limited, instance.Id)
+		m.logger.Info(fmt.Sprintf("Updated MySQL instance %d after API limit", instance.Id))
+		if len(m.limited) == 0 {
+			m.status.Update("instance-limit", "")
+		}
+	}
+	return err
+}
+
+func (m *Manager) retryLimited() {
+	m.limitMux.Lock()
+	instances := make([]*proto.MySQLInstance, 0, len(m.limited))
+	for _, instance := range m.limited {
+		instances = append(instances, instance)
+	}
+	m.limitMux.Unlock()
+
+	for _, instance := range instances {
+		if err := m.updateInstanceInfo(instance); err != nil {
+			m.logger.Warn(err)
+		}
+	}
+}
+
+// purge calls the remove hooks for the removed instance and sends an event
+// summarizing what they removed, which is also the Remove cmd reply.
+func (m *Manager) purge(service string, id uint, uuid string) []string {
+	name := m.repo.Name(service, id)
+	m.status.Update("instance", "Purging "+name)
+	removed := []string{}
+	for _, hook := range m.removeHooks {
+		r, err := hook(service, id, uuid)
+		if err != nil {
+			m.logger.Warn("Cannot purge " + name + ": " + err.Error())
+		}
+		removed = append(removed, r...)
+	}
+	var msg string
+	if len(removed) == 0 {
+		msg = "Removed instance " + name + ", it had no data or state"
+	} else {
+		msg = "Removed instance " + name + " and its " + strings.Join(removed, ", ")
+	}
+	m.logger.Info(msg)
+	pct.SendEvent(pct.Event{
+		Type:    "agent/instance/remove",
+		Level:   pct.EVENT_INFO,
+		Message: msg,
+		Data:    removed,
+	})
+	return removed
+}
@@ -18,6 +18,7 @@
 package instance
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,13 +34,23 @@ import (
 	"sync"
 )
 
+/**
+ * Instance ids are reused: an instance can be removed and another added with
+ * the same id.  So each instance also has a UUID, made by the agent when the
+ * instance is added and saved in <name>.uuid next to its config, to name its
+ * data and state, which must never be mixed up with those of an instance
+ * that had the same id, see data.InstanceSpooler.
+ */
+
 type Repo struct {
 	logger    *pct.Logger
 	configDir string
 	api       pct.APIConnector
 	// --
-	it  map[string]interface{}
-	mux *sync.RWMutex
+	it     map[string]interface{}
+	uuids  map[string]string
+	groups Groups
+	mux    *sync.RWMutex
 }
 
 func NewRepo(logger *pct.Logger, configDir string, api pct.APIConnector) *Repo {
@@ -48,8 +59,9 @@ func NewRepo(logger *pct.Logger, configDir string, api pct.APIConnector) *Repo {
 		configDir: configDir,
 		api:       api,
 		// --
-		it:  make(map[string]interface{}),
-		mux: &sync.RWMutex{},
+		it:    make(map[string]interface{}),
+		uuids: make(map[string]string),
+		mux:   &sync.RWMutex{},
 	}
 	return m
 }
@@ -60,7 +72,7 @@ func (r *Repo) Init() error {
 			return fmt.Errorf("%s: %s", service, err)
 		}
 	}
-	return nil
+	return r.loadGroups()
 }
 
 func (r *Repo) loadInstances(service string) error {
@@ -87,7 +99,7 @@ func (r *Repo) loadInstances(service string) error {
 			return pct.InvalidServiceInstanceError{Service: service, Id: uint(id)}
 		}
 
-		data, err := ioutil.ReadFile(file)
+		data, err := pct.Basedir.ReadConfigFile(file)
 		if err != nil {
 			return errors.New(file + ":" + err.Error())
 		}
@@ -142,6 +154,12 @@ func (r *Repo) add(service string, id uint, data []byte, writeToDisk bool) error
 		return pct.DuplicateServiceInstanceError{Service: service, Id: id}
 	}
 
+	// A new instance gets a new UUID, a loaded one keeps its UUID.
+	uuid, err := r.loadUUID(name, writeToDisk)
+	if err != nil {
+		return err
+	}
+
 	if writeToDisk {
 		if err := pct.Basedir.WriteConfig(name, info); err != nil {
 			return err
@@ -150,9 +168,48 @@ func (r *Repo) add(service string, id uint, data []byte, writeToDisk bool) error
 	}
 
 	r.it[name] = info
+	r.uuids[name] = uuid
 	return nil
 }
 
+// loadUUID returns the UUID of the instance, making and saving one if it has
+// none or if renew is true.
+func (r *Repo) loadUUID(name string, renew bool) (string, error) {
+	file := r.uuidFile(name)
+	if !renew {
+		data, err := ioutil.ReadFile(file)
+		if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			return strings.TrimSpace(string(data)), nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, []byte(uuid+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+func (r *Repo) uuidFile(name string) string {
+	return r.configDir + "/" + name + ".uuid"
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
 func (r *Repo) Get(service string, id uint, info interface{}) error {
 	r.logger.Debug("Get:call")
 	defer r.logger.Debug("Get:return")
@@ -244,7 +301,12 @@ func (r *Repo) Remove(service string, id uint) error {
 		return err
 	}
 
+	if err := os.Remove(r.uuidFile(name)); err != nil && !os.IsNotExist(err) {
+		r.logger.Warn("Cannot remove UUID of " + name + ": " + err.Error())
+	}
+
 	delete(r.it, name)
+	delete(r.uuids, name)
 	r.logger.Info("Removed " + name)
 	return nil
 }
@@ -263,6 +325,45 @@ func (r *Repo) Name(service string, id uint) string {
 	return fmt.Sprintf("%s-%d", service, id)
 }
 
+// UUID returns the UUID of the instance, or "" if there's no such instance.
+func (r *Repo) UUID(service string, id uint) string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.uuids[r.Name(service, id)]
+}
+
+// splitName returns the service and ID of an instance name, e.g. "mysql-1".
+func splitName(name string) (string, uint, error) {
+	part := strings.Split(name, "-")
+	if len(part) != 2 {
+		return "", 0, errors.New("Invalid instance name: " + name)
+	}
+	id, err := strconv.ParseUint(part[1], 10, 32)
+	if err != nil {
+		return "", 0, err
+	}
+	return part[0], uint(id), nil
+}
+
+// Instances returns the JSON of every instance by name, e.g. mysql-1.  The
+// values are pointers because json.Marshal encodes map values of type
+// json.RawMessage as []byte (base64), not as the JSON they are.
+func (r *Repo) Instances() map[string]*json.RawMessage {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	instances := make(map[string]*json.RawMessage, len(r.it))
+	for name, info := range r.it {
+		data, err := json.Marshal(info)
+		if err != nil {
+			r.logger.Warn("Cannot encode instance " + name + ": " + err.Error())
+			continue
+		}
+		raw := json.RawMessage(data)
+		instances[name] = &raw
+	}
+	return instances
+}
+
 func (r *Repo) List() []string {
 	r.mux.Lock()
 	defer r.mux.Unlock()
@@ -20,6 +20,7 @@ package log
 const (
 	DEFAULT_LOG_FILE  = ""
 	DEFAULT_LOG_LEVEL = "info"
+	MAX_DEBUG_MINUTES = 240
 )
 
 type Config struct {
@@ -27,3 +28,10 @@ type Config struct {
 	File    string
 	Offline bool
 }
+
+// Debug is the data for the Debug cmd: log Service at debug level for Minutes,
+// or revert to the log level now if Minutes is zero.  See DebugLevel.
+type Debug struct {
+	Service string
+	Minutes uint
+}
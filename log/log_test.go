@@ -133,6 +133,46 @@ func (s *RelayTestSuite) TestLogLevel(t *C) {
 	t.Check(got, DeepEquals, expect)
 }
 
+func (s *RelayTestSuite) TestDebug(t *C) {
+	r := s.relay
+	sub := pct.NewLogger(s.relay.LogChan(), "test-sub")
+	other := pct.NewLogger(s.relay.LogChan(), "other")
+
+	// Debug the "test" service and its sub-services, but not others.
+	r.DebugChan() <- log.DebugLevel{Service: "test", Until: time.Now().Add(time.Minute)}
+	s.logger.Debug("debug")
+	sub.Debug("sub debug")
+	other.Debug("other debug")
+	other.Info("other info")
+	got := test.WaitLog(s.recvChan, 4)
+	expect := []proto.LogEntry{
+		{Ts: test.Ts, Level: proto.LOG_DEBUG, Service: "test", Msg: "debug"},
+		{Ts: test.Ts, Level: proto.LOG_DEBUG, Service: "test-sub", Msg: "sub debug"},
+		{Ts: test.Ts, Level: proto.LOG_INFO, Service: "other", Msg: "other info"},
+	}
+	t.Check(got, DeepEquals, expect)
+	t.Check(r.Status()["log-debug"], Matches, "test until .+")
+
+	// Revert now.
+	r.DebugChan() <- log.DebugLevel{Service: "test"}
+	s.logger.Debug("debug")
+	s.logger.Info("info")
+	got = test.WaitLog(s.recvChan, 2)
+	expect = []proto.LogEntry{
+		{Ts: test.Ts, Level: proto.LOG_INFO, Service: "test", Msg: "info"},
+	}
+	t.Check(got, DeepEquals, expect)
+	t.Check(r.Status()["log-debug"], Equals, "")
+
+	// Revert when it expires.
+	r.DebugChan() <- log.DebugLevel{Service: "test", Until: time.Now().Add(100 * time.Millisecond)}
+	time.Sleep(200 * time.Millisecond)
+	s.logger.Debug("debug")
+	s.logger.Info("info")
+	got = test.WaitLog(s.recvChan, 2)
+	t.Check(got, DeepEquals, expect)
+}
+
 func (s *RelayTestSuite) TestLogFile(t *C) {
 	/**
 	 * This test is going to be a real pain in the ass because it writes/reads
@@ -661,6 +701,68 @@ func (s *ManagerTestSuite) TestLogService(t *C) {
 	t.Check(status["log-level"], Equals, "warning")
 }
 
+func (s *ManagerTestSuite) TestDebug(t *C) {
+	config := &log.Config{
+		Level: "warning",
+	}
+	pct.Basedir.WriteConfig("log", config)
+
+	eventChan := make(chan pct.Event, 3)
+	pct.SetEventSink(func(e pct.Event) {
+		eventChan <- e
+	})
+	defer pct.SetEventSink(nil)
+
+	// Use a separate client and log chan, else this relay, which is at level
+	// warning, would relay log entries for other tests.
+	recvChan := make(chan interface{}, log.BUFFER_SIZE)
+	client := mock.NewWebsocketClient(nil, nil, make(chan interface{}, log.BUFFER_SIZE), recvChan)
+	m := log.NewManager(client, make(chan *proto.LogEntry, log.BUFFER_SIZE))
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "log",
+		Cmd:     "Debug",
+		Data:    []byte(`{"Service":"mm","Minutes":500}`),
+	}
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Matches, "Invalid Minutes.+")
+
+	cmd.Data = []byte(`{"Service":"mm","Minutes":30}`)
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	t.Check(test.WaitStatusPrefix(1, m.Relay(), "log-debug", "mm until "), Equals, true)
+
+	// The change is logged, and so are mm debug log entries.
+	logger := pct.NewLogger(m.Relay().LogChan(), "mm-ag-60")
+	logger.Debug("debug")
+	got := test.WaitLog(recvChan, 2)
+	t.Assert(got, HasLen, 2)
+	t.Check(got[0].Level, Equals, proto.LOG_WARNING)
+	t.Check(got[0].Msg, Matches, "Debug logging for mm for 30 minutes until .+ by daniel")
+	t.Check(got[1], DeepEquals, proto.LogEntry{Ts: test.Ts, Level: proto.LOG_DEBUG, Service: "mm-ag-60", Msg: "debug"})
+
+	// The change is recorded as an event too.
+	e := <-eventChan
+	t.Check(e.Type, Equals, "agent/log-debug")
+	t.Check(e.Message, Equals, got[0].Msg)
+	t.Check(e.Data, DeepEquals, &log.Debug{Service: "mm", Minutes: 30})
+
+	// Revert now.
+	cmd.Data = []byte(`{"Service":"mm","Minutes":0}`)
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	logger.Debug("debug")
+	got = test.WaitLog(recvChan, 2)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Msg, Equals, "Debug logging for mm reverted to warning level by daniel")
+	e = <-eventChan
+	t.Check(e.Message, Equals, got[0].Msg)
+	t.Check(e.Data, DeepEquals, &log.Debug{Service: "mm", Minutes: 0})
+}
+
 func (s *ManagerTestSuite) TestReconnect(t *C) {
 	config := &log.Config{
 		File:  s.logFile,
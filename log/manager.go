@@ -20,6 +20,7 @@ package log
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	"os"
@@ -37,6 +38,8 @@ type Manager struct {
 	logger  *pct.Logger
 	relay   *Relay
 	status  *pct.Status
+	// --
+	debugTimers map[string]*time.Timer // keyed on Debug.Service, guarded by mux
 }
 
 func NewManager(client pct.WebsocketClient, logChan chan *proto.LogEntry) *Manager {
@@ -46,6 +49,8 @@ func NewManager(client pct.WebsocketClient, logChan chan *proto.LogEntry) *Manag
 		// --
 		status: pct.NewStatus([]string{"log"}),
 		mux:    &sync.RWMutex{},
+		// --
+		debugTimers: make(map[string]*time.Timer),
 	}
 	return m
 }
@@ -137,6 +142,16 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	case "GetConfig":
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
+	case "Debug":
+		// proto.Cmd[Service:log, Cmd:Debug, Data:log.Debug]
+		debug := &Debug{}
+		if err := json.Unmarshal(cmd.Data, debug); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if err := m.debug(debug, cmd.User); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		return cmd.Reply(nil)
 	case "Reconnect":
 		m.client.Disconnect()
 		return cmd.Reply(nil)
@@ -167,11 +182,85 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return []proto.AgentConfig{config}, nil
 }
 
+// Reload applies changes to log.conf with SetConfig.  See pct.ConfigReloader.
+func (m *Manager) Reload() []error {
+	return pct.ReloadConfig(m, "log")
+}
+
 // @goroutine[0]
 func (m *Manager) Relay() *Relay {
 	return m.relay
 }
 
+// debug raises the service log level to debug for the minutes, or reverts it
+// now if minutes is zero.  The change and the revert are logged (warning) and
+// sent as agent/log-debug events so the API has a record of them.
+// @goroutine[0]
+func (m *Manager) debug(debug *Debug, user string) error {
+	if debug.Service == "" {
+		return errors.New("No Service to debug")
+	}
+	if debug.Minutes > MAX_DEBUG_MINUTES {
+		return fmt.Errorf("Invalid Minutes: %d: max is %d", debug.Minutes, MAX_DEBUG_MINUTES)
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if timer, ok := m.debugTimers[debug.Service]; ok {
+		timer.Stop()
+		delete(m.debugTimers, debug.Service)
+	}
+
+	if debug.Minutes == 0 {
+		if err := m.setDebug(DebugLevel{Service: debug.Service}); err != nil {
+			return err
+		}
+		m.debugEvent(debug, fmt.Sprintf("Debug logging for %s reverted to %s level by %s", debug.Service, m.config.Level, user))
+		return nil
+	}
+
+	d := time.Duration(debug.Minutes) * time.Minute
+	until := time.Now().Add(d)
+	if err := m.setDebug(DebugLevel{Service: debug.Service, Until: until}); err != nil {
+		return err
+	}
+	service := debug.Service
+	m.debugTimers[service] = time.AfterFunc(d, func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		delete(m.debugTimers, service)
+		if err := m.setDebug(DebugLevel{Service: service}); err != nil {
+			m.logger.Warn("Cannot revert debug logging for", service, ":", err)
+			return
+		}
+		m.debugEvent(&Debug{Service: service}, fmt.Sprintf("Debug logging for %s expired, reverted to %s level", service, m.config.Level))
+	})
+	m.debugEvent(debug, fmt.Sprintf("Debug logging for %s for %d minutes until %s by %s",
+		service, debug.Minutes, until.UTC().Format("15:04:05 MST"), user))
+	return nil
+}
+
+func (m *Manager) debugEvent(debug *Debug, msg string) {
+	m.logger.Warn(msg)
+	pct.SendEvent(pct.Event{
+		Type:    "agent/log-debug",
+		Level:   pct.EVENT_INFO,
+		Message: msg,
+		Data:    debug,
+	})
+}
+
+// setDebug sends the debug level to the relay.  The caller must hold mux.
+func (m *Manager) setDebug(debug DebugLevel) error {
+	select {
+	case m.relay.DebugChan() <- debug:
+		return nil
+	case <-time.After(3 * time.Second):
+		return errors.New("Timeout setting debug log level")
+	}
+}
+
 func (m *Manager) validateConfig(config *Config) error {
 	if config.Level == "" {
 		config.Level = DEFAULT_LOG_LEVEL
@@ -24,6 +24,9 @@ import (
 	golog "log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +34,14 @@ const (
 	BUFFER_SIZE int = 50
 )
 
+// DebugLevel raises the log level of a service to debug until a time,
+// regardless of the relay log level.  Service matches the loggers named
+// Service or prefixed Service-, e.g. "mm" matches "mm-ag-60".
+type DebugLevel struct {
+	Service string
+	Until   time.Time // zero to revert now
+}
+
 type Relay struct {
 	client   pct.WebsocketClient
 	logChan  chan *proto.LogEntry
@@ -41,12 +52,15 @@ type Relay struct {
 	connected     bool
 	logLevelChan  chan byte
 	logFileChan   chan string
+	debugChan     chan DebugLevel
+	debug         map[string]time.Time // keyed on DebugLevel.Service
 	logger        *golog.Logger
 	firstBuf      []*proto.LogEntry
 	firstBufSize  int
 	secondBuf     []*proto.LogEntry
 	secondBufSize int
 	lost          int
+	buffered      int32 // firstBufSize + secondBufSize, for Buffered()
 	status        *pct.Status
 }
 
@@ -60,12 +74,15 @@ func NewRelay(client pct.WebsocketClient, logChan chan *proto.LogEntry, logFile
 		// --
 		logLevelChan: make(chan byte),
 		logFileChan:  make(chan string),
+		debugChan:    make(chan DebugLevel),
+		debug:        make(map[string]time.Time),
 		firstBuf:     make([]*proto.LogEntry, BUFFER_SIZE),
 		secondBuf:    make([]*proto.LogEntry, BUFFER_SIZE),
 		status: pct.NewStatus([]string{
 			"log-relay",
 			"log-file",
 			"log-level",
+			"log-debug",
 			"log-chan",
 			"log-buf1",
 			"log-buf2",
@@ -86,6 +103,16 @@ func (r *Relay) LogFileChan() chan string {
 	return r.logFileChan
 }
 
+func (r *Relay) DebugChan() chan DebugLevel {
+	return r.debugChan
+}
+
+// Buffered returns the number of log entries buffered because they could not
+// be sent.  It's safe to call from any goroutine, unlike reading Status.
+func (r *Relay) Buffered() int {
+	return int(atomic.LoadInt32(&r.buffered))
+}
+
 func (r *Relay) Status() map[string]string {
 	return r.status.Merge(r.client.Status())
 }
@@ -109,8 +136,9 @@ func (r *Relay) Run() {
 		r.status.Update("log-relay", "Idle")
 		select {
 		case entry := <-r.logChan:
-			// Skip if log level too high, too verbose.
-			if entry.Level > r.logLevel {
+			// Skip if log level too high, too verbose, unless the service
+			// is being debugged.
+			if entry.Level > r.logLevel && !r.debugging(entry.Service) {
 				continue
 			}
 
@@ -142,6 +170,8 @@ func (r *Relay) Run() {
 			r.setLogFile(file)
 		case level := <-r.logLevelChan:
 			r.setLogLevel(level)
+		case debug := <-r.debugChan:
+			r.setDebug(debug)
 		}
 	}
 }
@@ -172,6 +202,7 @@ func (r *Relay) buffer(e *proto.LogEntry) {
 	defer func() {
 		r.status.Update("log-buf1", fmt.Sprintf("%d", r.firstBufSize))
 		r.status.Update("log-buf2", fmt.Sprintf("%d", r.secondBufSize))
+		atomic.StoreInt32(&r.buffered, int32(r.firstBufSize+r.secondBufSize))
 	}()
 
 	// First time we need to buffer delayed/lost log entries is closest to
@@ -223,6 +254,7 @@ func (r *Relay) resend() {
 	defer func() {
 		r.status.Update("log-buf1", fmt.Sprintf("%d", r.firstBufSize))
 		r.status.Update("log-buf2", fmt.Sprintf("%d", r.secondBufSize))
+		atomic.StoreInt32(&r.buffered, int32(r.firstBufSize+r.secondBufSize))
 	}()
 
 	r.status.Update("log-relay", "Resending buf1")
@@ -291,10 +323,10 @@ func (r *Relay) setLogFile(logFile string) {
 		file = os.Stderr
 	} else {
 		if !filepath.IsAbs(logFile) {
-			logFile = filepath.Join(pct.Basedir.Path(), logFile)
+			logFile = filepath.Join(pct.Basedir.StatePath(), logFile)
 		}
 		var err error
-		file, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		file, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
 		if err != nil {
 			r.internal(err.Error(), proto.LOG_WARNING)
 			return
@@ -305,3 +337,42 @@ func (r *Relay) setLogFile(logFile string) {
 	r.logFile = file.Name()
 	r.status.Update("log-file", logFile)
 }
+
+func (r *Relay) setDebug(debug DebugLevel) {
+	if debug.Until.IsZero() {
+		delete(r.debug, debug.Service)
+	} else {
+		r.debug[debug.Service] = debug.Until
+	}
+	r.updateDebugStatus()
+}
+
+// debugging returns true if the service is being debugged.  Expired debug
+// levels are removed, so they revert even if the manager doesn't.
+func (r *Relay) debugging(service string) bool {
+	if len(r.debug) == 0 {
+		return false
+	}
+	now := time.Now()
+	debugging := false
+	for s, until := range r.debug {
+		if now.After(until) {
+			delete(r.debug, s)
+			r.updateDebugStatus()
+			continue
+		}
+		if service == s || strings.HasPrefix(service, s+"-") {
+			debugging = true
+		}
+	}
+	return debugging
+}
+
+func (r *Relay) updateDebugStatus() {
+	debug := make([]string, 0, len(r.debug))
+	for s, until := range r.debug {
+		debug = append(debug, s+" until "+until.UTC().Format("2006-01-02 15:04:05 MST"))
+	}
+	sort.Strings(debug)
+	r.status.Update("log-debug", strings.Join(debug, ", "))
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/pct"
 	"math"
+	"sync"
 	"time"
 )
 
@@ -32,8 +33,25 @@ type Aggregator struct {
 	collectionChan chan *Collection
 	spool          data.Spooler
 	// --
-	sync    *pct.SyncChan
-	running bool
+	reports     *ReportBuffer
+	sync        *pct.SyncChan
+	running     bool
+	mux         *sync.Mutex                 // guards derived, percentiles, anomalies, statsd, and rollup
+	derived     map[string]*derivedInstance // keyed on service-instanceId
+	percentiles map[string][]float64        // keyed on service-instanceId
+	anomalies   map[string]anomalyConfig    // keyed on service-instanceId
+	statsd      map[string]*StatsD          // keyed on service-instanceId
+	rollup      *proto.ServiceInstance      // server instance for host rollups, see rollup.go
+	collected   *pct.LastTs                 // keyed on mm-service-instanceId
+
+	// Counter baselines, see handoff.go.
+	baselines map[string]map[string]CounterBaseline // from the previous agent, read-only
+	last      []*InstanceStats                      // when run() stopped, for Baselines
+}
+
+type anomalyConfig struct {
+	sigma  float64
+	window int
 }
 
 func NewAggregator(logger *pct.Logger, interval int64, collectionChan chan *Collection, spool data.Spooler) *Aggregator {
@@ -43,7 +61,14 @@ func NewAggregator(logger *pct.Logger, interval int64, collectionChan chan *Coll
 		collectionChan: collectionChan,
 		spool:          spool,
 		// --
-		sync: pct.NewSyncChan(),
+		reports:     NewReportBuffer(logger, DEFAULT_REPORT_BUFFER, spool),
+		sync:        pct.NewSyncChan(),
+		mux:         &sync.Mutex{},
+		derived:     make(map[string]*derivedInstance),
+		percentiles: make(map[string][]float64),
+		anomalies:   make(map[string]anomalyConfig),
+		statsd:      make(map[string]*StatsD),
+		collected:   pct.NewLastTs(pct.LAST_COLLECTED),
 	}
 	return a
 }
@@ -54,6 +79,7 @@ func NewAggregator(logger *pct.Logger, interval int64, collectionChan chan *Coll
 
 // @goroutine[0]
 func (a *Aggregator) Start() {
+	a.reports.Start()
 	go a.run()
 	a.running = true // XXX: not guarded
 }
@@ -62,6 +88,45 @@ func (a *Aggregator) Start() {
 func (a *Aggregator) Stop() {
 	a.sync.Stop()
 	a.sync.Wait()
+	a.reports.Stop()
+	a.mux.Lock()
+	for key, s := range a.statsd {
+		s.Close()
+		delete(a.statsd, key)
+	}
+	a.mux.Unlock()
+}
+
+// Status returns the aggregator's spooling status, keyed on its interval
+// because there's one aggregator per unique report interval, and when each
+// service instance was last collected, e.g. mm-mysql-1-last-collected.
+// @goroutine[0]
+func (a *Aggregator) Status() map[string]string {
+	status := a.collected.Status()
+	status[fmt.Sprintf("mm-aggregator-%ds", a.interval)] = a.reports.Status()
+	return status
+}
+
+// Forget removes when the service instance was last collected from Status,
+// e.g. when its monitor is stopped.
+// @goroutine[0]
+func (a *Aggregator) Forget(si proto.ServiceInstance) {
+	a.collected.Remove(fmt.Sprintf("mm-%s-%d", si.Service, si.InstanceId))
+}
+
+// SetDerived sets the derived metrics (see derived.go) to compute for the
+// service instance's collections, replacing any previous ones.  If metrics
+// is empty, no derived metrics are computed for the instance.
+// @goroutine[0]
+func (a *Aggregator) SetDerived(si proto.ServiceInstance, metrics []*DerivedMetric) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	key := fmt.Sprintf("%s-%d", si.Service, si.InstanceId)
+	if len(metrics) == 0 {
+		delete(a.derived, key)
+		return
+	}
+	a.derived[key] = &derivedInstance{metrics: metrics}
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -85,6 +150,9 @@ func (a *Aggregator) run() {
 	for {
 		select {
 		case collection := <-a.collectionChan:
+			if !isMarker(collection) {
+				a.collected.Mark(fmt.Sprintf("mm-%s-%d", collection.Service, collection.InstanceId), time.Unix(collection.Ts, 0))
+			}
 			interval := (collection.Ts / a.interval) * a.interval
 			if curInterval == 0 {
 				curInterval = interval
@@ -102,6 +170,7 @@ func (a *Aggregator) run() {
 					for key, _ := range cur[n].Stats {
 						cur[n].Stats[key].Reset()
 					}
+					cur[n].Events = nil
 				}
 				curInterval = interval
 				startTs = GoTime(a.interval, interval)
@@ -133,8 +202,23 @@ func (a *Aggregator) run() {
 				cur = append(cur, is)
 			}
 
-			// Add each metric in the collection to its Stats.
-			for _, metric := range collection.Metrics {
+			// Events are reported as-is.
+			is.Events = append(is.Events, collection.Events...)
+			if blackoutEnded(collection) {
+				for _, stats := range is.Stats {
+					stats.Restart()
+				}
+			}
+
+			// Add each metric in the collection to its Stats, plus the
+			// derived metrics computed from them.
+			metrics := collection.Metrics
+			if derived := a.derive(collection); len(derived) > 0 {
+				metrics = append(append([]Metric{}, collection.Metrics...), derived...)
+			}
+			a.emit(is.ServiceInstance, metrics)
+			baselines := a.baselines[fmt.Sprintf("%s-%d", collection.Service, collection.InstanceId)]
+			for _, metric := range metrics {
 				stats, haveStats := is.Stats[metric.Name]
 				if !haveStats {
 					// New metric, create stats for it.
@@ -144,6 +228,12 @@ func (a *Aggregator) run() {
 						a.logger.Error(metric.Name, "invalid:", err.Error())
 						continue
 					}
+					stats.SetPercentiles(a.getPercentiles(is.ServiceInstance))
+					anomaly := a.getAnomaly(is.ServiceInstance)
+					stats.SetAnomaly(anomaly.sigma, anomaly.window)
+					if b, ok := baselines[metric.Name]; ok && b.current(collection.Ts) {
+						stats.SetBaseline(b)
+					}
 					is.Stats[metric.Name] = stats
 				}
 				if err := stats.Add(&metric, collection.Ts); err != nil {
@@ -157,11 +247,108 @@ func (a *Aggregator) run() {
 				}
 			}
 		case <-a.sync.StopChan:
+			a.last = cur
 			return
 		}
 	}
 }
 
+// SetPercentiles sets the extra percentiles to report for the service
+// instance's gauges (see Stats.SetPercentiles), or none if pcts is empty.
+// @goroutine[0]
+func (a *Aggregator) SetPercentiles(si proto.ServiceInstance, pcts []float64) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	key := fmt.Sprintf("%s-%d", si.Service, si.InstanceId)
+	if len(pcts) == 0 {
+		delete(a.percentiles, key)
+		return
+	}
+	a.percentiles[key] = pcts
+}
+
+// SetAnomaly sets the anomaly flagging (see anomaly.go) for the service
+// instance's metrics, or disables it if sigma is zero.
+// @goroutine[0]
+func (a *Aggregator) SetAnomaly(si proto.ServiceInstance, sigma float64, window uint) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	key := fmt.Sprintf("%s-%d", si.Service, si.InstanceId)
+	if sigma <= 0 {
+		delete(a.anomalies, key)
+		return
+	}
+	a.anomalies[key] = anomalyConfig{sigma, int(window)}
+}
+
+// SetStatsD sets the StatsD emitter (see statsd.go) to send the service
+// instance's collected metrics to, closing the previous one, if any.  If s is
+// nil, the metrics are not sent.
+// @goroutine[0]
+func (a *Aggregator) SetStatsD(si proto.ServiceInstance, s *StatsD) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	key := fmt.Sprintf("%s-%d", si.Service, si.InstanceId)
+	if old, ok := a.statsd[key]; ok {
+		old.Close()
+	}
+	if s == nil {
+		delete(a.statsd, key)
+		return
+	}
+	a.statsd[key] = s
+}
+
+// SetRollup enables or disables host rollups (see rollup.go) reported under
+// the server instance.
+// @goroutine[0]
+func (a *Aggregator) SetRollup(server proto.ServiceInstance, enable bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if enable {
+		a.rollup = &server
+	} else if a.rollup != nil && a.rollup.Service == server.Service && a.rollup.InstanceId == server.InstanceId {
+		a.rollup = nil
+	}
+}
+
+// @goroutine[1]
+func (a *Aggregator) getAnomaly(si proto.ServiceInstance) anomalyConfig {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.anomalies[fmt.Sprintf("%s-%d", si.Service, si.InstanceId)]
+}
+
+// @goroutine[1]
+func (a *Aggregator) getPercentiles(si proto.ServiceInstance) []float64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.percentiles[fmt.Sprintf("%s-%d", si.Service, si.InstanceId)]
+}
+
+// @goroutine[1]
+func (a *Aggregator) derive(c *Collection) []Metric {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	di, ok := a.derived[fmt.Sprintf("%s-%d", c.Service, c.InstanceId)]
+	if !ok {
+		return nil
+	}
+	return di.derive(c)
+}
+
+// @goroutine[1]
+func (a *Aggregator) emit(si proto.ServiceInstance, metrics []Metric) {
+	// Send without the lock: it's network I/O which shouldn't block
+	// config changes.  If SetStatsD closes s meanwhile, nothing is sent.
+	a.mux.Lock()
+	s, ok := a.statsd[fmt.Sprintf("%s-%d", si.Service, si.InstanceId)]
+	a.mux.Unlock()
+	if ok {
+		s.Send(si, metrics)
+	}
+}
+
 // @goroutine[1]
 func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 	a.logger.Debug("Summarize metrics for", startTs)
@@ -176,7 +363,8 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 	for _, i := range is {
 
 		// Finalize the stats for every metric.  If the final stats are nil,
-		// then no values were reported (Cnt=0), so we ignore the metric.
+		// then no values (Cnt=0) or resets were reported, so we ignore the
+		// metric.
 		finalMetrics := make(map[string]*Stats)
 		for metric, stats := range i.Stats {
 			finalStats := stats.Finalize()
@@ -187,11 +375,11 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 			finalMetrics[metric] = finalStats
 		}
 
-		// If the instance has no metrics with stats; ignore it.  This can
-		// happen if, for example, the MySQL metrics take too long to collect.
-		// This isn't reported here; the metrics monitor should report it
-		// because it knows that it collect any metrics.
-		if len(finalMetrics) == 0 {
+		// If the instance has no metrics with stats and no events; ignore it.
+		// This can happen if, for example, the MySQL metrics take too long to
+		// collect.  This isn't reported here; the metrics monitor should report
+		// it because it knows that it collect any metrics.
+		if len(finalMetrics) == 0 && len(i.Events) == 0 {
 			continue
 		}
 
@@ -203,9 +391,20 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 			},
 			Stats: finalMetrics,
 		}
+		if len(i.Events) > 0 {
+			finalInstance.Events = make([]Event, len(i.Events))
+			copy(finalInstance.Events, i.Events)
+		}
 		finalInstanceStats = append(finalInstanceStats, finalInstance)
 	}
 
+	a.mux.Lock()
+	server := a.rollup
+	a.mux.Unlock()
+	if server != nil && len(finalInstanceStats) > 0 {
+		finalInstanceStats = rollup(*server, finalInstanceStats)
+	}
+
 	if len(finalInstanceStats) == 0 {
 		// This shouldn't happen: no instances with valid metrics/stats.
 		a.logger.Warn("No metrics collected for", startTs)
@@ -217,9 +416,9 @@ func (a *Aggregator) report(startTs time.Time, is []*InstanceStats) {
 		Duration: uint(a.interval),
 		Stats:    finalInstanceStats,
 	}
-	if err := a.spool.Write("mm", report); err != nil {
-		a.logger.Warn("Lost report:", err)
-	}
+	// Spool the report via the buffer so a slow spooler doesn't block
+	// us and, in turn, every monitor sending to us.
+	a.reports.Push(report)
 }
 
 func GoTime(interval, unixTs int64) time.Time {
@@ -0,0 +1,85 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"math"
+)
+
+/**
+ * If Config.AnomalySigma is set, each metric's Stats counts the values (gauge
+ * values or counter rates) that are more than AnomalySigma standard deviations
+ * from the mean of the previous Config.AnomalyWindow values: Stats.Anomalies.
+ * The window spans report intervals, so a jump at the start of an interval is
+ * still flagged.  It's a cheap hint for the API to highlight sudden changes,
+ * not real anomaly detection: nothing is flagged until the window has
+ * MIN_ANOMALY_VALUES values, or while the window is flat (stddev 0).
+ */
+
+const (
+	DEFAULT_ANOMALY_WINDOW = 60
+	MIN_ANOMALY_VALUES     = 10
+)
+
+type anomalyWindow struct {
+	sigma float64
+	vals  []float64 // ring buffer
+	n     int       // number of values in vals
+	i     int       // next value goes here
+	sum   float64
+	sumSq float64
+}
+
+func newAnomalyWindow(sigma float64, size int) *anomalyWindow {
+	if size <= 0 {
+		size = DEFAULT_ANOMALY_WINDOW
+	}
+	w := &anomalyWindow{
+		sigma: sigma,
+		vals:  make([]float64, size),
+	}
+	return w
+}
+
+// check returns true if val is an anomaly given the previous values in the
+// window, then adds val to the window.
+func (w *anomalyWindow) check(val float64) bool {
+	anomaly := false
+	if w.n >= MIN_ANOMALY_VALUES {
+		n := float64(w.n)
+		mean := w.sum / n
+		variance := w.sumSq/n - mean*mean
+		if variance > 0 {
+			anomaly = math.Abs(val-mean) > w.sigma*math.Sqrt(variance)
+		}
+	}
+
+	if w.n == len(w.vals) {
+		old := w.vals[w.i]
+		w.sum -= old
+		w.sumSq -= old * old
+	} else {
+		w.n++
+	}
+	w.vals[w.i] = val
+	w.sum += val
+	w.sumSq += val * val
+	w.i = (w.i + 1) % len(w.vals)
+
+	return anomaly
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test/mock"
+)
+
+/**
+ * Benchmarks of the mm data pipeline with 10k to 500k metrics per collection,
+ * so regressions are caught before users with huge schemas hit them.  Run:
+ *
+ *   go test -run XXX -bench . -benchmem ./mm/
+ *
+ * One op is one report interval: two collections are aggregated and the report
+ * is spooled.  The Aggregator benchmarks spool to a mock; the Pipeline
+ * benchmarks serialize with the default gzip serializer and write to a real
+ * spool like the agent does.  Making the collections is not timed.
+ */
+
+func BenchmarkAggregator10k(b *testing.B)  { benchmarkAggregator(b, 10000) }
+func BenchmarkAggregator100k(b *testing.B) { benchmarkAggregator(b, 100000) }
+func BenchmarkAggregator500k(b *testing.B) { benchmarkAggregator(b, 500000) }
+
+func BenchmarkPipeline10k(b *testing.B)  { benchmarkPipeline(b, 10000) }
+func BenchmarkPipeline100k(b *testing.B) { benchmarkPipeline(b, 100000) }
+func BenchmarkPipeline500k(b *testing.B) { benchmarkPipeline(b, 500000) }
+
+func benchmarkAggregator(b *testing.B, metrics int) {
+	reportChan := make(chan interface{}, 1)
+	runBenchmark(b, metrics, mock.NewSpooler(reportChan), reportChan)
+}
+
+func benchmarkPipeline(b *testing.B, metrics int) {
+	tmpDir, err := ioutil.TempDir("/tmp", "mm-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logger := pct.NewLogger(make(chan *proto.LogEntry, 100), "mm-bench-spooler")
+	limits := proto.DataSpoolLimits{
+		MaxAge:   data.DEFAULT_DATA_MAX_AGE,
+		MaxSize:  data.DEFAULT_DATA_MAX_SIZE,
+		MaxFiles: data.DEFAULT_DATA_MAX_FILES,
+	}
+	spool := data.NewDiskvSpooler(logger, path.Join(tmpDir, "data"), path.Join(tmpDir, "trash"), "localhost", limits)
+	if err := spool.Start(data.NewJsonGzipSerializer()); err != nil {
+		b.Fatal(err)
+	}
+	defer spool.Stop()
+
+	reportChan := make(chan interface{}, 1)
+	runBenchmark(b, metrics, &syncSpooler{spool, reportChan}, reportChan)
+}
+
+func runBenchmark(b *testing.B, metrics int, spool data.Spooler, reportChan chan interface{}) {
+	// Nothing reads the log chan; the logger drops entries when it's full.
+	logger := pct.NewLogger(make(chan *proto.LogEntry, 100), "mm-bench")
+	collectionChan := make(chan *mm.Collection)
+	a := mm.NewAggregator(logger, 60, collectionChan, spool)
+	a.Start()
+	defer a.Stop()
+
+	load := mock.NewLoadMonitor("mysql", 1, metrics)
+	ts := int64(1257894000) // 2009-11-10 23:00:00, like the fixtures
+	collectionChan <- load.Collection(ts)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c1 := load.Collection(ts + 30)
+		c2 := load.Collection(ts + 60) // next interval, makes the aggregator report
+		ts += 60
+		b.StartTimer()
+
+		collectionChan <- c1
+		collectionChan <- c2
+		<-reportChan
+	}
+}
+
+// syncSpooler signals reportChan after each report is written to the real
+// spooler so the benchmark can wait for it.
+type syncSpooler struct {
+	data.Spooler
+	reportChan chan interface{}
+}
+
+func (s *syncSpooler) Write(service string, v interface{}) error {
+	err := s.Spooler.Write(service, v)
+	s.reportChan <- v
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * Monitors don't collect during their blackout (Config.Blackout, see
+ * pct/blackout.go), so the report for an interval in a blackout has no stats
+ * for the instance.  Instead, the start and end of the blackout are events
+ * in the report stream, so the API knows why there's no data and doesn't
+ * fire alerts or count it in baselines.  After a blackout, counters start
+ * again (see Stats.Restart), else their first rate would be the average
+ * across the blackout.
+ */
+
+const (
+	EVENT_BLACKOUT     = "mm/blackout"     // blackout started
+	EVENT_BLACKOUT_END = "mm/blackout/end" // blackout ended
+)
+
+// blackoutMarker returns the pct.BlackoutTicker mark func for the instance:
+// it sends a collection with only a blackout event, unless the ticker is
+// stopped first.
+func blackoutMarker(si proto.ServiceInstance, collectionChan chan *Collection) func(time.Time, bool, chan bool) bool {
+	return func(t time.Time, in bool, stopChan chan bool) bool {
+		e := Event{
+			Ts:      t.Unix(),
+			Type:    EVENT_BLACKOUT,
+			Level:   EVENT_INFO,
+			Message: "Blackout started, not collecting",
+		}
+		if !in {
+			e.Type = EVENT_BLACKOUT_END
+			e.Message = "Blackout ended, collecting"
+		}
+		c := &Collection{
+			ServiceInstance: si,
+			Ts:              t.Unix(),
+			Metrics:         []Metric{},
+			Events:          []Event{e},
+		}
+		select {
+		case collectionChan <- c:
+			return true
+		case <-stopChan:
+			return false
+		}
+	}
+}
+
+// isMarker returns true if the collection wasn't collected by a monitor: it
+// marks the start or end of a blackout, or it's the dropped collections
+// counter, see CollectionBuffer.
+func isMarker(c *Collection) bool {
+	if len(c.Metrics) == 1 && c.Metrics[0].Name == DROPPED_COLLECTIONS {
+		return true
+	}
+	if len(c.Metrics) > 0 || len(c.Events) == 0 {
+		return false
+	}
+	for _, e := range c.Events {
+		if e.Type != EVENT_BLACKOUT && e.Type != EVENT_BLACKOUT_END {
+			return false
+		}
+	}
+	return true
+}
+
+// blackoutEnded returns true if the collection marks the end of a blackout.
+func blackoutEnded(c *Collection) bool {
+	for _, e := range c.Events {
+		if e.Type == EVENT_BLACKOUT_END {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,392 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * A CollectionBuffer sits between monitors and an Aggregator.  Monitors send
+ * to In() which never blocks for long because the buffer only appends to a
+ * bounded ring; it sends from the ring to the aggregator as fast as the
+ * aggregator receives.  So if the aggregator stalls, e.g. spooling is slow,
+ * collections queue in the ring instead of monitors timing out and losing
+ * them.  If the ring is full, the oldest collection is dropped and counted
+ * in the percona-agent/mm/dropped_collections counter which is sent to the
+ * aggregator as an agent metric once per collect interval.  The counter is
+ * kept outside the ring so it never takes the place of a collection: it's
+ * sent after the collections queued before it, i.e. with its Ts or older.
+ */
+
+// ring is a bounded FIFO queue that drops the oldest item when full.  It's
+// shared by CollectionBuffer and ReportBuffer which guard it with their mux.
+type ring struct {
+	items []interface{}
+	head  int // oldest item
+	n     int // items in ring
+}
+
+func newRing(size int) *ring {
+	return &ring{items: make([]interface{}, size)}
+}
+
+// push appends v and returns the oldest item if the ring was full and it
+// was dropped to make room, else nil.
+func (r *ring) push(v interface{}) interface{} {
+	var dropped interface{}
+	if r.n == len(r.items) {
+		dropped = r.peek()
+		r.pop()
+	}
+	r.items[(r.head+r.n)%len(r.items)] = v
+	r.n++
+	return dropped
+}
+
+// peek returns the oldest item, or nil if the ring is empty.
+func (r *ring) peek() interface{} {
+	if r.n == 0 {
+		return nil
+	}
+	return r.items[r.head]
+}
+
+// pop removes the oldest item.
+func (r *ring) pop() {
+	if r.n == 0 {
+		return
+	}
+	r.items[r.head] = nil
+	r.head = (r.head + 1) % len(r.items)
+	r.n--
+}
+
+func (r *ring) len() int {
+	return r.n
+}
+
+const (
+	DEFAULT_COLLECTION_BUFFER = 100
+	DROPPED_COLLECTIONS       = "percona-agent/mm/dropped_collections"
+)
+
+type CollectionBuffer struct {
+	logger  *pct.Logger
+	outChan chan *Collection // -> aggregator
+	// --
+	inChan  chan *Collection // <- monitors
+	mux     *sync.Mutex      // guards ring for Len
+	ring    *ring            // of *Collection
+	dropped uint64
+	sync    *pct.SyncChan
+}
+
+func NewCollectionBuffer(logger *pct.Logger, size uint, outChan chan *Collection) *CollectionBuffer {
+	if size == 0 {
+		size = DEFAULT_COLLECTION_BUFFER
+	}
+	b := &CollectionBuffer{
+		logger:  logger,
+		outChan: outChan,
+		// --
+		inChan: make(chan *Collection, 1),
+		mux:    &sync.Mutex{},
+		ring:   newRing(int(size)),
+		sync:   pct.NewSyncChan(),
+	}
+	return b
+}
+
+// In returns the chan that monitors send collections to.
+func (b *CollectionBuffer) In() chan *Collection {
+	return b.inChan
+}
+
+// Len returns the number of collections queued for the aggregator: in In(),
+// the ring, and the aggregator's chan.  The dropped collections counter isn't
+// counted unless it's in the aggregator's chan.
+func (b *CollectionBuffer) Len() int {
+	b.mux.Lock()
+	n := b.ring.len()
+	b.mux.Unlock()
+	return len(b.inChan) + n + len(b.outChan)
+}
+
+func (b *CollectionBuffer) Start() {
+	go b.run()
+}
+
+func (b *CollectionBuffer) Stop() {
+	b.sync.Stop()
+	b.sync.Wait()
+}
+
+func (b *CollectionBuffer) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			b.logger.Error("Collection buffer crashed: ", err)
+		}
+		b.sync.Done()
+	}()
+
+	var lastTs int64
+	var dropped *Collection // dropped collections counter, not sent yet
+	for {
+		// Only try to send if there's something to send: a nil chan blocks.
+		var outChan chan *Collection
+		var next *Collection
+		b.mux.Lock()
+		if b.ring.len() > 0 {
+			outChan = b.outChan
+			next = b.ring.peek().(*Collection)
+		}
+		b.mux.Unlock()
+		if dropped != nil && (next == nil || next.Ts > dropped.Ts) {
+			outChan = b.outChan
+			next = dropped
+		}
+
+		select {
+		case c := <-b.inChan:
+			b.push(c)
+			// Report dropped collections once per collect interval.  If
+			// the last count wasn't sent yet, this one replaces it.
+			if c.Ts > lastTs {
+				lastTs = c.Ts
+				dropped = b.droppedCollection(c.Ts)
+			}
+		case outChan <- next:
+			if next == dropped {
+				dropped = nil
+				continue
+			}
+			b.mux.Lock()
+			b.ring.pop()
+			b.mux.Unlock()
+		case <-b.sync.StopChan:
+			return
+		}
+	}
+}
+
+func (b *CollectionBuffer) push(c *Collection) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if v := b.ring.push(c); v != nil {
+		// Ring was full; the oldest collection was dropped.
+		dropped := v.(*Collection)
+		b.dropped++
+		b.logger.Warn("Dropped", dropped.Service, dropped.InstanceId, "collection at",
+			time.Unix(dropped.Ts, 0).UTC(), "because the aggregator is not keeping up")
+	}
+}
+
+func (b *CollectionBuffer) droppedCollection(ts int64) *Collection {
+	return &Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    "agent",
+			InstanceId: 0,
+		},
+		Ts: ts,
+		Metrics: []Metric{
+			{Name: DROPPED_COLLECTIONS, Type: "counter", Number: float64(b.dropped)},
+		},
+	}
+}
+
+/**
+ * A ReportBuffer sits between an Aggregator and the data spooler.  The
+ * aggregator pushes each report to the buffer which never blocks because,
+ * like a CollectionBuffer, it only appends to a bounded ring; the buffer's
+ * goroutine writes reports from the ring to the spooler (and latest.json)
+ * as fast as the spooler accepts them.  So if the spooler stalls, e.g. one
+ * slow disk, reports queue in the ring instead of the aggregator blocking
+ * and collections backing up into every monitor.  Reports that time out
+ * spooling are retried; if the ring is full, the oldest report is dropped
+ * and counted.  Status() reports the stall, queued, and dropped reports.
+ */
+
+const (
+	DEFAULT_REPORT_BUFFER = 10
+	REPORT_RETRY_WAIT     = 1 * time.Second // after data.ErrSpoolTimeout
+	REPORT_STALL_TIME     = 1 * time.Second // spooling longer = stalled
+)
+
+type ReportBuffer struct {
+	logger *pct.Logger
+	spool  data.Spooler
+	// --
+	mux       *sync.Mutex // guards ring, dropped, failed, spooling, and stalled
+	ring      *ring       // of *Report
+	dropped   uint64
+	failed    uint64    // spool timeouts and errors
+	spooling  time.Time // when spooling the oldest report began, zero if idle
+	stalled   bool      // spool timed out since spooling began
+	readyChan chan struct{}
+	sync      *pct.SyncChan
+}
+
+func NewReportBuffer(logger *pct.Logger, size uint, spool data.Spooler) *ReportBuffer {
+	if size == 0 {
+		size = DEFAULT_REPORT_BUFFER
+	}
+	b := &ReportBuffer{
+		logger: logger,
+		spool:  spool,
+		// --
+		mux:       &sync.Mutex{},
+		ring:      newRing(int(size)),
+		readyChan: make(chan struct{}, 1),
+		sync:      pct.NewSyncChan(),
+	}
+	return b
+}
+
+func (b *ReportBuffer) Start() {
+	go b.run()
+}
+
+func (b *ReportBuffer) Stop() {
+	b.sync.Stop()
+	b.sync.Wait()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if n := b.ring.len(); n > 0 {
+		b.logger.Warn("Lost", n, "unspooled reports")
+	}
+}
+
+// Push queues the report for spooling.  It does not block.
+func (b *ReportBuffer) Push(r *Report) {
+	b.mux.Lock()
+	if v := b.ring.push(r); v != nil {
+		// Ring was full; the oldest report was dropped.
+		b.dropped++
+		b.logger.Warn("Dropped report for", v.(*Report).Ts, "because spooling is not keeping up")
+	}
+	b.mux.Unlock()
+
+	// Wake up run() if it's waiting.
+	select {
+	case b.readyChan <- struct{}{}:
+	default:
+	}
+}
+
+// Dropped returns the number of reports dropped because the ring was full.
+func (b *ReportBuffer) Dropped() uint64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.dropped
+}
+
+func (b *ReportBuffer) Status() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	status := "Idle"
+	if !b.spooling.IsZero() {
+		if b.stalled || time.Now().Sub(b.spooling) > REPORT_STALL_TIME {
+			status = "Spooling stalled since " + pct.TimeString(b.spooling)
+		} else {
+			status = "Spooling"
+		}
+	}
+	return fmt.Sprintf("%s, %d reports queued, %d dropped, %d spool failures", status, b.ring.len(), b.dropped, b.failed)
+}
+
+func (b *ReportBuffer) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			b.logger.Error("Report buffer crashed: ", err)
+		}
+		b.sync.Done()
+	}()
+
+	for {
+		b.mux.Lock()
+		var r *Report
+		if b.ring.len() > 0 {
+			r = b.ring.peek().(*Report)
+			if b.spooling.IsZero() {
+				b.spooling = time.Now()
+			}
+		}
+		b.mux.Unlock()
+
+		if r == nil {
+			select {
+			case <-b.readyChan:
+				continue
+			case <-b.sync.StopChan:
+				return
+			}
+		}
+
+		err := b.spool.Write("mm", r)
+
+		b.mux.Lock()
+		if err == data.ErrSpoolTimeout {
+			// Spooler is backed up; keep the report and try again.
+			if !b.stalled {
+				b.logger.Warn("Spooling stalled, will retry report for", r.Ts)
+				b.stalled = true
+			}
+			b.failed++
+			b.mux.Unlock()
+			select {
+			case <-time.After(REPORT_RETRY_WAIT):
+				continue
+			case <-b.sync.StopChan:
+				return
+			}
+		}
+		if err != nil {
+			b.failed++
+			b.logger.Warn("Lost report:", err)
+		}
+		if b.stalled || time.Now().Sub(b.spooling) > REPORT_STALL_TIME {
+			b.logger.Info("Spooling resumed after stall since", pct.TimeString(b.spooling))
+		}
+		b.spooling = time.Time{}
+		b.stalled = false
+		// Push() may have dropped this report while it was being spooled.
+		if b.ring.peek() == r {
+			b.ring.pop()
+		}
+		b.mux.Unlock()
+
+		// Write each instance's stats to its latest.json for local consumers.
+		for _, i := range r.Stats {
+			latest := &Report{
+				Ts:       r.Ts,
+				Duration: r.Duration,
+				Stats:    []*InstanceStats{i},
+			}
+			if err := pct.Basedir.WriteLatest("mm", i.ServiceInstance, latest); err != nil {
+				b.logger.Warn("Cannot write latest report:", err)
+			}
+		}
+	}
+}
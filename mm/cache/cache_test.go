@@ -0,0 +1,208 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package cache_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/cache"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var sample = test.RootDir + "/mm/cache"
+
+type TestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-cache-test")
+}
+
+// fakeServer reads requests line by line and writes reply(line) if it's not
+// empty, like Redis and Memcached which reply once a command is complete.
+func fakeServer(t *C, reply func(line string) string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if out := reply(strings.TrimSpace(line)); out != "" {
+					conn.Write([]byte(out))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestParseRedisInfo(t *C) {
+	content, err := ioutil.ReadFile(sample + "/redis-info001.txt")
+	t.Assert(err, IsNil)
+	got := cache.ParseRedisInfo(content)
+	t.Check(got["connected_clients"], Equals, float64(12))
+	t.Check(got["mem_fragmentation_ratio"], Equals, 1.25)
+	t.Check(got["keyspace_hits"], Equals, float64(800))
+	t.Check(got["used_cpu_user"], Equals, 30.25)
+	t.Check(got["db0/keys"], Equals, float64(100))
+	t.Check(got["db0/avg_ttl"], Equals, float64(3600000))
+	t.Check(got["db3/keys"], Equals, float64(5))
+
+	// Not numeric.
+	_, ok := got["redis_version"]
+	t.Check(ok, Equals, false)
+	_, ok = got["used_memory_human"]
+	t.Check(ok, Equals, false)
+	_, ok = got["role"]
+	t.Check(ok, Equals, false)
+}
+
+func (s *TestSuite) TestParseMemcachedStats(t *C) {
+	content, err := ioutil.ReadFile(sample + "/memcached-stats001.txt")
+	t.Assert(err, IsNil)
+	got := cache.ParseMemcachedStats(content)
+	t.Check(got["curr_connections"], Equals, float64(10))
+	t.Check(got["get_hits"], Equals, float64(900))
+	t.Check(got["rusage_user"], Equals, 1.5)
+	_, ok := got["version"]
+	t.Check(ok, Equals, false)
+	t.Check(got, HasLen, 16)
+}
+
+func (s *TestSuite) TestRedisMonitor(t *C) {
+	content, err := ioutil.ReadFile(sample + "/redis-info001.txt")
+	t.Assert(err, IsNil)
+	l := fakeServer(t, func(line string) string {
+		switch line {
+		case "secret":
+			return "+OK\r\n"
+		case "wrong":
+			return "-ERR invalid password\r\n"
+		case "INFO":
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(content), content)
+		}
+		return ""
+	})
+	defer l.Close()
+
+	config := &cache.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "redis", InstanceId: 1},
+			Collect:         1,
+			Report:          60,
+		},
+		Instances: []cache.Instance{
+			{Name: "sessions", Addr: l.Addr().String(), Password: "secret"},
+			{Name: "queue", Addr: l.Addr().String(), Password: "wrong"},
+		},
+		Include: []string{"connected_clients", "keyspace_*", "db0/*", "total_*"},
+		Exclude: []string{"db0/avg_ttl"},
+	}
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	m := cache.NewMonitor("mm-redis-1", cache.REDIS, config, s.logger)
+	err = m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	tickChan <- time.Now()
+	got := test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Metrics, DeepEquals, []mm.Metric{
+		{Name: "redis/sessions/up", Type: "gauge", Number: 1},
+		{Name: "redis/sessions/connected_clients", Type: "gauge", Number: 12},
+		{Name: "redis/sessions/db0/expires", Type: "gauge", Number: 10},
+		{Name: "redis/sessions/db0/keys", Type: "gauge", Number: 100},
+		{Name: "redis/sessions/keyspace_hits", Type: "counter", Number: 800},
+		{Name: "redis/sessions/keyspace_misses", Type: "counter", Number: 200},
+		{Name: "redis/sessions/total_commands_processed", Type: "counter", Number: 90000},
+		{Name: "redis/sessions/total_connections_received", Type: "counter", Number: 1500},
+		{Name: "redis/sessions/total_system_memory", Type: "gauge", Number: 8589934592},
+		{Name: "redis/queue/up", Type: "gauge", Number: 0},
+	})
+}
+
+func (s *TestSuite) TestMemcachedMonitor(t *C) {
+	content, err := ioutil.ReadFile(sample + "/memcached-stats001.txt")
+	t.Assert(err, IsNil)
+	l := fakeServer(t, func(line string) string {
+		if line == "stats" {
+			return string(content) + "END\r\n"
+		}
+		return ""
+	})
+	defer l.Close()
+
+	config := &cache.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "memcached", InstanceId: 1},
+			Collect:         1,
+			Report:          60,
+		},
+		Instances: []cache.Instance{
+			{Name: "mc1", Addr: l.Addr().String()},
+		},
+		Include: []string{"curr_*", "get_*", "cmd_get"},
+	}
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	m := cache.NewMonitor("mm-memcached-1", cache.MEMCACHED, config, s.logger)
+	err = m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	tickChan <- time.Now()
+	got := test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Metrics, DeepEquals, []mm.Metric{
+		{Name: "memcached/mc1/up", Type: "gauge", Number: 1},
+		{Name: "memcached/mc1/cmd_get", Type: "counter", Number: 1000},
+		{Name: "memcached/mc1/curr_connections", Type: "gauge", Number: 10},
+		{Name: "memcached/mc1/curr_items", Type: "gauge", Number: 25},
+		{Name: "memcached/mc1/get_hits", Type: "counter", Number: 900},
+		{Name: "memcached/mc1/get_misses", Type: "counter", Number: 100},
+	})
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package cache
+
+import (
+	"github.com/percona/percona-agent/mm"
+)
+
+const (
+	DEFAULT_TIMEOUT = 1000 // milliseconds
+)
+
+type Config struct {
+	mm.Config
+	Instances []Instance
+	Include   []string // only collect variables matching these globs, default all numeric
+	Exclude   []string // but not those matching these globs
+	Timeout   uint     // milliseconds per instance, default DEFAULT_TIMEOUT
+}
+
+type Instance struct {
+	Name     string // metrics are <service>/<Name>/<var>, e.g. redis/sessions/connected_clients
+	Addr     string // host:port, or Unix socket path
+	Password string // Redis AUTH, if required
+}
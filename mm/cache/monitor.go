@@ -0,0 +1,287 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package cache
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * The cache monitor collects Redis INFO or Memcached stats from every
+ * Config.Instances on each tick, all at once, and sends one collection with
+ * metrics prefixed by service and instance name, e.g. redis/sessions/used_memory.
+ * Each instance is dialed on every tick, so there's no connection state to
+ * recover; if one can't be reached, only its <service>/<name>/up is sent (0).
+ */
+
+type Monitor struct {
+	name    string
+	service string // REDIS or MEMCACHED
+	config  *Config
+	logger  *pct.Logger
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+	include        *pct.GlobMatcher // nil if all
+	exclude        *pct.GlobMatcher
+	counters       *pct.GlobMatcher
+	down           map[string]bool // instances down, warned once, keyed on Instance.Name
+	mux            *sync.Mutex     // guards down
+}
+
+func NewMonitor(name, service string, config *Config, logger *pct.Logger) *Monitor {
+	counters := redisCounters
+	if service == MEMCACHED {
+		counters = memcachedCounters
+	}
+	m := &Monitor{
+		name:    name,
+		service: service,
+		config:  config,
+		logger:  logger,
+		// --
+		status:   pct.NewStatus([]string{name}),
+		sync:     pct.NewSyncChan(),
+		exclude:  pct.NewGlobMatcher(config.Exclude),
+		counters: pct.NewGlobMatcher(counters),
+		down:     make(map[string]bool),
+		mux:      &sync.Mutex{},
+	}
+	if len(config.Include) > 0 {
+		m.include = pct.NewGlobMatcher(config.Include)
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Cache monitor crashed: ", err)
+		}
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	var lastTs int64
+	for {
+		m.logger.Debug("run:idle")
+		m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(time.Unix(lastTs, 0))))
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			m.status.Update(m.name, "Running")
+
+			c := m.collect(now)
+
+			// Send the metrics to the aggregator.
+			if len(c.Metrics) > 0 {
+				select {
+				case m.collectionChan <- c:
+					lastTs = c.Ts
+				case <-time.After(500 * time.Millisecond):
+					// lost collection
+					m.logger.Debug("Lost " + m.service + " metrics; timeout spooling after 500ms")
+				}
+			} else {
+				m.logger.Debug("run:no metrics") // no instances
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+func (m *Monitor) collect(now time.Time) *mm.Collection {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+
+	// Collect from all at once so one slow instance doesn't delay the others.
+	metrics := make([][]mm.Metric, len(m.config.Instances))
+	var wg sync.WaitGroup
+	for i, in := range m.config.Instances {
+		wg.Add(1)
+		go func(i int, in Instance) {
+			defer wg.Done()
+			metrics[i] = m.collectInstance(in)
+		}(i, in)
+	}
+	wg.Wait()
+
+	for _, instanceMetrics := range metrics {
+		c.Metrics = append(c.Metrics, instanceMetrics...)
+	}
+	return c
+}
+
+func (m *Monitor) collectInstance(in Instance) []mm.Metric {
+	prefix := m.service + "/" + in.Name + "/"
+	values, err := m.getValues(in)
+
+	m.mux.Lock()
+	wasDown := m.down[in.Name]
+	m.down[in.Name] = err != nil
+	m.mux.Unlock()
+
+	if err != nil {
+		if !wasDown {
+			m.logger.Warn(fmt.Sprintf("Cannot collect %s %s: %s", m.service, in.Name, err))
+		}
+		return []mm.Metric{{Name: prefix + "up", Type: "gauge", Number: 0}}
+	}
+	if wasDown {
+		m.logger.Info(fmt.Sprintf("Collecting %s %s again", m.service, in.Name))
+	}
+
+	// Sorted so metrics are always in the same order.
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if m.include != nil && !m.include.Match(name) {
+			continue
+		}
+		if m.exclude.Match(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []mm.Metric{{Name: prefix + "up", Type: "gauge", Number: 1}}
+	for _, name := range names {
+		mtype := "gauge"
+		if m.counters.Match(name) {
+			mtype = "counter"
+		}
+		metrics = append(metrics, mm.Metric{Name: prefix + name, Type: mtype, Number: values[name]})
+	}
+	return metrics
+}
+
+func (m *Monitor) getValues(in Instance) (map[string]float64, error) {
+	timeout := time.Duration(m.config.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DEFAULT_TIMEOUT * time.Millisecond
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(in.Addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, in.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	switch m.service {
+	case REDIS:
+		content, err := RedisInfo(conn, in.Password)
+		if err != nil {
+			return nil, err
+		}
+		return ParseRedisInfo(content), nil
+	case MEMCACHED:
+		content, err := MemcachedStats(conn)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMemcachedStats(content), nil
+	}
+	return nil, fmt.Errorf("Unknown cache service: %s", m.service)
+}
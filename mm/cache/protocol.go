@@ -0,0 +1,212 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Both protocols are simple enough that the monitor speaks them itself:
+ * Redis INFO (RESP) and the Memcached text protocol "stats" command.
+ * Only numeric values are returned; Redis keyspace lines like
+ * "db0:keys=1,expires=0,avg_ttl=0" are split into db0/keys, etc.
+ */
+
+const (
+	REDIS     = "redis"
+	MEMCACHED = "memcached"
+)
+
+// RedisInfo returns the INFO output, after AUTH if password isn't empty.
+func RedisInfo(conn io.ReadWriter, password string) ([]byte, error) {
+	r := bufio.NewReader(conn)
+	if password != "" {
+		if _, err := conn.Write(respCommand("AUTH", password)); err != nil {
+			return nil, err
+		}
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "+") {
+			return nil, fmt.Errorf("Redis AUTH failed: %s", strings.TrimPrefix(line, "-"))
+		}
+	}
+
+	if _, err := conn.Write(respCommand("INFO")); err != nil {
+		return nil, err
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("Redis INFO failed: %s", strings.TrimPrefix(line, "-"))
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid Redis INFO reply: %s", line)
+	}
+	content := make([]byte, n+2) // + \r\n
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return content[:n], nil
+}
+
+// MemcachedStats returns the "stats" command output.
+func MemcachedStats(conn io.ReadWriter) ([]byte, error) {
+	if _, err := conn.Write([]byte("stats\r\n")); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	var content bytes.Buffer
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "END" {
+			break
+		}
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "SERVER_ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") {
+			return nil, fmt.Errorf("Memcached stats failed: %s", line)
+		}
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+	return content.Bytes(), nil
+}
+
+// ParseRedisInfo returns the numeric values in Redis INFO output.
+func ParseRedisInfo(content []byte) map[string]float64 {
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue // section header, e.g. # Server
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		name, value := line[:i], line[i+1:]
+		if strings.HasPrefix(name, "db") && strings.Contains(value, "=") {
+			// Keyspace: db0:keys=1,expires=0,avg_ttl=0
+			for _, kv := range strings.Split(value, ",") {
+				j := strings.Index(kv, "=")
+				if j < 0 {
+					continue
+				}
+				if n, err := strconv.ParseFloat(kv[j+1:], 64); err == nil {
+					values[name+"/"+kv[:j]] = n
+				}
+			}
+			continue
+		}
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			values[name] = n
+		}
+	}
+	return values
+}
+
+// ParseMemcachedStats returns the numeric values in Memcached stats output:
+// "STAT name value" lines.
+func ParseMemcachedStats(content []byte) map[string]float64 {
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 || f[0] != "STAT" {
+			continue
+		}
+		if n, err := strconv.ParseFloat(f[2], 64); err == nil {
+			values[f[1]] = n
+		}
+	}
+	return values
+}
+
+// redisCounters and memcachedCounters are the variables that only increase;
+// every other variable is a gauge.  Names are explicit where a prefix also
+// matches gauges, e.g. Redis total_system_memory.
+var redisCounters = []string{
+	"total_connections_received",
+	"total_commands_processed",
+	"total_net_input_bytes",
+	"total_net_output_bytes",
+	"total_net_repl_input_bytes",
+	"total_net_repl_output_bytes",
+	"total_error_replies",
+	"total_reads_processed",
+	"total_writes_processed",
+	"total_forks",
+	"keyspace_hits",
+	"keyspace_misses",
+	"expired_keys",
+	"evicted_keys",
+	"rejected_connections",
+	"sync_full",
+	"sync_partial_ok",
+	"sync_partial_err",
+	"used_cpu_*",
+}
+
+var memcachedCounters = []string{
+	"cmd_*",
+	"*_hits",
+	"*_misses",
+	"bytes_read",
+	"bytes_written",
+	"total_items",
+	"total_connections",
+	"evictions",
+	"reclaimed",
+	"expired_unfetched",
+	"evicted_unfetched",
+	"rejected_connections",
+	"conn_yields",
+	"listen_disabled_num",
+	"rusage_*",
+	"auth_cmds",
+	"auth_errors",
+}
+
+// respCommand returns a Redis command as a RESP array of bulk strings.
+func respCommand(args ...string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buf.Bytes()
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package checks_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/checks"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	logChan    chan *proto.LogEntry
+	logger     *pct.Logger
+	listener   net.Listener
+	closedAddr string
+	server     *httptest.Server
+	healthy    bool
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-checks-test")
+
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+
+	// Nothing listens on this port after it's closed.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	s.closedAddr = closed.Addr().String()
+	closed.Close()
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func (s *TestSuite) SetUpTest(t *C) {
+	s.healthy = true
+}
+
+func (s *TestSuite) TearDownSuite(t *C) {
+	s.listener.Close()
+	s.server.Close()
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestProbe(t *C) {
+	r := checks.Probe(checks.Check{Name: "tcp", TCP: s.listener.Addr().String()})
+	t.Check(r.Up, Equals, true)
+	t.Check(r.Err, IsNil)
+	t.Check(r.Latency > 0, Equals, true)
+
+	r = checks.Probe(checks.Check{Name: "tcp", TCP: s.closedAddr})
+	t.Check(r.Up, Equals, false)
+	t.Check(r.Err, NotNil)
+
+	r = checks.Probe(checks.Check{Name: "http", HTTP: s.server.URL})
+	t.Check(r.Up, Equals, true)
+	t.Check(r.HTTPStatus, Equals, 200)
+
+	s.healthy = false
+	r = checks.Probe(checks.Check{Name: "http", HTTP: s.server.URL})
+	t.Check(r.Up, Equals, false)
+	t.Check(r.HTTPStatus, Equals, 503)
+	t.Check(r.Err, ErrorMatches, "HTTP status 503.*")
+
+	// 503 is expected, e.g. a passive node's health endpoint.
+	r = checks.Probe(checks.Check{Name: "http", HTTP: s.server.URL, Status: 503})
+	t.Check(r.Up, Equals, true)
+
+	r = checks.Probe(checks.Check{Name: "none"})
+	t.Check(r.Up, Equals, false)
+	t.Check(r.Err, ErrorMatches, "Check none has no TCP or HTTP")
+}
+
+func (s *TestSuite) TestMonitor(t *C) {
+	config := &checks.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service: "checks",
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Checks: []checks.Check{
+			{Name: "proxysql", TCP: s.listener.Addr().String()},
+			{Name: "app", HTTP: s.server.URL + "/health"},
+		},
+	}
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	m := checks.NewMonitor("mm-checks", config, s.logger)
+	err := m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	tickChan <- time.Now()
+	got := test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Assert(got[0].Metrics, HasLen, 5)
+	t.Check(got[0].Metrics[0], Equals, mm.Metric{Name: "checks/proxysql/up", Type: "gauge", Number: 1})
+	t.Check(got[0].Metrics[1].Name, Equals, "checks/proxysql/latency")
+	t.Check(got[0].Metrics[2], Equals, mm.Metric{Name: "checks/app/up", Type: "gauge", Number: 1})
+	t.Check(got[0].Metrics[3].Name, Equals, "checks/app/latency")
+	t.Check(got[0].Metrics[4], Equals, mm.Metric{Name: "checks/app/http_status", Type: "gauge", Number: 200})
+	t.Check(got[0].Events, HasLen, 0)
+
+	// App goes down: event with the reason.
+	s.healthy = false
+	tickChan <- time.Now()
+	got = test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Metrics[2], Equals, mm.Metric{Name: "checks/app/up", Type: "gauge", Number: 0})
+	t.Assert(got[0].Events, HasLen, 1)
+	t.Check(got[0].Events[0].Type, Equals, "checks/app/down")
+	t.Check(got[0].Events[0].Level, Equals, mm.EVENT_WARNING)
+	t.Check(got[0].Events[0].Message, Matches, "app is down: HTTP status 503.*")
+
+	// Still down: no new event.
+	tickChan <- time.Now()
+	got = test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Events, HasLen, 0)
+
+	// Back up.
+	s.healthy = true
+	tickChan <- time.Now()
+	got = test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Assert(got[0].Events, HasLen, 1)
+	t.Check(got[0].Events[0].Type, Equals, "checks/app/up")
+	t.Check(got[0].Events[0].Level, Equals, mm.EVENT_INFO)
+}
@@ -0,0 +1,39 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package checks
+
+import (
+	"github.com/percona/percona-agent/mm"
+)
+
+const (
+	DEFAULT_TIMEOUT = 2000 // milliseconds
+)
+
+type Config struct {
+	mm.Config
+	Checks []Check
+}
+
+type Check struct {
+	Name    string // metrics are checks/<Name>/up etc., e.g. app-health
+	TCP     string // host:port to connect to, e.g. 127.0.0.1:6032 (ProxySQL admin), or
+	HTTP    string // URL to GET, e.g. http://app1/health
+	Status  int    // expected HTTP status, default any 2xx
+	Timeout uint   // milliseconds, default DEFAULT_TIMEOUT
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package checks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * The checks monitor probes Config.Checks, TCP ports or HTTP URLs, from the
+ * agent's host on every tick, all at once, so a DBA can tell whether "the
+ * database is unreachable" is really a network path problem.  For each check
+ * it reports checks/<name>/up (1 or 0) and checks/<name>/latency (seconds),
+ * and checks/<name>/http_status for HTTP checks.  When a check goes down or
+ * comes back up, an event says so, and why it's down.
+ */
+
+type Monitor struct {
+	name   string
+	config *Config
+	logger *pct.Logger
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+	up             map[string]bool // last state, keyed on Check.Name
+}
+
+func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
+	m := &Monitor{
+		name:   name,
+		config: config,
+		logger: logger,
+		// --
+		status: pct.NewStatus([]string{name}),
+		sync:   pct.NewSyncChan(),
+		up:     make(map[string]bool),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Checks monitor crashed: ", err)
+		}
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	var lastTs int64
+	for {
+		m.logger.Debug("run:idle")
+		m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(time.Unix(lastTs, 0))))
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			m.status.Update(m.name, "Running")
+
+			c := m.collect(now)
+
+			// Send the metrics to the aggregator.
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
+				select {
+				case m.collectionChan <- c:
+					lastTs = c.Ts
+				case <-time.After(500 * time.Millisecond):
+					// lost collection
+					m.logger.Debug("Lost checks metrics; timeout spooling after 500ms")
+				}
+			} else {
+				m.logger.Debug("run:no metrics") // no checks
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+func (m *Monitor) collect(now time.Time) *mm.Collection {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+
+	// Probe all at once so one slow check doesn't delay the others.
+	results := make([]Result, len(m.config.Checks))
+	var wg sync.WaitGroup
+	for i, check := range m.config.Checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = Probe(check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for i, check := range m.config.Checks {
+		r := results[i]
+		prefix := "checks/" + check.Name + "/"
+		up := 0.0
+		if r.Up {
+			up = 1
+		}
+		c.Metrics = append(c.Metrics,
+			mm.Metric{Name: prefix + "up", Type: "gauge", Number: up},
+			mm.Metric{Name: prefix + "latency", Type: "gauge", Number: r.Latency.Seconds()},
+		)
+		if check.HTTP != "" && r.HTTPStatus > 0 {
+			c.Metrics = append(c.Metrics, mm.Metric{Name: prefix + "http_status", Type: "gauge", Number: float64(r.HTTPStatus)})
+		}
+
+		// Event only on change, or if the first probe is down.
+		lastUp, seen := m.up[check.Name]
+		m.up[check.Name] = r.Up
+		if (!seen || lastUp) && !r.Up {
+			m.logger.Warn(fmt.Sprintf("Check %s is down: %s", check.Name, r.Err))
+			c.Events = append(c.Events, mm.Event{
+				Ts:      c.Ts,
+				Type:    prefix + "down",
+				Level:   mm.EVENT_WARNING,
+				Message: fmt.Sprintf("%s is down: %s", check.Name, r.Err),
+			})
+		} else if seen && !lastUp && r.Up {
+			m.logger.Info(fmt.Sprintf("Check %s is up", check.Name))
+			c.Events = append(c.Events, mm.Event{
+				Ts:      c.Ts,
+				Type:    prefix + "up",
+				Level:   mm.EVENT_INFO,
+				Message: check.Name + " is up",
+			})
+		}
+	}
+
+	return c
+}
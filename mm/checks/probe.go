@@ -0,0 +1,82 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package checks
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Result of one Check.
+type Result struct {
+	Up         bool
+	Latency    time.Duration // time to connect (TCP) or to get the response (HTTP)
+	HTTPStatus int           // 0 for TCP or if there was no response
+	Err        error         // why it's not up
+}
+
+// Probe runs the check once.  A TCP check is up if it connects; the
+// connection is closed right away.  An HTTP check is up if the response
+// status is Check.Status, or any 2xx if that's not set.  Connections
+// aren't reused, so every probe sees the network path like a new client.
+func Probe(check Check) Result {
+	timeout := time.Duration(check.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DEFAULT_TIMEOUT * time.Millisecond
+	}
+
+	var r Result
+	start := time.Now()
+	switch {
+	case check.TCP != "":
+		conn, err := net.DialTimeout("tcp", check.TCP, timeout)
+		r.Latency = time.Now().Sub(start)
+		if err != nil {
+			r.Err = err
+			return r
+		}
+		conn.Close()
+		r.Up = true
+	case check.HTTP != "":
+		client := &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+			Timeout:   timeout,
+		}
+		resp, err := client.Get(check.HTTP)
+		r.Latency = time.Now().Sub(start)
+		if err != nil {
+			r.Err = err
+			return r
+		}
+		resp.Body.Close()
+		r.HTTPStatus = resp.StatusCode
+		if check.Status != 0 {
+			r.Up = resp.StatusCode == check.Status
+		} else {
+			r.Up = resp.StatusCode >= 200 && resp.StatusCode < 300
+		}
+		if !r.Up {
+			r.Err = fmt.Errorf("HTTP status %s", resp.Status)
+		}
+	default:
+		r.Err = fmt.Errorf("Check %s has no TCP or HTTP", check.Name)
+	}
+	return r
+}
@@ -18,6 +18,8 @@
 package mm
 
 import (
+	"fmt"
+
 	"github.com/percona/cloud-protocol/proto/v1"
 )
 
@@ -28,7 +30,43 @@ import (
  */
 
 type Config struct {
-	proto.ServiceInstance      // info about external service being monitored
-	Collect               uint // how often monitor collects metrics (seconds)
-	Report                uint // how often aggregator reports metrics (seconds)
+	proto.ServiceInstance                   // info about external service being monitored
+	Collect               uint              // how often monitor collects metrics (seconds)
+	Report                uint              // how often aggregator reports metrics (seconds)
+	Derived               map[string]string // metric name => expression, see derived.go
+	Percentiles           []float64         // extra gauge percentiles to report, e.g. 99, 99.9
+	AnomalySigma          float64           // flag values this many stddevs from the window, see anomaly.go
+	AnomalyWindow         uint              // number of trailing values
+	Buffer                uint              // max collections buffered for the aggregator, see buffer.go
+	ForecastHours         uint              // event if a resource will be exhausted this soon, see forecast.go
+	Profile               string            // "" (full) or "light": collect less, less often
+	StatsD                string            // also send collected metrics to this host:port or unix:<socket>, see statsd.go
+	StatsDSampleRate      float64           // send this fraction of metrics, 0 or 1 = all
+	StatsDTags            map[string]string // metric name prefix => DogStatsD tags, e.g. "mysql/innodb/" => "subsystem:innodb"
+	Rollup                bool              // server only: host metrics across MySQL instances, see rollup.go
+	Blackout              []string          // cron expressions of minutes not to collect, see pct/blackout.go
+}
+
+// Config.Profile values.  A monitor applies the profile to its own config,
+// e.g. mysql.Config.ApplyProfile(); the manager only enforces the collect
+// interval because it makes the collect ticker.
+const (
+	PROFILE_FULL          = ""
+	PROFILE_LIGHT         = "light"
+	PROFILE_LIGHT_COLLECT = 10 // min collect interval (seconds) for PROFILE_LIGHT
+)
+
+// ApplyProfile sets the collect interval for the profile, or returns an
+// error if the profile is invalid.
+func (c *Config) ApplyProfile() error {
+	switch c.Profile {
+	case PROFILE_FULL:
+	case PROFILE_LIGHT:
+		if c.Collect < PROFILE_LIGHT_COLLECT {
+			c.Collect = PROFILE_LIGHT_COLLECT
+		}
+	default:
+		return fmt.Errorf("Invalid Profile: %s: expected %s or \"\"", c.Profile, PROFILE_LIGHT)
+	}
+	return nil
 }
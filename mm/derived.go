@@ -0,0 +1,335 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Derived metrics are computed by the Aggregator from the other metrics in
+ * each Collection, as defined in Config.Derived, e.g.:
+ *
+ *   "mysql/qps":                   "com_select + com_insert + com_update + com_delete"
+ *   "mysql/buffer_pool_hit_ratio": "1 - innodb_buffer_pool_reads / innodb_buffer_pool_read_requests"
+ *
+ * Expressions have numbers, metric names, + - * / and parentheses.  A bare
+ * name like com_select is relative to the derived metric's prefix (mysql/),
+ * so it's mysql/com_select.  Any other metric is given in brackets, e.g.
+ * [memory/MemFree].  Counter metrics are their per-second rate since the
+ * previous collection, so every derived metric is a gauge.  A derived metric
+ * is not computed for a collection if a metric it uses wasn't collected, a
+ * counter has no rate yet or was reset, or the result is not a number, e.g.
+ * divide by zero.
+ */
+
+type DerivedMetric struct {
+	Name  string
+	Expr  string
+	root  exprNode
+	names []string // metric names used by Expr
+}
+
+// NewDerivedMetric parses expr and returns a derived metric, or an error if
+// expr is not valid.
+func NewDerivedMetric(name, expr string) (*DerivedMetric, error) {
+	prefix := ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		prefix = name[0 : i+1]
+	}
+	p := &exprParser{expr: expr, prefix: prefix}
+	root, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression for derived metric %s: %s", name, err)
+	}
+	d := &DerivedMetric{
+		Name:  name,
+		Expr:  expr,
+		root:  root,
+		names: p.names,
+	}
+	return d, nil
+}
+
+// Eval returns the value of the derived metric given the values of the
+// metrics it uses, or false if a value is missing or the result is not
+// a number.
+func (d *DerivedMetric) Eval(values map[string]float64) (float64, bool) {
+	val, ok := d.root.eval(values)
+	if !ok || math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, false
+	}
+	return val, true
+}
+
+// Names returns the names of the metrics that the derived metric uses.
+func (d *DerivedMetric) Names() []string {
+	return d.names
+}
+
+// MakeDerivedMetrics parses all derived metrics in a Config.Derived map.
+func MakeDerivedMetrics(derived map[string]string) ([]*DerivedMetric, error) {
+	metrics := []*DerivedMetric{}
+	for name, expr := range derived {
+		d, err := NewDerivedMetric(name, expr)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, d)
+	}
+	return metrics, nil
+}
+
+// derivedInstance computes the derived metrics for one service instance.
+// It remembers the last value of every counter to compute rates.
+type derivedInstance struct {
+	metrics []*DerivedMetric
+	prevTs  int64
+	prev    map[string]float64 // counters
+}
+
+func (di *derivedInstance) derive(c *Collection) []Metric {
+	values := make(map[string]float64, len(c.Metrics))
+	cur := make(map[string]float64)
+	for _, m := range c.Metrics {
+		switch m.Type {
+		case "gauge":
+			values[m.Name] = m.Number
+		case "counter":
+			cur[m.Name] = m.Number
+			prev, ok := di.prev[m.Name]
+			if !ok || m.Number < prev || c.Ts <= di.prevTs {
+				continue // no rate yet or reset
+			}
+			values[m.Name] = (m.Number - prev) / float64(c.Ts-di.prevTs)
+		}
+	}
+	di.prevTs = c.Ts
+	di.prev = cur
+
+	metrics := []Metric{}
+	for _, d := range di.metrics {
+		if val, ok := d.Eval(values); ok {
+			metrics = append(metrics, Metric{Name: d.Name, Type: "gauge", Number: val})
+		}
+	}
+	return metrics
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Expression parser
+/////////////////////////////////////////////////////////////////////////////
+
+type exprNode interface {
+	eval(values map[string]float64) (float64, bool)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(values map[string]float64) (float64, bool) {
+	return float64(n), true
+}
+
+type metricNode string
+
+func (n metricNode) eval(values map[string]float64) (float64, bool) {
+	val, ok := values[string(n)]
+	return val, ok
+}
+
+type negNode struct {
+	x exprNode
+}
+
+func (n negNode) eval(values map[string]float64) (float64, bool) {
+	x, ok := n.x.eval(values)
+	return -x, ok
+}
+
+type binaryNode struct {
+	op   byte
+	x, y exprNode
+}
+
+func (n binaryNode) eval(values map[string]float64) (float64, bool) {
+	x, ok := n.x.eval(values)
+	if !ok {
+		return 0, false
+	}
+	y, ok := n.y.eval(values)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		return x + y, true
+	case '-':
+		return x - y, true
+	case '*':
+		return x * y, true
+	case '/':
+		if y == 0 {
+			return 0, false
+		}
+		return x / y, true
+	}
+	return 0, false
+}
+
+/**
+ * exprParser is a recursive descent parser for:
+ *   expr   = term { ("+" | "-") term }
+ *   term   = factor { ("*" | "/") factor }
+ *   factor = number | name | "[" name "]" | "(" expr ")" | "-" factor
+ */
+type exprParser struct {
+	expr   string
+	prefix string
+	pos    int
+	names  []string
+}
+
+func (p *exprParser) parse() (exprNode, error) {
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.expr[p.pos], p.pos)
+	}
+	return n, nil
+}
+
+// peek skips whitespace and returns the next char, or 0 at the end.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos == len(p.expr) {
+		return 0
+	}
+	return p.expr[p.pos]
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	x, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryNode{op, x, y}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	x, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryNode{op, x, y}
+	}
+}
+
+func (p *exprParser) parseFactor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		x, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x}, nil
+	case c == '(':
+		p.pos++
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	case c == '[':
+		end := strings.IndexByte(p.expr[p.pos:], ']')
+		if end < 0 {
+			return nil, fmt.Errorf("missing ] at position %d", p.pos)
+		}
+		name := strings.TrimSpace(p.expr[p.pos+1 : p.pos+end])
+		if name == "" {
+			return nil, fmt.Errorf("empty metric name at position %d", p.pos)
+		}
+		p.pos += end + 1
+		return p.metric(name), nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.expr) && (isDigit(p.expr[p.pos]) || p.expr[p.pos] == '.') {
+			p.pos++
+		}
+		val, err := strconv.ParseFloat(p.expr[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", p.expr[start:p.pos], start)
+		}
+		return numberNode(val), nil
+	case isNameChar(c):
+		start := p.pos
+		for p.pos < len(p.expr) && (isNameChar(p.expr[p.pos]) || isDigit(p.expr[p.pos]) || p.expr[p.pos] == '.') {
+			p.pos++
+		}
+		return p.metric(p.prefix + p.expr[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
+
+func (p *exprParser) metric(name string) exprNode {
+	p.names = append(p.names, name)
+	return metricNode(name)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * An Estimate is how many metrics a monitor would collect with a config, made
+ * by the EstimateMetrics cmd without starting the monitor, so users can check
+ * a config before they start it, e.g. per-table user stats on a server with
+ * a hundred thousand tables.  Metrics is the number of unique metrics in each
+ * report, i.e. its cardinality.  Values is the number of values collected per
+ * report interval, which is more because most metrics are collected every
+ * Config.Collect seconds.  The numbers are for the server as it is now, so
+ * they change when, for example, tables are added.
+ */
+type Estimate struct {
+	proto.ServiceInstance
+	Collect uint // seconds, Config.Collect
+	Report  uint // seconds, Config.Report
+	Groups  []EstimateGroup
+	Metrics uint     // unique metrics per report, sum of Groups
+	Values  uint     // values collected per report
+	Notes   []string `json:",omitempty"`
+}
+
+type EstimateGroup struct {
+	Name     string // e.g. status, userstats
+	Metrics  uint
+	Interval uint   // seconds between collections, 0 = Collect
+	Note     string `json:",omitempty"` // e.g. how the metrics were counted
+}
+
+// A MetricEstimator is a MonitorFactory that can estimate the metrics its
+// monitors would collect.  data is the monitor config, like Make.  It returns
+// an Estimate with Groups and Notes; the manager sets the rest.
+type MetricEstimator interface {
+	Estimate(service string, instanceId uint, data []byte) (*Estimate, error)
+}
+
+// Add adds a group of metrics collected every interval seconds.
+func (e *Estimate) Add(name string, metrics, interval uint, note string) {
+	e.Groups = append(e.Groups, EstimateGroup{
+		Name:     name,
+		Metrics:  metrics,
+		Interval: interval,
+		Note:     note,
+	})
+}
+
+// Sum sets Metrics and Values for the collect and report intervals.
+func (e *Estimate) Sum(collect, report uint) {
+	e.Collect = collect
+	e.Report = report
+	e.Metrics = 0
+	e.Values = 0
+	for _, g := range e.Groups {
+		interval := g.Interval
+		if interval < collect {
+			interval = collect
+		}
+		n := uint(1)
+		if interval > 0 && report > interval {
+			n = report / interval
+		}
+		e.Metrics += g.Metrics
+		e.Values += g.Metrics * n
+	}
+}
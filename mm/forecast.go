@@ -0,0 +1,120 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+/**
+ * A Forecaster predicts when a resource will be exhausted, e.g. when a disk
+ * will be full, by fitting a line (least squares) to a trailing window of
+ * samples.  Monitors sample the resource every FORECAST_SAMPLE_INTERVAL
+ * seconds and, if it will be exhausted within Config.ForecastHours, send an
+ * event so there's time to act, at most once per FORECAST_EVENT_INTERVAL so
+ * the same prediction isn't sent every minute.
+ */
+
+const (
+	FORECAST_SAMPLE_INTERVAL = 60   // 1 minute
+	FORECAST_WINDOW          = 60   // samples, so 1 hour
+	FORECAST_MIN_SAMPLES     = 10   // don't predict from fewer samples
+	FORECAST_EVENT_INTERVAL  = 3600 // 1 hour
+)
+
+type Forecaster struct {
+	ts          []int64 // ring buffer, same index as vals
+	vals        []float64
+	n           int // samples in ring
+	i           int // next sample goes here
+	lastTs      int64
+	lastEventTs int64
+}
+
+func NewForecaster() *Forecaster {
+	f := &Forecaster{
+		ts:   make([]int64, FORECAST_WINDOW),
+		vals: make([]float64, FORECAST_WINDOW),
+	}
+	return f
+}
+
+// Due returns true if it's time to sample the resource at ts.
+func (f *Forecaster) Due(ts int64) bool {
+	return f.lastTs == 0 || ts-f.lastTs >= FORECAST_SAMPLE_INTERVAL
+}
+
+// Add samples the resource's value at ts.
+func (f *Forecaster) Add(ts int64, val float64) {
+	f.ts[f.i] = ts
+	f.vals[f.i] = val
+	f.i = (f.i + 1) % len(f.vals)
+	if f.n < len(f.vals) {
+		f.n++
+	}
+	f.lastTs = ts
+}
+
+// ExhaustIn returns the seconds from the last sample until the trend reaches
+// limit, or false if it's not trending toward limit or there are too few
+// samples.  The resource can be decreasing toward limit, e.g. disk free
+// space toward 0, or increasing toward it, e.g. used space toward the size
+// of the filesystem.
+func (f *Forecaster) ExhaustIn(limit float64) (float64, bool) {
+	if f.n < FORECAST_MIN_SAMPLES {
+		return 0, false
+	}
+
+	// Least squares fit: val = a + b*t, with t relative to the last sample
+	// so the numbers stay small.
+	var sumT, sumV, sumTT, sumTV float64
+	for j := 0; j < f.n; j++ {
+		t := float64(f.ts[j] - f.lastTs)
+		v := f.vals[j]
+		sumT += t
+		sumV += v
+		sumTT += t * t
+		sumTV += t * v
+	}
+	n := float64(f.n)
+	d := n*sumTT - sumT*sumT
+	if d == 0 {
+		return 0, false
+	}
+	b := (n*sumTV - sumT*sumV) / d
+	a := (sumV - b*sumT) / n // value at the last sample (t=0)
+	if b == 0 {
+		return 0, false
+	}
+	eta := (limit - a) / b
+	if eta <= 0 {
+		return 0, false // trending away from limit, or already past it
+	}
+	return eta, true
+}
+
+// Check returns the seconds until the resource reaches limit if that's within
+// hours and an event should be sent: not more than once per
+// FORECAST_EVENT_INTERVAL.
+func (f *Forecaster) Check(limit float64, hours uint) (float64, bool) {
+	eta, ok := f.ExhaustIn(limit)
+	if !ok || eta > float64(hours)*3600 {
+		return 0, false
+	}
+	if f.lastEventTs > 0 && f.lastTs-f.lastEventTs < FORECAST_EVENT_INTERVAL {
+		return 0, false
+	}
+	f.lastEventTs = f.lastTs
+	return eta, true
+}
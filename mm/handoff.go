@@ -0,0 +1,121 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * When the agent restarts (see pct/handoff.go), mm hands off the last value
+ * of every counter so the new agent's first collection has a rate: without
+ * the baseline, a counter's first value only primes it, so the interval in
+ * which the agent restarted would have no counter stats.  Monitors don't
+ * change anything in what they monitor, so they're simply stopped.  The
+ * baselines are only used by the monitors started with the new agent, and
+ * not if they're older than pct.HANDOFF_MAX_AGE, i.e. the rate would span
+ * a long gap in collection.  Gauges and the stats of the old agent's last
+ * interval aren't handed off; that interval is reported by the new agent.
+ */
+
+const HANDOFF_NAME = "mm"
+
+// A CounterBaseline is a counter's last value and when it was collected.
+type CounterBaseline struct {
+	Ts    int64 // Unix
+	Value float64
+}
+
+func (b CounterBaseline) current(ts int64) bool {
+	return ts > b.Ts && ts-b.Ts <= int64(pct.HANDOFF_MAX_AGE/time.Second)
+}
+
+// SetBaselines sets the counter baselines for the first values of the
+// counters, keyed on service-instanceId and metric name.  The map isn't
+// changed, so aggregators can share it.  Call before Start.
+// @goroutine[0]
+func (a *Aggregator) SetBaselines(baselines map[string]map[string]CounterBaseline) {
+	a.baselines = baselines
+}
+
+// Baselines returns the last value of every counter, keyed on
+// service-instanceId and metric name.  Call after Stop.
+// @goroutine[0]
+func (a *Aggregator) Baselines() map[string]map[string]CounterBaseline {
+	baselines := make(map[string]map[string]CounterBaseline)
+	for _, is := range a.last {
+		counters := make(map[string]CounterBaseline)
+		for name, stats := range is.Stats {
+			if b, ok := stats.Baseline(); ok {
+				counters[name] = b
+			}
+		}
+		if len(counters) > 0 {
+			baselines[fmt.Sprintf("%s-%d", is.Service, is.InstanceId)] = counters
+		}
+	}
+	return baselines
+}
+
+// Handoff implements pct.StateHandoff: monitors and aggregators are stopped
+// and the counter baselines are saved for the next agent.
+// @goroutine[0]
+func (m *Manager) Handoff(h *pct.Handoff) error {
+	m.logger.Debug("Handoff:call")
+	defer m.logger.Debug("Handoff:return")
+
+	m.mux.RLock()
+	aggregators := make([]*Aggregator, 0, len(m.aggregators))
+	for _, a := range m.aggregators {
+		aggregators = append(aggregators, a.aggregator)
+	}
+	m.mux.RUnlock()
+
+	if err := m.Stop(); err != nil {
+		return err
+	}
+
+	baselines := make(map[string]map[string]CounterBaseline)
+	for _, a := range aggregators {
+		for key, counters := range a.Baselines() {
+			baselines[key] = counters
+		}
+	}
+	if err := h.Put(HANDOFF_NAME, baselines); err != nil {
+		return err
+	}
+	m.logger.Info(fmt.Sprintf("Handed off counters of %d instances", len(baselines)))
+	return nil
+}
+
+// Resume implements pct.StateHandoff: counters of the monitors started by
+// Start have the previous agent's last values as baselines.  Call before
+// Start().
+// @goroutine[0]
+func (m *Manager) Resume(h *pct.Handoff) error {
+	baselines := make(map[string]map[string]CounterBaseline)
+	ok, err := h.Take(HANDOFF_NAME, &baselines)
+	if err != nil || !ok {
+		return err
+	}
+	m.baselines = baselines
+	return nil
+}
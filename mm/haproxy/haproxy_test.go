@@ -0,0 +1,170 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package haproxy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/haproxy"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var sample = test.RootDir + "/mm/haproxy"
+
+type TestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+	tmpDir  string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-haproxy-test")
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "mm-haproxy-test-")
+	t.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownSuite(t *C) {
+	os.RemoveAll(s.tmpDir)
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestParseStats(t *C) {
+	content, err := ioutil.ReadFile(sample + "/stats001.csv")
+	t.Assert(err, IsNil)
+	stats, err := haproxy.ParseStats(content)
+	t.Assert(err, IsNil)
+	t.Assert(stats, HasLen, 7)
+
+	db2 := stats[4]
+	t.Check(db2.Proxy, Equals, "mysql-write")
+	t.Check(db2.Server, Equals, "db2")
+	t.Check(db2.Type, Equals, haproxy.TYPE_SERVER)
+	t.Check(db2.Status, Equals, "DOWN")
+	t.Check(db2.Up(), Equals, false)
+
+	backend := stats[5]
+	t.Check(backend.Type, Equals, haproxy.TYPE_BACKEND)
+	t.Check(haproxy.StatMetrics(backend), DeepEquals, []mm.Metric{
+		{Name: "haproxy/mysql-write/BACKEND/up", Type: "gauge", Number: 1},
+		{Name: "haproxy/mysql-write/BACKEND/qcur", Type: "gauge", Number: 4},
+		{Name: "haproxy/mysql-write/BACKEND/scur", Type: "gauge", Number: 12},
+		{Name: "haproxy/mysql-write/BACKEND/rate", Type: "gauge", Number: 5},
+		{Name: "haproxy/mysql-write/BACKEND/stot", Type: "counter", Number: 12000},
+		{Name: "haproxy/mysql-write/BACKEND/bin", Type: "counter", Number: 10485760},
+		{Name: "haproxy/mysql-write/BACKEND/bout", Type: "counter", Number: 20971520},
+		{Name: "haproxy/mysql-write/BACKEND/econ", Type: "counter", Number: 3},
+		{Name: "haproxy/mysql-write/BACKEND/eresp", Type: "counter", Number: 1},
+		{Name: "haproxy/mysql-write/BACKEND/wretr", Type: "counter", Number: 0},
+		{Name: "haproxy/mysql-write/BACKEND/wredis", Type: "counter", Number: 0},
+		{Name: "haproxy/mysql-write/BACKEND/downtime", Type: "counter", Number: 0},
+	})
+
+	_, err = haproxy.ParseStats([]byte(""))
+	t.Check(err, NotNil)
+}
+
+func (s *TestSuite) TestSocket(t *C) {
+	content, err := ioutil.ReadFile(sample + "/stats001.csv")
+	t.Assert(err, IsNil)
+
+	// Fake stats socket: one "show stat" per connection, like HAProxy.
+	var mux sync.Mutex
+	socket := filepath.Join(s.tmpDir, "haproxy.sock")
+	l, err := net.Listen("unix", socket)
+	t.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 64)
+			conn.Read(buf)
+			if bytes.HasPrefix(buf, []byte("show stat\n")) {
+				mux.Lock()
+				conn.Write(content)
+				mux.Unlock()
+			}
+			conn.Close()
+		}
+	}()
+
+	config := &haproxy.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "haproxy", InstanceId: 1},
+			Collect:         1,
+			Report:          60,
+		},
+		Socket:  socket,
+		Proxies: []string{"mysql-*"},
+	}
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	m := haproxy.NewMonitor("mm-haproxy-1", config, s.logger)
+	err = m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	tickChan <- time.Now()
+	got := test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	up := map[string]float64{}
+	for _, metric := range got[0].Metrics {
+		if metric.Name[len(metric.Name)-3:] == "/up" {
+			up[metric.Name] = metric.Number
+		}
+	}
+	// No stats proxy, no frontends.
+	t.Check(up, DeepEquals, map[string]float64{
+		"haproxy/mysql-write/db1/up":     1,
+		"haproxy/mysql-write/db2/up":     0,
+		"haproxy/mysql-write/BACKEND/up": 1,
+	})
+	t.Check(got[0].Events, HasLen, 0)
+
+	// db1 goes down.
+	mux.Lock()
+	content = bytes.Replace(content, []byte(",UP,1,1,0,0,0,86400"), []byte(",DOWN,1,1,0,1,1,5"), 1)
+	mux.Unlock()
+	tickChan <- time.Now()
+	got = test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Assert(got[0].Events, HasLen, 1)
+	t.Check(got[0].Events[0].Type, Equals, "haproxy/mysql-write/db1/down")
+	t.Check(got[0].Events[0].Level, Equals, mm.EVENT_WARNING)
+	t.Check(got[0].Events[0].Message, Equals, "mysql-write/db1 is DOWN")
+}
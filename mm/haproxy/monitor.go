@@ -0,0 +1,297 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * The HAProxy monitor reads "show stat" from the stats socket (Config.Socket)
+ * or the CSV stats page (Config.URL) on every tick.  For every backend and
+ * server it reports the fields in statFields and up (1 or 0) as
+ * haproxy/<backend>/<server>/<field>, where <server> is BACKEND for the
+ * backend totals, e.g. haproxy/mysql-write/BACKEND/scur.  An event is sent
+ * when a backend or server goes down or comes back up.
+ */
+
+type Monitor struct {
+	name   string
+	config *Config
+	logger *pct.Logger
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+	proxies        *pct.GlobMatcher // nil if all
+	up             map[string]bool  // last state, keyed on <backend>/<server>
+}
+
+func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
+	m := &Monitor{
+		name:   name,
+		config: config,
+		logger: logger,
+		// --
+		status: pct.NewStatus([]string{name}),
+		sync:   pct.NewSyncChan(),
+		up:     make(map[string]bool),
+	}
+	if len(config.Proxies) > 0 {
+		m.proxies = pct.NewGlobMatcher(config.Proxies)
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("HAProxy monitor crashed: ", err)
+		}
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	var lastTs int64
+	var lastError string
+	for {
+		t := time.Unix(lastTs, 0)
+		if lastError == "" {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(t)))
+		} else {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s, error: %s)", pct.TimeString(t), lastError))
+		}
+
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			m.status.Update(m.name, "Running")
+
+			c, err := m.collect(now)
+			if err != nil {
+				if err.Error() != lastError {
+					m.logger.Warn(err) // once, not every tick
+				}
+				lastError = err.Error()
+				continue
+			}
+
+			// Send the metrics to the aggregator.
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
+				select {
+				case m.collectionChan <- c:
+					lastTs = c.Ts
+					lastError = ""
+				case <-time.After(500 * time.Millisecond):
+					// lost collection
+					m.logger.Debug("Lost HAProxy metrics; timeout spooling after 500ms")
+					lastError = "Spool timeout"
+				}
+			} else {
+				m.logger.Debug("run:no metrics")
+				lastError = "No metrics"
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+func (m *Monitor) collect(now time.Time) (*mm.Collection, error) {
+	content, err := m.readStats()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := ParseStats(content)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+	for _, stat := range stats {
+		if stat.Type != TYPE_BACKEND && stat.Type != TYPE_SERVER {
+			continue
+		}
+		if m.proxies != nil && !m.proxies.Match(stat.Proxy) {
+			continue
+		}
+		c.Metrics = append(c.Metrics, StatMetrics(stat)...)
+
+		key := stat.Proxy + "/" + stat.Server
+		lastUp, seen := m.up[key]
+		up := stat.Up()
+		m.up[key] = up
+		if seen && lastUp != up {
+			e := mm.Event{
+				Ts:      c.Ts,
+				Type:    "haproxy/" + key + "/up",
+				Level:   mm.EVENT_INFO,
+				Message: fmt.Sprintf("%s is %s", key, stat.Status),
+			}
+			if !up {
+				e.Type = "haproxy/" + key + "/down"
+				e.Level = mm.EVENT_WARNING
+			}
+			c.Events = append(c.Events, e)
+		}
+	}
+	return c, nil
+}
+
+// StatMetrics returns the metrics for one backend or server.
+func StatMetrics(stat Stat) []mm.Metric {
+	prefix := "haproxy/" + stat.Proxy + "/" + stat.Server + "/"
+	up := 0.0
+	if stat.Up() {
+		up = 1
+	}
+	metrics := []mm.Metric{{Name: prefix + "up", Type: "gauge", Number: up}}
+	for _, field := range statFields {
+		value, ok := stat.Values[field.name]
+		if !ok || value == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		metrics = append(metrics, mm.Metric{Name: prefix + field.name, Type: field.mtype, Number: n})
+	}
+	return metrics
+}
+
+func (m *Monitor) readStats() ([]byte, error) {
+	timeout := time.Duration(m.config.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DEFAULT_TIMEOUT * time.Millisecond
+	}
+
+	if m.config.Socket != "" {
+		conn, err := net.DialTimeout("unix", m.config.Socket, timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte("show stat\n")); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(conn) // HAProxy closes the connection after one command
+	}
+
+	if m.config.URL != "" {
+		url := m.config.URL
+		if !strings.HasSuffix(url, ";csv") {
+			url += ";csv"
+		}
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(url) // user:pass in the URL is sent as basic auth
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", pct.RedactDSN(url), resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	return nil, fmt.Errorf("HAProxy monitor config has no Socket or URL")
+}
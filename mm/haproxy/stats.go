@@ -0,0 +1,109 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package haproxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Types of rows in HAProxy stats, the "type" field.
+const (
+	TYPE_FRONTEND = 0
+	TYPE_BACKEND  = 1
+	TYPE_SERVER   = 2
+	TYPE_LISTENER = 3
+)
+
+// Stats fields collected for backends and servers.  Fields that a row
+// doesn't have, e.g. qcur for a backend without queueing, are empty and
+// not reported.
+var statFields = []struct {
+	name  string
+	mtype string
+}{
+	{"qcur", "gauge"},    // queued requests
+	{"scur", "gauge"},    // current sessions
+	{"rate", "gauge"},    // sessions per second over the last second
+	{"stot", "counter"},  // total sessions
+	{"bin", "counter"},   // bytes in
+	{"bout", "counter"},  // bytes out
+	{"econ", "counter"},  // connection errors
+	{"eresp", "counter"}, // response errors
+	{"wretr", "counter"}, // retries
+	{"wredis", "counter"},
+	{"chkfail", "counter"}, // failed health checks
+	{"downtime", "counter"},
+	{"hrsp_5xx", "counter"},
+}
+
+// A Stat is one row of HAProxy "show stat" CSV.
+type Stat struct {
+	Proxy  string // pxname
+	Server string // svname: BACKEND, FRONTEND, or the server name
+	Type   int
+	Status string // UP, DOWN, UP 1/3, MAINT, no check, etc.
+	Values map[string]string
+}
+
+// Up returns true unless the server or backend is down or in maintenance.
+func (s Stat) Up() bool {
+	return !strings.HasPrefix(s.Status, "DOWN") && !strings.HasPrefix(s.Status, "MAINT")
+}
+
+// ParseStats parses HAProxy stats CSV.  The first line is the header,
+// which starts with "# ".  Fields vary by HAProxy version, so they're
+// looked up by name.
+func ParseStats(content []byte) ([]Stat, error) {
+	content = bytes.TrimPrefix(content, []byte("# "))
+	r := csv.NewReader(bytes.NewReader(content))
+	r.FieldsPerRecord = -1 // trailing empty field
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("No header in HAProxy stats")
+	}
+	header := records[0]
+
+	stats := []Stat{}
+	for _, record := range records[1:] {
+		values := make(map[string]string, len(header))
+		for i, field := range header {
+			if i < len(record) && field != "" {
+				values[field] = record[i]
+			}
+		}
+		t, err := strconv.Atoi(values["type"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid HAProxy stats type: %s", values["type"])
+		}
+		stats = append(stats, Stat{
+			Proxy:  values["pxname"],
+			Server: values["svname"],
+			Type:   t,
+			Status: values["status"],
+			Values: values,
+		})
+	}
+	return stats, nil
+}
@@ -32,8 +32,9 @@ import (
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/ticker"
-	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -45,6 +46,7 @@ import (
 type Binding struct {
 	aggregator     *Aggregator
 	collectionChan chan *Collection // <- metrics from monitors
+	buffer         *CollectionBuffer
 }
 
 type Manager struct {
@@ -55,11 +57,15 @@ type Manager struct {
 	im      *instance.Repo
 	// --
 	monitors    map[string]Monitor
+	hashes      map[string]string // pct.ConfigHash of monitors' StartService data
 	running     bool
-	mux         *sync.RWMutex // guards monitors and running
+	mux         *sync.RWMutex // guards monitors, hashes, blackouts, and running
 	status      *pct.Status
 	aggregators map[uint]*Binding
 	mrm         mrms.Monitor
+	factories   map[string]MonitorFactory // registered, keyed on service prefix
+	blackouts   map[string]*pct.BlackoutTicker
+	baselines   map[string]map[string]CounterBaseline // from Resume, only for Start, see handoff.go
 }
 
 func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager, spool data.Spooler, im *instance.Repo, mrm mrms.Monitor) *Manager {
@@ -71,11 +77,18 @@ func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager
 		im:      im,
 		// --
 		monitors:    make(map[string]Monitor),
-		status:      pct.NewStatus([]string{"mm"}),
+		hashes:      make(map[string]string),
+		status:      pct.NewStatus([]string{"mm", "mm-factories"}),
 		aggregators: make(map[uint]*Binding),
 		mux:         &sync.RWMutex{},
 		mrm:         mrm,
+		factories:   make(map[string]MonitorFactory),
+		blackouts:   make(map[string]*pct.BlackoutTicker),
 	}
+	for prefix, f := range monitorFactories {
+		m.factories[prefix] = f
+	}
+	m.updateFactoriesStatus()
 	return m
 }
 
@@ -101,7 +114,7 @@ func (m *Manager) Start() error {
 	}
 
 	for _, configFile := range configFiles {
-		data, err := ioutil.ReadFile(configFile)
+		data, err := pct.Basedir.ReadConfigFile(configFile)
 		if err != nil {
 			m.logger.Error("Read " + configFile + ": " + err.Error())
 			continue
@@ -125,6 +138,7 @@ func (m *Manager) Start() error {
 	}
 
 	m.running = true
+	m.baselines = nil
 
 	m.logger.Info("Started")
 	m.status.Update("mm", "Running")
@@ -142,7 +156,19 @@ func (m *Manager) Stop() error {
 			continue
 		}
 		m.clock.Remove(monitor.TickChan())
+		if bt, ok := m.blackouts[name]; ok {
+			m.clock.Remove(bt.TickChan())
+			bt.Stop()
+			delete(m.blackouts, name)
+		}
 		delete(m.monitors, name)
+		delete(m.hashes, name)
+	}
+	// Stop the buffers before their aggregators which they send to.
+	for report, a := range m.aggregators {
+		a.buffer.Stop()
+		a.aggregator.Stop()
+		delete(m.aggregators, report)
 	}
 	m.running = false
 	m.logger.Info("Stopped")
@@ -165,27 +191,72 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		m.status.UpdateRe("mm", "Starting "+name, cmd)
 		m.logger.Info("Start", name, cmd)
 
-		// Monitors names must be unique.
+		// Monitors names must be unique, but the API re-sends StartService
+		// for running monitors to reconcile configs.  If the config is the
+		// same, there's nothing to do, else the monitor is restarted with the
+		// new config below, after the new config is checked and its monitor made.
+		hash, err := pct.ConfigHash(cmd.Data)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
 		m.mux.RLock()
-		_, haveMonitor := m.monitors[name]
+		oldMonitor, haveMonitor := m.monitors[name]
+		sameConfig := haveMonitor && m.hashes[name] == hash
 		m.mux.RUnlock()
-		if haveMonitor {
-			return cmd.Reply(nil, errors.New("Duplicate monitor: "+name))
+		if sameConfig {
+			m.logger.Info(name, "is running with the same config")
+			return cmd.Reply(nil) // success
+		}
+
+		// Check the profile, derived metrics, and percentiles before making
+		// the monitor so an invalid config fails the command.
+		if err := mm.ApplyProfile(); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		derived, err := MakeDerivedMetrics(mm.Derived)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+		for _, p := range mm.Percentiles {
+			if p <= 0 || p >= 100 {
+				return cmd.Reply(nil, fmt.Errorf("Invalid percentile: %g: must be > 0 and < 100", p))
+			}
+		}
+		if mm.Rollup && mm.Service != "server" {
+			return cmd.Reply(nil, errors.New("Rollup is only valid for the server service, not "+mm.Service))
+		}
+		blackout, err := pct.NewBlackout(mm.Blackout)
+		if err != nil {
+			return cmd.Reply(nil, err)
 		}
 
 		// Create the monitor based on its type.
-		monitor, err := m.factory.Make(mm.Service, mm.InstanceId, cmd.Data)
+		monitor, err := m.monitorFactory(mm.Service).Make(mm.Service, mm.InstanceId, cmd.Data)
 		if err != nil {
 			return cmd.Reply(nil, errors.New("Factory: "+err.Error()))
 		}
 
-		// Make synchronized (3rd arg=true) ticker for collect interval.  It's
-		// synchronized so all data aligns in charts, else we can get MySQL metrics
-		// at 00:03 and system metrics at 00:05 and other metrics at 00:06 which
-		// makes it very difficult to see all metrics at a single point in time
-		// or meaningfully compare a single interval, e.g. 00:00 to 00:05.
-		tickChan := make(chan time.Time)
-		m.clock.Add(tickChan, mm.Collect, true)
+		var statsd *StatsD
+		if mm.StatsD != "" {
+			logger := pct.NewLogger(m.logger.LogChan(), "mm-statsd-"+name)
+			statsd, err = NewStatsD(logger, mm.StatsD, mm.StatsDSampleRate, mm.StatsDTags)
+			if err != nil {
+				return cmd.Reply(nil, err)
+			}
+		}
+
+		// If the new monitor fails to start, the old one is started again
+		// with its config, like the agent starts it from its config file.
+		var oldConfig []byte
+		if haveMonitor {
+			m.logger.Info("Restarting", name, "with new config")
+			if oldConfig, err = json.Marshal(oldMonitor.Config()); err != nil {
+				return cmd.Reply(nil, errors.New("Restart "+name+": "+err.Error()))
+			}
+			if err := m.stopMonitor(name, oldMonitor, mm.ServiceInstance); err != nil {
+				return cmd.Reply(nil, errors.New("Restart "+name+": "+err.Error()))
+			}
+		}
 
 		// We need one aggregator for each unique report interval.  There's usually
 		// just one: 60s.  Remember: report interval != collect interval.  Monitors
@@ -193,24 +264,78 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		// at the same 60s interval, or different report intervals.
 		a, ok := m.aggregators[mm.Report]
 		if !ok {
-			// Make new aggregator for this report interval.
+			// Make new aggregator for this report interval.  Monitors send
+			// to a buffer in front of it so they don't lose collections if
+			// it stalls.  The first monitor's Buffer config sets its size.
 			logger := pct.NewLogger(m.logger.LogChan(), fmt.Sprintf("mm-ag-%d", mm.Report))
 			collectionChan := make(chan *Collection, 5)
 			aggregator := NewAggregator(logger, int64(mm.Report), collectionChan, m.spool)
+			aggregator.SetBaselines(m.baselines)
 			aggregator.Start()
+			buffer := NewCollectionBuffer(logger, mm.Buffer, collectionChan)
+			buffer.Start()
 
 			// Save aggregator for other monitors with same report interval.
-			a = &Binding{aggregator, collectionChan}
+			a = &Binding{aggregator, buffer.In(), buffer}
 			m.aggregators[mm.Report] = a
 			m.logger.Info("Created", mm.Report, "second aggregator")
 		}
 
+		a.aggregator.SetDerived(mm.ServiceInstance, derived)
+		a.aggregator.SetPercentiles(mm.ServiceInstance, mm.Percentiles)
+		a.aggregator.SetAnomaly(mm.ServiceInstance, mm.AnomalySigma, mm.AnomalyWindow)
+		a.aggregator.SetStatsD(mm.ServiceInstance, statsd)
+		if mm.Rollup {
+			a.aggregator.SetRollup(mm.ServiceInstance, true)
+		}
+
+		// Make synchronized (3rd arg=true) ticker for collect interval.  It's
+		// synchronized so all data aligns in charts, else we can get MySQL metrics
+		// at 00:03 and system metrics at 00:05 and other metrics at 00:06 which
+		// makes it very difficult to see all metrics at a single point in time
+		// or meaningfully compare a single interval, e.g. 00:00 to 00:05.
+		tickChan := make(chan time.Time)
+
+		// During a blackout, ticks are dropped so the monitor doesn't collect,
+		// and its start and end are marked with events, see blackout.go.
+		clockChan := tickChan
+		var blackoutTicker *pct.BlackoutTicker
+		if len(mm.Blackout) > 0 {
+			blackoutTicker = pct.NewBlackoutTicker(blackout, tickChan, blackoutMarker(mm.ServiceInstance, a.collectionChan))
+			blackoutTicker.Start()
+			clockChan = blackoutTicker.TickChan()
+		}
+		m.clock.Add(clockChan, mm.Collect, true)
+
 		// Start the monitor.
+		if qm, ok := monitor.(CollectionQueueMonitor); ok {
+			qm.SetCollectionQueue(a.buffer.Len)
+		}
 		if err := monitor.Start(tickChan, a.collectionChan); err != nil {
-			return cmd.Reply(nil, errors.New("Start "+name+": "+err.Error()))
+			m.clock.Remove(clockChan)
+			if blackoutTicker != nil {
+				blackoutTicker.Stop()
+			}
+			err = errors.New("Start " + name + ": " + err.Error())
+			if oldConfig != nil {
+				m.logger.Warn(err.Error() + ", restarting with old config")
+				restart := &proto.Cmd{
+					Ts:   time.Now().UTC(),
+					Cmd:  "StartService",
+					Data: oldConfig,
+				}
+				if reply := m.Handle(restart); reply.Error != "" {
+					m.logger.Error("Restart " + name + " with old config: " + reply.Error)
+				}
+			}
+			return cmd.Reply(nil, err)
 		}
 		m.mux.Lock()
 		m.monitors[name] = monitor
+		m.hashes[name] = hash
+		if blackoutTicker != nil {
+			m.blackouts[name] = blackoutTicker
+		}
 		m.mux.Unlock()
 
 		// Save the monitor-specific config to disk so agent starts on restart.
@@ -221,7 +346,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 		return cmd.Reply(nil) // success
 	case "StopService":
-		_, name, err := m.getMonitorConfig(cmd)
+		mm, name, err := m.getMonitorConfig(cmd)
 		if err != nil {
 			return cmd.Reply(nil, err)
 		}
@@ -233,23 +358,44 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		if !ok {
 			return cmd.Reply(nil, errors.New("Unknown monitor: "+name))
 		}
-		if err := monitor.Stop(); err != nil {
-			return cmd.Reply(nil, errors.New("Stop "+name+": "+err.Error()))
+		if err := m.stopMonitor(name, monitor, mm.ServiceInstance); err != nil {
+			return cmd.Reply(nil, err)
 		}
-		m.clock.Remove(monitor.TickChan())
 		if err := pct.Basedir.RemoveConfig(name); err != nil {
 			return cmd.Reply(nil, errors.New("Remove "+name+": "+err.Error()))
 		}
-		m.mux.Lock()
-		delete(m.monitors, name)
-		m.mux.Unlock()
 		return cmd.Reply(nil) // success
 	case "GetConfig":
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
+	case "EstimateMetrics":
+		// cmd.Data is a config like StartService, but the monitor only
+		// estimates the metrics it would collect; it's not started.
+		mm, name, err := m.getMonitorConfig(cmd)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+		m.status.UpdateRe("mm", "Estimating "+name, cmd)
+		if err := mm.ApplyProfile(); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		estimator, ok := m.monitorFactory(mm.Service).(MetricEstimator)
+		if !ok {
+			return cmd.Reply(nil, errors.New("Cannot estimate metrics for "+mm.Service+" monitors"))
+		}
+		estimate, err := estimator.Estimate(mm.Service, mm.InstanceId, cmd.Data)
+		if err != nil {
+			return cmd.Reply(nil, errors.New("Factory: "+err.Error()))
+		}
+		if len(mm.Derived) > 0 {
+			estimate.Add("derived", uint(len(mm.Derived)), mm.Report, "")
+		}
+		estimate.ServiceInstance = mm.ServiceInstance
+		estimate.Sum(mm.Collect, mm.Report)
+		return cmd.Reply(estimate)
 	default:
 		// SetConfig does not work by design.  To re-configure a monitor,
-		// stop it then start it again with the new config.
+		// start it again with the new config: it's restarted if the config changed.
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
 }
@@ -262,6 +408,16 @@ func (m *Manager) Status() map[string]string {
 	for _, monitor := range m.monitors {
 		monitorStatus := monitor.Status()
 		for k, v := range monitorStatus {
+			// Registered monitors can use any status names, but they
+			// cannot overwrite ours.
+			if k == "mm" || k == "mm-factories" {
+				continue
+			}
+			status[k] = v
+		}
+	}
+	for _, a := range m.aggregators {
+		for k, v := range a.aggregator.Status() {
 			status[k] = v
 		}
 	}
@@ -309,6 +465,103 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return configs, errs
 }
 
+// Reload applies changes to the monitors' saved configs: monitors with new or changed
+// configs are (re)started and monitors whose configs were removed are stopped.
+func (m *Manager) Reload() []error {
+	return pct.ReloadServices(m, "mm-*.conf")
+}
+
+// RegisterMonitorFactory makes the manager use f instead of its factory to
+// make monitors for services whose name begins with prefix.  The longest
+// matching prefix wins, so "appliance-db" can override "appliance".
+// Monitors are made when started, including from saved configs in Start(),
+// so register factories before calling Start().
+func (m *Manager) RegisterMonitorFactory(prefix string, f MonitorFactory) error {
+	if prefix == "" {
+		return errors.New("Empty monitor factory prefix")
+	}
+	if f == nil {
+		return errors.New("Nil monitor factory for " + prefix)
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.factories[prefix]; ok {
+		return errors.New("Duplicate monitor factory: " + prefix)
+	}
+	m.factories[prefix] = f
+	m.updateFactoriesStatus()
+	return nil
+}
+
+func (m *Manager) monitorFactory(service string) MonitorFactory {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	factory := m.factory
+	match := ""
+	for prefix, f := range m.factories {
+		if strings.HasPrefix(service, prefix) && len(prefix) > len(match) {
+			factory = f
+			match = prefix
+		}
+	}
+	return factory
+}
+
+// Capabilities returns the monitors the factory can make plus the services
+// of registered factories, for agent cmd Capabilities.
+func (m *Manager) Capabilities() []string {
+	caps := []string{}
+	if r, ok := m.factory.(pct.CapabilityReporter); ok {
+		caps = append(caps, r.Capabilities()...)
+	}
+	m.mux.RLock()
+	for prefix := range m.factories {
+		caps = append(caps, "monitor:"+prefix)
+	}
+	m.mux.RUnlock()
+	sort.Strings(caps)
+	return caps
+}
+
+// stopMonitor stops the monitor and forgets it, for StopService and to restart
+// it with a new config.  Its config file is not removed.
+func (m *Manager) stopMonitor(name string, monitor Monitor, si proto.ServiceInstance) error {
+	if err := monitor.Stop(); err != nil {
+		return errors.New("Stop " + name + ": " + err.Error())
+	}
+	m.clock.Remove(monitor.TickChan())
+	m.mux.Lock()
+	if bt, ok := m.blackouts[name]; ok {
+		m.clock.Remove(bt.TickChan())
+		bt.Stop()
+		delete(m.blackouts, name)
+	}
+	m.mux.Unlock()
+	for _, a := range m.aggregators {
+		a.aggregator.SetDerived(si, nil)
+		a.aggregator.SetPercentiles(si, nil)
+		a.aggregator.SetAnomaly(si, 0, 0)
+		a.aggregator.SetStatsD(si, nil)
+		a.aggregator.SetRollup(si, false)
+		a.aggregator.Forget(si)
+	}
+	m.mux.Lock()
+	delete(m.monitors, name)
+	delete(m.hashes, name)
+	m.mux.Unlock()
+	return nil
+}
+
+// Caller must lock mux, or not need to (NewManager).
+func (m *Manager) updateFactoriesStatus() {
+	prefixes := make([]string, 0, len(m.factories))
+	for prefix := range m.factories {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	m.status.Update("mm-factories", strings.Join(prefixes, ", "))
+}
+
 func (m *Manager) getMonitorConfig(cmd *proto.Cmd) (*Config, string, error) {
 	/**
 	 * cmd.Data is a monitor-specific config, e.g. mysql.Config.  But monitor-specific
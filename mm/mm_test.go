@@ -19,11 +19,14 @@ package mm_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -133,6 +136,52 @@ func (s *AggregatorTestSuite) TestC001(t *C) {
 		test.Dump(expect.Stats)
 		t.Fatal(diff)
 	}
+
+	// Status reports when the instance was last collected: c001-2's Ts.
+	t.Check(a.Status()["mm-mysql-1-last-collected"], Matches, "at 2009-11-10 23:05:01 UTC .+")
+	a.Forget(proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+	_, ok := a.Status()["mm-mysql-1-last-collected"]
+	t.Check(ok, Equals, false)
+}
+
+func (s *AggregatorTestSuite) TestLastCollectedMarkers(t *C) {
+	a := mm.NewAggregator(s.logger, 60, s.collectionChan, s.spool)
+	go a.Start()
+	defer a.Stop()
+
+	mysql1 := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	ts := int64(1420070400)
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: mysql1,
+		Ts:              ts,
+		Metrics:         []mm.Metric{{Name: "threads_running", Type: "gauge", Number: 1}},
+	}
+
+	// Blackout and dropped collections markers aren't collections.
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: mysql1,
+		Ts:              ts + 1,
+		Metrics:         []mm.Metric{},
+		Events:          []mm.Event{{Ts: ts + 1, Type: mm.EVENT_BLACKOUT, Level: mm.EVENT_INFO}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{Service: "agent"},
+		Ts:              ts + 2,
+		Metrics:         []mm.Metric{{Name: mm.DROPPED_COLLECTIONS, Type: "counter", Number: 1}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 2},
+		Ts:              ts + 3,
+		Metrics:         []mm.Metric{{Name: "threads_running", Type: "gauge", Number: 1}},
+	}
+	if !test.WaitStatusPrefix(1, a, "mm-mysql-2-last-collected", "at") {
+		t.Fatal("Timeout waiting for mm-mysql-2-last-collected")
+	}
+
+	status := a.Status()
+	t.Check(status["mm-mysql-1-last-collected"], Matches, "at 2015-01-01 00:00:00 UTC .+")
+	_, ok := status["mm-agent-0-last-collected"]
+	t.Check(ok, Equals, false)
 }
 
 func (s *AggregatorTestSuite) TestC002(t *C) {
@@ -494,6 +543,161 @@ func (s *AggregatorTestSuite) TestMissingAllMetrics(t *C) {
 	t.Check(got.Stats[0].Stats["foo"].Avg, Equals, float64(170))
 }
 
+func (s *AggregatorTestSuite) TestEvents(t *C) {
+	interval := int64(300)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	go a.Start()
+	defer a.Stop()
+
+	// 2009-11-10 23:00:00 and 23:00:01
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	event := mm.Event{Ts: 1257894001, Type: "mysql/checksum/diff", Level: mm.EVENT_WARNING, Message: "db.t has diffs"}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894000,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "gauge", Number: 1}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894001,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "gauge", Number: 2}},
+		Events:          []mm.Event{event},
+	}
+
+	// Next interval: events are reported with the stats for their interval.
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894300,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "gauge", Number: 3}},
+	}
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 1)
+	t.Check(got.Stats[0].Stats["foo"].Cnt, Equals, 2)
+	t.Check(got.Stats[0].Events, DeepEquals, []mm.Event{event})
+
+	// Events are not reported again in the next interval.
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894600,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "gauge", Number: 4}},
+	}
+	got = test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 1)
+	t.Check(got.Stats[0].Events, HasLen, 0)
+}
+
+func (s *AggregatorTestSuite) TestBlackout(t *C) {
+	interval := int64(300)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	go a.Start()
+	defer a.Stop()
+
+	// 2009-11-10 23:00:00: counter 100, blackout starts at 23:00:10 and
+	// ends at 23:01:40 when the counter is 1000, then it's 1010 at 23:01:50.
+	// The rate across the blackout (900/100s) isn't reported.
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	start := mm.Event{Ts: 1257894010, Type: mm.EVENT_BLACKOUT, Level: mm.EVENT_INFO, Message: "Blackout started, not collecting"}
+	end := mm.Event{Ts: 1257894100, Type: mm.EVENT_BLACKOUT_END, Level: mm.EVENT_INFO, Message: "Blackout ended, collecting"}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894000,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 100}},
+	}
+	s.collectionChan <- &mm.Collection{ServiceInstance: si, Ts: 1257894010, Metrics: []mm.Metric{}, Events: []mm.Event{start}}
+	s.collectionChan <- &mm.Collection{ServiceInstance: si, Ts: 1257894100, Metrics: []mm.Metric{}, Events: []mm.Event{end}}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894100,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 1000}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894110,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 1010}},
+	}
+
+	// Next interval.
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894300,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 1200}},
+	}
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 1)
+	t.Check(got.Stats[0].Events, DeepEquals, []mm.Event{start, end})
+	t.Check(got.Stats[0].Stats["foo"].Cnt, Equals, 1)
+	t.Check(got.Stats[0].Stats["foo"].Max, Equals, float64(1))
+}
+
+func (s *AggregatorTestSuite) TestHandoff(t *C) {
+	interval := int64(60)
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+
+	// The old agent collects 2009-11-10 23:00:00 and 23:00:10, then stops.
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	a.Start()
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894000,
+		Metrics: []mm.Metric{
+			{Name: "foo", Type: "counter", Number: 100},
+			{Name: "bar", Type: "gauge", Number: 5},
+		},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894010,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 110}},
+	}
+	a.Stop()
+	baselines := a.Baselines()
+	t.Check(baselines, DeepEquals, map[string]map[string]mm.CounterBaseline{
+		"mysql-1": {"foo": {Ts: 1257894010, Value: 110}},
+	})
+
+	// A baseline from long ago isn't used.
+	baselines["mysql-2"] = map[string]mm.CounterBaseline{"foo": {Ts: 1257890000, Value: 0}}
+	si2 := proto.ServiceInstance{Service: "mysql", InstanceId: 2}
+
+	// The new agent's first collection, at 23:00:20, has a rate.
+	a = mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	a.SetBaselines(baselines)
+	a.Start()
+	defer a.Stop()
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894020,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 130}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si2,
+		Ts:              1257894020,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 100}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si2,
+		Ts:              1257894040,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 120}},
+	}
+
+	// Next interval.
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894060,
+		Metrics:         []mm.Metric{{Name: "foo", Type: "counter", Number: 190}},
+	}
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 2)
+	t.Check(got.Stats[0].Stats["foo"].Cnt, Equals, 1)
+	t.Check(got.Stats[0].Stats["foo"].Max, Equals, float64(2))
+	t.Check(got.Stats[1].Stats["foo"].Cnt, Equals, 1)
+	t.Check(got.Stats[1].Stats["foo"].Max, Equals, float64(1))
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Manager test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -806,6 +1010,291 @@ func (s *ManagerTestSuite) TestRestartMonitor(t *C) {
 	t.Check(reply.Error, Not(Equals), "")
 }
 
+func (s *ManagerTestSuite) TestStartServiceAgain(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, s.im, mrm)
+	t.Assert(m, NotNil)
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	mmConfig := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+	}
+	mmConfigData, err := json.Marshal(mmConfig)
+	t.Assert(err, IsNil)
+	s.mysqlMonitor.SetConfig(mmConfig)
+
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "mm",
+		Cmd:     "StartService",
+		Data:    mmConfigData,
+	}
+	reply := m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{1})
+
+	// The API re-sends StartService with the same config to reconcile.
+	// It's not an error and the monitor isn't restarted.
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{1})
+	t.Check(s.clock.Removed, HasLen, 0)
+	t.Check(m.Status()["monitor"], Equals, "Running")
+
+	// With a different config, the monitor is restarted and its new config
+	// is saved.
+	mmConfig.Collect = 10
+	mmConfigData, err = json.Marshal(mmConfig)
+	t.Assert(err, IsNil)
+	s.mysqlMonitor.SetConfig(mmConfig)
+	cmd.Data = mmConfigData
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{1, 10})
+	t.Check(s.clock.Removed, HasLen, 1)
+	t.Check(m.Status()["monitor"], Equals, "Running")
+
+	data, err := ioutil.ReadFile(s.configDir + "/mm-mysql-1.conf")
+	t.Assert(err, IsNil)
+	gotConfig := &mysql.Config{}
+	err = json.Unmarshal(data, gotConfig)
+	t.Check(err, IsNil)
+	t.Check(gotConfig.Collect, Equals, uint(10))
+
+	// If the monitor fails to start with a new config, it's started again
+	// with its old config, not left stopped.
+	badConfig := *mmConfig
+	badConfig.Collect = 5
+	badConfigData, err := json.Marshal(badConfig)
+	t.Assert(err, IsNil)
+	s.mysqlMonitor.StartError = errors.New("bad config")
+	cmd.Data = badConfigData
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "Start mm-mysql-1: bad config")
+	t.Check(s.clock.Added, DeepEquals, []uint{1, 10, 5, 10})
+	t.Check(s.clock.Removed, HasLen, 3)
+	t.Check(m.Status()["monitor"], Equals, "Running")
+
+	data, err = ioutil.ReadFile(s.configDir + "/mm-mysql-1.conf")
+	t.Assert(err, IsNil)
+	gotConfig = &mysql.Config{}
+	err = json.Unmarshal(data, gotConfig)
+	t.Check(err, IsNil)
+	t.Check(gotConfig.Collect, Equals, uint(10))
+
+	// Stop the monitor so other tests start clean.
+	cmd.Data = mmConfigData
+	cmd.Cmd = "StopService"
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+}
+
+func (s *ManagerTestSuite) TestBlackout(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, s.im, mrm)
+	t.Assert(m, NotNil)
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	mmConfig := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect:  1,
+			Report:   60,
+			Blackout: []string{"0-29 2 * *"},
+		},
+	}
+	mmConfigData, err := json.Marshal(mmConfig)
+	t.Assert(err, IsNil)
+	s.mysqlMonitor.SetConfig(mmConfig)
+
+	// An invalid blackout fails the cmd.
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "mm",
+		Cmd:     "StartService",
+		Data:    mmConfigData,
+	}
+	reply := m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Matches, "Invalid blackout: 0-29 2 \\* \\*: .+")
+	t.Check(s.clock.Added, HasLen, 0)
+
+	// The clock ticks the blackout ticker, not the monitor, so both are
+	// removed when the monitor is stopped.
+	mmConfig.Blackout = []string{"0-29 2 * * *"}
+	mmConfigData, err = json.Marshal(mmConfig)
+	t.Assert(err, IsNil)
+	s.mysqlMonitor.SetConfig(mmConfig)
+	cmd.Data = mmConfigData
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{1})
+
+	cmd.Cmd = "StopService"
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Removed, HasLen, 2)
+}
+
+// Out-of-tree monitors register at init, before managers are made.  Only
+// once per process because it panics if the prefix is registered twice,
+// e.g. when the suite is rerun with go test -count.
+func init() {
+	mm.RegisterMonitorFactory("init-test", mock.NewMmMonitorFactory(map[string]mm.Monitor{
+		"init-test-1": mock.NewMmMonitor(),
+	}))
+}
+
+func (s *ManagerTestSuite) TestRegisterMonitorFactory(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, s.im, mrm)
+	t.Assert(m, NotNil)
+
+	applianceMonitor := mock.NewMmMonitor()
+	applianceFactory := mock.NewMmMonitorFactory(map[string]mm.Monitor{
+		"appliance-1": applianceMonitor,
+	})
+	err := m.RegisterMonitorFactory("appliance", applianceFactory)
+	t.Assert(err, IsNil)
+	err = m.RegisterMonitorFactory("appliance", applianceFactory)
+	t.Check(err, NotNil)
+	err = m.RegisterMonitorFactory("", applianceFactory)
+	t.Check(err, NotNil)
+
+	status := m.Status()
+	t.Check(status["mm-factories"], Equals, "appliance, init-test")
+
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// StartService for the appliance service uses the registered factory,
+	// not the default factory (which panics for unknown monitors).
+	mmConfig := &mm.Config{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    "appliance",
+			InstanceId: 1,
+		},
+		Collect: 1,
+		Report:  60,
+	}
+	applianceMonitor.SetConfig(mmConfig)
+	mmConfigData, err := json.Marshal(mmConfig)
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "mm",
+		Cmd:     "StartService",
+		Data:    mmConfigData,
+	}
+	reply := m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+
+	// Its status is merged, and its config is saved like any monitor.
+	status = m.Status()
+	t.Check(status["monitor"], Equals, "Running")
+	t.Check(pct.FileExists(s.configDir+"/mm-appliance-1.conf"), Equals, true)
+
+	cmd.Cmd = "StopService"
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(pct.FileExists(s.configDir+"/mm-appliance-1.conf"), Equals, false)
+}
+
+func (s *ManagerTestSuite) TestEstimateMetrics(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, s.im, mrm)
+	t.Assert(m, NotNil)
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// The factory estimates the monitor's metrics, the manager adds derived
+	// metrics and sums them for the collect and report intervals.
+	s.factory.Estimates = map[string]*mm.Estimate{
+		"mysql-1": &mm.Estimate{
+			Groups: []mm.EstimateGroup{
+				{Name: "status", Metrics: 300},
+				{Name: "userstats-tables", Metrics: 30000, Interval: 60},
+			},
+			Notes: []string{"performance_schema: 100 of 1000 instruments enabled (not collected by mm)"},
+		},
+	}
+	defer func() { s.factory.Estimates = nil }()
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 10,
+			Report:  60,
+			Derived: map[string]string{"mysql/qps": "mysql/queries / 60"},
+		},
+		UserStats:         true,
+		UserStatsInterval: 60,
+	}
+	data, err := json.Marshal(config)
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "mm",
+		Cmd:     "EstimateMetrics",
+		Data:    data,
+	}
+	reply := m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Assert(reply.Error, Equals, "")
+
+	got := &mm.Estimate{}
+	err = json.Unmarshal(reply.Data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Service, Equals, "mysql")
+	t.Check(got.InstanceId, Equals, uint(1))
+	t.Check(got.Groups, HasLen, 3)
+	t.Check(got.Groups[2].Name, Equals, "derived")
+	t.Check(got.Metrics, Equals, uint(300+30000+1))
+	t.Check(got.Values, Equals, uint(300*6+30000+1))
+	t.Check(got.Notes, HasLen, 1)
+
+	// Nothing is started.
+	status := m.Status()
+	t.Check(status["monitor"], Equals, "")
+	t.Check(pct.FileExists(s.configDir+"/mm-mysql-1.conf"), Equals, false)
+
+	// The factory's error is returned.
+	config.InstanceId = 2
+	data, err = json.Marshal(config)
+	t.Assert(err, IsNil)
+	cmd.Data = data
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Not(Equals), "")
+}
+
 func (s *ManagerTestSuite) TestGetConfig(t *C) {
 	mrm := mock.NewMrmsMonitor()
 	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, s.im, mrm)
@@ -911,6 +1400,449 @@ func (s *ManagerTestSuite) TestGetConfig(t *C) {
 	}
 }
 
+func (s *AggregatorTestSuite) TestDerived(t *C) {
+	interval := int64(300)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	derived, err := mm.MakeDerivedMetrics(map[string]string{
+		"mysql/qps":       "com_select + com_insert",
+		"mysql/hit_ratio": "1 - reads / read_requests",
+	})
+	t.Assert(err, IsNil)
+	a.SetDerived(si, derived)
+	go a.Start()
+	defer a.Stop()
+
+	// 2009-11-10 23:00:00, 23:00:10, 23:00:20.  Counters are rates since
+	// the previous collection, so the first collection has no derived metrics.
+	for i, v := range []float64{0, 100, 300} {
+		s.collectionChan <- &mm.Collection{
+			ServiceInstance: si,
+			Ts:              1257894000 + int64(i*10),
+			Metrics: []mm.Metric{
+				{Name: "mysql/com_select", Type: "counter", Number: v * 4},
+				{Name: "mysql/com_insert", Type: "counter", Number: v},
+				{Name: "mysql/reads", Type: "counter", Number: v / 10},
+				{Name: "mysql/read_requests", Type: "counter", Number: v},
+			},
+		}
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: si,
+		Ts:              1257894300,
+		Metrics:         []mm.Metric{{Name: "mysql/com_select", Type: "counter", Number: 2000}},
+	}
+
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 1)
+	qps := got.Stats[0].Stats["mysql/qps"]
+	t.Assert(qps, NotNil)
+	t.Check(qps.Cnt, Equals, 2)
+	t.Check(qps.Min, Equals, float64(50))  // (400 + 100) / 10s
+	t.Check(qps.Max, Equals, float64(100)) // (800 + 200) / 10s
+	hitRatio := got.Stats[0].Stats["mysql/hit_ratio"]
+	t.Assert(hitRatio, NotNil)
+	t.Check(hitRatio.Avg, Equals, float64(0.9))
+}
+
+func (s *AggregatorTestSuite) TestRollup(t *C) {
+	interval := int64(60)
+	a := mm.NewAggregator(s.logger, interval, s.collectionChan, s.spool)
+	server := proto.ServiceInstance{Service: "server", InstanceId: 1}
+	a.SetRollup(server, true)
+	go a.Start()
+	defer a.Stop()
+
+	// Two MySQL instances, 10 and 30 QPS, with 128M and 1G buffer pools on
+	// a host with 4G RAM.
+	for i, qps := range []float64{10, 30} {
+		si := proto.ServiceInstance{Service: "mysql", InstanceId: uint(i + 1)}
+		for j := int64(0); j < 2; j++ {
+			s.collectionChan <- &mm.Collection{
+				ServiceInstance: si,
+				Ts:              1257894000 + j*10,
+				Metrics: []mm.Metric{
+					{Name: "mysql/queries", Type: "counter", Number: qps * float64(j*10)},
+					{Name: "mysql/threads_connected", Type: "gauge", Number: qps},
+					{Name: "mysql/innodb_buffer_pool_pages_total", Type: "gauge", Number: float64((i*7 + 1) * 8192)},
+					{Name: "mysql/innodb_page_size", Type: "gauge", Number: 16384},
+				},
+			}
+		}
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: server,
+		Ts:              1257894000,
+		Metrics:         []mm.Metric{{Name: "memory/MemTotal", Type: "gauge", Number: 4 * 1024 * 1024}},
+	}
+	s.collectionChan <- &mm.Collection{
+		ServiceInstance: server,
+		Ts:              1257894060,
+		Metrics:         []mm.Metric{{Name: "memory/MemTotal", Type: "gauge", Number: 4 * 1024 * 1024}},
+	}
+
+	got := test.WaitMmReport(s.dataChan)
+	t.Assert(got, NotNil)
+	t.Assert(got.Stats, HasLen, 3)
+	host := got.Stats[2]
+	t.Assert(host.ServiceInstance, DeepEquals, server)
+	t.Check(host.Stats["host/mysql/instances"].Avg, Equals, float64(2))
+	t.Check(host.Stats["host/mysql/queries"].Avg, Equals, float64(40))
+	t.Check(host.Stats["host/mysql/threads_connected"].Avg, Equals, float64(40))
+	t.Check(host.Stats["host/mysql/buffer_pool_bytes"].Avg, Equals, float64(1152*1024*1024))
+	t.Check(host.Stats["host/mysql/buffer_pool_pct"].Avg, Equals, float64(28.125))
+	t.Check(host.Stats["memory/MemTotal"], NotNil)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Collection buffer test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type BufferTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&BufferTestSuite{})
+
+func (s *BufferTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "mm-buffer-test")
+}
+
+func (s *BufferTestSuite) TestDropOldest(t *C) {
+	logChan := make(chan *proto.LogEntry, 10)
+	logger := pct.NewLogger(logChan, "mm-buffer-test")
+	outChan := make(chan *mm.Collection)
+	b := mm.NewCollectionBuffer(logger, 3, outChan)
+	b.Start()
+	defer b.Stop()
+
+	// Nothing receives from outChan yet, like a stalled aggregator, so
+	// monitors' collections queue.  The first collection each second also
+	// makes the dropped collections counter, but it doesn't take a slot.
+	for i, ts := range []int64{1, 1, 1, 2} {
+		b.In() <- &mm.Collection{
+			ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: uint(i + 1)},
+			Ts:              ts,
+			Metrics:         []mm.Metric{{Name: "foo", Type: "gauge", Number: 1}},
+		}
+	}
+	// Wait for the last one to be pushed, which drops the first.
+	select {
+	case entry := <-logChan:
+		t.Check(entry.Msg, Matches, "Dropped mysql 1 collection at .+")
+	case <-time.After(1 * time.Second):
+		t.Fatal("Timeout waiting for dropped collection")
+	}
+
+	got := []*mm.Collection{}
+	for i := 0; i < 4; i++ {
+		select {
+		case c := <-outChan:
+			got = append(got, c)
+		case <-time.After(1 * time.Second):
+			t.Fatal("Timeout receiving from buffer")
+		}
+	}
+	t.Check(got[0].InstanceId, Equals, uint(2))
+	t.Check(got[1].InstanceId, Equals, uint(3))
+	t.Check(got[2].InstanceId, Equals, uint(4))
+	t.Check(got[3].Service, Equals, "agent")
+	t.Check(got[3].Ts, Equals, int64(2))
+	t.Check(got[3].Metrics, DeepEquals, []mm.Metric{{Name: mm.DROPPED_COLLECTIONS, Type: "counter", Number: 1}})
+}
+
+func (s *BufferTestSuite) TestLen(t *C) {
+	outChan := make(chan *mm.Collection, 1)
+	b := mm.NewCollectionBuffer(s.logger, 10, outChan)
+	b.Start()
+	defer b.Stop()
+
+	// The first collection is in the aggregator's chan which counts, too.
+	// The second queues in the ring, but the dropped collections counter
+	// doesn't count: it's not in the ring.
+	b.In() <- &mm.Collection{Ts: 1}
+	b.In() <- &mm.Collection{Ts: 1}
+	for i := 0; i < 100 && b.Len() != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Check(b.Len(), Equals, 2)
+	t.Check(outChan, HasLen, 1)
+}
+
+func (s *BufferTestSuite) TestReportStall(t *C) {
+	// Nothing receives from dataChan yet, like a stalled spooler, so the
+	// first report blocks in spool.Write() and the rest queue.
+	dataChan := make(chan interface{})
+	spool := mock.NewSpooler(dataChan)
+	b := mm.NewReportBuffer(s.logger, 2, spool)
+	b.Start()
+	defer b.Stop()
+
+	reports := make([]*mm.Report, 4)
+	for i := range reports {
+		reports[i] = &mm.Report{
+			Ts:       time.Unix(int64(60*i), 0).UTC(),
+			Duration: 60,
+		}
+	}
+
+	b.Push(reports[0])
+	time.Sleep(mm.REPORT_STALL_TIME + 100*time.Millisecond)
+	t.Check(b.Status(), Matches, "Spooling stalled since .+, 1 reports queued, 0 dropped, 0 spool failures")
+
+	// The ring holds 2 reports, so the 1st (still being spooled) and 2nd
+	// are dropped.
+	for _, r := range reports[1:] {
+		b.Push(r)
+	}
+	t.Check(b.Dropped(), Equals, uint64(2))
+
+	got := []interface{}{}
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-dataChan:
+			got = append(got, r)
+		case <-time.After(1 * time.Second):
+			t.Fatal("Timeout receiving from spooler")
+		}
+	}
+	t.Check(got, DeepEquals, []interface{}{reports[0], reports[2], reports[3]})
+
+	// Spooling has caught up.
+	var status string
+	for i := 0; i < 10; i++ {
+		if status = b.Status(); strings.HasPrefix(status, "Idle") {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Check(status, Equals, "Idle, 0 reports queued, 2 dropped, 0 spool failures")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Derived metrics test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type DerivedTestSuite struct {
+}
+
+var _ = Suite(&DerivedTestSuite{})
+
+func (s *DerivedTestSuite) TestEval(t *C) {
+	values := map[string]float64{
+		"mysql/a":        10,
+		"mysql/b":        4,
+		"mysql/zero":     0,
+		"memory/MemFree": 2,
+	}
+	tests := []struct {
+		expr string
+		val  float64
+		ok   bool
+	}{
+		{"a + b", 14, true},
+		{"a - b * 2", 2, true},
+		{"(a - b) * 2", 12, true},
+		{"1 - b / a", 0.6, true},
+		{"-a + 1.5", -8.5, true},
+		{"a * [memory/MemFree]", 20, true},
+		{"a / zero", 0, false},    // divide by zero
+		{"a + missing", 0, false}, // metric not collected
+	}
+	for _, tt := range tests {
+		d, err := mm.NewDerivedMetric("mysql/x", tt.expr)
+		t.Assert(err, IsNil, Commentf(tt.expr))
+		val, ok := d.Eval(values)
+		t.Check(ok, Equals, tt.ok, Commentf(tt.expr))
+		t.Check(val, Equals, tt.val, Commentf(tt.expr))
+	}
+}
+
+func (s *DerivedTestSuite) TestNames(t *C) {
+	d, err := mm.NewDerivedMetric("mysql/x", "com_select / [server/cpu/user]")
+	t.Assert(err, IsNil)
+	t.Check(d.Names(), DeepEquals, []string{"mysql/com_select", "server/cpu/user"})
+}
+
+func (s *DerivedTestSuite) TestInvalid(t *C) {
+	for _, expr := range []string{"", "a +", "(a + b", "a b", "[a", "a % b", "1.2.3"} {
+		_, err := mm.NewDerivedMetric("mysql/x", expr)
+		t.Check(err, NotNil, Commentf(expr))
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Forecast test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ForecastTestSuite struct {
+}
+
+var _ = Suite(&ForecastTestSuite{})
+
+func (s *ForecastTestSuite) TestExhaustIn(t *C) {
+	// Disk free space drops 100 bytes/minute from 10000.
+	f := mm.NewForecaster()
+	ts := int64(1000)
+	free := 10000.0
+	for i := 0; i < mm.FORECAST_MIN_SAMPLES-1; i++ {
+		t.Check(f.Due(ts), Equals, true)
+		f.Add(ts, free)
+		ts += mm.FORECAST_SAMPLE_INTERVAL
+		free -= 100
+	}
+	t.Check(f.Due(ts-1), Equals, false)
+
+	// Too few samples yet.
+	_, ok := f.ExhaustIn(0)
+	t.Check(ok, Equals, false)
+
+	f.Add(ts, free) // 9100 left, so 91 minutes
+	eta, ok := f.ExhaustIn(0)
+	t.Check(ok, Equals, true)
+	t.Check(int(eta+0.5), Equals, 91*60)
+
+	// Not trending toward a limit above the current value.
+	_, ok = f.ExhaustIn(20000)
+	t.Check(ok, Equals, false)
+
+	// Full in 1.5 hours, so an event if ForecastHours >= 2, but only once
+	// per FORECAST_EVENT_INTERVAL.
+	_, ok = f.Check(0, 1)
+	t.Check(ok, Equals, false)
+	_, ok = f.Check(0, 2)
+	t.Check(ok, Equals, true)
+	f.Add(ts+mm.FORECAST_SAMPLE_INTERVAL, free-100)
+	_, ok = f.Check(0, 2)
+	t.Check(ok, Equals, false)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// StatsD test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type StatsDTestSuite struct {
+	logger *pct.Logger
+	conn   *net.UDPConn
+}
+
+var _ = Suite(&StatsDTestSuite{})
+
+func (s *StatsDTestSuite) SetUpSuite(t *C) {
+	s.logger = pct.NewLogger(make(chan *proto.LogEntry, 10), "mm-statsd-test")
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, err := net.ListenUDP("udp", addr)
+	t.Assert(err, IsNil)
+	s.conn = conn
+}
+
+func (s *StatsDTestSuite) TearDownSuite(t *C) {
+	s.conn.Close()
+}
+
+func (s *StatsDTestSuite) recv(t *C) []string {
+	buf := make([]byte, mm.STATSD_UDP_PACKET)
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := s.conn.Read(buf)
+	t.Assert(err, IsNil)
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func (s *StatsDTestSuite) TestStatsD(t *C) {
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	metrics := []mm.Metric{
+		{Name: "mysql/status/Threads_running", Type: "gauge", Number: 3},
+		{Name: "mysql/innodb/buffer_pool_reads", Type: "counter", Number: 12.5},
+		{Name: "mysql/var/version", Type: "string", String: "5.6"},
+	}
+
+	// Plain StatsD: instance id in the name, no tags.
+	statsd, err := mm.NewStatsD(s.logger, s.conn.LocalAddr().String(), 0, nil)
+	t.Assert(err, IsNil)
+	statsd.Send(si, metrics)
+	statsd.Close()
+	t.Check(s.recv(t), DeepEquals, []string{
+		"percona.1.mysql.status.Threads_running:3|g",
+		"percona.1.mysql.innodb.buffer_pool_reads:12.5|g",
+	})
+
+	// DogStatsD: instance and longest metric prefix tags.
+	tags := map[string]string{
+		"mysql/":        "db:mysql",
+		"mysql/innodb/": "subsystem:innodb, team:db",
+	}
+	statsd, err = mm.NewStatsD(s.logger, s.conn.LocalAddr().String(), 1, tags)
+	t.Assert(err, IsNil)
+	statsd.Send(si, metrics)
+	statsd.Close()
+	t.Check(s.recv(t), DeepEquals, []string{
+		"percona.mysql.status.Threads_running:3|g|#instance:1,db:mysql",
+		"percona.mysql.innodb.buffer_pool_reads:12.5|g|#instance:1,subsystem:innodb,team:db",
+	})
+}
+
+func (s *StatsDTestSuite) TestInvalid(t *C) {
+	_, err := mm.NewStatsD(s.logger, "localhost", 0, nil)
+	t.Check(err, NotNil)
+	_, err = mm.NewStatsD(s.logger, s.conn.LocalAddr().String(), 1.5, nil)
+	t.Check(err, NotNil)
+	_, err = mm.NewStatsD(s.logger, s.conn.LocalAddr().String(), 0, map[string]string{"": "a:b"})
+	t.Check(err, NotNil)
+}
+
+func (s *StatsDTestSuite) TestNoServer(t *C) {
+	// The socket doesn't exist yet, e.g. DogStatsD isn't running, but that's
+	// not an error: it's dialed when metrics are sent, and sending is
+	// best-effort.
+	statsd, err := mm.NewStatsD(s.logger, "unix:/tmp/percona-agent-test-no-such.sock", 0, map[string]string{})
+	t.Assert(err, IsNil)
+	statsd.Send(proto.ServiceInstance{Service: "mysql", InstanceId: 1}, []mm.Metric{{Name: "foo", Type: "gauge", Number: 1}})
+	t.Check(statsd.Close(), IsNil)
+	_, err = mm.NewStatsD(s.logger, "unix:", 0, nil)
+	t.Check(err, NotNil)
+}
+
+func (s *StatsDTestSuite) TestRedial(t *C) {
+	// DogStatsD restarts and recreates its socket, so the old conn fails
+	// and the sender must dial the new socket.
+	socket := "/tmp/percona-agent-test-statsd.sock"
+	os.Remove(socket)
+	listen := func() *net.UnixConn {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		t.Assert(err, IsNil)
+		return conn
+	}
+	recv := func(conn *net.UnixConn) string {
+		buf := make([]byte, mm.STATSD_UNIX_PACKET)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		t.Assert(err, IsNil)
+		return string(buf[:n])
+	}
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	metrics := []mm.Metric{{Name: "foo", Type: "gauge", Number: 1}}
+
+	server := listen()
+	statsd, err := mm.NewStatsD(s.logger, "unix:"+socket, 0, map[string]string{})
+	t.Assert(err, IsNil)
+	defer statsd.Close()
+	statsd.Send(si, metrics)
+	t.Check(recv(server), Equals, "percona.foo:1|g|#instance:1")
+
+	server.Close()
+	os.Remove(socket)
+	statsd.Send(si, metrics) // fails, drops the conn
+
+	server = listen()
+	defer server.Close()
+	defer os.Remove(socket)
+	statsd.Send(si, metrics)
+	t.Check(recv(server), Equals, "percona.foo:1|g|#instance:1")
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Stats test suite
 /////////////////////////////////////////////////////////////////////////////
@@ -932,6 +1864,53 @@ func (s *StatsTestSuite) TestCounterBasic(t *C) {
 	t.Check(got.Max, Equals, float64(6))
 }
 
+func (s *StatsTestSuite) TestPercentiles(t *C) {
+	stats, _ := mm.NewStats("gauge")
+	stats.SetPercentiles([]float64{50, 99, 99.5})
+	for i := 1; i <= 1000; i++ {
+		stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: float64(i)}, int64(i))
+	}
+	got := stats.Finalize()
+	t.Check(got.Pct95, Equals, float64(951))
+	t.Check(got.Pct, DeepEquals, map[string]float64{
+		"50":   501,
+		"99":   991,
+		"99.5": 996,
+	})
+
+	// Only gauges have extra percentiles.
+	stats, _ = mm.NewStats("counter")
+	stats.SetPercentiles([]float64{99})
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 1}, 1)
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 2}, 2)
+	got = stats.Finalize()
+	t.Check(got.Pct, IsNil)
+}
+
+func (s *StatsTestSuite) TestAnomalies(t *C) {
+	stats, _ := mm.NewStats("gauge")
+	stats.SetAnomaly(3, 20)
+
+	// Mean 11, stddev 1.
+	ts := int64(1)
+	for i := 0; i < 20; i++ {
+		stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: float64(10 + 2*(i%2))}, ts)
+		ts++
+	}
+	stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: 13.5}, ts) // 2.5 sigma
+	ts++
+	stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: 20}, ts) // 9 sigma
+	ts++
+	got := stats.Finalize()
+	t.Check(got.Anomalies, Equals, 1)
+
+	// The window spans intervals but the count is per interval.
+	stats.Reset()
+	stats.Add(&mm.Metric{Name: "foo", Type: "gauge", Number: 11}, ts)
+	got = stats.Finalize()
+	t.Check(got.Anomalies, Equals, 0)
+}
+
 func (s *StatsTestSuite) TestCounterReset(t *C) {
 	stats, _ := mm.NewStats("counter")
 	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 3}, 1)
@@ -945,6 +1924,27 @@ func (s *StatsTestSuite) TestCounterReset(t *C) {
 	t.Check(got.Min, Equals, float64(2))
 	t.Check(got.Avg, Equals, float64(4.25))
 	t.Check(got.Max, Equals, float64(6))
+	t.Check(got.Resets, Equals, 1)
+
+	// Resets are per interval.
+	stats.Reset()
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 10}, 7) // +1
+	got = stats.Finalize()
+	t.Check(got.Cnt, Equals, 1)
+	t.Check(got.Resets, Equals, 0)
+
+	// The only sample of the interval is a reset: no values, but the reset
+	// is reported.
+	stats.Reset()
+	stats.Add(&mm.Metric{Name: "foo", Type: "counter", Number: 2}, 8) // reset
+	got = stats.Finalize()
+	t.Assert(got, NotNil)
+	t.Check(got.Cnt, Equals, 0)
+	t.Check(got.Resets, Equals, 1)
+
+	// No values or resets: no stats.
+	stats.Reset()
+	t.Check(stats.Finalize(), IsNil)
 }
 
 func (s *StatsTestSuite) TestValueLap(t *C) {
@@ -1031,3 +2031,58 @@ func (s *StatsTestSuite) TestPCT939(t *C) {
 		test.Dump(got)
 	*/
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Metric name escaping test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type NameTestSuite struct {
+}
+
+var _ = Suite(&NameTestSuite{})
+
+func (s *NameTestSuite) TestEscapeName(t *C) {
+	names := map[string]string{
+		"":               "",
+		"shop":           "shop",
+		"Orders_2015":    "Orders_2015",
+		"tmp$1-old":      "tmp$1-old",
+		"a.b":            "a%2Eb",
+		"a/t.b":          "a%2Ft%2Eb",
+		"my table":       "my%20table",
+		"100%":           "100%25",
+		"nul\x00byte":    "nul%00byte",
+		"t#P#p0":         "t%23P%23p0",
+		"café":           "caf%C3%A9",
+		"日本":             "%E6%97%A5%E6%9C%AC",
+		"bad\xffutf8":    "bad%FFutf8",
+		"%2E":            "%252E",
+		"idx.PRIMARY/db": "idx%2EPRIMARY%2Fdb",
+	}
+	for name, escaped := range names {
+		got := mm.EscapeName(name)
+		t.Check(got, Equals, escaped, Commentf("%q", name))
+		t.Check(strings.ContainsAny(got, "./ \x00"), Equals, false, Commentf("%q", name))
+		unescaped, err := mm.UnescapeName(got)
+		t.Check(err, IsNil, Commentf("%q", name))
+		t.Check(unescaped, Equals, name, Commentf("%q", name))
+	}
+
+	// Every byte round-trips.
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	unescaped, err := mm.UnescapeName(mm.EscapeName(string(all)))
+	t.Check(err, IsNil)
+	t.Check(unescaped, Equals, string(all))
+
+	// Different names never escape to the same name.
+	t.Check(mm.EscapeName("a.b"), Not(Equals), mm.EscapeName("a_b"))
+	t.Check(mm.EscapeName("a%2Eb"), Not(Equals), mm.EscapeName("a.b"))
+
+	for _, invalid := range []string{"%", "a%2", "%zz", "%+1", "%-1"} {
+		_, err := mm.UnescapeName(invalid)
+		t.Check(err, NotNil, Commentf("%q", invalid))
+	}
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mongo
+
+import (
+	"github.com/percona/percona-agent/mm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/**
+ * If Config.Collections lists db.collection globs, e.g. "app.*", collStats
+ * is collected for every matching collection every CollectionsInterval
+ * seconds (default 60).  Databases and collections are listed every time,
+ * so new ones are picked up.  Metrics are mongo/coll/<db>/<collection>/<stat>
+ * with db and collection escaped by mm.EscapeName, because collection names
+ * often have dots, e.g. system.users.
+ */
+
+// collStats fields collected; all are gauges.
+var collStatsMetrics = []string{
+	"count",
+	"size",
+	"storageSize",
+	"totalIndexSize",
+	"nindexes",
+	"avgObjSize",
+}
+
+func (m *Monitor) getCollStats(c *mm.Collection) error {
+	m.logger.Debug("getCollStats:call")
+	defer m.logger.Debug("getCollStats:return")
+
+	m.status.Update(m.name, "Getting collection stats")
+
+	dbs, err := m.session.DatabaseNames()
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		colls, err := m.session.DB(db).CollectionNames()
+		if err != nil {
+			return err
+		}
+		for _, coll := range colls {
+			if !m.collections.Match(db + "." + coll) {
+				continue
+			}
+			stats := bson.M{}
+			if err := m.session.DB(db).Run(bson.D{{"collStats", coll}}, &stats); err != nil {
+				return err
+			}
+			c.Metrics = append(c.Metrics, CollStatsMetrics(db, coll, stats)...)
+		}
+	}
+	return nil
+}
+
+// CollStatsMetrics returns the collStatsMetrics found in the given collStats
+// document for collection db.coll.
+func CollStatsMetrics(db, coll string, stats map[string]interface{}) []mm.Metric {
+	prefix := "mongo/coll/" + mm.EscapeName(db) + "/" + mm.EscapeName(coll) + "/"
+	metrics := []mm.Metric{}
+	for _, stat := range collStatsMetrics {
+		n, ok := toFloat(stats[stat])
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, mm.Metric{Name: prefix + stat, Type: "gauge", Number: n})
+	}
+	return metrics
+}
@@ -0,0 +1,34 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mongo
+
+import (
+	"github.com/percona/percona-agent/mm"
+)
+
+const (
+	DEFAULT_COLLECTIONS_INTERVAL = 60 // seconds
+)
+
+type Config struct {
+	mm.Config
+	URI                 string   // mongodb://[user:pass@]host[:port][/db][?options]
+	ReplLag             bool     // replSetGetStatus lag and health of each member, see repl.go
+	Collections         []string // collStats for db.collection matching these globs, see coll.go
+	CollectionsInterval uint     // how often to collect Collections metrics (seconds)
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mongo_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/mongo"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var sample = test.RootDir + "/mm/mongo"
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestServerStatus(t *C) {
+	content, err := ioutil.ReadFile(sample + "/serverStatus001.json")
+	t.Assert(err, IsNil)
+	status := map[string]interface{}{}
+	t.Assert(json.Unmarshal(content, &status), IsNil)
+
+	got := mongo.ServerStatusMetrics(status)
+	metrics := make(map[string]mm.Metric)
+	for _, metric := range got {
+		metrics[metric.Name] = metric
+	}
+	t.Check(metrics["mongo/opcounters/insert"], Equals, mm.Metric{Name: "mongo/opcounters/insert", Type: "counter", Number: 100})
+	t.Check(metrics["mongo/connections/current"], Equals, mm.Metric{Name: "mongo/connections/current", Type: "gauge", Number: 12})
+	t.Check(metrics["mongo/globalLock/currentQueue/writers"].Number, Equals, float64(2))
+	t.Check(metrics["mongo/network/bytesOut"].Number, Equals, float64(209715200))
+
+	// Not in the document, or not a number.
+	_, ok := metrics["mongo/wiredTiger/concurrentTransactions/read/out"]
+	t.Check(ok, Equals, false)
+	_, ok = metrics["mongo/host"]
+	t.Check(ok, Equals, false)
+
+	// 5 asserts, 3 connections, 6 globalLock, 3 mem, 3 network, 6 opcounters
+	t.Check(got, HasLen, 26)
+}
+
+func (s *TestSuite) TestReplLag(t *C) {
+	now := time.Now()
+	status := &mongo.ReplSetStatus{
+		Set: "rs0",
+		Members: []mongo.ReplMember{
+			{Name: "db1:27017", Health: 1, State: mongo.REPL_STATE_PRIMARY, OptimeDate: now},
+			{Name: "db2:27017", Health: 1, State: mongo.REPL_STATE_SECONDARY, OptimeDate: now.Add(-3 * time.Second)},
+			{Name: "db3:27017", Health: 0, State: 8, OptimeDate: now.Add(-time.Hour)},
+		},
+	}
+	got := mongo.ReplLagMetrics(status)
+	t.Check(got, DeepEquals, []mm.Metric{
+		{Name: "mongo/repl/db1:27017/health", Type: "gauge", Number: 1},
+		{Name: "mongo/repl/db1:27017/state", Type: "gauge", Number: 1},
+		{Name: "mongo/repl/db2:27017/health", Type: "gauge", Number: 1},
+		{Name: "mongo/repl/db2:27017/state", Type: "gauge", Number: 2},
+		{Name: "mongo/repl/db2:27017/lag", Type: "gauge", Number: 3},
+		{Name: "mongo/repl/db3:27017/health", Type: "gauge", Number: 0},
+		{Name: "mongo/repl/db3:27017/state", Type: "gauge", Number: 8},
+	})
+
+	// No primary, no lag.
+	status.Members[0].State = mongo.REPL_STATE_SECONDARY
+	for _, metric := range mongo.ReplLagMetrics(status) {
+		t.Check(metric.Name, Not(Matches), ".+/lag")
+	}
+}
+
+func (s *TestSuite) TestCollStats(t *C) {
+	content, err := ioutil.ReadFile(sample + "/collStats001.json")
+	t.Assert(err, IsNil)
+	stats := map[string]interface{}{}
+	t.Assert(json.Unmarshal(content, &stats), IsNil)
+
+	got := mongo.CollStatsMetrics("app", "users", stats)
+	t.Check(got, DeepEquals, []mm.Metric{
+		{Name: "mongo/coll/app/users/count", Type: "gauge", Number: 1000},
+		{Name: "mongo/coll/app/users/size", Type: "gauge", Number: 256000},
+		{Name: "mongo/coll/app/users/storageSize", Type: "gauge", Number: 524288},
+		{Name: "mongo/coll/app/users/totalIndexSize", Type: "gauge", Number: 65536},
+		{Name: "mongo/coll/app/users/nindexes", Type: "gauge", Number: 2},
+		{Name: "mongo/coll/app/users/avgObjSize", Type: "gauge", Number: 256},
+	})
+
+	got = mongo.CollStatsMetrics("app", "users.archive", stats)
+	t.Check(got[0].Name, Equals, "mongo/coll/app/users%2Earchive/count")
+}
@@ -0,0 +1,363 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/**
+ * The MongoDB monitor works like the MySQL monitor: it connects with
+ * Config.URI, then on every tick it collects serverStatus and, if enabled,
+ * replSetGetStatus and collStats, and sends the collection to the same
+ * aggregator as every other monitor.  Metrics are prefixed "mongo/".
+ *
+ * If a command fails, the session is pinged: if the ping fails too, MongoDB
+ * is gone, so the monitor reconnects (with backoff) and the tick is lost.
+ * Else the error is logged and the other metrics are still sent.
+ */
+
+const (
+	DIAL_TIMEOUT = 5 * time.Second
+)
+
+var (
+	networkError = errors.New("Network error")
+)
+
+type Monitor struct {
+	name   string
+	config *Config
+	logger *pct.Logger
+	// --
+	session        *mgo.Session
+	backoff        *pct.Backoff
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	sessionChan    chan *mgo.Session
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+	collectLimit   float64
+	collections    *pct.GlobMatcher
+	collectionsTs  int64 // last collected, for Config.CollectionsInterval
+}
+
+func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
+	m := &Monitor{
+		name:   name,
+		config: config,
+		logger: logger,
+		// --
+		backoff:      pct.NewBackoff(20 * time.Second),
+		sessionChan:  make(chan *mgo.Session),
+		status:       pct.NewStatus([]string{name, name + "-mongo"}),
+		sync:         pct.NewSyncChan(),
+		collectLimit: float64(config.Collect) * 0.1, // 10% of Collect time
+		collections:  pct.NewGlobMatcher(config.Collections),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+// connect dials MongoDB until it connects, then gives the session to run().
+// run() closes doneChan when it returns, e.g. if Stop() is called during the
+// dial, so connect() returns and closes the session instead of leaking it.
+func (m *Monitor) connect(err error, doneChan chan bool) {
+	m.logger.Debug("connect:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("MongoDB connection crashed: ", err)
+		}
+		m.logger.Debug("connect:return")
+	}()
+
+	// Try forever to connect to MongoDB...
+	for {
+		m.logger.Debug("connect:try")
+		if err != nil {
+			m.status.Update(m.name+"-mongo", fmt.Sprintf("Connecting (%s)", err))
+		} else {
+			m.status.Update(m.name+"-mongo", "Connecting")
+		}
+		select {
+		case <-time.After(m.backoff.Wait()):
+		case <-doneChan:
+			return
+		}
+
+		var session *mgo.Session
+		session, err = mgo.DialWithTimeout(m.config.URI, DIAL_TIMEOUT)
+		if err != nil {
+			m.logger.Warn(err)
+			continue
+		}
+		session.SetMode(mgo.Monotonic, true)
+		session.SetSocketTimeout(time.Duration(m.collectLimit * float64(time.Second)))
+		m.backoff.Success()
+
+		// Give run() the session so it can try to collect metrics.
+		// If connection is lost, it will call us again.
+		select {
+		case m.sessionChan <- session:
+			m.logger.Info("Connected")
+			m.status.Update(m.name+"-mongo", "Connected")
+		case <-doneChan:
+			session.Close()
+		}
+		return
+	}
+}
+
+func (m *Monitor) close() {
+	if m.session != nil {
+		m.session.Close()
+		m.session = nil
+	}
+}
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	doneChan := make(chan bool)
+	defer func() {
+		close(doneChan) // stop connect()
+		if err := recover(); err != nil {
+			m.logger.Error("MongoDB monitor crashed: ", err)
+		}
+		m.close()
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	connected := false
+	go m.connect(nil, doneChan)
+
+	m.status.Update(m.name, "Ready")
+
+	var lastTs int64
+	var lastError string
+	for {
+		t := time.Unix(lastTs, 0)
+		if lastError == "" {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(t)))
+		} else {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s, error: %s)", pct.TimeString(t), lastError))
+		}
+
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			if !connected {
+				m.logger.Debug("run:collect:disconnected")
+				lastError = "Not connected to MongoDB"
+				continue
+			}
+
+			m.status.Update(m.name, "Running")
+
+			// Start timing the collection.  If must take < collectLimit else
+			// it's discarded.
+			start := time.Now()
+
+			c, err := m.collect(now)
+			if err != nil {
+				connected = false
+				lastError = "Lost connection to MongoDB"
+				m.close()
+				go m.connect(err, doneChan)
+				continue
+			}
+
+			diff := time.Now().Sub(start).Seconds()
+			if diff >= m.collectLimit {
+				lastError = fmt.Sprintf("Skipping interval because it took too long to collect: %.2fs >= %.2fs", diff, m.collectLimit)
+				m.logger.Warn(lastError)
+				continue
+			}
+
+			// Send the metrics to an mm.Aggregator.
+			m.status.Update(m.name, "Sending metrics")
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
+				select {
+				case m.collectionChan <- c:
+					lastTs = c.Ts
+					lastError = ""
+				case <-time.After(500 * time.Millisecond):
+					// lost collection
+					m.logger.Debug("Lost MongoDB metrics; timeout spooling after 500ms")
+					lastError = "Spool timeout"
+				}
+			} else {
+				m.logger.Debug("run:no metrics") // shouldn't happen
+				lastError = "No metrics"
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case m.session = <-m.sessionChan:
+			m.logger.Debug("run:connected")
+			connected = true
+			m.status.Update(m.name, "Ready")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+// collect gets all the metrics enabled by the config.  It returns networkError
+// if the connection to MongoDB was lost, else errors are logged and the
+// collection is returned.
+func (m *Monitor) collect(now time.Time) (*mm.Collection, error) {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+
+	// db.serverStatus()
+	m.status.Update(m.name, "Getting server status")
+	status := bson.M{}
+	if err := m.session.Run(bson.D{{"serverStatus", 1}}, &status); err != nil {
+		if m.collectError(err) == networkError {
+			return nil, networkError
+		}
+	} else {
+		c.Metrics = append(c.Metrics, ServerStatusMetrics(status)...)
+	}
+
+	// rs.status()
+	if m.config.ReplLag {
+		if err := m.getReplLag(c); err != nil {
+			if m.collectError(err) == networkError {
+				return nil, networkError
+			}
+		}
+	}
+
+	// db.collection.stats()
+	interval := m.config.CollectionsInterval
+	if interval == 0 {
+		interval = DEFAULT_COLLECTIONS_INTERVAL
+	}
+	if len(m.config.Collections) > 0 && due(m.collectionsTs, c.Ts, interval) {
+		if err := m.getCollStats(c); err != nil {
+			if m.collectError(err) == networkError {
+				return nil, networkError
+			}
+		} else {
+			m.collectionsTs = c.Ts
+		}
+	}
+
+	return c, nil
+}
+
+// collectError returns networkError if err is because the connection to
+// MongoDB was lost, which is the case if the server doesn't answer a ping,
+// else it logs and returns err.
+func (m *Monitor) collectError(err error) error {
+	if pingErr := m.session.Ping(); pingErr != nil {
+		m.logger.Warn("Lost connection to MongoDB:", err)
+		m.status.Update(m.name+"-mongo", fmt.Sprintf("Disconnected (%s)", err))
+		return networkError
+	}
+	m.logger.Warn(err)
+	return err
+}
+
+// due returns true if a group of metrics collected every interval seconds
+// should be collected at ts, i.e. it wasn't collected at lastTs in the same
+// interval.  It's the same as in mm/mysql: collection is aligned to the first
+// tick in each interval, and the caller sets lastTs = ts only if the
+// collection succeeds so a failed one is retried on the next tick.
+func due(lastTs, ts int64, interval uint) bool {
+	if interval <= 1 {
+		return true
+	}
+	i := int64(interval)
+	return lastTs == 0 || ts/i != lastTs/i
+}
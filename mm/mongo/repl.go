@@ -0,0 +1,110 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mongo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/percona/percona-agent/mm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/**
+ * If Config.ReplLag is true, replSetGetStatus is collected on every tick.
+ * Lag is the difference between the primary's last applied operation and
+ * each secondary's, so it's computed on any member, not only secondaries.
+ * Every member reports mongo/repl/<member>/health and /state, and secondaries
+ * report mongo/repl/<member>/lag (seconds).  If the server isn't a replica set
+ * member, ReplLag is disabled so the error isn't logged every tick.
+ */
+
+const (
+	REPL_STATE_PRIMARY   = 1
+	REPL_STATE_SECONDARY = 2
+)
+
+// Error code returned by replSetGetStatus if the server isn't running
+// with --replSet.
+const ERR_NO_REPLICATION_ENABLED = 76
+
+type ReplSetStatus struct {
+	Set     string       `bson:"set"`
+	Members []ReplMember `bson:"members"`
+}
+
+type ReplMember struct {
+	Name       string    `bson:"name"` // host:port
+	Health     float64   `bson:"health"`
+	State      int       `bson:"state"`
+	StateStr   string    `bson:"stateStr"`
+	OptimeDate time.Time `bson:"optimeDate"`
+}
+
+func (m *Monitor) getReplLag(c *mm.Collection) error {
+	m.logger.Debug("getReplLag:call")
+	defer m.logger.Debug("getReplLag:return")
+
+	m.status.Update(m.name, "Getting replica set status")
+
+	status := &ReplSetStatus{}
+	if err := m.session.Run(bson.D{{"replSetGetStatus", 1}}, status); err != nil {
+		if qErr, ok := err.(*mgo.QueryError); ok && qErr.Code == ERR_NO_REPLICATION_ENABLED {
+			m.logger.Info("Not a replica set member, disabling ReplLag")
+			m.config.ReplLag = false
+			return nil
+		}
+		return err
+	}
+
+	c.Metrics = append(c.Metrics, ReplLagMetrics(status)...)
+	return nil
+}
+
+// ReplLagMetrics returns the health and state of every member, and the lag
+// of every secondary.  Lag isn't reported if there's no primary, e.g. during
+// an election, because it can't be computed.
+func ReplLagMetrics(status *ReplSetStatus) []mm.Metric {
+	var primary *ReplMember
+	for i := range status.Members {
+		if status.Members[i].State == REPL_STATE_PRIMARY {
+			primary = &status.Members[i]
+			break
+		}
+	}
+
+	metrics := []mm.Metric{}
+	for _, member := range status.Members {
+		prefix := fmt.Sprintf("mongo/repl/%s/", member.Name)
+		metrics = append(metrics,
+			mm.Metric{Name: prefix + "health", Type: "gauge", Number: member.Health},
+			mm.Metric{Name: prefix + "state", Type: "gauge", Number: float64(member.State)},
+		)
+		if primary == nil || member.State != REPL_STATE_SECONDARY {
+			continue
+		}
+		lag := primary.OptimeDate.Sub(member.OptimeDate).Seconds()
+		if lag < 0 {
+			// The secondary's optime was read after the primary's.
+			lag = 0
+		}
+		metrics = append(metrics, mm.Metric{Name: prefix + "lag", Type: "gauge", Number: lag})
+	}
+	return metrics
+}
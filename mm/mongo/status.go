@@ -0,0 +1,142 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mongo
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// serverStatus fields collected, keyed on their dotted path in the document,
+// e.g. opcounters.insert is reported as mongo/opcounters/insert.  Fields not
+// in the document, e.g. wiredTiger.* with MMAPv1, are skipped.
+var serverStatusMetrics = map[string]string{
+	"asserts.msg":                                       "counter",
+	"asserts.regular":                                   "counter",
+	"asserts.rollovers":                                 "counter",
+	"asserts.user":                                      "counter",
+	"asserts.warning":                                   "counter",
+	"connections.available":                             "gauge",
+	"connections.current":                               "gauge",
+	"connections.totalCreated":                          "counter",
+	"cursors.timedOut":                                  "counter",
+	"cursors.totalOpen":                                 "gauge",
+	"extra_info.page_faults":                            "counter",
+	"globalLock.activeClients.readers":                  "gauge",
+	"globalLock.activeClients.total":                    "gauge",
+	"globalLock.activeClients.writers":                  "gauge",
+	"globalLock.currentQueue.readers":                   "gauge",
+	"globalLock.currentQueue.total":                     "gauge",
+	"globalLock.currentQueue.writers":                   "gauge",
+	"mem.mapped":                                        "gauge",
+	"mem.resident":                                      "gauge",
+	"mem.virtual":                                       "gauge",
+	"metrics.cursor.open.total":                         "gauge",
+	"metrics.cursor.timedOut":                           "counter",
+	"metrics.document.deleted":                          "counter",
+	"metrics.document.inserted":                         "counter",
+	"metrics.document.returned":                         "counter",
+	"metrics.document.updated":                          "counter",
+	"network.bytesIn":                                   "counter",
+	"network.bytesOut":                                  "counter",
+	"network.numRequests":                               "counter",
+	"opcounters.command":                                "counter",
+	"opcounters.delete":                                 "counter",
+	"opcounters.getmore":                                "counter",
+	"opcounters.insert":                                 "counter",
+	"opcounters.query":                                  "counter",
+	"opcounters.update":                                 "counter",
+	"opcountersRepl.command":                            "counter",
+	"opcountersRepl.delete":                             "counter",
+	"opcountersRepl.getmore":                            "counter",
+	"opcountersRepl.insert":                             "counter",
+	"opcountersRepl.query":                              "counter",
+	"opcountersRepl.update":                             "counter",
+	"wiredTiger.concurrentTransactions.read.out":        "gauge",
+	"wiredTiger.concurrentTransactions.read.available":  "gauge",
+	"wiredTiger.concurrentTransactions.write.out":       "gauge",
+	"wiredTiger.concurrentTransactions.write.available": "gauge",
+}
+
+// ServerStatusMetrics returns the metrics in serverStatusMetrics found in
+// the given serverStatus document, sorted by name.
+func ServerStatusMetrics(status map[string]interface{}) []mm.Metric {
+	paths := make([]string, 0, len(serverStatusMetrics))
+	for path := range serverStatusMetrics {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	metrics := []mm.Metric{}
+	for _, path := range paths {
+		val, ok := lookup(status, strings.Split(path, "."))
+		if !ok {
+			continue
+		}
+		n, ok := toFloat(val)
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, mm.Metric{
+			Name:   "mongo/" + strings.Replace(path, ".", "/", -1),
+			Type:   serverStatusMetrics[path],
+			Number: n,
+		})
+	}
+	return metrics
+}
+
+// lookup returns the value at the path of keys in doc.  Sub-documents are
+// bson.M when read from MongoDB, or map[string]interface{} when read from
+// JSON (e.g. test fixtures).
+func lookup(doc map[string]interface{}, keys []string) (interface{}, bool) {
+	val, ok := doc[keys[0]]
+	if !ok || len(keys) == 1 {
+		return val, ok
+	}
+	switch sub := val.(type) {
+	case bson.M:
+		return lookup(sub, keys[1:])
+	case map[string]interface{}:
+		return lookup(sub, keys[1:])
+	}
+	return nil, false
+}
+
+// toFloat returns the value of a BSON number, which can be any of these types.
+func toFloat(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -19,6 +19,8 @@ package mm
 
 import (
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/pct"
 	"time"
 )
 
@@ -41,10 +43,37 @@ type Monitor interface {
 	Config() interface{}
 }
 
+// A CollectionQueueMonitor is a Monitor that reports how many collections
+// are queued for its aggregator, like the agent self monitor.  The manager
+// sets the queue, see CollectionBuffer.Len, before starting the monitor.
+type CollectionQueueMonitor interface {
+	SetCollectionQueue(queue func() int)
+}
+
 type MonitorFactory interface {
 	Make(service string, instanceId uint, data []byte) (Monitor, error)
 }
 
+var monitorFactories = make(map[string]MonitorFactory)
+
+/**
+ * RegisterMonitorFactory registers a factory for monitors of services whose
+ * name begins with prefix, e.g. "appliance" for appliance and appliance-db.
+ * Out-of-tree monitors call it in an init() func so they can be compiled in
+ * without changing mm/monitor/factory.go or bin/percona-agent; every Manager
+ * made after that uses the factory (see Manager.RegisterMonitorFactory).
+ * Like sql.Register, it panics if the prefix is registered twice.
+ */
+func RegisterMonitorFactory(prefix string, f MonitorFactory) {
+	if prefix == "" || f == nil {
+		panic("mm: RegisterMonitorFactory: empty prefix or nil factory")
+	}
+	if _, dup := monitorFactories[prefix]; dup {
+		panic("mm: RegisterMonitorFactory called twice for " + prefix)
+	}
+	monitorFactories[prefix] = f
+}
+
 var MetricTypes map[string]bool = map[string]bool{
 	"gauge":   true,
 	"counter": true,
@@ -59,6 +88,23 @@ type Metric struct {
 	String string
 }
 
+const (
+	EVENT_INFO    = pct.EVENT_INFO
+	EVENT_WARNING = pct.EVENT_WARNING
+	EVENT_ERROR   = pct.EVENT_ERROR
+)
+
+// Something that happened, e.g. a checksum diff was found, as opposed to a
+// Metric which is measured every collect interval.  Monitors send events in
+// a Collection; they're reported as-is with the Stats for the interval.
+type Event struct {
+	Ts      int64  // UTC Unix timestamp
+	Type    string // mysql/checksum/diff
+	Level   string // EVENT_INFO, EVENT_WARNING, or EVENT_ERROR
+	Message string
+	Data    interface{} `json:",omitempty"` // structured details, e.g. mysql.Deadlock
+}
+
 // All metrics from a service instance collected at the same time.
 // Collections can come from different instances.  For example,
 // one agent can monitor two different MySQL instances.
@@ -66,12 +112,14 @@ type Collection struct {
 	proto.ServiceInstance
 	Ts      int64 // UTC Unix timestamp
 	Metrics []Metric
+	Events  []Event `json:",omitempty"`
 }
 
 // Stats for each metric from a service instance, computed at each report interval.
 type InstanceStats struct {
 	proto.ServiceInstance
-	Stats map[string]*Stats // keyed on metric name
+	Stats  map[string]*Stats // keyed on metric name
+	Events []Event           `json:",omitempty"`
 }
 
 type Report struct {
@@ -79,3 +127,56 @@ type Report struct {
 	Duration uint      // seconds
 	Stats    []*InstanceStats
 }
+
+// MetricStats returns the stats of the report for sinks like Graphite, see
+// data.MetricReport.
+func (r *Report) MetricStats() (time.Time, []data.InstanceMetricStats) {
+	instances := make([]data.InstanceMetricStats, len(r.Stats))
+	for i, is := range r.Stats {
+		instances[i] = data.InstanceMetricStats{
+			Service:    is.Service,
+			InstanceId: is.InstanceId,
+			Stats:      make(map[string]data.MetricStats, len(is.Stats)),
+		}
+		for metric, s := range is.Stats {
+			instances[i].Stats[metric] = data.MetricStats{
+				Cnt:   s.Cnt,
+				Min:   s.Min,
+				Pct5:  s.Pct5,
+				Avg:   s.Avg,
+				Med:   s.Med,
+				Pct95: s.Pct95,
+				Max:   s.Max,
+				Pct:   s.Pct,
+			}
+		}
+	}
+	return r.Ts, instances
+}
+
+// EventReport returns a report of one agent event, see pct.SendEvent.  The
+// event is from the agent instance if it's not from another one.
+func EventReport(e pct.Event) *Report {
+	si := e.ServiceInstance
+	if si.Service == "" {
+		si = proto.ServiceInstance{Service: "agent"}
+	}
+	return &Report{
+		Ts: e.Ts.UTC(),
+		Stats: []*InstanceStats{
+			{
+				ServiceInstance: si,
+				Stats:           make(map[string]*Stats),
+				Events: []Event{
+					{
+						Ts:      e.Ts.Unix(),
+						Type:    e.Type,
+						Level:   e.Level,
+						Message: e.Message,
+						Data:    e.Data,
+					},
+				},
+			},
+		},
+	}
+}
@@ -20,20 +20,29 @@ package monitor
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/cache"
+	"github.com/percona/percona-agent/mm/checks"
+	"github.com/percona/percona-agent/mm/haproxy"
+	"github.com/percona/percona-agent/mm/mongo"
 	"github.com/percona/percona-agent/mm/mysql"
+	"github.com/percona/percona-agent/mm/postgres"
+	"github.com/percona/percona-agent/mm/self"
 	"github.com/percona/percona-agent/mm/system"
 	"github.com/percona/percona-agent/mrms"
 	mysqlConn "github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
+	"sort"
 )
 
 type Factory struct {
 	logChan chan *proto.LogEntry
 	ir      *instance.Repo
 	mrm     mrms.Monitor
+	queues  map[string]self.Queue // for agent monitors
 }
 
 func NewFactory(logChan chan *proto.LogEntry, ir *instance.Repo, mrm mrms.Monitor) *Factory {
@@ -41,55 +50,246 @@ func NewFactory(logChan chan *proto.LogEntry, ir *instance.Repo, mrm mrms.Monito
 		logChan: logChan,
 		ir:      ir,
 		mrm:     mrm,
+		queues:  make(map[string]self.Queue),
 	}
 	return f
 }
 
+// AddQueue adds a queue, e.g. the data spool, whose depth agent monitors
+// report as agent/queue/<name>.  Call before monitors are made.
+func (f *Factory) AddQueue(name string, queue self.Queue) {
+	f.queues[name] = queue
+}
+
+/**
+ * makers are the monitors Make can make, keyed on service.  Capabilities
+ * reports the same services, so they're always in sync.  Monitors that
+ * need a build tag add themselves to makers in an init() in their tagged
+ * file.
+ */
+var makers = map[string]func(f *Factory, service string, instanceId uint, data []byte) (mm.Monitor, error){
+	"agent":         (*Factory).makeAgent,
+	"mysql":         (*Factory).makeMySQL,
+	"server":        (*Factory).makeServer,
+	"mongodb":       (*Factory).makeMongo,
+	"postgres":      (*Factory).makePostgres,
+	"checks":        (*Factory).makeChecks,
+	cache.REDIS:     (*Factory).makeCache,
+	cache.MEMCACHED: (*Factory).makeCache,
+	"haproxy":       (*Factory).makeHAProxy,
+}
+
 func (f *Factory) Make(service string, instanceId uint, data []byte) (mm.Monitor, error) {
-	var monitor mm.Monitor
-	switch service {
-	case "mysql":
-		// Load the MySQL instance info (DSN, name, etc.).
-		mysqlIt := &proto.MySQLInstance{}
-		if err := f.ir.Get(service, instanceId, mysqlIt); err != nil {
-			return nil, err
-		}
-
-		// Parse the MySQL sysconfig config.
-		config := &mysql.Config{}
-		if err := json.Unmarshal(data, config); err != nil {
-			return nil, err
-		}
-
-		// The user-friendly name of the service, e.g. sysconfig-mysql-db101:
-		alias := "mm-mysql-" + mysqlIt.Hostname
-
-		// Make a MySQL metrics monitor.
-		monitor = mysql.NewMonitor(
+	maker, ok := makers[service]
+	if !ok {
+		return nil, errors.New("Unknown metrics monitor type: " + service)
+	}
+	return maker(f, service, instanceId, data)
+}
+
+// Capabilities returns the monitors Make can make.
+func (f *Factory) Capabilities() []string {
+	caps := make([]string, 0, len(makers))
+	for service := range makers {
+		caps = append(caps, "monitor:"+service)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func (f *Factory) makeAgent(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the agent self-metrics config.  There's only one agent, so
+	// like "server" there's no instance.
+	config := &self.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	alias := "mm-agent"
+
+	monitor := self.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+		f.queues,
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makeMySQL(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Load the MySQL instance info (DSN, name, etc.).
+	mysqlIt := &proto.MySQLInstance{}
+	if err := f.ir.Get(service, instanceId, mysqlIt); err != nil {
+		return nil, err
+	}
+
+	// Parse the MySQL sysconfig config.
+	config := &mysql.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.ApplyProfile(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// The user-friendly name of the service, e.g. sysconfig-mysql-db101:
+	alias := "mm-mysql-" + mysqlIt.Hostname
+
+	// Make a MySQL metrics monitor, or a multi-target monitor if the
+	// config lists instances to collect from.
+	if len(config.Targets) > 0 {
+		monitor := mysql.NewMultiMonitor(
 			alias,
 			config,
 			pct.NewLogger(f.logChan, alias),
-			mysqlConn.NewConnection(mysqlIt.DSN),
+			&mysqlConn.RealConnectionFactory{},
 			f.mrm,
 		)
-	case "server":
-		// Parse the system mm config.
-		config := &system.Config{}
-		if err := json.Unmarshal(data, config); err != nil {
-			return nil, err
-		}
-
-		// Only one system for now, so no SystemInstance and no  "-instanceName" suffix.
-		alias := "mm-system"
-
-		// Make a MySQL metrics monitor.
-		monitor = system.NewMonitor(
-			alias,
-			config,
-			pct.NewLogger(f.logChan, alias),
-		)
-	default:
-		return nil, errors.New("Unknown metrics monitor type: " + service)
+		return monitor, nil
+	}
+	monitor := mysql.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+		mysqlConn.NewConnection(mysqlIt.DSN),
+		f.mrm,
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makeServer(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the system mm config.
+	config := &system.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	// Only one system for now, so no SystemInstance and no  "-instanceName" suffix.
+	alias := "mm-system"
+
+	// Make a MySQL metrics monitor.
+	monitor := system.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makeMongo(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the MongoDB mm config.  There's no MongoDB instance in the
+	// instance repo, so the config has the URI to connect with.
+	config := &mongo.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.URI == "" {
+		return nil, errors.New("MongoDB metrics monitor config has no URI")
+	}
+
+	alias := fmt.Sprintf("mm-mongo-%d", instanceId)
+
+	monitor := mongo.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makePostgres(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the PostgreSQL mm config.  Like MongoDB, there's no
+	// PostgreSQL instance in the instance repo, so the config has the DSN.
+	config := &postgres.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.DSN == "" {
+		return nil, errors.New("PostgreSQL metrics monitor config has no DSN")
+	}
+
+	alias := fmt.Sprintf("mm-postgres-%d", instanceId)
+
+	monitor := postgres.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makeChecks(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the checks mm config.  Checks are probed from this host,
+	// so like "server" there's only one and no instance.
+	config := &checks.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	alias := "mm-checks"
+
+	monitor := checks.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makeCache(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the Redis or Memcached mm config.  One monitor collects
+	// from all the config's instances.
+	config := &cache.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	alias := fmt.Sprintf("mm-%s-%d", service, instanceId)
+
+	monitor := cache.NewMonitor(
+		alias,
+		service,
+		config,
+		pct.NewLogger(f.logChan, alias),
+	)
+	return monitor, nil
+}
+
+func (f *Factory) makeHAProxy(service string, instanceId uint, data []byte) (mm.Monitor, error) {
+	// Parse the HAProxy mm config.
+	config := &haproxy.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.Socket == "" && config.URL == "" {
+		return nil, errors.New("HAProxy metrics monitor config has no Socket or URL")
 	}
+
+	alias := fmt.Sprintf("mm-haproxy-%d", instanceId)
+
+	monitor := haproxy.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(f.logChan, alias),
+	)
 	return monitor, nil
 }
+
+// Estimate makes the monitor like Make but, instead of starting it, asks it
+// to estimate the metrics it would collect.  Only MySQL monitors can.
+func (f *Factory) Estimate(service string, instanceId uint, data []byte) (*mm.Estimate, error) {
+	monitor, err := f.Make(service, instanceId, data)
+	if err != nil {
+		return nil, err
+	}
+	estimator, ok := monitor.(interface {
+		Estimate() (*mm.Estimate, error)
+	})
+	if !ok {
+		return nil, errors.New("Cannot estimate metrics for " + service + " monitors")
+	}
+	return estimator.Estimate()
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// Some metrics are too slow to collect on every tick: the whole collection
+// is discarded if it takes longer than the collect limit.  These are collected
+// in the background every so often and sent with the next collection.
+type bgCollector struct {
+	sync.Mutex
+	running bool        // collecting in background
+	lastTs  int64       // when last started
+	metrics []mm.Metric // collected, not yet sent
+	events  []mm.Event  // collected, not yet sent
+}
+
+type bgCollectFunc func(conn *sql.DB, ts int64) ([]mm.Metric, []mm.Event)
+
+// getBackground adds to c the metrics and events collected in the background
+// by bg, if any, and starts collecting again if interval seconds have passed.
+func (m *Monitor) getBackground(bg *bgCollector, interval int64, conn *sql.DB, c *mm.Collection, collect bgCollectFunc) {
+	bg.Lock()
+	defer bg.Unlock()
+
+	if len(bg.metrics) > 0 {
+		c.Metrics = append(c.Metrics, bg.metrics...)
+		bg.metrics = nil
+	}
+	if len(bg.events) > 0 {
+		c.Events = append(c.Events, bg.events...)
+		bg.events = nil
+	}
+
+	if bg.running || (bg.lastTs > 0 && c.Ts-bg.lastTs < interval) {
+		return
+	}
+	bg.running = true
+	bg.lastTs = c.Ts
+
+	ts := c.Ts
+	go func() {
+		var metrics []mm.Metric
+		var events []mm.Event
+		defer func() {
+			if err := recover(); err != nil {
+				m.logger.Error("Background collection crashed: ", err)
+			}
+			bg.Lock()
+			bg.metrics = metrics
+			bg.events = events
+			bg.running = false
+			bg.Unlock()
+		}()
+		metrics, events = collect(conn, ts)
+	}()
+}
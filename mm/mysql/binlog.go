@@ -0,0 +1,352 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mysql"
+)
+
+/**
+ * If Config.Binlog is true, SHOW BINARY LOGS and SHOW MASTER STATUS are run
+ * every Config.BinlogInterval seconds to report:
+ *
+ *   mysql/binlog/files          number of binlog files
+ *   mysql/binlog/bytes          total size of binlog files
+ *   mysql/binlog/growth         bytes written per second since last time
+ *   mysql/binlog/gtid_executed  transactions in the executed GTID set (if any)
+ *   mysql/binlog/replicas       replicas in SHOW SLAVE HOSTS
+ *
+ * bytes is what's on disk, so it drops when binlogs are purged; growth is
+ * how fast binlogs are written, from the master position, so it doesn't.
+ *
+ * If Config.BinlogReplicas is true, every replica in SHOW SLAVE HOSTS is
+ * checked for binlogs that it needs but the master has purged: it connects
+ * to the replica's report_host:report_port with the master's DSN (like
+ * pt-table-checksum --recursion-method=hosts) and compares the replica's
+ * SHOW SLAVE STATUS to the master's first binlog and, with GTID auto-position,
+ * to @@gtid_purged.  A replica that stops because of this (error 1236)
+ * disconnects and drops from SHOW SLAVE HOSTS, so replicas seen before are
+ * checked, too, until they cannot be reached.  mysql/binlog/replicas_missing
+ * is the number of such replicas, and an error event is sent for each once.
+ * This runs in the background (see background.go) because connecting to
+ * replicas can be slow.
+ */
+
+const (
+	DEFAULT_BINLOG_INTERVAL = 60 // 1 minute
+)
+
+type binlogState struct {
+	disabled bool   // binary logging is off, warned once
+	lastTs   int64  // last collected
+	lastFile string // master position last collected
+	lastPos  int64
+	replicas map[string]*binlogReplica // keyed on Server_id
+}
+
+type binlogReplica struct {
+	host     string
+	port     string
+	reported string // missing binlog last reported, so it's reported once
+}
+
+type binlogFile struct {
+	name string
+	size int64
+}
+
+func (m *Monitor) collectBinlogMetrics(conn *sql.DB, ts int64) ([]mm.Metric, []mm.Event) {
+	state := &m.binlogState
+	if state.disabled {
+		return nil, nil
+	}
+
+	files, err := showBinaryLogs(conn)
+	if err != nil {
+		if mysql.MySQLErrorCode(err) == mysql.ER_NO_BINARY_LOGGING {
+			m.logger.Warn("Cannot collect binlog metrics: binary logging is not enabled")
+			state.disabled = true
+			return nil, nil
+		}
+		m.logger.Warn("Cannot collect binlog metrics: ", err)
+		return nil, nil
+	}
+	master, err := showRow(conn, "SHOW MASTER STATUS")
+	if err != nil {
+		m.logger.Warn("Cannot collect binlog metrics: ", err)
+		return nil, nil
+	}
+
+	var bytes int64
+	for _, f := range files {
+		bytes += f.size
+	}
+	metrics := []mm.Metric{
+		{Name: "mysql/binlog/files", Type: "gauge", Number: float64(len(files))},
+		{Name: "mysql/binlog/bytes", Type: "gauge", Number: float64(bytes)},
+	}
+
+	if master != nil {
+		file := master["File"]
+		pos, _ := strconv.ParseInt(master["Position"], 10, 64)
+		if state.lastTs > 0 && ts > state.lastTs {
+			written, ok := binlogWritten(files, state.lastFile, state.lastPos, file, pos)
+			if ok {
+				metrics = append(metrics, mm.Metric{
+					Name:   "mysql/binlog/growth",
+					Type:   "gauge",
+					Number: float64(written) / float64(ts-state.lastTs),
+				})
+			}
+		}
+		state.lastTs = ts
+		state.lastFile = file
+		state.lastPos = pos
+
+		if gtids, ok := master["Executed_Gtid_Set"]; ok && gtids != "" {
+			metrics = append(metrics, mm.Metric{
+				Name:   "mysql/binlog/gtid_executed",
+				Type:   "gauge",
+				Number: float64(GtidCount(gtids)),
+			})
+		}
+	}
+
+	hosts, err := showSlaveHosts(conn)
+	if err != nil {
+		m.logger.Warn("Cannot get replicas: ", err)
+		return metrics, nil
+	}
+	metrics = append(metrics, mm.Metric{Name: "mysql/binlog/replicas", Type: "gauge", Number: float64(len(hosts))})
+
+	if !m.config.BinlogReplicas || len(files) == 0 {
+		return metrics, nil
+	}
+	if state.replicas == nil {
+		state.replicas = make(map[string]*binlogReplica)
+	}
+	for id, r := range hosts {
+		if prev, ok := state.replicas[id]; ok {
+			r.reported = prev.reported
+		}
+		state.replicas[id] = r
+	}
+	var purged string
+	if err := conn.QueryRow("SELECT @@GLOBAL.gtid_purged").Scan(&purged); err != nil {
+		purged = "" // MySQL < 5.6
+	}
+	missing := 0
+	events := []mm.Event{}
+	for id, r := range state.replicas {
+		need, err := m.replicaMissingBinlog(conn, r, files[0].name, purged)
+		if err != nil {
+			if _, ok := hosts[id]; !ok {
+				delete(state.replicas, id) // gone
+			} else {
+				m.logger.Warn(fmt.Sprintf("Cannot check replica %s (server_id %s): %s", r.addr(), id, err))
+			}
+			continue
+		}
+		if need == "" {
+			r.reported = ""
+			continue
+		}
+		missing++
+		if need == r.reported {
+			continue
+		}
+		r.reported = need
+		events = append(events, mm.Event{
+			Ts:    ts,
+			Type:  "mysql/binlog/purged_needed",
+			Level: mm.EVENT_ERROR,
+			Message: fmt.Sprintf("Replica %s (server_id %s) needs %s but it has been purged; first binlog is %s",
+				r.addr(), id, need, files[0].name),
+		})
+	}
+	metrics = append(metrics, mm.Metric{Name: "mysql/binlog/replicas_missing", Type: "gauge", Number: float64(missing)})
+
+	return metrics, events
+}
+
+// replicaMissingBinlog returns what the replica needs that the master has
+// purged: a binlog file or GTIDs, else "".  first is the master's first binlog,
+// purged is its @@gtid_purged.
+func (m *Monitor) replicaMissingBinlog(conn *sql.DB, r *binlogReplica, first, purged string) (string, error) {
+	if r.host == "" {
+		return "", fmt.Errorf("report_host is not set on the replica")
+	}
+	c := mysql.NewConnection(ReplicaDSN(m.conn.DSN(), r.host, r.port))
+	if err := c.Connect(1); err != nil {
+		return "", err
+	}
+	defer c.Close()
+	status, err := showRow(c.DB(), "SHOW SLAVE STATUS")
+	if err != nil {
+		return "", err
+	}
+	if status == nil {
+		return "", nil // not a replica anymore
+	}
+
+	if status["Auto_Position"] == "1" && purged != "" {
+		var subset bool
+		err := conn.QueryRow("SELECT GTID_SUBSET(?, ?)", purged, status["Executed_Gtid_Set"]).Scan(&subset)
+		if err != nil {
+			return "", err
+		}
+		if !subset {
+			return "purged GTIDs " + strings.Replace(purged, "\n", "", -1), nil
+		}
+		return "", nil
+	}
+
+	file := status["Master_Log_File"]
+	if file != "" && binlogIndex(file) < binlogIndex(first) {
+		return file, nil
+	}
+	if status["Last_IO_Errno"] == strconv.Itoa(mysql.ER_MASTER_FATAL_READING) {
+		return file, nil
+	}
+	return "", nil
+}
+
+func (r *binlogReplica) addr() string {
+	return r.host + ":" + r.port
+}
+
+// binlogWritten returns the bytes written from file1:pos1 to file2:pos2 given
+// the binlog files and their sizes.  It returns false if file1 was purged, or
+// if the position went backwards, e.g. RESET MASTER.
+func binlogWritten(files []binlogFile, file1 string, pos1 int64, file2 string, pos2 int64) (int64, bool) {
+	if file1 == file2 {
+		return pos2 - pos1, pos2 >= pos1
+	}
+	var written int64
+	found := false
+	for _, f := range files {
+		switch {
+		case f.name == file1:
+			found = true
+			written += f.size - pos1
+		case f.name == file2:
+			return written + pos2, found
+		case found:
+			written += f.size
+		}
+	}
+	return 0, false
+}
+
+// binlogIndex returns the number of a binlog file, e.g. 12 for mysql-bin.000012.
+func binlogIndex(file string) int64 {
+	i := strings.LastIndex(file, ".")
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(file[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+var gtidIntervalRe = regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
+
+// GtidCount returns the number of transactions in a GTID set, e.g. 15 for
+// "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-10:12-15,4D7...:1".
+func GtidCount(set string) uint64 {
+	var n uint64
+	for _, uuidSet := range strings.Split(set, ",") {
+		parts := strings.Split(strings.TrimSpace(uuidSet), ":")
+		for _, interval := range parts[1:] {
+			// Skip tags (MySQL 8.4), which aren't numbers.
+			m := gtidIntervalRe.FindStringSubmatch(interval)
+			if m == nil {
+				continue
+			}
+			start, _ := strconv.ParseUint(m[1], 10, 64)
+			end := start
+			if m[2] != "" {
+				end, _ = strconv.ParseUint(m[2], 10, 64)
+			}
+			if end >= start {
+				n += end - start + 1
+			}
+		}
+	}
+	return n
+}
+
+var dsnNetRe = regexp.MustCompile(`@(?:tcp6?|unix)\([^)]*\)`)
+
+// ReplicaDSN returns the DSN to connect to host:port with the credentials
+// and options of dsn, a MySQL DSN like user:pass@tcp(db1:3306)/?tls=true.
+func ReplicaDSN(dsn, host, port string) string {
+	if port == "" || port == "0" {
+		port = "3306"
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	net := "@tcp(" + host + ":" + port + ")"
+	if dsnNetRe.MatchString(dsn) {
+		return dsnNetRe.ReplaceAllLiteralString(dsn, net)
+	}
+	// user:pass@/db has no net, so it's the default: localhost.
+	if i := strings.LastIndex(dsn, "@/"); i >= 0 {
+		return dsn[:i] + net + dsn[i+1:]
+	}
+	return dsn
+}
+
+func showBinaryLogs(conn *sql.DB) ([]binlogFile, error) {
+	rows, err := showRows(conn, "SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	files := make([]binlogFile, len(rows))
+	for i, row := range rows {
+		files[i].name = row["Log_name"]
+		files[i].size, _ = strconv.ParseInt(row["File_size"], 10, 64)
+	}
+	return files, nil
+}
+
+// showSlaveHosts returns the replicas in SHOW SLAVE HOSTS keyed on Server_id.
+func showSlaveHosts(conn *sql.DB) (map[string]*binlogReplica, error) {
+	rows, err := showRows(conn, "SHOW SLAVE HOSTS")
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]*binlogReplica, len(rows))
+	for _, row := range rows {
+		hosts[row["Server_id"]] = &binlogReplica{
+			host: row["Host"],
+			port: row["Port"],
+		}
+	}
+	return hosts, nil
+}
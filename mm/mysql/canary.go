@@ -0,0 +1,69 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+/**
+ * If Config.Canary is true, a trivial query (SELECT 1, or Config.CanaryQuery)
+ * is run first on every tick and its round-trip time, including reading the
+ * result, is reported as mysql/canary/latency (seconds).  It's what an
+ * application sees, unlike server-reported counters.  mysql/canary/ok is 1
+ * if the query succeeded, else 0, e.g. if a configured query on an
+ * application table hits a lock wait timeout.  If the connection is lost,
+ * the tick is lost like every other metric, so a gap means unavailable.
+ */
+
+const (
+	DEFAULT_CANARY_QUERY = "SELECT 1"
+)
+
+func (m *Monitor) runCanary(conn *sql.DB, c *mm.Collection) error {
+	m.logger.Debug("runCanary:call")
+	defer m.logger.Debug("runCanary:return")
+
+	query := m.config.CanaryQuery
+	if query == "" {
+		query = DEFAULT_CANARY_QUERY
+	}
+
+	start := time.Now()
+	rows, err := conn.Query(query)
+	if err == nil {
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	latency := time.Now().Sub(start).Seconds()
+
+	if err != nil {
+		c.Metrics = append(c.Metrics, mm.Metric{Name: "mysql/canary/ok", Type: "gauge", Number: 0})
+		return err
+	}
+	c.Metrics = append(c.Metrics,
+		mm.Metric{Name: "mysql/canary/ok", Type: "gauge", Number: 1},
+		mm.Metric{Name: "mysql/canary/latency", Type: "gauge", Number: latency},
+	)
+	return nil
+}
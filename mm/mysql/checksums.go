@@ -0,0 +1,119 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+/**
+ * pt-table-checksum writes the checksum of each chunk of each table to a
+ * checksums table (default percona.checksums) on the master, and the writes
+ * replicate so each slave has the master's checksum (master_crc, master_cnt)
+ * and its own (this_crc, this_cnt).  A chunk differs if they don't match.
+ * The table only changes when pt-table-checksum runs, so it's read in the
+ * background every Config.ChecksumInterval seconds.  An event is sent when
+ * a table's diff chunks or last checksum time change and it has diffs, not
+ * every time, else the same diffs would be reported until the next run.
+ */
+
+const (
+	DEFAULT_CHECKSUM_TABLE    = "percona.checksums"
+	DEFAULT_CHECKSUM_INTERVAL = 300 // 5 minutes
+)
+
+type checksumResult struct {
+	db         string
+	tbl        string
+	chunks     int64
+	diffChunks int64
+	lastTs     string // max(ts) of the table's chunks
+}
+
+func (m *Monitor) collectChecksums(conn *sql.DB, ts int64) ([]mm.Metric, []mm.Event) {
+	table := m.config.ChecksumTable
+	if table == "" {
+		table = DEFAULT_CHECKSUM_TABLE
+	}
+
+	results, err := m.getChecksums(conn, table)
+	if err != nil {
+		m.logger.Warn("Cannot read checksums from "+table+": ", err)
+		return nil, nil
+	}
+
+	metrics := []mm.Metric{}
+	events := []mm.Event{}
+	diffTables := 0
+	for dbTable, r := range results {
+		prefix := "mysql/db." + mm.EscapeName(r.db) + "/t." + mm.EscapeName(r.tbl) + "/"
+		metrics = append(metrics,
+			mm.Metric{Name: prefix + "checksum_chunks", Type: "gauge", Number: float64(r.chunks)},
+			mm.Metric{Name: prefix + "checksum_diff_chunks", Type: "gauge", Number: float64(r.diffChunks)},
+		)
+		if r.diffChunks == 0 {
+			continue
+		}
+		diffTables++
+		if prev, ok := m.checksums[dbTable]; ok && *prev == *r {
+			continue // already reported
+		}
+		events = append(events, mm.Event{
+			Ts:    ts,
+			Type:  "mysql/checksum/diff",
+			Level: mm.EVENT_WARNING,
+			Message: fmt.Sprintf("%s has %d of %d chunks different from the master (checksummed at %s)",
+				dbTable, r.diffChunks, r.chunks, r.lastTs),
+		})
+	}
+	metrics = append(metrics, mm.Metric{Name: "mysql/checksum/diff_tables", Type: "gauge", Number: float64(diffTables)})
+
+	m.checksums = results
+	return metrics, events
+}
+
+func (m *Monitor) getChecksums(conn *sql.DB, table string) (map[string]*checksumResult, error) {
+	db, tbl, err := splitTable(table) // Config.Validate checked it
+	if err != nil {
+		return nil, err
+	}
+	// Same diff query as the pt-table-checksum docs, per table.
+	rows, err := conn.Query("SELECT db, tbl, COUNT(*)," +
+		" SUM(master_cnt <> this_cnt OR master_crc <> this_crc OR ISNULL(master_crc) <> ISNULL(this_crc))," +
+		" MAX(ts)" +
+		" FROM `" + db + "`.`" + tbl + "`" +
+		" GROUP BY db, tbl")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[string]*checksumResult)
+	for rows.Next() {
+		var diffChunks sql.NullInt64 // NULL if crc columns are NULL, e.g. still running
+		r := &checksumResult{}
+		if err := rows.Scan(&r.db, &r.tbl, &r.chunks, &diffChunks, &r.lastTs); err != nil {
+			return nil, err
+		}
+		r.diffChunks = diffChunks.Int64
+		results[r.db+"."+r.tbl] = r
+	}
+	return results, rows.Err()
+}
@@ -18,13 +18,193 @@
 package mysql
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
 	"github.com/percona/percona-agent/mm"
 )
 
+const (
+	STATUS_ALL         = "*"
+	DEFAULT_STATUS_MAX = 500
+)
+
 type Config struct {
 	mm.Config
-	Status            map[string]string // SHOW STATUS variables to collect, case-sensitive
-	InnoDB            []string          // SET GLOBAL innodb_monitor_enable="<value>"
-	UserStats         bool              // SET GLOBAL userstat=ON|OFF
+	Status            StatusVars // SHOW STATUS variables to collect, case-sensitive
+	StatusMax         uint       // max variables to collect if Status is "*"
+	Include           []string   // also collect SHOW STATUS variables matching these globs
+	Exclude           []string   // but not those matching these globs
+	InnoDB            []string   // SET GLOBAL innodb_monitor_enable="<value>"
+	InnoDBBufferPools bool       // per-instance INNODB_BUFFER_POOL_STATS
+	InnoDBInterval    uint       // how often to collect InnoDB metrics (seconds)
+	UserStats         bool       // SET GLOBAL userstat=ON|OFF
 	UserStatsIgnoreDb string
+	UserStatsInterval uint // how often to collect UserStats metrics (seconds)
+	UserStatsBySchema bool // sum user stats per database instead of per table/index
+	Space             bool // partition counts and tablespace sizes, see space.go
+	SpaceInterval     uint // how often to collect Space metrics (seconds)
+	Checksums         bool // pt-table-checksum results, see checksums.go
+	ChecksumTable     string
+	ChecksumInterval  uint     // how often to read ChecksumTable (seconds)
+	Slave             bool     // SHOW SLAVE STATUS threads and errors, see slave.go
+	SlaveRestart      []uint16 // restart slave threads stopped by these errors, e.g. 1205
+	SlaveRestartMax   uint     // max restarts per hour
+	SlaveInterval     uint     // how often to collect Slave metrics (seconds)
+	Binlog            bool     // binlog size, growth, and GTIDs, see binlog.go
+	BinlogInterval    uint     // how often to collect Binlog metrics (seconds)
+	BinlogReplicas    bool     // check replicas for purged binlogs they need
+	Deadlocks         bool     // SHOW ENGINE INNODB STATUS deadlocks and waits, see deadlock.go
+	DeadlockInterval  uint     // how often to collect Deadlocks metrics (seconds)
+	Canary            bool     // time a trivial query every tick, see canary.go
+	CanaryQuery       string   // query to time instead of SELECT 1
+	SLA               bool     // uptime, MTBF, and MTTR accounting, see sla.go
+	// Multi-target mode: collect from these instances instead of the one
+	// given by mm.Config.ServiceInstance.  See MultiMonitor.
+	Targets    []Target
+	MaxWorkers uint // max concurrent collections in multi-target mode
+}
+
+// LIGHT_STATUS is the core metric set for mm.PROFILE_LIGHT: enough to see
+// if MySQL is up, busy, and healthy, but cheap to collect from many instances.
+var LIGHT_STATUS = StatusVars{
+	"Uptime":                           "counter",
+	"Threads_connected":                "gauge",
+	"Threads_running":                  "gauge",
+	"Max_used_connections":             "gauge",
+	"Connections":                      "counter",
+	"Aborted_clients":                  "counter",
+	"Aborted_connects":                 "counter",
+	"Queries":                          "counter",
+	"Questions":                        "counter",
+	"Slow_queries":                     "counter",
+	"Com_select":                       "counter",
+	"Com_insert":                       "counter",
+	"Com_update":                       "counter",
+	"Com_delete":                       "counter",
+	"Bytes_received":                   "counter",
+	"Bytes_sent":                       "counter",
+	"Created_tmp_disk_tables":          "counter",
+	"Select_full_join":                 "counter",
+	"Innodb_row_lock_waits":            "counter",
+	"Innodb_buffer_pool_reads":         "counter",
+	"Innodb_buffer_pool_read_requests": "counter",
+}
+
+// ApplyProfile changes the config for its mm.Config.Profile.  The light
+// profile collects only LIGHT_STATUS and the canary query every 10s (at
+// least), plus replication (Slave) if configured because slave lag and thread
+// errors are core health; MRMS still watches the instance because every
+// monitor uses it.
+func (c *Config) ApplyProfile() error {
+	if err := c.Config.ApplyProfile(); err != nil {
+		return err
+	}
+	if c.Profile != mm.PROFILE_LIGHT {
+		return nil
+	}
+	c.Status = StatusVars{}
+	for name, metricType := range LIGHT_STATUS {
+		c.Status[name] = metricType
+	}
+	c.Include = nil
+	c.Exclude = nil
+	c.InnoDB = nil
+	c.InnoDBBufferPools = false
+	c.UserStats = false
+	c.Space = false
+	c.Checksums = false
+	c.Binlog = false
+	c.Deadlocks = false
+	c.Canary = true
+	return nil
+}
+
+// Validate returns an error if the config has values that would be put in
+// SQL or metric names unchecked: ChecksumTable must be db.tbl, and each
+// Target must have a DSN and a unique InstanceName without a slash because
+// it's a metric name prefix.
+func (c *Config) Validate() error {
+	if c.ChecksumTable != "" {
+		if _, _, err := splitTable(c.ChecksumTable); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for i, t := range c.Targets {
+		switch {
+		case t.InstanceName == "":
+			return fmt.Errorf("Target %d has no InstanceName", i+1)
+		case strings.Contains(t.InstanceName, "/"):
+			return fmt.Errorf("Invalid Target InstanceName: %s: cannot have /", t.InstanceName)
+		case names[t.InstanceName]:
+			return fmt.Errorf("Duplicate Target InstanceName: %s", t.InstanceName)
+		case t.DSN == "":
+			return fmt.Errorf("Target %s has no DSN", t.InstanceName)
+		}
+		names[t.InstanceName] = true
+	}
+	return nil
+}
+
+var tableName = regexp.MustCompile(`^([0-9A-Za-z$_]+)\.([0-9A-Za-z$_]+)$`)
+
+// splitTable returns the db and table of a db.tbl name, or an error if it's
+// not db.tbl with plain identifiers, so they're safe to quote with backticks.
+func splitTable(table string) (string, string, error) {
+	m := tableName.FindStringSubmatch(table)
+	if m == nil {
+		return "", "", errors.New("Invalid table: " + table + ": expected db.tbl")
+	}
+	return m[1], m[2], nil
+}
+
+type Target struct {
+	InstanceName string // metrics are prefixed mysql/<InstanceName>/
+	DSN          string
+}
+
+// StatusVars maps SHOW STATUS variables to their metric type.  In JSON it
+// can also be "*" to collect every numeric variable, which is useful before
+// the metric set is tuned.  Variables matching Config.Exclude are not
+// collected, and at most Config.StatusMax are collected.  "*" can also be
+// a key in the map to collect every variable and set the type of some.
+// Keys are case-insensitive and can be patterns, see status.go.
+type StatusVars map[string]string
+
+// All returns true if all variables are collected.
+func (s StatusVars) All() bool {
+	_, ok := s[STATUS_ALL]
+	return ok
+}
+
+func (s *StatusVars) UnmarshalJSON(data []byte) error {
+	var all string
+	if err := json.Unmarshal(data, &all); err == nil {
+		if all != STATUS_ALL {
+			return fmt.Errorf("Invalid Status: %s: expected %s or an object", all, STATUS_ALL)
+		}
+		*s = StatusVars{STATUS_ALL: ""}
+		return nil
+	}
+	vars := map[string]string{}
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return err
+	}
+	// Invalid types and regexps fail here so they fail StartService.
+	if _, err := newStatusMatcher(vars); err != nil {
+		return err
+	}
+	*s = StatusVars(vars)
+	return nil
+}
+
+func (s StatusVars) MarshalJSON() ([]byte, error) {
+	if len(s) == 1 && s.All() {
+		return json.Marshal(STATUS_ALL)
+	}
+	return json.Marshal(map[string]string(s))
 }
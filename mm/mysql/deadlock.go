@@ -0,0 +1,315 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mysql"
+)
+
+/**
+ * If Config.Deadlocks is true, SHOW ENGINE INNODB STATUS is run every
+ * Config.DeadlockInterval seconds to report:
+ *
+ *   mysql/engine_status/deadlocks             deadlocks since MySQL started
+ *   mysql/engine_status/lock_waits            transactions waiting for a lock
+ *   mysql/engine_status/history_list_length   undo log entries not purged
+ *   mysql/engine_status/semaphore_waits       threads waiting on a semaphore
+ *   mysql/engine_status/os_wait_reservations  OS WAIT ARRAY INFO counters
+ *   mysql/engine_status/os_wait_signals
+ *   mysql/engine_status/<lock>_spin_waits     for mutex, rw_shared, rw_excl,
+ *   mysql/engine_status/<lock>_spin_rounds    and rw_sx (5.7), as reported
+ *   mysql/engine_status/<lock>_os_waits
+ *
+ * The status only has the latest deadlock, so deadlocks is Innodb_deadlocks
+ * (Percona Server) or lock_deadlocks in INNODB_METRICS (5.6), else the number
+ * of different LATEST DETECTED DEADLOCK sections seen by the agent.  When it
+ * changes, the section is parsed into a Deadlock and sent as the Data of a
+ * mysql/engine_status/deadlock event, so a deadlock is reported once even if
+ * it stays the latest for days.  The first status only sets the baseline: its
+ * deadlock happened before the agent was watching.  This runs in the
+ * background (see background.go) because the status can be slow on busy
+ * servers.
+ */
+
+const (
+	DEFAULT_DEADLOCK_INTERVAL = 60 // 1 minute
+)
+
+// A Deadlock is the LATEST DETECTED DEADLOCK section of SHOW ENGINE INNODB
+// STATUS, sent as mm.Event.Data.
+type Deadlock struct {
+	Ts           string // as printed by InnoDB, MySQL's local time
+	Transactions []DeadlockTransaction
+	RolledBack   int // Number of the transaction rolled back, 0 if not printed
+}
+
+type DeadlockTransaction struct {
+	Number   int    // (1), (2), etc.
+	Id       string // InnoDB transaction id
+	ThreadId string // MySQL thread (connection) id
+	Thread   string // MySQL thread id line: host, user, state
+	Query    string
+	Holds    []string // locks held: RECORD LOCKS or TABLE LOCK lines
+	Waits    []string // lock waited for
+}
+
+type deadlockState struct {
+	disabled  bool   // no PROCESS privilege, warned once
+	collected bool   // baseline set
+	deadlocks uint64 // last count
+	latest    string // last LATEST DETECTED DEADLOCK section
+}
+
+var (
+	spinWaitsRe  = regexp.MustCompile(`^(Mutex|RW-shared|RW-excl|RW-sx) spin(?:s| waits) (\d+), rounds (\d+), OS waits (\d+)`)
+	osWaitRe     = regexp.MustCompile(`^OS WAIT ARRAY INFO: (reservation|signal) count (\d+)`)
+	deadlockTrx  = regexp.MustCompile(`^\*\*\* \((\d+)\) (TRANSACTION|HOLDS THE LOCK\(S\)|WAITING FOR THIS LOCK TO BE GRANTED):`)
+	rolledBackRe = regexp.MustCompile(`^\*\*\* WE ROLL BACK TRANSACTION \((\d+)\)`)
+)
+
+func (m *Monitor) collectDeadlocks(conn *sql.DB, ts int64) ([]mm.Metric, []mm.Event) {
+	state := &m.deadlockState
+	if state.disabled {
+		return nil, nil
+	}
+
+	sections, err := showEngineInnoDBStatus(conn)
+	if err != nil {
+		if mysql.MySQLErrorCode(err) == mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR {
+			m.logger.Warn("Cannot collect deadlocks: SHOW ENGINE INNODB STATUS requires the PROCESS privilege")
+			state.disabled = true
+			return nil, nil
+		}
+		m.logger.Warn("Cannot collect deadlocks: ", err)
+		return nil, nil
+	}
+	metrics := EngineStatusMetrics(sections)
+
+	latest := sections["LATEST DETECTED DEADLOCK"]
+	count, ok := deadlockCount(conn)
+	if !ok {
+		count = state.deadlocks
+		if state.collected && latest != "" && latest != state.latest {
+			count++
+		}
+	}
+	metrics = append(metrics, mm.Metric{Name: "mysql/engine_status/deadlocks", Type: "counter", Number: float64(count)})
+
+	var events []mm.Event
+	if state.collected && count != state.deadlocks && latest != "" && latest != state.latest {
+		deadlock := ParseDeadlock(latest)
+		msg := fmt.Sprintf("Deadlock at %s between %d transactions", deadlock.Ts, len(deadlock.Transactions))
+		if deadlock.RolledBack > 0 {
+			msg += fmt.Sprintf(", rolled back transaction (%d)", deadlock.RolledBack)
+		}
+		if count > state.deadlocks+1 {
+			msg += fmt.Sprintf("; %d deadlocks since last collected, this is the latest", count-state.deadlocks)
+		}
+		events = append(events, mm.Event{
+			Ts:      ts,
+			Type:    "mysql/engine_status/deadlock",
+			Level:   mm.EVENT_WARNING,
+			Message: msg,
+			Data:    deadlock,
+		})
+	}
+	state.collected = true
+	state.deadlocks = count
+	state.latest = latest
+
+	return metrics, events
+}
+
+// showEngineInnoDBStatus returns the sections of SHOW ENGINE INNODB STATUS
+// keyed on title, e.g. "SEMAPHORES".
+func showEngineInnoDBStatus(conn *sql.DB) (map[string]string, error) {
+	row, err := showRow(conn, "SHOW ENGINE INNODB STATUS")
+	if err != nil {
+		return nil, err
+	}
+	return ParseEngineStatus(row["Status"]), nil
+}
+
+// deadlockCount returns the number of deadlocks since MySQL started if MySQL
+// counts them, else ok is false.
+func deadlockCount(conn *sql.DB) (count uint64, ok bool) {
+	var name string
+	if err := conn.QueryRow("SHOW GLOBAL STATUS LIKE 'Innodb_deadlocks'").Scan(&name, &count); err == nil {
+		return count, true
+	}
+	err := conn.QueryRow("SELECT COUNT FROM INFORMATION_SCHEMA.INNODB_METRICS" +
+		" WHERE NAME = 'lock_deadlocks' AND STATUS = 'enabled'").Scan(&count)
+	return count, err == nil
+}
+
+// ParseEngineStatus returns the sections of the SHOW ENGINE INNODB STATUS text
+// keyed on title.  A section starts with its title, e.g. SEMAPHORES, between
+// two lines of dashes.
+func ParseEngineStatus(status string) map[string]string {
+	sections := map[string]string{}
+	lines := strings.Split(status, "\n")
+	title := ""
+	start := 0
+	for i := 0; i+2 < len(lines); i++ {
+		if !isDashes(lines[i]) || !isDashes(lines[i+2]) || lines[i+1] == "" || strings.HasPrefix(lines[i+1], "-") {
+			continue
+		}
+		if title != "" {
+			sections[title] = strings.Join(lines[start:i], "\n")
+		}
+		title = strings.TrimSpace(lines[i+1])
+		start = i + 3
+		i += 2
+	}
+	if title != "" {
+		// The last section ends before END OF INNODB MONITOR OUTPUT.
+		end := len(lines)
+		for i := start; i < len(lines); i++ {
+			if strings.HasPrefix(lines[i], "END OF INNODB MONITOR OUTPUT") {
+				end = i
+				if isDashes(lines[i-1]) {
+					end--
+				}
+				break
+			}
+		}
+		sections[title] = strings.Join(lines[start:end], "\n")
+	}
+	return sections
+}
+
+func isDashes(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) >= 3 && strings.Trim(line, "-") == ""
+}
+
+// EngineStatusMetrics returns the semaphore and transaction metrics in the
+// sections of SHOW ENGINE INNODB STATUS, but not deadlocks which is counted
+// elsewhere.
+func EngineStatusMetrics(sections map[string]string) []mm.Metric {
+	const prefix = "mysql/engine_status/"
+	metrics := []mm.Metric{}
+
+	if semaphores, ok := sections["SEMAPHORES"]; ok {
+		waits := 0
+		for _, line := range strings.Split(semaphores, "\n") {
+			if strings.Contains(line, " has waited at ") {
+				waits++
+			} else if m := osWaitRe.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.ParseFloat(m[2], 64)
+				metrics = append(metrics, mm.Metric{Name: prefix + "os_wait_" + m[1] + "s", Type: "counter", Number: n})
+			} else if m := spinWaitsRe.FindStringSubmatch(line); m != nil {
+				lock := strings.Replace(strings.ToLower(m[1]), "-", "_", -1)
+				for i, stat := range []string{"spin_waits", "spin_rounds", "os_waits"} {
+					n, _ := strconv.ParseFloat(m[i+2], 64)
+					metrics = append(metrics, mm.Metric{Name: prefix + lock + "_" + stat, Type: "counter", Number: n})
+				}
+			}
+		}
+		metrics = append(metrics, mm.Metric{Name: prefix + "semaphore_waits", Type: "gauge", Number: float64(waits)})
+	}
+
+	if trx, ok := sections["TRANSACTIONS"]; ok {
+		waits := 0
+		for _, line := range strings.Split(trx, "\n") {
+			if strings.HasPrefix(line, "------- TRX HAS BEEN WAITING") {
+				waits++
+			} else if strings.HasPrefix(line, "History list length ") {
+				n, err := strconv.ParseFloat(strings.TrimSpace(line[len("History list length "):]), 64)
+				if err == nil {
+					metrics = append(metrics, mm.Metric{Name: prefix + "history_list_length", Type: "gauge", Number: n})
+				}
+			}
+		}
+		metrics = append(metrics, mm.Metric{Name: prefix + "lock_waits", Type: "gauge", Number: float64(waits)})
+	}
+
+	return metrics
+}
+
+// ParseDeadlock parses the LATEST DETECTED DEADLOCK section.  Record dumps
+// (the hex lines after each lock) are not kept.
+func ParseDeadlock(section string) *Deadlock {
+	d := &Deadlock{Transactions: []DeadlockTransaction{}}
+	var trx *DeadlockTransaction
+	part := ""
+	for _, line := range strings.Split(section, "\n") {
+		if d.Ts == "" {
+			d.Ts = strings.TrimSpace(line) // first line, e.g. 2014-10-08 12:17:10 7f4d2c2e0700
+			continue
+		}
+		if m := deadlockTrx.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			part = m[2]
+			if part == "TRANSACTION" {
+				d.Transactions = append(d.Transactions, DeadlockTransaction{Number: n, Holds: []string{}, Waits: []string{}})
+			}
+			trx = nil
+			for i := range d.Transactions {
+				if d.Transactions[i].Number == n {
+					trx = &d.Transactions[i]
+				}
+			}
+			continue
+		}
+		if m := rolledBackRe.FindStringSubmatch(line); m != nil {
+			d.RolledBack, _ = strconv.Atoi(m[1])
+			trx = nil
+			continue
+		}
+		if trx == nil {
+			continue
+		}
+		switch part {
+		case "TRANSACTION":
+			switch {
+			case strings.HasPrefix(line, "TRANSACTION ") && trx.Id == "":
+				trx.Id = strings.TrimSuffix(strings.Fields(line)[1], ",")
+			case strings.HasPrefix(line, "MySQL thread id "):
+				trx.Thread = line
+				trx.ThreadId = strings.TrimSuffix(strings.Fields(line)[3], ",")
+			case trx.Thread != "":
+				// The query is everything after the thread line.
+				if trx.Query != "" {
+					trx.Query += "\n"
+				}
+				trx.Query += line
+			}
+		case "HOLDS THE LOCK(S)":
+			if isLockLine(line) {
+				trx.Holds = append(trx.Holds, line)
+			}
+		default: // WAITING FOR THIS LOCK TO BE GRANTED
+			if isLockLine(line) {
+				trx.Waits = append(trx.Waits, line)
+			}
+		}
+	}
+	return d
+}
+
+func isLockLine(line string) bool {
+	return strings.HasPrefix(line, "RECORD LOCKS ") || strings.HasPrefix(line, "TABLE LOCK ")
+}
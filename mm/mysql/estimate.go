@@ -0,0 +1,259 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * Estimate connects to MySQL and counts the metrics the monitor would collect
+ * with its config, without starting it, for the EstimateMetrics cmd.  Most
+ * groups are counted by running the same queries as collect() on a throwaway
+ * Collection, but nothing is changed: there's no SET GLOBAL, no slave restart,
+ * and no background collector.  So InnoDB metrics that the config would enable
+ * and user stats that aren't running yet are counted from what the server has:
+ *
+ *   - InnoDB: INNODB_METRICS rows enabled now or matched by Config.InnoDB.
+ *   - User stats: every table and index in INFORMATION_SCHEMA, which is the
+ *     upper bound because only tables and indexes that are read or changed
+ *     are in TABLE_STATISTICS and INDEX_STATISTICS.
+ *
+ * mm does not collect Performance Schema instruments, but they're noted because
+ * they're what makes P_S more or less expensive on the server, too.
+ */
+func (m *Monitor) Estimate() (*mm.Estimate, error) {
+	m.logger.Debug("Estimate:call")
+	defer m.logger.Debug("Estimate:return")
+
+	if err := m.conn.Connect(1); err != nil {
+		return nil, err
+	}
+	defer m.conn.Close()
+	conn := m.conn.DB()
+
+	m.checkMariaDB()
+
+	e := &mm.Estimate{}
+
+	// SHOW GLOBAL STATUS
+	c := &mm.Collection{Metrics: []mm.Metric{}}
+	if err := m.GetShowStatusMetrics(conn, c); err != nil {
+		return nil, err
+	}
+	e.Add("status", uint(len(c.Metrics)), 0, "")
+
+	if len(m.config.InnoDB) > 0 {
+		n, err := m.estimateInnoDBMetrics(conn)
+		if err != nil {
+			e.Notes = append(e.Notes, "Cannot count InnoDB metrics: "+err.Error())
+		} else {
+			e.Add("innodb", n, m.config.InnoDBInterval, "enabled or matched by InnoDB")
+		}
+	}
+
+	if m.config.InnoDBBufferPools {
+		c := &mm.Collection{Metrics: []mm.Metric{}}
+		if err := m.getBufferPoolStats(conn, c); err != nil {
+			e.Notes = append(e.Notes, "Cannot count InnoDB buffer pool metrics: "+err.Error())
+		} else {
+			e.Add("innodb-buffer-pools", uint(len(c.Metrics)), m.config.InnoDBInterval, "")
+		}
+	}
+
+	if m.config.UserStats {
+		tables, indexes, note, err := m.estimateUserStats(conn)
+		if err != nil {
+			e.Notes = append(e.Notes, "Cannot count user stats: "+err.Error())
+		} else {
+			e.Add("userstats-tables", tables, m.config.UserStatsInterval, note)
+			e.Add("userstats-indexes", indexes, m.config.UserStatsInterval, note)
+		}
+	}
+
+	if m.config.Space {
+		interval := m.config.SpaceInterval
+		if interval == 0 {
+			interval = DEFAULT_SPACE_INTERVAL
+		}
+		metrics, _ := m.collectSpaceMetrics(conn, 0) // warns on error
+		e.Add("space", uint(len(metrics)), interval, "")
+	}
+
+	if m.config.Checksums {
+		table := m.config.ChecksumTable
+		if table == "" {
+			table = DEFAULT_CHECKSUM_TABLE
+		}
+		interval := m.config.ChecksumInterval
+		if interval == 0 {
+			interval = DEFAULT_CHECKSUM_INTERVAL
+		}
+		results, err := m.getChecksums(conn, table)
+		if err != nil {
+			e.Notes = append(e.Notes, "Cannot read checksums from "+table+": "+err.Error())
+		} else {
+			e.Add("checksums", uint(len(results)*2+1), interval, "")
+		}
+	}
+
+	if m.config.Slave {
+		status, err := showSlaveStatus(conn)
+		if err != nil {
+			e.Notes = append(e.Notes, "Cannot get slave status: "+err.Error())
+		} else if status == nil {
+			e.Add("slave", 0, m.config.SlaveInterval, "not a slave")
+		} else {
+			e.Add("slave", uint(len(slaveThreads)*2), m.config.SlaveInterval, "")
+		}
+	}
+
+	if m.config.Binlog {
+		interval := m.config.BinlogInterval
+		if interval == 0 {
+			interval = DEFAULT_BINLOG_INTERVAL
+		}
+		n := uint(5) // files, bytes, growth, gtid_executed, replicas
+		if m.config.BinlogReplicas {
+			n++
+		}
+		e.Add("binlog", n, interval, "")
+	}
+
+	if m.config.Deadlocks {
+		interval := m.config.DeadlockInterval
+		if interval == 0 {
+			interval = DEFAULT_DEADLOCK_INTERVAL
+		}
+		sections, err := showEngineInnoDBStatus(conn)
+		if err != nil {
+			e.Notes = append(e.Notes, "Cannot get InnoDB status: "+err.Error())
+		} else {
+			n := uint(len(EngineStatusMetrics(sections)) + 1) // + deadlocks
+			e.Add("deadlocks", n, interval, "")
+		}
+	}
+
+	if m.config.Canary {
+		e.Add("canary", 2, 0, "")
+	}
+
+	// Performance Schema
+	var enabled, total sql.NullInt64
+	err := conn.QueryRow("SELECT SUM(ENABLED = 'YES'), COUNT(*) FROM performance_schema.setup_instruments").Scan(&enabled, &total)
+	if err == nil {
+		e.Notes = append(e.Notes, fmt.Sprintf("performance_schema: %d of %d instruments enabled (not collected by mm)",
+			enabled.Int64, total.Int64))
+	}
+
+	return e, nil
+}
+
+func (m *Monitor) estimateInnoDBMetrics(conn *sql.DB) (uint, error) {
+	/**
+	 * Config.InnoDB values are innodb_monitor_enable values: a counter name,
+	 * module_<name>, all, or a pattern with % wildcards.  Module names are
+	 * usually module_<SUBSYSTEM>, so this is an estimate.
+	 */
+	all := false
+	modules := map[string]bool{}
+	patterns := []string{}
+	for _, v := range m.config.InnoDB {
+		v = strings.ToLower(v)
+		switch {
+		case v == "all":
+			all = true
+		case strings.HasPrefix(v, "module_"):
+			modules[strings.TrimPrefix(v, "module_")] = true
+		default:
+			patterns = append(patterns, strings.Replace(v, "%", "*", -1))
+		}
+	}
+	names := pct.NewGlobMatcher(patterns)
+
+	rows, err := conn.Query("SELECT NAME, SUBSYSTEM, STATUS FROM INFORMATION_SCHEMA.INNODB_METRICS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n uint
+	for rows.Next() {
+		var name, subsystem, status string
+		if err := rows.Scan(&name, &subsystem, &status); err != nil {
+			return 0, err
+		}
+		if all || status == "enabled" || modules[strings.ToLower(subsystem)] || names.Match(name) {
+			n++
+		}
+	}
+	return n, rows.Err()
+}
+
+func (m *Monitor) estimateUserStats(conn *sql.DB) (tables, indexes uint, note string, err error) {
+	// Fails if the server doesn't have user stats, so collect() would fail, too.
+	var running uint
+	if err := conn.QueryRow("SELECT COUNT(*) FROM INFORMATION_SCHEMA.TABLE_STATISTICS").Scan(&running); err != nil {
+		return 0, 0, "", err
+	}
+
+	where := " WHERE TABLE_SCHEMA NOT IN ('information_schema', 'performance_schema')"
+	if m.config.UserStatsIgnoreDb != "" {
+		where += " AND TABLE_SCHEMA NOT LIKE '" + m.config.UserStatsIgnoreDb + "'"
+	}
+	var nTables, nIndexes, nSchemas, nIndexSchemas uint
+	err = conn.QueryRow("SELECT COUNT(*), COUNT(DISTINCT TABLE_SCHEMA) FROM INFORMATION_SCHEMA.TABLES"+where).Scan(&nTables, &nSchemas)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	err = conn.QueryRow("SELECT COUNT(DISTINCT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME), COUNT(DISTINCT TABLE_SCHEMA)"+
+		" FROM INFORMATION_SCHEMA.STATISTICS"+where).Scan(&nIndexes, &nIndexSchemas)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	note = fmt.Sprintf("upper bound, %d tables have stats now", running)
+	if m.config.UserStatsBySchema {
+		return nSchemas * 3, nIndexSchemas, note, nil
+	}
+	return nTables * 3, nIndexes, note, nil
+}
+
+// Estimate estimates each target like a single Monitor.  Groups are prefixed
+// by the target's instance name, e.g. db1/status, like its metrics.
+func (m *MultiMonitor) Estimate() (*mm.Estimate, error) {
+	e := &mm.Estimate{}
+	for i, target := range m.targets {
+		name := m.config.Targets[i].InstanceName
+		t, err := target.Estimate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for _, g := range t.Groups {
+			e.Add(name+"/"+g.Name, g.Metrics, g.Interval, g.Note)
+		}
+		for _, note := range t.Notes {
+			e.Notes = append(e.Notes, name+": "+note)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"strings"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * MariaDB has SHOW STATUS variables that MySQL and Percona Server don't:
+ * the Aria storage engine (Aria_*), its thread pool (Threadpool_*), and
+ * optimizer and row counters.  When the monitor connects it checks @@version
+ * and, if the server is MariaDB, collects these variables too, like Include
+ * patterns, unless they match Config.Exclude.  StatusType knows which are
+ * gauges.
+ */
+
+var mariadbStatus = []string{
+	"aria_*",
+	"threadpool_*",
+	"optimizer_*",
+	"rows_read",
+	"rows_sent",
+	"rows_tmp_read",
+	"memory_used",
+}
+
+func isMariaDB(version string) bool {
+	return strings.Contains(strings.ToLower(version), "mariadb")
+}
+
+// checkMariaDB sets m.mariadb to match mariadbStatus if the server is MariaDB,
+// else to match nothing.  It's called by connect() before it tells run() that
+// it's connected, so run() never collects while it changes.
+func (m *Monitor) checkMariaDB() {
+	var version string
+	if err := m.conn.DB().QueryRow("SELECT @@version").Scan(&version); err != nil {
+		m.logger.Warn("Cannot get MySQL version: ", err)
+		m.mariadb = pct.NewGlobMatcher(nil)
+		return
+	}
+	if isMariaDB(version) {
+		m.logger.Info("MariaDB " + version + ": collecting MariaDB status variables")
+		m.mariadb = pct.NewGlobMatcher(mariadbStatus)
+	} else {
+		m.mariadb = pct.NewGlobMatcher(nil)
+	}
+}
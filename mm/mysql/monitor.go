@@ -19,7 +19,9 @@ package mysql
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -55,9 +57,43 @@ type Monitor struct {
 	running        bool
 	collectLimit   float64
 	mrm            mrms.Monitor
+	statusVars     *statusMatcher // Config.Status, see status.go
+	include        *pct.GlobMatcher
+	exclude        *pct.GlobMatcher
+	mariadb        *pct.GlobMatcher // MariaDB status variables, see mariadb.go
+	notNumeric     map[string]bool  // Include variables with non-numeric values
+	statusCapped   bool             // StatusMax reached, warned once
+	space          bgCollector
+	checksum       bgCollector
+	checksums      map[string]*checksumResult // last read, keyed on db.tbl
+	binlog         bgCollector
+	binlogState    binlogState // only used by collectBinlogMetrics
+	deadlock       bgCollector
+	deadlockState  deadlockState // only used by collectDeadlocks
+	sla            *SLA          // Config.SLA, only used by run()
+	canaryFailed   bool          // last canary query failed, for SLA
+	slave          slaveState
+	innodbTs       int64 // last collected, for Config.InnoDBInterval
+	userStatsTs    int64 // last collected, for Config.UserStatsInterval
+	slaveTs        int64 // last collected, for Config.SlaveInterval
+
+	// Last user stats per schema for Config.UserStatsBySchema, keyed on
+	// table and table.index.
+	schemaTables  map[string]map[string]schemaUserStats
+	schemaIndexes map[string]map[string]int64
 }
 
 func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Connector, mrm mrms.Monitor) *Monitor {
+	statusVars, err := newStatusMatcher(config.Status)
+	if err != nil {
+		// Configs from JSON are validated, so only a bad config in code.
+		logger.Error(err)
+		statusVars, _ = newStatusMatcher(nil)
+	}
+	statusProcs := []string{name, name + "-mysql"}
+	if config.SLA {
+		statusProcs = append(statusProcs, name+"-sla")
+	}
 	m := &Monitor{
 		name:   name,
 		config: config,
@@ -66,10 +102,15 @@ func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Conn
 		// --
 		connectedChan: make(chan bool, 1),
 		restartChan:   nil,
-		status:        pct.NewStatus([]string{name, name + "-mysql"}),
+		status:        pct.NewStatus(statusProcs),
 		sync:          pct.NewSyncChan(),
 		collectLimit:  float64(config.Collect) * 0.1, // 10% of Collect time
 		mrm:           mrm,
+		statusVars:    statusVars,
+		include:       pct.NewGlobMatcher(config.Include),
+		exclude:       pct.NewGlobMatcher(config.Exclude),
+		mariadb:       pct.NewGlobMatcher(nil),
+		notNumeric:    make(map[string]bool),
 	}
 	return m
 }
@@ -157,25 +198,40 @@ func (m *Monitor) connect(err error) {
 			m.logger.Warn(err)
 			continue
 		}
+		// Add the instance only when we have a connection. Otherwise, mrm.Add will fail
+		if m.restartChan == nil {
+			m.restartChan, err = m.mrm.Add(m.conn.DSN())
+			if err != nil {
+				m.logger.Warn(fmt.Sprintf("Cannot add instance to the restart monitor: %v", err))
+			}
+		}
 		m.logger.Info("Connected")
 		m.status.Update(m.name+"-mysql", "Connected")
 
+		m.checkMariaDB()
 		m.setGlobalVars()
 
 		// Tell run() goroutine that it can try to collect metrics.
 		// If connection is lost, it will call us again.
 		m.connectedChan <- true
-		// Add the instance only when we have a connection. Otherwise, mrm.Add will fail
-		if m.restartChan == nil {
-			m.restartChan, err = m.mrm.Add(m.conn.DSN())
-			if err != nil {
-				m.logger.Warn(fmt.Sprintf("Cannot add instance to the restart monitor: %v", err))
-			}
-		}
 		return
 	}
 }
 
+// reconnect is called by run() when collecting fails because the connection
+// to MySQL was lost.  It tells run() to stop collecting (connectedChan <- false)
+// and restarts connect() which retries, with backoff, until MySQL is back.
+func (m *Monitor) reconnect(err error) {
+	m.logger.Debug("reconnect:call")
+	defer m.logger.Debug("reconnect:return")
+	select {
+	case m.connectedChan <- false:
+	default:
+		// Chan is full; run() has already set connected=false itself.
+	}
+	go m.connect(err)
+}
+
 // We need to set these vars everytime we connect to the DB because as these
 // are session variables, they get lost on MySQL restarts
 func (m *Monitor) setGlobalVars() {
@@ -199,8 +255,14 @@ func (m *Monitor) setGlobalVars() {
 	if m.config.UserStats {
 		// 5.1.49 <= v <= 5.5.10: SET GLOBAL userstat_running=ON
 		// 5.5.10 <  v:           SET GLOBAL userstat=ON
+		// MariaDB:               SET GLOBAL userstat=ON
 		sql := "SET GLOBAL userstat=ON"
-		if _, err := m.conn.DB().Exec(sql); err != nil {
+		_, err := m.conn.DB().Exec(sql)
+		if err != nil && mysql.MySQLErrorCode(err) == mysql.ER_UNKNOWN_SYSTEM_VARIABLE {
+			sql = "SET GLOBAL userstat_running=ON"
+			_, err = m.conn.DB().Exec(sql)
+		}
+		if err != nil {
 			errMsg := fmt.Sprintf("Cannot collect user stats because '%s' failed: %s", sql, err)
 			m.logger.Error(errMsg)
 			m.config.UserStats = false
@@ -215,11 +277,24 @@ func (m *Monitor) run() {
 			m.logger.Error("MySQL monitor crashed: ", err)
 		}
 		m.conn.Close()
+		if m.sla != nil {
+			if err := m.sla.Save(); err != nil {
+				m.logger.Warn("Cannot save SLA accounting: ", err)
+			}
+		}
 		m.status.Update(m.name, "Stopped")
 		m.sync.Done()
 		m.logger.Debug("run:return")
 	}()
 
+	if m.config.SLA {
+		sla, err := NewSLA(SLAFile(m.config.InstanceId))
+		if err != nil {
+			m.logger.Warn("Cannot load SLA accounting, starting over: ", err)
+		}
+		m.sla = sla
+	}
+
 	connected := false
 	go m.connect(nil)
 
@@ -241,67 +316,26 @@ func (m *Monitor) run() {
 			if !connected {
 				m.logger.Debug("run:collect:disconnected")
 				lastError = "Not connected to MySQL"
+				m.sendEvents(now, m.slaTick(now, false))
 				continue
 			}
 
 			m.status.Update(m.name, "Running")
-			c := &mm.Collection{
-				ServiceInstance: proto.ServiceInstance{
-					Service:    m.config.Service,
-					InstanceId: m.config.InstanceId,
-				},
-				Ts:      now.UTC().Unix(),
-				Metrics: []mm.Metric{},
-			}
 
 			// Start timing the collection.  If must take < collectLimit else
 			// it's discarded.
 			start := time.Now()
-			conn := m.conn.DB()
-
-			// SHOW GLOBAL STATUS
-			if err := m.GetShowStatusMetrics(conn, c); err != nil {
-				if m.collectError(err) == networkError {
-					connected = false
-					continue
-				}
-			}
-
-			// SELECT NAME, ... FROM INFORMATION_SCHEMA.INNODB_METRICS
-			if len(m.config.InnoDB) > 0 {
-				if err := m.GetInnoDBMetrics(conn, c); err != nil {
-					switch m.collectError(err) {
-					case accessDenied:
-						m.config.InnoDB = []string{}
-					case networkError:
-						connected = false
-						continue
-					}
-				}
-			}
 
-			if m.config.UserStats {
-				// SELECT ... FROM INFORMATION_SCHEMA.TABLE_STATISTICS
-				if err := m.getTableUserStats(conn, c, m.config.UserStatsIgnoreDb); err != nil {
-					switch m.collectError(err) {
-					case accessDenied:
-						m.config.UserStats = false
-					case networkError:
-						connected = false
-						continue
-					}
-				}
-				// SELECT ... FROM INFORMATION_SCHEMA.INDEX_STATISTICS
-				if err := m.getIndexUserStats(conn, c, m.config.UserStatsIgnoreDb); err != nil {
-					switch m.collectError(err) {
-					case accessDenied:
-						m.config.UserStats = false
-					case networkError:
-						connected = false
-						continue
-					}
-				}
+			c, err := m.collect(now)
+			if err != nil {
+				connected = false
+				lastError = "Lost connection to MySQL"
+				m.sendEvents(now, m.slaTick(now, false))
+				m.reconnect(err)
+				continue
 			}
+			slaEvents := m.slaTick(now, !m.canaryFailed)
+			c.Events = append(c.Events, slaEvents...)
 
 			// It is possible that collecting metrics will stall for many
 			// seconds for some reason so even though we issued captures 1 sec in
@@ -313,12 +347,13 @@ func (m *Monitor) run() {
 			if diff >= m.collectLimit {
 				lastError = fmt.Sprintf("Skipping interval because it took too long to collect: %.2fs >= %.2fs", diff, m.collectLimit)
 				m.logger.Warn(lastError)
+				m.sendEvents(now, slaEvents)
 				continue
 			}
 
 			// Send the metrics to an mm.Aggregator.
 			m.status.Update(m.name, "Sending metrics")
-			if len(c.Metrics) > 0 {
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
 				select {
 				case m.collectionChan <- c:
 					lastTs = c.Ts
@@ -335,10 +370,21 @@ func (m *Monitor) run() {
 
 			m.logger.Debug("run:collect:stop")
 		case connected = <-m.connectedChan:
-			m.logger.Debug("run:connected:true")
-			m.status.Update(m.name, "Ready")
+			m.logger.Debug(fmt.Sprintf("run:connected:%t", connected))
+			if connected {
+				m.status.Update(m.name, "Ready")
+			}
 		case <-m.restartChan:
 			m.logger.Debug("run:mysql:restart")
+			if m.sla != nil {
+				if err := m.sla.Restart(time.Now().UTC().Unix()); err != nil {
+					m.logger.Warn("Cannot save SLA accounting: ", err)
+				}
+			}
+			if !connected {
+				// Already reconnecting, connect() will tell us when it's done.
+				continue
+			}
 			connected = false
 			go m.connect(fmt.Errorf("Lost connection to MySQL, restarting"))
 		case <-m.sync.StopChan:
@@ -348,6 +394,189 @@ func (m *Monitor) run() {
 	}
 }
 
+// slaTick accounts the tick if Config.SLA, see sla.go.  It returns the daily
+// mysql/sla event if it's due.
+func (m *Monitor) slaTick(now time.Time, up bool) []mm.Event {
+	if m.sla == nil {
+		return nil
+	}
+	ts := now.UTC().Unix()
+	if err := m.sla.Tick(ts, up); err != nil {
+		m.logger.Warn("Cannot save SLA accounting: ", err)
+	}
+	m.status.Update(m.name+"-sla", slaStatus(m.sla.Windows(ts)))
+	if report := m.sla.Report(ts); report != nil {
+		return []mm.Event{slaEvent(report)}
+	}
+	return nil
+}
+
+// sendEvents sends the events without metrics, e.g. the daily mysql/sla event
+// when MySQL is down.
+func (m *Monitor) sendEvents(now time.Time, events []mm.Event) {
+	if len(events) == 0 {
+		return
+	}
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+		Events:  events,
+	}
+	select {
+	case m.collectionChan <- c:
+	case <-time.After(500 * time.Millisecond):
+		m.logger.Warn("Lost events; timeout spooling after 500ms")
+	}
+}
+
+// collect gets all the metrics enabled by the config.  It returns networkError
+// if the connection to MySQL was lost, else errors are handled (logged, and
+// the failed metrics may be disabled) and the collection is returned.
+func (m *Monitor) collect(now time.Time) (*mm.Collection, error) {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+
+	conn := m.conn.DB()
+
+	// SELECT 1, first so it's not delayed by other queries
+	m.canaryFailed = false
+	if m.config.Canary {
+		if err := m.runCanary(conn, c); err != nil {
+			m.canaryFailed = true
+			// Not disabled on error: mysql/canary/ok=0 is the signal.
+			if m.collectError(err) == networkError {
+				return nil, networkError
+			}
+		}
+	}
+
+	// SHOW GLOBAL STATUS
+	if err := m.GetShowStatusMetrics(conn, c); err != nil {
+		if m.collectError(err) == networkError {
+			return nil, networkError
+		}
+	}
+
+	// SELECT NAME, ... FROM INFORMATION_SCHEMA.INNODB_METRICS
+	// SELECT POOL_ID, ... FROM INFORMATION_SCHEMA.INNODB_BUFFER_POOL_STATS
+	if (len(m.config.InnoDB) > 0 || m.config.InnoDBBufferPools) && due(m.innodbTs, c.Ts, m.config.InnoDBInterval) {
+		if err := m.GetInnoDBMetrics(conn, c); err != nil {
+			switch m.collectError(err) {
+			case accessDenied:
+				m.config.InnoDB = []string{}
+				m.config.InnoDBBufferPools = false
+			case networkError:
+				return nil, networkError
+			}
+		} else {
+			m.innodbTs = c.Ts
+		}
+	}
+
+	if m.config.UserStats && due(m.userStatsTs, c.Ts, m.config.UserStatsInterval) {
+		// SELECT ... FROM INFORMATION_SCHEMA.TABLE_STATISTICS
+		tableErr := m.getTableUserStats(conn, c, m.config.UserStatsIgnoreDb)
+		if tableErr != nil {
+			switch m.collectError(tableErr) {
+			case accessDenied:
+				m.config.UserStats = false
+			case networkError:
+				return nil, networkError
+			}
+		}
+		// SELECT ... FROM INFORMATION_SCHEMA.INDEX_STATISTICS
+		indexErr := m.getIndexUserStats(conn, c, m.config.UserStatsIgnoreDb)
+		if indexErr != nil {
+			switch m.collectError(indexErr) {
+			case accessDenied:
+				m.config.UserStats = false
+			case networkError:
+				return nil, networkError
+			}
+		}
+		if tableErr == nil && indexErr == nil {
+			m.userStatsTs = c.Ts
+		}
+	}
+
+	// SELECT ... FROM INFORMATION_SCHEMA.PARTITIONS, FILES (in background)
+	if m.config.Space {
+		interval := int64(m.config.SpaceInterval)
+		if interval == 0 {
+			interval = DEFAULT_SPACE_INTERVAL
+		}
+		m.getBackground(&m.space, interval, conn, c, m.collectSpaceMetrics)
+	}
+
+	// SHOW SLAVE STATUS
+	if m.config.Slave && due(m.slaveTs, c.Ts, m.config.SlaveInterval) {
+		if err := m.getSlaveStatus(conn, c); err != nil {
+			switch m.collectError(err) {
+			case accessDenied:
+				m.config.Slave = false
+			case networkError:
+				return nil, networkError
+			}
+		} else {
+			m.slaveTs = c.Ts
+		}
+	}
+
+	// SHOW BINARY LOGS, MASTER STATUS, SLAVE HOSTS (in background)
+	if m.config.Binlog {
+		interval := int64(m.config.BinlogInterval)
+		if interval == 0 {
+			interval = DEFAULT_BINLOG_INTERVAL
+		}
+		m.getBackground(&m.binlog, interval, conn, c, m.collectBinlogMetrics)
+	}
+
+	// SHOW ENGINE INNODB STATUS (in background)
+	if m.config.Deadlocks {
+		interval := int64(m.config.DeadlockInterval)
+		if interval == 0 {
+			interval = DEFAULT_DEADLOCK_INTERVAL
+		}
+		m.getBackground(&m.deadlock, interval, conn, c, m.collectDeadlocks)
+	}
+
+	// SELECT ... FROM percona.checksums (in background)
+	if m.config.Checksums {
+		interval := int64(m.config.ChecksumInterval)
+		if interval == 0 {
+			interval = DEFAULT_CHECKSUM_INTERVAL
+		}
+		m.getBackground(&m.checksum, interval, conn, c, m.collectChecksums)
+	}
+
+	return c, nil
+}
+
+// due returns true if a group of metrics collected every interval seconds
+// should be collected at ts, i.e. it wasn't collected at lastTs in the same
+// interval.  The caller sets lastTs = ts only if the collection succeeds, so
+// a failed one is retried on the next tick.  The group is collected on the
+// first tick in each interval, e.g. every minute at :00 if interval=60, so it
+// stays aligned with the synchronized collect ticks even if a tick is skipped.
+// If interval is 0 or 1, it's collected every tick.
+func due(lastTs, ts int64, interval uint) bool {
+	if interval <= 1 {
+		return true
+	}
+	i := int64(interval)
+	return lastTs == 0 || ts/i != lastTs/i
+}
+
 // --------------------------------------------------------------------------
 // SHOW STATUS
 // --------------------------------------------------------------------------
@@ -358,6 +587,14 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 
 	m.status.Update(m.name, "Getting global status metrics")
 
+	all := m.config.Status.All()
+	max := int(m.config.StatusMax)
+	if max == 0 {
+		max = DEFAULT_STATUS_MAX
+	}
+	collected := 0
+	skipped := 0
+
 	rows, err := conn.Query("SHOW /*!50002 GLOBAL */ STATUS")
 	if err != nil {
 		return err
@@ -371,9 +608,19 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 		}
 
 		statName = strings.ToLower(statName)
-		metricType, ok := m.config.Status[statName]
-		if !ok {
-			continue // not collecting this stat
+		key, ok := m.statusVars.Match(statName)
+		named := ok && key.glob == nil && key.re == nil
+		if !named {
+			// Variables named in Status are always collected, else collect
+			// those matching Status patterns or Include (or all if Status is
+			// "*") or MariaDB variables but not Exclude.
+			if !(ok || all || m.include.Match(statName) || m.mariadb.Match(statName)) || m.exclude.Match(statName) || m.notNumeric[statName] {
+				continue // not collecting this stat
+			}
+		}
+		metricType := key.metricType
+		if metricType == "" {
+			metricType = StatusType(statName)
 		}
 
 		if statValue == "" {
@@ -384,17 +631,44 @@ func (m *Monitor) GetShowStatusMetrics(conn *sql.DB, c *mm.Collection) error {
 
 		metricValue, err := strconv.ParseFloat(statValue, 64)
 		if err != nil {
+			if !named {
+				// Patterns match variables like Slave_running=ON,
+				// so this is expected; don't warn.
+				m.notNumeric[statName] = true
+				continue
+			}
 			m.logger.Warn(fmt.Sprintf("Cannot convert '%s' value '%s' to float: %s", statName, statValue, err))
-			delete(m.config.Status, statName) // stop collecting it
+			m.statusVars.Remove(statName)    // stop collecting it
+			delete(m.config.Status, key.key) // and don't save it
 			continue
 		}
 
+		if all {
+			if collected >= max {
+				skipped++
+				continue
+			}
+			collected++
+		}
+
 		c.Metrics = append(c.Metrics, mm.Metric{"mysql/" + statName, metricType, metricValue, ""})
 	}
 	err = rows.Err()
 	if err != nil {
 		return err
 	}
+
+	if all {
+		// Report how many variables "*" collects so the API can suggest
+		// pruning the list to the ones actually used.
+		c.Metrics = append(c.Metrics, mm.Metric{"mysql/status/collected", "gauge", float64(collected), ""})
+		if skipped > 0 && !m.statusCapped {
+			m.logger.Warn(fmt.Sprintf("Collecting only %d of %d SHOW STATUS variables because StatusMax=%d",
+				collected, collected+skipped, max))
+			m.statusCapped = true
+		}
+	}
+
 	return nil
 }
 
@@ -408,6 +682,20 @@ func (m *Monitor) GetInnoDBMetrics(conn *sql.DB, c *mm.Collection) error {
 	m.logger.Debug("GetInnoDBMetrics:call")
 	defer m.logger.Debug("GetInnoDBMetrics:return")
 
+	if len(m.config.InnoDB) > 0 {
+		if err := m.getInnoDBMetrics(conn, c); err != nil {
+			return err
+		}
+	}
+	if m.config.InnoDBBufferPools {
+		if err := m.getBufferPoolStats(conn, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) getInnoDBMetrics(conn *sql.DB, c *mm.Collection) error {
 	m.status.Update(m.name, "Getting InnoDB metrics")
 
 	rows, err := conn.Query("SELECT NAME, SUBSYSTEM, COUNT, TYPE FROM INFORMATION_SCHEMA.INNODB_METRICS WHERE STATUS='enabled'")
@@ -446,6 +734,54 @@ func (m *Monitor) GetInnoDBMetrics(conn *sql.DB, c *mm.Collection) error {
 	return nil
 }
 
+// --------------------------------------------------------------------------
+// InnoDB buffer pool instances
+// http://dev.mysql.com/doc/refman/5.6/en/innodb-buffer-pool-stats-table.html
+// --------------------------------------------------------------------------
+
+func (m *Monitor) getBufferPoolStats(conn *sql.DB, c *mm.Collection) error {
+	m.status.Update(m.name, "Getting InnoDB buffer pool metrics")
+
+	/**
+	 * SHOW STATUS only has the sum of all buffer pool instances, which hides
+	 * imbalance between instances, e.g. one instance with no free pages.
+	 * HIT_RATE is per 1000 page requests, so 1000 = 100%.
+	 */
+	rows, err := conn.Query("SELECT POOL_ID, FREE_BUFFERS, DATABASE_PAGES, MODIFIED_DATABASE_PAGES," +
+		" HIT_RATE, PENDING_READS FROM INFORMATION_SCHEMA.INNODB_BUFFER_POOL_STATS")
+	if err != nil {
+		if mysql.MySQLErrorCode(err) == mysql.ER_UNKNOWN_TABLE {
+			// MySQL < 5.6 or not Percona Server 5.5
+			m.logger.Warn("Cannot collect InnoDB buffer pool metrics: ", err)
+			m.config.InnoDBBufferPools = false
+			return nil
+		}
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var poolId string
+		var freeBuffers, databasePages, modifiedPages, hitRate, pendingReads float64
+		err = rows.Scan(&poolId, &freeBuffers, &databasePages, &modifiedPages, &hitRate, &pendingReads)
+		if err != nil {
+			return err
+		}
+		prefix := "mysql/innodb/buffer_pool/" + poolId + "/"
+		c.Metrics = append(c.Metrics,
+			mm.Metric{prefix + "pages_free", "gauge", freeBuffers, ""},
+			mm.Metric{prefix + "pages_data", "gauge", databasePages, ""},
+			mm.Metric{prefix + "pages_dirty", "gauge", modifiedPages, ""},
+			mm.Metric{prefix + "hit_rate", "gauge", hitRate / 1000, ""},
+			mm.Metric{prefix + "pending_reads", "gauge", pendingReads, ""},
+		)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // --------------------------------------------------------------------------
 // User Statistics
 // http://www.percona.com/doc/percona-server/5.5/diagnostics/user_stats.html
@@ -472,6 +808,17 @@ func (m *Monitor) getTableUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 		return err
 	}
 	defer rows.Close()
+
+	// If UserStatsBySchema, sum per database and append those metrics last.
+	// The sums are counters, so they must not go down when a table is dropped:
+	// each table's last values are kept until its schema has no stats.
+	var tables map[string]map[string]schemaUserStats
+	var schemas []string
+	if m.config.UserStatsBySchema {
+		tables = make(map[string]map[string]schemaUserStats)
+		schemas = []string{}
+	}
+
 	for rows.Next() {
 		var tableSchema string
 		var tableName string
@@ -483,18 +830,33 @@ func (m *Monitor) getTableUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 			return err
 		}
 
+		if tables != nil {
+			t, ok := tables[tableSchema]
+			if !ok {
+				t = make(map[string]schemaUserStats)
+				for name, last := range m.schemaTables[tableSchema] {
+					t[name] = last
+				}
+				tables[tableSchema] = t
+				schemas = append(schemas, tableSchema)
+			}
+			t[tableName] = schemaUserStats{rowsRead, rowsChanged, rowsChangedIndexes}
+			continue
+		}
+
+		prefix := "mysql/db." + mm.EscapeName(tableSchema) + "/t." + mm.EscapeName(tableName) + "/"
 		c.Metrics = append(c.Metrics, mm.Metric{
-			Name:   "mysql/db." + tableSchema + "/t." + tableName + "/rows_read",
+			Name:   prefix + "rows_read",
 			Type:   "counter",
 			Number: float64(rowsRead),
 		})
 		c.Metrics = append(c.Metrics, mm.Metric{
-			Name:   "mysql/db." + tableSchema + "/t." + tableName + "/rows_changed",
+			Name:   prefix + "rows_changed",
 			Type:   "counter",
 			Number: float64(rowsChanged),
 		})
 		c.Metrics = append(c.Metrics, mm.Metric{
-			Name:   "mysql/db." + tableSchema + "/t." + tableName + "/rows_changed_x_indexes",
+			Name:   prefix + "rows_changed_x_indexes",
 			Type:   "counter",
 			Number: float64(rowsChangedIndexes),
 		})
@@ -503,6 +865,35 @@ func (m *Monitor) getTableUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 	if err != nil {
 		return err
 	}
+
+	if tables == nil {
+		return nil
+	}
+	m.schemaTables = tables
+	for _, tableSchema := range schemas {
+		s := schemaUserStats{}
+		for _, t := range tables[tableSchema] {
+			s.rowsRead += t.rowsRead
+			s.rowsChanged += t.rowsChanged
+			s.rowsChangedIndexes += t.rowsChangedIndexes
+		}
+		prefix := "mysql/db." + mm.EscapeName(tableSchema) + "/"
+		c.Metrics = append(c.Metrics, mm.Metric{
+			Name:   prefix + "rows_read",
+			Type:   "counter",
+			Number: float64(s.rowsRead),
+		})
+		c.Metrics = append(c.Metrics, mm.Metric{
+			Name:   prefix + "rows_changed",
+			Type:   "counter",
+			Number: float64(s.rowsChanged),
+		})
+		c.Metrics = append(c.Metrics, mm.Metric{
+			Name:   prefix + "rows_changed_x_indexes",
+			Type:   "counter",
+			Number: float64(s.rowsChangedIndexes),
+		})
+	}
 	return nil
 }
 
@@ -528,6 +919,16 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 		return err
 	}
 	defer rows.Close()
+
+	// Like table user stats, each index's last rows_read is kept so the
+	// per-database sums don't go down when an index or table is dropped.
+	var indexes map[string]map[string]int64
+	var schemas []string
+	if m.config.UserStatsBySchema {
+		indexes = make(map[string]map[string]int64)
+		schemas = []string{}
+	}
+
 	for rows.Next() {
 		var tableSchema string
 		var tableName string
@@ -538,7 +939,21 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 			return err
 		}
 
-		metricName := "mysql/db." + tableSchema + "/t." + tableName + "/idx." + indexName + "/rows_read"
+		if indexes != nil {
+			idx, ok := indexes[tableSchema]
+			if !ok {
+				idx = make(map[string]int64)
+				for name, last := range m.schemaIndexes[tableSchema] {
+					idx[name] = last
+				}
+				indexes[tableSchema] = idx
+				schemas = append(schemas, tableSchema)
+			}
+			idx[tableName+"."+indexName] = rowsRead
+			continue
+		}
+
+		metricName := "mysql/db." + mm.EscapeName(tableSchema) + "/t." + mm.EscapeName(tableName) + "/idx." + mm.EscapeName(indexName) + "/rows_read"
 		metricValue := float64(rowsRead)
 		c.Metrics = append(c.Metrics, mm.Metric{metricName, "counter", metricValue, ""})
 	}
@@ -546,9 +961,31 @@ func (m *Monitor) getIndexUserStats(conn *sql.DB, c *mm.Collection, ignoreDb str
 	if err != nil {
 		return err
 	}
+
+	if indexes == nil {
+		return nil
+	}
+	m.schemaIndexes = indexes
+	for _, tableSchema := range schemas {
+		var rowsRead int64
+		for _, n := range indexes[tableSchema] {
+			rowsRead += n
+		}
+		metricName := "mysql/db." + mm.EscapeName(tableSchema) + "/idx_rows_read"
+		metricValue := float64(rowsRead)
+		c.Metrics = append(c.Metrics, mm.Metric{metricName, "counter", metricValue, ""})
+	}
 	return nil
 }
 
+// Table user stats per table, and summed per database, when
+// Config.UserStatsBySchema is true.
+type schemaUserStats struct {
+	rowsRead           int64
+	rowsChanged        int64
+	rowsChangedIndexes int64
+}
+
 func (m *Monitor) collectError(err error) error {
 	switch {
 	case mysql.MySQLErrorCode(err) == mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR:
@@ -561,6 +998,14 @@ func (m *Monitor) collectError(err error) error {
 		m.status.Update(m.name+"-mysql", fmt.Sprintf("Disconnected (%s)", err))
 		return networkError
 	}
+	switch err {
+	case driver.ErrBadConn, io.EOF:
+		// The driver returns these when MySQL goes away between queries,
+		// e.g. it was restarted or the connection was killed.
+		m.logger.Warn("Lost connection to MySQL:", err)
+		m.status.Update(m.name+"-mysql", fmt.Sprintf("Disconnected (%s)", err))
+		return networkError
+	}
 	m.logger.Warn(err)
 	return err
 }
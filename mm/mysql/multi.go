@@ -0,0 +1,329 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mrms"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	DEFAULT_MAX_WORKERS = 4
+)
+
+/**
+ * MultiMonitor collects from all Config.Targets on each tick, at most
+ * Config.MaxWorkers at once, and sends one Collection with the metrics of
+ * every target prefixed by its name: mysql/threads_running from target db1
+ * is sent as mysql/db1/threads_running.  Each target is a Monitor that's
+ * never started; MultiMonitor connects and collects through it so targets
+ * handle MySQL errors and reconnects exactly like a single Monitor.
+ */
+type MultiMonitor struct {
+	name    string
+	config  *Config
+	logger  *pct.Logger
+	targets []*Monitor // same order as config.Targets
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+	collectLimit   float64
+	mrm            mrms.Monitor
+}
+
+func NewMultiMonitor(name string, config *Config, logger *pct.Logger, connFactory mysql.ConnectionFactory, mrm mrms.Monitor) *MultiMonitor {
+	targets := make([]*Monitor, len(config.Targets))
+	for i, t := range config.Targets {
+		// Each target gets its own copy of the config because a target
+		// disables metrics that it cannot collect.
+		targetConfig := *config
+		targetConfig.Targets = nil
+		targetConfig.SLA = false // not supported, see sla.go
+		targetConfig.Status = make(map[string]string, len(config.Status))
+		for k, v := range config.Status {
+			targetConfig.Status[k] = v
+		}
+		targetConfig.InnoDB = make([]string, len(config.InnoDB))
+		copy(targetConfig.InnoDB, config.InnoDB)
+
+		targetName := name + "-" + t.InstanceName
+		targets[i] = NewMonitor(
+			targetName,
+			&targetConfig,
+			pct.NewLogger(logger.LogChan(), targetName),
+			connFactory.Make(t.DSN),
+			mrm,
+		)
+	}
+
+	m := &MultiMonitor{
+		name:    name,
+		config:  config,
+		logger:  logger,
+		targets: targets,
+		// --
+		status:       pct.NewStatus([]string{name}),
+		sync:         pct.NewSyncChan(),
+		collectLimit: float64(config.Collect) * 0.1, // 10% of Collect time
+		mrm:          mrm,
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *MultiMonitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *MultiMonitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	for _, t := range m.targets {
+		m.mrm.Remove(t.conn.DSN(), t.restartChan)
+	}
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *MultiMonitor) Status() map[string]string {
+	status := m.status.All()
+	for _, t := range m.targets {
+		for k, v := range t.Status() {
+			status[k] = v
+		}
+	}
+	return status
+}
+
+func (m *MultiMonitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *MultiMonitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *MultiMonitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("MySQL multi-target monitor crashed: ", err)
+		}
+		for _, t := range m.targets {
+			t.conn.Close()
+			t.status.Update(t.name, "Stopped")
+		}
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	connected := make([]bool, len(m.targets))
+	for _, t := range m.targets {
+		t.status.Update(t.name, "Ready")
+		go t.connect(nil)
+	}
+
+	m.status.Update(m.name, "Ready")
+
+	var lastTs int64
+	var lastError string
+	for {
+		t := time.Unix(lastTs, 0)
+		if lastError == "" {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(t)))
+		} else {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s, error: %s)", pct.TimeString(t), lastError))
+		}
+
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			m.status.Update(m.name, "Running")
+
+			m.updateConnected(connected)
+
+			// Start timing the collection.  If must take < collectLimit else
+			// it's discarded, same as a single Monitor.
+			start := time.Now()
+
+			c := m.collect(now, connected)
+
+			diff := time.Now().Sub(start).Seconds()
+			if diff >= m.collectLimit {
+				lastError = fmt.Sprintf("Skipping interval because it took too long to collect: %.2fs >= %.2fs", diff, m.collectLimit)
+				m.logger.Warn(lastError)
+				continue
+			}
+
+			// Send the metrics to an mm.Aggregator.
+			m.status.Update(m.name, "Sending metrics")
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
+				select {
+				case m.collectionChan <- c:
+					lastTs = c.Ts
+					lastError = ""
+				case <-time.After(500 * time.Millisecond):
+					// lost collection
+					m.logger.Debug("Lost MySQL metrics; timeout spooling after 500ms")
+					lastError = "Spool timeout"
+				}
+			} else {
+				m.logger.Debug("run:no metrics")
+				lastError = "No metrics (no targets connected)"
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+// updateConnected does for all targets what Monitor.run() does for its
+// connectedChan and restartChan, without blocking.
+func (m *MultiMonitor) updateConnected(connected []bool) {
+	for i, t := range m.targets {
+		select {
+		case connected[i] = <-t.connectedChan:
+			m.logger.Debug(fmt.Sprintf("run:%s:connected:%t", t.name, connected[i]))
+		default:
+		}
+		select {
+		case <-t.restartChan:
+			m.logger.Debug("run:" + t.name + ":mysql:restart")
+			if connected[i] {
+				connected[i] = false
+				go t.connect(fmt.Errorf("Lost connection to MySQL, restarting"))
+			}
+		default:
+		}
+	}
+}
+
+// collect collects from all connected targets using at most MaxWorkers
+// goroutines and merges their metrics into one Collection.
+func (m *MultiMonitor) collect(now time.Time, connected []bool) *mm.Collection {
+	maxWorkers := m.config.MaxWorkers
+	if maxWorkers == 0 {
+		maxWorkers = DEFAULT_MAX_WORKERS
+	}
+
+	results := make([]*mm.Collection, len(m.targets))
+	errs := make([]error, len(m.targets))
+	workers := make(chan bool, maxWorkers)
+	var wg sync.WaitGroup
+	for i, t := range m.targets {
+		if !connected[i] {
+			t.status.Update(t.name, "Not connected to MySQL")
+			continue
+		}
+		wg.Add(1)
+		workers <- true
+		go func(i int, t *Monitor) {
+			defer func() {
+				if err := recover(); err != nil {
+					m.logger.Error(t.name, "collect crashed:", err)
+				}
+				<-workers
+				wg.Done()
+			}()
+			t.status.Update(t.name, "Running")
+			results[i], errs[i] = t.collect(now)
+		}(i, t)
+	}
+	wg.Wait()
+
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+	for i, t := range m.targets {
+		if errs[i] != nil {
+			connected[i] = false
+			t.status.Update(t.name, "Lost connection to MySQL")
+			t.reconnect(errs[i])
+			continue
+		}
+		if results[i] == nil {
+			continue
+		}
+		prefix := "mysql/" + m.config.Targets[i].InstanceName + "/"
+		for _, metric := range results[i].Metrics {
+			metric.Name = prefix + strings.TrimPrefix(metric.Name, "mysql/")
+			c.Metrics = append(c.Metrics, metric)
+		}
+		for _, event := range results[i].Events {
+			event.Type = prefix + strings.TrimPrefix(event.Type, "mysql/")
+			c.Events = append(c.Events, event)
+		}
+		t.status.Update(t.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(now)))
+	}
+	return c
+}
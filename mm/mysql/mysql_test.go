@@ -19,11 +19,20 @@ package mysql_test
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqlDriver "github.com/go-sql-driver/mysql"
 
 	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/mm"
@@ -181,22 +190,7 @@ func (s *TestSuite) TestStartCollectStop(t *C) {
 	}
 }
 
-func (s *TestSuite) TestCollectInnoDBStats(t *C) {
-	/**
-	 * Disable and reset InnoDB metrics so we can test that the monitor enables and sets them.
-	 */
-	if _, err := s.db.Exec("set global innodb_monitor_disable = '%'"); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := s.db.Exec("set global innodb_monitor_reset_all = '%'"); err != nil {
-		t.Fatal(err)
-	}
-
-	s.db.Exec("drop database if exists percona_agent_test")
-	s.db.Exec("create database percona_agent_test")
-	s.db.Exec("create table percona_agent_test.t (i int) engine=innodb")
-	defer s.db.Exec("drop database if exists percona_agent_test")
-
+func (s *TestSuite) TestIncludeExclude(t *C) {
 	config := &mysql.Config{
 		Config: mm.Config{
 			ServiceInstance: proto.ServiceInstance{
@@ -206,165 +200,113 @@ func (s *TestSuite) TestCollectInnoDBStats(t *C) {
 			Collect: 1,
 			Report:  60,
 		},
-		Status: map[string]string{},
-		InnoDB: []string{"dml_%"}, // same as above ^
+		Status: map[string]string{
+			"uptime": "counter",
+		},
+		Include: []string{"threads_*", "slave_running"},
+		Exclude: []string{"threads_cached"},
 	}
 
 	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
-	if m == nil {
-		t.Fatal("Make new mysql.Monitor")
-	}
-
 	err := m.Start(s.tickChan, s.collectionChan)
-	if err != nil {
-		t.Fatalf("Start monitor without error, got %s", err)
-	}
+	t.Assert(err, IsNil)
+	defer m.Stop()
 
 	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
 		t.Fatal("Monitor is ready")
 	}
 
-	// Do INSERT to increment dml_inserts before monitor collects.  If it enabled
-	// the InnoDB metrics and collects them, we should get dml_inserts=1 this later..
-	s.db.Exec("insert into percona_agent_test.t (i) values (42)")
-
 	s.tickChan <- time.Now()
 	got := test.WaitCollection(s.collectionChan, 1)
 	if len(got) == 0 {
 		t.Fatal("Got a collection after tick")
 	}
-	c := got[0]
 
-	/**
-	 * ...monitor should have collected the InnoDB metrics:
-	 *
-	 * mysql> SELECT NAME, SUBSYSTEM, COUNT, TYPE FROM INFORMATION_SCHEMA.INNODB_METRICS WHERE STATUS='enabled';
-	 * +-------------+-----------+-------+----------------+
-	 * | NAME        | SUBSYSTEM | COUNT | TYPE           |
-	 * +-------------+-----------+-------+----------------+
-	 * | dml_reads   | dml       |     0 | status_counter |
-	 * | dml_inserts | dml       |     1 | status_counter |
-	 * | dml_deletes | dml       |     0 | status_counter |
-	 * | dml_updates | dml       |     0 | status_counter |
-	 * +-------------+-----------+-------+----------------+
-	 */
-	if len(c.Metrics) != 4 {
-		t.Fatal("Collect 4 InnoDB metrics; got %+v", c.Metrics)
-	}
-	expect := []mm.Metric{
-		{Name: "mysql/innodb/dml/dml_reads", Type: "counter", Number: 0},
-		{Name: "mysql/innodb/dml/dml_inserts", Type: "counter", Number: 1}, // <-- our INSERT
-		{Name: "mysql/innodb/dml/dml_deletes", Type: "counter", Number: 0},
-		{Name: "mysql/innodb/dml/dml_updates", Type: "counter", Number: 0},
-	}
-	if ok, diff := test.IsDeeply(c.Metrics, expect); !ok {
-		t.Error(diff)
+	// Slave_running=OFF is not numeric, so it's silently skipped.
+	types := map[string]string{}
+	for _, m := range got[0].Metrics {
+		types[m.Name] = m.Type
 	}
-
-	// Stop montior, clean up.
-	m.Stop()
+	t.Check(types, DeepEquals, map[string]string{
+		"mysql/uptime":            "counter",
+		"mysql/threads_connected": "gauge",
+		"mysql/threads_created":   "counter",
+		"mysql/threads_running":   "gauge",
+	})
 }
 
-func (s *TestSuite) TestCollectUserstats(t *C) {
-	/**
-	 * Disable and reset user stats.
-	 */
-	if _, err := s.db.Exec("set global userstat = off"); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := s.db.Exec("flush user_statistics"); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := s.db.Exec("flush index_statistics"); err != nil {
-		t.Fatal(err)
-	}
-
-	config := &mysql.Config{
-		Config: mm.Config{
-			ServiceInstance: proto.ServiceInstance{
-				Service:    "mysql",
-				InstanceId: 1,
-			},
-			Collect: 1,
-			Report:  60,
-		},
-		UserStats: true,
-	}
+func (s *TestSuite) TestStatusPatterns(t *C) {
+	config := &mysql.Config{}
+	err := json.Unmarshal([]byte(`{"Collect":1,"Report":60,`+
+		`"Status":{"Uptime":"Counter","threads_*":"","THREADS_RUNNING":"counter","/^slave_(running|open_temp_tables)$/":"gauge"},`+
+		`"Exclude":["threads_cached"]}`), config)
+	t.Assert(err, IsNil)
 
 	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
-	if m == nil {
-		t.Fatal("Make new mysql.Monitor")
-	}
-
-	err := m.Start(s.tickChan, s.collectionChan)
-	if err != nil {
-		t.Fatalf("Start monitor without error, got %s", err)
-	}
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
 
 	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
 		t.Fatal("Monitor is ready")
 	}
 
-	var user, host string
-	err = s.db.QueryRow("SELECT SUBSTRING_INDEX(CURRENT_USER(),'@',1) AS 'user', SUBSTRING_INDEX(CURRENT_USER(),'@',-1) AS host").Scan(&user, &host)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// To get index stats, we need to use an index: mysq.user PK <host, user>
-	rows, err := s.db.Query("select * from mysql.user where host=? and user=?", host, user)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer rows.Close()
-
 	s.tickChan <- time.Now()
 	got := test.WaitCollection(s.collectionChan, 1)
 	if len(got) == 0 {
 		t.Fatal("Got a collection after tick")
 	}
-	c := got[0]
 
-	/**
-	 * Monitor should have collected the user stats: just table and index.
-	 * Values vary a little, but there should be a table metric for mysql.user
-	 * because login uses this table.
-	 */
-	if len(c.Metrics) < 1 {
-		t.Fatalf("Collect at least 1 user stat metric; got %+v", c.Metrics)
+	// Keys are case-insensitive, named variables have their key's type
+	// (threads_running isn't really a counter), patterns match like Include
+	// with their type or StatusType, and Slave_running=OFF is skipped.
+	types := map[string]string{}
+	for _, m := range got[0].Metrics {
+		types[m.Name] = m.Type
 	}
+	t.Check(types, DeepEquals, map[string]string{
+		"mysql/uptime":                 "counter",
+		"mysql/threads_connected":      "gauge",
+		"mysql/threads_created":        "counter",
+		"mysql/threads_running":        "counter",
+		"mysql/slave_open_temp_tables": "gauge",
+	})
+}
 
-	var tblStat mm.Metric
-	var idxStat mm.Metric
-	for _, m := range c.Metrics {
-		switch m.Name {
-		case "mysql/db.mysql/t.user/rows_read":
-			tblStat = m
-		case "mysql/db.mysql/t.user/idx.PRIMARY/rows_read":
-			idxStat = m
-		}
-	}
+func (s *TestSuite) TestStatusAll(t *C) {
+	config := &mysql.Config{}
+	err := json.Unmarshal([]byte(`{"Collect":1,"Report":60,"Status":"*","StatusMax":5,"Exclude":["com_*"]}`), config)
+	t.Assert(err, IsNil)
+	t.Assert(config.Status.All(), Equals, true)
+	bytes, err := json.Marshal(config.Status)
+	t.Assert(err, IsNil)
+	t.Check(string(bytes), Equals, `"*"`)
 
-	// At least 2 rows should have been read from mysql.user:
-	//   1: our db connection
-	//   2: the monitor's db connection
-	if tblStat.Number < 2 {
-		t.Errorf("mysql/db.mysql/t.user/rows_read >= 2, got %+v", tblStat)
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
 	}
 
-	// At least 1 index read on mysql.user PK due to our SELECT ^.
-	if idxStat.Number < 1 {
-		t.Errorf("mysql/db.mysql/t.user/idx.PRIMARY/rows_read >= 1, got %+v", idxStat)
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	if len(got) == 0 {
+		t.Fatal("Got a collection after tick")
 	}
 
-	// Stop montior, clean up.
-	m.Stop()
+	// StatusMax variables plus the count of collected variables.
+	metrics := got[0].Metrics
+	t.Assert(metrics, HasLen, 6)
+	for _, m := range metrics[0:5] {
+		t.Check(strings.HasPrefix(m.Name, "mysql/com_"), Equals, false)
+	}
+	t.Check(metrics[5], DeepEquals, mm.Metric{Name: "mysql/status/collected", Type: "gauge", Number: 5})
 }
 
-// This test is the same as TestCollectInnoDBStats with the only difference that
-// now we are simulating a MySQL disconnection.
-// After a disconnection, we must still be able to collect InnoDB stats
-func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
+func (s *TestSuite) TestCollectInnoDBStats(t *C) {
 	/**
 	 * Disable and reset InnoDB metrics so we can test that the monitor enables and sets them.
 	 */
@@ -407,22 +349,6 @@ func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
 		t.Fatal("Monitor is ready")
 	}
 
-	/**
-	 * Simulate a MySQL disconnection by disabling InnoDB metrics and putting a
-	 * true into the restart channel. The monitor must enable them again
-	 */
-	if _, err := s.db.Exec("set global innodb_monitor_disable = '%'"); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := s.db.Exec("set global innodb_monitor_reset_all = '%'"); err != nil {
-		t.Fatal(err)
-	}
-	s.mrm.SimulateMySQLRestart()
-
-	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
-		t.Fatal("Monitor is ready")
-	}
-
 	// Do INSERT to increment dml_inserts before monitor collects.  If it enabled
 	// the InnoDB metrics and collects them, we should get dml_inserts=1 this later..
 	s.db.Exec("insert into percona_agent_test.t (i) values (42)")
@@ -464,8 +390,7 @@ func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
 	m.Stop()
 }
 
-func (s *TestSuite) TestSlowResponse(t *C) {
-	// https://jira.percona.com/browse/PCT-565
+func (s *TestSuite) TestCollectBufferPoolStats(t *C) {
 	config := &mysql.Config{
 		Config: mm.Config{
 			ServiceInstance: proto.ServiceInstance{
@@ -475,20 +400,13 @@ func (s *TestSuite) TestSlowResponse(t *C) {
 			Collect: 1,
 			Report:  60,
 		},
-		UserStats: true,
-	}
-
-	slowCon := mock.NewSlowMySQL(dsn)
-	slowCon.SetGlobalDelay(time.Duration(config.Collect+1) * time.Second)
-	m := mysql.NewMonitor(s.name, config, s.logger, slowCon, s.mrm)
-	if m == nil {
-		t.Fatal("Make new mysql.Monitor")
+		Status:            map[string]string{},
+		InnoDBBufferPools: true,
 	}
 
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
 	err := m.Start(s.tickChan, s.collectionChan)
-	if err != nil {
-		t.Fatalf("Start monitor without error, got %s", err)
-	}
+	t.Assert(err, IsNil)
 	defer m.Stop()
 
 	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
@@ -497,16 +415,29 @@ func (s *TestSuite) TestSlowResponse(t *C) {
 
 	s.tickChan <- time.Now()
 	got := test.WaitCollection(s.collectionChan, 1)
-	// If it took more than 10% of config.Collect, the monitor must
-	// discard those metrics -> len(got) == 0
-	t.Check(got, HasLen, 0)
+	if len(got) == 0 {
+		t.Fatal("Got a collection after tick")
+	}
+	c := got[0]
+
+	// 5 metrics for each buffer pool instance, and there's at least one.
+	t.Assert(len(c.Metrics) >= 5, Equals, true)
+	t.Check(len(c.Metrics)%5, Equals, 0)
+	names := []string{}
+	for _, m := range c.Metrics[0:5] {
+		names = append(names, m.Name)
+		t.Check(m.Type, Equals, "gauge")
+	}
+	t.Check(names, DeepEquals, []string{
+		"mysql/innodb/buffer_pool/0/pages_free",
+		"mysql/innodb/buffer_pool/0/pages_data",
+		"mysql/innodb/buffer_pool/0/pages_dirty",
+		"mysql/innodb/buffer_pool/0/hit_rate",
+		"mysql/innodb/buffer_pool/0/pending_reads",
+	})
 }
 
-// Even having a wrong user/pass, the monitor should be able to start
-// It won't be able to connect to the DB, but it should start without
-// blocking.
-// This test if for cases where the agent starts but MySQL is down
-func (s *TestSuite) TestStartWithInvalidDSN(t *C) {
+func (s *TestSuite) TestInnoDBInterval(t *C) {
 	config := &mysql.Config{
 		Config: mm.Config{
 			ServiceInstance: proto.ServiceInstance{
@@ -518,16 +449,1613 @@ func (s *TestSuite) TestStartWithInvalidDSN(t *C) {
 		},
 		Status: map[string]string{
 			"threads_connected": "gauge",
-			"threads_running":   "gauge",
 		},
+		InnoDBBufferPools: true,
+		InnoDBInterval:    60,
 	}
 
-	failDsn := "user:pass@tcp(127.0.0.2:3309)/"
-	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(failDsn), s.mrm)
-	if m == nil {
-		t.Fatal("Make new mysql.Monitor")
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
 	}
 
-	err := m.Start(s.tickChan, s.collectionChan)
+	// SHOW STATUS is collected every tick, InnoDB metrics on the first tick
+	// of each minute.  2009-11-10 23:00:00, 23:00:01, 23:00:59, 23:01:00.
+	innodb := []bool{}
+	for _, ts := range []int64{1257894000, 1257894001, 1257894059, 1257894060} {
+		s.tickChan <- time.Unix(ts, 0)
+		got := test.WaitCollection(s.collectionChan, 1)
+		t.Assert(got, HasLen, 1)
+		t.Check(got[0].Metrics[0].Name, Equals, "mysql/threads_connected")
+		innodb = append(innodb, len(got[0].Metrics) > 1)
+	}
+	t.Check(innodb, DeepEquals, []bool{true, false, false, true})
+}
+
+func (s *TestSuite) TestCollectSpaceMetrics(t *C) {
+	s.db.Exec("drop database if exists percona_agent_test")
+	s.db.Exec("create database percona_agent_test")
+	_, err := s.db.Exec("create table percona_agent_test.p (i int) engine=innodb partition by hash(i) partitions 3")
+	t.Assert(err, IsNil)
+	defer s.db.Exec("drop database if exists percona_agent_test")
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+		Space:         true,
+		SpaceInterval: 60,
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	// First tick starts collecting space metrics in the background, so
+	// they're sent with a later collection, and only once per SpaceInterval.
+	var partitions *mm.Metric
+	var tablespaces int
+	for i := 0; i < 5 && partitions == nil; i++ {
+		s.tickChan <- time.Now()
+		got := test.WaitCollection(s.collectionChan, 1)
+		if len(got) == 0 {
+			continue
+		}
+		for n, metric := range got[0].Metrics {
+			if metric.Name == "mysql/db.percona_agent_test/t.p/partitions" {
+				partitions = &got[0].Metrics[n]
+			}
+			if strings.HasPrefix(metric.Name, "mysql/tablespace.") {
+				tablespaces++
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	t.Assert(partitions, NotNil)
+	t.Check(partitions.Number, Equals, float64(3))
+	t.Check(partitions.Type, Equals, "gauge")
+	t.Check(tablespaces > 0, Equals, true)
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Metrics, HasLen, 1) // just threads_connected
+}
+
+func (s *TestSuite) TestCollectChecksums(t *C) {
+	// Fake pt-table-checksum results: t1 has 1 of 2 chunks different.
+	s.db.Exec("drop database if exists percona_agent_test")
+	s.db.Exec("create database percona_agent_test")
+	defer s.db.Exec("drop database if exists percona_agent_test")
+	_, err := s.db.Exec("create table percona_agent_test.checksums (" +
+		" db char(64) not null, tbl char(64) not null, chunk int not null," +
+		" this_crc char(40) not null, this_cnt int not null," +
+		" master_crc char(40) null, master_cnt int null," +
+		" ts timestamp not null default current_timestamp," +
+		" primary key (db, tbl, chunk))")
 	t.Assert(err, IsNil)
+	_, err = s.db.Exec("insert into percona_agent_test.checksums (db, tbl, chunk, this_crc, this_cnt, master_crc, master_cnt) values" +
+		" ('db', 't1', 1, 'aaa', 10, 'aaa', 10)," +
+		" ('db', 't1', 2, 'bbb', 10, 'ccc', 10)," +
+		" ('db', 't2', 1, 'ddd', 5, 'ddd', 5)")
+	t.Assert(err, IsNil)
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+		Checksums:        true,
+		ChecksumTable:    "percona_agent_test.checksums",
+		ChecksumInterval: 1,
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	// Checksums are read in the background, so they're sent with a later
+	// collection, and the diff event is sent only once.
+	metrics := map[string]float64{}
+	events := []mm.Event{}
+	for i := 0; i < 5; i++ {
+		s.tickChan <- time.Now().Add(time.Duration(i) * time.Second)
+		got := test.WaitCollection(s.collectionChan, 1)
+		if len(got) == 0 {
+			continue
+		}
+		for _, metric := range got[0].Metrics {
+			metrics[metric.Name] = metric.Number
+		}
+		events = append(events, got[0].Events...)
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	t.Check(metrics["mysql/db.db/t.t1/checksum_chunks"], Equals, float64(2))
+	t.Check(metrics["mysql/db.db/t.t1/checksum_diff_chunks"], Equals, float64(1))
+	t.Check(metrics["mysql/db.db/t.t2/checksum_diff_chunks"], Equals, float64(0))
+	t.Check(metrics["mysql/checksum/diff_tables"], Equals, float64(1))
+	t.Assert(events, HasLen, 1)
+	t.Check(events[0].Type, Equals, "mysql/checksum/diff")
+	t.Check(events[0].Level, Equals, mm.EVENT_WARNING)
+	t.Check(strings.HasPrefix(events[0].Message, "db.t1 has 1 of 2 chunks different"), Equals, true)
+}
+
+func (s *TestSuite) TestSlaveStatusNotSlave(t *C) {
+	// The test server is not a slave, so Slave adds nothing and doesn't
+	// disable or break the other metrics.
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+		Slave:        true,
+		SlaveRestart: []uint16{1205},
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Assert(got[0].Metrics, HasLen, 1)
+	t.Check(got[0].Metrics[0].Name, Equals, "mysql/threads_connected")
+	t.Check(got[0].Events, HasLen, 0)
+}
+
+func (s *TestSuite) TestCollectBinlog(t *C) {
+	var logBin bool
+	if err := s.db.QueryRow("SELECT @@log_bin").Scan(&logBin); err != nil || !logBin {
+		t.Skip("binary logging is not enabled")
+	}
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+		Binlog:         true,
+		BinlogInterval: 1,
+		BinlogReplicas: true,
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	// Binlog metrics are collected in the background, so they're sent with
+	// a later collection.  Growth needs two collections.
+	metrics := map[string]float64{}
+	for i := 0; i < 6; i++ {
+		s.tickChan <- time.Now().Add(time.Duration(i) * time.Second)
+		got := test.WaitCollection(s.collectionChan, 1)
+		if len(got) == 0 {
+			continue
+		}
+		for _, metric := range got[0].Metrics {
+			metrics[metric.Name] = metric.Number
+		}
+		t.Check(got[0].Events, HasLen, 0)
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	t.Check(metrics["mysql/binlog/files"] > 0, Equals, true)
+	t.Check(metrics["mysql/binlog/bytes"] > 0, Equals, true)
+	_, ok := metrics["mysql/binlog/growth"]
+	t.Check(ok, Equals, true)
+	_, ok = metrics["mysql/binlog/replicas"]
+	t.Check(ok, Equals, true)
+	t.Check(metrics["mysql/binlog/replicas_missing"], Equals, float64(0))
+}
+
+func (s *TestSuite) TestCanary(t *C) {
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+		Canary: true,
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Assert(got[0].Metrics, HasLen, 3)
+	t.Check(got[0].Metrics[0], Equals, mm.Metric{Name: "mysql/canary/ok", Type: "gauge", Number: 1})
+	t.Check(got[0].Metrics[1].Name, Equals, "mysql/canary/latency")
+	t.Check(got[0].Metrics[1].Number > 0, Equals, true)
+	t.Check(got[0].Metrics[2].Name, Equals, "mysql/threads_connected")
+
+	// A failed canary query is reported, and doesn't stop the other metrics.
+	config.CanaryQuery = "SELECT * FROM no_such_db.no_such_table"
+	s.tickChan <- time.Now().Add(time.Second)
+	got = test.WaitCollection(s.collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Assert(got[0].Metrics, HasLen, 2)
+	t.Check(got[0].Metrics[0], Equals, mm.Metric{Name: "mysql/canary/ok", Type: "gauge", Number: 0})
+	t.Check(got[0].Metrics[1].Name, Equals, "mysql/threads_connected")
+}
+
+func (s *TestSuite) TestCollectUserstats(t *C) {
+	/**
+	 * Disable and reset user stats.
+	 */
+	if _, err := s.db.Exec("set global userstat = off"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("flush user_statistics"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("flush index_statistics"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		UserStats: true,
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	if m == nil {
+		t.Fatal("Make new mysql.Monitor")
+	}
+
+	err := m.Start(s.tickChan, s.collectionChan)
+	if err != nil {
+		t.Fatalf("Start monitor without error, got %s", err)
+	}
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	var user, host string
+	err = s.db.QueryRow("SELECT SUBSTRING_INDEX(CURRENT_USER(),'@',1) AS 'user', SUBSTRING_INDEX(CURRENT_USER(),'@',-1) AS host").Scan(&user, &host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// To get index stats, we need to use an index: mysq.user PK <host, user>
+	rows, err := s.db.Query("select * from mysql.user where host=? and user=?", host, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	if len(got) == 0 {
+		t.Fatal("Got a collection after tick")
+	}
+	c := got[0]
+
+	/**
+	 * Monitor should have collected the user stats: just table and index.
+	 * Values vary a little, but there should be a table metric for mysql.user
+	 * because login uses this table.
+	 */
+	if len(c.Metrics) < 1 {
+		t.Fatalf("Collect at least 1 user stat metric; got %+v", c.Metrics)
+	}
+
+	var tblStat mm.Metric
+	var idxStat mm.Metric
+	for _, m := range c.Metrics {
+		switch m.Name {
+		case "mysql/db.mysql/t.user/rows_read":
+			tblStat = m
+		case "mysql/db.mysql/t.user/idx.PRIMARY/rows_read":
+			idxStat = m
+		}
+	}
+
+	// At least 2 rows should have been read from mysql.user:
+	//   1: our db connection
+	//   2: the monitor's db connection
+	if tblStat.Number < 2 {
+		t.Errorf("mysql/db.mysql/t.user/rows_read >= 2, got %+v", tblStat)
+	}
+
+	// At least 1 index read on mysql.user PK due to our SELECT ^.
+	if idxStat.Number < 1 {
+		t.Errorf("mysql/db.mysql/t.user/idx.PRIMARY/rows_read >= 1, got %+v", idxStat)
+	}
+
+	// Stop montior, clean up.
+	m.Stop()
+}
+
+func (s *TestSuite) TestCollectUserstatsBySchema(t *C) {
+	if _, err := s.db.Exec("set global userstat = off"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("flush user_statistics"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("flush index_statistics"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		UserStats:         true,
+		UserStatsBySchema: true,
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	if m == nil {
+		t.Fatal("Make new mysql.Monitor")
+	}
+
+	err := m.Start(s.tickChan, s.collectionChan)
+	if err != nil {
+		t.Fatalf("Start monitor without error, got %s", err)
+	}
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	var user, host string
+	err = s.db.QueryRow("SELECT SUBSTRING_INDEX(CURRENT_USER(),'@',1) AS 'user', SUBSTRING_INDEX(CURRENT_USER(),'@',-1) AS host").Scan(&user, &host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := s.db.Query("select * from mysql.user where host=? and user=?", host, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	if len(got) == 0 {
+		t.Fatal("Got a collection after tick")
+	}
+	c := got[0]
+
+	// Only per-schema metrics, no per-table or per-index metrics.
+	var tblStat mm.Metric
+	var idxStat mm.Metric
+	for _, m := range c.Metrics {
+		switch m.Name {
+		case "mysql/db.mysql/rows_read":
+			tblStat = m
+		case "mysql/db.mysql/idx_rows_read":
+			idxStat = m
+		}
+		t.Check(strings.Contains(m.Name, "/t."), Equals, false, Commentf("%+v", m))
+	}
+	if tblStat.Number < 2 {
+		t.Errorf("mysql/db.mysql/rows_read >= 2, got %+v", tblStat)
+	}
+	if idxStat.Number < 1 {
+		t.Errorf("mysql/db.mysql/idx_rows_read >= 1, got %+v", idxStat)
+	}
+}
+
+// This test is the same as TestCollectInnoDBStats with the only difference that
+// now we are simulating a MySQL disconnection.
+// After a disconnection, we must still be able to collect InnoDB stats
+func (s *TestSuite) TestHandleMySQLRestarts(t *C) {
+	/**
+	 * Disable and reset InnoDB metrics so we can test that the monitor enables and sets them.
+	 */
+	if _, err := s.db.Exec("set global innodb_monitor_disable = '%'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("set global innodb_monitor_reset_all = '%'"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.db.Exec("drop database if exists percona_agent_test")
+	s.db.Exec("create database percona_agent_test")
+	s.db.Exec("create table percona_agent_test.t (i int) engine=innodb")
+	defer s.db.Exec("drop database if exists percona_agent_test")
+
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{},
+		InnoDB: []string{"dml_%"}, // same as above ^
+	}
+
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn), s.mrm)
+	if m == nil {
+		t.Fatal("Make new mysql.Monitor")
+	}
+
+	err := m.Start(s.tickChan, s.collectionChan)
+	if err != nil {
+		t.Fatalf("Start monitor without error, got %s", err)
+	}
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	/**
+	 * Simulate a MySQL disconnection by disabling InnoDB metrics and putting a
+	 * true into the restart channel. The monitor must enable them again
+	 */
+	if _, err := s.db.Exec("set global innodb_monitor_disable = '%'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("set global innodb_monitor_reset_all = '%'"); err != nil {
+		t.Fatal(err)
+	}
+	s.mrm.SimulateMySQLRestart()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	// Do INSERT to increment dml_inserts before monitor collects.  If it enabled
+	// the InnoDB metrics and collects them, we should get dml_inserts=1 this later..
+	s.db.Exec("insert into percona_agent_test.t (i) values (42)")
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	if len(got) == 0 {
+		t.Fatal("Got a collection after tick")
+	}
+	c := got[0]
+
+	/**
+	 * ...monitor should have collected the InnoDB metrics:
+	 *
+	 * mysql> SELECT NAME, SUBSYSTEM, COUNT, TYPE FROM INFORMATION_SCHEMA.INNODB_METRICS WHERE STATUS='enabled';
+	 * +-------------+-----------+-------+----------------+
+	 * | NAME        | SUBSYSTEM | COUNT | TYPE           |
+	 * +-------------+-----------+-------+----------------+
+	 * | dml_reads   | dml       |     0 | status_counter |
+	 * | dml_inserts | dml       |     1 | status_counter |
+	 * | dml_deletes | dml       |     0 | status_counter |
+	 * | dml_updates | dml       |     0 | status_counter |
+	 * +-------------+-----------+-------+----------------+
+	 */
+	if len(c.Metrics) != 4 {
+		t.Fatal("Collect 4 InnoDB metrics; got %+v", c.Metrics)
+	}
+	expect := []mm.Metric{
+		{Name: "mysql/innodb/dml/dml_reads", Type: "counter", Number: 0},
+		{Name: "mysql/innodb/dml/dml_inserts", Type: "counter", Number: 1}, // <-- our INSERT
+		{Name: "mysql/innodb/dml/dml_deletes", Type: "counter", Number: 0},
+		{Name: "mysql/innodb/dml/dml_updates", Type: "counter", Number: 0},
+	}
+	if ok, diff := test.IsDeeply(c.Metrics, expect); !ok {
+		t.Error(diff)
+	}
+
+	// Stop montior, clean up.
+	m.Stop()
+}
+
+func (s *TestSuite) TestSlowResponse(t *C) {
+	// https://jira.percona.com/browse/PCT-565
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		UserStats: true,
+	}
+
+	slowCon := mock.NewSlowMySQL(dsn)
+	slowCon.SetGlobalDelay(time.Duration(config.Collect+1) * time.Second)
+	m := mysql.NewMonitor(s.name, config, s.logger, slowCon, s.mrm)
+	if m == nil {
+		t.Fatal("Make new mysql.Monitor")
+	}
+
+	err := m.Start(s.tickChan, s.collectionChan)
+	if err != nil {
+		t.Fatalf("Start monitor without error, got %s", err)
+	}
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-mysql", "Connected"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	s.tickChan <- time.Now()
+	got := test.WaitCollection(s.collectionChan, 1)
+	// If it took more than 10% of config.Collect, the monitor must
+	// discard those metrics -> len(got) == 0
+	t.Check(got, HasLen, 0)
+}
+
+// Even having a wrong user/pass, the monitor should be able to start
+// It won't be able to connect to the DB, but it should start without
+// blocking.
+// This test if for cases where the agent starts but MySQL is down
+func (s *TestSuite) TestStartWithInvalidDSN(t *C) {
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+			"threads_running":   "gauge",
+		},
+	}
+
+	failDsn := "user:pass@tcp(127.0.0.2:3309)/"
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(failDsn), s.mrm)
+	if m == nil {
+		t.Fatal("Make new mysql.Monitor")
+	}
+
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestMultiTarget(t *C) {
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: map[string]string{
+			"threads_connected": "gauge",
+		},
+		Targets: []mysql.Target{
+			{InstanceName: "db1", DSN: dsn},
+			{InstanceName: "db2", DSN: dsn},
+			{InstanceName: "db3", DSN: "user:pass@tcp(127.0.0.2:3309)/"}, // never connects
+		},
+		MaxWorkers: 2,
+	}
+
+	m := mysql.NewMultiMonitor(s.name, config, s.logger, &mysqlConn.RealConnectionFactory{}, s.mrm)
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if ok := test.WaitStatus(5, m, s.name+"-db1-mysql", "Connected"); !ok {
+		t.Fatal("Target db1 is ready")
+	}
+	if ok := test.WaitStatus(5, m, s.name+"-db2-mysql", "Connected"); !ok {
+		t.Fatal("Target db2 is ready")
+	}
+
+	// Targets report connected to run() on the next tick, so the first
+	// tick may not collect from all of them.
+	var c *mm.Collection
+	for i := 0; i < 3; i++ {
+		s.tickChan <- time.Now()
+		got := test.WaitCollection(s.collectionChan, 1)
+		if len(got) > 0 && len(got[0].Metrics) == 2 {
+			c = got[0]
+			break
+		}
+	}
+	t.Assert(c, NotNil)
+
+	// Metrics from both connected targets, prefixed by target name,
+	// in Targets order.
+	t.Check(c.InstanceId, Equals, uint(1))
+	t.Check(c.Metrics[0].Name, Equals, "mysql/db1/threads_connected")
+	t.Check(c.Metrics[1].Name, Equals, "mysql/db2/threads_connected")
+
+	status := m.Status()
+	t.Check(status[s.name+"-db3"], Equals, "Not connected to MySQL")
+}
+
+func (s *TestSuite) TestApplyProfile(t *C) {
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+			Collect:         1,
+			Report:          60,
+			Profile:         mm.PROFILE_LIGHT,
+		},
+		Status:    mysql.StatusVars{mysql.STATUS_ALL: ""},
+		InnoDB:    []string{"dml_%"},
+		UserStats: true,
+		Space:     true,
+		Slave:     true,
+	}
+	err := config.ApplyProfile()
+	t.Assert(err, IsNil)
+
+	// Only the core status variables, the canary, and replication, collected
+	// every 10s.
+	t.Check(config.Collect, Equals, uint(mm.PROFILE_LIGHT_COLLECT))
+	t.Check(config.Status, DeepEquals, mysql.LIGHT_STATUS)
+	t.Check(config.InnoDB, IsNil)
+	t.Check(config.UserStats, Equals, false)
+	t.Check(config.Space, Equals, false)
+	t.Check(config.Slave, Equals, true)
+	t.Check(config.Canary, Equals, true)
+
+	// The config has a copy of the core set.
+	config.Status["Foo"] = "gauge"
+	_, ok := mysql.LIGHT_STATUS["Foo"]
+	t.Check(ok, Equals, false)
+
+	// The full profile doesn't change anything.
+	config = &mysql.Config{
+		Config: mm.Config{Collect: 1},
+		Space:  true,
+	}
+	err = config.ApplyProfile()
+	t.Assert(err, IsNil)
+	t.Check(config.Collect, Equals, uint(1))
+	t.Check(config.Space, Equals, true)
+
+	config.Profile = "heavy"
+	err = config.ApplyProfile()
+	t.Check(err, NotNil)
+}
+
+// --------------------------------------------------------------------------
+
+type BinlogTestSuite struct{}
+
+var _ = Suite(&BinlogTestSuite{})
+
+func (s *BinlogTestSuite) TestGtidCount(t *C) {
+	t.Check(mysql.GtidCount(""), Equals, uint64(0))
+	t.Check(mysql.GtidCount("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"), Equals, uint64(5))
+	t.Check(mysql.GtidCount("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10:12-15,\n"+
+		"4d7f6a2e-71ca-11e1-9e33-c80aa9429562:7"), Equals, uint64(15))
+	t.Check(mysql.GtidCount("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-3:etl:1-2"), Equals, uint64(5))
+}
+
+func (s *BinlogTestSuite) TestReplicaDSN(t *C) {
+	t.Check(mysql.ReplicaDSN("user:pass@tcp(db1:3306)/?tls=true", "db2", "3307"), Equals, "user:pass@tcp(db2:3307)/?tls=true")
+	t.Check(mysql.ReplicaDSN("user:p@ss@unix(/tmp/mysql.sock)/", "10.0.0.2", "0"), Equals, "user:p@ss@tcp(10.0.0.2:3306)/")
+	t.Check(mysql.ReplicaDSN("user@/", "::1", "3306"), Equals, "user@tcp([::1]:3306)/")
+}
+
+// --------------------------------------------------------------------------
+
+type StatusTestSuite struct{}
+
+var _ = Suite(&StatusTestSuite{})
+
+func (s *StatusTestSuite) TestInvalid(t *C) {
+	config := &mysql.Config{}
+	err := json.Unmarshal([]byte(`{"Status":{"uptime":"counter","threads_*":"GAUGE"}}`), config)
+	t.Check(err, IsNil)
+
+	err = json.Unmarshal([]byte(`{"Status":{"uptime":"histogram"}}`), config)
+	t.Check(err, ErrorMatches, "Invalid Status type for uptime: histogram.*")
+
+	err = json.Unmarshal([]byte(`{"Status":{"/com_(select/":""}}`), config)
+	t.Check(err, ErrorMatches, "Invalid Status regexp: /com_\\(select/.*")
+}
+
+func (s *StatusTestSuite) TestValidate(t *C) {
+	config := &mysql.Config{
+		ChecksumTable: "percona.checksums",
+		Targets: []mysql.Target{
+			{InstanceName: "db1", DSN: "user:pass@tcp(db1:3306)/"},
+			{InstanceName: "db2", DSN: "user:pass@tcp(db2:3306)/"},
+		},
+	}
+	t.Check(config.Validate(), IsNil)
+
+	for _, table := range []string{"checksums", "a.b.c", ".checksums", "percona.checksums WHERE 1=1; --", "percona.`checksums`"} {
+		config := &mysql.Config{ChecksumTable: table}
+		t.Check(config.Validate(), ErrorMatches, "Invalid table: .+", Commentf(table))
+	}
+
+	targets := [][]mysql.Target{
+		{{InstanceName: "", DSN: "dsn"}},
+		{{InstanceName: "db/1", DSN: "dsn"}},
+		{{InstanceName: "db1", DSN: "dsn"}, {InstanceName: "db1", DSN: "dsn2"}},
+		{{InstanceName: "db1", DSN: ""}},
+	}
+	for _, tt := range targets {
+		config := &mysql.Config{Targets: tt}
+		t.Check(config.Validate(), NotNil, Commentf("%+v", tt))
+	}
+}
+
+// --------------------------------------------------------------------------
+
+type DeadlockTestSuite struct {
+	status string
+}
+
+var _ = Suite(&DeadlockTestSuite{})
+
+func (s *DeadlockTestSuite) SetUpSuite(t *C) {
+	data, err := ioutil.ReadFile(test.RootDir + "/mm/mysql/innodb-status001.txt")
+	t.Assert(err, IsNil)
+	s.status = string(data)
+}
+
+func (s *DeadlockTestSuite) TestParseEngineStatus(t *C) {
+	sections := mysql.ParseEngineStatus(s.status)
+	titles := []string{}
+	for title := range sections {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	t.Check(titles, DeepEquals, []string{"BACKGROUND THREAD", "FILE I/O", "LATEST DETECTED DEADLOCK", "SEMAPHORES", "TRANSACTIONS"})
+	t.Check(strings.HasPrefix(sections["LATEST DETECTED DEADLOCK"], "2014-10-08 12:17:10 7f4d2c2e0700\n"), Equals, true)
+	t.Check(strings.HasSuffix(sections["FILE I/O"], "aio writes: 0 [0, 0, 0, 0] ,"), Equals, true)
+
+	got := mysql.EngineStatusMetrics(sections)
+	expect := []mm.Metric{
+		{Name: "mysql/engine_status/os_wait_reservations", Type: "counter", Number: 38},
+		{Name: "mysql/engine_status/os_wait_signals", Type: "counter", Number: 36},
+		{Name: "mysql/engine_status/mutex_spin_waits", Type: "counter", Number: 12},
+		{Name: "mysql/engine_status/mutex_spin_rounds", Type: "counter", Number: 340},
+		{Name: "mysql/engine_status/mutex_os_waits", Type: "counter", Number: 9},
+		{Name: "mysql/engine_status/rw_shared_spin_waits", Type: "counter", Number: 27},
+		{Name: "mysql/engine_status/rw_shared_spin_rounds", Type: "counter", Number: 810},
+		{Name: "mysql/engine_status/rw_shared_os_waits", Type: "counter", Number: 27},
+		{Name: "mysql/engine_status/rw_excl_spin_waits", Type: "counter", Number: 1},
+		{Name: "mysql/engine_status/rw_excl_spin_rounds", Type: "counter", Number: 30},
+		{Name: "mysql/engine_status/rw_excl_os_waits", Type: "counter", Number: 1},
+		{Name: "mysql/engine_status/semaphore_waits", Type: "gauge", Number: 1},
+		{Name: "mysql/engine_status/history_list_length", Type: "gauge", Number: 17},
+		{Name: "mysql/engine_status/lock_waits", Type: "gauge", Number: 1},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+
+	// No status, no metrics.
+	t.Check(mysql.EngineStatusMetrics(mysql.ParseEngineStatus("")), HasLen, 0)
+}
+
+func (s *DeadlockTestSuite) TestParseDeadlock(t *C) {
+	sections := mysql.ParseEngineStatus(s.status)
+	got := mysql.ParseDeadlock(sections["LATEST DETECTED DEADLOCK"])
+	expect := &mysql.Deadlock{
+		Ts: "2014-10-08 12:17:10 7f4d2c2e0700",
+		Transactions: []mysql.DeadlockTransaction{
+			{
+				Number:   1,
+				Id:       "2863",
+				ThreadId: "4",
+				Thread:   "MySQL thread id 4, OS thread handle 0x7f4d2c2a0700, query id 83 localhost root updating",
+				Query:    "UPDATE t SET c = 1\nWHERE id = 2",
+				Holds:    []string{},
+				Waits: []string{
+					"RECORD LOCKS space id 6 page no 3 n bits 72 index `PRIMARY` of table `test`.`t` trx id 2863 lock_mode X locks rec but not gap waiting",
+				},
+			},
+			{
+				Number:   2,
+				Id:       "2864",
+				ThreadId: "5",
+				Thread:   "MySQL thread id 5, OS thread handle 0x7f4d2c2e0700, query id 84 10.0.0.5 app updating",
+				Query:    "UPDATE t SET c = 2 WHERE id = 1",
+				Holds: []string{
+					"RECORD LOCKS space id 6 page no 3 n bits 72 index `PRIMARY` of table `test`.`t` trx id 2864 lock_mode X locks rec but not gap",
+				},
+				Waits: []string{
+					"RECORD LOCKS space id 6 page no 3 n bits 72 index `PRIMARY` of table `test`.`t` trx id 2864 lock_mode X locks rec but not gap waiting",
+				},
+			},
+		},
+		RolledBack: 1,
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+
+type SpaceTestSuite struct{}
+
+var _ = Suite(&SpaceTestSuite{})
+
+func (s *SpaceTestSuite) TestTablespaceName(t *C) {
+	t.Check(mysql.TablespaceName("innodb_system"), Equals, "innodb_system")
+	t.Check(mysql.TablespaceName("shop/orders"), Equals, "shop.orders")
+	t.Check(mysql.TablespaceName("shop/orders#P#p0"), Equals, "shop.orders%23P%23p0")
+	// db "a.b" table "c" and db "a" table "b.c" don't collide.  InnoDB
+	// encodes them in tablespace names like in file names.
+	t.Check(mysql.TablespaceName("a@002eb/c"), Equals, "a%2Eb.c")
+	t.Check(mysql.TablespaceName("a/b@002ec"), Equals, "a.b%2Ec")
+	t.Check(mysql.TablespaceName("a/b@002fc"), Equals, "a.b%2Fc")
+	t.Check(mysql.TablespaceName("a/b@0G"), Equals, "a.b%400G")
+}
+
+// --------------------------------------------------------------------------
+
+type SLATestSuite struct {
+	tmpDir string
+	file   string
+}
+
+var _ = Suite(&SLATestSuite{})
+
+func (s *SLATestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "percona-agent-test")
+	t.Assert(err, IsNil)
+	err = pct.Basedir.Init(s.tmpDir)
+	t.Assert(err, IsNil)
+	s.file = mysql.SLAFile(1)
+}
+
+func (s *SLATestSuite) SetUpTest(t *C) {
+	os.Remove(s.file)
+}
+
+func (s *SLATestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *SLATestSuite) TestAccounting(t *C) {
+	sla, err := mysql.NewSLA(s.file)
+	t.Assert(err, IsNil)
+
+	day := int64(1420070400) // 2015-01-01 00:00:00 UTC
+	ts := day + 3600
+	for _, up := range []bool{true, true, false, false, true, true} {
+		err = sla.Tick(ts, up)
+		t.Assert(err, IsNil)
+		ts += 10
+	}
+	// 50s observed (the first tick starts accounting), 20s down, 1 outage.
+	w := sla.Windows(ts).Windows[0]
+	t.Check(w.Days, Equals, uint(1))
+	t.Check(w.Observed, Equals, int64(50))
+	t.Check(w.Downtime, Equals, int64(20))
+	t.Check(w.Failures, Equals, uint(1))
+	t.Check(w.Uptime, Equals, float64(60))
+	t.Check(w.MTBF, Equals, float64(30))
+	t.Check(w.MTTR, Equals, float64(20))
+
+	// A gap longer than SLA_MAX_GAP isn't observed, e.g. agent not running.
+	ts += mysql.SLA_MAX_GAP
+	err = sla.Tick(ts, false)
+	t.Assert(err, IsNil)
+	w = sla.Windows(ts).Windows[0]
+	t.Check(w.Observed, Equals, int64(50))
+	t.Check(w.Failures, Equals, uint(2))
+	t.Check(sla.Up(), Equals, false)
+
+	// A restart when up is a failure, but not when already down.
+	err = sla.Restart(ts)
+	t.Assert(err, IsNil)
+	ts += 10
+	err = sla.Tick(ts, true)
+	t.Assert(err, IsNil)
+	err = sla.Restart(ts)
+	t.Assert(err, IsNil)
+	w = sla.Windows(ts).Windows[0]
+	t.Check(w.Observed, Equals, int64(60))
+	t.Check(w.Downtime, Equals, int64(20))
+	t.Check(w.Failures, Equals, uint(3))
+	t.Check(w.Restarts, Equals, uint(2))
+	t.Check(sla.Up(), Equals, false)
+
+	// Restart saves, so the accounting is the same when loaded again.
+	sla2, err := mysql.NewSLA(s.file)
+	t.Assert(err, IsNil)
+	t.Check(sla2.Windows(ts), DeepEquals, sla.Windows(ts))
+	t.Check(sla2.Up(), Equals, false)
+
+	// The time the agent wasn't running isn't observed, even if it's less
+	// than SLA_MAX_GAP.
+	ts += 10
+	err = sla2.Tick(ts, true)
+	t.Assert(err, IsNil)
+	t.Check(sla2.Windows(ts).Windows[0].Observed, Equals, int64(60))
+}
+
+func (s *SLATestSuite) TestReport(t *C) {
+	sla, err := mysql.NewSLA(s.file)
+	t.Assert(err, IsNil)
+
+	day := int64(1420070400) // 2015-01-01 00:00:00 UTC
+	ts := day + 86400 - 20
+	t.Check(sla.Report(ts), IsNil) // no ticks yet
+	sla.Tick(ts, true)
+	sla.Tick(ts+10, false)
+	t.Check(sla.Report(ts+10), IsNil) // same day
+
+	// First collection on the next day reports the windows ending yesterday.
+	sla.Tick(ts+20, false)
+	report := sla.Report(ts + 20)
+	t.Assert(report, NotNil)
+	t.Check(report.Ts, Equals, ts+20)
+	t.Assert(report.Windows, HasLen, len(mysql.SLA_WINDOWS))
+	w := report.Windows[0]
+	t.Check(w.Observed, Equals, int64(10))
+	t.Check(w.Downtime, Equals, int64(10))
+	t.Check(w.Failures, Equals, uint(1))
+	t.Check(w.Uptime, Equals, float64(0))
+	for i, days := range mysql.SLA_WINDOWS {
+		t.Check(report.Windows[i].Days, Equals, days)
+		t.Check(report.Windows[i].Observed, Equals, int64(10))
+	}
+	t.Check(sla.Report(ts+30), IsNil) // already reported today
+
+	// Today's down time is in today's window, not yesterday's.
+	t.Check(sla.Windows(ts + 20).Windows[0].Downtime, Equals, int64(10))
+
+	// Days older than SLA_DAYS are removed.
+	ts = day + (mysql.SLA_DAYS+1)*86400 + 3600
+	sla.Tick(ts, true)
+	report = sla.Report(ts)
+	t.Assert(report, NotNil)
+	for _, w := range report.Windows {
+		t.Check(w.Observed, Equals, int64(0), Commentf("%d days", w.Days))
+	}
+}
+
+// fakeMySQL is a MySQL connection that doesn't need MySQL: it connects when
+// the test sends on connectChan, and queries go to db, which is either a real
+// *sql.DB that fails every query or a fakeServer.
+type fakeMySQL struct {
+	*mock.NullMySQL
+	db          *sql.DB
+	connectChan chan bool
+}
+
+func (c *fakeMySQL) DB() *sql.DB {
+	return c.db
+}
+
+func (c *fakeMySQL) Connect(tries uint) error {
+	<-c.connectChan
+	return nil
+}
+
+func (s *SLATestSuite) TestMonitor(t *C) {
+	db, err := sql.Open("mysql", "user:pass@tcp(127.0.0.1:1)/")
+	t.Assert(err, IsNil)
+	defer db.Close()
+	conn := &fakeMySQL{
+		NullMySQL:   mock.NewNullMySQL(),
+		db:          db,
+		connectChan: make(chan bool),
+	}
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		SLA: true,
+	}
+	logger := pct.NewLogger(make(chan *proto.LogEntry, 100), "mm-mysql-1")
+	mrm := mock.NewMrmsMonitor()
+	m := mysql.NewMonitor("mm-mysql-1", config, logger, conn, mrm)
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	err = m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// MySQL is down, but the first tick of the day still sends the daily
+	// event, alone.
+	day := time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)
+	tickChan <- day.Add(-10 * time.Second)
+	tickChan <- day.Add(5 * time.Second)
+	got := test.WaitCollection(collectionChan, 1)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Ts, Equals, day.Unix()+5)
+	t.Check(got[0].Metrics, HasLen, 0)
+	t.Assert(got[0].Events, HasLen, 1)
+	t.Check(got[0].Events[0].Type, Equals, "mysql/sla")
+	t.Check(got[0].Events[0].Level, Equals, mm.EVENT_WARNING) // went down
+	t.Check(test.WaitStatus(1, m, "mm-mysql-1-sla", "0.00% 1d, 0.00% 7d, 0.00% 30d"), Equals, true)
+
+	// A restart detected by MRMS is accounted and saved.
+	conn.connectChan <- true
+	t.Assert(test.WaitStatus(5, m, "mm-mysql-1-mysql", "Connected"), Equals, true)
+	mrm.SimulateMySQLRestart()
+	t.Assert(test.WaitStatus(5, m, "mm-mysql-1-mysql", "Connecting (Lost connection to MySQL, restarting)"), Equals, true)
+	sla, err := mysql.NewSLA(s.file)
+	t.Assert(err, IsNil)
+	t.Check(sla.Windows(time.Now().UTC().Unix()).Windows[0].Restarts, Equals, uint(1))
+}
+
+func (s *SLATestSuite) TestInvalidFile(t *C) {
+	err := ioutil.WriteFile(s.file, []byte("{bad json"), 0600)
+	t.Assert(err, IsNil)
+	sla, err := mysql.NewSLA(s.file)
+	t.Check(err, NotNil)
+	t.Assert(sla, NotNil)
+	t.Check(sla.Up(), Equals, true)
+	t.Check(sla.Tick(1420070400, true), IsNil)
+
+	// Starting over overwrote the invalid file.
+	_, err = mysql.NewSLA(s.file)
+	t.Check(err, IsNil)
+}
+
+// --------------------------------------------------------------------------
+
+/**
+ * fakeServer is a database/sql driver, registered as "fakemysql", that
+ * answers queries with the rows or error set for them, so tests can make the
+ * monitor connect, lose the connection, and see MariaDB without MySQL.
+ * The DSN is the name of the server in fakeServers.  Values are returned as
+ * []byte like the real driver returns them.
+ */
+
+type fakeServer struct {
+	sync.Mutex
+	results map[string]fakeResult
+	queries []string
+}
+
+type fakeResult struct {
+	rows [][]string
+	err  error
+}
+
+var fakeServersMux = &sync.Mutex{}
+var fakeServers = make(map[string]*fakeServer)
+
+func init() {
+	sql.Register("fakemysql", fakeDriver{})
+}
+
+// newFakeServer returns a new fakeServer and a *sql.DB connected to it.
+func newFakeServer(name string) (*fakeServer, *sql.DB, error) {
+	s := &fakeServer{
+		results: make(map[string]fakeResult),
+	}
+	fakeServersMux.Lock()
+	fakeServers[name] = s
+	fakeServersMux.Unlock()
+	db, err := sql.Open("fakemysql", name)
+	return s, db, err
+}
+
+// Set makes query return the rows, or err if not nil.
+func (s *fakeServer) Set(query string, err error, rows ...[]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.results[query] = fakeResult{rows: rows, err: err}
+}
+
+// Queries returns the queries run so far.
+func (s *fakeServer) Queries() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.queries...)
+}
+
+func (s *fakeServer) run(query string) (*fakeRows, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.queries = append(s.queries, query)
+	r, ok := s.results[query]
+	if !ok {
+		return nil, fmt.Errorf("fakemysql: no result for %s", query)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &fakeRows{rows: r.rows}, nil
+}
+
+type fakeDriver struct{}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeServersMux.Lock()
+	defer fakeServersMux.Unlock()
+	s, ok := fakeServers[name]
+	if !ok {
+		return nil, fmt.Errorf("fakemysql: no server %s", name)
+	}
+	return &fakeConn{s}, nil
+}
+
+type fakeConn struct {
+	s *fakeServer
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{s: c.s, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakemysql: transactions not supported")
+}
+
+type fakeStmt struct {
+	s     *fakeServer
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.s.run(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.s.run(s.query)
+}
+
+type fakeRows struct {
+	rows [][]string
+	n    int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"c1"}
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = fmt.Sprintf("c%d", i+1)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.n >= len(r.rows) {
+		return io.EOF
+	}
+	for i, v := range r.rows[r.n] {
+		dest[i] = []byte(v)
+	}
+	r.n++
+	return nil
+}
+
+// collectOne ticks until m sends a collection because, after connect()
+// reports "Connected", run() may not know yet that it's connected.
+func collectOne(tickChan chan time.Time, collectionChan chan *mm.Collection) *mm.Collection {
+	for i := 0; i < 20; i++ {
+		tickChan <- time.Now()
+		select {
+		case c := <-collectionChan:
+			return c
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+type ConnectTestSuite struct {
+	logChan        chan *proto.LogEntry
+	logger         *pct.Logger
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	name           string
+	mrm            *mock.MrmsMonitor
+}
+
+var _ = Suite(&ConnectTestSuite{})
+
+func (s *ConnectTestSuite) SetUpSuite(t *C) {
+	s.name = "mm-mysql-1"
+	s.logChan = make(chan *proto.LogEntry, 1000)
+	s.logger = pct.NewLogger(s.logChan, s.name)
+	s.tickChan = make(chan time.Time)
+	s.collectionChan = make(chan *mm.Collection, 1)
+	s.mrm = mock.NewMrmsMonitor()
+}
+
+func (s *ConnectTestSuite) SetUpTest(t *C) {
+	for {
+		select {
+		case <-s.collectionChan:
+		case <-s.logChan:
+		default:
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ConnectTestSuite) TestReconnect(t *C) {
+	server, db, err := newFakeServer(t.TestName())
+	t.Assert(err, IsNil)
+	defer db.Close()
+	server.Set("SELECT @@version", nil, []string{"5.6.24-log"})
+	server.Set("SHOW /*!50002 GLOBAL */ STATUS", nil, []string{"Threads_running", "3"})
+
+	conn := &fakeMySQL{
+		NullMySQL:   mock.NewNullMySQL(),
+		db:          db,
+		connectChan: make(chan bool),
+	}
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status: mysql.StatusVars{"Threads_running": ""},
+	}
+	m := mysql.NewMonitor(s.name, config, s.logger, conn, s.mrm)
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	conn.connectChan <- true
+	t.Assert(test.WaitStatus(5, m, s.name+"-mysql", "Connected"), Equals, true)
+	c := collectOne(s.tickChan, s.collectionChan)
+	t.Assert(c, NotNil)
+	t.Check(c.Metrics, DeepEquals, []mm.Metric{{"mysql/threads_running", "gauge", 3, ""}})
+
+	// The driver returns io.EOF when MySQL goes away between queries.  run()
+	// stops collecting and connect() tries again until MySQL is back.
+	server.Set("SHOW /*!50002 GLOBAL */ STATUS", io.EOF)
+	s.tickChan <- time.Now()
+	t.Assert(test.WaitStatus(5, m, s.name+"-mysql", "Connecting (Network error)"), Equals, true)
+	t.Check(test.WaitStatusPrefix(1, m, s.name, "Idle"), Equals, true)
+	t.Check(strings.HasSuffix(m.Status()[s.name], "error: Lost connection to MySQL)"), Equals, true)
+
+	// Not connected, so ticks don't query MySQL.
+	n := len(server.Queries())
+	s.tickChan <- time.Now()
+	t.Check(test.WaitCollection(s.collectionChan, 1), HasLen, 0)
+	t.Check(server.Queries(), HasLen, n)
+
+	// Connected again: connect() checks the version again and run() collects.
+	server.Set("SHOW /*!50002 GLOBAL */ STATUS", nil, []string{"Threads_running", "5"})
+	conn.connectChan <- true
+	t.Assert(test.WaitStatus(5, m, s.name+"-mysql", "Connected"), Equals, true)
+	c = collectOne(s.tickChan, s.collectionChan)
+	t.Assert(c, NotNil)
+	t.Check(c.Metrics, DeepEquals, []mm.Metric{{"mysql/threads_running", "gauge", 5, ""}})
+	versionChecks := 0
+	for _, q := range server.Queries() {
+		if q == "SELECT @@version" {
+			versionChecks++
+		}
+	}
+	t.Check(versionChecks, Equals, 2)
+}
+
+func (s *ConnectTestSuite) TestMariaDB(t *C) {
+	status := [][]string{
+		{"Aria_pagecache_blocks_used", "10"},
+		{"Aria_pagecache_reads", "200"},
+		{"Threadpool_threads", "4"},
+		{"Rows_read", "1000"},
+		{"Com_select", "5"},
+		{"Threads_running", "3"},
+	}
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status:  mysql.StatusVars{"Threads_running": ""},
+		Exclude: []string{"rows_*"},
+	}
+
+	// MySQL: only the Status variables.
+	types := s.collectTypes(t, t.TestName()+"-mysql", "5.6.24-log", status, config)
+	t.Check(types, DeepEquals, map[string]string{
+		"mysql/threads_running": "gauge",
+	})
+
+	// MariaDB: also its variables, except those excluded, typed by StatusType.
+	types = s.collectTypes(t, t.TestName()+"-mariadb", "10.0.17-MariaDB-log", status, config)
+	t.Check(types, DeepEquals, map[string]string{
+		"mysql/aria_pagecache_blocks_used": "gauge",
+		"mysql/aria_pagecache_reads":       "counter",
+		"mysql/threadpool_threads":         "gauge",
+		"mysql/threads_running":            "gauge",
+	})
+}
+
+// collectTypes starts a monitor for a fakeServer with the version and SHOW
+// STATUS rows, and returns the metric types of the first collection.
+func (s *ConnectTestSuite) collectTypes(t *C, name, version string, status [][]string, config *mysql.Config) map[string]string {
+	server, db, err := newFakeServer(name)
+	t.Assert(err, IsNil)
+	defer db.Close()
+	server.Set("SELECT @@version", nil, []string{version})
+	server.Set("SHOW /*!50002 GLOBAL */ STATUS", nil, status...)
+
+	conn := &fakeMySQL{
+		NullMySQL:   mock.NewNullMySQL(),
+		db:          db,
+		connectChan: make(chan bool, 1),
+	}
+	conn.connectChan <- true
+	m := mysql.NewMonitor(s.name, config, s.logger, conn, s.mrm)
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	c := collectOne(s.tickChan, s.collectionChan)
+	t.Assert(c, NotNil)
+	types := map[string]string{}
+	for _, metric := range c.Metrics {
+		types[metric.Name] = metric.Type
+	}
+	return types
+}
+
+func (s *ConnectTestSuite) TestUserStats(t *C) {
+	unknownVar := &mysqlDriver.MySQLError{
+		Number:  mysqlConn.ER_UNKNOWN_SYSTEM_VARIABLE,
+		Message: "Unknown system variable 'userstat'",
+	}
+	tests := []struct {
+		userstat        error
+		userstatRunning error
+		enabled         bool
+		queries         []string
+	}{
+		// Percona Server 5.5.10 and newer, and MariaDB.
+		{nil, nil, true, []string{"SET GLOBAL userstat=ON"}},
+		// Percona Server 5.1.49 to 5.5.10.
+		{unknownVar, nil, true, []string{"SET GLOBAL userstat=ON", "SET GLOBAL userstat_running=ON"}},
+		// MySQL has neither, so user stats are disabled.
+		{unknownVar, unknownVar, false, []string{"SET GLOBAL userstat=ON", "SET GLOBAL userstat_running=ON"}},
+	}
+	for i, tt := range tests {
+		server, db, err := newFakeServer(fmt.Sprintf("%s-%d", t.TestName(), i))
+		t.Assert(err, IsNil)
+		server.Set("SELECT @@version", nil, []string{"5.5.30-log"})
+		server.Set("SET GLOBAL userstat=ON", tt.userstat)
+		server.Set("SET GLOBAL userstat_running=ON", tt.userstatRunning)
+		server.Set("SHOW /*!50002 GLOBAL */ STATUS", nil, []string{"Threads_running", "3"})
+
+		conn := &fakeMySQL{
+			NullMySQL:   mock.NewNullMySQL(),
+			db:          db,
+			connectChan: make(chan bool, 1),
+		}
+		conn.connectChan <- true
+		config := &mysql.Config{
+			Config: mm.Config{
+				ServiceInstance: proto.ServiceInstance{
+					Service:    "mysql",
+					InstanceId: 1,
+				},
+				Collect: 1,
+				Report:  60,
+			},
+			Status:    mysql.StatusVars{"Threads_running": ""},
+			UserStats: true,
+		}
+		m := mysql.NewMonitor(s.name, config, s.logger, conn, s.mrm)
+		err = m.Start(s.tickChan, s.collectionChan)
+		t.Assert(err, IsNil)
+
+		// connect() sets the global vars before run() collects.
+		c := collectOne(s.tickChan, s.collectionChan)
+		m.Stop()
+		db.Close()
+		t.Assert(c, NotNil, Commentf("test %d", i))
+
+		set := []string{}
+		for _, q := range server.Queries() {
+			if strings.HasPrefix(q, "SET GLOBAL") {
+				set = append(set, q)
+			}
+		}
+		t.Check(set, DeepEquals, tt.queries, Commentf("test %d", i))
+		t.Check(m.Config().(*mysql.Config).UserStats, Equals, tt.enabled, Commentf("test %d", i))
+	}
+}
+
+func (s *ConnectTestSuite) TestUserStatsBySchemaDropTable(t *C) {
+	server, db, err := newFakeServer(t.TestName())
+	t.Assert(err, IsNil)
+	defer db.Close()
+	tableStats := "SELECT TABLE_SCHEMA, TABLE_NAME, ROWS_READ, ROWS_CHANGED, ROWS_CHANGED_X_INDEXES FROM INFORMATION_SCHEMA.TABLE_STATISTICS"
+	indexStats := "SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, ROWS_READ FROM INFORMATION_SCHEMA.INDEX_STATISTICS"
+	server.Set("SELECT @@version", nil, []string{"5.6.24-log"})
+	server.Set("SET GLOBAL userstat=ON", nil)
+	server.Set("SHOW /*!50002 GLOBAL */ STATUS", nil, []string{"Threads_running", "3"})
+	server.Set(tableStats, nil,
+		[]string{"db1", "t1", "100", "10", "20"},
+		[]string{"db1", "t2", "50", "5", "10"},
+		[]string{"db2", "t1", "7", "0", "0"},
+	)
+	server.Set(indexStats, nil,
+		[]string{"db1", "t1", "PRIMARY", "80"},
+		[]string{"db1", "t2", "PRIMARY", "40"},
+		[]string{"db2", "t1", "PRIMARY", "7"},
+	)
+
+	conn := &fakeMySQL{
+		NullMySQL:   mock.NewNullMySQL(),
+		db:          db,
+		connectChan: make(chan bool, 1),
+	}
+	conn.connectChan <- true
+	config := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		Status:            mysql.StatusVars{"Threads_running": ""},
+		UserStats:         true,
+		UserStatsBySchema: true,
+	}
+	m := mysql.NewMonitor(s.name, config, s.logger, conn, s.mrm)
+	err = m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	metrics := func(c *mm.Collection) map[string]float64 {
+		values := map[string]float64{}
+		for _, metric := range c.Metrics {
+			if strings.HasPrefix(metric.Name, "mysql/db.") {
+				t.Check(metric.Type, Equals, "counter", Commentf(metric.Name))
+				values[metric.Name] = metric.Number
+			}
+		}
+		return values
+	}
+
+	c := collectOne(s.tickChan, s.collectionChan)
+	t.Assert(c, NotNil)
+	t.Check(metrics(c), DeepEquals, map[string]float64{
+		"mysql/db.db1/rows_read":              150,
+		"mysql/db.db1/rows_changed":           15,
+		"mysql/db.db1/rows_changed_x_indexes": 30,
+		"mysql/db.db1/idx_rows_read":          120,
+		"mysql/db.db2/rows_read":              7,
+		"mysql/db.db2/rows_changed":           0,
+		"mysql/db.db2/rows_changed_x_indexes": 0,
+		"mysql/db.db2/idx_rows_read":          7,
+	})
+
+	// Drop db1.t2 and db2: the db1 sums keep t2's last values so the counters
+	// don't go down, and db2 is no longer reported.
+	server.Set(tableStats, nil,
+		[]string{"db1", "t1", "110", "11", "22"},
+	)
+	server.Set(indexStats, nil,
+		[]string{"db1", "t1", "PRIMARY", "90"},
+	)
+	c = collectOne(s.tickChan, s.collectionChan)
+	t.Assert(c, NotNil)
+	t.Check(metrics(c), DeepEquals, map[string]float64{
+		"mysql/db.db1/rows_read":              160,
+		"mysql/db.db1/rows_changed":           16,
+		"mysql/db.db1/rows_changed_x_indexes": 32,
+		"mysql/db.db1/idx_rows_read":          130,
+	})
 }
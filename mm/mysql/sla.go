@@ -0,0 +1,318 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * If Config.SLA is true, the monitor keeps availability accounting for the
+ * instance so basic SLA numbers are available without dashboards.  Every
+ * tick the instance is up if the monitor is connected, collecting works,
+ * and the canary query (if Config.Canary) succeeds, else it's down.  The
+ * time since the previous tick is counted as observed, and as down if the
+ * instance is down at this tick.  Going down is a failure (an outage), and so
+ * is a restart detected by MRMS even if no tick saw the instance down.  Gaps
+ * longer than SLA_MAX_GAP and the time the agent isn't running aren't
+ * observed: they're neither up nor down.
+ *
+ * Accounting is kept per UTC day for SLA_DAYS in history/sla-mysql-<id>.json
+ * so it survives agent restarts.  The first tick of every UTC day sends a
+ * mysql/sla event with an SLAReport: uptime, downtime, failures, MTBF, and
+ * MTTR over the last 1, 7, and 30 days (SLA_WINDOWS).  It's sent with the
+ * collection, or alone if the instance is down.  Multi-target monitors
+ * don't have SLA accounting.
+ */
+
+const (
+	SLA_DAYS    = 30  // days of accounting kept
+	SLA_MAX_GAP = 300 // seconds between ticks, more isn't observed
+	SLA_SAVE    = 300 // save accounting at least this often (seconds)
+)
+
+var SLA_WINDOWS = []uint{1, 7, 30} // days
+
+// SLADay is the availability accounting for one UTC day.
+type SLADay struct {
+	Day      int64 // UTC Unix ts of midnight
+	Observed int64 // seconds
+	Down     int64 // seconds of Observed
+	Failures uint  // outages and restarts
+	Restarts uint  // restarts detected by MRMS
+}
+
+// SLAWindow is the availability for Days UTC days.
+type SLAWindow struct {
+	Days     uint
+	Observed int64   // seconds
+	Uptime   float64 // percent of Observed
+	Downtime int64   // seconds
+	Failures uint
+	Restarts uint
+	MTBF     float64 // mean seconds up between failures, 0 if no failures
+	MTTR     float64 // mean seconds down per failure, 0 if no failures
+}
+
+// SLAReport is the Data of the daily mysql/sla event.
+type SLAReport struct {
+	Ts      int64 // UTC Unix timestamp
+	Windows []SLAWindow
+}
+
+type slaState struct {
+	Up        bool     // at LastTs
+	LastTs    int64    // last tick since NewSLA, 0 if none
+	ReportDay int64    // day of the last report
+	Days      []SLADay // oldest first
+}
+
+// SLA is the availability accounting for one instance.  It's not guarded:
+// only the monitor's run goroutine uses it.
+type SLA struct {
+	file    string
+	state   slaState
+	savedTs int64
+}
+
+// SLAFile returns the SLA accounting file for the MySQL instance.
+func SLAFile(instanceId uint) string {
+	return filepath.Join(pct.Basedir.Dir("history"), fmt.Sprintf("sla-mysql-%d.json", instanceId))
+}
+
+// RemoveSLA removes the SLA accounting of the MySQL instance when the
+// instance is removed, and returns true if it had any.
+func RemoveSLA(instanceId uint) (bool, error) {
+	err := os.Remove(SLAFile(instanceId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// NewSLA returns the SLA accounting saved in file, or new accounting if there
+// is no file.  If the file can't be read or is invalid, the error is returned
+// with new accounting which overwrites the file when saved.
+func NewSLA(file string) (*SLA, error) {
+	s := &SLA{
+		file: file,
+	}
+	s.reset()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		s.reset()
+		return s, fmt.Errorf("Invalid SLA file %s: %s", file, err)
+	}
+	// The agent wasn't running since the last tick, so that time isn't
+	// observed even if it's less than SLA_MAX_GAP.
+	s.state.LastTs = 0
+	return s, nil
+}
+
+// Tick accounts the time since the last tick, and saves the accounting if
+// the instance went down or up, or SLA_SAVE seconds have passed.
+func (s *SLA) Tick(ts int64, up bool) error {
+	day := s.day(ts)
+	if s.state.LastTs > 0 && ts > s.state.LastTs && ts-s.state.LastTs <= SLA_MAX_GAP {
+		d := ts - s.state.LastTs
+		day.Observed += d
+		if !up {
+			day.Down += d
+		}
+	}
+	changed := up != s.state.Up
+	if changed && !up {
+		day.Failures++
+	}
+	s.state.Up = up
+	s.state.LastTs = ts
+	if s.state.ReportDay == 0 {
+		s.state.ReportDay = day.Day // first report tomorrow
+	}
+	if changed || ts-s.savedTs >= SLA_SAVE {
+		return s.Save()
+	}
+	return nil
+}
+
+// Restart accounts a MySQL restart.  It's a failure unless the instance is
+// already down, and the instance is down until the next tick that's up.
+func (s *SLA) Restart(ts int64) error {
+	day := s.day(ts)
+	day.Restarts++
+	if s.state.Up {
+		day.Failures++
+		s.state.Up = false
+	}
+	return s.Save()
+}
+
+// Up returns true if the instance was up at the last tick.
+func (s *SLA) Up() bool {
+	return s.state.Up
+}
+
+// Report returns the SLAReport of the windows ending yesterday if ts is in
+// a new UTC day since the last report, else nil.
+func (s *SLA) Report(ts int64) *SLAReport {
+	today := slaDay(ts)
+	if s.state.ReportDay == 0 || today <= s.state.ReportDay {
+		return nil
+	}
+	s.state.ReportDay = today
+	report := s.windows(today - 86400)
+	report.Ts = ts
+	return report
+}
+
+// Windows returns the availability for SLA_WINDOWS days up to and including
+// the UTC day of ts.
+func (s *SLA) Windows(ts int64) *SLAReport {
+	report := s.windows(slaDay(ts))
+	report.Ts = ts
+	return report
+}
+
+func (s *SLA) windows(lastDay int64) *SLAReport {
+	report := &SLAReport{
+		Windows: make([]SLAWindow, len(SLA_WINDOWS)),
+	}
+	for i, days := range SLA_WINDOWS {
+		w := SLAWindow{Days: days}
+		since := lastDay - int64(days-1)*86400
+		for _, d := range s.state.Days {
+			if d.Day < since || d.Day > lastDay {
+				continue
+			}
+			w.Observed += d.Observed
+			w.Downtime += d.Down
+			w.Failures += d.Failures
+			w.Restarts += d.Restarts
+		}
+		if w.Observed > 0 {
+			w.Uptime = float64(w.Observed-w.Downtime) / float64(w.Observed) * 100
+		}
+		if w.Failures > 0 {
+			w.MTBF = float64(w.Observed-w.Downtime) / float64(w.Failures)
+			w.MTTR = float64(w.Downtime) / float64(w.Failures)
+		}
+		report.Windows[i] = w
+	}
+	return report
+}
+
+// Save writes the accounting file.  It's written then renamed so a crash
+// doesn't leave a partial file.
+func (s *SLA) Save() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	if err := pct.MakeDir(filepath.Dir(s.file)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(s.file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(s.file+".tmp", s.file); err != nil {
+		return err
+	}
+	s.savedTs = s.state.LastTs
+	return nil
+}
+
+func (s *SLA) reset() {
+	s.state = slaState{
+		Up:   true,
+		Days: []SLADay{},
+	}
+}
+
+// day returns the accounting for the UTC day of ts, adding it and removing
+// days older than SLA_DAYS if it's a new day.
+func (s *SLA) day(ts int64) *SLADay {
+	d := slaDay(ts)
+	n := len(s.state.Days)
+	if n > 0 && s.state.Days[n-1].Day == d {
+		return &s.state.Days[n-1]
+	}
+	if n > 0 && s.state.Days[n-1].Day > d {
+		// Clock went back: account to the last day rather than reorder.
+		return &s.state.Days[n-1]
+	}
+	s.state.Days = append(s.state.Days, SLADay{Day: d})
+	oldest := d - (SLA_DAYS-1)*86400
+	for len(s.state.Days) > 0 && s.state.Days[0].Day < oldest {
+		s.state.Days = s.state.Days[1:]
+	}
+	return &s.state.Days[len(s.state.Days)-1]
+}
+
+func slaDay(ts int64) int64 {
+	return ts - ts%86400
+}
+
+// slaStatus formats the report for the monitor status, like "99.98% 1d,
+// 99.99% 7d, 99.99% 30d".
+func slaStatus(report *SLAReport) string {
+	status := ""
+	for i, w := range report.Windows {
+		if i > 0 {
+			status += ", "
+		}
+		if w.Observed == 0 {
+			status += fmt.Sprintf("n/a %dd", w.Days)
+		} else {
+			status += fmt.Sprintf("%.2f%% %dd", w.Uptime, w.Days)
+		}
+	}
+	return status
+}
+
+// slaEvent returns the mysql/sla event of the daily report.
+func slaEvent(report *SLAReport) mm.Event {
+	level := mm.EVENT_INFO
+	for _, w := range report.Windows {
+		if w.Failures > 0 && w.Days == SLA_WINDOWS[0] {
+			level = mm.EVENT_WARNING // failures in the last day
+		}
+	}
+	return mm.Event{
+		Ts:      report.Ts,
+		Type:    "mysql/sla",
+		Level:   level,
+		Message: "Uptime " + slaStatus(report),
+		Data:    report,
+	}
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+/**
+ * If Config.Slave is true, SHOW SLAVE STATUS is collected on every tick:
+ * whether the IO and SQL threads are running, and their last error numbers,
+ * as metrics; and an event with the error text when an error first appears.
+ *
+ * Remediation is opt-in: if Config.SlaveRestart lists error numbers, e.g.
+ * 1205 (lock wait timeout), and a replication thread stopped because of one of
+ * them, the monitor restarts only that thread, at most Config.SlaveRestartMax
+ * times per hour.  Every restart and every restart not done because of the
+ * limit is reported as an event, so there's a full audit trail.
+ */
+
+const (
+	DEFAULT_SLAVE_RESTART_MAX = 3 // per hour
+)
+
+type slaveThread struct {
+	name    string // io or sql
+	running string // Slave_IO_Running, Slave_SQL_Running
+	errno   string // Last_IO_Errno, Last_SQL_Errno
+	error   string // Last_IO_Error, Last_SQL_Error
+	start   string // START SLAVE ...
+}
+
+var slaveThreads = []slaveThread{
+	{"io", "Slave_IO_Running", "Last_IO_Errno", "Last_IO_Error", "START SLAVE IO_THREAD"},
+	{"sql", "Slave_SQL_Running", "Last_SQL_Errno", "Last_SQL_Error", "START SLAVE SQL_THREAD"},
+}
+
+type slaveState struct {
+	lastErrno  map[string]int64 // keyed on slaveThread.name
+	limitErrno map[string]int64 // error for which restart limit was reported
+	restarts   []int64          // Unix ts of restarts in the last hour
+}
+
+func (m *Monitor) getSlaveStatus(conn *sql.DB, c *mm.Collection) error {
+	m.logger.Debug("getSlaveStatus:call")
+	defer m.logger.Debug("getSlaveStatus:return")
+
+	m.status.Update(m.name, "Getting slave status")
+
+	status, err := showSlaveStatus(conn)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return nil // not a slave
+	}
+
+	if m.slave.lastErrno == nil {
+		m.slave.lastErrno = make(map[string]int64)
+		m.slave.limitErrno = make(map[string]int64)
+	}
+
+	for _, t := range slaveThreads {
+		running := status[t.running] == "Yes"
+		errno, _ := strconv.ParseInt(status[t.errno], 10, 64)
+
+		var runningVal float64
+		if running {
+			runningVal = 1
+		}
+		c.Metrics = append(c.Metrics,
+			mm.Metric{Name: "mysql/slave/" + t.name + "_running", Type: "gauge", Number: runningVal},
+			mm.Metric{Name: "mysql/slave/last_" + t.name + "_errno", Type: "gauge", Number: float64(errno)},
+		)
+
+		// Report an error once, when it appears or changes.
+		if errno != 0 && errno != m.slave.lastErrno[t.name] {
+			c.Events = append(c.Events, mm.Event{
+				Ts:      c.Ts,
+				Type:    "mysql/slave/" + t.name + "_error",
+				Level:   mm.EVENT_ERROR,
+				Message: fmt.Sprintf("Slave %s thread error %d: %s", t.name, errno, status[t.error]),
+			})
+		}
+		m.slave.lastErrno[t.name] = errno
+
+		if !running && errno != 0 && m.canRestartSlave(uint16(errno)) {
+			m.restartSlave(conn, c, t, errno)
+		}
+	}
+
+	return nil
+}
+
+func (m *Monitor) canRestartSlave(errno uint16) bool {
+	for _, e := range m.config.SlaveRestart {
+		if e == errno {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Monitor) restartSlave(conn *sql.DB, c *mm.Collection, t slaveThread, errno int64) {
+	max := m.config.SlaveRestartMax
+	if max == 0 {
+		max = DEFAULT_SLAVE_RESTART_MAX
+	}
+
+	// Forget restarts more than an hour ago.
+	restarts := []int64{}
+	for _, ts := range m.slave.restarts {
+		if c.Ts-ts < 3600 {
+			restarts = append(restarts, ts)
+		}
+	}
+	m.slave.restarts = restarts
+
+	event := mm.Event{
+		Ts:   c.Ts,
+		Type: "mysql/slave/restart",
+	}
+	if uint(len(restarts)) >= max {
+		event.Level = mm.EVENT_ERROR
+		event.Message = fmt.Sprintf("Not restarting slave %s thread after error %d: already restarted %d times in the last hour",
+			t.name, errno, len(restarts))
+		// Report hitting the limit once, not every tick.
+		if m.slave.limitErrno[t.name] != errno {
+			c.Events = append(c.Events, event)
+			m.logger.Warn(event.Message)
+		}
+		m.slave.limitErrno[t.name] = errno
+		return
+	}
+	m.slave.limitErrno[t.name] = 0
+
+	m.slave.restarts = append(m.slave.restarts, c.Ts)
+	if _, err := conn.Exec(t.start); err != nil {
+		event.Level = mm.EVENT_ERROR
+		event.Message = fmt.Sprintf("%s after error %d failed: %s", t.start, errno, err)
+	} else {
+		event.Level = mm.EVENT_WARNING
+		event.Message = fmt.Sprintf("%s after error %d (restart %d of %d this hour)", t.start, errno, len(m.slave.restarts), max)
+	}
+	c.Events = append(c.Events, event)
+	m.logger.Warn(event.Message)
+}
+
+// showSlaveStatus returns SHOW SLAVE STATUS keyed on column name, or nil
+// if the server is not a slave.
+func showSlaveStatus(conn *sql.DB) (map[string]string, error) {
+	return showRow(conn, "SHOW SLAVE STATUS")
+}
+
+// showRow returns the first row of a SHOW command keyed on column name, or
+// nil if there are no rows.
+func showRow(conn *sql.DB, query string) (map[string]string, error) {
+	rows, err := showRows(conn, query)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows[0], nil
+}
+
+// showRows returns the rows of a SHOW command keyed on column name.  Columns
+// vary by version, so they're not scanned into a struct.  NULL is "".
+func showRows(conn *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	all := []map[string]string{}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(columns))
+		for i, col := range columns {
+			row[col] = values[i].String
+		}
+		all = append(all, row)
+	}
+	return all, rows.Err()
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mysql"
+)
+
+/**
+ * Partition counts and tablespace sizes come from INFORMATION_SCHEMA tables
+ * which can take seconds to query on servers with many tables, much longer
+ * than the collect limit, so they're collected in the background (see
+ * background.go) every Config.SpaceInterval seconds.
+ */
+
+const (
+	DEFAULT_SPACE_INTERVAL = 300 // 5 minutes
+)
+
+func (m *Monitor) collectSpaceMetrics(conn *sql.DB, ts int64) ([]mm.Metric, []mm.Event) {
+	metrics := []mm.Metric{}
+
+	partitions, err := m.getPartitionCounts(conn)
+	if err != nil {
+		m.logger.Warn("Cannot collect partition counts: ", err)
+	} else {
+		metrics = append(metrics, partitions...)
+	}
+
+	tablespaces, err := m.getTablespaceSizes(conn)
+	if err != nil {
+		m.logger.Warn("Cannot collect tablespace sizes: ", err)
+	} else {
+		metrics = append(metrics, tablespaces...)
+	}
+
+	return metrics, nil
+}
+
+func (m *Monitor) getPartitionCounts(conn *sql.DB) ([]mm.Metric, error) {
+	rows, err := conn.Query("SELECT TABLE_SCHEMA, TABLE_NAME, COUNT(*)" +
+		" FROM INFORMATION_SCHEMA.PARTITIONS" +
+		" WHERE PARTITION_NAME IS NOT NULL" +
+		" GROUP BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metrics := []mm.Metric{}
+	for rows.Next() {
+		var tableSchema string
+		var tableName string
+		var partitions float64
+		if err := rows.Scan(&tableSchema, &tableName, &partitions); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, mm.Metric{
+			Name:   "mysql/db." + mm.EscapeName(tableSchema) + "/t." + mm.EscapeName(tableName) + "/partitions",
+			Type:   "gauge",
+			Number: partitions,
+		})
+	}
+	return metrics, rows.Err()
+}
+
+func (m *Monitor) getTablespaceSizes(conn *sql.DB) ([]mm.Metric, error) {
+	// MySQL 5.7 and newer have InnoDB tablespaces in FILES.  Before 5.7,
+	// FILES is only for NDB, so this returns no rows.
+	rows, err := conn.Query("SELECT TABLESPACE_NAME, TOTAL_EXTENTS * EXTENT_SIZE, DATA_FREE" +
+		" FROM INFORMATION_SCHEMA.FILES" +
+		" WHERE ENGINE = 'InnoDB' AND TABLESPACE_NAME IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := tablespaceMetrics(rows)
+	if err != nil || len(metrics) > 0 {
+		return metrics, err
+	}
+
+	// Percona Server 5.6 has file sizes in INNODB_SYS_TABLESPACES but not free space.
+	rows, err = conn.Query("SELECT NAME, FILE_SIZE, NULL FROM INFORMATION_SCHEMA.INNODB_SYS_TABLESPACES")
+	if err != nil {
+		switch mysql.MySQLErrorCode(err) {
+		case mysql.ER_UNKNOWN_TABLE, mysql.ER_BAD_FIELD_ERROR:
+			return nil, fmt.Errorf("not supported by this version of MySQL (%s)", err)
+		}
+		return nil, err
+	}
+	return tablespaceMetrics(rows)
+}
+
+func tablespaceMetrics(rows *sql.Rows) ([]mm.Metric, error) {
+	defer rows.Close()
+	metrics := []mm.Metric{}
+	for rows.Next() {
+		var name string
+		var size sql.NullFloat64
+		var free sql.NullFloat64
+		if err := rows.Scan(&name, &size, &free); err != nil {
+			return nil, err
+		}
+		prefix := "mysql/tablespace." + TablespaceName(name) + "/"
+		if size.Valid {
+			metrics = append(metrics, mm.Metric{Name: prefix + "size", Type: "gauge", Number: size.Float64})
+		}
+		if free.Valid {
+			metrics = append(metrics, mm.Metric{Name: prefix + "free", Type: "gauge", Number: free.Float64})
+		}
+	}
+	return metrics, rows.Err()
+}
+
+// TablespaceName returns the metric name component for a tablespace.
+// File-per-table tablespaces are named db/table in InnoDB's filename encoding,
+// e.g. a@002eb/c for db "a.b" table "c", which becomes db.table with each part
+// decoded and escaped (see mm/name.go), so a "." in db or table isn't ambiguous.
+func TablespaceName(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	for i := range parts {
+		parts[i] = mm.EscapeName(decodeFilename(parts[i]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// decodeFilename decodes the @XXXX sequences of MySQL's filename encoding:
+// characters that aren't safe in file names are @ and their Unicode code point
+// in 4 hex digits, e.g. @002e for ".".  Other sequences, like @0G for
+// accented letters, are left as-is.
+func decodeFilename(name string) string {
+	if !strings.Contains(name, "@") {
+		return name
+	}
+	buf := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '@' && i+5 <= len(name) {
+			if r, err := strconv.ParseUint(name[i+1:i+5], 16, 32); err == nil {
+				buf = append(buf, string(rune(r))...)
+				i += 4
+				continue
+			}
+		}
+		buf = append(buf, name[i])
+	}
+	return string(buf)
+}
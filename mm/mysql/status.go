@@ -0,0 +1,202 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * Config.Status gives the type of each variable, but variables matched by
+ * Config.Include patterns have no type, so StatusType guesses: most SHOW STATUS
+ * variables only increase (counters), these are the ones that don't.
+ */
+
+var gaugeStatus = map[string]bool{
+	"aria_pagecache_blocks_not_flushed": true,
+	"aria_pagecache_blocks_unused":      true,
+	"aria_pagecache_blocks_used":        true,
+	"binlog_snapshot_position":          true,
+	"innodb_buffer_pool_bytes_data":     true,
+	"innodb_buffer_pool_bytes_dirty":    true,
+	"innodb_buffer_pool_pages_data":     true,
+	"innodb_buffer_pool_pages_dirty":    true,
+	"innodb_buffer_pool_pages_free":     true,
+	"innodb_buffer_pool_pages_misc":     true,
+	"innodb_buffer_pool_pages_old":      true,
+	"innodb_buffer_pool_pages_total":    true,
+	"innodb_checkpoint_age":             true,
+	"innodb_data_pending_fsyncs":        true,
+	"innodb_data_pending_reads":         true,
+	"innodb_data_pending_writes":        true,
+	"innodb_history_list_length":        true,
+	"innodb_os_log_pending_fsyncs":      true,
+	"innodb_os_log_pending_writes":      true,
+	"innodb_page_size":                  true,
+	"innodb_row_lock_current_waits":     true,
+	"innodb_row_lock_time_avg":          true,
+	"innodb_row_lock_time_max":          true,
+	"key_blocks_not_flushed":            true,
+	"key_blocks_unused":                 true,
+	"key_blocks_used":                   true,
+	"max_used_connections":              true,
+	"memory_used":                       true,
+	"open_files":                        true,
+	"open_streams":                      true,
+	"open_table_definitions":            true,
+	"open_tables":                       true,
+	"prepared_stmt_count":               true,
+	"qcache_free_blocks":                true,
+	"qcache_free_memory":                true,
+	"qcache_queries_in_cache":           true,
+	"qcache_total_blocks":               true,
+	"slave_heartbeat_period":            true,
+	"slave_open_temp_tables":            true,
+	"threadpool_idle_threads":           true,
+	"threadpool_threads":                true,
+	"threads_cached":                    true,
+	"threads_connected":                 true,
+	"threads_running":                   true,
+	"wsrep_cert_deps_distance":          true,
+	"wsrep_cluster_size":                true,
+	"wsrep_flow_control_paused":         true,
+	"wsrep_local_recv_queue":            true,
+	"wsrep_local_send_queue":            true,
+}
+
+// StatusType returns "gauge" or "counter" for the SHOW STATUS variable name,
+// which must be lowercase.
+func StatusType(name string) string {
+	if gaugeStatus[name] {
+		return "gauge"
+	}
+	return "counter"
+}
+
+/**
+ * Config.Status keys are matched case-insensitively, like MySQL matches
+ * SHOW STATUS variable names, so "Threads_running" and "threads_running" are
+ * the same key.  Keys can also be patterns so configs don't have to list every
+ * variable, or every variant of a variable across versions:
+ *
+ *   "innodb_buffer_pool_*"       glob: * matches any characters, ? one character
+ *   "/^com_(select|insert)$/"   regexp between slashes, case-insensitive
+ *
+ * Types are case-insensitive, too: "gauge", "counter", or "" for StatusType.
+ * A variable matched by a key without wildcards has that key's type, else the
+ * type of the longest pattern that matches it.  Unlike variables named by
+ * keys, variables matched by patterns are like Config.Include variables:
+ * Config.Exclude applies and non-numeric values are skipped silently.
+ */
+
+type statusMatcher struct {
+	exact    map[string]statusKey // keyed on lowercase name
+	patterns []statusKey          // longest key first
+}
+
+type statusKey struct {
+	key        string // Config.Status key
+	metricType string // "gauge", "counter", or "" for StatusType
+	glob       *pct.GlobMatcher
+	re         *regexp.Regexp
+}
+
+// isStatusPattern returns true if the Config.Status key is a glob or regexp.
+func isStatusPattern(key string) bool {
+	return key != STATUS_ALL && (strings.ContainsAny(key, "*?") || isStatusRegexp(key))
+}
+
+func isStatusRegexp(key string) bool {
+	return len(key) > 2 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/")
+}
+
+func statusMetricType(key, metricType string) (string, error) {
+	metricType = strings.ToLower(strings.TrimSpace(metricType))
+	switch metricType {
+	case "", "gauge", "counter":
+		return metricType, nil
+	}
+	return "", fmt.Errorf("Invalid Status type for %s: %s: expected gauge, counter, or \"\"", key, metricType)
+}
+
+func newStatusMatcher(vars StatusVars) (*statusMatcher, error) {
+	s := &statusMatcher{
+		exact: make(map[string]statusKey, len(vars)),
+	}
+	for key, metricType := range vars {
+		if key == STATUS_ALL {
+			continue
+		}
+		metricType, err := statusMetricType(key, metricType)
+		if err != nil {
+			return nil, err
+		}
+		k := statusKey{key: key, metricType: metricType}
+		switch {
+		case isStatusRegexp(key):
+			re, err := regexp.Compile("(?i)" + key[1:len(key)-1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Status regexp: %s: %s", key, err)
+			}
+			k.re = re
+			s.patterns = append(s.patterns, k)
+		case isStatusPattern(key):
+			k.glob = pct.NewGlobMatcher([]string{key})
+			s.patterns = append(s.patterns, k)
+		default:
+			s.exact[strings.ToLower(key)] = k
+		}
+	}
+	sort.Sort(byKeyLength(s.patterns))
+	return s, nil
+}
+
+// Match returns the key that matches the lowercase variable name and its type,
+// or false if none does.
+func (s *statusMatcher) Match(name string) (statusKey, bool) {
+	if k, ok := s.exact[name]; ok {
+		return k, true
+	}
+	for _, k := range s.patterns {
+		if (k.glob != nil && k.glob.Match(name)) || (k.re != nil && k.re.MatchString(name)) {
+			return k, true
+		}
+	}
+	return statusKey{}, false
+}
+
+// Remove stops matching the lowercase variable name by its exact key.
+func (s *statusMatcher) Remove(name string) {
+	delete(s.exact, name)
+}
+
+type byKeyLength []statusKey
+
+func (a byKeyLength) Len() int      { return len(a) }
+func (a byKeyLength) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byKeyLength) Less(i, j int) bool {
+	if len(a[i].key) != len(a[j].key) {
+		return len(a[i].key) > len(a[j].key)
+	}
+	return a[i].key < a[j].key // stable order for keys of equal length
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"errors"
+	"strconv"
+)
+
+/**
+ * Metric names are components separated by "/", and some components are
+ * <type>.<name> like mysql/db.<schema>/t.<table>/idx.<index>/rows_read.
+ * Schema, table, and index names can have any character, even "/", ".",
+ * and NUL, so a name like db "a/t.b" would make another metric's name, and
+ * sinks like Graphite which turn "/" into "." can't tell db "a.b" from
+ * db "a" and table "b".  So names are escaped with EscapeName: bytes other
+ * than ASCII letters, digits, "_", "$", and "-" become %XX (uppercase hex
+ * of each byte, so multi-byte UTF-8 characters are several %XX).  Common
+ * names are unchanged, and UnescapeName(EscapeName(s)) == s for any s.
+ */
+
+// EscapeName escapes a name (schema, table, index, etc.) for use as or in
+// one metric name component.
+func EscapeName(name string) string {
+	escape := false
+	for i := 0; i < len(name); i++ {
+		if !nameSafe(name[i]) {
+			escape = true
+			break
+		}
+	}
+	if !escape {
+		return name
+	}
+	const hex = "0123456789ABCDEF"
+	buf := make([]byte, 0, len(name)*3)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if nameSafe(c) {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, '%', hex[c>>4], hex[c&0xF])
+		}
+	}
+	return string(buf)
+}
+
+// UnescapeName returns the name escaped by EscapeName, or an error if s has
+// an invalid %XX.
+func UnescapeName(s string) (string, error) {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			buf = append(buf, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("Invalid escaped name: " + s + ": incomplete %XX")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("Invalid escaped name: " + s + ": invalid %" + s[i+1:i+3])
+		}
+		buf = append(buf, byte(c))
+		i += 2
+	}
+	return string(buf), nil
+}
+
+func nameSafe(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$' || c == '-'
+}
@@ -0,0 +1,322 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * The PostgreSQL monitor works like the MySQL monitor: it connects with
+ * Config.DSN, then on every tick it collects pg_stat_database, pg_stat_bgwriter,
+ * connection counts from pg_stat_activity, and, if Config.Replication is true,
+ * replication lag, and sends the collection to the same aggregator as every
+ * other monitor.  Metrics are prefixed "postgres/".
+ *
+ * If a query fails, the server is pinged: if the ping fails too, PostgreSQL
+ * is gone, so the monitor reconnects (with backoff) and the tick is lost.
+ * Else the error is logged and the other metrics are still sent.
+ */
+
+var (
+	networkError = errors.New("Network error")
+)
+
+type Monitor struct {
+	name   string
+	config *Config
+	logger *pct.Logger
+	// --
+	db             *sql.DB
+	version        int // server_version_num, e.g. 90405
+	backoff        *pct.Backoff
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	connectedChan  chan bool
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+	collectLimit   float64
+	databases      *pct.GlobMatcher
+}
+
+func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
+	m := &Monitor{
+		name:   name,
+		config: config,
+		logger: logger,
+		// --
+		backoff:       pct.NewBackoff(20 * time.Second),
+		connectedChan: make(chan bool, 1),
+		status:        pct.NewStatus([]string{name, name + "-postgres"}),
+		sync:          pct.NewSyncChan(),
+		collectLimit:  float64(config.Collect) * 0.1, // 10% of Collect time
+		databases:     pct.NewGlobMatcher(config.Databases),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) connect(err error) {
+	m.logger.Debug("connect:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("PostgreSQL connection crashed: ", err)
+		}
+		m.logger.Debug("connect:return")
+	}()
+
+	// Try forever to connect to PostgreSQL...
+	for {
+		m.logger.Debug("connect:try")
+		if err != nil {
+			m.status.Update(m.name+"-postgres", fmt.Sprintf("Connecting (%s)", err))
+		} else {
+			m.status.Update(m.name+"-postgres", "Connecting")
+		}
+		time.Sleep(m.backoff.Wait())
+
+		var db *sql.DB
+		if db, err = sql.Open("postgres", m.config.DSN); err != nil {
+			m.logger.Warn(err)
+			continue
+		}
+		if err = db.QueryRow("SHOW server_version_num").Scan(&m.version); err != nil {
+			db.Close()
+			m.logger.Warn(err)
+			continue
+		}
+		db.SetMaxOpenConns(1)
+		m.backoff.Success()
+
+		m.db = db
+		m.logger.Info("Connected")
+		m.status.Update(m.name+"-postgres", "Connected")
+
+		// Tell run() goroutine that it can try to collect metrics.
+		// If connection is lost, it will call us again.
+		m.connectedChan <- true
+		return
+	}
+}
+
+func (m *Monitor) close() {
+	if m.db != nil {
+		m.db.Close()
+		m.db = nil
+	}
+}
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("PostgreSQL monitor crashed: ", err)
+		}
+		m.close()
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	connected := false
+	go m.connect(nil)
+
+	m.status.Update(m.name, "Ready")
+
+	var lastTs int64
+	var lastError string
+	for {
+		t := time.Unix(lastTs, 0)
+		if lastError == "" {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(t)))
+		} else {
+			m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s, error: %s)", pct.TimeString(t), lastError))
+		}
+
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			if !connected {
+				m.logger.Debug("run:collect:disconnected")
+				lastError = "Not connected to PostgreSQL"
+				continue
+			}
+
+			m.status.Update(m.name, "Running")
+
+			// Start timing the collection.  If must take < collectLimit else
+			// it's discarded.
+			start := time.Now()
+
+			c, err := m.collect(now)
+			if err != nil {
+				connected = false
+				lastError = "Lost connection to PostgreSQL"
+				m.close()
+				go m.connect(err)
+				continue
+			}
+
+			diff := time.Now().Sub(start).Seconds()
+			if diff >= m.collectLimit {
+				lastError = fmt.Sprintf("Skipping interval because it took too long to collect: %.2fs >= %.2fs", diff, m.collectLimit)
+				m.logger.Warn(lastError)
+				continue
+			}
+
+			// Send the metrics to an mm.Aggregator.
+			m.status.Update(m.name, "Sending metrics")
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
+				select {
+				case m.collectionChan <- c:
+					lastTs = c.Ts
+					lastError = ""
+				case <-time.After(500 * time.Millisecond):
+					// lost collection
+					m.logger.Debug("Lost PostgreSQL metrics; timeout spooling after 500ms")
+					lastError = "Spool timeout"
+				}
+			} else {
+				m.logger.Debug("run:no metrics") // shouldn't happen
+				lastError = "No metrics"
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case connected = <-m.connectedChan:
+			m.logger.Debug(fmt.Sprintf("run:connected:%t", connected))
+			if connected {
+				m.status.Update(m.name, "Ready")
+			}
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+// collect gets all the metrics enabled by the config.  It returns networkError
+// if the connection to PostgreSQL was lost, else errors are logged and the
+// collection is returned.
+func (m *Monitor) collect(now time.Time) (*mm.Collection, error) {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+
+	collectors := []func(*mm.Collection) error{
+		m.getDatabaseStats,
+		m.getBgwriterStats,
+		m.getConnections,
+	}
+	if m.config.Replication {
+		collectors = append(collectors, m.getReplLag)
+	}
+	for _, collector := range collectors {
+		if err := collector(c); err != nil {
+			if m.collectError(err) == networkError {
+				return nil, networkError
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// collectError returns networkError if err is because the connection to
+// PostgreSQL was lost, which is the case if the server doesn't answer a ping,
+// else it logs and returns err.
+func (m *Monitor) collectError(err error) error {
+	if pingErr := m.db.Ping(); pingErr != nil {
+		m.logger.Warn("Lost connection to PostgreSQL:", err)
+		m.status.Update(m.name+"-postgres", fmt.Sprintf("Disconnected (%s)", err))
+		return networkError
+	}
+	m.logger.Warn(err)
+	return err
+}
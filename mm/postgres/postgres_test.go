@@ -0,0 +1,131 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package postgres_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/postgres"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+/**
+ * The monitor tests need a PostgreSQL server; they're skipped if this isn't set.
+ */
+var dsn = os.Getenv("PCT_TEST_POSTGRES_DSN")
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+/////////////////////////////////////////////////////////////////////////////
+// Monitor
+/////////////////////////////////////////////////////////////////////////////
+
+type TestSuite struct {
+	logChan        chan *proto.LogEntry
+	logger         *pct.Logger
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	name           string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	if dsn == "" {
+		t.Skip("PCT_TEST_POSTGRES_DSN is not set")
+	}
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-postgres-test")
+	s.tickChan = make(chan time.Time)
+	s.collectionChan = make(chan *mm.Collection, 1)
+	s.name = "mm-postgres-1"
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestCollect(t *C) {
+	config := &postgres.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "postgres",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+		DSN:         dsn,
+		Replication: true,
+	}
+	m := postgres.NewMonitor(s.name, config, s.logger)
+	err := m.Start(s.tickChan, s.collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	if !test.WaitStatus(5, m, s.name+"-postgres", "Connected") {
+		t.Fatal("Monitor did not connect: ", m.Status())
+	}
+	if !test.WaitStatus(1, m, s.name, "Ready") {
+		t.Fatal("Monitor not ready: ", m.Status())
+	}
+
+	s.tickChan <- time.Now()
+
+	var c *mm.Collection
+	select {
+	case c = <-s.collectionChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("No collection: ", m.Status())
+	}
+
+	metrics := make(map[string]mm.Metric)
+	for _, metric := range c.Metrics {
+		metrics[metric.Name] = metric
+	}
+	t.Check(metrics["postgres/bgwriter/buffers_alloc"].Type, Equals, "counter")
+	t.Check(metrics["postgres/db/postgres/xact_commit"].Type, Equals, "counter")
+	t.Check(metrics["postgres/db/postgres/numbackends"].Type, Equals, "gauge")
+	t.Check(metrics["postgres/connections/total"].Number >= 1, Equals, true)
+	t.Check(metrics["postgres/connections/max"].Number > 0, Equals, true)
+	_, ok := metrics["postgres/db/template0/xact_commit"]
+	t.Check(ok, Equals, false)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Helpers
+/////////////////////////////////////////////////////////////////////////////
+
+type HelperTestSuite struct {
+}
+
+var _ = Suite(&HelperTestSuite{})
+
+// --------------------------------------------------------------------------
+
+func (s *HelperTestSuite) TestConnectionState(t *C) {
+	t.Check(postgres.ConnectionState("active"), Equals, "active")
+	t.Check(postgres.ConnectionState("idle in transaction"), Equals, "idle_in_transaction")
+	t.Check(postgres.ConnectionState("idle in transaction (aborted)"), Equals, "idle_in_transaction_aborted")
+	t.Check(postgres.ConnectionState("fastpath function call"), Equals, "fastpath_function_call")
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+/**
+ * If Config.Replication is true, replication lag is collected on every tick.
+ * On a primary, that's how many bytes of WAL each standby in
+ * pg_stat_replication has yet to replay: postgres/repl/<standby>/lag_bytes,
+ * where <standby> is its application_name, else its client IP address,
+ * escaped with mm.EscapeName.
+ * On a standby, it's the seconds since the last replayed transaction was
+ * committed on the primary: postgres/repl/lag.  That grows if the primary
+ * is idle, so it's an upper bound.
+ *
+ * The WAL functions were renamed in PostgreSQL 10, hence two queries.
+ */
+
+const (
+	replLagBytes9 = "SELECT COALESCE(NULLIF(application_name, ''), host(client_addr), 'unknown')," +
+		" pg_xlog_location_diff(pg_current_xlog_location(), replay_location)" +
+		" FROM pg_stat_replication"
+	replLagBytes10 = "SELECT COALESCE(NULLIF(application_name, ''), host(client_addr), 'unknown')," +
+		" pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn)" +
+		" FROM pg_stat_replication"
+	replLagSeconds = "SELECT COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)"
+)
+
+func (m *Monitor) getReplLag(c *mm.Collection) error {
+	m.logger.Debug("getReplLag:call")
+	defer m.logger.Debug("getReplLag:return")
+
+	m.status.Update(m.name, "Getting replication lag")
+
+	var standby bool
+	if err := m.db.QueryRow("SELECT pg_is_in_recovery()").Scan(&standby); err != nil {
+		return err
+	}
+
+	if standby {
+		var lag float64
+		if err := m.db.QueryRow(replLagSeconds).Scan(&lag); err != nil {
+			return err
+		}
+		c.Metrics = append(c.Metrics, mm.Metric{Name: "postgres/repl/lag", Type: "gauge", Number: lag})
+		return nil
+	}
+
+	query := replLagBytes9
+	if m.version >= 100000 {
+		query = replLagBytes10
+	}
+	rows, err := m.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var lag sql.NullFloat64 // NULL until the standby has replayed something
+		if err := rows.Scan(&name, &lag); err != nil {
+			return err
+		}
+		if !lag.Valid {
+			continue
+		}
+		c.Metrics = append(c.Metrics, mm.Metric{Name: "postgres/repl/" + mm.EscapeName(name) + "/lag_bytes", Type: "gauge", Number: lag.Float64})
+	}
+	return rows.Err()
+}
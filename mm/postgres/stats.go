@@ -0,0 +1,182 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package postgres
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// pg_stat_database columns collected per database, except templates.
+var databaseStats = []struct {
+	column string
+	mtype  string
+}{
+	{"numbackends", "gauge"},
+	{"xact_commit", "counter"},
+	{"xact_rollback", "counter"},
+	{"blks_read", "counter"},
+	{"blks_hit", "counter"},
+	{"tup_returned", "counter"},
+	{"tup_fetched", "counter"},
+	{"tup_inserted", "counter"},
+	{"tup_updated", "counter"},
+	{"tup_deleted", "counter"},
+	{"conflicts", "counter"},
+	{"temp_files", "counter"},
+	{"temp_bytes", "counter"},
+	{"deadlocks", "counter"},
+}
+
+// pg_stat_bgwriter columns collected; all are counters.
+var bgwriterStats = []string{
+	"checkpoints_timed",
+	"checkpoints_req",
+	"buffers_checkpoint",
+	"buffers_clean",
+	"maxwritten_clean",
+	"buffers_backend",
+	"buffers_backend_fsync",
+	"buffers_alloc",
+}
+
+func (m *Monitor) getDatabaseStats(c *mm.Collection) error {
+	m.logger.Debug("getDatabaseStats:call")
+	defer m.logger.Debug("getDatabaseStats:return")
+
+	m.status.Update(m.name, "Getting database stats")
+
+	columns := make([]string, len(databaseStats))
+	for i, stat := range databaseStats {
+		columns[i] = stat.column
+	}
+	rows, err := m.db.Query("SELECT datname, " + strings.Join(columns, ", ") +
+		" FROM pg_stat_database WHERE datname IS NOT NULL AND datname NOT LIKE 'template%'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]sql.NullFloat64, len(databaseStats))
+	dest := make([]interface{}, len(databaseStats)+1)
+	var datname string
+	dest[0] = &datname
+	for i := range values {
+		dest[i+1] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if len(m.config.Databases) > 0 && !m.databases.Match(datname) {
+			continue
+		}
+		for i, stat := range databaseStats {
+			if !values[i].Valid {
+				continue
+			}
+			c.Metrics = append(c.Metrics, mm.Metric{
+				Name:   "postgres/db/" + mm.EscapeName(datname) + "/" + stat.column,
+				Type:   stat.mtype,
+				Number: values[i].Float64,
+			})
+		}
+	}
+	return rows.Err()
+}
+
+func (m *Monitor) getBgwriterStats(c *mm.Collection) error {
+	m.logger.Debug("getBgwriterStats:call")
+	defer m.logger.Debug("getBgwriterStats:return")
+
+	m.status.Update(m.name, "Getting bgwriter stats")
+
+	values := make([]sql.NullFloat64, len(bgwriterStats))
+	dest := make([]interface{}, len(bgwriterStats))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err := m.db.QueryRow("SELECT " + strings.Join(bgwriterStats, ", ") + " FROM pg_stat_bgwriter").Scan(dest...)
+	if err != nil {
+		return err
+	}
+	for i, column := range bgwriterStats {
+		if !values[i].Valid {
+			continue
+		}
+		c.Metrics = append(c.Metrics, mm.Metric{
+			Name:   "postgres/bgwriter/" + column,
+			Type:   "counter",
+			Number: values[i].Float64,
+		})
+	}
+	return nil
+}
+
+// getConnections collects the number of connections in each state, e.g.
+// postgres/connections/idle_in_transaction, the total, and max_connections.
+func (m *Monitor) getConnections(c *mm.Collection) error {
+	m.logger.Debug("getConnections:call")
+	defer m.logger.Debug("getConnections:return")
+
+	m.status.Update(m.name, "Getting connections")
+
+	var maxConns float64
+	if err := m.db.QueryRow("SELECT setting::float FROM pg_settings WHERE name = 'max_connections'").Scan(&maxConns); err != nil {
+		return err
+	}
+
+	rows, err := m.db.Query("SELECT COALESCE(state, 'unknown'), count(*) FROM pg_stat_activity GROUP BY 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var total float64
+	for rows.Next() {
+		var state string
+		var n float64
+		if err := rows.Scan(&state, &n); err != nil {
+			return err
+		}
+		total += n
+		c.Metrics = append(c.Metrics, mm.Metric{
+			Name:   "postgres/connections/" + ConnectionState(state),
+			Type:   "gauge",
+			Number: n,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.Metrics = append(c.Metrics,
+		mm.Metric{Name: "postgres/connections/total", Type: "gauge", Number: total},
+		mm.Metric{Name: "postgres/connections/max", Type: "gauge", Number: maxConns},
+	)
+	return nil
+}
+
+// ConnectionState returns the metric name for a pg_stat_activity state,
+// e.g. "idle in transaction (aborted)" is idle_in_transaction_aborted.
+func ConnectionState(state string) string {
+	state = strings.NewReplacer("(", "", ")", "").Replace(state)
+	return strings.Join(strings.Fields(state), "_")
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * Host rollups are metrics computed across every MySQL instance in a report
+ * and reported under the server (OS) instance, so hosts running several
+ * MySQL instances have capacity views without cross-instance math on the
+ * server side.  They're enabled by Config.Rollup on the server monitor.
+ * Only MySQL instances reporting at the same interval (Config.Report) are
+ * in the same report, so they should all use the same interval.
+ *
+ *   host/mysql/instances          MySQL instances in the report
+ *   host/mysql/queries            total QPS (mysql/queries)
+ *   host/mysql/threads_connected  total connections
+ *   host/mysql/buffer_pool_bytes  total InnoDB buffer pool size
+ *   host/mysql/buffer_pool_pct    buffer_pool_bytes as percent of memory/MemTotal
+ *
+ * Stats are summed per stat, e.g. Max is the sum of every instance's Max, so
+ * only Avg is the exact stat of the total; the others are bounds.  Buffer
+ * pool size and RAM don't change, so their Avg is used.
+ */
+
+const ROLLUP_PREFIX = "host/mysql/"
+
+var rollupSums = map[string]string{
+	"mysql/queries":           ROLLUP_PREFIX + "queries",
+	"mysql/threads_connected": ROLLUP_PREFIX + "threads_connected",
+}
+
+// rollup adds the host rollup metrics to the server instance stats, adding
+// the server instance if it's not in the stats, and returns the stats.  If
+// there are no MySQL instances, nothing is added.
+func rollup(server proto.ServiceInstance, stats []*InstanceStats) []*InstanceStats {
+	var host *InstanceStats
+	metrics := map[string]*Stats{}
+	nMySQL := 0
+	bufferPoolBytes := 0.0
+	for _, is := range stats {
+		if is.Service == server.Service && is.InstanceId == server.InstanceId {
+			host = is
+			continue
+		}
+		if is.Service != "mysql" {
+			continue
+		}
+		nMySQL++
+		for metric, name := range rollupSums {
+			s, ok := is.Stats[metric]
+			if !ok {
+				continue
+			}
+			sum, ok := metrics[name]
+			if !ok {
+				sum = &Stats{}
+				metrics[name] = sum
+			}
+			sum.Cnt += s.Cnt
+			sum.Min += s.Min
+			sum.Pct5 += s.Pct5
+			sum.Avg += s.Avg
+			sum.Med += s.Med
+			sum.Pct95 += s.Pct95
+			sum.Max += s.Max
+		}
+		pages, ok1 := is.Stats["mysql/innodb_buffer_pool_pages_total"]
+		pageSize, ok2 := is.Stats["mysql/innodb_page_size"]
+		if ok1 && ok2 {
+			bufferPoolBytes += pages.Avg * pageSize.Avg
+		}
+	}
+	if nMySQL == 0 {
+		return stats
+	}
+
+	metrics[ROLLUP_PREFIX+"instances"] = constStats(float64(nMySQL))
+	if bufferPoolBytes > 0 {
+		metrics[ROLLUP_PREFIX+"buffer_pool_bytes"] = constStats(bufferPoolBytes)
+	}
+
+	if host == nil {
+		host = &InstanceStats{
+			ServiceInstance: server,
+			Stats:           map[string]*Stats{},
+		}
+		stats = append(stats, host)
+	}
+	if memTotal, ok := host.Stats["memory/MemTotal"]; ok && memTotal.Avg > 0 && bufferPoolBytes > 0 {
+		// MemTotal is kB.
+		metrics[ROLLUP_PREFIX+"buffer_pool_pct"] = constStats(100 * bufferPoolBytes / (memTotal.Avg * 1024))
+	}
+	for name, s := range metrics {
+		host.Stats[name] = s
+	}
+	return stats
+}
+
+func constStats(val float64) *Stats {
+	return &Stats{Cnt: 1, Min: val, Pct5: val, Avg: val, Med: val, Pct95: val, Max: val}
+}
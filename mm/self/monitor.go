@@ -0,0 +1,235 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package self
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * The self monitor reports the agent's own runtime stats on every tick, so a
+ * stuck or leaking agent can be diagnosed without attaching pprof:
+ *
+ *   agent/uptime              seconds since the agent started
+ *   agent/goroutines          runtime.NumGoroutine()
+ *   agent/heap/alloc          bytes allocated and not yet freed
+ *   agent/heap/sys            bytes obtained from the OS for the heap
+ *   agent/heap/objects        allocated objects
+ *   agent/gc/count            garbage collections (counter)
+ *   agent/gc/pause_total      seconds paused by garbage collections (counter)
+ *   agent/gc/last_pause       seconds paused by the last garbage collection
+ *   agent/queue/<name>        items waiting in a queue
+ *
+ * Queues are chans and buffers between the agent's goroutines: when one
+ * keeps growing, whatever drains it is stuck.  The monitor always reports
+ * mm_collections, the collections queued for its aggregator, which every mm
+ * monitor with the same report interval shares: the mm.CollectionBuffer ring
+ * and chans, see SetCollectionQueue.  Others, like the data spool and the
+ * log relay buffer, are given by the agent through the factory, see
+ * monitor.Factory.AddQueue.
+ */
+
+// started is about when the agent started: package vars are initialized
+// before main() runs.
+var started = time.Now()
+
+// A Queue returns the number of items waiting in a queue.  It's called from
+// the monitor's goroutine, so it must be safe to call concurrently.
+type Queue func() int
+
+type Monitor struct {
+	name   string
+	config *Config
+	logger *pct.Logger
+	queues map[string]Queue
+	// --
+	tickChan       chan time.Time
+	collectionChan chan *mm.Collection
+	status         *pct.Status
+	sync           *pct.SyncChan
+	running        bool
+}
+
+func NewMonitor(name string, config *Config, logger *pct.Logger, queues map[string]Queue) *Monitor {
+	m := &Monitor{
+		name:   name,
+		config: config,
+		logger: logger,
+		queues: make(map[string]Queue),
+		// --
+		status: pct.NewStatus([]string{name}),
+		sync:   pct.NewSyncChan(),
+	}
+	for name, queue := range queues {
+		m.queues[name] = queue
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// SetCollectionQueue sets the queue reported as mm_collections, else it's the
+// collectionChan.  Call it before Start.  See mm.CollectionQueueMonitor.
+func (m *Monitor) SetCollectionQueue(queue func() int) {
+	m.queues["mm_collections"] = queue
+}
+
+func (m *Monitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.logger.Debug("Start:call")
+	defer m.logger.Debug("Start:return")
+
+	if m.running {
+		return pct.ServiceIsRunningError{Service: m.name}
+	}
+
+	m.tickChan = tickChan
+	m.collectionChan = collectionChan
+	if _, ok := m.queues["mm_collections"]; !ok {
+		m.queues["mm_collections"] = func() int { return len(collectionChan) }
+	}
+
+	go m.run()
+	m.running = true
+	m.logger.Info("Started")
+
+	return nil
+}
+
+func (m *Monitor) Stop() error {
+	m.logger.Debug("Stop:call")
+	defer m.logger.Debug("Stop:return")
+
+	if !m.running {
+		return nil // already stopped
+	}
+
+	// Stop run().  When it returns, it updates status to "Stopped".
+	m.status.Update(m.name, "Stopping")
+	m.sync.Stop()
+	m.sync.Wait()
+
+	m.running = false
+	m.logger.Info("Stopped")
+
+	// Do not update status to "Stopped" here; run() does that on return.
+	return nil
+}
+
+func (m *Monitor) Status() map[string]string {
+	return m.status.All()
+}
+
+func (m *Monitor) TickChan() chan time.Time {
+	return m.tickChan
+}
+
+func (m *Monitor) Config() interface{} {
+	return m.config
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Implementation
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *Monitor) run() {
+	m.logger.Debug("run:call")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("Self monitor crashed: ", err)
+		}
+		m.status.Update(m.name, "Stopped")
+		m.sync.Done()
+		m.logger.Debug("run:return")
+	}()
+
+	var lastTs int64
+	for {
+		m.logger.Debug("run:idle")
+		m.status.Update(m.name, fmt.Sprintf("Idle (last collected at %s)", pct.TimeString(time.Unix(lastTs, 0))))
+		select {
+		case now := <-m.tickChan:
+			m.logger.Debug("run:collect:start")
+			m.status.Update(m.name, "Running")
+
+			c := m.Collect(now)
+
+			// Send the metrics to the aggregator.
+			select {
+			case m.collectionChan <- c:
+				lastTs = c.Ts
+			case <-time.After(500 * time.Millisecond):
+				// lost collection
+				m.logger.Debug("Lost agent metrics; timeout spooling after 500ms")
+			}
+
+			m.logger.Debug("run:collect:stop")
+		case <-m.sync.StopChan:
+			m.logger.Debug("run:stop")
+			return
+		}
+	}
+}
+
+// Collect returns the agent's runtime stats and queue depths at now.
+func (m *Monitor) Collect(now time.Time) *mm.Collection {
+	c := &mm.Collection{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:      now.UTC().Unix(),
+		Metrics: []mm.Metric{},
+	}
+
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+	var lastPause uint64
+	if ms.NumGC > 0 {
+		lastPause = ms.PauseNs[(ms.NumGC+255)%256]
+	}
+	c.Metrics = append(c.Metrics,
+		mm.Metric{Name: "agent/uptime", Type: "gauge", Number: now.Sub(started).Seconds()},
+		mm.Metric{Name: "agent/goroutines", Type: "gauge", Number: float64(runtime.NumGoroutine())},
+		mm.Metric{Name: "agent/heap/alloc", Type: "gauge", Number: float64(ms.HeapAlloc)},
+		mm.Metric{Name: "agent/heap/sys", Type: "gauge", Number: float64(ms.HeapSys)},
+		mm.Metric{Name: "agent/heap/objects", Type: "gauge", Number: float64(ms.HeapObjects)},
+		mm.Metric{Name: "agent/gc/count", Type: "counter", Number: float64(ms.NumGC)},
+		mm.Metric{Name: "agent/gc/pause_total", Type: "counter", Number: float64(ms.PauseTotalNs) / 1e9},
+		mm.Metric{Name: "agent/gc/last_pause", Type: "gauge", Number: float64(lastPause) / 1e9},
+	)
+
+	names := make([]string, 0, len(m.queues))
+	for name := range m.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.Metrics = append(c.Metrics, mm.Metric{Name: "agent/queue/" + name, Type: "gauge", Number: float64(m.queues[name]())})
+	}
+
+	return c
+}
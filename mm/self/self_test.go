@@ -0,0 +1,157 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package self_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mm/self"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mm-self-test")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *TestSuite) TestCollect(t *C) {
+	config := &self.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "agent"},
+			Collect:         1,
+			Report:          60,
+		},
+	}
+	queues := map[string]self.Queue{
+		"spool": func() int { return 3 },
+		"log":   func() int { return 0 },
+	}
+	m := self.NewMonitor("mm-agent", config, s.logger, queues)
+
+	now := time.Now()
+	c := m.Collect(now)
+	t.Check(c.Service, Equals, "agent")
+	t.Check(c.Ts, Equals, now.UTC().Unix())
+
+	got := map[string]mm.Metric{}
+	names := []string{}
+	for _, metric := range c.Metrics {
+		got[metric.Name] = metric
+		names = append(names, metric.Name)
+	}
+	t.Check(names, DeepEquals, []string{
+		"agent/uptime",
+		"agent/goroutines",
+		"agent/heap/alloc",
+		"agent/heap/sys",
+		"agent/heap/objects",
+		"agent/gc/count",
+		"agent/gc/pause_total",
+		"agent/gc/last_pause",
+		"agent/queue/log",
+		"agent/queue/spool",
+	})
+	t.Check(got["agent/uptime"].Number > 0, Equals, true)
+	t.Check(got["agent/goroutines"].Number >= 1, Equals, true)
+	t.Check(got["agent/heap/alloc"].Number > 0, Equals, true)
+	t.Check(got["agent/gc/count"].Type, Equals, "counter")
+	t.Check(got["agent/queue/spool"].Number, Equals, float64(3))
+	t.Check(got["agent/queue/log"].Number, Equals, float64(0))
+}
+
+func (s *TestSuite) TestStartStop(t *C) {
+	config := &self.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "agent"},
+			Collect:         1,
+			Report:          60,
+		},
+	}
+	m := self.NewMonitor("mm-agent", config, s.logger, nil)
+
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 2)
+	err := m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// The collectionChan is a queue, too.
+	collectionChan <- &mm.Collection{}
+	tickChan <- time.Now()
+	for i := 0; i < 100 && len(collectionChan) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Assert(len(collectionChan), Equals, 2)
+	<-collectionChan // the one sent above
+	c := <-collectionChan
+	last := c.Metrics[len(c.Metrics)-1]
+	t.Check(last.Name, Equals, "agent/queue/mm_collections")
+	t.Check(last.Number, Equals, float64(1))
+
+	err = m.Stop()
+	t.Check(err, IsNil)
+	t.Check(m.Status()["mm-agent"], Equals, "Stopped")
+}
+
+func (s *TestSuite) TestCollectionQueue(t *C) {
+	config := &self.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{Service: "agent"},
+			Collect:         1,
+			Report:          60,
+		},
+	}
+	m := self.NewMonitor("mm-agent", config, s.logger, nil)
+
+	// The mm manager sets the collection queue to its buffer, see
+	// mm.CollectionQueueMonitor, so it's reported instead of collectionChan.
+	var _ mm.CollectionQueueMonitor = m
+	m.SetCollectionQueue(func() int { return 7 })
+
+	tickChan := make(chan time.Time)
+	collectionChan := make(chan *mm.Collection, 1)
+	err := m.Start(tickChan, collectionChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	tickChan <- time.Now()
+	var c *mm.Collection
+	select {
+	case c = <-collectionChan:
+	case <-time.After(time.Second):
+		t.Fatal("No collection")
+	}
+	last := c.Metrics[len(c.Metrics)-1]
+	t.Check(last.Name, Equals, "agent/queue/mm_collections")
+	t.Check(last.Number, Equals, float64(7))
+}
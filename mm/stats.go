@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -49,6 +50,8 @@ type Stats struct {
 	penuVal    float64   `json:"-"` // 2nd to last (penultimate) value
 	vals       []float64 `json:"-"`
 	sum        float64   `json:"-"`
+	pcts       []float64 `json:"-"` // Config.Percentiles
+	anomaly    *anomalyWindow
 	Cnt        int
 	Min        float64
 	Pct5       float64
@@ -56,6 +59,9 @@ type Stats struct {
 	Med        float64
 	Pct95      float64
 	Max        float64
+	Pct        map[string]float64 `json:",omitempty"` // gauges only, keyed on percentile, e.g. "99"
+	Resets     int                `json:",omitempty"` // counter decreased, e.g. MySQL restarted
+	Anomalies  int                `json:",omitempty"` // values far from the trailing window, see anomaly.go
 }
 
 func NewStats(metricType string) (*Stats, error) {
@@ -70,9 +76,64 @@ func NewStats(metricType string) (*Stats, error) {
 	return s, nil
 }
 
+// SetPercentiles sets the extra percentiles, e.g. 99 and 99.9, to report for
+// a gauge.  Every value in an interval is kept (see Add), so they're exact.
+func (s *Stats) SetPercentiles(pcts []float64) {
+	if s.metricType != "gauge" {
+		return
+	}
+	s.pcts = pcts
+}
+
+// SetAnomaly enables counting values more than sigma standard deviations
+// from the previous window values, see anomaly.go.
+func (s *Stats) SetAnomaly(sigma float64, window int) {
+	if sigma <= 0 {
+		s.anomaly = nil
+		return
+	}
+	s.anomaly = newAnomalyWindow(sigma, window)
+}
+
 func (s *Stats) Reset() {
 	s.sum = 0
 	s.vals = []float64{}
+	s.Resets = 0
+	s.Anomalies = 0
+}
+
+// Restart makes the next value of a counter its first, so no rate is computed
+// across a gap in collection, e.g. a blackout (see blackout.go).
+func (s *Stats) Restart() {
+	s.firstVal = true
+}
+
+// Baseline returns a counter's last value, or false if the stats aren't for a
+// counter or have no value yet.
+func (s *Stats) Baseline() (CounterBaseline, bool) {
+	if s.metricType != "counter" || s.firstVal {
+		return CounterBaseline{}, false
+	}
+	return CounterBaseline{Ts: s.prevTs, Value: s.prevVal}, true
+}
+
+// SetBaseline makes a counter's next value its second, so a rate is computed
+// from the baseline, e.g. the previous agent's last value (see handoff.go).
+func (s *Stats) SetBaseline(b CounterBaseline) {
+	if s.metricType != "counter" {
+		return
+	}
+	s.prevTs = b.Ts
+	s.prevVal = b.Value
+	s.penuTs = 0
+	s.penuVal = 0
+	s.firstVal = false
+}
+
+func (s *Stats) checkAnomaly(val float64) {
+	if s.anomaly != nil && s.anomaly.check(val) {
+		s.Anomalies++
+	}
 }
 
 func (s *Stats) Add(m *Metric, ts int64) error {
@@ -81,6 +142,7 @@ func (s *Stats) Add(m *Metric, ts int64) error {
 	case "gauge":
 		s.vals = append(s.vals, m.Number)
 		s.sum += m.Number
+		s.checkAnomaly(m.Number)
 	case "counter":
 		if !s.firstVal {
 			if m.Number >= s.prevVal {
@@ -108,6 +170,7 @@ func (s *Stats) Add(m *Metric, ts int64) error {
 
 				// Keep running total to calc Avg.
 				s.sum += val
+				s.checkAnomaly(val)
 
 				// Current values become previous values.
 				s.penuTs = s.prevTs
@@ -115,7 +178,11 @@ func (s *Stats) Add(m *Metric, ts int64) error {
 				s.penuVal = s.prevVal
 				s.prevVal = m.Number
 			} else {
-				// Metric value reset, e.g. FLUSH GLOBAL STATUS.
+				// Metric value reset, e.g. FLUSH GLOBAL STATUS, MySQL restart,
+				// or a 32-bit counter wrapped.  There's no rate for this
+				// collection because the delta is negative or bogus, so the
+				// reset is only counted to flag it in the report.
+				s.Resets++
 				s.penuTs = s.prevTs
 				s.prevTs = ts
 				s.penuVal = s.prevVal
@@ -135,19 +202,25 @@ func (s *Stats) Add(m *Metric, ts int64) error {
 	return err
 }
 
+// Finalize returns the stats of the interval, or nil if there are none: no
+// values and no resets.  A counter reset has no value, so an interval whose
+// only sample was the reset has stats with Cnt=0 and Resets=1.
 func (s *Stats) Finalize() *Stats {
-	if len(s.vals) == 0 {
+	if len(s.vals) == 0 && s.Resets == 0 {
 		return nil
 	}
 	s.Summarize()
 	return &Stats{
-		Cnt:   s.Cnt,
-		Min:   s.Min,
-		Pct5:  s.Pct5,
-		Avg:   s.Avg,
-		Med:   s.Med,
-		Pct95: s.Pct95,
-		Max:   s.Max,
+		Cnt:       s.Cnt,
+		Min:       s.Min,
+		Pct5:      s.Pct5,
+		Avg:       s.Avg,
+		Med:       s.Med,
+		Pct95:     s.Pct95,
+		Max:       s.Max,
+		Pct:       s.Pct,
+		Resets:    s.Resets,
+		Anomalies: s.Anomalies,
 	}
 }
 
@@ -171,5 +244,16 @@ func (s *Stats) Summarize() {
 			s.Pct95 = s.vals[0]
 			s.Max = s.vals[0]
 		}
+		if len(s.pcts) > 0 && s.Cnt > 0 {
+			// vals are sorted above if Cnt > 1.
+			s.Pct = make(map[string]float64, len(s.pcts))
+			for _, p := range s.pcts {
+				i := int(p * float64(s.Cnt) / 100)
+				if i >= s.Cnt {
+					i = s.Cnt - 1
+				}
+				s.Pct[strconv.FormatFloat(p, 'f', -1, 64)] = s.vals[i]
+			}
+		}
 	}
 }
@@ -0,0 +1,281 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * A StatsD emitter sends every collected metric, before aggregation, to a
+ * local StatsD or DogStatsD server (Config.StatsD), e.g. a Datadog agent on
+ * the same host.  Metrics are sent as gauges of their raw values because
+ * counters are cumulative (StatsD counters are increments).  Names are
+ * STATSD_PREFIX.<instance id>.<metric>, e.g. percona.1.mysql.status.Threads_running.
+ *
+ * If Config.StatsDTags is set (even empty), the server is DogStatsD: names
+ * don't have the instance id, it's tagged instead (instance:1) along with
+ * the tags of the longest metric name prefix in StatsDTags, e.g.
+ * "mysql/innodb/" => "subsystem:innodb,team:db".
+ *
+ * Sending is best-effort: datagrams are lost if the server isn't listening,
+ * and a slow unix socket isn't waited on longer than STATSD_WRITE_TIMEOUT
+ * so it can't stall the aggregator.  The server is dialed when metrics are
+ * first sent, not when the monitor starts, so a DogStatsD socket that doesn't
+ * exist yet doesn't fail StartService; if dialing fails, it's retried every
+ * STATSD_RETRY.  A write error closes the conn and it's dialed again on the
+ * next send, e.g. a restarted DogStatsD recreates its socket so the old one
+ * never works again.
+ */
+
+const (
+	STATSD_PREFIX        = "percona"
+	STATSD_UDP_PACKET    = 1432 // max bytes, fits in a 1500 MTU
+	STATSD_UNIX_PACKET   = 8192 // max bytes, DogStatsD default buffer
+	STATSD_WRITE_TIMEOUT = 100 * time.Millisecond
+	STATSD_RETRY         = 10 * time.Second // between dials
+)
+
+type StatsD struct {
+	logger    *pct.Logger
+	network   string // udp or unixgram
+	addr      string
+	rate      float64
+	tags      []statsdTags // longest prefix first
+	dogstatsd bool
+	maxPacket int
+	// --
+	mux     *sync.Mutex // guards conn, dialed, and closed
+	conn    net.Conn    // nil until dialed
+	dialed  time.Time   // last dial
+	closed  bool
+	failing bool
+}
+
+type statsdTags struct {
+	prefix string
+	tags   string
+}
+
+type byPrefixLen []statsdTags
+
+func (a byPrefixLen) Len() int           { return len(a) }
+func (a byPrefixLen) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPrefixLen) Less(i, j int) bool { return len(a[i].prefix) > len(a[j].prefix) }
+
+// NewStatsD returns a StatsD emitter for addr, host:port (UDP) or
+// unix:<socket path> (datagram), or an error if the config is invalid.
+// A sample rate of 0 is the same as 1: send every metric.  It doesn't dial
+// addr, Send does.
+func NewStatsD(logger *pct.Logger, addr string, rate float64, tags map[string]string) (*StatsD, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("Invalid StatsDSampleRate: %g: must be >= 0 and <= 1", rate)
+	}
+	if rate == 0 {
+		rate = 1
+	}
+
+	s := &StatsD{
+		logger:    logger,
+		rate:      rate,
+		dogstatsd: tags != nil,
+		mux:       &sync.Mutex{},
+	}
+	for prefix, t := range tags {
+		if prefix == "" {
+			return nil, errors.New("Invalid StatsDTags: empty metric name prefix")
+		}
+		parts := strings.Split(t, ",")
+		for i, part := range parts {
+			parts[i] = statsdSanitize(strings.TrimSpace(part), true)
+		}
+		s.tags = append(s.tags, statsdTags{prefix, strings.Join(parts, ",")})
+	}
+	sort.Sort(byPrefixLen(s.tags))
+
+	if strings.HasPrefix(addr, "unix:") {
+		s.network, s.addr = "unixgram", strings.TrimPrefix(addr, "unix:")
+		s.maxPacket = STATSD_UNIX_PACKET
+		if s.addr == "" {
+			return nil, fmt.Errorf("Invalid StatsD: %s: no socket path", addr)
+		}
+	} else {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("Invalid StatsD: %s: expected host:port or unix:<socket>", addr)
+		}
+		s.network, s.addr = "udp", addr
+		s.maxPacket = STATSD_UDP_PACKET
+	}
+	return s, nil
+}
+
+// Send sends the instance's metrics, batching as many as fit in a packet.
+// @goroutine[1]
+func (s *StatsD) Send(si proto.ServiceInstance, metrics []Metric) {
+	conn := s.connect()
+	if conn == nil {
+		return
+	}
+
+	prefix := STATSD_PREFIX + "."
+	if !s.dogstatsd {
+		prefix += strconv.FormatUint(uint64(si.InstanceId), 10) + "."
+	}
+	instanceTag := "instance:" + strconv.FormatUint(uint64(si.InstanceId), 10)
+
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		if metric.Type != "gauge" && metric.Type != "counter" {
+			continue
+		}
+		if s.rate < 1 && rand.Float64() >= s.rate {
+			continue
+		}
+		line := prefix + statsdSanitize(strings.Replace(metric.Name, "/", ".", -1), false) +
+			":" + strconv.FormatFloat(metric.Number, 'f', -1, 64) + "|g"
+		if s.rate < 1 {
+			line += "|@" + strconv.FormatFloat(s.rate, 'f', -1, 64)
+		}
+		if s.dogstatsd {
+			line += "|#" + instanceTag
+			if tags := s.tagsFor(metric.Name); tags != "" {
+				line += "," + tags
+			}
+		}
+		if buf.Len() > 0 && buf.Len()+1+len(line) > s.maxPacket {
+			s.write(conn, buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		s.write(conn, buf.Bytes())
+	}
+}
+
+func (s *StatsD) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// connect returns the conn, dialing if not connected and STATSD_RETRY has
+// passed since the last dial, else nil.  Only dialing is done with the lock:
+// the conn is safe to use concurrently, and writing to it after Close fails.
+func (s *StatsD) connect() net.Conn {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return nil
+	}
+	if s.conn != nil {
+		return s.conn
+	}
+	if time.Now().Sub(s.dialed) < STATSD_RETRY {
+		return nil
+	}
+	s.dialed = time.Now()
+	conn, err := net.Dial(s.network, s.addr)
+	if err != nil {
+		if !s.failing {
+			s.logger.Warn("StatsD:", err)
+			s.failing = true
+		}
+		return nil
+	}
+	s.conn = conn
+	return conn
+}
+
+func (s *StatsD) tagsFor(name string) string {
+	for _, t := range s.tags {
+		if strings.HasPrefix(name, t.prefix) {
+			return t.tags
+		}
+	}
+	return ""
+}
+
+func (s *StatsD) write(conn net.Conn, packet []byte) {
+	conn.SetWriteDeadline(time.Now().Add(STATSD_WRITE_TIMEOUT))
+	_, err := conn.Write(packet)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return // error is from Close
+	}
+	if err != nil {
+		// Warn once until sending works again, else every collection
+		// would log the same error while the server is down.
+		if !s.failing {
+			s.logger.Warn("StatsD:", err)
+			s.failing = true
+		}
+		// Redial on the next send, not after STATSD_RETRY: the conn
+		// worked, so the server is probably back or restarting.
+		if s.conn == conn {
+			s.conn.Close()
+			s.conn = nil
+			s.dialed = time.Time{}
+		}
+		return
+	}
+	if s.failing {
+		s.logger.Info("StatsD: sending again")
+		s.failing = false
+	}
+}
+
+// statsdSanitize replaces characters that delimit StatsD name, value, rate,
+// and tag fields.  Tags are key:value, so a tag can have a colon.
+func statsdSanitize(s string, tag bool) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':':
+			if tag {
+				return r
+			}
+			return '_'
+		case '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
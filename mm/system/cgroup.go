@@ -0,0 +1,240 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * Host-level metrics hide which container is using the CPU, memory and
+ * disk, so if Config.Cgroups has patterns, e.g. "/docker/*", every cgroup
+ * whose path matches is collected from Config.CgroupRoot:
+ *
+ *   cgroup/<name>/cpu_usage         counter, CPU seconds
+ *   cgroup/<name>/memory_usage      gauge, bytes
+ *   cgroup/<name>/blkio_read_bytes  counter
+ *   cgroup/<name>/blkio_write_bytes counter
+ *   cgroup/<name>/blkio_reads       counter
+ *   cgroup/<name>/blkio_writes      counter
+ *
+ * <name> is the cgroup path with / replaced by ., and 64-char container
+ * IDs shortened to 12 chars like docker ps, e.g. /docker/4f3a...2a is
+ * cgroup/docker.4f3a2b1c9d8e, and with systemd
+ * /system.slice/docker-4f3a...2a.scope is
+ * cgroup/system.slice.docker-4f3a2b1c9d8e.scope.  Both cgroup v1 (a hierarchy per controller:
+ * cpuacct, memory, blkio) and v2 (one unified hierarchy) are supported.
+ */
+
+const (
+	DEFAULT_CGROUP_ROOT = "/sys/fs/cgroup"
+)
+
+var containerId = regexp.MustCompile(`[0-9a-f]{64}`)
+
+type cgroupFs struct {
+	root    string
+	v2      bool
+	matcher *pct.GlobMatcher
+}
+
+func newCgroupFs(root string, patterns []string) *cgroupFs {
+	if root == "" {
+		root = DEFAULT_CGROUP_ROOT
+	}
+	c := &cgroupFs{
+		root:    root,
+		matcher: pct.NewGlobMatcher(patterns),
+	}
+	// v2 has cgroup.controllers in the root of the unified hierarchy.
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		c.v2 = true
+	}
+	return c
+}
+
+// CgroupName returns the metric name prefix for a cgroup path.
+func CgroupName(path string) string {
+	name := strings.Replace(strings.Trim(path, "/"), "/", ".", -1)
+	name = containerId.ReplaceAllStringFunc(name, func(id string) string { return id[0:12] })
+	return "cgroup/" + name
+}
+
+func (m *Monitor) CgroupMetrics() ([]mm.Metric, error) {
+	m.logger.Debug("CgroupMetrics:call")
+	defer m.logger.Debug("CgroupMetrics:return")
+
+	m.status.Update(m.name, "Getting cgroup metrics")
+
+	paths, err := m.cgroups.paths()
+	if err != nil {
+		return nil, err
+	}
+	metrics := []mm.Metric{}
+	for _, path := range paths {
+		metrics = append(metrics, m.cgroups.metrics(path)...)
+	}
+	return metrics, nil
+}
+
+// paths returns the paths, relative to the hierarchy root, of the cgroups
+// that match the patterns.  In v1, cgroups are found in the cpuacct
+// hierarchy; every container has one.
+func (c *cgroupFs) paths() ([]string, error) {
+	dir := c.root
+	if !c.v2 {
+		dir = filepath.Join(c.root, "cpuacct")
+	}
+	// cpuacct is usually a symlink to cpu,cpuacct, and Walk doesn't follow
+	// a symlinked root.
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // cgroup removed while walking
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		path := "/" + strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+		if c.matcher.Match(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+func (c *cgroupFs) metrics(path string) []mm.Metric {
+	prefix := CgroupName(path) + "/"
+	metrics := []mm.Metric{}
+	if c.v2 {
+		dir := filepath.Join(c.root, path)
+		if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+			if usec, ok := stat["usage_usec"]; ok {
+				metrics = append(metrics, mm.Metric{Name: prefix + "cpu_usage", Type: "counter", Number: usec / 1e6})
+			}
+		}
+		if val, err := readNumber(filepath.Join(dir, "memory.current")); err == nil {
+			metrics = append(metrics, mm.Metric{Name: prefix + "memory_usage", Type: "gauge", Number: val})
+		}
+		if io, err := readIoStat(filepath.Join(dir, "io.stat")); err == nil {
+			metrics = append(metrics, blkioMetrics(prefix, io["rbytes"], io["wbytes"], io["rios"], io["wios"])...)
+		}
+		return metrics
+	}
+
+	if nsec, err := readNumber(filepath.Join(c.root, "cpuacct", path, "cpuacct.usage")); err == nil {
+		metrics = append(metrics, mm.Metric{Name: prefix + "cpu_usage", Type: "counter", Number: nsec / 1e9})
+	}
+	if val, err := readNumber(filepath.Join(c.root, "memory", path, "memory.usage_in_bytes")); err == nil {
+		metrics = append(metrics, mm.Metric{Name: prefix + "memory_usage", Type: "gauge", Number: val})
+	}
+	blkio := filepath.Join(c.root, "blkio", path)
+	bytes, err1 := readBlkio(filepath.Join(blkio, "blkio.throttle.io_service_bytes"))
+	ios, err2 := readBlkio(filepath.Join(blkio, "blkio.throttle.io_serviced"))
+	if err1 == nil && err2 == nil {
+		metrics = append(metrics, blkioMetrics(prefix, bytes["Read"], bytes["Write"], ios["Read"], ios["Write"])...)
+	}
+	return metrics
+}
+
+func blkioMetrics(prefix string, readBytes, writeBytes, reads, writes float64) []mm.Metric {
+	return []mm.Metric{
+		{Name: prefix + "blkio_read_bytes", Type: "counter", Number: readBytes},
+		{Name: prefix + "blkio_write_bytes", Type: "counter", Number: writeBytes},
+		{Name: prefix + "blkio_reads", Type: "counter", Number: reads},
+		{Name: prefix + "blkio_writes", Type: "counter", Number: writes},
+	}
+}
+
+func readNumber(file string) (float64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+}
+
+// readKeyValues reads "key value" lines, e.g. cpu.stat.
+func readKeyValues(file string) (map[string]float64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		values[fields[0]] = StrToFloat(fields[1])
+	}
+	return values, nil
+}
+
+// readBlkio sums the per-device "8:0 Read 1234" lines of a v1 blkio file
+// by operation.
+func readBlkio(file string) (map[string]float64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue // "Total 1234" for all devices
+		}
+		values[fields[1]] += StrToFloat(fields[2])
+	}
+	return values, nil
+}
+
+// readIoStat sums the per-device "8:0 rbytes=1234 wbytes=5678 ..." lines of
+// a v2 io.stat file by key.
+func readIoStat(file string) (map[string]float64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			if i := strings.IndexByte(kv, '='); i > 0 {
+				values[kv[0:i]] += StrToFloat(kv[i+1:])
+			}
+		}
+	}
+	return values, nil
+}
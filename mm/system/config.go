@@ -22,4 +22,13 @@ import (
 
 type Config struct {
 	mm.Config
+	Filesystems      bool     // collect space and inodes of mounted filesystems (fs.go)
+	FsInclude        []string // mount point globs, e.g. /var/lib/*; default all on /dev/
+	FsExclude        []string // mount point globs, e.g. /boot*
+	Cgroups          []string // cgroup paths (globs) to collect, e.g. /docker/* (cgroup.go)
+	CgroupRoot       string   // default /sys/fs/cgroup
+	DiskInclude      []string // device globs, e.g. sd*; default all (diskstats.go)
+	DiskExclude      []string // device globs, e.g. dm-*
+	Numa             bool     // collect NUMA node and mysqld memory stats (numa.go)
+	NumaMapsInterval uint     // seconds, default 60
 }
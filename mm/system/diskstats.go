@@ -0,0 +1,116 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"time"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * /proc/diskstats has only counters, which show throughput but not
+ * saturation, so like iostat -x, these gauges are computed from the
+ * difference between the current and previous values of each device:
+ *
+ *   read_iops, write_iops    r/s, w/s
+ *   read_await, write_await  r_await, w_await: ms per read, write
+ *   await                    ms per I/O, including time in the queue
+ *   svctm                    ms per I/O of device time
+ *   util                     %util: percent of time the device was busy
+ *   queue_size               avgqu-sz: average number of I/O in flight
+ *
+ * Config.DiskInclude and Config.DiskExclude are device name globs, e.g.
+ * "sd*" or "dm-*", to limit which devices are collected.
+ */
+
+// diskSample is one device's line of /proc/diskstats, fields 3-13.
+type diskSample [14]float64
+
+// globFilter is a pair of include and exclude globs, for devices here and
+// mount points in fs.go.
+type globFilter struct {
+	include *pct.GlobMatcher // nil if all
+	exclude *pct.GlobMatcher
+}
+
+func newGlobFilter(include, exclude []string) globFilter {
+	f := globFilter{exclude: pct.NewGlobMatcher(exclude)}
+	if len(include) > 0 {
+		f.include = pct.NewGlobMatcher(include)
+	}
+	return f
+}
+
+// Match returns true if the name should be collected.
+func (f globFilter) Match(name string) bool {
+	if f.include != nil && !f.include.Match(name) {
+		return false
+	}
+	return !f.exclude.Match(name)
+}
+
+func (m *Monitor) diskGauges(device string, cur diskSample, now time.Time) []mm.Metric {
+	prev, ok := m.prevDisk[device]
+	if !ok || m.prevDiskTs.IsZero() {
+		return nil
+	}
+	ms := now.Sub(m.prevDiskTs).Seconds() * 1000
+	if ms <= 0 {
+		return nil
+	}
+	d := diskSample{}
+	for i := 3; i <= 13; i++ {
+		d[i] = cur[i] - prev[i]
+		if d[i] < 0 {
+			return nil // counter wrapped or device was reset
+		}
+	}
+	reads, readTime := d[3], d[6]
+	writes, writeTime := d[7], d[10]
+	ios := reads + writes
+
+	var readAwait, writeAwait, await, svctm float64
+	if reads > 0 {
+		readAwait = readTime / reads
+	}
+	if writes > 0 {
+		writeAwait = writeTime / writes
+	}
+	if ios > 0 {
+		await = (readTime + writeTime) / ios
+		svctm = d[12] / ios
+	}
+	util := d[12] * 100 / ms
+	if util > 100 {
+		util = 100 // io_time can run ahead of the clock
+	}
+
+	prefix := "disk/" + device + "/"
+	return []mm.Metric{
+		{Name: prefix + "read_iops", Type: "gauge", Number: reads * 1000 / ms},
+		{Name: prefix + "write_iops", Type: "gauge", Number: writes * 1000 / ms},
+		{Name: prefix + "read_await", Type: "gauge", Number: readAwait},
+		{Name: prefix + "write_await", Type: "gauge", Number: writeAwait},
+		{Name: prefix + "await", Type: "gauge", Number: await},
+		{Name: prefix + "svctm", Type: "gauge", Number: svctm},
+		{Name: prefix + "util", Type: "gauge", Number: util},
+		{Name: prefix + "queue_size", Type: "gauge", Number: d[13] / ms},
+	}
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * If Config.Filesystems is true, the space and inodes of every mounted
+ * filesystem on a block device (/dev/...) are collected:
+ *
+ *   fs/<mount>/size         total bytes
+ *   fs/<mount>/used         bytes used, like df
+ *   fs/<mount>/free         bytes available to non-root users
+ *   fs/<mount>/inodes       total inodes, if the filesystem has a fixed number
+ *   fs/<mount>/inodes_used
+ *   fs/<mount>/inodes_free
+ *
+ * where <mount> is the mount point with / replaced by ., e.g.
+ * fs/var.lib.mysql/free, and / is fs/root.  Config.FsInclude and
+ * Config.FsExclude are mount point globs.  If FsInclude is set, only matching
+ * mount points are collected, on any device, so e.g. an NFS or tmpfs mount
+ * can be included explicitly; else tmpfs, overlay, proc, etc. are skipped.
+ * If mm.Config.ForecastHours is also set, an event is sent if a filesystem
+ * will be full that soon.
+ */
+
+// FsName returns the metric name prefix for a mount point.
+func FsName(mount string) string {
+	name := strings.Replace(strings.Trim(mount, "/"), "/", ".", -1)
+	if name == "" {
+		name = "root"
+	}
+	return "fs/" + name
+}
+
+// Mounts returns the mount points in /proc/mounts to collect, in order,
+// without duplicates (e.g. bind mounts of the same mount point).
+func (m *Monitor) Mounts(content []byte) []string {
+	mounts := []string{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		// /dev/sda1 / ext4 rw,relatime,data=ordered 0 0
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		mount := unescapeMount(fields[1])
+		if seen[mount] || !m.mounts.Match(mount) {
+			continue
+		}
+		if m.mounts.include == nil && !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		seen[mount] = true
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
+
+func (m *Monitor) ProcMounts(content []byte) ([]mm.Metric, error) {
+	m.logger.Debug("ProcMounts:call")
+	defer m.logger.Debug("ProcMounts:return")
+
+	m.status.Update(m.name, "Getting filesystem metrics")
+
+	metrics := []mm.Metric{}
+	for _, mount := range m.Mounts(content) {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(mount, &stat); err != nil {
+			m.logger.Debug("ProcMounts:statfs:", mount, err)
+			continue
+		}
+		// Statfs_t field types differ by OS, e.g. Ffree is int64 on
+		// FreeBSD, so convert each field before doing arithmetic.
+		bsize := uint64(stat.Bsize)
+		prefix := FsName(mount)
+		metrics = append(metrics,
+			mm.Metric{Name: prefix + "/size", Type: "gauge", Number: float64(uint64(stat.Blocks) * bsize)},
+			mm.Metric{Name: prefix + "/used", Type: "gauge", Number: float64((uint64(stat.Blocks) - uint64(stat.Bfree)) * bsize)},
+			mm.Metric{Name: prefix + "/free", Type: "gauge", Number: float64(uint64(stat.Bavail) * bsize)},
+		)
+		// Some filesystems, e.g. btrfs, allocate inodes dynamically and
+		// report zero.
+		if stat.Files > 0 {
+			metrics = append(metrics,
+				mm.Metric{Name: prefix + "/inodes", Type: "gauge", Number: float64(stat.Files)},
+				mm.Metric{Name: prefix + "/inodes_used", Type: "gauge", Number: float64(uint64(stat.Files) - uint64(stat.Ffree))},
+				mm.Metric{Name: prefix + "/inodes_free", Type: "gauge", Number: float64(stat.Ffree)},
+			)
+		}
+	}
+	return metrics, nil
+}
+
+// unescapeMount unescapes the octal escapes in /proc/mounts, e.g. \040 for space.
+func unescapeMount(mount string) string {
+	if !strings.Contains(mount, `\`) {
+		return mount
+	}
+	s := make([]byte, 0, len(mount))
+	for i := 0; i < len(mount); i++ {
+		if mount[i] == '\\' && i+3 < len(mount) {
+			if c, err := strconv.ParseUint(mount[i+1:i+4], 8, 8); err == nil {
+				s = append(s, byte(c))
+				i += 3
+				continue
+			}
+		}
+		s = append(s, mount[i])
+	}
+	return string(s)
+}
+
+// ForecastFilesystems samples the free space of each filesystem in metrics
+// and adds an event to c for those that will be full within ForecastHours.
+func (m *Monitor) ForecastFilesystems(c *mm.Collection, metrics []mm.Metric) {
+	for _, metric := range metrics {
+		if !strings.HasSuffix(metric.Name, "/free") {
+			continue
+		}
+		prefix := strings.TrimSuffix(metric.Name, "/free")
+		f, ok := m.fsForecast[prefix]
+		if !ok {
+			f = mm.NewForecaster()
+			m.fsForecast[prefix] = f
+		}
+		if !f.Due(c.Ts) {
+			continue
+		}
+		f.Add(c.Ts, metric.Number)
+		if eta, ok := f.Check(0, m.config.ForecastHours); ok {
+			c.Events = append(c.Events, mm.Event{
+				Ts:    c.Ts,
+				Type:  prefix + "/forecast",
+				Level: mm.EVENT_WARNING,
+				Message: fmt.Sprintf("Filesystem %s will be full in ~%.1f hours (%s free)",
+					strings.TrimPrefix(prefix, "fs/"), eta/3600, pct.Bytes(uint64(metric.Number))),
+			})
+		}
+	}
+}
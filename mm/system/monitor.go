@@ -41,8 +41,15 @@ type Monitor struct {
 	tickChan       chan time.Time
 	collectionChan chan *mm.Collection
 	// --
-	prevCPUval map[string][]float64 // [cpu0] => [user, nice, ...]
-	prevCPUsum map[string]float64   // [cpu0] => user + nice + ...
+	prevCPUval map[string][]float64      // [cpu0] => [user, nice, ...]
+	prevCPUsum map[string]float64        // [cpu0] => user + nice + ...
+	fsForecast map[string]*mm.Forecaster // [fs/root] => free space trend
+	cgroups    *cgroupFs
+	prevDisk   map[string]diskSample // [sda] => /proc/diskstats fields
+	prevDiskTs time.Time
+	disks      globFilter
+	mounts     globFilter
+	numaMapsTs int64
 	sync       *pct.SyncChan
 	status     *pct.Status
 	running    bool
@@ -56,6 +63,11 @@ func NewMonitor(name string, config *Config, logger *pct.Logger) *Monitor {
 		// --
 		prevCPUval: make(map[string][]float64),
 		prevCPUsum: make(map[string]float64),
+		fsForecast: make(map[string]*mm.Forecaster),
+		cgroups:    newCgroupFs(config.CgroupRoot, config.Cgroups),
+		prevDisk:   make(map[string]diskSample),
+		disks:      newGlobFilter(config.DiskInclude, config.DiskExclude),
+		mounts:     newGlobFilter(config.FsInclude, config.FsExclude),
 		status:     pct.NewStatus([]string{name}),
 		sync:       pct.NewSyncChan(),
 	}
@@ -201,15 +213,59 @@ func (m *Monitor) run() {
 
 			content, err = ioutil.ReadFile("/proc/diskstats")
 			if err == nil {
-				if metrics, err := m.ProcDiskstats(content); err != nil {
+				if metrics, err := m.ProcDiskstats(content, now); err != nil {
 					m.logger.Warn("system:run:ProcDiskstats:", err)
 				} else {
 					c.Metrics = append(c.Metrics, metrics...)
 				}
 			}
 
+			content, err = ioutil.ReadFile("/proc/net/dev")
+			if err == nil {
+				if metrics, err := m.ProcNetDev(content); err != nil {
+					m.logger.Warn("system:run:ProcNetDev:", err)
+				} else {
+					c.Metrics = append(c.Metrics, metrics...)
+				}
+			}
+
+			content, err = ioutil.ReadFile("/proc/net/snmp")
+			if err == nil {
+				if metrics, err := m.ProcNetSnmp(content); err != nil {
+					m.logger.Warn("system:run:ProcNetSnmp:", err)
+				} else {
+					c.Metrics = append(c.Metrics, metrics...)
+				}
+			}
+
+			if m.config.Numa {
+				c.Metrics = append(c.Metrics, m.collectNuma(c.Ts)...)
+			}
+
+			if m.config.Filesystems {
+				content, err = ioutil.ReadFile("/proc/mounts")
+				if err == nil {
+					if metrics, err := m.ProcMounts(content); err != nil {
+						m.logger.Warn("system:run:ProcMounts:", err)
+					} else {
+						c.Metrics = append(c.Metrics, metrics...)
+						if m.config.ForecastHours > 0 {
+							m.ForecastFilesystems(c, metrics)
+						}
+					}
+				}
+			}
+
+			if len(m.config.Cgroups) > 0 {
+				if metrics, err := m.CgroupMetrics(); err != nil {
+					m.logger.Warn("system:run:CgroupMetrics:", err)
+				} else {
+					c.Metrics = append(c.Metrics, metrics...)
+				}
+			}
+
 			// Send the metrics to the aggregator.
-			if len(c.Metrics) > 0 {
+			if len(c.Metrics) > 0 || len(c.Events) > 0 {
 				select {
 				case m.collectionChan <- c:
 					lastTs = c.Ts
@@ -461,7 +517,7 @@ func (m *Monitor) ProcLoadavg(content []byte) ([]mm.Metric, error) {
 	return metrics, nil
 }
 
-func (m *Monitor) ProcDiskstats(content []byte) ([]mm.Metric, error) {
+func (m *Monitor) ProcDiskstats(content []byte, now time.Time) ([]mm.Metric, error) {
 	m.logger.Debug("ProcDiskstats:call")
 	defer m.logger.Debug("ProcDiskstats:return")
 
@@ -485,6 +541,7 @@ func (m *Monitor) ProcDiskstats(content []byte) ([]mm.Metric, error) {
 	 *    3-13: 11 stats: https://www.kernel.org/doc/Documentation/iostats.txt
 	 */
 	metrics := []mm.Metric{}
+	currDisk := make(map[string]diskSample)
 	lines := strings.Split(string(content), "\n")
 	for _, line := range lines {
 		fields := strings.Fields(line)
@@ -497,9 +554,12 @@ func (m *Monitor) ProcDiskstats(content []byte) ([]mm.Metric, error) {
 		if strings.HasPrefix(device, "ram") || strings.HasPrefix(device, "loop") {
 			continue
 		}
+		if !m.disks.Match(device) {
+			continue
+		}
 
 		// 11 stats
-		val := [14]float64{}
+		val := diskSample{}
 		for k := 3; k <= 13 && k < len(fields); k++ {
 			val[k] = StrToFloat(fields[k])
 		}
@@ -516,6 +576,8 @@ func (m *Monitor) ProcDiskstats(content []byte) ([]mm.Metric, error) {
 			metrics = append(metrics, mm.Metric{Name: "disk/" + device + "/io_time", Type: "counter", Number: val[12]})
 			metrics = append(metrics, mm.Metric{Name: "disk/" + device + "/io_time_weighted", Type: "counter", Number: val[13]})
 			metrics = append(metrics, mm.Metric{Name: "disk/" + device + "/iops", Type: "counter", Number: val[3] + val[7]})
+			metrics = append(metrics, m.diskGauges(device, val, now)...)
+			currDisk[device] = val
 		} else {
 			// Early 2.6 kernels had only 4 fields for partitions.
 			metrics = append(metrics, mm.Metric{Name: "disk/" + device + "/reads", Type: "counter", Number: val[3]})
@@ -525,5 +587,7 @@ func (m *Monitor) ProcDiskstats(content []byte) ([]mm.Metric, error) {
 			metrics = append(metrics, mm.Metric{Name: "disk/" + device + "/iops", Type: "counter", Number: val[3] + val[5]})
 		}
 	}
+	m.prevDisk = currDisk
+	m.prevDiskTs = now
 	return metrics, nil
 }
@@ -0,0 +1,150 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+)
+
+// Columns of /proc/net/dev to collect, by index after the interface name.
+var netDevStats = map[int]string{
+	0:  "rx_bytes",
+	1:  "rx_packets",
+	2:  "rx_errors",
+	3:  "rx_drops",
+	8:  "tx_bytes",
+	9:  "tx_packets",
+	10: "tx_errors",
+	11: "tx_drops",
+}
+
+// Columns of /proc/net/snmp to collect.  CurrEstab is the only gauge.
+var netSnmpStats = map[string]map[string]string{
+	"Tcp": {
+		"ActiveOpens":  "active_opens",
+		"PassiveOpens": "passive_opens",
+		"AttemptFails": "attempt_fails",
+		"EstabResets":  "estab_resets",
+		"CurrEstab":    "curr_estab",
+		"InSegs":       "in_segs",
+		"OutSegs":      "out_segs",
+		"RetransSegs":  "retrans_segs",
+		"InErrs":       "in_errs",
+		"OutRsts":      "out_rsts",
+	},
+	"Udp": {
+		"InDatagrams":  "in_datagrams",
+		"OutDatagrams": "out_datagrams",
+		"NoPorts":      "no_ports",
+		"InErrors":     "in_errors",
+		"RcvbufErrors": "rcvbuf_errors",
+		"SndbufErrors": "sndbuf_errors",
+	},
+}
+
+func (m *Monitor) ProcNetDev(content []byte) ([]mm.Metric, error) {
+	m.logger.Debug("ProcNetDev:call")
+	defer m.logger.Debug("ProcNetDev:return")
+
+	m.status.Update(m.name, "Getting /proc/net/dev metrics")
+
+	/**
+	 * Inter-|   Receive                                                |  Transmit
+	 *  face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+	 *     lo: 56504164    6001    0    0    0     0          0         0 56504164    6001    0    0    0     0       0          0
+	 *   eth0:1902838716 2340152   12  305    0     0          0      1093 871613905 1785493    3    7    0     0       0          0
+	 *
+	 * There may be no space after the colon, as for eth0.
+	 */
+	metrics := []mm.Metric{}
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue // header
+		}
+		iface := strings.TrimSpace(line[0:colon])
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) < 16 {
+			continue
+		}
+		for i := 0; i < 16; i++ {
+			name, ok := netDevStats[i]
+			if !ok {
+				continue
+			}
+			metrics = append(metrics, mm.Metric{
+				Name:   "net/" + iface + "/" + name,
+				Type:   "counter",
+				Number: StrToFloat(fields[i]),
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (m *Monitor) ProcNetSnmp(content []byte) ([]mm.Metric, error) {
+	m.logger.Debug("ProcNetSnmp:call")
+	defer m.logger.Debug("ProcNetSnmp:return")
+
+	m.status.Update(m.name, "Getting /proc/net/snmp metrics")
+
+	/**
+	 * Each protocol has a line of column names then a line of values:
+	 *
+	 * Tcp: RtoAlgorithm RtoMin RtoMax MaxConn ActiveOpens PassiveOpens ...
+	 * Tcp: 1 200 120000 -1 4321 8765 ...
+	 */
+	metrics := []mm.Metric{}
+	var header []string
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		proto := strings.TrimSuffix(fields[0], ":")
+		stats, ok := netSnmpStats[proto]
+		if !ok {
+			continue
+		}
+		if header == nil || header[0] != fields[0] {
+			header = fields
+			continue
+		}
+		for i := 1; i < len(fields) && i < len(header); i++ {
+			name, ok := stats[header[i]]
+			if !ok {
+				continue
+			}
+			metricType := "counter"
+			if header[i] == "CurrEstab" {
+				metricType = "gauge"
+			}
+			metrics = append(metrics, mm.Metric{
+				Name:   "net/" + strings.ToLower(proto) + "/" + name,
+				Type:   metricType,
+				Number: StrToFloat(fields[i]),
+			})
+		}
+		header = nil
+	}
+	return metrics, nil
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/percona/percona-agent/mm"
+	"github.com/percona/percona-agent/mysql"
+)
+
+/**
+ * If Config.Numa is true, NUMA allocation counters are collected for each
+ * node (os/numa/node0/numa_miss, etc.) every tick, and where each mysqld's
+ * memory is (os/numa/mysqld/node0_bytes, etc.) every Config.NumaMapsInterval
+ * seconds because reading /proc/<pid>/numa_maps walks the process's page
+ * tables.  A mysqld that's not [mysqld] in the option files, like mysqld2 for
+ * mysqld_multi, is os/numa/mysqld2/.  Memory mostly on one node with
+ * numa_miss and swapping rising is the "swap insanity" problem; interleave
+ * (numactl --interleave=all) shows as interleave_bytes.
+ */
+
+const (
+	DEFAULT_NUMA_MAPS_INTERVAL = 60 // seconds
+	NUMA_NODE_DIR              = "/sys/devices/system/node"
+)
+
+func (m *Monitor) collectNuma(ts int64) []mm.Metric {
+	metrics := []mm.Metric{}
+
+	nodes, _ := filepath.Glob(filepath.Join(NUMA_NODE_DIR, "node[0-9]*"))
+	for _, dir := range nodes {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "numastat"))
+		if err != nil {
+			continue
+		}
+		if nodeMetrics, err := m.NodeNumastat(filepath.Base(dir), content); err != nil {
+			m.logger.Warn("system:run:NodeNumastat:", err)
+		} else {
+			metrics = append(metrics, nodeMetrics...)
+		}
+	}
+
+	interval := int64(m.config.NumaMapsInterval)
+	if interval == 0 {
+		interval = DEFAULT_NUMA_MAPS_INTERVAL
+	}
+	if m.numaMapsTs > 0 && ts-m.numaMapsTs < interval {
+		return metrics
+	}
+	m.numaMapsTs = ts
+
+	all, err := mysql.DiscoverMysqld("/proc", mysql.DefaultOptionFiles)
+	if err != nil {
+		m.logger.Warn("system:run:DiscoverMysqld:", err)
+		return metrics
+	}
+	for _, mysqld := range all {
+		content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/numa_maps", mysqld.Pid))
+		if err != nil {
+			continue // exited, or kernel without NUMA
+		}
+		if mapsMetrics, err := m.ProcNumaMaps("os/numa/"+mysqld.Group+"/", content); err != nil {
+			m.logger.Warn("system:run:ProcNumaMaps:", err)
+		} else {
+			metrics = append(metrics, mapsMetrics...)
+		}
+	}
+	return metrics
+}
+
+func (m *Monitor) NodeNumastat(node string, content []byte) ([]mm.Metric, error) {
+	m.logger.Debug("NodeNumastat:call")
+	defer m.logger.Debug("NodeNumastat:return")
+
+	m.status.Update(m.name, "Getting "+node+" numastat metrics")
+
+	/**
+	 * numa_hit 2701389
+	 * numa_miss 1204
+	 * numa_foreign 88
+	 * interleave_hit 997
+	 * local_node 2700001
+	 * other_node 2592
+	 */
+	metrics := []mm.Metric{}
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		metrics = append(metrics, mm.Metric{
+			Name:   "os/numa/" + node + "/" + fields[0],
+			Type:   "counter",
+			Number: StrToFloat(fields[1]),
+		})
+	}
+	return metrics, nil
+}
+
+func (m *Monitor) ProcNumaMaps(prefix string, content []byte) ([]mm.Metric, error) {
+	m.logger.Debug("ProcNumaMaps:call")
+	defer m.logger.Debug("ProcNumaMaps:return")
+
+	m.status.Update(m.name, "Getting numa_maps metrics")
+
+	/**
+	 * One line per mapping: address, policy, then key=value; Nx=pages is
+	 * the number of pages on node x, each kernelpagesize_kB.
+	 *
+	 * 7f1a2c000000 interleave:0-1 anon=262144 dirty=262144 N0=131072 N1=131072 kernelpagesize_kB=4
+	 */
+	nodeBytes := make(map[string]float64)
+	var interleaveBytes float64
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		pageSize := 4096.0
+		pages := make(map[string]float64)
+		for _, kv := range fields[2:] {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 {
+				continue
+			}
+			key, val := kv[0:i], kv[i+1:]
+			switch {
+			case key == "kernelpagesize_kB":
+				pageSize = StrToFloat(val) * 1024
+			case len(key) > 1 && key[0] == 'N':
+				if _, err := strconv.Atoi(key[1:]); err == nil {
+					pages["node"+key[1:]] += StrToFloat(val)
+				}
+			}
+		}
+		for node, n := range pages {
+			nodeBytes[node] += n * pageSize
+			if strings.HasPrefix(fields[1], "interleave") {
+				interleaveBytes += n * pageSize
+			}
+		}
+	}
+
+	nodes := make([]string, 0, len(nodeBytes))
+	for node := range nodeBytes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	metrics := []mm.Metric{}
+	for _, node := range nodes {
+		metrics = append(metrics, mm.Metric{Name: prefix + node + "_bytes", Type: "gauge", Number: nodeBytes[node]})
+	}
+	metrics = append(metrics, mm.Metric{Name: prefix + "interleave_bytes", Type: "gauge", Number: interleaveBytes})
+	return metrics, nil
+}
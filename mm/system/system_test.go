@@ -312,6 +312,267 @@ func (s *ProcLoadavgTestSuite) TestProcLoadavg001(t *C) {
 	}
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// ProcNetDev and ProcNetSnmp
+/////////////////////////////////////////////////////////////////////////////
+
+type ProcNetTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&ProcNetTestSuite{})
+
+func (s *ProcNetTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "system-monitor-test")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ProcNetTestSuite) TestProcNetDev001(t *C) {
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+	content, err := ioutil.ReadFile(sample + "/proc/netdev001.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.ProcNetDev(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []mm.Metric{
+		{Name: "net/lo/rx_bytes", Type: "counter", Number: 56504164},
+		{Name: "net/lo/rx_packets", Type: "counter", Number: 6001},
+		{Name: "net/lo/rx_errors", Type: "counter", Number: 0},
+		{Name: "net/lo/rx_drops", Type: "counter", Number: 0},
+		{Name: "net/lo/tx_bytes", Type: "counter", Number: 56504164},
+		{Name: "net/lo/tx_packets", Type: "counter", Number: 6001},
+		{Name: "net/lo/tx_errors", Type: "counter", Number: 0},
+		{Name: "net/lo/tx_drops", Type: "counter", Number: 0},
+		// --
+		{Name: "net/eth0/rx_bytes", Type: "counter", Number: 1902838716},
+		{Name: "net/eth0/rx_packets", Type: "counter", Number: 2340152},
+		{Name: "net/eth0/rx_errors", Type: "counter", Number: 12},
+		{Name: "net/eth0/rx_drops", Type: "counter", Number: 305},
+		{Name: "net/eth0/tx_bytes", Type: "counter", Number: 871613905},
+		{Name: "net/eth0/tx_packets", Type: "counter", Number: 1785493},
+		{Name: "net/eth0/tx_errors", Type: "counter", Number: 3},
+		{Name: "net/eth0/tx_drops", Type: "counter", Number: 7},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+func (s *ProcNetTestSuite) TestProcNetSnmp001(t *C) {
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+	content, err := ioutil.ReadFile(sample + "/proc/snmp001.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.ProcNetSnmp(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remember: the order of this array must match order in which each
+	// stat appears in the input file:
+	expect := []mm.Metric{
+		{Name: "net/tcp/active_opens", Type: "counter", Number: 4321},
+		{Name: "net/tcp/passive_opens", Type: "counter", Number: 8765},
+		{Name: "net/tcp/attempt_fails", Type: "counter", Number: 12},
+		{Name: "net/tcp/estab_resets", Type: "counter", Number: 34},
+		{Name: "net/tcp/curr_estab", Type: "gauge", Number: 56},
+		{Name: "net/tcp/in_segs", Type: "counter", Number: 2301245},
+		{Name: "net/tcp/out_segs", Type: "counter", Number: 1780034},
+		{Name: "net/tcp/retrans_segs", Type: "counter", Number: 1523},
+		{Name: "net/tcp/in_errs", Type: "counter", Number: 2},
+		{Name: "net/tcp/out_rsts", Type: "counter", Number: 410},
+		// --
+		{Name: "net/udp/in_datagrams", Type: "counter", Number: 45012},
+		{Name: "net/udp/no_ports", Type: "counter", Number: 11},
+		{Name: "net/udp/in_errors", Type: "counter", Number: 3},
+		{Name: "net/udp/out_datagrams", Type: "counter", Number: 44990},
+		{Name: "net/udp/rcvbuf_errors", Type: "counter", Number: 1},
+		{Name: "net/udp/sndbuf_errors", Type: "counter", Number: 0},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// NUMA
+/////////////////////////////////////////////////////////////////////////////
+
+type NumaTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&NumaTestSuite{})
+
+func (s *NumaTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "system-monitor-test")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *NumaTestSuite) TestNodeNumastat(t *C) {
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+	content, err := ioutil.ReadFile(sample + "/numa/node/node1/numastat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.NodeNumastat("node1", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []mm.Metric{
+		{Name: "os/numa/node1/numa_hit", Type: "counter", Number: 1802274},
+		{Name: "os/numa/node1/numa_miss", Type: "counter", Number: 88},
+		{Name: "os/numa/node1/numa_foreign", Type: "counter", Number: 1204},
+		{Name: "os/numa/node1/interleave_hit", Type: "counter", Number: 995},
+		{Name: "os/numa/node1/local_node", Type: "counter", Number: 1800000},
+		{Name: "os/numa/node1/other_node", Type: "counter", Number: 2362},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+func (s *NumaTestSuite) TestProcNumaMaps(t *C) {
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+	content, err := ioutil.ReadFile(sample + "/numa/numa_maps001.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.ProcNumaMaps("os/numa/mysqld/", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4k pages except 512 2M huge pages on node1.
+	expect := []mm.Metric{
+		{Name: "os/numa/mysqld/node0_bytes", Type: "gauge", Number: (2841 + 131072 + 40960 + 9) * 4096},
+		{Name: "os/numa/mysqld/node1_bytes", Type: "gauge", Number: (131072+10240)*4096 + 512*2097152},
+		{Name: "os/numa/mysqld/interleave_bytes", Type: "gauge", Number: 262144 * 4096},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Filesystems
+/////////////////////////////////////////////////////////////////////////////
+
+type FsTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&FsTestSuite{})
+
+func (s *FsTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "system-monitor-test")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *FsTestSuite) TestFsName(t *C) {
+	t.Check(system.FsName("/"), Equals, "fs/root")
+	t.Check(system.FsName("/var/lib/mysql"), Equals, "fs/var.lib.mysql")
+	t.Check(system.FsName("/data/"), Equals, "fs/data")
+}
+
+func (s *FsTestSuite) TestMounts(t *C) {
+	content, err := ioutil.ReadFile(sample + "/proc/mounts001.txt")
+	t.Assert(err, IsNil)
+
+	// Default: only block devices, no duplicates.
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+	t.Check(m.Mounts(content), DeepEquals, []string{"/", "/boot", "/var/lib/mysql", "/mnt/mysql binlogs"})
+
+	m = system.NewMonitor("", &system.Config{FsExclude: []string{"/boot*", "/mnt/*"}}, s.logger)
+	t.Check(m.Mounts(content), DeepEquals, []string{"/", "/var/lib/mysql"})
+
+	// Included mount points can be on any device.
+	config := &system.Config{
+		FsInclude: []string{"/run", "/var/lib/*"},
+		FsExclude: []string{"/var/lib/docker/*"},
+	}
+	m = system.NewMonitor("", config, s.logger)
+	t.Check(m.Mounts(content), DeepEquals, []string{"/run", "/var/lib/mysql"})
+}
+
+func (s *FsTestSuite) TestProcMounts(t *C) {
+	// / always exists, so statfs works wherever the test runs.
+	m := system.NewMonitor("", &system.Config{}, s.logger)
+	got, err := m.ProcMounts([]byte("/dev/root / ext4 rw,relatime 0 0\n"))
+	t.Assert(err, IsNil)
+	t.Assert(len(got) >= 3, Equals, true)
+
+	metrics := make(map[string]float64)
+	for _, metric := range got {
+		t.Check(metric.Type, Equals, "gauge")
+		metrics[metric.Name] = metric.Number
+	}
+	t.Check(metrics["fs/root/size"] > 0, Equals, true)
+	t.Check(metrics["fs/root/used"]+metrics["fs/root/free"] <= metrics["fs/root/size"], Equals, true)
+	if inodes, ok := metrics["fs/root/inodes"]; ok {
+		t.Check(metrics["fs/root/inodes_used"]+metrics["fs/root/inodes_free"], Equals, inodes)
+	}
+}
+
+func (s *FsTestSuite) TestForecastFilesystems(t *C) {
+	config := &system.Config{
+		Config: mm.Config{ForecastHours: 2},
+	}
+	m := system.NewMonitor("", config, s.logger)
+
+	// / loses 100 bytes a minute, /data doesn't change.
+	ts := int64(1420070400)
+	free := 10000.0
+	var c *mm.Collection
+	for i := 0; i < mm.FORECAST_MIN_SAMPLES; i++ {
+		c = &mm.Collection{Ts: ts}
+		m.ForecastFilesystems(c, []mm.Metric{
+			{Name: "fs/root/size", Type: "gauge", Number: 20000},
+			{Name: "fs/root/free", Type: "gauge", Number: free},
+			{Name: "fs/data/free", Type: "gauge", Number: 5000},
+		})
+		if i < mm.FORECAST_MIN_SAMPLES-1 {
+			t.Check(c.Events, HasLen, 0)
+		}
+
+		// Not sampled between FORECAST_SAMPLE_INTERVAL, so free space
+		// going up for a moment doesn't change the forecast.
+		m.ForecastFilesystems(&mm.Collection{Ts: ts + 1}, []mm.Metric{
+			{Name: "fs/root/free", Type: "gauge", Number: 20000},
+		})
+
+		ts += mm.FORECAST_SAMPLE_INTERVAL
+		free -= 100
+	}
+
+	// 9100 bytes left, so full in 91 minutes.
+	t.Assert(c.Events, HasLen, 1)
+	t.Check(c.Events[0].Ts, Equals, c.Ts)
+	t.Check(c.Events[0].Type, Equals, "fs/root/forecast")
+	t.Check(c.Events[0].Level, Equals, mm.EVENT_WARNING)
+	t.Check(c.Events[0].Message, Matches, "Filesystem root will be full in ~1.5 hours .*")
+
+	// The event is sent only once per FORECAST_EVENT_INTERVAL.
+	c = &mm.Collection{Ts: ts}
+	m.ForecastFilesystems(c, []mm.Metric{{Name: "fs/root/free", Type: "gauge", Number: free}})
+	t.Check(c.Events, HasLen, 0)
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // ProcDiskstats
 /////////////////////////////////////////////////////////////////////////////
@@ -336,7 +597,7 @@ func (s *ProcDiskstatsTestSuite) TestProcDiskstats001(t *C) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err := m.ProcDiskstats(content)
+	got, err := m.ProcDiskstats(content, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -445,6 +706,43 @@ func (s *ProcDiskstatsTestSuite) TestProcDiskstats001(t *C) {
 	}
 }
 
+func (s *ProcDiskstatsTestSuite) TestProcDiskstats002(t *C) {
+	config := &system.Config{
+		DiskInclude: []string{"sd*"},
+		DiskExclude: []string{"sda?"},
+	}
+	m := system.NewMonitor("", config, s.logger)
+	content1, err := ioutil.ReadFile(sample + "/proc/diskstats001.txt")
+	t.Assert(err, IsNil)
+	content2, err := ioutil.ReadFile(sample + "/proc/diskstats002.txt")
+	t.Assert(err, IsNil)
+
+	// First read has only counters, no previous values for the gauges.
+	now := time.Now()
+	got, err := m.ProcDiskstats(content1, now)
+	t.Assert(err, IsNil)
+	t.Check(len(got), Equals, 11) // only sda
+
+	// 1s later: 100 reads in 500ms, 50 writes in 1000ms, busy 750ms.
+	got, err = m.ProcDiskstats(content2, now.Add(time.Second))
+	t.Assert(err, IsNil)
+	t.Assert(len(got), Equals, 11+8)
+	expect := []mm.Metric{
+		{Name: "disk/sda/read_iops", Type: "gauge", Number: 100},
+		{Name: "disk/sda/write_iops", Type: "gauge", Number: 50},
+		{Name: "disk/sda/read_await", Type: "gauge", Number: 5},
+		{Name: "disk/sda/write_await", Type: "gauge", Number: 20},
+		{Name: "disk/sda/await", Type: "gauge", Number: 10},
+		{Name: "disk/sda/svctm", Type: "gauge", Number: 5},
+		{Name: "disk/sda/util", Type: "gauge", Number: 75},
+		{Name: "disk/sda/queue_size", Type: "gauge", Number: 1.5},
+	}
+	if same, diff := test.IsDeeply(got[11:], expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Manager
 /////////////////////////////////////////////////////////////////////////////
@@ -575,3 +873,73 @@ func (s *ManagerTestSuite) TestStartCollectStop(t *C) {
 		t.Fatal("Monitor has stopped")
 	}
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Cgroups
+/////////////////////////////////////////////////////////////////////////////
+
+type CgroupTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+}
+
+var _ = Suite(&CgroupTestSuite{})
+
+func (s *CgroupTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "system-monitor-test")
+}
+
+// --------------------------------------------------------------------------
+
+func (s *CgroupTestSuite) TestCgroupName(t *C) {
+	id := "4f3a2b1c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a"
+	t.Check(system.CgroupName("/docker/"+id), Equals, "cgroup/docker.4f3a2b1c9d8e")
+	t.Check(system.CgroupName("/system.slice/docker-"+id+".scope"), Equals, "cgroup/system.slice.docker-4f3a2b1c9d8e.scope")
+	t.Check(system.CgroupName("/lxc/db1"), Equals, "cgroup/lxc.db1")
+}
+
+func (s *CgroupTestSuite) TestCgroupV1(t *C) {
+	config := &system.Config{
+		Cgroups:    []string{"/docker/*"},
+		CgroupRoot: sample + "/cgroup/v1",
+	}
+	m := system.NewMonitor("", config, s.logger)
+	got, err := m.CgroupMetrics()
+	t.Assert(err, IsNil)
+	expect := []mm.Metric{
+		{Name: "cgroup/docker.4f3a2b1c9d8e/cpu_usage", Type: "counter", Number: 1.5},
+		{Name: "cgroup/docker.4f3a2b1c9d8e/memory_usage", Type: "gauge", Number: 268435456},
+		{Name: "cgroup/docker.4f3a2b1c9d8e/blkio_read_bytes", Type: "counter", Number: 5120},
+		{Name: "cgroup/docker.4f3a2b1c9d8e/blkio_write_bytes", Type: "counter", Number: 8192},
+		{Name: "cgroup/docker.4f3a2b1c9d8e/blkio_reads", Type: "counter", Number: 2},
+		{Name: "cgroup/docker.4f3a2b1c9d8e/blkio_writes", Type: "counter", Number: 2},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
+
+func (s *CgroupTestSuite) TestCgroupV2(t *C) {
+	config := &system.Config{
+		Cgroups:    []string{"/system.slice/docker-*"},
+		CgroupRoot: sample + "/cgroup/v2",
+	}
+	m := system.NewMonitor("", config, s.logger)
+	got, err := m.CgroupMetrics()
+	t.Assert(err, IsNil)
+	prefix := "cgroup/system.slice.docker-4f3a2b1c9d8e.scope/"
+	expect := []mm.Metric{
+		{Name: prefix + "cpu_usage", Type: "counter", Number: 1.5},
+		{Name: prefix + "memory_usage", Type: "gauge", Number: 268435456},
+		{Name: prefix + "blkio_read_bytes", Type: "counter", Number: 5120},
+		{Name: prefix + "blkio_write_bytes", Type: "counter", Number: 8192},
+		{Name: prefix + "blkio_reads", Type: "counter", Number: 2},
+		{Name: prefix + "blkio_writes", Type: "counter", Number: 2},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+}
@@ -84,8 +84,8 @@ func (m *Monitor) Status() map[string]string {
 }
 
 func (m *Monitor) Add(dsn string) (c <-chan bool, err error) {
-	m.logger.Debug("Add:call:" + mysql.HideDSNPassword(dsn))
-	defer m.logger.Debug("Add:return:" + mysql.HideDSNPassword(dsn))
+	m.logger.Debug("Add:call:" + pct.RedactDSN(dsn))
+	defer m.logger.Debug("Add:return:" + pct.RedactDSN(dsn))
 
 	m.Lock()
 	defer m.Unlock()
@@ -121,8 +121,8 @@ func (m *Monitor) GlobalSubscribe() (chan string, error) {
 }
 
 func (m *Monitor) Remove(dsn string, c <-chan bool) {
-	m.logger.Debug("Remove:call:" + mysql.HideDSNPassword(dsn))
-	defer m.logger.Debug("Remove:return:" + mysql.HideDSNPassword(dsn))
+	m.logger.Debug("Remove:call:" + pct.RedactDSN(dsn))
+	defer m.logger.Debug("Remove:return:" + pct.RedactDSN(dsn))
 
 	m.Lock()
 	defer m.Unlock()
@@ -150,7 +150,7 @@ func (m *Monitor) Check() {
 			continue
 		}
 		if wasRestarted {
-			m.logger.Debug("Check:restarted:" + mysql.HideDSNPassword(mysqlInstance.DSN()))
+			m.logger.Debug("Check:restarted:" + pct.RedactDSN(mysqlInstance.DSN()))
 			mysqlInstance.Subscribers.Notify()
 		}
 	}
@@ -189,8 +189,8 @@ func (m *Monitor) run(interval time.Duration) {
 }
 
 func (m *Monitor) createMysqlInstance(dsn string) (mi *MysqlInstance, err error) {
-	m.logger.Debug("createMysqlInstance:call:" + mysql.HideDSNPassword(dsn))
-	defer m.logger.Debug("createMysqlInstance:return:" + mysql.HideDSNPassword(dsn))
+	m.logger.Debug("createMysqlInstance:call:" + pct.RedactDSN(dsn))
+	defer m.logger.Debug("createMysqlInstance:return:" + pct.RedactDSN(dsn))
 
 	mysqlConn := m.mysqlConnFactory.Make(dsn)
 	// todo: fix
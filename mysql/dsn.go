@@ -20,10 +20,10 @@ package mysql
 import (
 	"errors"
 	"fmt"
-	"os/exec"
-	"os/user"
 	"path"
 	"strings"
+
+	"github.com/percona/percona-agent/pct"
 )
 
 type DSN struct {
@@ -39,7 +39,7 @@ type DSN struct {
 const (
 	dsnSuffix         = "/?parseTime=true"
 	allowOldPasswords = "&allowOldPasswords=true"
-	HiddenPassword    = "<password-hidden>"
+	HiddenPassword    = pct.HIDDEN_PASSWORD
 )
 
 var ErrNoSocket error = errors.New("Cannot find MySQL socket (localhost implies socket).  Specify socket or use 127.0.0.1 instead of localhost.")
@@ -60,12 +60,8 @@ func (dsn DSN) DSN() (string, error) {
 	// "connections on Unix to localhost are made using a Unix socket file by default"
 	if dsn.Hostname == "localhost" && (dsn.Protocol == "" || dsn.Protocol == "socket") {
 		if dsn.Socket == "" {
-			// Try to auto-detect MySQL socket from netstat output.
-			out, err := exec.Command("netstat", "-anp").Output()
-			if err != nil {
-				return "", ErrNoSocket
-			}
-			socket := ParseSocketFromNetstat(string(out))
+			// Try to auto-detect MySQL socket, see netstat.go.
+			socket := detectSocket()
 			if socket == "" {
 				return "", ErrNoSocket
 			}
@@ -91,11 +87,11 @@ func (dsn DSN) DSN() (string, error) {
 			dsn.Port,
 		)
 	} else {
-		user, err := user.Current()
+		username, err := pct.CurrentUser()
 		if err != nil {
 			return "", err
 		}
-		dsnString = fmt.Sprintf("%s@", user.Username)
+		dsnString = fmt.Sprintf("%s@", username)
 	}
 	dsnString = dsnString + dsnSuffix
 	if dsn.OldPasswords {
@@ -127,6 +123,15 @@ func (dsn DSN) String() string {
 	return dsnString
 }
 
+// GoString hides the password so %#v is safe to log.
+func (dsn DSN) GoString() string {
+	if dsn.Password != "" {
+		dsn.Password = HiddenPassword
+	}
+	type plainDSN DSN // no GoString, else infinite recursion
+	return strings.Replace(fmt.Sprintf("%#v", plainDSN(dsn)), "mysql.plainDSN", "mysql.DSN", 1)
+}
+
 func (dsn DSN) StringWithSuffixes() string {
 	if dsn.Username == "" {
 		dsn.Username = "<anonymous-user>"
@@ -150,13 +155,7 @@ func ParseSocketFromNetstat(out string) string {
 	return ""
 }
 
+// HideDSNPassword is pct.RedactDSN, which also handles other DSN forms.
 func HideDSNPassword(dsn string) string {
-	dsnParts := strings.Split(dsn, "@")
-	userPart := dsnParts[0]
-	hostPart := ""
-	if len(dsnParts) > 1 {
-		hostPart = dsnParts[1]
-	}
-	userPasswordParts := strings.Split(userPart, ":")
-	return userPasswordParts[0] + ":" + HiddenPassword + "@" + hostPart
+	return pct.RedactDSN(dsn)
 }
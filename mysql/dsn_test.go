@@ -44,6 +44,10 @@ func (s *DSNTestSuite) TestAllFields(t *C) {
 	// Stringify DSN removes password, e.g. makes it safe to print log, etc.
 	str = fmt.Sprintf("%s", dsn)
 	t.Check(str, Equals, "user:<password-hidden>@tcp(host.example.com:3306)")
+
+	// So does %#v, e.g. in installer debug output.
+	str = fmt.Sprintf("%#v", dsn)
+	t.Check(str, Equals, `mysql.DSN{Username:"user", Password:"<password-hidden>", Hostname:"host.example.com", Port:"3306", Socket:"", OldPasswords:false, Protocol:""}`)
 }
 
 func (s *DSNTestSuite) TestOldPasswords(t *C) {
@@ -79,5 +83,7 @@ func (s *DSNTestSuite) TestHideDSNPassword(t *C) {
 	dsn = "percona-agent:0xabd123def@tcp(host.example.com:3306)/?parseTime=true"
 	t.Check(mysql.HideDSNPassword(dsn), Equals, "percona-agent:"+mysql.HiddenPassword+"@tcp(host.example.com:3306)/?parseTime=true")
 	dsn = ""
-	t.Check(mysql.HideDSNPassword(dsn), Equals, ":"+mysql.HiddenPassword+"@")
+	t.Check(mysql.HideDSNPassword(dsn), Equals, "")
+	dsn = "user:p@ss@unix(/var/lib/mysql/mysql.sock)/"
+	t.Check(mysql.HideDSNPassword(dsn), Equals, "user:"+mysql.HiddenPassword+"@unix(/var/lib/mysql/mysql.sock)/")
 }
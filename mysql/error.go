@@ -31,4 +31,9 @@ const (
 	ER_SPECIFIC_ACCESS_DENIED_ERROR = 1227
 	ER_SYNTAX_ERROR                 = 1064
 	ER_USER_DENIED                  = 1142
+	ER_UNKNOWN_TABLE                = 1109
+	ER_BAD_FIELD_ERROR              = 1054
+	ER_UNKNOWN_SYSTEM_VARIABLE      = 1193
+	ER_NO_BINARY_LOGGING            = 1381
+	ER_MASTER_FATAL_READING         = 1236 // replica: fatal error reading binlog from master
 )
@@ -108,7 +108,7 @@ func (c *Connection) Connect(tries uint) error {
 		return nil
 	}
 
-	return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSNPassword(c.dsn), FormatError(err))
+	return fmt.Errorf("Cannot connect to MySQL %s: %s", pct.RedactDSN(c.dsn), FormatError(err))
 }
 
 func (c *Connection) Close() {
@@ -169,7 +169,7 @@ func (c *Connection) GetGlobalVarNumber(varName string) float64 {
 
 func (c *Connection) Uptime() (uptime int64, err error) {
 	if c.conn == nil {
-		return 0, fmt.Errorf("Error while getting Uptime(). Not connected to the db: %s", c.DSN())
+		return 0, fmt.Errorf("Error while getting Uptime(). Not connected to the db: %s", pct.RedactDSN(c.DSN()))
 	}
 	// Result from SHOW STATUS includes two columns,
 	// Variable_name and Value, we ignore the first one as we need only Value
@@ -0,0 +1,264 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * A host can run several mysqld, each with its own socket, port, datadir,
+ * pid file and logs, and each is a separate MySQL instance for the agent.
+ * Its DSN is all that tells them apart: QAN, MRMS, and the error log tailer
+ * get each one's slow log, uptime, and error log over its own connection
+ * (@@slow_query_log_file, Uptime, @@log_error), so they aren't parsed from
+ * the options here.  The two common ways to run several are:
+ *
+ *   mysqld_multi: [mysqld1], [mysqld2], ... option groups; mysqld_multi
+ *                 starts each mysqld with its group's options as args.
+ *   systemd:      a mysqld@.service template; mysqld@2 runs mysqld with
+ *                 --defaults-group-suffix=@2 so it reads [mysqld@2] after
+ *                 [mysqld].
+ *
+ * DiscoverMysqld finds running mysqld processes in /proc and fills in the
+ * options they weren't started with from the option files, so both cases
+ * (and a single plain mysqld) are handled the same way.
+ */
+
+var DefaultOptionFiles = []string{"/etc/my.cnf", "/etc/mysql/my.cnf"}
+
+// Mysqld is a mysqld process on the local host.
+type Mysqld struct {
+	Pid     int
+	Group   string // option group, e.g. mysqld, mysqld2, mysqld@2
+	Socket  string
+	Port    string
+	Datadir string
+}
+
+// DSN returns a DSN, without user and password, to connect to the mysqld.
+func (m Mysqld) DSN() DSN {
+	if m.Socket != "" {
+		return DSN{Socket: m.Socket}
+	}
+	port := m.Port
+	if port == "" {
+		port = "3306"
+	}
+	return DSN{Hostname: "127.0.0.1", Port: port}
+}
+
+// DiscoverMysqld returns the mysqld processes running on the host, ordered
+// by pid.  procDir is normally /proc.  optionFiles are read for options not
+// given on a mysqld's command line; normally they're DefaultOptionFiles.
+func DiscoverMysqld(procDir string, optionFiles []string) ([]Mysqld, error) {
+	dirs, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	all := []Mysqld{}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue // not a process
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(procDir, d.Name(), "cmdline"))
+		if err != nil {
+			continue // process exited
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if !isMysqld(args[0]) {
+			continue
+		}
+		m := ParseMysqldArgs(args[1:], optionFiles)
+		m.Pid = pid
+		all = append(all, m)
+	}
+	sort.Sort(byPid(all))
+	return all, nil
+}
+
+// ParseMysqldArgs returns the mysqld started with args, like --port=3307,
+// reading options not in args from the option files.
+func ParseMysqldArgs(args []string, optionFiles []string) Mysqld {
+	opts := make(map[string]string)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		kv := strings.SplitN(arg[2:], "=", 2)
+		if len(kv) == 2 {
+			opts[normalizeOption(kv[0])] = kv[1]
+		}
+	}
+
+	if file, ok := opts["defaults-file"]; ok {
+		optionFiles = []string{file}
+	}
+	groups := ReadOptionFiles(optionFiles)
+
+	m := Mysqld{Group: "mysqld"}
+	if suffix, ok := opts["defaults-group-suffix"]; ok {
+		m.Group += suffix
+	} else if g := matchMultiGroup(groups, opts); g != "" {
+		m.Group = g
+	}
+
+	// Command line options override the group's, which override [mysqld].
+	merged := make(map[string]string)
+	for _, g := range []string{"mysqld", m.Group} {
+		for k, v := range groups[g] {
+			merged[k] = v
+		}
+	}
+	for k, v := range opts {
+		merged[k] = v
+	}
+
+	m.Socket = merged["socket"]
+	m.Port = merged["port"]
+	m.Datadir = merged["datadir"]
+	return m
+}
+
+// ReadOptionFiles reads MySQL option files and returns their options by
+// group, later files overriding earlier ones.  Missing files are ignored,
+// like mysqld does.
+func ReadOptionFiles(files []string) map[string]map[string]string {
+	groups := make(map[string]map[string]string)
+	for _, file := range files {
+		readOptionFile(file, groups, nil, 0)
+	}
+	return groups
+}
+
+// OptionFiles returns the option files that ReadOptionFiles reads, including
+// the files they !include and the *.cnf files in the dirs they !includedir,
+// and those dirs.  Missing files are returned too so callers watching them
+// can tell when they're created.
+func OptionFiles(files []string) ([]string, []string) {
+	inc := &includes{seen: make(map[string]bool)}
+	for _, file := range files {
+		readOptionFile(file, make(map[string]map[string]string), inc, 0)
+	}
+	return inc.files, inc.dirs
+}
+
+// includes records the files and dirs readOptionFile reads, in order.
+type includes struct {
+	files []string
+	dirs  []string
+	seen  map[string]bool
+}
+
+func (inc *includes) add(list *[]string, name string) {
+	if inc.seen[name] {
+		return
+	}
+	inc.seen[name] = true
+	*list = append(*list, name)
+}
+
+func readOptionFile(file string, groups map[string]map[string]string, inc *includes, depth int) {
+	if depth > 10 {
+		return // include loop
+	}
+	if inc != nil {
+		inc.add(&inc.files, file)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	group := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case strings.HasPrefix(line, "!includedir"):
+			dir := strings.TrimSpace(strings.TrimPrefix(line, "!includedir"))
+			if inc != nil {
+				inc.add(&inc.dirs, dir)
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "*.cnf"))
+			sort.Strings(files)
+			for _, f := range files {
+				readOptionFile(f, groups, inc, depth+1)
+			}
+		case strings.HasPrefix(line, "!include"):
+			readOptionFile(strings.TrimSpace(strings.TrimPrefix(line, "!include")), groups, inc, depth+1)
+		case line[0] == '[' && line[len(line)-1] == ']':
+			group = strings.TrimSpace(line[1 : len(line)-1])
+			if groups[group] == nil {
+				groups[group] = make(map[string]string)
+			}
+		case group != "":
+			kv := strings.SplitN(line, "=", 2)
+			val := ""
+			if len(kv) == 2 {
+				val = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+			}
+			groups[group][normalizeOption(strings.TrimSpace(kv[0]))] = val
+		}
+	}
+}
+
+// matchMultiGroup returns the mysqld_multi group, like mysqld2, whose socket
+// or port is the one mysqld was started with, or "" if there's none.
+func matchMultiGroup(groups map[string]map[string]string, opts map[string]string) string {
+	for g, groupOpts := range groups {
+		if g == "mysqld" || !strings.HasPrefix(g, "mysqld") {
+			continue
+		}
+		if _, err := strconv.Atoi(g[len("mysqld"):]); err != nil {
+			continue // not mysqldN, e.g. mysqld_safe
+		}
+		if s := opts["socket"]; s != "" && s == groupOpts["socket"] {
+			return g
+		}
+		if p := opts["port"]; p != "" && p == groupOpts["port"] {
+			return g
+		}
+	}
+	return ""
+}
+
+func isMysqld(cmd string) bool {
+	switch filepath.Base(cmd) {
+	case "mysqld", "mysqld-debug", "mariadbd":
+		return true
+	}
+	return false
+}
+
+// normalizeOption makes option names canonical: slow_query_log_file and
+// slow-query-log-file are the same option.
+func normalizeOption(opt string) string {
+	return strings.Replace(strings.ToLower(opt), "_", "-", -1)
+}
+
+type byPid []Mysqld
+
+func (a byPid) Len() int           { return len(a) }
+func (a byPid) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPid) Less(i, j int) bool { return a[i].Pid < a[j].Pid }
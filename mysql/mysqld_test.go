@@ -0,0 +1,105 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql_test
+
+import (
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type MysqldTestSuite struct {
+}
+
+var _ = Suite(&MysqldTestSuite{})
+
+func (s *MysqldTestSuite) TestDiscoverMysqld(t *C) {
+	dir := test.RootDir + "/mysql/mysqld001"
+	got, err := mysql.DiscoverMysqld(dir+"/proc", []string{dir + "/my.cnf"})
+	t.Assert(err, IsNil)
+	expect := []mysql.Mysqld{
+		// mysqld_multi: options on the command line, group found by socket
+		{
+			Pid:     101,
+			Group:   "mysqld1",
+			Socket:  "/var/run/mysqld/mysqld1.sock",
+			Port:    "3307",
+			Datadir: "/var/lib/mysql1",
+		},
+		// systemd mysqld@2: options from [mysqld@2] then [mysqld]
+		{
+			Pid:     202,
+			Group:   "mysqld@2",
+			Socket:  "/var/run/mysqld/mysqld2.sock",
+			Port:    "3308",
+			Datadir: "/var/lib/mysql2",
+		},
+	}
+	if same, diff := test.IsDeeply(got, expect); !same {
+		test.Dump(got)
+		t.Error(diff)
+	}
+
+	t.Check(got[0].DSN(), Equals, mysql.DSN{Socket: "/var/run/mysqld/mysqld1.sock"})
+}
+
+func (s *MysqldTestSuite) TestParseMysqldArgs(t *C) {
+	// No option files, nothing but the command line.
+	m := mysql.ParseMysqldArgs([]string{"--port=3310", "--datadir=/tmp/mysql"}, nil)
+	t.Check(m.Group, Equals, "mysqld")
+	t.Check(m.Port, Equals, "3310")
+	t.Check(m.Datadir, Equals, "/tmp/mysql")
+	t.Check(m.DSN(), Equals, mysql.DSN{Hostname: "127.0.0.1", Port: "3310"})
+}
+
+func (s *MysqldTestSuite) TestOptionFiles(t *C) {
+	// Include paths are absolute, so make the option files in a tmp dir.
+	dir, err := ioutil.TempDir("/tmp", "percona-agent-test-")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	confd := filepath.Join(dir, "conf.d")
+	t.Assert(os.Mkdir(confd, 0755), IsNil)
+	files := map[string]string{
+		"my.cnf":        "[mysqld]\ndatadir = /var/lib/mysql\n!include " + dir + "/extra.cnf\n!includedir " + confd + "\n",
+		"extra.cnf":     "[mysqld]\nport = 3307\n!include " + dir + "/my.cnf\n", // loop
+		"conf.d/b.cnf":  "[mysqld]\nsocket = /tmp/mysql.sock\n",
+		"conf.d/a.cnf":  "[mysqld]\nlog-error = error.log\n",
+		"conf.d/README": "not an option file\n",
+	}
+	for name, content := range files {
+		t.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	gotFiles, gotDirs := mysql.OptionFiles([]string{dir + "/my.cnf", dir + "/missing.cnf"})
+	t.Check(gotFiles, DeepEquals, []string{
+		dir + "/my.cnf",
+		dir + "/extra.cnf",
+		confd + "/a.cnf",
+		confd + "/b.cnf",
+		dir + "/missing.cnf",
+	})
+	t.Check(gotDirs, DeepEquals, []string{confd})
+
+	// The options are the same as if read without OptionFiles.
+	groups := mysql.ReadOptionFiles([]string{dir + "/my.cnf"})
+	t.Check(groups["mysqld"]["port"], Equals, "3307")
+	t.Check(groups["mysqld"]["socket"], Equals, "/tmp/mysql.sock")
+}
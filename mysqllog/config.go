@@ -0,0 +1,63 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysqllog
+
+import (
+	"errors"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+const (
+	DEFAULT_INTERVAL = 10  // seconds
+	DEFAULT_DEDUP    = 300 // seconds
+	MAX_ENTRIES      = 1000
+)
+
+type Config struct {
+	proto.ServiceInstance
+	File     string // error log, "" = @@log_error (relative to @@datadir)
+	Interval uint   // how often to read new entries (seconds)
+	Dedup    uint   // seconds repeats of an entry are counted, not sent
+	Notes    bool   // send [Note] entries too, not only warnings and errors
+}
+
+// Validate sets defaults and returns an error if the config is invalid.
+func (c *Config) Validate() error {
+	if c.Service != "mysql" {
+		return errors.New("Service must be mysql, got '" + c.Service + "'")
+	}
+	if c.InstanceId == 0 {
+		return errors.New("InstanceId must be > 0")
+	}
+	if c.Interval == 0 {
+		c.Interval = DEFAULT_INTERVAL
+	}
+	if c.Dedup == 0 {
+		c.Dedup = DEFAULT_DEDUP
+	}
+	return nil
+}
+
+func (c Config) Instance() proto.ServiceInstance {
+	return c.ServiceInstance
+}
+
+func (c Config) TickInterval() uint {
+	return c.Interval
+}
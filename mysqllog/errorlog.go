@@ -0,0 +1,226 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysqllog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+)
+
+// A Report is the new entries of an error log, spooled as "mysqllog" data.
+type Report struct {
+	proto.ServiceInstance
+	Ts      time.Time // UTC
+	File    string
+	Entries []Entry
+	Dropped uint `json:",omitempty"` // entries over MAX_ENTRIES
+}
+
+/**
+ * errorLog is the Log of a MySQL error log Tailer.  It spools the entries of
+ * the lines as a Report every interval.
+ *
+ * An entry that repeats, e.g. "Aborted connection 123 to db", is sent the first
+ * time, then its repeats in the next Config.Dedup seconds are only counted,
+ * and sent as one entry with Repeated = the count when the time is up.  Entries
+ * are the same if only their numbers differ.  Crashes and corruption (entries
+ * with a Kind) are never deduplicated: every one is sent and logged.
+ */
+type errorLog struct {
+	logger   *pct.Logger
+	config   Config
+	filename func() (string, error)
+	spool    data.Spooler
+	// --
+	parser *Parser
+	dedup  map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	entry    Entry     // first, sent
+	sent     time.Time // when entry was sent
+	last     time.Time // Ts of last repeat
+	repeated uint
+}
+
+var numbers = regexp.MustCompile(`\d+`)
+
+// NewTailer returns a Tailer that sends the entries of the error log returned
+// by filename.
+func NewTailer(logger *pct.Logger, config Config, filename func() (string, error), tickChan chan time.Time, spool data.Spooler) *Tailer {
+	log := &errorLog{
+		logger:   logger,
+		config:   config,
+		filename: filename,
+		spool:    spool,
+		// --
+		parser: NewParser(time.Local),
+		dedup:  make(map[string]*dedupEntry),
+	}
+	return NewLogTailer(logger, config, log, tickChan, "")
+}
+
+func (l *errorLog) Source() (string, error) {
+	return l.filename()
+}
+
+// Send spools the entries that aren't filtered or repeats, and the repeats of
+// entries that aren't repeating anymore.  A report the spool doesn't take is
+// lost: the error log isn't an audit trail, so it isn't read again.
+func (l *errorLog) Send(now time.Time, file string, lines []string, eof bool) (int64, error) {
+	var n int64
+	for _, line := range lines {
+		n += int64(len(line)) + 1 // newline
+	}
+
+	entries := l.parser.Parse(lines)
+	if len(lines) == 0 || eof {
+		// No lines continued the last entry, or none can, so it's complete.
+		entries = append(entries, l.parser.Flush()...)
+	}
+
+	report := &Report{
+		ServiceInstance: l.config.ServiceInstance,
+		Ts:              now.UTC(),
+		File:            file,
+		Entries:         []Entry{},
+	}
+	add := func(e Entry) {
+		if len(report.Entries) >= MAX_ENTRIES {
+			report.Dropped++
+			return
+		}
+		report.Entries = append(report.Entries, e)
+	}
+
+	for _, e := range entries {
+		if e.Level == LEVEL_NOTE && !l.config.Notes {
+			continue
+		}
+		if e.Kind != "" {
+			// Make sure someone notices: it's in the agent log, too.
+			add(e)
+			msg := e.Msg
+			if i := strings.Index(msg, "\n"); i > 0 {
+				msg = msg[0:i]
+			}
+			l.logger.Error(fmt.Sprintf("MySQL %s at %s: %s", e.Kind, pct.TimeString(e.Ts), msg))
+			continue
+		}
+		key := e.Level + " " + numbers.ReplaceAllString(e.Msg, "N")
+		if d, ok := l.dedup[key]; ok {
+			d.repeated++
+			d.last = e.Ts
+			continue
+		}
+		l.dedup[key] = &dedupEntry{entry: e, sent: now, last: e.Ts}
+		add(e)
+	}
+
+	window := time.Duration(l.config.Dedup) * time.Second
+	for key, d := range l.dedup {
+		if now.Sub(d.sent) < window {
+			continue
+		}
+		if d.repeated > 0 {
+			e := d.entry
+			e.Ts = d.last
+			e.Repeated = d.repeated
+			add(e)
+		}
+		delete(l.dedup, key)
+	}
+
+	if len(report.Entries) == 0 {
+		return n, nil
+	}
+	if report.Dropped > 0 {
+		l.logger.Warn(fmt.Sprintf("Dropped %d entries from %s, more than %d in one interval", report.Dropped, file, MAX_ENTRIES))
+	}
+	if err := l.spool.Write("mysqllog", report); err != nil {
+		l.logger.Warn("Lost report:", err)
+	}
+	return n, nil
+}
+
+// --------------------------------------------------------------------------
+
+// errorLogFactory makes the error log tailers of the mysqllog Manager.
+type errorLogFactory struct {
+	spool       data.Spooler
+	im          *instance.Repo
+	connFactory mysql.ConnectionFactory
+}
+
+func (f *errorLogFactory) Make(logger *pct.Logger, data []byte, tickChan chan time.Time) (*Tailer, error) {
+	config := Config{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.New("Invalid mysqllog.Config: " + err.Error())
+	}
+	filename, err := f.filenameFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewTailer(logger, config, filename, tickChan, f.spool), nil
+}
+
+// filenameFunc returns a func that returns the error log: Config.File, else
+// @@log_error, which is got every interval because it can change (FLUSH
+// ERROR LOGS after changing the config file, or a restart).
+func (f *errorLogFactory) filenameFunc(config Config) (func() (string, error), error) {
+	if config.File != "" {
+		file := config.File
+		return func() (string, error) { return file, nil }, nil
+	}
+
+	mysqlInstance := proto.MySQLInstance{}
+	if err := f.im.Get(config.Service, config.InstanceId, &mysqlInstance); err != nil {
+		return nil, fmt.Errorf("Cannot get MySQL instance from repo: %s", err)
+	}
+	mysqlConn := f.connFactory.Make(mysqlInstance.DSN)
+	filename := func() (string, error) {
+		if err := mysqlConn.Connect(1); err != nil {
+			return "", err
+		}
+		defer mysqlConn.Close()
+		file := mysqlConn.GetGlobalVarString("log_error")
+		if file == "" || file == "stderr" {
+			return "", errors.New("MySQL logs errors to stderr (log_error is not set), set File to the file it's redirected to")
+		}
+		// log_error can be relative to the datadir, e.g. ./host.err.
+		if !path.IsAbs(file) {
+			file = path.Join(mysqlConn.GetGlobalVarString("datadir"), file)
+		}
+		return file, nil
+	}
+	return filename, nil
+}
@@ -0,0 +1,280 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysqllog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/ticker"
+)
+
+// A TailerFactory makes the tailers of a Manager from their StartService data,
+// e.g. a Config.  The tailers aren't started.
+type TailerFactory interface {
+	Make(logger *pct.Logger, data []byte, tickChan chan time.Time) (*Tailer, error)
+}
+
+/**
+ * Manager is a proxy manager for log tailers, one per MySQL instance, like
+ * sysconfig for its monitors: mysqllog for error logs, and auditlog for audit
+ * logs.  StartService starts a Tailer for the instance and saves its config,
+ * e.g. mysqllog-mysql-1.conf, so it's started again when the agent restarts.
+ * StopService stops it and removes the config and the tailer's position, if
+ * any, so it starts at the end of the log next time.
+ */
+type Manager struct {
+	service string // e.g. mysqllog
+	logger  *pct.Logger
+	clock   ticker.Manager
+	im      *instance.Repo
+	factory TailerFactory
+	// --
+	tailers map[string]*Tailer
+	hashes  map[string]string // pct.ConfigHash of tailers' StartService data
+	running bool
+	mux     *sync.RWMutex // guards tailers, hashes, and running
+	status  *pct.Status
+}
+
+// NewManager returns the mysqllog Manager, which tails MySQL error logs.
+func NewManager(logger *pct.Logger, clock ticker.Manager, spool data.Spooler, im *instance.Repo, connFactory mysql.ConnectionFactory) *Manager {
+	factory := &errorLogFactory{
+		spool:       spool,
+		im:          im,
+		connFactory: connFactory,
+	}
+	return NewLogManager("mysqllog", logger, clock, im, factory)
+}
+
+func NewLogManager(service string, logger *pct.Logger, clock ticker.Manager, im *instance.Repo, factory TailerFactory) *Manager {
+	m := &Manager{
+		service: service,
+		logger:  logger,
+		clock:   clock,
+		im:      im,
+		factory: factory,
+		// --
+		tailers: make(map[string]*Tailer),
+		hashes:  make(map[string]string),
+		mux:     &sync.RWMutex{},
+		status:  pct.NewStatus([]string{service}),
+	}
+	return m
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Interface
+/////////////////////////////////////////////////////////////////////////////
+
+// @goroutine[0]
+func (m *Manager) Start() error {
+	m.mux.Lock()
+	if m.running {
+		m.mux.Unlock()
+		return pct.ServiceIsRunningError{Service: m.service}
+	}
+	m.running = true
+	m.mux.Unlock()
+
+	// Start a tailer for each saved config.
+	glob := filepath.Join(pct.Basedir.Dir("config"), m.service+"-*.conf")
+	configFiles, err := filepath.Glob(glob)
+	if err != nil {
+		return err
+	}
+	for _, configFile := range configFiles {
+		data, err := pct.Basedir.ReadConfigFile(configFile)
+		if err != nil {
+			m.logger.Error("Read " + configFile + ": " + err.Error())
+			continue
+		}
+		cmd := &proto.Cmd{
+			Ts:   time.Now().UTC(),
+			Cmd:  "StartService",
+			Data: data,
+		}
+		reply := m.Handle(cmd)
+		if reply.Error != "" {
+			m.logger.Error("Start " + configFile + ": " + reply.Error)
+			continue
+		}
+		m.logger.Info("Started " + configFile)
+	}
+
+	m.logger.Info("Started")
+	m.status.Update(m.service, "Running")
+	return nil
+}
+
+// @goroutine[0]
+func (m *Manager) Stop() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for name, tailer := range m.tailers {
+		m.status.Update(m.service, "Stopping "+name)
+		tailer.Stop()
+		m.clock.Remove(tailer.TickChan())
+		delete(m.tailers, name)
+		delete(m.hashes, name)
+	}
+	m.running = false
+	m.logger.Info("Stopped")
+	m.status.Update(m.service, "Stopped")
+	return nil
+}
+
+// @goroutine[0]
+func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
+	m.status.UpdateRe(m.service, "Handling", cmd)
+	defer m.status.Update(m.service, "Running")
+
+	switch cmd.Cmd {
+	case "StartService":
+		// proto.Cmd[Service:mysqllog, Cmd:StartService, Data:mysqllog.Config], or auditlog.Config
+		si := proto.ServiceInstance{}
+		if err := json.Unmarshal(cmd.Data, &si); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		name := m.service + "-" + m.im.Name(si.Service, si.InstanceId)
+		m.logger.Info("Start", name, cmd)
+
+		hash, err := pct.ConfigHash(cmd.Data)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		oldTailer, haveTailer := m.tailers[name]
+		if haveTailer && m.hashes[name] == hash {
+			m.logger.Info(name, "is running with the same config")
+			return cmd.Reply(nil) // success
+		}
+
+		tickChan := make(chan time.Time, 1)
+		tailer, err := m.factory.Make(pct.NewLogger(m.logger.LogChan(), name), cmd.Data, tickChan)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
+		if haveTailer {
+			// Config changed: restart the tailer.  Its position, if any, is
+			// kept so the new tailer resumes where the old one stopped.
+			m.logger.Info("Restart", name, "with new config")
+			m.clock.Remove(oldTailer.TickChan())
+			oldTailer.Stop()
+			delete(m.tailers, name)
+			delete(m.hashes, name)
+		}
+		config := tailer.Config()
+		tailer.Start()
+		m.clock.Add(tickChan, config.TickInterval(), false)
+		m.tailers[name] = tailer
+		m.hashes[name] = hash
+
+		// Save the config to disk so agent starts the tailer on restart.
+		if err := pct.Basedir.WriteConfig(name, config); err != nil {
+			return cmd.Reply(nil, errors.New("Write "+name+" config: "+err.Error()))
+		}
+		return cmd.Reply(nil) // success
+	case "StopService":
+		si := proto.ServiceInstance{}
+		if err := json.Unmarshal(cmd.Data, &si); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		name := m.service + "-" + m.im.Name(si.Service, si.InstanceId)
+		m.logger.Info("Stop", name, cmd)
+
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		tailer, ok := m.tailers[name]
+		if !ok {
+			return cmd.Reply(nil, errors.New("Unknown tailer: "+name))
+		}
+		m.clock.Remove(tailer.TickChan())
+		tailer.Stop()
+		delete(m.tailers, name)
+		delete(m.hashes, name)
+		if err := pct.Basedir.RemoveConfig(name); err != nil {
+			return cmd.Reply(nil, errors.New("Remove "+name+": "+err.Error()))
+		}
+		if err := os.Remove(PositionFile(name)); err != nil && !os.IsNotExist(err) {
+			return cmd.Reply(nil, errors.New("Remove "+name+" position: "+err.Error()))
+		}
+		return cmd.Reply(nil) // success
+	case "GetConfig":
+		config, errs := m.GetConfig()
+		return cmd.Reply(config, errs...)
+	default:
+		// SetConfig does not work by design.  To re-configure a tailer,
+		// start it again with the new config: it's restarted if the config changed.
+		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
+	}
+}
+
+// @goroutine[1]
+func (m *Manager) Status() map[string]string {
+	status := m.status.All()
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	for _, tailer := range m.tailers {
+		for k, v := range tailer.Status() {
+			status[k] = v
+		}
+	}
+	return status
+}
+
+func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	// Manager does not have its own config.  It returns all tailers' configs instead.
+	configs := []proto.AgentConfig{}
+	errs := []error{}
+	for _, tailer := range m.tailers {
+		config := tailer.Config()
+		bytes, err := json.Marshal(config)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		configs = append(configs, proto.AgentConfig{
+			InternalService: m.service,
+			ExternalService: config.Instance(),
+			Config:          string(bytes),
+			Running:         true, // config removed if stopped, so it must be running
+		})
+	}
+	return configs, errs
+}
+
+// Reload applies changes to the tailers' saved configs: tailers with new or changed
+// configs are (re)started and tailers whose configs were removed are stopped.
+func (m *Manager) Reload() []error {
+	return pct.ReloadServices(m, m.service+"-*.conf")
+}
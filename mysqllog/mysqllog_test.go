@@ -0,0 +1,288 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysqllog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mysqllog"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+// Hook gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+/////////////////////////////////////////////////////////////////////////////
+// Parser test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ParserTestSuite struct {
+}
+
+var _ = Suite(&ParserTestSuite{})
+
+func (s *ParserTestSuite) TestFormats(t *C) {
+	p := mysqllog.NewParser(time.UTC)
+	lines := []string{
+		// 5.5
+		"150102 10:04:05 [ERROR] Cannot find or open table db/t from",
+		"the internal data dictionary of InnoDB though the .frm file for the",
+		"150102  9:04:05  InnoDB: Database was not shut down normally!",
+		"150102  9:04:06  InnoDB: Warning: a long semaphore wait:",
+		// 5.6
+		"2015-01-02 10:04:05 1234 [Warning] Aborted connection 5 to db: 'test'",
+		"2015-01-02 10:04:05 7f3b2c0e0700 InnoDB: Database page corruption on disk or a failed",
+		// 5.7 and 8.0
+		"2015-01-02T10:04:05.123456Z 0 [Note] mysqld: ready for connections.",
+		"Version: '5.7.5-m15-log'  socket: '/tmp/mysql.sock'  port: 3306",
+		"2015-01-02T11:04:05.000001+01:00 3 [Warning] IP address could not be resolved",
+		"2015-01-02T10:04:05.123456Z 0 [System] [MY-010116] [Server] /usr/sbin/mysqld starting",
+	}
+	got := p.Parse(lines)
+	got = append(got, p.Flush()...)
+	t.Assert(got, HasLen, 8)
+
+	ts := time.Date(2015, 1, 2, 10, 4, 5, 0, time.UTC)
+	t.Check(got[0].Ts, Equals, ts)
+	t.Check(got[0].Level, Equals, mysqllog.LEVEL_ERROR)
+	t.Check(got[0].Msg, Equals, "Cannot find or open table db/t from\nthe internal data dictionary of InnoDB though the .frm file for the")
+	t.Check(got[1].Ts, Equals, ts.Add(-time.Hour))
+	t.Check(got[1].Level, Equals, mysqllog.LEVEL_NOTE)
+	t.Check(got[1].Msg, Equals, "InnoDB: Database was not shut down normally!")
+	t.Check(got[2].Level, Equals, mysqllog.LEVEL_WARNING)
+
+	t.Check(got[3].Ts, Equals, ts)
+	t.Check(got[3].Level, Equals, mysqllog.LEVEL_WARNING)
+	t.Check(got[3].Msg, Equals, "Aborted connection 5 to db: 'test'")
+	t.Check(got[4].Level, Equals, mysqllog.LEVEL_ERROR)
+	t.Check(got[4].Kind, Equals, mysqllog.KIND_CORRUPTION)
+	t.Check(got[4].Msg, Equals, "InnoDB: Database page corruption on disk or a failed")
+
+	t.Check(got[5].Ts, Equals, ts.Add(123456*time.Microsecond))
+	t.Check(got[5].Level, Equals, mysqllog.LEVEL_NOTE)
+	t.Check(got[5].Msg, Equals, "mysqld: ready for connections.\nVersion: '5.7.5-m15-log'  socket: '/tmp/mysql.sock'  port: 3306")
+	t.Check(got[6].Ts, Equals, ts.Add(time.Microsecond))
+	t.Check(got[6].Level, Equals, mysqllog.LEVEL_WARNING)
+	t.Check(got[7].Level, Equals, mysqllog.LEVEL_NOTE)
+	t.Check(got[7].Msg, Equals, "/usr/sbin/mysqld starting")
+}
+
+func (s *ParserTestSuite) TestCrash(t *C) {
+	p := mysqllog.NewParser(time.UTC)
+	got := p.Parse([]string{
+		"2015-01-02 10:04:05 1234 [Note] Event Scheduler: Loaded 0 events",
+		"10:04:09 UTC - mysqld got signal 11 ;",
+		"This could be because you hit a bug. It is also possible that this binary",
+	})
+	t.Assert(got, HasLen, 1) // crash is pending until the next entry or flush
+	got = p.Flush()
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Level, Equals, mysqllog.LEVEL_ERROR)
+	t.Check(got[0].Kind, Equals, mysqllog.KIND_CRASH)
+	t.Check(got[0].Ts.Format("15:04:05"), Equals, "10:04:09")
+	t.Check(got[0].Msg, Equals, "mysqld got signal 11 ;\nThis could be because you hit a bug. It is also possible that this binary")
+	t.Check(p.Flush(), HasLen, 0)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Tailer test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type TailerTestSuite struct {
+	tmpDir   string
+	logChan  chan *proto.LogEntry
+	logger   *pct.Logger
+	dataChan chan interface{}
+	spool    *mock.Spooler
+	clock    *mock.Clock
+}
+
+var _ = Suite(&TailerTestSuite{})
+
+func (s *TailerTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "mysqllog-mysql-1")
+	s.dataChan = make(chan interface{}, 10)
+	s.spool = mock.NewSpooler(s.dataChan)
+	s.clock = mock.NewClock()
+}
+
+func (s *TailerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func appendFile(t *C, file string, lines string) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	t.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteString(lines)
+	t.Assert(err, IsNil)
+}
+
+func (s *TailerTestSuite) waitReport() *mysqllog.Report {
+	select {
+	case v := <-s.dataChan:
+		r, _ := v.(*mysqllog.Report)
+		return r
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
+
+func (s *TailerTestSuite) TestTail(t *C) {
+	file := filepath.Join(s.tmpDir, "error.log")
+	appendFile(t, file, "2015-01-02 10:00:00 1234 [ERROR] Old, not sent\n")
+
+	config := mysqllog.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		Dedup:           60,
+	}
+	t.Assert(config.Validate(), IsNil)
+	tickChan := make(chan time.Time)
+	filename := func() (string, error) { return file, nil }
+	tailer := mysqllog.NewTailer(s.logger, config, filename, tickChan, s.spool)
+	tailer.Start()
+	defer tailer.Stop()
+
+	// 1st tick: start at the end of the file.
+	now := time.Date(2015, 1, 2, 10, 5, 0, 0, time.UTC)
+	tickChan <- now
+	appendFile(t, file, "2015-01-02 10:04:05 1234 [Warning] Aborted connection 5 to db: 'test'\n"+
+		"2015-01-02 10:04:06 1234 [Note] Event Scheduler: Loaded 0 events\n"+
+		"2015-01-02 10:04:07 1234 [Warning] Aborted connection 6 to db: 'test'\n"+
+		"2015-01-02T10:04:08.000000Z 0 [ERROR] Can't open the mysql.plugin table.\n"+
+		"10:04:09 UTC - mysqld got signal 11 ;\n"+
+		"This could be because you hit a bug.\n")
+
+	// 2nd tick: the new entries, but not the note, the repeat, or the crash
+	// which is pending because lines can continue it.
+	tickChan <- now.Add(10 * time.Second)
+	got := s.waitReport()
+	t.Assert(got, NotNil)
+	t.Check(got.ServiceInstance, DeepEquals, config.ServiceInstance)
+	t.Check(got.File, Equals, file)
+	t.Assert(got.Entries, HasLen, 2)
+	t.Check(got.Entries[0].Msg, Equals, "Aborted connection 5 to db: 'test'")
+	t.Check(got.Entries[0].Ts, Equals, time.Date(2015, 1, 2, 10, 4, 5, 0, time.Local).UTC())
+	t.Check(got.Entries[1].Level, Equals, mysqllog.LEVEL_ERROR)
+	t.Check(got.Entries[1].Msg, Equals, "Can't open the mysql.plugin table.")
+
+	// 3rd tick, the dedup window later: the crash and the repeat count.
+	tickChan <- now.Add(70 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Entries, HasLen, 2)
+	t.Check(got.Entries[0].Kind, Equals, mysqllog.KIND_CRASH)
+	t.Check(got.Entries[0].Msg, Equals, "mysqld got signal 11 ;\nThis could be because you hit a bug.")
+	t.Check(got.Entries[1].Msg, Equals, "Aborted connection 5 to db: 'test'")
+	t.Check(got.Entries[1].Repeated, Equals, uint(1))
+	t.Check(got.Entries[1].Ts, Equals, time.Date(2015, 1, 2, 10, 4, 7, 0, time.Local).UTC())
+
+	// Rotate the log: the rest of the old file is read, then the new one.
+	appendFile(t, file, "2015-01-02 10:05:00 1234 [ERROR] Last in old file\n")
+	err := os.Rename(file, file+".1")
+	t.Assert(err, IsNil)
+	appendFile(t, file, "2015-01-02 10:06:00 1234 [ERROR] First in new file\n")
+	tickChan <- now.Add(80 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Entries, HasLen, 1)
+	t.Check(got.Entries[0].Msg, Equals, "Last in old file")
+	tickChan <- now.Add(90 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Entries, HasLen, 1)
+	t.Check(got.Entries[0].Msg, Equals, "First in new file")
+
+	// Corruption isn't deduplicated: every one is sent.
+	appendFile(t, file, "2015-01-02 10:06:10 7f3b2c0e0700 InnoDB: Database page corruption on disk or a failed\n"+
+		"2015-01-02 10:06:11 7f3b2c0e0700 InnoDB: Database page corruption on disk or a failed\n"+
+		"2015-01-02 10:06:12 1234 [Note] Not sent\n")
+	tickChan <- now.Add(95 * time.Second)
+	got = s.waitReport()
+	t.Assert(got, NotNil)
+	t.Assert(got.Entries, HasLen, 2)
+	t.Check(got.Entries[0].Kind, Equals, mysqllog.KIND_CORRUPTION)
+	t.Check(got.Entries[1].Kind, Equals, mysqllog.KIND_CORRUPTION)
+	t.Check(got.Entries[1].Repeated, Equals, uint(0))
+
+	t.Check(test.WaitStatus(1, tailer, "mysqllog-mysql-1", "Idle"), Equals, true)
+	t.Check(tailer.Status()["mysqllog-mysql-1-last-collected"], Matches, "at 2015-01-02 10:06:35 UTC.*")
+}
+
+func (s *TailerTestSuite) TestManager(t *C) {
+	file := filepath.Join(s.tmpDir, "manager.log")
+	appendFile(t, file, "")
+
+	im := instance.NewRepo(s.logger, pct.Basedir.Dir("config"), nil)
+	m := mysqllog.NewManager(s.logger, s.clock, s.spool, im, &mock.ConnectionFactory{})
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Only MySQL instances.
+	cmd := &proto.Cmd{
+		Service: "mysqllog",
+		Cmd:     "StartService",
+		Data:    []byte(`{"Service":"server","InstanceId":1}`),
+	}
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Matches, "Invalid mysqllog.Config: Service must be mysql.+")
+
+	cmd.Data = []byte(`{"Service":"mysql","InstanceId":1,"File":"` + file + `"}`)
+	reply = m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{mysqllog.DEFAULT_INTERVAL})
+	t.Check(pct.FileExists(pct.Basedir.ConfigFile("mysqllog-mysql-1")), Equals, true)
+	t.Check(m.Status()["mysqllog-mysql-1"], Not(Equals), "")
+
+	configs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Assert(configs, HasLen, 1)
+	t.Check(configs[0].ExternalService, DeepEquals, proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+
+	// Re-sending the same config succeeds without restarting it.
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, HasLen, 1)
+
+	cmd.Cmd = "StopService"
+	reply = m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+	t.Check(s.clock.Removed, HasLen, 1)
+	t.Check(pct.FileExists(pct.Basedir.ConfigFile("mysqllog-mysql-1")), Equals, false)
+	_, ok := m.Status()["mysqllog-mysql-1"]
+	t.Check(ok, Equals, false)
+}
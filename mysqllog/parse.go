@@ -0,0 +1,215 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysqllog
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	LEVEL_ERROR   = "error"
+	LEVEL_WARNING = "warning"
+	LEVEL_NOTE    = "note"
+	// --
+	KIND_CRASH      = "crash"
+	KIND_CORRUPTION = "corruption"
+	// --
+	MAX_MSG_LEN = 4096 // bytes, longer messages (e.g. stack traces) are cut
+)
+
+/**
+ * The error log format depends on the MySQL version:
+ *
+ *   5.5  150102 10:04:05 [ERROR] Cannot find or open table db/t
+ *        150102 10:04:05  InnoDB: Database was not shut down normally!
+ *   5.6  2015-01-02 10:04:05 1234 [Warning] Aborted connection 5 to db
+ *        2015-01-02 10:04:05 7f3b2c0e0700 InnoDB: Error: page 7 log sequence
+ *   5.7  2015-01-02T10:04:05.123456Z 0 [Note] mysqld: ready for connections.
+ *
+ * 5.5 and 5.6 timestamps are the server's local time; 5.7 timestamps are UTC
+ * (Z) or have an offset (log_timestamps=SYSTEM).  Lines without a timestamp,
+ * e.g. stack traces and the "Version: ..." line, continue the previous entry.
+ * The only exception is the first line of a crash report, which has a time
+ * but no date:
+ *
+ *   10:04:05 UTC - mysqld got signal 11 ;
+ *
+ * Old InnoDB messages have no level, so it's guessed from the message.  Crash
+ * and corruption messages are errors and have a Kind, so they can be found
+ * and are always sent.
+ */
+
+type Entry struct {
+	Ts       time.Time
+	Level    string // LEVEL_ERROR, LEVEL_WARNING, or LEVEL_NOTE
+	Kind     string `json:",omitempty"` // KIND_CRASH, KIND_CORRUPTION, or ""
+	Msg      string
+	Repeated uint `json:",omitempty"` // times repeated since last sent, see Config.Dedup
+}
+
+var (
+	line57    = regexp.MustCompile(`^(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d+)?(?:Z|[+-]\d\d:\d\d))\s+\d+\s+\[(\w+)\]\s+(?:\[MY-\d+\]\s+\[\w+\]\s+)?(.*)$`)
+	line56    = regexp.MustCompile(`^(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d)\s+(?:[0-9a-f]+\s+)?(?:\[(\w+)\]\s+)?(.*)$`)
+	line55    = regexp.MustCompile(`^(\d{6}\s+\d{1,2}:\d\d:\d\d)\s+(?:\[(\w+)\]\s+)?(.*)$`)
+	lineCrash = regexp.MustCompile(`^(\d\d:\d\d:\d\d) UTC - (mysqld got .*)$`)
+	spaces    = regexp.MustCompile(`\s+`)
+)
+
+// A Parser parses error log lines into entries.  An entry isn't complete
+// until the next one starts because lines can continue it, so Parse keeps
+// the last entry until the next call, or Flush.
+type Parser struct {
+	loc     *time.Location // of 5.5 and 5.6 timestamps
+	now     func() time.Time
+	pending *Entry
+}
+
+func NewParser(loc *time.Location) *Parser {
+	p := &Parser{
+		loc: loc,
+		now: time.Now,
+	}
+	return p
+}
+
+// Parse returns the entries completed by the lines, which don't have the
+// trailing newline.
+func (p *Parser) Parse(lines []string) []Entry {
+	entries := []Entry{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e := p.parseLine(line)
+		if e == nil {
+			if p.pending == nil {
+				// Rest of an entry before the offset read from, or garbage.
+				e = &Entry{Ts: p.now(), Level: guessLevel(line), Msg: line}
+				setKind(e)
+				p.pending = e
+				continue
+			}
+			if len(p.pending.Msg) < MAX_MSG_LEN {
+				p.pending.Msg = cut(p.pending.Msg + "\n" + line)
+				setKind(p.pending)
+			}
+			continue
+		}
+		if p.pending != nil {
+			entries = append(entries, *p.pending)
+		}
+		p.pending = e
+	}
+	return entries
+}
+
+// Flush returns the last entry, if any, because no line continued it.
+func (p *Parser) Flush() []Entry {
+	if p.pending == nil {
+		return nil
+	}
+	e := *p.pending
+	p.pending = nil
+	return []Entry{e}
+}
+
+// parseLine returns the entry that the line starts, or nil if the line
+// continues the previous entry.
+func (p *Parser) parseLine(line string) *Entry {
+	var ts time.Time
+	var level, msg string
+	var err error
+	if m := line57.FindStringSubmatch(line); m != nil {
+		ts, err = time.Parse(time.RFC3339Nano, m[1])
+		level, msg = m[2], m[3]
+	} else if m := line56.FindStringSubmatch(line); m != nil {
+		ts, err = time.ParseInLocation("2006-01-02 15:04:05", m[1], p.loc)
+		level, msg = m[2], m[3]
+	} else if m := line55.FindStringSubmatch(line); m != nil {
+		ts, err = time.ParseInLocation("060102 15:04:05", spaces.ReplaceAllString(m[1], " "), p.loc)
+		level, msg = m[2], m[3]
+	} else if m := lineCrash.FindStringSubmatch(line); m != nil {
+		// Time but no date: it's the crash that just happened.
+		now := p.now().UTC()
+		ts, err = time.Parse("2006-01-02 15:04:05", now.Format("2006-01-02 ")+m[1])
+		if ts.After(now) {
+			ts = ts.AddDate(0, 0, -1) // crashed just before midnight
+		}
+		level, msg = LEVEL_ERROR, m[2]
+	} else {
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	e := &Entry{
+		Ts:    ts.UTC(),
+		Level: normalizeLevel(level, msg),
+		Msg:   cut(msg),
+	}
+	setKind(e)
+	return e
+}
+
+func normalizeLevel(level, msg string) string {
+	switch strings.ToLower(level) {
+	case "error", "err":
+		return LEVEL_ERROR
+	case "warning", "warn":
+		return LEVEL_WARNING
+	case "note", "system", "information", "info":
+		return LEVEL_NOTE
+	}
+	return guessLevel(msg)
+}
+
+// guessLevel returns the level of a message without one, e.g. old InnoDB
+// messages like "InnoDB: Error: page 7 log sequence number...".
+func guessLevel(msg string) string {
+	lmsg := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lmsg, "error") || strings.Contains(lmsg, "assertion failure"):
+		return LEVEL_ERROR
+	case strings.Contains(lmsg, "warning"):
+		return LEVEL_WARNING
+	}
+	return LEVEL_NOTE
+}
+
+func setKind(e *Entry) {
+	lmsg := strings.ToLower(e.Msg)
+	switch {
+	case strings.Contains(lmsg, "mysqld got signal") || strings.Contains(lmsg, "mysqld got exception") || strings.Contains(lmsg, "assertion failure"):
+		e.Kind = KIND_CRASH
+	case strings.Contains(lmsg, "corrupt"):
+		e.Kind = KIND_CORRUPTION
+	default:
+		return
+	}
+	e.Level = LEVEL_ERROR
+}
+
+func cut(msg string) string {
+	if len(msg) > MAX_MSG_LEN {
+		return msg[0:MAX_MSG_LEN]
+	}
+	return msg
+}
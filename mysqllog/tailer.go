@@ -0,0 +1,342 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysqllog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+)
+
+const (
+	MAX_READ = 10 * 1024 * 1024 // bytes per interval, the rest is read next interval
+)
+
+// A Log is what's specific to the log a Tailer reads, e.g. the MySQL error log
+// or the audit log: where it is, and how its lines are parsed and spooled.
+type Log interface {
+	// Source returns the log file.  It's called every interval because it
+	// can change, e.g. @@log_error after a restart.
+	Source() (string, error)
+	// Send parses and spools the lines read from file, which don't have the
+	// trailing newline.  It returns the number of bytes of the lines that
+	// are done with, e.g. spooled or filtered: the rest are read again next
+	// interval.  If eof is true, the lines are the rest of a rotated file.
+	Send(now time.Time, file string, lines []string, eof bool) (int64, error)
+}
+
+// A TailerConfig is the config of a Tailer, e.g. Config.
+type TailerConfig interface {
+	Instance() proto.ServiceInstance
+	TickInterval() uint // seconds
+}
+
+// position is where a tailer stopped reading its log, saved so it continues
+// there when it's started again.
+type position struct {
+	File   string
+	Offset int64
+}
+
+/**
+ * A Tailer reads the new lines of one log every interval and passes them to
+ * its Log, which sends what it wants of them.  The first time, it starts at
+ * the end of the log: old lines aren't sent.  If it has a position file, its
+ * position is saved after the lines are sent, and it continues there when it's
+ * started again, e.g. after an agent restart, so lines aren't lost.  Lines the
+ * Log doesn't finish with, e.g. because the spool didn't take them, are read
+ * again next interval.  Rotations are detected by a pct.FileWatchdog, and the
+ * rest of the old file is read before the new one.
+ *
+ * NewTailer returns a Tailer for MySQL error logs; other packages, e.g.
+ * auditlog, make them with NewLogTailer and their own Log.
+ */
+type Tailer struct {
+	logger   *pct.Logger
+	name     string
+	config   TailerConfig
+	log      Log
+	tickChan chan time.Time
+	posFile  string // "" = don't save the position
+	// --
+	watchdog  *pct.FileWatchdog
+	file      string // log last read
+	offset    int64  // of file read
+	sync      *pct.SyncChan
+	status    *pct.Status
+	collected *pct.LastTs
+}
+
+func NewLogTailer(logger *pct.Logger, config TailerConfig, log Log, tickChan chan time.Time, posFile string) *Tailer {
+	name := logger.Service()
+	t := &Tailer{
+		logger:   logger,
+		name:     name,
+		config:   config,
+		log:      log,
+		tickChan: tickChan,
+		posFile:  posFile,
+		// --
+		watchdog:  pct.NewFileWatchdog(),
+		sync:      pct.NewSyncChan(),
+		status:    pct.NewStatus([]string{name}),
+		collected: pct.NewLastTs(pct.LAST_COLLECTED),
+	}
+	return t
+}
+
+func (t *Tailer) Start() {
+	t.status.Update(t.name, "Starting")
+	go t.run()
+}
+
+func (t *Tailer) Stop() {
+	t.sync.Stop()
+	t.sync.Wait()
+}
+
+func (t *Tailer) Config() TailerConfig {
+	return t.config
+}
+
+func (t *Tailer) TickChan() chan time.Time {
+	return t.tickChan
+}
+
+func (t *Tailer) Status() map[string]string {
+	status := t.status.Merge(t.collected.Status())
+	// Logs can report more, e.g. how many events were sent and filtered.
+	if s, ok := t.log.(pct.StatusReporter); ok {
+		for k, v := range s.Status() {
+			status[k] = v
+		}
+	}
+	return status
+}
+
+// --------------------------------------------------------------------------
+
+func (t *Tailer) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			t.logger.Error("Tailer crashed: ", err)
+		}
+		t.status.Update(t.name, "Stopped")
+		t.sync.Done()
+	}()
+	t.status.Update(t.name, "Idle")
+	for {
+		select {
+		case now := <-t.tickChan:
+			t.status.Update(t.name, "Reading")
+			if err := t.tail(now); err != nil {
+				t.logger.Warn(err)
+				t.status.Update(t.name, "Idle (error: "+err.Error()+")")
+				continue
+			}
+			t.status.Update(t.name, "Idle")
+		case <-t.sync.StopChan:
+			t.sync.Graceful()
+			return
+		}
+	}
+}
+
+func (t *Tailer) tail(now time.Time) error {
+	file, err := t.log.Source()
+	if err != nil {
+		return err
+	}
+
+	if t.file == "" {
+		if err := t.start(file); err != nil {
+			return err
+		}
+	}
+
+	rotation, err := t.watchdog.Check(file, t.offset)
+	if err != nil {
+		return err
+	}
+	if rotation != nil {
+		rotation.Report(t.logger, t.config.Instance())
+		if rotation.RotatedTo != "" {
+			// Nothing is written to the old file now, so read all of it.
+			// The position is in the new file after this, so if the lines
+			// can't be sent now, they're lost.
+			lines, _, err := readLines(rotation.RotatedTo, t.offset, true)
+			if err == nil {
+				_, err = t.log.Send(now, rotation.RotatedTo, lines, true)
+			}
+			if err != nil {
+				t.logger.Warn(fmt.Sprintf("Lost the end of %s: %s", rotation.RotatedTo, err))
+			}
+		}
+		t.offset = 0
+	}
+	t.file = file
+
+	lines, nRead, err := readLines(file, t.offset, false)
+	if err != nil {
+		return err
+	}
+	n, err := t.log.Send(now, file, lines, false)
+	if err == nil && n == 0 && nRead >= MAX_READ {
+		// A line or record larger than MAX_READ can't be read, skip it.
+		t.logger.Warn(fmt.Sprintf("Skipped %s of %s at offset %d: no complete line or record", pct.Bytes(uint64(nRead)), file, t.offset))
+		n = nRead
+	}
+
+	// Save the position of what was sent even if not all of it was, so it
+	// isn't sent again.
+	t.offset += n
+	if err := t.savePosition(); err != nil {
+		t.logger.Warn("Cannot save position: ", err)
+	}
+	if err != nil {
+		return err
+	}
+	t.collected.Mark(t.name, now)
+	return nil
+}
+
+// start sets where to start reading the log: the saved position if it's in
+// the file, else the end of the file.
+func (t *Tailer) start(file string) error {
+	size, err := pct.FileSize(file)
+	if err != nil {
+		return err
+	}
+	if err := t.watchdog.Reset(file); err != nil {
+		return err
+	}
+	offset := size
+	pos, err := t.loadPosition()
+	if err != nil {
+		t.logger.Warn("Cannot load position: ", err)
+	} else if pos.File == file {
+		if pos.Offset <= size {
+			offset = pos.Offset
+		} else {
+			// The log was rotated or truncated while stopped, so all
+			// of this one is new.
+			t.logger.Warn(fmt.Sprintf("%s is smaller than it was (%d < %d), reading from the start", file, size, pos.Offset))
+			offset = 0
+		}
+	} else if pos.File != "" {
+		t.logger.Warn(fmt.Sprintf("Log changed from %s to %s while stopped", pos.File, file))
+	}
+	t.file, t.offset = file, offset
+	t.logger.Info(fmt.Sprintf("Reading %s from offset %d", file, offset))
+	return nil
+}
+
+func (t *Tailer) loadPosition() (position, error) {
+	pos := position{}
+	if t.posFile == "" {
+		return pos, nil
+	}
+	data, err := ioutil.ReadFile(t.posFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pos, nil
+		}
+		return pos, err
+	}
+	err = json.Unmarshal(data, &pos)
+	return pos, err
+}
+
+func (t *Tailer) savePosition() error {
+	if t.posFile == "" {
+		return nil
+	}
+	if err := pct.MakeDir(filepath.Dir(t.posFile)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	data, err := json.Marshal(position{File: t.file, Offset: t.offset})
+	if err != nil {
+		return err
+	}
+	// Write then rename so the position is never partial.
+	if err := ioutil.WriteFile(t.posFile+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(t.posFile+".tmp", t.posFile)
+}
+
+// PositionFile returns the file the tailer, e.g. auditlog-mysql-1, saves its
+// position in.
+func PositionFile(name string) string {
+	return filepath.Join(pct.Basedir.Dir("history"), name+".json")
+}
+
+// RemovePosition removes the position of the tailer, e.g. when its instance is
+// removed.  It returns false if there was none.
+func RemovePosition(name string) (bool, error) {
+	err := os.Remove(PositionFile(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readLines returns the lines of file from offset to the end, at most MAX_READ
+// bytes, and the number of bytes read.  The last line is returned only if it
+// has a newline, so it's read when complete.  If all is true, e.g. for a rotated
+// file, the rest of the file is read: all of it and the last line regardless.
+func readLines(file string, offset int64, all bool) ([]string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		return nil, 0, err
+	}
+	var r io.Reader = f
+	if !all {
+		r = io.LimitReader(f, MAX_READ)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	nRead := int64(len(buf))
+	if !all {
+		if i := bytes.LastIndex(buf, []byte("\n")); i >= 0 {
+			buf = buf[0 : i+1]
+		} else {
+			buf = nil
+		}
+	}
+	if len(buf) == 0 {
+		return []string{}, nRead, nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	return lines, nRead, nil
+}
@@ -54,6 +54,8 @@ type APIConnector interface {
 	ApiKey() string
 	AgentUuid() string
 	URL(paths ...string) string
+	ProtocolVersion() int
+	DataContentTypes() []string
 }
 
 type API struct {
@@ -63,6 +65,8 @@ type API struct {
 	agentUuid  string
 	entryLinks map[string]string
 	agentLinks map[string]string
+	protocol   int
+	dataTypes  []string // accepted by API, see DataContentTypes
 	mux        *sync.RWMutex
 	client     *http.Client
 }
@@ -82,6 +86,7 @@ func NewAPI() *API {
 	a := &API{
 		origin:     "http://" + hostname,
 		agentLinks: make(map[string]string),
+		protocol:   PROTOCOL_V1,
 		mux:        new(sync.RWMutex),
 		client:     client,
 	}
@@ -142,16 +147,22 @@ func (a *API) Connect(hostname, apiKey, agentUuid string) error {
 	}
 
 	// Get entry links: GET <API hostname>/
-	entryLinks, err := a.getLinks(apiKey, schema+hostname)
+	// This request also negotiates the protocol version.
+	entryLinks, header, err := a.getLinks(apiKey, schema+hostname)
 	if err != nil {
 		return err
 	}
 	if err := a.checkLinks(entryLinks, requiredEntryLinks...); err != nil {
 		return err
 	}
+	protocol, err := NegotiatedVersion(header)
+	if err != nil {
+		return err
+	}
+	dataTypes := NegotiatedContentTypes(header)
 
 	// Get agent links: <API hostname>/agents/
-	agentLinks, err := a.getLinks(apiKey, entryLinks["agents"]+"/"+agentUuid)
+	agentLinks, _, err := a.getLinks(apiKey, entryLinks["agents"]+"/"+agentUuid)
 	if err != nil {
 		return err
 	}
@@ -167,6 +178,8 @@ func (a *API) Connect(hostname, apiKey, agentUuid string) error {
 	a.agentUuid = agentUuid
 	a.entryLinks = entryLinks
 	a.agentLinks = agentLinks
+	a.protocol = protocol
+	a.dataTypes = dataTypes
 	return nil
 }
 
@@ -192,36 +205,46 @@ func (a *API) checkLinks(links map[string]string, req ...string) error {
 	return nil
 }
 
-func (a *API) getLinks(apiKey, url string) (map[string]string, error) {
-	code, data, err := a.Get(apiKey, url)
+func (a *API) getLinks(apiKey, url string) (map[string]string, http.Header, error) {
+	code, header, data, err := a.get(apiKey, url)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if code >= 400 {
-		return nil, fmt.Errorf("Error %d from %s\n", code, url)
+		return nil, nil, ClassifyAPIError(code, fmt.Errorf("Error %d from %s", code, url))
 	} else if len(data) == 0 {
-		return nil, fmt.Errorf("OK response from %s but no content", url)
+		return nil, nil, fmt.Errorf("OK response from %s but no content", url)
 	}
 
 	links := &proto.Links{}
 	if err := json.Unmarshal(data, links); err != nil {
-		return nil, fmt.Errorf("GET %s error: json.Unmarshal: %s: %s", url, err, string(data))
+		return nil, nil, fmt.Errorf("GET %s error: json.Unmarshal: %s: %s", url, err, string(data))
 	}
 
-	return links.Links, nil
+	return links.Links, header, nil
 }
 
 func (a *API) Get(apiKey, url string) (int, []byte, error) {
+	code, _, data, err := a.get(apiKey, url)
+	return code, data, err
+}
+
+func (a *API) get(apiKey, url string) (int, http.Header, []byte, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
 	}
 	req.Header.Add("X-Percona-API-Key", apiKey)
+	req.Header.Add(PROTOCOL_HEADER, ProtocolVersionsHeader())
+	req.Header.Add(DATA_CONTENT_TYPES_HEADER, strings.Join(DataContentTypes, ", "))
 
 	// todo: timeout
 	resp, err := a.client.Do(req)
 	if err != nil {
-		return 0, nil, fmt.Errorf("GET %s error: client.Do: %s", url, err)
+		return 0, nil, nil, &APIError{
+			Category: apiErrorCategory(0, err),
+			Err:      fmt.Errorf("GET %s error: client.Do: %s", url, err),
+		}
 	}
 	defer resp.Body.Close()
 
@@ -230,20 +253,20 @@ func (a *API) Get(apiKey, url string) (int, []byte, error) {
 		buf := new(bytes.Buffer)
 		gz, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			return 0, nil, err
+			return 0, nil, nil, err
 		}
 		if _, err := io.Copy(buf, gz); err != nil {
-			return resp.StatusCode, nil, err
+			return resp.StatusCode, nil, nil, err
 		}
 		data = buf.Bytes()
 	} else {
 		data, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return resp.StatusCode, nil, fmt.Errorf("GET %s error: ioutil.ReadAll: %s", url, err)
+			return resp.StatusCode, nil, nil, fmt.Errorf("GET %s error: ioutil.ReadAll: %s", url, err)
 		}
 	}
 
-	return resp.StatusCode, data, nil
+	return resp.StatusCode, resp.Header, data, nil
 }
 
 func (a *API) EntryLink(resource string) string {
@@ -285,6 +308,25 @@ func (a *API) AgentUuid() string {
 	return a.agentUuid
 }
 
+// ProtocolVersion returns the protocol version negotiated by Connect,
+// PROTOCOL_V1 before then.
+func (a *API) ProtocolVersion() int {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.protocol
+}
+
+// DataContentTypes returns the data content types that the API accepts, as
+// negotiated by Connect, only CONTENT_TYPE_JSON before then.
+func (a *API) DataContentTypes() []string {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	if len(a.dataTypes) == 0 {
+		return []string{CONTENT_TYPE_JSON}
+	}
+	return a.dataTypes
+}
+
 func (a *API) Post(apiKey, url string, data []byte) (*http.Response, []byte, error) {
 	return a.send("POST", apiKey, url, data)
 }
@@ -0,0 +1,252 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+/**
+ * API errors are classified so that, for example, an expired API key is not
+ * mistaken for a network outage.  The category is part of the error message,
+ * of the <name>-api-error status, and of the agent/api-error/<category> event
+ * (see APIErrorReporter), and it sets the log and event level: auth errors
+ * are errors because only the user can fix them, the others are warnings
+ * because they're usually transient.
+ */
+const (
+	API_ERROR_AUTH     = "auth"     // 401, 403: bad or expired API key
+	API_ERROR_LIMIT    = "limit"    // 402, 429: quota or rate limit
+	API_ERROR_NETWORK  = "network"  // cannot connect, timeout, connection lost
+	API_ERROR_SERVER   = "server"   // 5xx
+	API_ERROR_REJECTED = "rejected" // websocket handshake refused (no code)
+	API_ERROR_OTHER    = "other"
+)
+
+const DEFAULT_API_ERROR_REPORT_INTERVAL = 5 * time.Minute
+
+type APIError struct {
+	Category string
+	Code     int // HTTP status code, if any
+	Err      error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API %s error: %s", e.Category, e.Err)
+}
+
+// ClassifyAPIError returns err as an APIError.  code is the HTTP status code
+// of the response, or zero if there's none.  If err is already an APIError,
+// it's returned as-is.
+func ClassifyAPIError(code int, err error) *APIError {
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr
+	}
+	if err == nil {
+		err = fmt.Errorf("HTTP status %d", code)
+	}
+	return &APIError{Category: apiErrorCategory(code, err), Code: code, Err: err}
+}
+
+func apiErrorCategory(code int, err error) string {
+	switch {
+	case code == 401 || code == 403:
+		return API_ERROR_AUTH
+	case code == 402 || code == 429:
+		return API_ERROR_LIMIT
+	case code >= 500:
+		return API_ERROR_SERVER
+	}
+	if dialErr, ok := err.(*websocket.DialError); ok {
+		// go.net/websocket doesn't return the status code of a failed
+		// handshake, only that it wasn't 101.
+		if dialErr.Err == websocket.ErrBadStatus {
+			return API_ERROR_REJECTED
+		}
+		err = dialErr.Err
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if _, ok := err.(net.Error); ok {
+		return API_ERROR_NETWORK
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return API_ERROR_NETWORK
+	}
+	return API_ERROR_OTHER
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// The API refuses to create more of a resource than the account allows with
+// 403 and an X-Percona-<resource>-Limit: <limit> header.
+var limitResources = map[string]string{
+	"agents": "agents",
+	"os":     "OS instances",
+	"mysql":  "MySQL instances",
+}
+
+type LimitError struct {
+	Resource string // e.g. agents, OS instances
+	Limit    string // as returned by the API
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("Maximum number of %s %s exceeded", e.Limit, e.Resource)
+}
+
+// CheckLimitHeaders returns an API_ERROR_LIMIT APIError with a LimitError if
+// resp has an X-Percona-<resource>-Limit header, else nil.
+func CheckLimitHeaders(resp *http.Response) *APIError {
+	if resp == nil {
+		return nil
+	}
+	for header, values := range resp.Header {
+		// Header names are canonical, e.g. X-Percona-Os-Limit.
+		h := strings.ToLower(header)
+		if !strings.HasPrefix(h, "x-percona-") || !strings.HasSuffix(h, "-limit") || len(values) == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(h, "x-percona-"), "-limit")
+		resource, ok := limitResources[name]
+		if !ok {
+			resource = name
+		}
+		return &APIError{
+			Category: API_ERROR_LIMIT,
+			Code:     resp.StatusCode,
+			Err:      LimitError{Resource: resource, Limit: values[0]},
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type apiErrorCount struct {
+	n          uint
+	first      time.Time
+	reported   time.Time
+	suppressed uint
+}
+
+/**
+ * APIErrorReporter logs API errors without flooding the log: an error is
+ * logged once per interval per category, then only counted, and the next
+ * error logged says how many were suppressed.  Every error logged is also
+ * sent as an event (see SendEvent) so the API can show it, e.g. that the
+ * agent's API key expired, once the agent can send data again.  Its status
+ * shows the last error and how many times its category occurred until
+ * Success() is called.
+ */
+type APIErrorReporter struct {
+	logger   *Logger
+	name     string
+	interval time.Duration
+	// --
+	errors map[string]*apiErrorCount
+	status *Status
+	mux    *sync.Mutex
+}
+
+func NewAPIErrorReporter(logger *Logger, name string, interval time.Duration) *APIErrorReporter {
+	r := &APIErrorReporter{
+		logger:   logger,
+		name:     name,
+		interval: interval,
+		// --
+		errors: make(map[string]*apiErrorCount),
+		status: NewStatus([]string{name + "-api-error"}),
+		mux:    new(sync.Mutex),
+	}
+	return r
+}
+
+// Report classifies, logs (or counts) the error, and returns it as an APIError.
+func (r *APIErrorReporter) Report(code int, err error) *APIError {
+	apiErr := ClassifyAPIError(code, err)
+	now := time.Now()
+
+	r.mux.Lock()
+
+	c, ok := r.errors[apiErr.Category]
+	if !ok {
+		c = &apiErrorCount{first: now}
+		r.errors[apiErr.Category] = c
+	}
+	c.n++
+	r.status.Update(r.name+"-api-error", fmt.Sprintf("%s at %s: %s (%d since %s)",
+		apiErr.Category, TimeString(now), apiErr.Err, c.n, TimeString(c.first)))
+
+	if !c.reported.IsZero() && now.Sub(c.reported) < r.interval {
+		c.suppressed++
+		r.logger.Debug("api-error:suppressed:", apiErr)
+		r.mux.Unlock()
+		return apiErr
+	}
+
+	msg := apiErr.Error()
+	if c.suppressed > 0 {
+		msg += fmt.Sprintf(" (%d more %s errors not logged since %s)", c.suppressed, apiErr.Category, TimeString(c.reported))
+	}
+	level := EVENT_WARNING
+	if apiErr.Category == API_ERROR_AUTH {
+		level = EVENT_ERROR
+		r.logger.Error(msg)
+	} else {
+		r.logger.Warn(msg)
+	}
+	c.reported = now
+	c.suppressed = 0
+	r.mux.Unlock()
+
+	// Not while locked: the event sink spools, which can report an API error.
+	SendEvent(Event{
+		Ts:      now.UTC(),
+		Type:    "agent/api-error/" + apiErr.Category,
+		Level:   level,
+		Message: r.name + ": " + msg,
+		Data:    map[string]int{"code": apiErr.Code},
+	})
+	return apiErr
+}
+
+// Success resets the counts and clears the status because the API works again.
+func (r *APIErrorReporter) Success() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.errors) == 0 {
+		return
+	}
+	r.errors = make(map[string]*apiErrorCount)
+	r.status.Update(r.name+"-api-error", "")
+}
+
+func (r *APIErrorReporter) Status() map[string]string {
+	return r.status.All()
+}
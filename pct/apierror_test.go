@@ -0,0 +1,150 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// apierror.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type APIErrorTestSuite struct {
+}
+
+var _ = Suite(&APIErrorTestSuite{})
+
+// logged returns the non-debug log entries in logChan.
+func logged(logChan chan *proto.LogEntry) []*proto.LogEntry {
+	entries := []*proto.LogEntry{}
+	for {
+		select {
+		case entry := <-logChan:
+			if entry.Level != proto.LOG_DEBUG {
+				entries = append(entries, entry)
+			}
+		default:
+			return entries
+		}
+	}
+}
+
+func (s *APIErrorTestSuite) TestClassifyAPIError(t *C) {
+	err := errors.New("oops")
+	t.Check(pct.ClassifyAPIError(401, err).Category, Equals, pct.API_ERROR_AUTH)
+	t.Check(pct.ClassifyAPIError(403, err).Category, Equals, pct.API_ERROR_AUTH)
+	t.Check(pct.ClassifyAPIError(429, err).Category, Equals, pct.API_ERROR_LIMIT)
+	t.Check(pct.ClassifyAPIError(503, nil).Category, Equals, pct.API_ERROR_SERVER)
+	t.Check(pct.ClassifyAPIError(0, err).Category, Equals, pct.API_ERROR_OTHER)
+	t.Check(pct.ClassifyAPIError(0, io.EOF).Category, Equals, pct.API_ERROR_NETWORK)
+
+	_, dialErr := net.Dial("tcp", "127.0.0.1:1") // nothing listens on port 1
+	t.Assert(dialErr, NotNil)
+	t.Check(pct.ClassifyAPIError(0, dialErr).Category, Equals, pct.API_ERROR_NETWORK)
+	t.Check(pct.ClassifyAPIError(0, &websocket.DialError{Err: dialErr}).Category, Equals, pct.API_ERROR_NETWORK)
+	t.Check(pct.ClassifyAPIError(0, &websocket.DialError{Err: websocket.ErrBadStatus}).Category, Equals, pct.API_ERROR_REJECTED)
+
+	// Already classified errors are not classified again.
+	apiErr := pct.ClassifyAPIError(401, err)
+	t.Check(pct.ClassifyAPIError(0, apiErr), Equals, apiErr)
+	t.Check(apiErr.Error(), Equals, "API auth error: oops")
+}
+
+func (s *APIErrorTestSuite) TearDownTest(t *C) {
+	pct.SetEventSink(nil)
+}
+
+func (s *APIErrorTestSuite) TestReporter(t *C) {
+	events := []pct.Event{}
+	pct.SetEventSink(func(e pct.Event) {
+		events = append(events, e)
+	})
+
+	logChan := make(chan *proto.LogEntry, 100)
+	logger := pct.NewLogger(logChan, "test")
+	r := pct.NewAPIErrorReporter(logger, "test", 200*time.Millisecond)
+	t.Check(r.Status(), DeepEquals, map[string]string{"test-api-error": ""})
+
+	// First error of each category is logged, auth errors as errors.
+	r.Report(401, errors.New("Error 401 from http://localhost/agents"))
+	r.Report(0, io.EOF)
+	entries := logged(logChan)
+	t.Assert(entries, HasLen, 2)
+	t.Check(entries[0].Level, Equals, proto.LOG_ERROR)
+	t.Check(entries[0].Msg, Equals, "API auth error: Error 401 from http://localhost/agents")
+	t.Check(entries[1].Level, Equals, proto.LOG_WARNING)
+
+	// And sent as events.
+	t.Assert(events, HasLen, 2)
+	t.Check(events[0].Type, Equals, "agent/api-error/auth")
+	t.Check(events[0].Level, Equals, pct.EVENT_ERROR)
+	t.Check(events[0].Message, Equals, "test: API auth error: Error 401 from http://localhost/agents")
+	t.Check(events[0].Data, DeepEquals, map[string]int{"code": 401})
+	t.Check(events[1].Type, Equals, "agent/api-error/network")
+	t.Check(events[1].Level, Equals, pct.EVENT_WARNING)
+
+	// Repeated errors are only counted until the interval passes.
+	r.Report(401, errors.New("Error 401 from http://localhost/agents"))
+	r.Report(401, errors.New("Error 401 from http://localhost/agents"))
+	t.Check(logged(logChan), HasLen, 0)
+	t.Check(events, HasLen, 2)
+	status := r.Status()["test-api-error"]
+	t.Check(strings.HasPrefix(status, "auth at "), Equals, true)
+	t.Check(strings.Contains(status, "(3 since "), Equals, true)
+
+	time.Sleep(300 * time.Millisecond)
+	r.Report(401, errors.New("Error 401 from http://localhost/agents"))
+	entries = logged(logChan)
+	t.Assert(entries, HasLen, 1)
+	t.Check(strings.Contains(entries[0].Msg, "(2 more auth errors not logged since "), Equals, true)
+
+	// Success clears the status and counts.
+	r.Success()
+	t.Check(r.Status()["test-api-error"], Equals, "")
+	r.Report(401, errors.New("Error 401 from http://localhost/agents"))
+	t.Check(logged(logChan), HasLen, 1)
+}
+
+func (s *APIErrorTestSuite) TestCheckLimitHeaders(t *C) {
+	resp := &http.Response{StatusCode: 403, Header: http.Header{}}
+	t.Check(pct.CheckLimitHeaders(resp), IsNil)
+	t.Check(pct.CheckLimitHeaders(nil), IsNil)
+
+	resp.Header.Set("X-Percona-OS-Limit", "3")
+	apiErr := pct.CheckLimitHeaders(resp)
+	t.Assert(apiErr, NotNil)
+	t.Check(apiErr.Category, Equals, pct.API_ERROR_LIMIT)
+	t.Check(apiErr.Code, Equals, 403)
+	t.Check(apiErr.Err, Equals, pct.LimitError{Resource: "OS instances", Limit: "3"})
+	t.Check(apiErr.Error(), Equals, "API limit error: Maximum number of 3 OS instances exceeded")
+
+	resp.Header = http.Header{}
+	resp.Header.Set("X-Percona-Agents-Limit", "5")
+	t.Check(pct.CheckLimitHeaders(resp).Err, Equals, pct.LimitError{Resource: "agents", Limit: "5"})
+}
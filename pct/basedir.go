@@ -18,11 +18,18 @@
 package pct
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+
+	"github.com/percona/cloud-protocol/proto/v1"
 )
 
 const (
@@ -33,32 +40,104 @@ const (
 	DATA_DIR     = "data"
 	BIN_DIR      = "bin"
 	TRASH_DIR    = "trash"
+	LATEST_DIR   = "latest"
+	QUEUE_DIR    = "queue"
+	HISTORY_DIR  = "history"
+	LATEST_FILE  = "latest.json"
 	START_LOCK   = "start.lock"
 	START_SCRIPT = "start.sh"
+	HANDOFF_FILE = "handoff.json"
+	SPOOL_KEY    = "spool.key"
+	DATA_LEDGER  = "data-ledger.json"
+	SEEDED_FILE  = ".seeded.json" // in the state config dir, see InitReadOnly
 )
 
 type basedir struct {
-	path      string
-	configDir string
-	dataDir   string
-	binDir    string
-	trashDir  string
+	path       string
+	statePath  string // path, or state dir if read-only
+	readOnly   bool
+	configDir  string
+	dataDir    string
+	binDir     string
+	trashDir   string
+	latestDir  string
+	queueDir   string
+	historyDir string
 }
 
 var Basedir basedir
 
+/**
+ * The agent writes configs, spooled data, and state (offsets, handoff, etc.)
+ * under its basedir.  Immutable images have a read-only basedir, so with
+ * InitReadOnly everything the agent writes goes under a writable state dir
+ * instead: config/, data/, trash/, latest/, queue/, history/, the files in
+ * File(), and the PID and log files if they're relative.  The basedir only
+ * has bin/ and the configs the image was built with, which are copied to the
+ * state config dir.  Configs are read from and written to the state config
+ * dir only.  An image config is copied again only if it's new or changed in
+ * the image since it was last copied, so the agent's changes to a config, or
+ * removing it, stick until the image changes it.  SEEDED_FILE in the state
+ * config dir has the SHA-256 of each image config last copied.
+ */
+
 func (b *basedir) Init(path string) error {
 	var err error
 	b.path, err = filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-
 	if err := MakeDir(b.path); err != nil && !os.IsExist(err) {
 		return err
 	}
+	b.statePath = b.path
+	b.readOnly = false
+	return b.initDirs()
+}
+
+// InitReadOnly inits a read-only basedir with a writable state dir.  It returns
+// an error if the basedir doesn't exist or the state dir isn't writable.
+func (b *basedir) InitReadOnly(path, stateDir string) error {
+	var err error
+	b.path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(b.path); err != nil {
+		return fmt.Errorf("Read-only basedir %s: %s", b.path, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("Read-only basedir %s is not a directory", b.path)
+	}
 
-	b.configDir = filepath.Join(b.path, CONFIG_DIR)
+	b.statePath, err = filepath.Abs(stateDir)
+	if err != nil {
+		return err
+	}
+	if b.statePath == b.path {
+		return fmt.Errorf("State dir cannot be the basedir: %s", b.statePath)
+	}
+	if err := MakeDir(b.statePath); err != nil {
+		return fmt.Errorf("Cannot make state dir %s: %s", b.statePath, err)
+	}
+	tmpFile, err := ioutil.TempFile(b.statePath, ".write-test.")
+	if err != nil {
+		return fmt.Errorf("State dir %s is not writable: %s", b.statePath, err)
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	b.readOnly = true
+
+	if err := b.initDirs(); err != nil {
+		return fmt.Errorf("State dir %s: %s", b.statePath, err)
+	}
+	if err := seedConfigs(filepath.Join(b.path, CONFIG_DIR), b.configDir); err != nil {
+		return fmt.Errorf("Cannot copy configs to state dir %s: %s", b.configDir, err)
+	}
+	return nil
+}
+
+func (b *basedir) initDirs() error {
+	b.configDir = filepath.Join(b.statePath, CONFIG_DIR)
 	if err := MakeDir(b.configDir); err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -66,28 +145,69 @@ func (b *basedir) Init(path string) error {
 		return err
 	}
 
-	b.dataDir = filepath.Join(b.path, DATA_DIR)
-	if err := MakeDir(b.dataDir); err != nil && !os.IsExist(err) {
+	b.dataDir = filepath.Join(b.statePath, DATA_DIR)
+	if err := makePrivateDir(b.dataDir); err != nil {
 		return err
 	}
 
+	// The bin dir is never written by the agent, only by the installer.
 	b.binDir = filepath.Join(b.path, BIN_DIR)
-	if err := MakeDir(b.binDir); err != nil && !os.IsExist(err) {
+	if !b.readOnly {
+		if err := MakeDir(b.binDir); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	b.trashDir = filepath.Join(b.statePath, TRASH_DIR)
+	if err := makePrivateDir(b.trashDir); err != nil {
 		return err
 	}
 
-	b.trashDir = filepath.Join(b.path, TRASH_DIR)
-	if err := MakeDir(b.trashDir); err != nil && !os.IsExist(err) {
+	b.latestDir = filepath.Join(b.statePath, LATEST_DIR)
+	if err := MakeDir(b.latestDir); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	b.queueDir = filepath.Join(b.statePath, QUEUE_DIR)
+	if err := makePrivateDir(b.queueDir); err != nil {
+		return err
+	}
+
+	b.historyDir = filepath.Join(b.statePath, HISTORY_DIR)
+	if err := makePrivateDir(b.historyDir); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// makePrivateDir makes dir with mode 0700 if it doesn't exist.  The mode of
+// an existing dir is only changed by CheckPermissions with fix (the
+// -fix-permissions flag) because the user may have set it on purpose.
+func makePrivateDir(dir string) error {
+	if FileExists(dir) {
+		return nil
+	}
+	if err := MakeDir(dir); err != nil {
+		return err
+	}
+	return os.Chmod(dir, 0700)
+}
+
 func (b *basedir) Path() string {
 	return b.path
 }
 
+// StatePath returns the dir for files the agent writes: the basedir, or the
+// state dir if the basedir is read-only.
+func (b *basedir) StatePath() string {
+	return b.statePath
+}
+
+func (b *basedir) ReadOnly() bool {
+	return b.readOnly
+}
+
 func (b *basedir) Dir(service string) string {
 	switch service {
 	case "config":
@@ -98,6 +218,12 @@ func (b *basedir) Dir(service string) string {
 		return b.binDir
 	case "trash":
 		return b.trashDir
+	case "latest":
+		return b.latestDir
+	case "queue":
+		return b.queueDir
+	case "history":
+		return b.historyDir
 	default:
 		log.Panic("Invalid service: " + service)
 	}
@@ -110,7 +236,7 @@ func (b *basedir) ConfigFile(service string) string {
 
 func (b *basedir) ReadConfig(service string, v interface{}) error {
 	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	data, err := ioutil.ReadFile(configFile)
+	data, err := b.ReadConfigFile(configFile)
 	if err != nil && !os.IsNotExist(err) {
 		// There's an error and it's not "file not found".
 		return err
@@ -121,18 +247,33 @@ func (b *basedir) ReadConfig(service string, v interface{}) error {
 	return err
 }
 
+// ReadConfigFile returns the contents of the config file with its variables
+// expanded (see expand.go).  Tools that read their config files directly,
+// not with ReadConfig, must use this.
+func (b *basedir) ReadConfigFile(configFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ExpandConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", configFile, err)
+	}
+	return data, nil
+}
+
 func (b *basedir) WriteConfig(service string, config interface{}) error {
 	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
 	data, err := json.MarshalIndent(config, "", "    ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(configFile, data, 0600)
+	return writeConfigFile(configFile, data)
 }
 
 func (b *basedir) WriteConfigString(service, config string) error {
 	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	return ioutil.WriteFile(configFile, []byte(config), 0600)
+	return writeConfigFile(configFile, []byte(config))
 }
 
 func (b *basedir) RemoveConfig(service string) error {
@@ -140,14 +281,216 @@ func (b *basedir) RemoveConfig(service string) error {
 	return RemoveFile(configFile)
 }
 
+/**
+ * WriteLatest writes the latest report of a tool (mm, qan, sysconfig) for a
+ * service instance to latest/<tool>/<service>-<instance id>/latest.json.
+ * Local scripts and health checks can read it instead of parsing the data
+ * spool or querying MySQL again.  The file is replaced atomically (written
+ * then renamed) so readers never see a partial report.  Nothing is written
+ * if the basedir isn't initialized, e.g. in tests.
+ */
+func (b *basedir) WriteLatest(tool string, si proto.ServiceInstance, v interface{}) error {
+	if b.latestDir == "" {
+		return nil
+	}
+	dir := filepath.Join(b.latestDir, tool, fmt.Sprintf("%s-%d", si.Service, si.InstanceId))
+	if err := MakeDir(dir); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(dir, LATEST_FILE+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) // fails after the rename, that's ok
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(dir, LATEST_FILE))
+}
+
+// LatestFile returns the latest.json file written by WriteLatest.
+func (b *basedir) LatestFile(tool string, si proto.ServiceInstance) string {
+	return filepath.Join(b.latestDir, tool, fmt.Sprintf("%s-%d", si.Service, si.InstanceId), LATEST_FILE)
+}
+
+// RemoveLatest removes the latest reports of every tool for the service
+// instance, e.g. when it's removed, and returns the tools that had one.
+func (b *basedir) RemoveLatest(si proto.ServiceInstance) ([]string, error) {
+	if b.latestDir == "" {
+		return nil, nil
+	}
+	dirs, err := filepath.Glob(filepath.Join(b.latestDir, "*", fmt.Sprintf("%s-%d", si.Service, si.InstanceId)))
+	if err != nil {
+		return nil, err
+	}
+	tools := []string{}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return tools, err
+		}
+		tools = append(tools, filepath.Base(filepath.Dir(dir)))
+	}
+	return tools, nil
+}
+
 func (b *basedir) File(file string) string {
 	switch file {
 	case "start-lock":
 		file = START_LOCK
 	case "start-script":
 		file = START_SCRIPT
+	case "handoff":
+		file = HANDOFF_FILE
+	case "spool-key":
+		file = SPOOL_KEY
+	case "data-ledger":
+		file = DATA_LEDGER
 	default:
 		log.Panicf("Unknown basedir file: %s", file)
 	}
-	return filepath.Join(b.Path(), file)
+	return filepath.Join(b.StatePath(), file)
+}
+
+// seedConfigs copies the config files in src that are new or changed since
+// they were last copied to dst, see SEEDED_FILE.  src not existing is not an
+// error: the image may have no configs.
+func seedConfigs(src, dst string) error {
+	files, err := filepath.Glob(filepath.Join(src, "*"+CONFIG_FILE_SUFFIX))
+	if err != nil {
+		return err
+	}
+	seededFile := filepath.Join(dst, SEEDED_FILE)
+	seeded := make(map[string]string)
+	if data, err := ioutil.ReadFile(seededFile); err == nil {
+		if err := json.Unmarshal(data, &seeded); err != nil {
+			return fmt.Errorf("%s: %s", seededFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	n := 0
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(file)
+		sum := sha256.Sum256(data)
+		if seeded[name] == hex.EncodeToString(sum[:]) {
+			continue // not changed in the image
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, name), data, 0600); err != nil {
+			return err
+		}
+		seeded[name] = hex.EncodeToString(sum[:])
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	data, err := json.Marshal(seeded)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(seededFile, data, 0600)
+}
+
+/**
+ * writeConfigFile writes the config data to the config file, keeping its
+ * variables (see expand.go).  Tools write their config when they start and
+ * when the API changes it, so without this the variables would be replaced
+ * by their values, e.g. a password from the environment would be saved in
+ * the file.  If the file has variables and, expanded, is the same config as
+ * data, it's not written.  Else every JSON string in data that's the same as
+ * the expanded string at the same place in the file is written as it is in
+ * the file, i.e. with its variables, and only the fields that changed are
+ * written as values.  The file is rewritten with its keys sorted.  A file
+ * that can't be re-templated (undefined variables, or variables outside JSON
+ * strings) is not overwritten: that's an error.
+ */
+func writeConfigFile(configFile string, data []byte) error {
+	cur, err := ioutil.ReadFile(configFile)
+	if err != nil || !bytes.Contains(cur, []byte("${")) {
+		return ioutil.WriteFile(configFile, data, 0600)
+	}
+	expanded, err := ExpandConfig(cur)
+	if err != nil {
+		return fmt.Errorf("Not overwriting %s: %s", configFile, err)
+	}
+	var template, old, v interface{}
+	if err := decodeConfig(data, &v); err != nil {
+		return err
+	}
+	if decodeConfig(expanded, &old) != nil {
+		// Not a valid config, so nothing to keep.
+		return ioutil.WriteFile(configFile, data, 0600)
+	}
+	if reflect.DeepEqual(old, v) {
+		return nil
+	}
+	if err := decodeConfig(cur, &template); err != nil {
+		return fmt.Errorf("Not overwriting %s: it has variables outside JSON strings", configFile)
+	}
+	data, err = json.MarshalIndent(retemplate(template, old, v), "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, data, 0600)
+}
+
+// decodeConfig decodes JSON data with numbers as json.Number so they're
+// written back as they are, not as floats.
+func decodeConfig(data []byte, v *interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// retemplate returns v with the strings that are the same as in old, the
+// expanded template, replaced by their values in template.
+func retemplate(template, old, v interface{}) interface{} {
+	switch t := template.(type) {
+	case string:
+		o, ok := old.(string)
+		if !ok || o == t {
+			break
+		}
+		if n, ok := v.(string); ok && n == o {
+			return t
+		}
+	case map[string]interface{}:
+		o, ok1 := old.(map[string]interface{})
+		n, ok2 := v.(map[string]interface{})
+		if !ok1 || !ok2 {
+			break
+		}
+		for k, nv := range n {
+			if _, ok := t[k]; ok {
+				n[k] = retemplate(t[k], o[k], nv)
+			}
+		}
+	case []interface{}:
+		o, ok1 := old.([]interface{})
+		n, ok2 := v.([]interface{})
+		if !ok1 || !ok2 || len(o) != len(t) {
+			break
+		}
+		for i := range n {
+			if i < len(t) {
+				n[i] = retemplate(t[i], o[i], n[i])
+			}
+		}
+	}
+	return v
 }
@@ -0,0 +1,341 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type BasedirTestSuite struct {
+	baseDir string
+}
+
+var _ = Suite(&BasedirTestSuite{})
+
+func (s *BasedirTestSuite) SetUpSuite(t *C) {
+	basedir, err := ioutil.TempDir("", "basedir-test-")
+	t.Assert(err, IsNil)
+	s.baseDir = basedir
+	if err := pct.Basedir.Init(s.baseDir); err != nil {
+		t.Errorf("Could initialize tmp Basedir: %v", err)
+	}
+}
+
+func (s *BasedirTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.baseDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *BasedirTestSuite) TestWriteLatest(t *C) {
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	file := pct.Basedir.LatestFile("mm", si)
+	t.Check(file, Equals, filepath.Join(s.baseDir, "latest", "mm", "mysql-1", "latest.json"))
+
+	// Each write replaces the previous report.
+	for _, n := range []int{1, 2} {
+		err := pct.Basedir.WriteLatest("mm", si, map[string]int{"n": n})
+		t.Assert(err, IsNil)
+
+		data, err := ioutil.ReadFile(file)
+		t.Assert(err, IsNil)
+		got := map[string]int{}
+		err = json.Unmarshal(data, &got)
+		t.Assert(err, IsNil)
+		t.Check(got["n"], Equals, n)
+	}
+
+	// Only latest.json, no temp files left behind.
+	files, err := ioutil.ReadDir(filepath.Dir(file))
+	t.Assert(err, IsNil)
+	t.Assert(files, HasLen, 1)
+	t.Check(files[0].Name(), Equals, "latest.json")
+}
+
+func (s *BasedirTestSuite) TestRemoveLatest(t *C) {
+	si1 := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+	si2 := proto.ServiceInstance{Service: "mysql", InstanceId: 2}
+	for _, tool := range []string{"mm", "qan"} {
+		err := pct.Basedir.WriteLatest(tool, si1, "report")
+		t.Assert(err, IsNil)
+	}
+	err := pct.Basedir.WriteLatest("mm", si2, "report")
+	t.Assert(err, IsNil)
+
+	tools, err := pct.Basedir.RemoveLatest(si1)
+	t.Assert(err, IsNil)
+	t.Check(tools, DeepEquals, []string{"mm", "qan"})
+	t.Check(pct.FileExists(pct.Basedir.LatestFile("mm", si1)), Equals, false)
+	t.Check(pct.FileExists(pct.Basedir.LatestFile("qan", si1)), Equals, false)
+	t.Check(pct.FileExists(pct.Basedir.LatestFile("mm", si2)), Equals, true)
+
+	tools, err = pct.Basedir.RemoveLatest(si1)
+	t.Assert(err, IsNil)
+	t.Check(tools, HasLen, 0)
+}
+
+func (s *BasedirTestSuite) TestCheckPermissions(t *C) {
+	// Init sets secure permissions.
+	problems, err := pct.Basedir.CheckPermissions("", false)
+	t.Assert(err, IsNil)
+	t.Check(problems, HasLen, 0)
+
+	configFile := pct.Basedir.ConfigFile("perms-test")
+	err = ioutil.WriteFile(configFile, []byte(`{"DSN":"user:pass@tcp/"}`), 0644)
+	t.Assert(err, IsNil)
+	defer os.Remove(configFile)
+	// WriteFile doesn't change the mode of an existing file.
+	t.Assert(os.Chmod(configFile, 0644), IsNil)
+	t.Assert(os.Chmod(pct.Basedir.Dir("data"), 0755), IsNil)
+	logFile := filepath.Join(s.baseDir, "agent.log")
+	t.Assert(ioutil.WriteFile(logFile, []byte("log"), 0640), IsNil)
+
+	// Init doesn't change the mode of existing dirs, only -fix-permissions does.
+	err = pct.Basedir.Init(s.baseDir)
+	t.Assert(err, IsNil)
+
+	problems, err = pct.Basedir.CheckPermissions(logFile, false)
+	t.Assert(err, IsNil)
+	t.Assert(problems, HasLen, 2)
+	t.Check(problems[0].Path, Equals, configFile)
+	t.Check(problems[0].Problem, Equals, "mode 0644, should be at most 0600")
+	t.Check(problems[0].Credentials, Equals, true)
+	t.Check(problems[0].Fatal(), Equals, true)
+	t.Check(problems[1].Path, Equals, pct.Basedir.Dir("data"))
+	t.Check(problems[1].Fatal(), Equals, false)
+
+	// Fix them.
+	problems, err = pct.Basedir.CheckPermissions(logFile, true)
+	t.Assert(err, IsNil)
+	t.Assert(problems, HasLen, 2)
+	t.Check(problems[0].Fixed, Equals, true)
+	t.Check(problems[0].Fatal(), Equals, false)
+	t.Check(problems[1].Fixed, Equals, true)
+	fi, err := os.Stat(configFile)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	problems, err = pct.Basedir.CheckPermissions(logFile, false)
+	t.Assert(err, IsNil)
+	t.Check(problems, HasLen, 0)
+}
+
+func (s *BasedirTestSuite) TestHandoff(t *C) {
+	// No handoff file, no handoff.
+	h, err := pct.LoadHandoff()
+	t.Check(err, IsNil)
+	t.Check(h, IsNil)
+
+	type state struct {
+		Offset int64
+	}
+	h = pct.NewHandoff()
+	err = h.Put("qan-mysql-1", state{Offset: 123})
+	t.Assert(err, IsNil)
+	err = pct.SaveHandoff(h)
+	t.Assert(err, IsNil)
+
+	// The new agent loads and removes the handoff file.
+	got, err := pct.LoadHandoff()
+	t.Assert(err, IsNil)
+	t.Assert(got, NotNil)
+	t.Check(got.Pid, Equals, os.Getpid())
+	t.Check(pct.FileExists(pct.Basedir.File("handoff")), Equals, false)
+
+	// State is taken only once.
+	st := state{}
+	ok, err := got.Take("qan-mysql-1", &st)
+	t.Check(err, IsNil)
+	t.Check(ok, Equals, true)
+	t.Check(st.Offset, Equals, int64(123))
+	ok, err = got.Take("qan-mysql-1", &st)
+	t.Check(err, IsNil)
+	t.Check(ok, Equals, false)
+
+	// Stale handoffs are ignored.
+	err = pct.SaveHandoff(h)
+	t.Assert(err, IsNil)
+	h.Ts = h.Ts.Add(-1 * (pct.HANDOFF_MAX_AGE + time.Minute))
+	data, _ := json.Marshal(h)
+	err = ioutil.WriteFile(pct.Basedir.File("handoff"), data, 0600)
+	t.Assert(err, IsNil)
+	got, err = pct.LoadHandoff()
+	t.Check(err, IsNil)
+	t.Check(got, IsNil)
+}
+
+func (s *BasedirTestSuite) TestReadOnly(t *C) {
+	defer pct.Basedir.Init(s.baseDir)
+
+	// An image with a read-only basedir and the agent config.
+	roDir := filepath.Join(s.baseDir, "ro")
+	stateDir := filepath.Join(s.baseDir, "state")
+	err := os.MkdirAll(filepath.Join(roDir, pct.CONFIG_DIR), 0755)
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(roDir, pct.CONFIG_DIR, "agent.conf"), []byte(`{"ApiKey":"123"}`), 0600)
+	t.Assert(err, IsNil)
+
+	err = pct.Basedir.InitReadOnly(roDir, stateDir)
+	t.Assert(err, IsNil)
+	t.Check(pct.Basedir.ReadOnly(), Equals, true)
+	t.Check(pct.Basedir.Path(), Equals, roDir)
+	t.Check(pct.Basedir.StatePath(), Equals, stateDir)
+
+	// Everything the agent writes is in the state dir, except bin/.
+	t.Check(pct.Basedir.ConfigFile("agent"), Equals, filepath.Join(stateDir, pct.CONFIG_DIR, "agent.conf"))
+	t.Check(pct.Basedir.Dir("data"), Equals, filepath.Join(stateDir, pct.DATA_DIR))
+	t.Check(pct.Basedir.Dir("queue"), Equals, filepath.Join(stateDir, pct.QUEUE_DIR))
+	t.Check(pct.Basedir.Dir("bin"), Equals, filepath.Join(roDir, pct.BIN_DIR))
+	t.Check(pct.Basedir.File("handoff"), Equals, filepath.Join(stateDir, pct.HANDOFF_FILE))
+	t.Check(pct.FileExists(filepath.Join(roDir, pct.DATA_DIR)), Equals, false)
+
+	// Image configs are copied to the state config dir...
+	config := map[string]string{}
+	err = pct.Basedir.ReadConfig("agent", &config)
+	t.Assert(err, IsNil)
+	t.Check(config["ApiKey"], Equals, "123")
+
+	// ...but not again if unchanged in the image, else removed configs
+	// would come back...
+	err = pct.Basedir.RemoveConfig("agent")
+	t.Assert(err, IsNil)
+	err = pct.Basedir.InitReadOnly(roDir, stateDir)
+	t.Assert(err, IsNil)
+	t.Check(pct.FileExists(pct.Basedir.ConfigFile("agent")), Equals, false)
+
+	// ...whereas configs new or changed in the image are.
+	err = ioutil.WriteFile(filepath.Join(roDir, pct.CONFIG_DIR, "agent.conf"), []byte(`{"ApiKey":"456"}`), 0600)
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(roDir, pct.CONFIG_DIR, "data.conf"), []byte(`{"Blackhole":""}`), 0600)
+	t.Assert(err, IsNil)
+	err = pct.Basedir.InitReadOnly(roDir, stateDir)
+	t.Assert(err, IsNil)
+	err = pct.Basedir.ReadConfig("agent", &config)
+	t.Assert(err, IsNil)
+	t.Check(config["ApiKey"], Equals, "456")
+	t.Check(pct.FileExists(pct.Basedir.ConfigFile("data")), Equals, true)
+
+	// Only the state dir is checked: the read-only basedir can't be fixed.
+	err = os.Chmod(roDir, 0777)
+	t.Assert(err, IsNil)
+	problems, err := pct.Basedir.CheckPermissions("", false)
+	t.Assert(err, IsNil)
+	for _, p := range problems {
+		t.Check(p.Path, Not(Equals), roDir)
+	}
+
+	// Clear errors for bad dirs.
+	err = pct.Basedir.InitReadOnly(filepath.Join(s.baseDir, "nonexistent"), stateDir)
+	t.Check(err, ErrorMatches, "Read-only basedir .+")
+	err = pct.Basedir.InitReadOnly(roDir, roDir)
+	t.Check(err, ErrorMatches, "State dir cannot be the basedir.+")
+}
+
+func (s *BasedirTestSuite) TestExpandConfig(t *C) {
+	os.Setenv("PCT_TEST_PASSWORD", `pa"ss`)
+	defer os.Setenv("PCT_TEST_PASSWORD", "")
+	hostname, _ := os.Hostname()
+
+	got, err := pct.ExpandConfig([]byte(`{"DSN":"user:${PCT_TEST_PASSWORD}@tcp(${PCT_TEST_HOST:-localhost})/","Prefix":"${HOSTNAME}","Literal":"$${PCT_TEST_PASSWORD}"}`))
+	t.Assert(err, IsNil)
+	config := map[string]string{}
+	err = json.Unmarshal(got, &config)
+	t.Assert(err, IsNil)
+	if os.Getenv("HOSTNAME") != "" {
+		hostname = os.Getenv("HOSTNAME")
+	}
+	t.Check(config, DeepEquals, map[string]string{
+		"DSN":     `user:pa"ss@tcp(localhost)/`,
+		"Prefix":  hostname,
+		"Literal": "${PCT_TEST_PASSWORD}",
+	})
+
+	// Every undefined variable is reported.
+	_, err = pct.ExpandConfig([]byte(`{"A":"${PCT_TEST_B}","B":"${PCT_TEST_A}","C":"${PCT_TEST_EMPTY:-}"}`))
+	t.Check(err, DeepEquals, pct.UndefinedVariableError{Vars: []string{"PCT_TEST_A", "PCT_TEST_B"}})
+
+	// Writing the same config, e.g. when a tool starts, keeps the variables
+	// in the file, but a field that changed is written as its new value.
+	template := `{"Password":"${PCT_TEST_PASSWORD}"}`
+	err = pct.Basedir.WriteConfigString("expand", template)
+	t.Assert(err, IsNil)
+	defer pct.Basedir.RemoveConfig("expand")
+	config = map[string]string{}
+	err = pct.Basedir.ReadConfig("expand", &config)
+	t.Assert(err, IsNil)
+	t.Check(config["Password"], Equals, `pa"ss`)
+	err = pct.Basedir.WriteConfig("expand", config)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(pct.Basedir.ConfigFile("expand"))
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, template)
+	config["Password"] = "new"
+	err = pct.Basedir.WriteConfig("expand", config)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(pct.Basedir.ConfigFile("expand"))
+	t.Assert(err, IsNil)
+	t.Check(string(data), Not(Equals), template)
+
+	// Changing another field keeps the variables of the fields that didn't
+	// change, including ones that are only part of a value.
+	template = `{"DSN":"user:${PCT_TEST_PASSWORD}@tcp(${PCT_TEST_HOST:-localhost})/","Hosts":["${PCT_TEST_HOST:-db1}","db2"],"Interval":60,"Password":"${PCT_TEST_PASSWORD}"}`
+	err = ioutil.WriteFile(pct.Basedir.ConfigFile("expand"), []byte(template), 0600)
+	t.Assert(err, IsNil)
+	var v struct {
+		DSN      string
+		Hosts    []string
+		Interval int64
+		Password string
+	}
+	err = pct.Basedir.ReadConfig("expand", &v)
+	t.Assert(err, IsNil)
+	t.Check(v.DSN, Equals, `user:pa"ss@tcp(localhost)/`)
+	v.Interval = 1000000
+	err = pct.Basedir.WriteConfig("expand", v)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(pct.Basedir.ConfigFile("expand"))
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(data), `"user:${PCT_TEST_PASSWORD}@tcp(${PCT_TEST_HOST:-localhost})/"`), Equals, true, Commentf(string(data)))
+	t.Check(strings.Contains(string(data), `"Password": "${PCT_TEST_PASSWORD}"`), Equals, true, Commentf(string(data)))
+	t.Check(strings.Contains(string(data), `"${PCT_TEST_HOST:-db1}"`), Equals, true, Commentf(string(data)))
+	t.Check(strings.Contains(string(data), "pa"), Equals, false, Commentf(string(data)))
+	got2 := v
+	err = pct.Basedir.ReadConfig("expand", &got2)
+	t.Assert(err, IsNil)
+	t.Check(got2, DeepEquals, v)
+
+	// Variables outside JSON strings can't be kept, so the file isn't
+	// overwritten.
+	template = `{"Interval":${PCT_TEST_INTERVAL:-60},"Password":"${PCT_TEST_PASSWORD}"}`
+	err = ioutil.WriteFile(pct.Basedir.ConfigFile("expand"), []byte(template), 0600)
+	t.Assert(err, IsNil)
+	err = pct.Basedir.WriteConfig("expand", map[string]interface{}{"Interval": 30, "Password": `pa"ss`})
+	t.Check(err, ErrorMatches, "Not overwriting .+: it has variables outside JSON strings")
+	data, err = ioutil.ReadFile(pct.Basedir.ConfigFile("expand"))
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, template)
+}
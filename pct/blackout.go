@@ -0,0 +1,246 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * A blackout is a schedule of minutes when a tool doesn't collect, e.g. while
+ * nightly backups lock tables, so the data doesn't pollute baselines or fire
+ * alerts.  It's a list of cron expressions (minute hour day-of-month month
+ * day-of-week) and the tool is blacked out during every minute any of them
+ * matches, e.g. "0-29 2 * * *" is 02:00 to 02:29 every day and "* 1-3 * * 0"
+ * is 01:00 to 03:59 every Sunday.  Fields are *, N, N-M, and lists of those,
+ * with an optional /step.  Like cron, times are local unless the expression
+ * begins with CRON_TZ=<zone>, e.g. "CRON_TZ=UTC 0-29 2 * * *", and if both
+ * day fields are restricted, a day matches if either field matches.
+ *
+ * Tools put a BlackoutTicker between the clock and their monitors: it drops
+ * ticks during blackout and tells the tool when a blackout starts and ends
+ * so the tool can record it in its reports.
+ */
+
+type Blackout struct {
+	exprs []*cronExpr
+}
+
+type cronExpr struct {
+	loc     *time.Location
+	fields  [5]uint64 // bit sets: minute, hour, day of month, month, day of week
+	anyDays [2]bool   // day of month and day of week are *
+}
+
+var cronFields = []struct {
+	name     string
+	min, max uint
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are Sunday
+}
+
+// NewBlackout returns the blackout for the cron expressions, or an error if
+// one is invalid.
+func NewBlackout(exprs []string) (*Blackout, error) {
+	b := &Blackout{
+		exprs: make([]*cronExpr, len(exprs)),
+	}
+	for i, expr := range exprs {
+		c, err := parseCron(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid blackout: %s: %s", expr, err)
+		}
+		b.exprs[i] = c
+	}
+	return b, nil
+}
+
+// In returns true if t is in the blackout.  A nil Blackout is never in.
+func (b *Blackout) In(t time.Time) bool {
+	if b == nil {
+		return false
+	}
+	for _, c := range b.exprs {
+		if c.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCron(expr string) (*cronExpr, error) {
+	c := &cronExpr{
+		loc: time.Local,
+	}
+	f := strings.Fields(expr)
+	if len(f) > 0 && strings.HasPrefix(f[0], "CRON_TZ=") {
+		loc, err := time.LoadLocation(strings.TrimPrefix(f[0], "CRON_TZ="))
+		if err != nil {
+			return nil, err
+		}
+		c.loc = loc
+		f = f[1:]
+	}
+	if len(f) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(cronFields), len(f))
+	}
+	for i, field := range f {
+		bits, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", cronFields[i].name, err)
+		}
+		c.fields[i] = bits
+	}
+	if c.fields[4]&(1<<7) != 0 {
+		c.fields[4] |= 1 // Sunday
+	}
+	c.anyDays[0] = f[2] == "*"
+	c.anyDays[1] = f[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max uint) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := uint(1)
+		if n := strings.Index(part, "/"); n >= 0 {
+			s, err := strconv.ParseUint(part[n+1:], 10, 8)
+			if err != nil || s == 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			step = uint(s)
+			part = part[:n]
+		}
+		first, last := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			n, err := strconv.ParseUint(r[0], 10, 8)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value: %s", part)
+			}
+			first, last = uint(n), uint(n)
+			if len(r) == 2 {
+				n, err := strconv.ParseUint(r[1], 10, 8)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value: %s", part)
+				}
+				last = uint(n)
+			} else if step > 1 {
+				last = max // N/step is N to max
+			}
+			if first < min || last > max || first > last {
+				return 0, fmt.Errorf("%s out of range %d-%d", part, min, max)
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronExpr) match(t time.Time) bool {
+	t = t.In(c.loc)
+	if c.fields[0]&(1<<uint(t.Minute())) == 0 ||
+		c.fields[1]&(1<<uint(t.Hour())) == 0 ||
+		c.fields[3]&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.fields[2]&(1<<uint(t.Day())) != 0
+	dow := c.fields[4]&(1<<uint(t.Weekday())) != 0
+	if !c.anyDays[0] && !c.anyDays[1] {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// --------------------------------------------------------------------------
+
+// A BlackoutTicker forwards ticks from the clock to a tool, except during the
+// blackout.  When a blackout starts and ends, it calls mark with the tick time,
+// true (started) or false (ended), and the ticker's stop chan: mark must not
+// block once the ticker is stopped, so if it has to wait, e.g. to send a marker
+// to the tool, it selects on the stop chan too and returns false if it
+// received from it.
+type BlackoutTicker struct {
+	blackout *Blackout
+	tickChan chan time.Time
+	mark     func(t time.Time, in bool, stopChan chan bool) bool
+	// --
+	clockChan chan time.Time
+	sync      *SyncChan
+}
+
+func NewBlackoutTicker(blackout *Blackout, tickChan chan time.Time, mark func(time.Time, bool, chan bool) bool) *BlackoutTicker {
+	bt := &BlackoutTicker{
+		blackout: blackout,
+		tickChan: tickChan,
+		mark:     mark,
+		// --
+		clockChan: make(chan time.Time),
+		sync:      NewSyncChan(),
+	}
+	return bt
+}
+
+// TickChan returns the chan to add to the clock instead of the tool's.
+func (bt *BlackoutTicker) TickChan() chan time.Time {
+	return bt.clockChan
+}
+
+func (bt *BlackoutTicker) Start() {
+	go bt.run()
+}
+
+func (bt *BlackoutTicker) Stop() {
+	bt.sync.Stop()
+	bt.sync.Wait()
+}
+
+func (bt *BlackoutTicker) run() {
+	defer bt.sync.Done()
+	in := false
+	for {
+		select {
+		case t := <-bt.clockChan:
+			if bt.blackout.In(t) != in {
+				in = !in
+				if !bt.mark(t, in, bt.sync.StopChan) {
+					return
+				}
+			}
+			if in {
+				continue
+			}
+			select {
+			case bt.tickChan <- t:
+			case <-bt.sync.StopChan:
+				return
+			}
+		case <-bt.sync.StopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type BlackoutTestSuite struct {
+}
+
+var _ = Suite(&BlackoutTestSuite{})
+
+func (s *BlackoutTestSuite) TestIn(t *C) {
+	b, err := pct.NewBlackout([]string{
+		"CRON_TZ=UTC 0-29 2 * * *",  // 02:00-02:29 daily
+		"CRON_TZ=UTC * 4-5 * * 0,7", // 04:00-05:59 Sundays
+		"CRON_TZ=UTC */15 6 1 * 3",  // 06:00, 06:15, ... on the 1st or Wednesdays
+	})
+	t.Assert(err, IsNil)
+
+	// 2015-03-01 is a Sunday.
+	in := map[string]bool{
+		"2015-03-02T01:59:00Z": false,
+		"2015-03-02T02:00:00Z": true,
+		"2015-03-02T02:29:59Z": true,
+		"2015-03-02T02:30:00Z": false,
+		"2015-03-01T04:00:00Z": true,
+		"2015-03-01T05:59:00Z": true,
+		"2015-03-01T06:00:00Z": true, // the 1st
+		"2015-03-02T04:00:00Z": false,
+		"2015-03-04T06:15:00Z": true, // Wednesday
+		"2015-03-04T06:16:00Z": false,
+		"2015-03-05T06:15:00Z": false,
+	}
+	for ts, expect := range in {
+		tm, _ := time.Parse(time.RFC3339, ts)
+		t.Check(b.In(tm), Equals, expect, Commentf(ts))
+	}
+
+	// Times in other zones are converted.
+	loc := time.FixedZone("UTC+2", 2*3600)
+	t.Check(b.In(time.Date(2015, 3, 2, 4, 10, 0, 0, loc)), Equals, true)
+
+	// No blackout.
+	var none *pct.Blackout
+	t.Check(none.In(time.Now()), Equals, false)
+	b, err = pct.NewBlackout(nil)
+	t.Assert(err, IsNil)
+	t.Check(b.In(time.Now()), Equals, false)
+}
+
+func (s *BlackoutTestSuite) TestInvalid(t *C) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"x * * * *",
+		"CRON_TZ=Nowhere/Foo * * * * *",
+	} {
+		_, err := pct.NewBlackout([]string{expr})
+		t.Check(err, NotNil, Commentf(expr))
+	}
+}
+
+func (s *BlackoutTestSuite) TestBlackoutTicker(t *C) {
+	b, err := pct.NewBlackout([]string{"CRON_TZ=UTC 0-29 2 * * *"})
+	t.Assert(err, IsNil)
+
+	type mark struct {
+		ts time.Time
+		in bool
+	}
+	marks := make(chan mark, 2)
+	tickChan := make(chan time.Time, 1)
+	bt := pct.NewBlackoutTicker(b, tickChan, func(ts time.Time, in bool, stopChan chan bool) bool {
+		marks <- mark{ts, in}
+		return true
+	})
+	bt.Start()
+	defer bt.Stop()
+
+	t1 := time.Date(2015, 3, 2, 1, 59, 0, 0, time.UTC)
+	t2 := time.Date(2015, 3, 2, 2, 0, 0, 0, time.UTC)
+	t3 := time.Date(2015, 3, 2, 2, 1, 0, 0, time.UTC)
+	t4 := time.Date(2015, 3, 2, 2, 30, 0, 0, time.UTC)
+
+	// Ticks outside the blackout are forwarded.
+	bt.TickChan() <- t1
+	t.Check(<-tickChan, Equals, t1)
+
+	// Ticks in the blackout are dropped, and its start is marked.
+	bt.TickChan() <- t2
+	bt.TickChan() <- t3
+	t.Check(<-marks, Equals, mark{t2, true})
+
+	// Its end is marked, then ticks are forwarded again.
+	bt.TickChan() <- t4
+	t.Check(<-marks, Equals, mark{t4, false})
+	t.Check(<-tickChan, Equals, t4)
+	select {
+	case ts := <-tickChan:
+		t.Errorf("Got tick during blackout: %s", ts)
+	case m := <-marks:
+		t.Errorf("Got extra mark: %+v", m)
+	default:
+	}
+}
+
+func (s *BlackoutTestSuite) TestBlackoutTickerStop(t *C) {
+	b, err := pct.NewBlackout([]string{"CRON_TZ=UTC 0-29 2 * * *"})
+	t.Assert(err, IsNil)
+
+	// The tool isn't receiving, e.g. it's being stopped, so the mark blocks
+	// until the ticker is stopped.
+	marking := make(chan bool, 1)
+	marks := make(chan bool)
+	bt := pct.NewBlackoutTicker(b, make(chan time.Time), func(ts time.Time, in bool, stopChan chan bool) bool {
+		marking <- true
+		select {
+		case marks <- in:
+			return true
+		case <-stopChan:
+			return false
+		}
+	})
+	bt.Start()
+	bt.TickChan() <- time.Date(2015, 3, 2, 2, 0, 0, 0, time.UTC)
+	<-marking
+
+	stopped := make(chan bool)
+	go func() {
+		bt.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(1 * time.Second):
+		t.Error("Stop blocked by mark")
+	}
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"sort"
+)
+
+/**
+ * Agent cmd Capabilities reports what this agent build and host can do so the
+ * API only offers configs the agent accepts.  Service managers that implement
+ * CapabilityReporter report their own capabilities, e.g. the monitors they can
+ * make, as "name" or "name:value" strings.  Optional features compiled in by
+ * build tags or OS-specific files are registered with RegisterFeature.
+ */
+
+// CapabilityReporter is an optional ServiceManager interface.
+type CapabilityReporter interface {
+	Capabilities() []string
+}
+
+var features = []string{}
+
+// RegisterFeature registers an optional feature compiled into the agent, e.g.
+// "mysql-option-file-watch:inotify".  Call it in an init() func.
+func RegisterFeature(feature string) {
+	for _, f := range features {
+		if f == feature {
+			return
+		}
+	}
+	features = append(features, feature)
+}
+
+// Features returns the registered features, sorted.
+func Features() []string {
+	f := make([]string, len(features))
+	copy(f, features)
+	sort.Strings(f)
+	return f
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type CapabilitiesTestSuite struct {
+}
+
+var _ = Suite(&CapabilitiesTestSuite{})
+
+func (s *CapabilitiesTestSuite) TestFeatures(t *C) {
+	pct.RegisterFeature("test-feature:b")
+	pct.RegisterFeature("test-feature:a")
+	pct.RegisterFeature("test-feature:b") // dupe ignored
+
+	n := 0
+	for _, f := range pct.Features() {
+		if f == "test-feature:a" || f == "test-feature:b" {
+			n++
+		}
+	}
+	t.Check(n, Equals, 2)
+
+	// Sorted copy, so callers can't change the registered features.
+	f := pct.Features()
+	for i := 1; i < len(f); i++ {
+		t.Check(f[i-1] < f[i], Equals, true)
+	}
+	f[0] = "changed"
+	t.Check(pct.Features()[0], Not(Equals), "changed")
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+)
+
+/**
+ * The API reconciles agent configs by re-sending StartService for tools that
+ * should be running, so a tool that's already running gets StartService again,
+ * usually with the same config.  Managers compare ConfigHash of the cmd data
+ * with the hash of the data the tool was started with: same config, nothing
+ * to do; different config, the tool is restarted with the new config.  The
+ * hash is of the JSON re-encoded with sorted keys, so key order and white
+ * space don't change it, but defaults do: a config with "Interval":60 and one
+ * without it are different even if 60 is the default.
+ */
+
+// ConfigHash returns the hash of a JSON config, or an error if it's not JSON.
+func ConfigHash(data []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(v) // maps are encoded with sorted keys
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(canonical)), nil
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type ConfigHashTestSuite struct {
+}
+
+var _ = Suite(&ConfigHashTestSuite{})
+
+func (s *ConfigHashTestSuite) TestConfigHash(t *C) {
+	h1, err := pct.ConfigHash([]byte(`{"Service":"mysql","InstanceId":1,"Interval":60}`))
+	t.Assert(err, IsNil)
+	t.Check(h1, Not(Equals), "")
+
+	// Key order and white space don't change the hash.
+	h2, err := pct.ConfigHash([]byte("{\n  \"Interval\": 60,\n  \"InstanceId\": 1,\n  \"Service\": \"mysql\"\n}"))
+	t.Assert(err, IsNil)
+	t.Check(h2, Equals, h1)
+
+	// Values and defaults do.
+	h3, err := pct.ConfigHash([]byte(`{"Service":"mysql","InstanceId":1,"Interval":10}`))
+	t.Assert(err, IsNil)
+	t.Check(h3, Not(Equals), h1)
+	h4, err := pct.ConfigHash([]byte(`{"Service":"mysql","InstanceId":1}`))
+	t.Assert(err, IsNil)
+	t.Check(h4, Not(Equals), h1)
+
+	_, err = pct.ConfigHash([]byte("not json"))
+	t.Check(err, NotNil)
+}
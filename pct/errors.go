@@ -19,6 +19,7 @@ package pct
 
 import (
 	"fmt"
+	"strings"
 )
 
 type ServiceIsRunningError struct {
@@ -126,3 +127,13 @@ type DuplicateServiceInstanceError struct {
 func (e DuplicateServiceInstanceError) Error() string {
 	return fmt.Sprintf("Duplicate %s instance: %d", e.Service, e.Id)
 }
+
+/////////////////////////////////////////////////////////////////////////////
+
+type UndefinedVariableError struct {
+	Vars []string
+}
+
+func (e UndefinedVariableError) Error() string {
+	return "Undefined config variables: " + strings.Join(e.Vars, ", ")
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"sync"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * Agent events are things the agent did or saw that the user should know
+ * about but that aren't from a monitor, e.g. an instance and its data were
+ * purged.  Anything can send one with SendEvent.  They're reported through
+ * the report stream like monitor events (see mm.Event): the agent sets the
+ * sink, which spools them as an mm report.  Events sent before the sink is
+ * set are kept, up to EVENT_BACKLOG, and sent when it's set.
+ */
+
+const (
+	EVENT_INFO    = "info"
+	EVENT_WARNING = "warning"
+	EVENT_ERROR   = "error"
+)
+
+const EVENT_BACKLOG = 100
+
+type Event struct {
+	proto.ServiceInstance           // the agent if Service is ""
+	Ts                    time.Time // UTC
+	Type                  string    // agent/instance/purge
+	Level                 string    // EVENT_INFO, EVENT_WARNING, or EVENT_ERROR
+	Message               string
+	Data                  interface{}
+}
+
+var (
+	eventSink    func(Event)
+	eventBacklog []Event
+	eventMux     = &sync.Mutex{}
+)
+
+// SetEventSink sets the func that reports events and sends it the events
+// sent before.  The sink must not block for long.
+func SetEventSink(sink func(Event)) {
+	eventMux.Lock()
+	eventSink = sink
+	backlog := eventBacklog
+	eventBacklog = nil
+	eventMux.Unlock()
+	if sink == nil {
+		return
+	}
+	for _, e := range backlog {
+		sink(e)
+	}
+}
+
+// SendEvent reports the event.  If Ts is zero, it's now.
+func SendEvent(e Event) {
+	if e.Ts.IsZero() {
+		e.Ts = time.Now().UTC()
+	}
+	eventMux.Lock()
+	sink := eventSink
+	if sink == nil {
+		if len(eventBacklog) < EVENT_BACKLOG {
+			eventBacklog = append(eventBacklog, e)
+		}
+		eventMux.Unlock()
+		return
+	}
+	eventMux.Unlock()
+	sink(e)
+}
@@ -0,0 +1,54 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type EventTestSuite struct {
+}
+
+var _ = Suite(&EventTestSuite{})
+
+func (s *EventTestSuite) SetUpTest(t *C) {
+	pct.SetEventSink(nil) // drop events sent by other tests
+}
+
+func (s *EventTestSuite) TearDownTest(t *C) {
+	pct.SetEventSink(nil)
+}
+
+func (s *EventTestSuite) TestSendEvent(t *C) {
+	// Events sent before the sink is set are sent when it's set.
+	pct.SendEvent(pct.Event{Type: "agent/test", Level: pct.EVENT_INFO, Message: "first"})
+
+	got := []pct.Event{}
+	pct.SetEventSink(func(e pct.Event) {
+		got = append(got, e)
+	})
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Message, Equals, "first")
+	t.Check(got[0].Ts.IsZero(), Equals, false)
+
+	pct.SendEvent(pct.Event{Type: "agent/test", Level: pct.EVENT_WARNING, Message: "second"})
+	t.Assert(got, HasLen, 2)
+	t.Check(got[1].Message, Equals, "second")
+	t.Check(got[1].Level, Equals, pct.EVENT_WARNING)
+}
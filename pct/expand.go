@@ -0,0 +1,76 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+)
+
+/**
+ * Config files can have ${NAME} variables which are replaced by the value
+ * of environment variable NAME when the config is read, so secrets like DSN
+ * passwords can be injected by the init system instead of being written in
+ * the file.  ${NAME:-default} is replaced by default if NAME is not set or
+ * empty, and $${ is a literal ${.  ${HOSTNAME} is the system hostname if the
+ * environment doesn't set it, e.g. "Prefix": "percona.${HOSTNAME}".
+ *
+ * Values are JSON-escaped because variables are usually inside JSON strings.
+ * Defaults are not: they're already in the JSON.  An undefined variable
+ * without a default is an error, so the config isn't used with an empty
+ * password, for example; use ${NAME:-} to allow an empty value.
+ */
+
+var configVarRe = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandConfig returns the config data with its variables replaced, or an
+// UndefinedVariableError listing every undefined variable.
+func ExpandConfig(data []byte) ([]byte, error) {
+	undefined := map[string]bool{}
+	expanded := configVarRe.ReplaceAllFunc(data, func(v []byte) []byte {
+		if string(v) == "$${" {
+			return []byte("${")
+		}
+		m := configVarRe.FindSubmatch(v)
+		name := string(m[1])
+		val := os.Getenv(name)
+		if val == "" && name == "HOSTNAME" {
+			val, _ = os.Hostname()
+		}
+		if val == "" {
+			if m[2] != nil {
+				return m[3] // default
+			}
+			undefined[name] = true
+			return nil
+		}
+		quoted, _ := json.Marshal(val)
+		return quoted[1 : len(quoted)-1]
+	})
+	if len(undefined) > 0 {
+		vars := make([]string, 0, len(undefined))
+		for name := range undefined {
+			vars = append(vars, name)
+		}
+		sort.Strings(vars)
+		return nil, UndefinedVariableError{Vars: vars}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"regexp"
+	"strings"
+)
+
+// GlobMatcher matches strings against a list of case-insensitive glob
+// patterns where * matches any characters and ? matches one character,
+// e.g. "innodb_*" or "com_s?????".  All patterns are compiled into one
+// regexp, so matching is fast enough to do for every metric every second.
+type GlobMatcher struct {
+	re *regexp.Regexp
+}
+
+func NewGlobMatcher(patterns []string) *GlobMatcher {
+	if len(patterns) == 0 {
+		return &GlobMatcher{}
+	}
+	alts := make([]string, len(patterns))
+	for i, p := range patterns {
+		p = regexp.QuoteMeta(p)
+		p = strings.Replace(p, `\*`, ".*", -1)
+		p = strings.Replace(p, `\?`, ".", -1)
+		alts[i] = p
+	}
+	// Patterns are quoted, so the regexp is always valid.
+	re := regexp.MustCompile("(?i)^(?:" + strings.Join(alts, "|") + ")$")
+	return &GlobMatcher{re: re}
+}
+
+// Match returns true if s matches any pattern.  It's always false if there
+// are no patterns.
+func (g *GlobMatcher) Match(s string) bool {
+	if g.re == nil {
+		return false
+	}
+	return g.re.MatchString(s)
+}
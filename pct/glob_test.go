@@ -0,0 +1,49 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type GlobTestSuite struct {
+}
+
+var _ = Suite(&GlobTestSuite{})
+
+func (s *GlobTestSuite) TestMatch(t *C) {
+	g := pct.NewGlobMatcher([]string{"innodb_*", "com_s?????", "threads_running"})
+	t.Check(g.Match("innodb_buffer_pool_pages_free"), Equals, true)
+	t.Check(g.Match("Innodb_rows_read"), Equals, true)
+	t.Check(g.Match("com_select"), Equals, true)
+	t.Check(g.Match("com_set_option"), Equals, false)
+	t.Check(g.Match("threads_running"), Equals, true)
+	t.Check(g.Match("threads_running2"), Equals, false)
+	t.Check(g.Match("xinnodb_rows_read"), Equals, false)
+
+	// Regexp meta chars are literal.
+	g = pct.NewGlobMatcher([]string{"a.b"})
+	t.Check(g.Match("a.b"), Equals, true)
+	t.Check(g.Match("axb"), Equals, false)
+
+	// No patterns, no matches.
+	g = pct.NewGlobMatcher(nil)
+	t.Check(g.Match(""), Equals, false)
+	t.Check(g.Match("foo"), Equals, false)
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/**
+ * A Handoff is tool state that an agent saves when it restarts (the Restart
+ * cmd) so the new agent resumes where the old one stopped, e.g. QAN resumes
+ * parsing the slow log at the old agent's offset instead of the end of the
+ * file, so no interval is lost.  The old agent saves the handoff file just
+ * before starting the new agent; the new agent loads and removes it before
+ * starting services.  Services that can hand off implement StateHandoff.
+ * Stale handoffs are ignored because the state no longer matches reality,
+ * e.g. the slow log has been rotated.
+ *
+ * QAN hands off its resumable (slow log) analyzers, and mm hands off the
+ * last value of its counters so the new agent's first collection has a rate
+ * (see mm/handoff.go).  Other tools start fresh, e.g. sysconfig has no state
+ * between intervals.
+ */
+
+const HANDOFF_MAX_AGE = 5 * time.Minute
+
+type StateHandoff interface {
+	// Handoff stops the service without undoing anything the new agent
+	// needs (e.g. MySQL config) and saves its state in the handoff.
+	Handoff(*Handoff) error
+	// Resume sets the state to resume from when the service is started.
+	Resume(*Handoff) error
+}
+
+type Handoff struct {
+	Ts    time.Time                   // when saved, UTC
+	Pid   int                         // of the agent that saved it
+	State map[string]*json.RawMessage // keyed on tool name
+}
+
+func NewHandoff() *Handoff {
+	h := &Handoff{
+		Pid:   os.Getpid(),
+		State: make(map[string]*json.RawMessage),
+	}
+	return h
+}
+
+// Put saves the tool's state.
+func (h *Handoff) Put(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// Pointer because a json.RawMessage map value is encoded as base64 (not
+	// addressable so its MarshalJSON isn't called) before Go 1.8.
+	raw := json.RawMessage(data)
+	h.State[name] = &raw
+	return nil
+}
+
+// Take loads the tool's state into v and removes it so the state is only
+// resumed once.  It returns false if there's no state for the tool.
+func (h *Handoff) Take(name string, v interface{}) (bool, error) {
+	data, ok := h.State[name]
+	if !ok {
+		return false, nil
+	}
+	delete(h.State, name)
+	if err := json.Unmarshal(*data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func SaveHandoff(h *Handoff) error {
+	h.Ts = time.Now().UTC()
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(Basedir.File("handoff"), data, 0600)
+}
+
+// LoadHandoff loads and removes the handoff file.  It returns nil if there's
+// no handoff file or it's older than HANDOFF_MAX_AGE.
+func LoadHandoff() (*Handoff, error) {
+	file := Basedir.File("handoff")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := os.Remove(file); err != nil {
+		return nil, err
+	}
+	h := &Handoff{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	if time.Now().UTC().Sub(h.Ts) > HANDOFF_MAX_AGE {
+		return nil, nil
+	}
+	if h.State == nil {
+		h.State = make(map[string]*json.RawMessage)
+	}
+	return h, nil
+}
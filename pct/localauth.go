@@ -0,0 +1,231 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Local endpoints (HTTP over a Unix socket or TCP) expose agent status and
+ * configs, which have DSNs, so they're authenticated with LocalAuth before
+ * they're enabled on shared hosts:
+ *
+ *   Unix sockets  The peer's credentials (SO_PEERCRED) must be root, the user
+ *                 running the agent, or one of LocalAuthConfig.SocketUsers.
+ *                 Without peer credentials (non-Linux) the socket is 0600 and
+ *                 SocketUsers isn't supported.
+ *   Token         If TokenFile is set, HTTP requests must have its token as
+ *                 "Authorization: Bearer <token>" or LOCAL_TOKEN_HEADER.  The
+ *                 file must not be readable by group or other.
+ *   Mutual TLS    If TLSCert and TLSKey are set, TCP endpoints serve HTTPS,
+ *                 and with TLSClientCA clients must have a cert it signed.
+ *
+ * TCP endpoints are reachable by every local user, so they require a token or
+ * mutual TLS.  Endpoints use LocalAuth.Listen and LocalAuth.Handler.
+ */
+
+const LOCAL_TOKEN_HEADER = "X-Percona-Agent-Token"
+
+var ErrPeerCredUnsupported = errors.New("Unix socket peer credentials are not supported on this OS")
+
+// LocalAuthConfig is agent.Config.LocalAuth.
+type LocalAuthConfig struct {
+	SocketUsers []string // user names or UIDs allowed besides root and the agent user
+	TokenFile   string   // require the token in this file
+	TLSCert     string   // cert file for HTTPS on TCP endpoints
+	TLSKey      string   // key file for TLSCert
+	TLSClientCA string   // require client certs signed by this CA
+}
+
+type LocalAuth struct {
+	uids      map[uint32]bool // allowed Unix socket peers
+	others    bool            // SocketUsers, so the socket is 0666
+	token     string          // "" if no TokenFile
+	tlsConfig *tls.Config     // nil if no TLSCert
+}
+
+func NewLocalAuth(config LocalAuthConfig) (*LocalAuth, error) {
+	a := &LocalAuth{
+		uids: map[uint32]bool{
+			0:                   true,
+			uint32(os.Getuid()): true,
+		},
+	}
+
+	for _, name := range config.SocketUsers {
+		uid, err := lookupUid(name)
+		if err != nil {
+			return nil, err
+		}
+		a.uids[uid] = true
+		a.others = true
+	}
+
+	if config.TokenFile != "" {
+		info, err := os.Stat(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("Token file %s is mode %#o, should be at most 0600", config.TokenFile, info.Mode().Perm())
+		}
+		bytes, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.token = strings.TrimSpace(string(bytes))
+		if a.token == "" {
+			return nil, errors.New("Token file is empty: " + config.TokenFile)
+		}
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		a.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		if config.TLSClientCA != "" {
+			pem, err := ioutil.ReadFile(config.TLSClientCA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("No certs in TLSClientCA " + config.TLSClientCA)
+			}
+			a.tlsConfig.ClientCAs = pool
+			a.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.TLSClientCA != "" {
+		return nil, errors.New("TLSClientCA requires TLSCert and TLSKey")
+	}
+
+	if len(config.SocketUsers) > 0 && !peerCredSupported {
+		return nil, ErrPeerCredUnsupported
+	}
+
+	return a, nil
+}
+
+// Listen listens on a Unix socket ("unix") or TCP ("tcp") address.  Unix
+// socket connections from peers that aren't allowed are closed when accepted.
+// TCP requires a token or mutual TLS, and serves TLS if configured.
+func (a *LocalAuth) Listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case "unix":
+		os.Remove(addr) // stale socket from previous agent
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		mode := os.FileMode(0600)
+		if a.others {
+			mode = 0666 // peer credentials are checked
+		}
+		if err := os.Chmod(addr, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return &peerListener{Listener: l, uids: a.uids}, nil
+	case "tcp":
+		if a.token == "" && (a.tlsConfig == nil || a.tlsConfig.ClientCAs == nil) {
+			return nil, errors.New("Local TCP endpoint " + addr + " requires TokenFile or TLSClientCA")
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if a.tlsConfig != nil {
+			return tls.NewListener(l, a.tlsConfig), nil
+		}
+		return l, nil
+	}
+	return nil, errors.New("Invalid local endpoint network: " + network)
+}
+
+// Handler returns h wrapped to require the token, if any.
+func (a *LocalAuth) Handler(h http.Handler) http.Handler {
+	if a.token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(LOCAL_TOKEN_HEADER)
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// --------------------------------------------------------------------------
+
+type peerListener struct {
+	net.Listener
+	uids map[uint32]bool
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !peerCredSupported {
+			return conn, nil // socket is 0600
+		}
+		uid, err := peerUid(conn)
+		if err == nil && l.uids[uid] {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func lookupUid(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(uid), nil
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type LocalAuthTestSuite struct {
+	tmpDir string
+}
+
+var _ = Suite(&LocalAuthTestSuite{})
+
+func (s *LocalAuthTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "localauth-test-")
+	t.Assert(err, IsNil)
+}
+
+func (s *LocalAuthTestSuite) TearDownSuite(t *C) {
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *LocalAuthTestSuite) TestUnixSocketToken(t *C) {
+	tokenFile := filepath.Join(s.tmpDir, "token")
+	err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0644)
+	t.Assert(err, IsNil)
+
+	// Token file readable by others is an error.
+	_, err = pct.NewLocalAuth(pct.LocalAuthConfig{TokenFile: tokenFile})
+	t.Check(err, NotNil)
+
+	err = os.Chmod(tokenFile, 0600)
+	t.Assert(err, IsNil)
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{
+		TokenFile:   tokenFile,
+		SocketUsers: []string{strconv.Itoa(os.Getuid())},
+	})
+	t.Assert(err, IsNil)
+
+	socket := filepath.Join(s.tmpDir, "agent.sock")
+	l, err := auth.Listen("unix", socket)
+	t.Assert(err, IsNil)
+	defer l.Close()
+	go http.Serve(l, auth.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+
+	// This process is an allowed peer, but has no token.
+	resp, err := client.Get("http://agent/status")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	req, _ := http.NewRequest("GET", "http://agent/status", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err = client.Do(req)
+	t.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(string(body), Equals, "ok")
+
+	req, _ = http.NewRequest("GET", "http://agent/status", nil)
+	req.Header.Set(pct.LOCAL_TOKEN_HEADER, "wrong")
+	resp, err = client.Do(req)
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (s *LocalAuthTestSuite) TestInsecureTCP(t *C) {
+	auth, err := pct.NewLocalAuth(pct.LocalAuthConfig{})
+	t.Assert(err, IsNil)
+
+	// Every local user can connect to TCP, so it requires a token or mTLS.
+	_, err = auth.Listen("tcp", "127.0.0.1:0")
+	t.Check(err, NotNil)
+
+	_, err = pct.NewLocalAuth(pct.LocalAuthConfig{TLSClientCA: "/etc/ssl/ca.pem"})
+	t.Check(err, NotNil)
+
+	_, err = pct.NewLocalAuth(pct.LocalAuthConfig{SocketUsers: []string{"no-such-user-xyz"}})
+	t.Check(err, NotNil)
+}
@@ -82,7 +82,7 @@ func (l *Logger) log(offline bool, level byte, entry []interface{}) {
 		Ts:      time.Now().UTC(),
 		Level:   level,
 		Service: l.service,
-		Msg:     fullMsg,
+		Msg:     RedactDSNs(fullMsg),
 		Offline: offline,
 	}
 	select {
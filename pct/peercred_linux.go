@@ -0,0 +1,65 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+)
+
+const peerCredSupported = true
+
+// peerUid returns the UID of the process on the other end of a Unix socket.
+// It doesn't use unixConn.File() because on older Go that puts the socket in
+// blocking mode, so reads ignore deadlines and each one ties up a thread.
+func peerUid(conn net.Conn) (uint32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, ErrPeerCredUnsupported
+	}
+	fd, ok := sysfd(unixConn)
+	if !ok {
+		return 0, ErrPeerCredUnsupported
+	}
+	cred, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
+
+// sysfd returns the file descriptor of the conn.  The net package doesn't
+// export it (SyscallConn is Go 1.9), so it's read from the conn's netFD:
+// sysfd before Go 1.9, pfd.Sysfd since.
+func sysfd(conn *net.UnixConn) (int, bool) {
+	netFD := reflect.ValueOf(conn).Elem().FieldByName("fd")
+	if !netFD.IsValid() || netFD.Kind() != reflect.Ptr || netFD.IsNil() {
+		return 0, false
+	}
+	netFD = netFD.Elem()
+	if fd := netFD.FieldByName("sysfd"); fd.IsValid() {
+		return int(fd.Int()), true
+	}
+	if pfd := netFD.FieldByName("pfd"); pfd.IsValid() {
+		if fd := pfd.FieldByName("Sysfd"); fd.IsValid() {
+			return int(fd.Int()), true
+		}
+	}
+	return 0, false
+}
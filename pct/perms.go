@@ -0,0 +1,147 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/**
+ * CheckPermissions checks that the agent's files aren't readable or
+ * writable by other users.  This matters most for configs: agent.conf has
+ * the API key and instance configs have DSNs with passwords.  Each path can
+ * have at most these permissions:
+ *
+ *   basedir (or state dir)   0755  (no group/other write)
+ *   config/                  0700
+ *   config/*.conf            0600  (credentials)
+ *   data/, queue/, trash/,
+ *   history/                 0700  (spooled data can have queries)
+ *   log file                 0640
+ *
+ * and it must be owned by the user running the agent.  If fix is true,
+ * extra permissions are removed; ownership is only reported.  The agent
+ * refuses to run if a credential file is still world-readable, see
+ * PermissionProblem.Fatal.  latest/ is skipped: it's meant to be read by
+ * local scripts.
+ */
+
+type PermissionProblem struct {
+	Path        string
+	Problem     string // e.g. "mode 0644, should be at most 0600"
+	Mode        os.FileMode
+	Credentials bool // has the API key or DSN passwords
+	Fixed       bool
+}
+
+func (p PermissionProblem) String() string {
+	s := p.Path + ": " + p.Problem
+	if p.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+// Fatal returns true if the problem is a world-readable credential file
+// that wasn't fixed.
+func (p PermissionProblem) Fatal() bool {
+	return p.Credentials && !p.Fixed && p.Mode&0004 != 0
+}
+
+func (b *basedir) CheckPermissions(logFile string, fix bool) ([]PermissionProblem, error) {
+	problems := []PermissionProblem{}
+	check := func(path string, max os.FileMode, credentials bool) error {
+		p, err := checkPermissions(path, max, credentials, fix)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		problems = append(problems, p...)
+		return nil
+	}
+
+	// A read-only basedir can't be fixed, and has no credentials the agent
+	// writes, so only its state dir is checked.
+	if err := check(b.statePath, 0755, false); err != nil {
+		return nil, err
+	}
+	if err := check(b.configDir, 0700, false); err != nil {
+		return nil, err
+	}
+	configFiles, err := filepath.Glob(filepath.Join(b.configDir, "*"+CONFIG_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range configFiles {
+		if err := check(file, 0600, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range []string{b.dataDir, b.queueDir, b.trashDir, b.historyDir} {
+		if err := check(dir, 0700, false); err != nil {
+			return nil, err
+		}
+	}
+	if logFile != "" {
+		if err := check(logFile, 0640, false); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+func checkPermissions(path string, max os.FileMode, credentials bool, fix bool) ([]PermissionProblem, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	problems := []PermissionProblem{}
+
+	mode := fi.Mode().Perm()
+	if extra := mode &^ max; extra != 0 {
+		p := PermissionProblem{
+			Path:        path,
+			Problem:     fmt.Sprintf("mode %04o, should be at most %04o", mode, max),
+			Mode:        mode,
+			Credentials: credentials,
+		}
+		if fix {
+			if err := os.Chmod(path, mode&max); err != nil {
+				p.Problem += fmt.Sprintf(": cannot fix: %s", err)
+			} else {
+				p.Fixed = true
+			}
+		}
+		problems = append(problems, p)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		problems = append(problems, PermissionProblem{
+			Path:    path,
+			Problem: fmt.Sprintf("owned by uid %d, agent runs as uid %d", st.Uid, os.Getuid()),
+			Mode:    mode,
+		})
+	}
+
+	return problems, nil
+}
@@ -61,18 +61,19 @@ func (p *PidFile) Set(pidFile string) error {
 		return nil
 	}
 	// Two kind of pidFile values are accepted.
-	// User provided an pidFile name with and absolute path that is equal to basedir.
+	// User provided an pidFile name with and absolute path that is equal to basedir
+	// (the state dir if the basedir is read-only).
 	// User provided relative path that has no path whatsoever.
 	// Any other case should return an error.
 	if filepath.IsAbs(pidFile) {
-		if filepath.Dir(pidFile) != Basedir.Path() {
+		if filepath.Dir(pidFile) != Basedir.StatePath() {
 			return errors.New("absolute pidfile path should be equals to basedir")
 		}
 	} else {
 		if filepath.Dir(pidFile) != "." {
 			return errors.New("relative pidfile should not contain any paths")
 		}
-		pidFile = filepath.Join(Basedir.Path(), pidFile)
+		pidFile = filepath.Join(Basedir.StatePath(), pidFile)
 	}
 
 	// Create new PID file, success only if it doesn't already exist.
@@ -0,0 +1,150 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * The agent and API negotiate the protocol version when the agent connects
+ * so one agent binary works with old and new APIs during a migration.  The
+ * agent sends the versions it speaks, most preferred first, in the
+ * PROTOCOL_HEADER of the entry links request, e.g. "2, 1".  An API that
+ * knows about versions responds with the one it chose in the same header.
+ * An old API doesn't, so no header means PROTOCOL_V1.  The ws client then
+ * requests the chosen version in its handshake and uses the Protocol for
+ * that version to decode cmds and encode replies.
+ *
+ * Only v1, the plain JSON of cloud-protocol, exists.  New versions must be
+ * defined in cloud-protocol first, then added here with their Protocol.
+ */
+
+const (
+	PROTOCOL_V1     = 1
+	PROTOCOL_HEADER = "X-Percona-Protocol"
+)
+
+// Supported protocol versions, most preferred first.
+var ProtocolVersions = []int{PROTOCOL_V1}
+
+/**
+ * Data content types are negotiated the same way: the agent sends the types
+ * it can encode data as, most preferred first, in the DATA_CONTENT_TYPES_HEADER
+ * of the entry links request, and the API responds with the types it accepts.
+ * No header means the API only accepts JSON.  The data spooler encodes data as
+ * the configured type only if the API accepts it, see data.NegotiatedSerializer.
+ * CONTENT_TYPE_BATCH isn't an encoding of data: an API that accepts it takes
+ * many spool files in one upload, see data/batch.go.
+ */
+
+const (
+	DATA_CONTENT_TYPES_HEADER = "X-Percona-Data-Content-Types"
+	CONTENT_TYPE_JSON         = "application/json"
+	CONTENT_TYPE_MSGPACK      = "application/x-msgpack"
+	CONTENT_TYPE_BATCH        = "application/x-percona-batch"
+)
+
+// Supported data content types, most preferred first.
+var DataContentTypes = []string{CONTENT_TYPE_MSGPACK, CONTENT_TYPE_JSON, CONTENT_TYPE_BATCH}
+
+// A Protocol encodes and decodes the cmd/reply messages of one version.
+type Protocol interface {
+	Version() int
+	DecodeCmd(data []byte) (*proto.Cmd, error)
+	EncodeReply(reply *proto.Reply) ([]byte, error)
+}
+
+func NewProtocol(version int) (Protocol, error) {
+	switch version {
+	case PROTOCOL_V1:
+		return protocolV1{}, nil
+	}
+	return nil, fmt.Errorf("Unsupported protocol version: %d", version)
+}
+
+// ProtocolVersionsHeader returns the value of PROTOCOL_HEADER that the agent
+// sends to advertise the versions it supports.
+func ProtocolVersionsHeader() string {
+	v := make([]string, len(ProtocolVersions))
+	for i, n := range ProtocolVersions {
+		v[i] = strconv.Itoa(n)
+	}
+	return strings.Join(v, ", ")
+}
+
+// NegotiatedVersion returns the protocol version chosen by the API in its
+// response header, PROTOCOL_V1 if the API didn't choose one, or an error if
+// it chose a version the agent doesn't support.
+func NegotiatedVersion(header http.Header) (int, error) {
+	val := strings.TrimSpace(header.Get(PROTOCOL_HEADER))
+	if val == "" {
+		return PROTOCOL_V1, nil
+	}
+	version, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s header from API: %s", PROTOCOL_HEADER, val)
+	}
+	for _, n := range ProtocolVersions {
+		if n == version {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("API requires protocol version %d, agent supports %s", version, ProtocolVersionsHeader())
+}
+
+// NegotiatedContentTypes returns the data content types that the API accepts
+// according to its response header, only CONTENT_TYPE_JSON if it didn't say.
+func NegotiatedContentTypes(header http.Header) []string {
+	types := []string{}
+	for _, t := range strings.Split(header.Get(DATA_CONTENT_TYPES_HEADER), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 0 {
+		return []string{CONTENT_TYPE_JSON}
+	}
+	return types
+}
+
+// --------------------------------------------------------------------------
+
+// v1: cmds and replies are plain JSON.
+type protocolV1 struct{}
+
+func (p protocolV1) Version() int {
+	return PROTOCOL_V1
+}
+
+func (p protocolV1) DecodeCmd(data []byte) (*proto.Cmd, error) {
+	cmd := &proto.Cmd{}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (p protocolV1) EncodeReply(reply *proto.Reply) ([]byte, error) {
+	return json.Marshal(reply)
+}
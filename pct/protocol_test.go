@@ -0,0 +1,136 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/json"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+type ProtocolTestSuite struct {
+}
+
+var _ = Suite(&ProtocolTestSuite{})
+
+// Fake API that chooses the given protocol version, or none like an old API,
+// and accepts the given data content types, or doesn't say like an old API.
+func fakeAPI(version string, got *string, contentTypes ...string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r.Header.Get(pct.PROTOCOL_HEADER)
+		if version != "" {
+			w.Header().Set(pct.PROTOCOL_HEADER, version)
+		}
+		if len(contentTypes) > 0 {
+			w.Header().Set(pct.DATA_CONTENT_TYPES_HEADER, strings.Join(contentTypes, ", "))
+		}
+		links := &proto.Links{
+			Links: map[string]string{
+				"agents":    server.URL + "/agents",
+				"instances": server.URL + "/instances",
+				"download":  server.URL + "/download",
+				"cmd":       "ws://" + server.Listener.Addr().String() + "/cmd",
+				"log":       "ws://" + server.Listener.Addr().String() + "/log",
+				"data":      "ws://" + server.Listener.Addr().String() + "/data",
+			},
+		}
+		data, _ := json.Marshal(links)
+		w.Write(data)
+	}))
+	return server
+}
+
+func (s *ProtocolTestSuite) TestNegotiate(t *C) {
+	var got string
+	hostname := func(server *httptest.Server) string {
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+
+	// Old API doesn't know about versions: v1.
+	server := fakeAPI("", &got)
+	api := pct.NewAPI()
+	err := api.Connect(hostname(server), "123", "abc")
+	server.Close()
+	t.Assert(err, IsNil)
+	t.Check(got, Equals, "1")
+	t.Check(api.ProtocolVersion(), Equals, pct.PROTOCOL_V1)
+
+	// New API chooses v1.
+	server = fakeAPI("1", &got)
+	api = pct.NewAPI()
+	err = api.Connect(hostname(server), "123", "abc")
+	server.Close()
+	t.Assert(err, IsNil)
+	t.Check(api.ProtocolVersion(), Equals, pct.PROTOCOL_V1)
+
+	// Future API requires a version this agent doesn't speak.
+	server = fakeAPI("2", &got)
+	api = pct.NewAPI()
+	err = api.Connect(hostname(server), "123", "abc")
+	server.Close()
+	t.Check(err, NotNil)
+	t.Check(api.ProtocolVersion(), Equals, pct.PROTOCOL_V1)
+}
+
+func (s *ProtocolTestSuite) TestNegotiateContentTypes(t *C) {
+	var got string
+	hostname := func(server *httptest.Server) string {
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+
+	// Before connecting and with an old API: only JSON.
+	api := pct.NewAPI()
+	t.Check(api.DataContentTypes(), DeepEquals, []string{pct.CONTENT_TYPE_JSON})
+	server := fakeAPI("", &got)
+	err := api.Connect(hostname(server), "123", "abc")
+	server.Close()
+	t.Assert(err, IsNil)
+	t.Check(api.DataContentTypes(), DeepEquals, []string{pct.CONTENT_TYPE_JSON})
+
+	// New API accepts msgpack too.
+	server = fakeAPI("1", &got, pct.CONTENT_TYPE_MSGPACK, pct.CONTENT_TYPE_JSON)
+	api = pct.NewAPI()
+	err = api.Connect(hostname(server), "123", "abc")
+	server.Close()
+	t.Assert(err, IsNil)
+	t.Check(api.DataContentTypes(), DeepEquals, []string{pct.CONTENT_TYPE_MSGPACK, pct.CONTENT_TYPE_JSON})
+}
+
+func (s *ProtocolTestSuite) TestCodecs(t *C) {
+	cmdV1 := []byte(`{"Service":"agent","Cmd":"Status"}`)
+	reply := &proto.Reply{Cmd: "Status", Error: "oops"}
+
+	v1, err := pct.NewProtocol(pct.PROTOCOL_V1)
+	t.Assert(err, IsNil)
+	cmd, err := v1.DecodeCmd(cmdV1)
+	t.Assert(err, IsNil)
+	t.Check(cmd.Service, Equals, "agent")
+	t.Check(cmd.Cmd, Equals, "Status")
+	data, err := v1.EncodeReply(reply)
+	t.Assert(err, IsNil)
+	expect, _ := json.Marshal(reply)
+	t.Check(string(data), Equals, string(expect))
+
+	_, err = pct.NewProtocol(2)
+	t.Check(err, NotNil)
+}
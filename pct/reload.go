@@ -0,0 +1,156 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * Tools read their configs from the basedir only when started, so a local
+ * config edit used to require restarting the agent, which interrupts tools
+ * like QAN.  Reloading re-reads the configs and applies the changes with the
+ * same cmds the API uses: tools with new or changed configs are (re)started
+ * with StartService or reconfigured with SetConfig, tools whose configs were
+ * removed are stopped with StopService, and tools with the same config are
+ * not touched.  Configs are compared by ConfigHash with the running configs
+ * from GetConfig, which are what the tools saved, so they're the same unless
+ * a config file was edited.
+ */
+
+// A ConfigReloader re-reads its configs from the basedir and applies the
+// changes.  It's optional: the agent reloads services that implement it
+// on SIGHUP.
+type ConfigReloader interface {
+	Reload() []error
+}
+
+// ReloadServices reloads the configs of a manager that runs a service for
+// each config file matching pattern in the config dir, e.g. "mm-*.conf".
+func ReloadServices(m ServiceManager, pattern string) []error {
+	configFiles, err := filepath.Glob(filepath.Join(Basedir.Dir("config"), pattern))
+	if err != nil {
+		return []error{err}
+	}
+
+	// Running configs keyed on service instance name, e.g. mysql-1, which
+	// identifies the tool like its config file name, e.g. mm-mysql-1.conf.
+	// Not on proto.ServiceInstance, which isn't comparable.
+	running, errs := m.GetConfig()
+	runningConfigs := make(map[string]string)
+	for _, config := range running {
+		si := proto.ServiceInstance{}
+		if err := json.Unmarshal([]byte(config.Config), &si); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		runningConfigs[instanceName(si)] = config.Config
+	}
+
+	for _, configFile := range configFiles {
+		data, err := Basedir.ReadConfigFile(configFile)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		si := proto.ServiceInstance{}
+		if err := json.Unmarshal(data, &si); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", configFile, err))
+			continue
+		}
+		config, ok := runningConfigs[instanceName(si)]
+		delete(runningConfigs, instanceName(si))
+		if ok && SameConfig(data, []byte(config)) {
+			continue
+		}
+		if err := reloadCmd(m, "StartService", data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", configFile, err))
+		}
+	}
+
+	// Config files removed, so stop their tools.
+	for _, config := range runningConfigs {
+		if err := reloadCmd(m, "StopService", []byte(config)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// instanceName returns the name of the service instance, e.g. mysql-1.
+func instanceName(si proto.ServiceInstance) string {
+	return fmt.Sprintf("%s-%d", si.Service, si.InstanceId)
+}
+
+// ReloadConfig reloads the config of a manager that has one config and
+// applies changes with SetConfig, e.g. log.conf.  There's nothing to do
+// if the config file doesn't exist.
+func ReloadConfig(m ServiceManager, service string) []error {
+	data, err := Basedir.ReadConfigFile(Basedir.ConfigFile(service))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return []error{err}
+	}
+	running, errs := m.GetConfig()
+	if len(errs) > 0 {
+		return errs
+	}
+	if len(running) == 1 && SameConfig(data, []byte(running[0].Config)) {
+		return nil
+	}
+	if err := reloadCmd(m, "SetConfig", data); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// SameConfig returns true if the JSON configs have the same ConfigHash.
+func SameConfig(config1, config2 []byte) bool {
+	hash1, err := ConfigHash(config1)
+	if err != nil {
+		return false
+	}
+	hash2, err := ConfigHash(config2)
+	if err != nil {
+		return false
+	}
+	return hash1 == hash2
+}
+
+func reloadCmd(m ServiceManager, cmd string, data []byte) error {
+	reply := m.Handle(&proto.Cmd{
+		Ts:   time.Now().UTC(),
+		User: "reload",
+		Cmd:  cmd,
+		Data: data,
+	})
+	if reply != nil && reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+type ReloadTestSuite struct {
+	baseDir string
+}
+
+var _ = Suite(&ReloadTestSuite{})
+
+func (s *ReloadTestSuite) SetUpSuite(t *C) {
+	basedir, err := ioutil.TempDir("", "reload-test-")
+	t.Assert(err, IsNil)
+	s.baseDir = basedir
+	err = pct.Basedir.Init(s.baseDir)
+	t.Assert(err, IsNil)
+}
+
+func (s *ReloadTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.baseDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func (s *ReloadTestSuite) writeConfig(t *C, service, config string) {
+	err := ioutil.WriteFile(filepath.Join(pct.Basedir.Dir("config"), service+".conf"), []byte(config), 0600)
+	t.Assert(err, IsNil)
+}
+
+func (s *ReloadTestSuite) TestReloadServices(t *C) {
+	m := mock.NewMockServiceManager("mm", nil, nil)
+	m.Configs = []proto.AgentConfig{
+		{InternalService: "mm", Config: `{"Service":"mysql","InstanceId":1,"Collect":1}`, Running: true},
+		{InternalService: "mm", Config: `{"Service":"mysql","InstanceId":2,"Collect":1}`, Running: true},
+		{InternalService: "mm", Config: `{"Service":"mysql","InstanceId":4,"Collect":1}`, Running: true},
+	}
+
+	// 1 is the same (only formatting changed), 2 changed, 3 is new, and 4
+	// was removed.
+	s.writeConfig(t, "mm-mysql-1", "{\n  \"Collect\": 1,\n  \"InstanceId\": 1,\n  \"Service\": \"mysql\"\n}")
+	s.writeConfig(t, "mm-mysql-2", `{"Service":"mysql","InstanceId":2,"Collect":10}`)
+	s.writeConfig(t, "mm-mysql-3", `{"Service":"mysql","InstanceId":3,"Collect":1}`)
+	defer os.Remove(pct.Basedir.ConfigFile("mm-mysql-1"))
+	defer os.Remove(pct.Basedir.ConfigFile("mm-mysql-2"))
+	defer os.Remove(pct.Basedir.ConfigFile("mm-mysql-3"))
+
+	errs := pct.ReloadServices(m, "mm-*.conf")
+	t.Check(errs, HasLen, 0)
+
+	t.Assert(m.Cmds, HasLen, 3)
+	t.Check(m.Cmds[0].Cmd, Equals, "StartService")
+	t.Check(string(m.Cmds[0].Data), Equals, `{"Service":"mysql","InstanceId":2,"Collect":10}`)
+	t.Check(m.Cmds[1].Cmd, Equals, "StartService")
+	t.Check(string(m.Cmds[1].Data), Equals, `{"Service":"mysql","InstanceId":3,"Collect":1}`)
+	t.Check(m.Cmds[2].Cmd, Equals, "StopService")
+	t.Check(string(m.Cmds[2].Data), Equals, `{"Service":"mysql","InstanceId":4,"Collect":1}`)
+}
+
+func (s *ReloadTestSuite) TestReloadConfig(t *C) {
+	m := mock.NewMockServiceManager("log", nil, nil)
+	m.Configs = []proto.AgentConfig{
+		{InternalService: "log", Config: `{"Level":"info","File":""}`, Running: true},
+	}
+
+	// No config file, nothing to do.
+	errs := pct.ReloadConfig(m, "log")
+	t.Check(errs, HasLen, 0)
+	t.Check(m.Cmds, HasLen, 0)
+
+	// Same config, nothing to do.
+	s.writeConfig(t, "log", `{"File":"","Level":"info"}`)
+	defer os.Remove(pct.Basedir.ConfigFile("log"))
+	errs = pct.ReloadConfig(m, "log")
+	t.Check(errs, HasLen, 0)
+	t.Check(m.Cmds, HasLen, 0)
+
+	// Changed config is set.
+	s.writeConfig(t, "log", `{"File":"","Level":"debug"}`)
+	errs = pct.ReloadConfig(m, "log")
+	t.Check(errs, HasLen, 0)
+	t.Assert(m.Cmds, HasLen, 1)
+	t.Check(m.Cmds[0].Cmd, Equals, "SetConfig")
+	t.Check(string(m.Cmds[0].Data), Equals, `{"File":"","Level":"debug"}`)
+}
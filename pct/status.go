@@ -20,7 +20,9 @@ package pct
 import (
 	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
+	"strings"
 	"sync"
+	"time"
 )
 
 type StatusReporter interface {
@@ -50,7 +52,7 @@ func (s *Status) Update(proc string, status string) {
 	if _, ok := s.status[proc]; !ok {
 		return
 	}
-	s.status[proc] = status
+	s.status[proc] = RedactDSNs(status)
 }
 
 func (s *Status) UpdateRe(proc string, status string, cmd *proto.Cmd) {
@@ -59,7 +61,7 @@ func (s *Status) UpdateRe(proc string, status string, cmd *proto.Cmd) {
 	if _, ok := s.status[proc]; !ok {
 		return
 	}
-	s.status[proc] = fmt.Sprintf("%s %s", status, cmd)
+	s.status[proc] = RedactDSNs(fmt.Sprintf("%s %s", status, cmd))
 }
 
 func (s *Status) Get(proc string) string {
@@ -91,3 +93,77 @@ func (s *Status) Merge(others ...map[string]string) map[string]string {
 	}
 	return status
 }
+
+// Suffixes of LastTs status keys.
+const (
+	LAST_COLLECTED = "last-collected"
+	LAST_SENT      = "last-sent"
+)
+
+// LastTs records when something last happened per key, e.g. when a tool last
+// collected data for an instance.  Status reports each key as "at <ts> (<d>
+// ago)" so a glance tells whether data is flowing, not just whether the tool
+// is running.
+type LastTs struct {
+	suffix string
+	ts     map[string]time.Time
+	mux    *sync.Mutex
+}
+
+// NewLastTs returns a LastTs whose status keys are "<key>-<suffix>", where
+// suffix is LAST_COLLECTED or LAST_SENT.
+func NewLastTs(suffix string) *LastTs {
+	l := &LastTs{
+		suffix: suffix,
+		ts:     make(map[string]time.Time),
+		mux:    &sync.Mutex{},
+	}
+	return l
+}
+
+func (l *LastTs) Mark(key string, ts time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if ts.After(l.ts[key]) {
+		l.ts[key] = ts
+	}
+}
+
+func (l *LastTs) Remove(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	delete(l.ts, key)
+}
+
+func (l *LastTs) Get(key string) time.Time {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.ts[key]
+}
+
+func (l *LastTs) Status() map[string]string {
+	now := time.Now()
+	status := make(map[string]string)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for key, ts := range l.ts {
+		status[key+"-"+l.suffix] = LastTsString(ts, now)
+	}
+	return status
+}
+
+// LastTsString returns "at <ts> (<d> ago)", or only "at <ts>" if ts is less
+// than a second before now.
+func LastTsString(ts, now time.Time) string {
+	s := "at " + TimeString(ts)
+	if ago := now.Sub(ts).Seconds(); ago >= 1 {
+		s += fmt.Sprintf(" (%s ago)", Duration(float64(int64(ago))))
+	}
+	return s
+}
+
+// IsLastTs returns true if the status key is a LastTs key, i.e. one of the
+// keys the agent heartbeat reports.
+func IsLastTs(key string) bool {
+	return strings.HasSuffix(key, "-"+LAST_COLLECTED) || strings.HasSuffix(key, "-"+LAST_SENT)
+}
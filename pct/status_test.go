@@ -0,0 +1,52 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type StatusTestSuite struct {
+}
+
+var _ = Suite(&StatusTestSuite{})
+
+func (s *StatusTestSuite) TestLastTs(t *C) {
+	l := pct.NewLastTs(pct.LAST_COLLECTED)
+	t.Check(l.Status(), DeepEquals, map[string]string{})
+
+	ts := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	l.Mark("mm-mysql-1", ts)
+	l.Mark("mm-mysql-1", ts.Add(-time.Minute)) // older, ignored
+	t.Check(l.Get("mm-mysql-1"), Equals, ts)
+	status := l.Status()
+	t.Check(status, HasLen, 1)
+	t.Check(status["mm-mysql-1-last-collected"], Matches, `at 2015-03-01 10:00:00 UTC \(.+ ago\)`)
+
+	t.Check(pct.LastTsString(ts, ts.Add(500*time.Millisecond)), Equals, "at 2015-03-01 10:00:00 UTC")
+	t.Check(pct.LastTsString(ts, ts.Add(90*time.Second)), Equals, "at 2015-03-01 10:00:00 UTC (1m30s ago)")
+
+	l.Remove("mm-mysql-1")
+	t.Check(l.Status(), DeepEquals, map[string]string{})
+
+	t.Check(pct.IsLastTs("mm-mysql-1-last-collected"), Equals, true)
+	t.Check(pct.IsLastTs("mm-last-sent"), Equals, true)
+	t.Check(pct.IsLastTs("data-sender-last"), Equals, false)
+}
@@ -18,8 +18,10 @@
 package pct
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/user"
 	"regexp"
 	"strings"
 	"time"
@@ -51,6 +53,22 @@ func SameFile(file1, file2 string) (bool, error) {
 	return os.SameFile(stat1, stat2), nil
 }
 
+// CurrentUser returns the name of the user running the process.  user.Current
+// needs cgo on some platforms, so in static builds (CGO_ENABLED=0) it can fail;
+// then $USER or $LOGNAME is used instead.
+func CurrentUser() (string, error) {
+	u, err := user.Current()
+	if err == nil {
+		return u.Username, nil
+	}
+	for _, env := range []string{"USER", "LOGNAME"} {
+		if name := os.Getenv(env); name != "" {
+			return name, nil
+		}
+	}
+	return "", errors.New("Cannot determine current user: " + err.Error())
+}
+
 func MakeDir(dir string) error {
 	err := os.MkdirAll(dir, 0755)
 	if os.IsExist(err) {
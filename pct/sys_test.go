@@ -32,6 +32,12 @@ type SysTestSuite struct {
 
 var _ = Suite(&SysTestSuite{})
 
+func (s *SysTestSuite) TestCurrentUser(t *C) {
+	username, err := pct.CurrentUser()
+	t.Assert(err, IsNil)
+	t.Check(username, Not(Equals), "")
+}
+
 func (s *SysTestSuite) TestSameFile(t *C) {
 	var err error
 	var same bool
@@ -1,3 +1,5 @@
+// +build !noexec
+
 /*
    Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
 
@@ -23,6 +25,7 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -105,6 +108,11 @@ func (u *Updater) Check() (string, string, error) {
 func (u *Updater) Update(version string) error {
 	u.logger.Info("Updating to", version)
 
+	// The new bin replaces the current bin, which an immutable image can't do.
+	if Basedir.ReadOnly() {
+		return errors.New("Cannot update: basedir " + Basedir.Path() + " is read-only, update the image instead")
+	}
+
 	// Download and decompress the gzipped bin and its signature.
 	url := fmt.Sprintf("%s/percona-agent-%s", u.api.EntryLink("download"), version)
 	data, err := u.download(url + ".gz")
@@ -1,3 +1,5 @@
+// +build !noexec
+
 /*
    Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
 
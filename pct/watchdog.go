@@ -0,0 +1,164 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+/**
+ * A FileWatchdog detects when a file the agent tails, e.g. the slow log, is
+ * rotated or truncated, so the agent reopens it instead of silently reading
+ * a file that's no longer written or a position past the end of it.  It keeps
+ * the os.FileInfo of the file, which identifies it by device and inode, and
+ * Check compares that with the file now:
+ *
+ *   different inode: the file was renamed (e.g. logrotate create) or removed
+ *                    and a new one created.  The watchdog looks for the old
+ *                    inode among the files named like it (e.g. slow.log.1,
+ *                    slow.log-20150102) so the rest of it can be read.
+ *   smaller:         the file was truncated (e.g. logrotate copytruncate).
+ *                    What was written after the offset read and before the
+ *                    truncate is only in the copy, so it's skipped.
+ *
+ * Compressed or removed old files can't be read either, so Rotation.Skipped
+ * says how many bytes, at least, were lost.  Rotation.Report logs it and sends
+ * an agent/log-rotation event so the user knows, e.g. that logrotate makes
+ * QAN miss queries.
+ */
+type FileWatchdog struct {
+	file string
+	info os.FileInfo // of file when last checked, nil until first
+}
+
+// A Rotation is the rotation of a file detected by a FileWatchdog.
+type Rotation struct {
+	File      string // file that was rotated, e.g. /var/lib/mysql/slow.log
+	RotatedTo string // where the old file is now, "" if not found or truncated
+	Truncated bool   // same file, but smaller than the offset read
+	Offset    int64  // bytes of the old file read
+	Size      int64  // of the old file: bytes [Offset, Size) are in RotatedTo
+	Skipped   int64  // bytes that cannot be read, at least
+}
+
+func (r *Rotation) String() string {
+	switch {
+	case r.Truncated:
+		return fmt.Sprintf("%s was truncated at offset %d, %d bytes skipped", r.File, r.Offset, r.Skipped)
+	case r.RotatedTo != "":
+		return fmt.Sprintf("%s was rotated to %s, %d bytes not read yet", r.File, r.RotatedTo, r.Size-r.Offset)
+	default:
+		return fmt.Sprintf("%s was rotated or removed and the old file was not found, %d bytes skipped", r.File, r.Skipped)
+	}
+}
+
+// Report logs the rotation, as a warning if bytes were skipped, and sends it
+// as an event for the instance whose file it is, or the agent if unknown.
+func (r *Rotation) Report(logger *Logger, si proto.ServiceInstance) {
+	level := EVENT_INFO
+	if r.Skipped > 0 {
+		level = EVENT_WARNING
+		logger.Warn(r)
+	} else {
+		logger.Info(r)
+	}
+	SendEvent(Event{
+		ServiceInstance: si,
+		Type:            "agent/log-rotation",
+		Level:           level,
+		Message:         r.String(),
+		Data:            r,
+	})
+}
+
+func NewFileWatchdog() *FileWatchdog {
+	return &FileWatchdog{}
+}
+
+// Reset makes the file the one to watch, as it is now.
+func (w *FileWatchdog) Reset(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.info = info
+	return nil
+}
+
+// Check returns a Rotation if the file isn't the one last checked or Reset,
+// or is smaller than offset, the number of bytes of it read so far, else nil.
+// The file can have another name than before, e.g. if MySQL was configured
+// to log to another file.  Then the watched file becomes file, as it is now.
+func (w *FileWatchdog) Check(file string, offset int64) (*Rotation, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	prevFile, prev := w.file, w.info
+	w.file, w.info = file, info
+	if prev == nil {
+		return nil, nil // first check
+	}
+
+	if os.SameFile(prev, info) {
+		if info.Size() >= offset {
+			return nil, nil
+		}
+		r := &Rotation{
+			File:      file,
+			Truncated: true,
+			Offset:    offset,
+			Size:      info.Size(),
+		}
+		if prev.Size() > offset {
+			r.Skipped = prev.Size() - offset
+		}
+		return r, nil
+	}
+
+	r := &Rotation{
+		File:   prevFile,
+		Offset: offset,
+		Size:   prev.Size(),
+	}
+	if name, old := findFile(prevFile, prev); old != nil {
+		r.RotatedTo = name
+		r.Size = old.Size()
+	} else if prev.Size() > offset {
+		r.Skipped = prev.Size() - offset
+	}
+	return r, nil
+}
+
+// findFile returns the name and current info of the file that was file, i.e.
+// has the same inode as info, if it's still file or was renamed to file*.
+func findFile(file string, info os.FileInfo) (string, os.FileInfo) {
+	names, _ := filepath.Glob(file + "*")
+	for _, name := range names {
+		cur, err := os.Stat(name)
+		if err == nil && os.SameFile(info, cur) {
+			return name, cur
+		}
+	}
+	return "", nil
+}
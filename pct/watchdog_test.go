@@ -0,0 +1,136 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type WatchdogTestSuite struct {
+	dir string
+}
+
+var _ = Suite(&WatchdogTestSuite{})
+
+func (s *WatchdogTestSuite) SetUpTest(t *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("/tmp", "percona-agent-test-")
+	t.Assert(err, IsNil)
+}
+
+func (s *WatchdogTestSuite) TearDownTest(t *C) {
+	os.RemoveAll(s.dir)
+	pct.SetEventSink(nil)
+}
+
+func (s *WatchdogTestSuite) TestRotate(t *C) {
+	file := filepath.Join(s.dir, "slow.log")
+	t.Assert(ioutil.WriteFile(file, []byte("123456"), 0644), IsNil)
+
+	w := pct.NewFileWatchdog()
+	t.Assert(w.Reset(file), IsNil)
+
+	// Same file, not smaller than what was read: no rotation.
+	r, err := w.Check(file, 6)
+	t.Assert(err, IsNil)
+	t.Check(r, IsNil)
+
+	// logrotate create: the file is renamed, more is written to it before
+	// MySQL reopens the slow log, then MySQL creates a new one.
+	t.Assert(os.Rename(file, file+".1"), IsNil)
+	t.Assert(ioutil.WriteFile(file+".1", []byte("123456789"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(file, []byte("ab"), 0644), IsNil)
+	r, err = w.Check(file, 6)
+	t.Assert(err, IsNil)
+	t.Check(r, DeepEquals, &pct.Rotation{
+		File:      file,
+		RotatedTo: file + ".1",
+		Offset:    6,
+		Size:      9,
+	})
+
+	// The new file is watched now.
+	r, err = w.Check(file, 2)
+	t.Assert(err, IsNil)
+	t.Check(r, IsNil)
+
+	// The old file is compressed (i.e. removed) before it's found: what
+	// wasn't read is lost.
+	t.Assert(ioutil.WriteFile(file, []byte("abcdef"), 0644), IsNil)
+	w.Reset(file)
+	t.Assert(ioutil.WriteFile(file+".new", []byte("x"), 0644), IsNil) // new inode
+	t.Assert(os.Remove(file), IsNil)
+	t.Assert(os.Rename(file+".new", file), IsNil)
+	r, err = w.Check(file, 2)
+	t.Assert(err, IsNil)
+	t.Check(r, DeepEquals, &pct.Rotation{
+		File:    file,
+		Offset:  2,
+		Size:    6,
+		Skipped: 4,
+	})
+
+	// logrotate copytruncate: same file, but smaller than what was read.
+	t.Assert(ioutil.WriteFile(file, []byte("xyz"), 0644), IsNil)
+	w.Reset(file)
+	t.Assert(os.Truncate(file, 0), IsNil)
+	r, err = w.Check(file, 1)
+	t.Assert(err, IsNil)
+	t.Check(r, DeepEquals, &pct.Rotation{
+		File:      file,
+		Truncated: true,
+		Offset:    1,
+		Size:      0,
+		Skipped:   2,
+	})
+}
+
+func (s *WatchdogTestSuite) TestReport(t *C) {
+	events := []pct.Event{}
+	pct.SetEventSink(func(e pct.Event) {
+		events = append(events, e)
+	})
+	logChan := make(chan *proto.LogEntry, 10)
+	logger := pct.NewLogger(logChan, "watchdog-test")
+	si := proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+
+	r := &pct.Rotation{File: "/tmp/slow.log", Offset: 2, Size: 6, Skipped: 4}
+	r.Report(logger, si)
+	entry := <-logChan
+	t.Check(entry.Level, Equals, proto.LOG_WARNING)
+	t.Check(entry.Msg, Equals, r.String())
+	t.Assert(events, HasLen, 1)
+	t.Check(events[0].ServiceInstance, DeepEquals, si)
+	t.Check(events[0].Type, Equals, "agent/log-rotation")
+	t.Check(events[0].Level, Equals, pct.EVENT_WARNING)
+	t.Check(events[0].Message, Equals, r.String())
+	t.Check(events[0].Data, Equals, r)
+
+	// Nothing lost: info.
+	r = &pct.Rotation{File: "/tmp/slow.log", RotatedTo: "/tmp/slow.log.1", Offset: 2, Size: 6}
+	r.Report(logger, si)
+	entry = <-logChan
+	t.Check(entry.Level, Equals, proto.LOG_INFO)
+	t.Assert(events, HasLen, 2)
+	t.Check(events[1].Level, Equals, pct.EVENT_INFO)
+}
@@ -18,6 +18,7 @@
 package qan
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"runtime/debug"
@@ -42,6 +43,14 @@ type Worker interface {
 	Status() map[string]string
 }
 
+// A ResumableWorker is a Worker that can save its state, e.g. counter baselines,
+// and resume from it in the next agent, see RealAnalyzer.Handoff.
+type ResumableWorker interface {
+	Worker
+	State() ([]byte, error) // after Stop()
+	Resume([]byte) error    // before first Setup()
+}
+
 // An Analyzer runs a Worker at each Interval. Analyzers are responsible for
 // MySQL: configuring, restarts, etc. The Worker is only ran when MySQL is
 // configured and ready. Analyzers are also responsible for making Reports from
@@ -56,6 +65,26 @@ type Analyzer interface {
 	SetConfig(Config)
 }
 
+// A ResumableAnalyzer is an Analyzer that can hand off to the next agent when
+// the agent restarts, see pct.Handoff.
+type ResumableAnalyzer interface {
+	Analyzer
+	Handoff() (*AnalyzerState, error) // instead of Stop()
+	Resume(*AnalyzerState) error      // before Start()
+}
+
+// A HistoryAnalyzer is an Analyzer that keeps its reports locally, see History.
+type HistoryAnalyzer interface {
+	Analyzer
+	Resend(start, end time.Time) (int, error) // for the ResendQAN cmd
+}
+
+// The state of an Analyzer handed off to the next agent.
+type AnalyzerState struct {
+	Next   *Interval       `json:",omitempty"` // start of the next interval to parse
+	Worker json.RawMessage `json:",omitempty"` // ResumableWorker.State()
+}
+
 // An AnalyzerFactory makes an Analyzer, real or mock.
 type AnalyzerFactory interface {
 	Make(config Config, name string, mysqlConn mysql.Connector, restartChan <-chan bool, tickChan chan time.Time) Analyzer
@@ -72,6 +101,9 @@ type RealAnalyzer struct {
 	worker      Worker
 	clock       ticker.Manager
 	spool       data.Spooler
+	explainer   Explainer
+	history     *History
+	sampler     StatusSampler
 	// --
 	name                string
 	mysqlConfiguredChan chan bool
@@ -81,6 +113,10 @@ type RealAnalyzer struct {
 	configureMySQLSync  *pct.SyncChan
 	running             bool
 	mux                 *sync.RWMutex
+	handoff             bool      // stopping for Handoff(), don't un-configure MySQL
+	interrupted         *Interval // worker stopped while parsing it for Handoff()
+	context             *ContextSamples
+	collected           *pct.LastTs // keyed on name
 }
 
 func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysqlConn mysql.Connector, restartChan <-chan bool, worker Worker, clock ticker.Manager, spool data.Spooler) *RealAnalyzer {
@@ -102,10 +138,51 @@ func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysql
 		runSync:             pct.NewSyncChan(),
 		configureMySQLSync:  pct.NewSyncChan(),
 		mux:                 &sync.RWMutex{},
+		collected:           pct.NewLastTs(pct.LAST_COLLECTED),
 	}
 	return a
 }
 
+// SetExplainer sets the Explainer for Config.ExplainTop.  Without one,
+// reports don't have EXPLAIN plans.
+func (a *RealAnalyzer) SetExplainer(explainer Explainer) {
+	a.explainer = explainer
+}
+
+// SetHistory sets the History for Config.RetainHours.  Without one, reports
+// aren't kept after they're spooled.
+func (a *RealAnalyzer) SetHistory(history *History) {
+	a.history = history
+}
+
+// SetStatusSampler sets the StatusSampler for Config.ContextInterval.
+// Without one, reports don't have a Context.
+func (a *RealAnalyzer) SetStatusSampler(sampler StatusSampler) {
+	a.sampler = sampler
+}
+
+// Resend spools again the reports of intervals that started in [start, end).
+// It returns the number of reports spooled.
+func (a *RealAnalyzer) Resend(start, end time.Time) (int, error) {
+	a.logger.Debug("Resend:call")
+	defer a.logger.Debug("Resend:return")
+
+	if a.history == nil {
+		return 0, fmt.Errorf("%s does not keep reports: RetainHours is zero", a.name)
+	}
+	reports, err := a.history.Reports(start, end)
+	if err != nil {
+		return 0, err
+	}
+	for n, report := range reports {
+		if err := a.spool.Write("qan", report); err != nil {
+			return n, err
+		}
+	}
+	a.logger.Info(fmt.Sprintf("Resent %d reports from %s to %s", len(reports), start, end))
+	return len(reports), nil
+}
+
 func (a *RealAnalyzer) String() string {
 	return a.name
 }
@@ -137,6 +214,54 @@ func (a *RealAnalyzer) Stop() error {
 	return nil
 }
 
+// Handoff stops the analyzer like Stop() but leaves MySQL configured and
+// returns the state from which the next agent resumes.  If the worker was
+// parsing an interval, the next agent parses it again from the start.
+func (a *RealAnalyzer) Handoff() (*AnalyzerState, error) {
+	a.logger.Debug("Handoff:call")
+	defer a.logger.Debug("Handoff:return")
+	a.mux.Lock()
+	a.handoff = true
+	a.mux.Unlock()
+	if err := a.Stop(); err != nil {
+		return nil, err
+	}
+	state := &AnalyzerState{}
+	if a.interrupted != nil {
+		state.Next = &Interval{
+			StartTime:   a.interrupted.StartTime,
+			Filename:    a.interrupted.Filename,
+			StartOffset: a.interrupted.StartOffset,
+		}
+	} else if iter, ok := a.iter.(ResumableIter); ok {
+		state.Next = iter.Next()
+	}
+	if worker, ok := a.worker.(ResumableWorker); ok {
+		data, err := worker.State()
+		if err != nil {
+			return nil, err
+		}
+		state.Worker = data
+	}
+	return state, nil
+}
+
+// Resume sets the state handed off by the previous agent.  Call before Start().
+func (a *RealAnalyzer) Resume(state *AnalyzerState) error {
+	a.logger.Debug("Resume:call")
+	defer a.logger.Debug("Resume:return")
+	if iter, ok := a.iter.(ResumableIter); ok && state.Next != nil {
+		iter.Resume(state.Next)
+	}
+	if worker, ok := a.worker.(ResumableWorker); ok && len(state.Worker) > 0 {
+		if err := worker.Resume(state.Worker); err != nil {
+			return err
+		}
+	}
+	a.logger.Info("Resuming from previous agent")
+	return nil
+}
+
 func (a *RealAnalyzer) Status() map[string]string {
 	a.mux.RLock()
 	defer a.mux.RUnlock()
@@ -145,7 +270,7 @@ func (a *RealAnalyzer) Status() map[string]string {
 	} else {
 		a.status.Update(a.name+"-next-interval", "")
 	}
-	return a.status.Merge(a.worker.Status())
+	return a.status.Merge(a.worker.Status(), a.collected.Status())
 }
 
 func (a *RealAnalyzer) Config() Config {
@@ -241,6 +366,8 @@ func (a *RealAnalyzer) run() {
 	defer a.logger.Debug("run:return")
 
 	mysqlConfigured := false
+	workerRunning := false
+	currentInterval := &Interval{}
 	go a.configureMySQL(a.config.Start, 0) // try forever
 
 	defer func() {
@@ -258,8 +385,16 @@ func (a *RealAnalyzer) run() {
 			a.configureMySQLSync.Wait()
 		}
 
-		a.status.Update(a.name, "Stopping QAN on MySQL")
-		a.configureMySQL(a.config.Stop, 1) // try once
+		// Handoff() set handoff before Stop(), which waits for us.  The next
+		// agent uses the MySQL config as-is, so don't un-configure it.
+		if a.handoff {
+			if workerRunning {
+				a.interrupted = currentInterval
+			}
+		} else {
+			a.status.Update(a.name, "Stopping QAN on MySQL")
+			a.configureMySQL(a.config.Stop, 1) // try once
+		}
 
 		if err := recover(); err != nil {
 			a.logger.Error("QAN crashed: ", err)
@@ -272,9 +407,17 @@ func (a *RealAnalyzer) run() {
 		a.runSync.Done()
 	}()
 
-	workerRunning := false
+	// Sample server status for Report.Context while running.  Keep samples
+	// for 2 intervals because the worker reports an interval after it ends.
+	a.context = nil
+	if a.sampler != nil && a.config.ContextInterval > 0 {
+		a.context = NewContextSamples(int(2*a.config.Interval/a.config.ContextInterval) + 2)
+		stopSampling := make(chan bool)
+		defer close(stopSampling)
+		go a.sampleStatus(a.context, stopSampling)
+	}
+
 	lastTs := time.Time{}
-	currentInterval := &Interval{}
 	for {
 		a.logger.Debug("run:idle")
 		if mysqlConfigured {
@@ -411,7 +554,71 @@ func (a *RealAnalyzer) runWorker(interval *Interval) {
 	// Translate the results into a report and spool.
 	// NOTE: "qan" here is correct; do not use a.name.
 	report := MakeReport(a.config, interval, result)
+	if a.config.ExplainTop > 0 && a.explainer != nil {
+		a.explainTop(report)
+	}
+	if a.context != nil {
+		report.Context = a.context.Context(report.StartTs, report.EndTs)
+	}
 	if err := a.spool.Write("qan", report); err != nil {
 		a.logger.Warn("Lost report:", err)
+	} else {
+		a.collected.Mark(a.name, time.Now())
+	}
+	if a.history != nil {
+		if err := a.history.Save(report); err != nil {
+			a.logger.Warn("Cannot save report in history:", err)
+		}
+	}
+	if err := pct.Basedir.WriteLatest("qan", report.ServiceInstance, report); err != nil {
+		a.logger.Warn("Cannot write latest report:", err)
 	}
 }
+
+func (a *RealAnalyzer) sampleStatus(context *ContextSamples, stopChan chan bool) {
+	a.logger.Debug("sampleStatus:call")
+	defer func() {
+		if err := recover(); err != nil {
+			a.logger.Error(a.name+":sampleStatus crashed: ", err)
+		}
+		a.logger.Debug("sampleStatus:return")
+	}()
+
+	ticker := time.NewTicker(time.Duration(a.config.ContextInterval) * time.Second)
+	defer ticker.Stop()
+	failing := false
+	for {
+		sample, err := a.sampler.SampleStatus()
+		if err != nil {
+			// Warn once, not every sample while MySQL is down.
+			if !failing {
+				a.logger.Warn("Cannot sample status for report context:", err)
+			}
+			failing = true
+		} else {
+			context.Add(sample)
+			failing = false
+		}
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func (a *RealAnalyzer) explainTop(report *Report) {
+	a.logger.Debug("explainTop:call")
+	defer a.logger.Debug("explainTop:return")
+
+	a.status.Update(a.name, "Explaining top queries")
+	defer a.status.Update(a.name, "Running") // worker is still running
+
+	if err := a.mysqlConn.Connect(1); err != nil {
+		a.logger.Warn("Cannot EXPLAIN top queries:", err)
+		return
+	}
+	defer a.mysqlConn.Close()
+
+	report.Explain = ExplainTop(a.explainer, report.Class, a.config.ExplainTop)
+}
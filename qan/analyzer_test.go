@@ -185,6 +185,38 @@ func (s *AnalyzerTestSuite) TestRunMockWorker(t *C) {
 	t.Check(a.String(), Equals, "qan-analyzer")
 }
 
+func (s *AnalyzerTestSuite) TestResend(t *C) {
+	spool := mock.NewSpooler(nil)
+	a := qan.NewRealAnalyzer(
+		pct.NewLogger(s.logChan, "qan-analyzer"),
+		s.config,
+		s.iter,
+		s.nullmysql,
+		s.restartChan,
+		s.worker,
+		s.clock,
+		spool,
+	)
+
+	// No history, nothing to resend.
+	now := time.Now().UTC().Truncate(time.Minute)
+	_, err := a.Resend(now.Add(-time.Hour), now)
+	t.Check(err, NotNil)
+
+	h := qan.NewHistory(qan.HistoryDir(1), time.Hour)
+	a.SetHistory(h)
+	for _, ago := range []time.Duration{3, 2, 1} {
+		err := h.Save(&qan.Report{ServiceInstance: s.mysqlInstance, StartTs: now.Add(-ago * time.Minute)})
+		t.Assert(err, IsNil)
+	}
+	n, err := a.Resend(now.Add(-2*time.Minute), now)
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, 2)
+	t.Assert(spool.DataIn, HasLen, 2)
+	t.Check(spool.DataIn[0].(*qan.Report).StartTs.Equal(now.Add(-2*time.Minute)), Equals, true)
+	t.Check(spool.DataIn[1].(*qan.Report).StartTs.Equal(now.Add(-1*time.Minute)), Equals, true)
+}
+
 func (s *AnalyzerTestSuite) TestStartServiceFast(t *C) {
 	// Simulate the next tick being 3m away (mock.clock.Eta = 180) so that
 	// run() sends the first tick on the tick chan, causing the first
@@ -32,9 +32,25 @@ type Config struct {
 	Interval          uint  // minutes, "How often to report"
 	MaxSlowLogSize    int64 // bytes, 0 = no max
 	RemoveOldSlowLogs bool  // after rotating for MaxSlowLogSize
+	RetainSlowLogs    int   // newest rotated slow logs to keep if RemoveOldSlowLogs
 	// Worker
-	ExampleQueries bool // only fingerprints if false
-	WorkerRunTime  uint // seconds
+	ExampleQueries bool     // only fingerprints if false
+	ExplainTop     uint     // EXPLAIN example queries of top N classes, 0 = none
+	GroupBy        string   // also group classes by "schema" or "user", "" = none
+	Blacklist      []string // skip classes with fingerprints matching these regexes
+	StripComments  bool     // strip /* comments */ before fingerprinting
+	Tables         bool     // report tables of each class
+	WorkerRunTime  uint     // seconds
 	// Report
-	ReportLimit uint
+	ReportLimit     uint
+	RetainHours     uint    // keep reports locally this long for ResendQAN, 0 = don't
+	SamplePercent   uint    // report this % of low-impact classes, the rest in LRQ; 0 = all
+	LowImpactTime   float64 // seconds, classes with less total Query_time are low-impact
+	ContextInterval uint    // seconds between status samples for Report.Context, 0 = no context
 }
+
+// Config.GroupBy values
+const (
+	GROUP_BY_SCHEMA = "schema"
+	GROUP_BY_USER   = "user"
+)
@@ -0,0 +1,262 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+/**
+ * Report.Context is a snapshot of the server during the interval so query
+ * regressions can be correlated with server state without looking up the mm
+ * data at the same time: status counter deltas, the peak Threads_running, the
+ * max replication lag, and the InnoDB buffer pool hit rate.  The analyzer
+ * samples status every Config.ContextInterval seconds while it runs, then
+ * makes the Context from the samples in the report interval.
+ */
+
+// Status counters reported as deltas in Context.Status.
+var ContextCounters = []string{
+	"Questions",
+	"Com_select",
+	"Com_insert",
+	"Com_update",
+	"Com_delete",
+	"Slow_queries",
+	"Select_full_join",
+	"Created_tmp_disk_tables",
+	"Innodb_row_lock_waits",
+	"Innodb_buffer_pool_read_requests",
+	"Innodb_buffer_pool_reads",
+	"Aborted_connects",
+}
+
+type Context struct {
+	Samples           int                // status samples in the interval
+	Status            map[string]float64 // ContextCounters deltas, if 2+ samples
+	ThreadsRunningMax float64
+	ReplicationLagMax *int64   `json:",omitempty"` // seconds, nil if not replicating
+	BufferPoolHitRate *float64 `json:",omitempty"` // 0 to 1, nil if no reads
+}
+
+type StatusSample struct {
+	Ts     time.Time
+	Status map[string]float64 // ContextCounters and Threads_running
+	Lag    int64              // Seconds_Behind_Master, -1 if not replicating or unknown
+}
+
+// A StatusSampler samples server status for Report.Context.
+type StatusSampler interface {
+	SampleStatus() (*StatusSample, error)
+}
+
+// ContextSamples keeps the latest status samples to make the Context of report
+// intervals.  It's safe to Add and make a Context concurrently.
+type ContextSamples struct {
+	max     int
+	samples []*StatusSample
+	mux     *sync.Mutex
+}
+
+func NewContextSamples(max int) *ContextSamples {
+	c := &ContextSamples{
+		max:     max,
+		samples: []*StatusSample{},
+		mux:     &sync.Mutex{},
+	}
+	return c
+}
+
+// Add adds a sample, removing the oldest if there are more than max.
+func (c *ContextSamples) Add(sample *StatusSample) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > c.max {
+		c.samples = c.samples[len(c.samples)-c.max:]
+	}
+}
+
+// Context returns the Context of samples in [start, end], or nil if there are
+// none.  Samples before start are removed because intervals are reported in
+// order.
+func (c *ContextSamples) Context(start, end time.Time) *Context {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var first, last *StatusSample
+	keep := []*StatusSample{}
+	ctx := &Context{}
+	for _, s := range c.samples {
+		if s.Ts.Before(start) {
+			continue
+		}
+		keep = append(keep, s)
+		if s.Ts.After(end) {
+			continue
+		}
+		if first == nil {
+			first = s
+		}
+		last = s
+		ctx.Samples++
+		if s.Status["Threads_running"] > ctx.ThreadsRunningMax {
+			ctx.ThreadsRunningMax = s.Status["Threads_running"]
+		}
+		if s.Lag >= 0 && (ctx.ReplicationLagMax == nil || s.Lag > *ctx.ReplicationLagMax) {
+			lag := s.Lag
+			ctx.ReplicationLagMax = &lag
+		}
+	}
+	c.samples = keep
+	if ctx.Samples == 0 {
+		return nil
+	}
+
+	if ctx.Samples > 1 {
+		ctx.Status = make(map[string]float64)
+		for _, name := range ContextCounters {
+			v0, ok0 := first.Status[name]
+			v1, ok1 := last.Status[name]
+			if !ok0 || !ok1 || v1 < v0 {
+				continue // not this server's version, or it restarted
+			}
+			ctx.Status[name] = v1 - v0
+		}
+		requests, ok := ctx.Status["Innodb_buffer_pool_read_requests"]
+		if ok && requests > 0 {
+			hitRate := 1 - ctx.Status["Innodb_buffer_pool_reads"]/requests
+			if hitRate < 0 {
+				hitRate = 0
+			}
+			ctx.BufferPoolHitRate = &hitRate
+		}
+	}
+	return ctx
+}
+
+// --------------------------------------------------------------------------
+
+// MySQLStatusSampler samples SHOW GLOBAL STATUS and SHOW SLAVE STATUS.
+type MySQLStatusSampler struct {
+	conn  mysql.Connector
+	names map[string]bool
+}
+
+func NewMySQLStatusSampler(conn mysql.Connector) *MySQLStatusSampler {
+	names := map[string]bool{"threads_running": true}
+	for _, name := range ContextCounters {
+		names[strings.ToLower(name)] = true
+	}
+	s := &MySQLStatusSampler{
+		conn:  conn,
+		names: names,
+	}
+	return s
+}
+
+func (s *MySQLStatusSampler) SampleStatus() (*StatusSample, error) {
+	if err := s.conn.Connect(1); err != nil {
+		return nil, err
+	}
+	defer s.conn.Close()
+
+	sample := &StatusSample{
+		Ts:     time.Now().UTC(),
+		Status: make(map[string]float64),
+		Lag:    -1,
+	}
+
+	rows, err := s.conn.DB().Query("SHOW /*!50002 GLOBAL */ STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if !s.names[strings.ToLower(name)] {
+			continue
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		sample.Status[contextName(name)] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The status is still useful without the lag, e.g. if the user doesn't
+	// have the REPLICATION CLIENT privilege, so keep Lag -1 on error.
+	if lag, err := slaveLag(s.conn.DB()); err == nil {
+		sample.Lag = lag
+	}
+	return sample, nil
+}
+
+// contextName returns the name as written in ContextCounters, e.g.
+// "Com_select" for "COM_SELECT", because some versions upper-case them.
+func contextName(name string) string {
+	for _, c := range ContextCounters {
+		if strings.EqualFold(c, name) {
+			return c
+		}
+	}
+	return "Threads_running"
+}
+
+// slaveLag returns Seconds_Behind_Master, or -1 if the server is not a slave
+// or replication is stopped (it's NULL).
+func slaveLag(conn *sql.DB) (int64, error) {
+	rows, err := conn.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return -1, err
+	}
+	if !rows.Next() {
+		return -1, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return -1, err
+	}
+	for i, col := range columns {
+		if col == "Seconds_Behind_Master" && values[i].Valid {
+			return strconv.ParseInt(values[i].String, 10, 64)
+		}
+	}
+	return -1, nil
+}
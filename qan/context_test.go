@@ -0,0 +1,96 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan_test
+
+import (
+	"time"
+
+	"github.com/percona/percona-agent/qan"
+	. "gopkg.in/check.v1"
+)
+
+type ContextTestSuite struct {
+}
+
+var _ = Suite(&ContextTestSuite{})
+
+func statusSample(ts time.Time, questions, threads, reads, requests float64, lag int64) *qan.StatusSample {
+	return &qan.StatusSample{
+		Ts: ts,
+		Status: map[string]float64{
+			"Questions":                        questions,
+			"Threads_running":                  threads,
+			"Innodb_buffer_pool_reads":         reads,
+			"Innodb_buffer_pool_read_requests": requests,
+		},
+		Lag: lag,
+	}
+}
+
+func (s *ContextTestSuite) TestContext(t *C) {
+	t0 := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := qan.NewContextSamples(10)
+
+	// No samples, no context.
+	t.Check(c.Context(t0, t0.Add(time.Minute)), IsNil)
+
+	c.Add(statusSample(t0.Add(-10*time.Second), 10, 50, 0, 0, 99)) // previous interval
+	c.Add(statusSample(t0, 100, 2, 10, 1000, -1))
+	c.Add(statusSample(t0.Add(20*time.Second), 150, 9, 20, 1500, 3))
+	c.Add(statusSample(t0.Add(40*time.Second), 300, 4, 30, 2000, 1))
+	c.Add(statusSample(t0.Add(70*time.Second), 400, 7, 40, 2500, 0)) // next interval
+
+	ctx := c.Context(t0, t0.Add(time.Minute))
+	t.Assert(ctx, NotNil)
+	t.Check(ctx.Samples, Equals, 3)
+	t.Check(ctx.Status["Questions"], Equals, float64(200))
+	t.Check(ctx.Status["Innodb_buffer_pool_reads"], Equals, float64(20))
+	t.Check(ctx.ThreadsRunningMax, Equals, float64(9))
+	t.Assert(ctx.ReplicationLagMax, NotNil)
+	t.Check(*ctx.ReplicationLagMax, Equals, int64(3))
+	t.Assert(ctx.BufferPoolHitRate, NotNil)
+	t.Check(*ctx.BufferPoolHitRate, Equals, 0.98)
+
+	// Samples before the interval were removed, the next interval's kept.
+	// The sample at t0 ends the previous interval and starts this one.
+	ctx = c.Context(t0.Add(-time.Minute), t0)
+	t.Assert(ctx, NotNil)
+	t.Check(ctx.Samples, Equals, 1)
+	t.Check(ctx.ThreadsRunningMax, Equals, float64(2))
+	ctx = c.Context(t0.Add(time.Minute), t0.Add(2*time.Minute))
+	t.Assert(ctx, NotNil)
+	t.Check(ctx.Samples, Equals, 1)
+	t.Check(ctx.Status, IsNil) // 1 sample, no deltas
+	t.Check(ctx.ThreadsRunningMax, Equals, float64(7))
+	t.Check(*ctx.ReplicationLagMax, Equals, int64(0))
+	t.Check(ctx.BufferPoolHitRate, IsNil)
+
+	// A counter that decreased (server restarted) has no delta, and there's
+	// no lag if not replicating.
+	c = qan.NewContextSamples(2)
+	c.Add(statusSample(t0.Add(-time.Second), 1, 1, 0, 0, -1)) // dropped, max 2 samples
+	c.Add(statusSample(t0, 500, 1, 0, 0, -1))
+	c.Add(statusSample(t0.Add(time.Second), 5, 1, 0, 0, -1))
+	ctx = c.Context(t0.Add(-time.Minute), t0.Add(time.Minute))
+	t.Assert(ctx, NotNil)
+	t.Check(ctx.Samples, Equals, 2)
+	_, ok := ctx.Status["Questions"]
+	t.Check(ok, Equals, false)
+	t.Check(ctx.ReplicationLagMax, IsNil)
+	t.Check(ctx.BufferPoolHitRate, IsNil)
+}
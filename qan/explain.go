@@ -0,0 +1,64 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/go-mysql/event"
+)
+
+// An Explainer EXPLAINs a query, classic and JSON if the server supports it.
+// It's a query/mysql.QueryExecutor except in tests.
+type Explainer interface {
+	Explain(db, query string) (*proto.ExplainResult, error)
+}
+
+// The EXPLAIN plan of a class example query, in Report.Explain.
+type Explain struct {
+	Db     string               `json:",omitempty"`
+	Result *proto.ExplainResult `json:",omitempty"`
+	Error  string               `json:",omitempty"`
+}
+
+// ExplainTop EXPLAINs the example query of the first n classes, which are
+// the top classes after MakeReport, and returns the plans keyed on class ID.
+// Classes without an example (perf schema, or ExampleQueries=false) and the
+// LRQ class are skipped.  A failed EXPLAIN doesn't stop the others; its
+// error is returned in its Explain.
+func ExplainTop(explainer Explainer, classes []*event.QueryClass, n uint) map[string]*Explain {
+	explains := make(map[string]*Explain)
+	for _, class := range classes {
+		if uint(len(explains)) >= n {
+			break
+		}
+		if class.Id == "0" || class.Example == nil || class.Example.Query == "" {
+			continue
+		}
+		e := &Explain{
+			Db: class.Example.Db,
+		}
+		res, err := explainer.Explain(class.Example.Db, class.Example.Query)
+		if err != nil {
+			e.Error = err.Error()
+		} else {
+			e.Result = res
+		}
+		explains[class.Id] = e
+	}
+	return explains
+}
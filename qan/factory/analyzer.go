@@ -27,6 +27,7 @@ import (
 	"github.com/percona/percona-agent/qan"
 	"github.com/percona/percona-agent/qan/perfschema"
 	"github.com/percona/percona-agent/qan/slowlog"
+	mysqlExec "github.com/percona/percona-agent/query/mysql"
 	"github.com/percona/percona-agent/ticker"
 )
 
@@ -71,11 +72,16 @@ func (f *RealAnalyzerFactory) Make(
 	case "slowlog":
 		worker = f.slowlogWorkerFactory.Make(name+"-worker", config, mysqlConn)
 	case "perfschema":
-		worker = f.perfschemaWorkerFactory.Make(name+"-worker", mysqlConn)
+		w := f.perfschemaWorkerFactory.Make(name+"-worker", mysqlConn)
+		w.SetGroupBy(config.GroupBy)
+		blacklist, _ := qan.NewBlacklist(config.Blacklist) // validated by qan.Manager
+		w.SetBlacklist(blacklist)
+		w.SetTables(config.Tables)
+		worker = w
 	default:
 		panic("Invalid analyzerType: " + analyzerType)
 	}
-	return qan.NewRealAnalyzer(
+	a := qan.NewRealAnalyzer(
 		pct.NewLogger(f.logChan, name),
 		config,
 		f.iterFactory.Make(analyzerType, mysqlConn, tickChan),
@@ -85,4 +91,12 @@ func (f *RealAnalyzerFactory) Make(
 		f.clock,
 		f.spool,
 	)
+	a.SetExplainer(mysqlExec.NewQueryExecutor(mysqlConn))
+	if config.ContextInterval > 0 {
+		a.SetStatusSampler(qan.NewMySQLStatusSampler(mysqlConn))
+	}
+	if config.RetainHours > 0 {
+		a.SetHistory(qan.NewHistory(qan.HistoryDir(config.InstanceId), time.Duration(config.RetainHours)*time.Hour))
+	}
+	return a
 }
@@ -0,0 +1,76 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"hash/crc32"
+	"regexp"
+
+	"github.com/percona/go-mysql/event"
+)
+
+// A Blacklist matches the fingerprints of query classes to skip, e.g. monitoring
+// heartbeats and health checks, see Config.Blacklist.  Patterns are regular
+// expressions, case-insensitive because slow log fingerprints are lowercase but
+// perf schema digest texts are not.
+type Blacklist []*regexp.Regexp
+
+func NewBlacklist(patterns []string) (Blacklist, error) {
+	b := make(Blacklist, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, err
+		}
+		b[i] = re
+	}
+	return b, nil
+}
+
+// Match returns true if the fingerprint matches any pattern.
+func (b Blacklist) Match(fingerprint string) bool {
+	for _, re := range b {
+		if re.MatchString(fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleClasses returns the classes to report and the low-impact classes not
+// sampled, see Config.SamplePercent.  A class is sampled or not by its ID, not
+// randomly, so the same low-impact classes are reported every interval.
+func sampleClasses(classes []*event.QueryClass, percent uint, lowImpactTime float64) (sampled, notSampled []*event.QueryClass) {
+	sampled = []*event.QueryClass{}
+	notSampled = []*event.QueryClass{}
+	for _, class := range classes {
+		if queryTime(class) < lowImpactTime && crc32.ChecksumIEEE([]byte(class.Id))%100 >= uint32(percent) {
+			notSampled = append(notSampled, class)
+		} else {
+			sampled = append(sampled, class)
+		}
+	}
+	return sampled, notSampled
+}
+
+func queryTime(class *event.QueryClass) float64 {
+	if stats, ok := class.Metrics.TimeMetrics["Query_time"]; ok {
+		return stats.Sum
+	}
+	return 0
+}
@@ -0,0 +1,235 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+/**
+ * A History keeps QAN reports locally after they're spooled so they can be
+ * sent again with the ResendQAN cmd, e.g. after an API ingestion outage: once
+ * the data sender sends a report, it's removed from the spool and gone from
+ * the agent.  Reports are kept Config.RetainHours in one file per interval,
+ * history/qan-<instance id>/<interval start Unix ts>.json.
+ */
+type History struct {
+	dir    string
+	retain time.Duration
+}
+
+// ResendRange is the data of the ResendQAN cmd: resend the reports of
+// intervals that started in [Start, End) for the MySQL instance, or all
+// instances if InstanceId is zero.
+type ResendRange struct {
+	InstanceId uint
+	Start      time.Time
+	End        time.Time
+}
+
+func NewHistory(dir string, retain time.Duration) *History {
+	h := &History{
+		dir:    dir,
+		retain: retain,
+	}
+	return h
+}
+
+// HistoryDir returns the History dir for the MySQL instance.
+func HistoryDir(instanceId uint) string {
+	return filepath.Join(pct.Basedir.Dir("history"), fmt.Sprintf("qan-%d", instanceId))
+}
+
+// RemoveHistory removes the History of the MySQL instance when the instance
+// is removed, and returns how many reports it had.
+func RemoveHistory(instanceId uint) (int, error) {
+	dir := HistoryDir(instanceId)
+	n := len(NewHistory(dir, 0).timestamps())
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Save saves the report and removes reports older than the retention.
+func (h *History) Save(report *Report) error {
+	if err := pct.MakeDir(h.dir); err != nil && !os.IsExist(err) {
+		return err
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	// Write then rename so Reports() never reads a partial report.
+	file := filepath.Join(h.dir, fmt.Sprintf("%d.json", report.StartTs.Unix()))
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	_, err = h.Purge(time.Now())
+	return err
+}
+
+// Reports returns the reports of intervals that started in [start, end),
+// oldest first.
+func (h *History) Reports(start, end time.Time) ([]*Report, error) {
+	reports := []*Report{}
+	for _, ts := range h.timestamps() {
+		if ts < start.Unix() || ts >= end.Unix() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(h.dir, fmt.Sprintf("%d.json", ts)))
+		if err != nil {
+			return nil, err
+		}
+		report := &Report{}
+		if err := json.Unmarshal(data, report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Purge removes reports of intervals that started more than the retention
+// before now.  It returns the number of reports removed.
+func (h *History) Purge(now time.Time) (int, error) {
+	n := 0
+	oldest := now.Add(-h.retain).Unix()
+	for _, ts := range h.timestamps() {
+		if ts >= oldest {
+			break
+		}
+		if err := os.Remove(filepath.Join(h.dir, fmt.Sprintf("%d.json", ts))); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// timestamps returns the start ts of the saved reports, in ascending order.
+func (h *History) timestamps() []int64 {
+	files, _ := filepath.Glob(filepath.Join(h.dir, "*.json"))
+	ts := make(int64Slice, 0, len(files))
+	for _, file := range files {
+		t, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), ".json"), 10, 64)
+		if err != nil {
+			continue // not a report
+		}
+		ts = append(ts, t)
+	}
+	sort.Sort(ts)
+	return ts
+}
+
+// A TableClass is a query class that uses a table, summed over the reports
+// in a History, see TableClasses.
+type TableClass struct {
+	Id          string
+	Fingerprint string
+	Queries     uint64  // total
+	QueryTime   float64 // total (seconds)
+	Intervals   int     // reports with the class
+}
+
+// TableClasses returns the top classes, by total query time, of the reports
+// in the History that use the table.  A class uses the table if the table is
+// in the report's Tables (Config.Tables) or the fingerprint's tables.  Names
+// are compared case-insensitively because fingerprints are lowercase, and an
+// unqualified name matches the table in any database.  The low-ranking
+// queries class is not a query, so it's never returned.
+func (h *History) TableClasses(db, table string, top int) ([]TableClass, error) {
+	qualified := strings.ToLower(db + "." + table)
+	table = strings.ToLower(table)
+	reports, err := h.Reports(time.Unix(0, 0), time.Now().Add(24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	classes := make(map[string]*TableClass)
+	for _, report := range reports {
+		for _, class := range report.Class {
+			if class.Id == "0" {
+				continue // LRQ
+			}
+			tables, ok := report.Tables[class.Id]
+			if !ok {
+				tables = Tables(class.Fingerprint)
+			}
+			if !usesTable(tables, qualified, table) {
+				continue
+			}
+			c, ok := classes[class.Id]
+			if !ok {
+				c = &TableClass{Id: class.Id, Fingerprint: class.Fingerprint}
+				classes[class.Id] = c
+			}
+			c.Queries += class.TotalQueries
+			c.QueryTime += queryTime(class)
+			c.Intervals++
+		}
+	}
+	tableClasses := make(tableClassesByQueryTime, 0, len(classes))
+	for _, c := range classes {
+		tableClasses = append(tableClasses, *c)
+	}
+	sort.Sort(tableClasses)
+	if top > 0 && len(tableClasses) > top {
+		tableClasses = tableClasses[0:top]
+	}
+	return tableClasses, nil
+}
+
+func usesTable(tables []string, qualified, table string) bool {
+	for _, t := range tables {
+		t = strings.ToLower(t)
+		if t == qualified || t == table {
+			return true
+		}
+	}
+	return false
+}
+
+type tableClassesByQueryTime []TableClass
+
+func (a tableClassesByQueryTime) Len() int      { return len(a) }
+func (a tableClassesByQueryTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a tableClassesByQueryTime) Less(i, j int) bool {
+	if a[i].QueryTime == a[j].QueryTime {
+		return a[i].Id < a[j].Id // stable order for equal times
+	}
+	return a[i].QueryTime > a[j].QueryTime
+}
+
+type int64Slice []int64
+
+func (a int64Slice) Len() int           { return len(a) }
+func (a int64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64Slice) Less(i, j int) bool { return a[i] < a[j] }
@@ -0,0 +1,141 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/go-mysql/event"
+	"github.com/percona/percona-agent/qan"
+	"github.com/percona/percona-agent/test"
+	. "gopkg.in/check.v1"
+)
+
+type HistoryTestSuite struct {
+	dir string
+}
+
+var _ = Suite(&HistoryTestSuite{})
+
+func (s *HistoryTestSuite) SetUpTest(t *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("/tmp", "qan-history-test")
+	t.Assert(err, IsNil)
+}
+
+func (s *HistoryTestSuite) TearDownTest(t *C) {
+	if err := os.RemoveAll(s.dir); err != nil {
+		t.Error(err)
+	}
+}
+
+func historyReport(startTs time.Time) *qan.Report {
+	return &qan.Report{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		StartTs:         startTs,
+		EndTs:           startTs.Add(time.Minute),
+	}
+}
+
+func (s *HistoryTestSuite) TestSaveResendPurge(t *C) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	h := qan.NewHistory(s.dir+"/qan-1", 2*time.Hour)
+
+	// Reports from 3h ago are purged when a report is saved.
+	for _, ago := range []time.Duration{3 * time.Hour, 90 * time.Minute, 60 * time.Minute, 30 * time.Minute} {
+		err := h.Save(historyReport(now.Add(-ago)))
+		t.Assert(err, IsNil)
+	}
+	t.Check(test.FileExists(fmt.Sprintf("%s/qan-1/%d.json", s.dir, now.Add(-3*time.Hour).Unix())), Equals, false)
+
+	// Range is [start, end).
+	got, err := h.Reports(now.Add(-90*time.Minute), now.Add(-30*time.Minute))
+	t.Assert(err, IsNil)
+	t.Assert(got, HasLen, 2)
+	t.Check(got[0].StartTs.Equal(now.Add(-90*time.Minute)), Equals, true)
+	t.Check(got[1].StartTs.Equal(now.Add(-60*time.Minute)), Equals, true)
+	t.Check(got[0].InstanceId, Equals, uint(1))
+
+	got, err = h.Reports(now.Add(-5*time.Hour), now)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 3)
+
+	// 1h later, the report from 90m ago is older than the retention.
+	n, err := h.Purge(now.Add(time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, 1)
+	got, err = h.Reports(now.Add(-5*time.Hour), now)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 2)
+
+	// No reports, no error.
+	h = qan.NewHistory(s.dir+"/qan-2", time.Hour)
+	got, err = h.Reports(now.Add(-5*time.Hour), now)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 0)
+}
+
+func historyClass(id, fingerprint string, queries uint64, queryTime float64) *event.QueryClass {
+	class := event.NewQueryClass(id, fingerprint, false, 0)
+	class.TotalQueries = queries
+	class.Metrics.TimeMetrics["Query_time"] = &event.TimeStats{Sum: queryTime}
+	return class
+}
+
+func (s *HistoryTestSuite) TestTableClasses(t *C) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	h := qan.NewHistory(s.dir+"/qan-1", 2*time.Hour)
+
+	r1 := historyReport(now.Add(-2 * time.Minute))
+	r1.Class = []*event.QueryClass{
+		historyClass("0", "", 100, 9), // LRQ
+		historyClass("A", "select * from t where id=?", 10, 1),
+		historyClass("B", "select * from db.t join u using (id)", 5, 2),
+		historyClass("C", "select * from other.t2", 1, 5),
+	}
+	r2 := historyReport(now.Add(-1 * time.Minute))
+	r2.Class = []*event.QueryClass{
+		historyClass("A", "select * from t where id=?", 30, 3),
+		historyClass("D", "update db.u set a=?", 2, 0.5),
+	}
+	// Config.Tables: the tables of the example query, not the fingerprint.
+	r2.Tables = map[string][]string{"D": []string{"db.T"}}
+	t.Assert(h.Save(r1), IsNil)
+	t.Assert(h.Save(r2), IsNil)
+
+	got, err := h.TableClasses("db", "T", 10)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []qan.TableClass{
+		{Id: "A", Fingerprint: "select * from t where id=?", Queries: 40, QueryTime: 4, Intervals: 2},
+		{Id: "B", Fingerprint: "select * from db.t join u using (id)", Queries: 5, QueryTime: 2, Intervals: 1},
+		{Id: "D", Fingerprint: "update db.u set a=?", Queries: 2, QueryTime: 0.5, Intervals: 1},
+	})
+
+	got, err = h.TableClasses("db", "t", 1)
+	t.Assert(err, IsNil)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].Id, Equals, "A")
+
+	got, err = h.TableClasses("db", "nope", 10)
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 0)
+}
@@ -51,6 +51,14 @@ type IntervalIter interface {
 	TickChan() chan time.Time
 }
 
+// A ResumableIter is an IntervalIter that can resume from the start of the
+// next interval saved by the previous agent, see RealAnalyzer.Handoff.
+type ResumableIter interface {
+	IntervalIter
+	Next() *Interval       // start of the next interval, after Stop()
+	Resume(next *Interval) // before Start()
+}
+
 // An IntervalIterFactory makes an IntervalIter, real or mock.
 type IntervalIterFactory interface {
 	Make(analyzerType string, mysqlConn mysql.Connector, tickChan chan time.Time) IntervalIter
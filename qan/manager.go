@@ -40,6 +40,7 @@ type AnalyzerInstance struct {
 	restartChan <-chan bool
 	tickChan    chan time.Time
 	analyzer    Analyzer
+	configHash  string // pct.ConfigHash of the validated config
 }
 
 // A Manager runs AnalyzerInstances, one per MySQL instance as configured.
@@ -55,6 +56,8 @@ type Manager struct {
 	running   bool
 	analyzers map[uint]AnalyzerInstance
 	status    *pct.Status
+	handoff   *pct.Handoff // from the previous agent, see Resume()
+	configId  uint         // InstanceId of the analyzer in qan.conf, 0 if none
 }
 
 func NewManager(
@@ -114,6 +117,7 @@ func (m *Manager) Start() error {
 		m.logger.Error("Read qan config:", err)
 		return nil
 	}
+	m.configId = config.InstanceId
 
 	// Start the slow log or perf schema analyzer. If it fails that's ok for
 	// the qan manager itself (i.e. don't fail this func) because user can fix
@@ -153,6 +157,46 @@ func (m *Manager) Stop() error {
 	return nil
 }
 
+// Handoff implements pct.StateHandoff: resumable analyzers are stopped without
+// un-configuring MySQL and their state is saved for the next agent.  Other
+// analyzers are stopped by Stop() as usual.
+func (m *Manager) Handoff(h *pct.Handoff) error {
+	m.logger.Debug("Handoff:call")
+	defer m.logger.Debug("Handoff:return")
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for instanceId, a := range m.analyzers {
+		ra, ok := a.analyzer.(ResumableAnalyzer)
+		if !ok {
+			continue
+		}
+		m.status.Update("qan", fmt.Sprintf("Handing off %s", a.analyzer))
+		m.clock.Remove(a.tickChan)
+		m.mrm.Remove(a.mysqlConn.DSN(), a.restartChan)
+		state, err := ra.Handoff()
+		delete(m.analyzers, instanceId)
+		if err != nil {
+			return err
+		}
+		if err := h.Put(handoffName(ra.Config()), state); err != nil {
+			return err
+		}
+		m.logger.Info("Handed off", a.analyzer)
+	}
+	return nil
+}
+
+// Resume implements pct.StateHandoff: analyzers started later resume from
+// the state in the handoff.  Call before Start().
+func (m *Manager) Resume(h *pct.Handoff) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.handoff = h
+	return nil
+}
+
 func (m *Manager) Status() map[string]string {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
@@ -165,6 +209,12 @@ func (m *Manager) Status() map[string]string {
 	return status
 }
 
+// Capabilities returns the Config.CollectFrom values the manager supports,
+// for agent cmd Capabilities.
+func (m *Manager) Capabilities() []string {
+	return []string{"collect:perfschema", "collect:slowlog"}
+}
+
 func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.status.UpdateRe("qan", "Handling", cmd)
 	defer m.status.Update("qan", "Running")
@@ -188,6 +238,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		if err := pct.Basedir.WriteConfig("qan", config); err != nil {
 			return cmd.Reply(nil, err)
 		}
+		m.configId = config.InstanceId
 		return cmd.Reply(nil) // success
 	case "StopService":
 		m.mux.Lock()
@@ -205,13 +256,21 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		if err := pct.Basedir.RemoveConfig("qan"); err != nil {
 			errs = append(errs, err)
 		}
+		m.configId = 0
 		return cmd.Reply(nil, errs...)
 	case "GetConfig":
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
+	case "ResendQAN":
+		r := ResendRange{}
+		if err := json.Unmarshal(cmd.Data, &r); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		n, err := m.resend(r)
+		return cmd.Reply(n, err)
 	default:
 		// SetConfig does not work by design.  To re-configure QAN,
-		// stop it then start it again with the new config.
+		// start it again with the new config: it's restarted if the config changed.
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
 }
@@ -241,6 +300,43 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return configs, nil
 }
 
+// Reload applies changes to qan.conf.  It doesn't use pct.ReloadServices
+// because there's one qan.conf but several analyzers, one per MySQL instance,
+// and StopService stops them all and removes qan.conf.  Instead, only the
+// analyzer in qan.conf is changed: it's (re)started if its config is new or
+// changed, stopped if qan.conf was removed, and if the InstanceId was changed,
+// the analyzer of the old instance is stopped.  Other analyzers are not touched.
+func (m *Manager) Reload() []error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.running {
+		return nil
+	}
+
+	config := Config{}
+	if err := pct.Basedir.ReadConfig("qan", &config); err != nil {
+		if !os.IsNotExist(err) {
+			return []error{err}
+		}
+		config.InstanceId = 0 // qan.conf removed
+	}
+
+	errs := []error{}
+	if m.configId != 0 && m.configId != config.InstanceId {
+		if err := m.stopAnalyzer(m.configId); err != nil {
+			errs = append(errs, err)
+		}
+		m.configId = 0
+	}
+	if config.InstanceId != 0 {
+		if err := m.startAnalyzer(config); err != nil {
+			errs = append(errs, err)
+		}
+		m.configId = config.InstanceId
+	}
+	return errs
+}
+
 func ValidateConfig(config *Config) error {
 	if config.CollectFrom == "" {
 		// Before perf schema, CollectFrom didn't exist, so existing default QAN configs
@@ -268,12 +364,43 @@ func ValidateConfig(config *Config) error {
 	if config.Interval > 3600 {
 		return errors.New("Interval must be <= 3600 (1 hour)")
 	}
+	if config.ContextInterval > 0 && config.ContextInterval >= config.Interval {
+		return errors.New("ContextInterval must be < Interval")
+	}
 	if config.WorkerRunTime == 0 {
 		return errors.New("WorkerRuntime must be > 0")
 	}
 	if config.WorkerRunTime > 1200 {
 		return errors.New("WorkerRuntime must be <= 1200 (20 minutes)")
 	}
+	if config.ExplainTop > 0 && !config.ExampleQueries {
+		return errors.New("ExplainTop requires ExampleQueries")
+	}
+	if _, err := NewBlacklist(config.Blacklist); err != nil {
+		return fmt.Errorf("Invalid Blacklist: %s", err)
+	}
+	if config.SamplePercent > 100 {
+		return errors.New("SamplePercent must be <= 100")
+	}
+	if config.SamplePercent > 0 && config.LowImpactTime <= 0 {
+		return errors.New("SamplePercent requires LowImpactTime > 0")
+	}
+	switch config.GroupBy {
+	case "", GROUP_BY_SCHEMA:
+	case GROUP_BY_USER:
+		// events_statements_summary_by_digest has no user column.
+		if config.CollectFrom == "perfschema" {
+			return errors.New("GroupBy user requires CollectFrom slowlog")
+		}
+	default:
+		return fmt.Errorf("Invalid GroupBy: '%s'.  Expected 'schema', 'user', or ''.", config.GroupBy)
+	}
+	if config.MaxSlowLogSize < 0 {
+		return errors.New("MaxSlowLogSize must be >= 0")
+	}
+	if config.RetainSlowLogs < 0 {
+		return errors.New("RetainSlowLogs must be >= 0")
+	}
 	return nil
 }
 
@@ -281,6 +408,38 @@ func ValidateConfig(config *Config) error {
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
 
+// resend resends the reports in the range, see ResendRange.  It returns the
+// number of reports resent.
+func (m *Manager) resend(r ResendRange) (int, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	if !r.Start.Before(r.End) {
+		return 0, fmt.Errorf("Invalid range: start %s is not before end %s", r.Start, r.End)
+	}
+	if r.InstanceId != 0 {
+		if _, ok := m.analyzers[r.InstanceId]; !ok {
+			return 0, fmt.Errorf("No analyzer for MySQL instance %d", r.InstanceId)
+		}
+	}
+	total := 0
+	for instanceId, a := range m.analyzers {
+		if r.InstanceId != 0 && instanceId != r.InstanceId {
+			continue
+		}
+		ha, ok := a.analyzer.(HistoryAnalyzer)
+		if !ok {
+			return total, fmt.Errorf("%s does not keep reports", a.analyzer)
+		}
+		n, err := ha.Resend(r.Start, r.End)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 func (m *Manager) startAnalyzer(config Config) error {
 	/*
 		XXX Assume caller has locked m.mux.
@@ -294,10 +453,21 @@ func (m *Manager) startAnalyzer(config Config) error {
 		return fmt.Errorf("Invalid qan.Config: %s", err)
 	}
 
-	// Check if an analyzer for this MySQL instance already exists.
-	if a, ok := m.analyzers[config.InstanceId]; ok {
-		return pct.ServiceIsRunningError{Service: a.analyzer.String()}
-
+	// The API re-sends StartService to reconcile configs, so an analyzer for
+	// this MySQL instance may already exist.  If its config is the same,
+	// there's nothing to do, else it's restarted with the new config.
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	configHash, err := pct.ConfigHash(data)
+	if err != nil {
+		return err
+	}
+	a, haveAnalyzer := m.analyzers[config.InstanceId]
+	if haveAnalyzer && a.configHash == configHash {
+		m.logger.Info(a.analyzer, "is running with the same config")
+		return nil
 	}
 
 	// Get the MySQL DSN and create a MySQL connection.
@@ -305,6 +475,12 @@ func (m *Manager) startAnalyzer(config Config) error {
 	if err := m.im.Get(config.Service, config.InstanceId, &mysqlInstance); err != nil {
 		return fmt.Errorf("Cannot get MySQL instance from repo: %s", err)
 	}
+	if haveAnalyzer {
+		m.logger.Info("Restart", a.analyzer, "with new config")
+		if err := m.stopAnalyzer(config.InstanceId); err != nil {
+			return err
+		}
+	}
 	mysqlConn := m.mysqlFactory.Make(mysqlInstance.DSN)
 
 	// Add the MySQL DSN to the MySQL restart monitor. If MySQL restarts,
@@ -329,6 +505,16 @@ func (m *Manager) startAnalyzer(config Config) error {
 		restartChan,
 		tickChan,
 	)
+	if ra, ok := analyzer.(ResumableAnalyzer); ok && m.handoff != nil {
+		state := &AnalyzerState{}
+		if ok, err := m.handoff.Take(handoffName(config), state); err != nil {
+			m.logger.Warn("Cannot resume from previous agent:", err)
+		} else if ok {
+			if err := ra.Resume(state); err != nil {
+				m.logger.Warn("Cannot resume from previous agent:", err)
+			}
+		}
+	}
 	if err := analyzer.Start(); err != nil {
 		return fmt.Errorf("Cannot start analyzer: %s", err)
 	}
@@ -339,6 +525,7 @@ func (m *Manager) startAnalyzer(config Config) error {
 		restartChan: restartChan,
 		tickChan:    tickChan,
 		analyzer:    analyzer,
+		configHash:  configHash,
 	}
 
 	return nil // success
@@ -381,3 +568,7 @@ func (m *Manager) stopAnalyzer(instanceId uint) error {
 
 	return nil // success
 }
+
+func handoffName(config Config) string {
+	return fmt.Sprintf("qan-%s-%d", config.Service, config.InstanceId)
+}
@@ -303,6 +303,42 @@ func (s *ManagerTestSuite) TestValidateConfig(t *C) {
 	err := qan.ValidateConfig(&config)
 	t.Check(err, IsNil)
 
+	// GroupBy user isn't possible with perf schema: it has no user column.
+	config.GroupBy = "user"
+	err = qan.ValidateConfig(&config)
+	t.Check(err, IsNil)
+	config.CollectFrom = "perfschema"
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
+	config.GroupBy = "host"
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
+	config.GroupBy = ""
+
+	// Blacklist patterns must compile, and sampling needs a low-impact time.
+	config.Blacklist = []string{"^select @@version", "("}
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
+	config.Blacklist = []string{"^select @@version"}
+	config.SamplePercent = 10
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
+	config.LowImpactTime = 0.5
+	err = qan.ValidateConfig(&config)
+	t.Check(err, IsNil)
+	config.SamplePercent = 101
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
+	config.SamplePercent = 0
+
+	// Status must be sampled more than once per interval for Report.Context.
+	config.ContextInterval = 300
+	err = qan.ValidateConfig(&config)
+	t.Check(err, NotNil)
+	config.ContextInterval = 10
+	err = qan.ValidateConfig(&config)
+	t.Check(err, IsNil)
+
 	config = qan.Config{
 		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
 		Start: []mysql.Query{
@@ -448,6 +484,80 @@ func (s *ManagerTestSuite) TestStartService(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *ManagerTestSuite) TestReload(t *C) {
+	data, err := json.Marshal(&proto.MySQLInstance{Hostname: "db02", DSN: "user:pass@tcp(db02:3306)/"})
+	t.Assert(err, IsNil)
+	s.im.Add("mysql", 2, data, false)
+	defer s.im.Remove("mysql", 2)
+
+	config := qan.Config{
+		ServiceInstance: s.mysqlInstance,
+		Start:           []mysql.Query{mysql.Query{Set: "SET GLOBAL slow_query_log=ON"}},
+		Stop:            []mysql.Query{mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"}},
+		Interval:        300,
+		MaxWorkers:      1,
+		WorkerRunTime:   600,
+		CollectFrom:     "slowlog",
+	}
+	err = pct.Basedir.WriteConfig("qan", config)
+	t.Assert(err, IsNil)
+
+	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
+	a1 := mock.NewQanAnalyzer()
+	a2 := mock.NewQanAnalyzer()
+	a3 := mock.NewQanAnalyzer()
+	f := mock.NewQanAnalyzerFactory(a1, a2, a3)
+	m := qan.NewManager(s.logger, s.clock, s.im, s.mrmsMonitor, mockConnFactory, f)
+	t.Assert(m, NotNil)
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	test.WaitStatus(1, m, "qan", "Running")
+	<-a1.StartChan
+
+	// Same config: nothing to do.
+	errs := m.Reload()
+	t.Check(errs, HasLen, 0)
+	t.Check(f.Args, HasLen, 1)
+
+	// Changed config: the analyzer is restarted.
+	config.Interval = 60
+	err = pct.Basedir.WriteConfig("qan", config)
+	t.Assert(err, IsNil)
+	errs = m.Reload()
+	t.Check(errs, HasLen, 0)
+	<-a1.StopChan
+	<-a2.StartChan
+	t.Assert(f.Args, HasLen, 2)
+	t.Check(f.Args[1].Config.Interval, Equals, uint(60))
+
+	// Changed instance: the old instance's analyzer is stopped and the new
+	// one started, and qan.conf isn't removed like StopService does.
+	config.InstanceId = 2
+	err = pct.Basedir.WriteConfig("qan", config)
+	t.Assert(err, IsNil)
+	errs = m.Reload()
+	t.Check(errs, HasLen, 0)
+	<-a2.StopChan
+	<-a3.StartChan
+	t.Assert(f.Args, HasLen, 3)
+	t.Check(f.Args[2].Config.InstanceId, Equals, uint(2))
+	t.Check(test.FileExists(pct.Basedir.ConfigFile("qan")), Equals, true)
+	gotConfigs, errs := m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Check(gotConfigs, HasLen, 1)
+
+	// qan.conf removed: its analyzer is stopped.
+	err = pct.Basedir.RemoveConfig("qan")
+	t.Assert(err, IsNil)
+	errs = m.Reload()
+	t.Check(errs, HasLen, 0)
+	<-a3.StopChan
+	gotConfigs, errs = m.GetConfig()
+	t.Check(errs, HasLen, 0)
+	t.Check(gotConfigs, HasLen, 0)
+}
+
 func (s *ManagerTestSuite) TestBadCmd(t *C) {
 	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
 	a := mock.NewQanAnalyzer()
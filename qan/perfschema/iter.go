@@ -30,6 +30,7 @@ type Iter struct {
 	// --
 	intervalChan chan *qan.Interval
 	sync         *pct.SyncChan
+	prev         time.Time // start of the next interval, see Next() and Resume()
 }
 
 func NewIter(logger *pct.Logger, tickChan chan time.Time) *Iter {
@@ -61,6 +62,20 @@ func (i *Iter) TickChan() chan time.Time {
 	return i.tickChan
 }
 
+// Next returns the start of the next interval.  Call after Stop().
+func (i *Iter) Next() *qan.Interval {
+	if i.prev.IsZero() {
+		return nil
+	}
+	return &qan.Interval{StartTime: i.prev}
+}
+
+// Resume makes the first interval start at next, i.e. when the previous
+// agent took its last snapshot.  Call before Start().
+func (i *Iter) Resume(next *qan.Interval) {
+	i.prev = next.StartTime
+}
+
 // --------------------------------------------------------------------------
 
 func (i *Iter) run() {
@@ -71,7 +86,6 @@ func (i *Iter) run() {
 		i.sync.Done()
 	}()
 
-	prev := time.Time{}
 	n := 0
 	for {
 		i.logger.Debug("run:wait")
@@ -81,7 +95,7 @@ func (i *Iter) run() {
 			n++
 			iter := &qan.Interval{
 				Number:    n,
-				StartTime: prev,
+				StartTime: i.prev,
 				StopTime:  now,
 			}
 			select {
@@ -89,7 +103,7 @@ func (i *Iter) run() {
 			case <-time.After(1 * time.Second):
 				i.logger.Warn("Lost interval: ", iter)
 			}
-			prev = now
+			i.prev = now
 		case <-i.sync.StopChan:
 			i.logger.Debug("run:stop")
 			return
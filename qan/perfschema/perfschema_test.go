@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -250,6 +251,45 @@ func (s *WorkerTestSuite) Test002(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *WorkerTestSuite) TestGroupBySchema(t *C) {
+	// Same input as 002, but also group by schema, so there's a group class
+	// for each schema in addition to the class aggregate of both.
+
+	rows, err := s.loadData("002")
+	t.Assert(err, IsNil)
+	getRows := makeGetRowsFunc(rows)
+	getText := makeGetTextFunc("select 1")
+	w := perfschema.NewWorker(s.logger, s.nullmysql, getRows, getText)
+	w.SetGroupBy(qan.GROUP_BY_SCHEMA)
+
+	for n := 1; n <= 2; n++ {
+		i := &qan.Interval{
+			Number:    n,
+			StartTime: time.Now().UTC(),
+		}
+		err = w.Setup(i)
+		t.Assert(err, IsNil)
+		res, err := w.Run()
+		t.Assert(err, IsNil)
+		if n == 1 {
+			t.Check(res, IsNil)
+		} else {
+			t.Assert(res, NotNil)
+			t.Assert(res.Class, HasLen, 1)
+			t.Check(res.Class[0].TotalQueries, Equals, uint64(3))
+			t.Assert(res.Group, HasLen, 2)
+			got := map[string]uint64{}
+			for _, g := range res.Group {
+				t.Check(g.Id, Equals, res.Class[0].Id)
+				got[g.Group] = g.TotalQueries
+			}
+			t.Check(got, DeepEquals, map[string]uint64{"db1": 1, "db2": 2})
+		}
+		err = w.Cleanup()
+		t.Assert(err, IsNil)
+	}
+}
+
 func (s *WorkerTestSuite) TestEmptyDigest(t *C) {
 	// This is the simplest input possible: 1 query in iter 1 and 2. The result
 	// is just the increase in its values.
@@ -643,3 +683,45 @@ func (s *WorkerTestSuite) Test003(t *C) {
 	err = w.Cleanup()
 	t.Assert(err, IsNil)
 }
+
+func (s *WorkerTestSuite) TestTruncated(t *C) {
+	// events_statements_summary_by_digest was truncated between iter 1 and 2,
+	// so the query's counters are lower in iter 2. Diffing them would wrap
+	// around, so the result is the iter 2 values: what the query did since
+	// the truncate.
+	rows, err := s.loadData("005")
+	t.Assert(err, IsNil)
+	getRows := makeGetRowsFunc(rows)
+	getText := makeGetTextFunc("select 1")
+	w := perfschema.NewWorker(s.logger, s.nullmysql, getRows, getText)
+
+	i := &qan.Interval{
+		Number:    1,
+		StartTime: time.Now().UTC(),
+	}
+	err = w.Setup(i)
+	t.Assert(err, IsNil)
+	res, err := w.Run()
+	t.Assert(err, IsNil)
+	t.Check(res, IsNil)
+	err = w.Cleanup()
+	t.Assert(err, IsNil)
+
+	i = &qan.Interval{
+		Number:    2,
+		StartTime: time.Now().UTC(),
+	}
+	err = w.Setup(i)
+	t.Assert(err, IsNil)
+	res, err = w.Run()
+	t.Assert(err, IsNil)
+	t.Assert(res, NotNil)
+	t.Assert(res.Class, HasLen, 1)
+	class := res.Class[0]
+	t.Check(class.TotalQueries, Equals, uint64(2))
+	t.Check(class.Metrics.TimeMetrics["Query_time"].Sum, Equals, float64(874610000)*math.Pow10(-12))
+	t.Check(class.Metrics.NumberMetrics["Rows_sent"].Sum, Equals, uint64(20))
+	t.Check(class.Metrics.BoolMetrics["Full_scan"].True, Equals, uint(2))
+	err = w.Cleanup()
+	t.Assert(err, IsNil)
+}
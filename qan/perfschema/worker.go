@@ -19,6 +19,7 @@ package perfschema
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"math"
 	"strings"
@@ -197,6 +198,9 @@ type Worker struct {
 	lastRowCnt    uint
 	lastFetchTime float64
 	lastPrepTime  float64
+	groupBy       string
+	blacklist     qan.Blacklist
+	tables        bool
 }
 
 func NewWorker(logger *pct.Logger, mysqlConn mysql.Connector, getRows GetDigestRowsFunc, getText GetDigestTextFunc) *Worker {
@@ -288,6 +292,38 @@ func (w *Worker) Status() map[string]string {
 	return w.status.All()
 }
 
+// State returns the last snapshot, the counter baselines for the next interval.
+func (w *Worker) State() ([]byte, error) {
+	return json.Marshal(w.prev)
+}
+
+// Resume sets the last snapshot saved by the previous agent so the first
+// interval is the diff since then rather than a new baseline.
+func (w *Worker) Resume(state []byte) error {
+	prev := make(Snapshot)
+	if err := json.Unmarshal(state, &prev); err != nil {
+		return err
+	}
+	w.prev = prev
+	return nil
+}
+
+// SetGroupBy sets qan.Config.GroupBy.  Only qan.GROUP_BY_SCHEMA is possible
+// because events_statements_summary_by_digest has no user column.
+func (w *Worker) SetGroupBy(groupBy string) {
+	w.groupBy = groupBy
+}
+
+// SetBlacklist sets the compiled qan.Config.Blacklist.
+func (w *Worker) SetBlacklist(blacklist qan.Blacklist) {
+	w.blacklist = blacklist
+}
+
+// SetTables sets qan.Config.Tables.
+func (w *Worker) SetTables(tables bool) {
+	w.tables = tables
+}
+
 // --------------------------------------------------------------------------
 
 func (w *Worker) reset() {
@@ -386,11 +422,18 @@ func (w *Worker) prepareResult(prev, curr Snapshot) (*qan.Result, error) {
 
 	global := event.NewGlobalClass()
 	classes := []*event.QueryClass{}
+	resets := 0 // rows with counters lower than in prev
+	groups := []*qan.GroupClass{}
+	tables := make(map[string][]string) // keyed on class ID
 
 	// Compare current classes to previous.
 CLASS_LOOP:
 	for classId, class := range curr {
 
+		if w.blacklist.Match(class.DigestText) {
+			continue CLASS_LOOP
+		}
+
 		// If this class does not exist in prev, skip the entire class.
 		prevClass, _ := prev[classId]
 		/*
@@ -401,12 +444,16 @@ CLASS_LOOP:
 
 		// This class exists in prev, so create a class aggregate of the per-schema
 		// query value diffs, for rows that exist in both prev and curr.
-		d := DigestRow{MinTimerWait: 0xFFFFFFFF} // class aggregate, becomes class metrics
-		n := uint64(0)                           // number of query instances in prev and curr
+		d := DigestRow{MinTimerWait: math.MaxUint64} // class aggregate, becomes class metrics
+		n := uint64(0)                               // number of query instances in prev and curr
 
 		// Each row is an instance of the query executed in the schema.
 	ROW_LOOP:
 		for schema, row := range class.Rows {
+			// If we didn't see this row last time, the query executed some time
+			// during the interval. Since this is our first time seeing it, we
+			// don't diff the values, we use the current values.
+			values := row
 			if prevRow, ok := prevClass.Rows[schema]; ok {
 				// We saw this row last time, so first check if it executed during
 				// the interval:
@@ -415,72 +462,29 @@ CLASS_LOOP:
 				}
 
 				// This row executed during the interval, and we've seen it before,
-				// so athe diff of the totals to the class metric totals. For example,
+				// so add the diff of the totals to the class metric totals. For example,
 				// if query 1 in db1 has prev.CountStar=50 and curr.CountStar=100,
 				// and query 1 in db2 has prev.CountStar=100 and curr.CountStar=200,
 				// that's +50 and +100 executions respectively, so +150 executions for
 				// the class metrics.
-				d.CountStar += row.CountStar - prevRow.CountStar
-				d.SumTimerWait += row.SumTimerWait - prevRow.SumTimerWait
-				d.SumLockTime += row.SumLockTime - prevRow.SumLockTime
-				d.SumErrors += row.SumErrors - prevRow.SumErrors
-				d.SumWarnings += row.SumWarnings - prevRow.SumWarnings
-				d.SumRowsAffected += row.SumRowsAffected - prevRow.SumRowsAffected
-				d.SumRowsSent += row.SumRowsSent - prevRow.SumRowsSent
-				d.SumRowsExamined += row.SumRowsExamined - prevRow.SumRowsExamined
-				d.SumCreatedTmpDiskTables += row.SumCreatedTmpDiskTables - prevRow.SumCreatedTmpDiskTables
-				d.SumCreatedTmpTables += row.SumCreatedTmpTables - prevRow.SumCreatedTmpTables
-				d.SumSelectFullJoin += row.SumSelectFullJoin - prevRow.SumSelectFullJoin
-				d.SumSelectFullRangeJoin += row.SumSelectFullRangeJoin - prevRow.SumSelectFullRangeJoin
-				d.SumSelectRange += row.SumSelectRange - prevRow.SumSelectRange
-				d.SumSelectRangeCheck += row.SumSelectRangeCheck - prevRow.SumSelectRangeCheck
-				d.SumSelectScan += row.SumSelectScan - prevRow.SumSelectScan
-				d.SumSortMergePasses += row.SumSortMergePasses - prevRow.SumSortMergePasses
-				d.SumSortRange += row.SumSortRange - prevRow.SumSortRange
-				d.SumSortRows += row.SumSortRows - prevRow.SumSortRows
-				d.SumSortScan += row.SumSortScan - prevRow.SumSortScan
-				d.SumNoIndexUsed += row.SumNoIndexUsed - prevRow.SumNoIndexUsed
-				d.SumNoGoodIndexUsed += row.SumNoGoodIndexUsed - prevRow.SumNoGoodIndexUsed
-
-				// Take the current min and max.
-				if row.MinTimerWait < d.MinTimerWait {
-					d.MinTimerWait = row.MinTimerWait
-				}
-				if row.MaxTimerWait > d.MaxTimerWait {
-					d.MaxTimerWait = row.MaxTimerWait
+				if diff, ok := diffRow(row, prevRow); ok {
+					values = diff
+				} else {
+					// The counters were reset since last time, so the current
+					// values are what the query did since then.
+					resets++
 				}
-				// Add the averages, divide later.
-				d.AvgTimerWait += row.AvgTimerWait
-			} else {
-				// We didn't see this row last time, so the query executed some
-				// time during the interval. Since this is our first time seeing
-				// it, we don't diff the values, we use the current values.
-				d.CountStar = row.CountStar
-				d.SumTimerWait = row.SumTimerWait
-				d.MinTimerWait = row.MinTimerWait
-				d.AvgTimerWait = row.AvgTimerWait
-				d.MaxTimerWait = row.MaxTimerWait
-				d.SumLockTime = row.SumLockTime
-				d.SumErrors = row.SumErrors
-				d.SumWarnings = row.SumWarnings
-				d.SumRowsAffected = row.SumRowsAffected
-				d.SumRowsSent = row.SumRowsSent
-				d.SumRowsExamined = row.SumRowsExamined
-				d.SumCreatedTmpDiskTables = row.SumCreatedTmpDiskTables
-				d.SumCreatedTmpTables = row.SumCreatedTmpTables
-				d.SumSelectFullJoin = row.SumSelectFullJoin
-				d.SumSelectFullRangeJoin = row.SumSelectFullRangeJoin
-				d.SumSelectRange = row.SumSelectRange
-				d.SumSelectRangeCheck = row.SumSelectRangeCheck
-				d.SumSelectScan = row.SumSelectScan
-				d.SumSortMergePasses = row.SumSortMergePasses
-				d.SumSortRange = row.SumSortRange
-				d.SumSortRows = row.SumSortRows
-				d.SumSortScan = row.SumSortScan
-				d.SumNoIndexUsed = row.SumNoIndexUsed
-				d.SumNoGoodIndexUsed = row.SumNoGoodIndexUsed
 			}
+			addRow(&d, values)
 			n++
+
+			// Each row is also the class's metrics for its schema.
+			if w.groupBy == qan.GROUP_BY_SCHEMA {
+				group := event.NewQueryClass(classId, class.DigestText, false, 0)
+				group.TotalQueries = values.CountStar
+				group.Metrics = makeMetrics(values)
+				groups = append(groups, &qan.GroupClass{Group: schema, QueryClass: group})
+			}
 		}
 
 		// Class was in prev, but no rows in prev were in curr, so skip the class.
@@ -497,38 +501,7 @@ CLASS_LOOP:
 		d.AvgTimerWait /= n
 
 		// Create standard metric stats from the class metrics just calculated.
-		stats := event.NewMetrics()
-
-		// Time metircs are in picoseconds, so multiply by 10^-12 to convert to seconds.
-		stats.TimeMetrics["Query_time"] = &event.TimeStats{
-			Sum: float64(d.SumTimerWait) * math.Pow10(-12),
-			Min: float64(d.MinTimerWait) * math.Pow10(-12),
-			Avg: float64(d.AvgTimerWait) * math.Pow10(-12),
-			Max: float64(d.MaxTimerWait) * math.Pow10(-12),
-		}
-
-		stats.TimeMetrics["Lock_time"] = &event.TimeStats{
-			Sum: float64(d.SumLockTime) * math.Pow10(-12),
-		}
-
-		stats.NumberMetrics["Errors"] = &event.NumberStats{Sum: d.SumErrors}
-		stats.NumberMetrics["Warnings"] = &event.NumberStats{Sum: d.SumWarnings}
-		stats.NumberMetrics["Rows_affected"] = &event.NumberStats{Sum: d.SumRowsAffected}
-		stats.NumberMetrics["Rows_sent"] = &event.NumberStats{Sum: d.SumRowsSent}
-		stats.NumberMetrics["Rows_examined"] = &event.NumberStats{Sum: d.SumRowsExamined}
-		stats.BoolMetrics["Tmp_table_on_disk"] = &event.BoolStats{True: d.SumCreatedTmpDiskTables}
-		stats.BoolMetrics["Tmp_table"] = &event.BoolStats{True: d.SumCreatedTmpTables}
-		stats.BoolMetrics["Full_join"] = &event.BoolStats{True: d.SumSelectFullJoin}
-		stats.NumberMetrics["Select_full_range_join"] = &event.NumberStats{Sum: d.SumSelectFullRangeJoin}
-		stats.NumberMetrics["Select_range"] = &event.NumberStats{Sum: d.SumSelectRange}
-		stats.NumberMetrics["Select_range_check"] = &event.NumberStats{Sum: d.SumSelectRangeCheck}
-		stats.BoolMetrics["Full_scan"] = &event.BoolStats{True: d.SumSelectScan}
-		stats.NumberMetrics["Merge_passes"] = &event.NumberStats{Sum: d.SumSortMergePasses}
-		stats.NumberMetrics["Sort_range"] = &event.NumberStats{Sum: d.SumSortRange}
-		stats.NumberMetrics["Sort_rows"] = &event.NumberStats{Sum: d.SumSortRows}
-		stats.NumberMetrics["Sort_scan"] = &event.NumberStats{Sum: d.SumSortScan}
-		stats.NumberMetrics["No_index_used"] = &event.NumberStats{Sum: d.SumNoIndexUsed}
-		stats.NumberMetrics["No_good_index_used"] = &event.NumberStats{Sum: d.SumNoGoodIndexUsed}
+		stats := makeMetrics(&d)
 
 		// Create and save the pre-aggregated class.  Using only last 16 digits
 		// of checksum is historical: pt-query-digest does the same:
@@ -538,11 +511,19 @@ CLASS_LOOP:
 		class.TotalQueries = d.CountStar
 		class.Metrics = stats
 		classes = append(classes, class)
+		if w.tables {
+			tables[classId] = qan.Tables(class.Fingerprint)
+		}
 
 		// Add the class to the global metrics.
 		global.AddClass(class)
 	}
 
+	if resets > 0 {
+		w.logger.Info(fmt.Sprintf("Counters reset for %d digests, using their current values;"+
+			" events_statements_summary_by_digest was truncated or MySQL restarted", resets))
+	}
+
 	// Each row/class was unique, so update the global counts.
 	nClasses := uint64(len(classes))
 	if nClasses == 0 {
@@ -553,6 +534,133 @@ CLASS_LOOP:
 		Global: global,
 		Class:  classes,
 	}
+	if len(groups) > 0 {
+		result.Group = groups
+	}
+	if len(tables) > 0 {
+		result.Tables = tables
+	}
 
 	return result, nil
 }
+
+// makeMetrics returns standard metric stats from the DigestRow values.
+func makeMetrics(d *DigestRow) *event.Metrics {
+	stats := event.NewMetrics()
+
+	// Time metircs are in picoseconds, so multiply by 10^-12 to convert to seconds.
+	stats.TimeMetrics["Query_time"] = &event.TimeStats{
+		Sum: float64(d.SumTimerWait) * math.Pow10(-12),
+		Min: float64(d.MinTimerWait) * math.Pow10(-12),
+		Avg: float64(d.AvgTimerWait) * math.Pow10(-12),
+		Max: float64(d.MaxTimerWait) * math.Pow10(-12),
+	}
+
+	stats.TimeMetrics["Lock_time"] = &event.TimeStats{
+		Sum: float64(d.SumLockTime) * math.Pow10(-12),
+	}
+
+	stats.NumberMetrics["Errors"] = &event.NumberStats{Sum: d.SumErrors}
+	stats.NumberMetrics["Warnings"] = &event.NumberStats{Sum: d.SumWarnings}
+	stats.NumberMetrics["Rows_affected"] = &event.NumberStats{Sum: d.SumRowsAffected}
+	stats.NumberMetrics["Rows_sent"] = &event.NumberStats{Sum: d.SumRowsSent}
+	stats.NumberMetrics["Rows_examined"] = &event.NumberStats{Sum: d.SumRowsExamined}
+	stats.BoolMetrics["Tmp_table_on_disk"] = &event.BoolStats{True: d.SumCreatedTmpDiskTables}
+	stats.BoolMetrics["Tmp_table"] = &event.BoolStats{True: d.SumCreatedTmpTables}
+	stats.BoolMetrics["Full_join"] = &event.BoolStats{True: d.SumSelectFullJoin}
+	stats.NumberMetrics["Select_full_range_join"] = &event.NumberStats{Sum: d.SumSelectFullRangeJoin}
+	stats.NumberMetrics["Select_range"] = &event.NumberStats{Sum: d.SumSelectRange}
+	stats.NumberMetrics["Select_range_check"] = &event.NumberStats{Sum: d.SumSelectRangeCheck}
+	stats.BoolMetrics["Full_scan"] = &event.BoolStats{True: d.SumSelectScan}
+	stats.NumberMetrics["Merge_passes"] = &event.NumberStats{Sum: d.SumSortMergePasses}
+	stats.NumberMetrics["Sort_range"] = &event.NumberStats{Sum: d.SumSortRange}
+	stats.NumberMetrics["Sort_rows"] = &event.NumberStats{Sum: d.SumSortRows}
+	stats.NumberMetrics["Sort_scan"] = &event.NumberStats{Sum: d.SumSortScan}
+	stats.NumberMetrics["No_index_used"] = &event.NumberStats{Sum: d.SumNoIndexUsed}
+	stats.NumberMetrics["No_good_index_used"] = &event.NumberStats{Sum: d.SumNoGoodIndexUsed}
+
+	return stats
+}
+
+// diffRow returns the values that row accumulated since prev. It returns false
+// if any counter decreased, which means the counters were reset since prev:
+// events_statements_summary_by_digest was truncated, MySQL restarted, or the
+// digest was evicted from the full table and added again. Min, avg, and max
+// are not counters, so they're the current values.
+func diffRow(row, prev *DigestRow) (*DigestRow, bool) {
+	reset := false
+	sub := func(curr, prev uint64) uint64 {
+		if curr < prev {
+			reset = true
+			return 0
+		}
+		return curr - prev
+	}
+	subBool := func(curr, prev uint) uint {
+		return uint(sub(uint64(curr), uint64(prev)))
+	}
+	d := &DigestRow{
+		Schema:                  row.Schema,
+		Digest:                  row.Digest,
+		CountStar:               sub(row.CountStar, prev.CountStar),
+		SumTimerWait:            sub(row.SumTimerWait, prev.SumTimerWait),
+		MinTimerWait:            row.MinTimerWait,
+		AvgTimerWait:            row.AvgTimerWait,
+		MaxTimerWait:            row.MaxTimerWait,
+		SumLockTime:             sub(row.SumLockTime, prev.SumLockTime),
+		SumErrors:               sub(row.SumErrors, prev.SumErrors),
+		SumWarnings:             sub(row.SumWarnings, prev.SumWarnings),
+		SumRowsAffected:         sub(row.SumRowsAffected, prev.SumRowsAffected),
+		SumRowsSent:             sub(row.SumRowsSent, prev.SumRowsSent),
+		SumRowsExamined:         sub(row.SumRowsExamined, prev.SumRowsExamined),
+		SumCreatedTmpDiskTables: subBool(row.SumCreatedTmpDiskTables, prev.SumCreatedTmpDiskTables),
+		SumCreatedTmpTables:     subBool(row.SumCreatedTmpTables, prev.SumCreatedTmpTables),
+		SumSelectFullJoin:       subBool(row.SumSelectFullJoin, prev.SumSelectFullJoin),
+		SumSelectFullRangeJoin:  sub(row.SumSelectFullRangeJoin, prev.SumSelectFullRangeJoin),
+		SumSelectRange:          sub(row.SumSelectRange, prev.SumSelectRange),
+		SumSelectRangeCheck:     sub(row.SumSelectRangeCheck, prev.SumSelectRangeCheck),
+		SumSelectScan:           subBool(row.SumSelectScan, prev.SumSelectScan),
+		SumSortMergePasses:      sub(row.SumSortMergePasses, prev.SumSortMergePasses),
+		SumSortRange:            sub(row.SumSortRange, prev.SumSortRange),
+		SumSortRows:             sub(row.SumSortRows, prev.SumSortRows),
+		SumSortScan:             sub(row.SumSortScan, prev.SumSortScan),
+		SumNoIndexUsed:          sub(row.SumNoIndexUsed, prev.SumNoIndexUsed),
+		SumNoGoodIndexUsed:      sub(row.SumNoGoodIndexUsed, prev.SumNoGoodIndexUsed),
+	}
+	return d, !reset
+}
+
+// addRow adds the row values to the class aggregate d.
+func addRow(d, row *DigestRow) {
+	d.CountStar += row.CountStar
+	d.SumTimerWait += row.SumTimerWait
+	d.SumLockTime += row.SumLockTime
+	d.SumErrors += row.SumErrors
+	d.SumWarnings += row.SumWarnings
+	d.SumRowsAffected += row.SumRowsAffected
+	d.SumRowsSent += row.SumRowsSent
+	d.SumRowsExamined += row.SumRowsExamined
+	d.SumCreatedTmpDiskTables += row.SumCreatedTmpDiskTables
+	d.SumCreatedTmpTables += row.SumCreatedTmpTables
+	d.SumSelectFullJoin += row.SumSelectFullJoin
+	d.SumSelectFullRangeJoin += row.SumSelectFullRangeJoin
+	d.SumSelectRange += row.SumSelectRange
+	d.SumSelectRangeCheck += row.SumSelectRangeCheck
+	d.SumSelectScan += row.SumSelectScan
+	d.SumSortMergePasses += row.SumSortMergePasses
+	d.SumSortRange += row.SumSortRange
+	d.SumSortRows += row.SumSortRows
+	d.SumSortScan += row.SumSortScan
+	d.SumNoIndexUsed += row.SumNoIndexUsed
+	d.SumNoGoodIndexUsed += row.SumNoGoodIndexUsed
+
+	// Take the current min and max.
+	if row.MinTimerWait < d.MinTimerWait {
+		d.MinTimerWait = row.MinTimerWait
+	}
+	if row.MaxTimerWait > d.MaxTimerWait {
+		d.MaxTimerWait = row.MaxTimerWait
+	}
+	// Add the averages, divide later.
+	d.AvgTimerWait += row.AvgTimerWait
+}
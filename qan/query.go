@@ -0,0 +1,205 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"strings"
+)
+
+// StripComments removes /* comments */ from the query, e.g. the request ID or
+// controller name some applications add to every query, so the same logical
+// query has one fingerprint, see Config.StripComments.  Version comments
+// (/*! ... */) and optimizer hints (/*+ ... */) are kept because MySQL runs
+// them.  Quoted strings are not changed.
+func StripComments(query string) string {
+	if !strings.Contains(query, "/*") {
+		return query
+	}
+	buf := make([]byte, 0, len(query))
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := quoteEnd(query, i)
+			buf = append(buf, query[i:end]...)
+			i = end - 1
+		case c == '/' && i+2 < len(query) && query[i+1] == '*' && query[i+2] != '!' && query[i+2] != '+':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				buf = append(buf, query[i:]...) // unterminated, keep the rest
+				return string(buf)
+			}
+			buf = append(buf, ' ')
+			i += 2 + end + 1
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+/**
+ * Tables returns the tables that the query reads or writes, in order, e.g.
+ * "db1.t1" and "t2" for "SELECT * FROM db1.t1 JOIN t2 USING (id)".  It's not
+ * a SQL parser: it returns the names after FROM, JOIN, UPDATE, INTO, and TABLE,
+ * plus the comma-separated names after FROM, UPDATE, and TABLES, which covers
+ * the queries and perf schema digest texts we see in practice.  Names are
+ * returned as written except quotes are removed.
+ */
+func Tables(query string) []string {
+	tokens := tokenize(query)
+	tables := []string{}
+	seen := map[string]bool{}
+	expect := false // next name is a table
+	list := false   // in a comma-separated list of tables
+	prev := ""
+	for _, tok := range tokens {
+		word := strings.ToLower(tok)
+		switch word {
+		case "from", "tables":
+			expect, list = true, true
+		case "update":
+			// Not SELECT ... FOR UPDATE or ON DUPLICATE KEY UPDATE.
+			if prev != "for" && prev != "key" {
+				expect, list = true, true
+			}
+		case "join", "into", "table":
+			expect, list = true, false
+		case ",":
+			expect = list
+		case "if", "not", "exists", "ignore", "low_priority", "quick", "dual":
+			// DROP TABLE IF EXISTS t, INSERT IGNORE INTO t, etc.
+		case "where", "set", "on", "using", "values", "value", "select", "group",
+			"order", "having", "limit", "union", "partition", "(", ")", ";":
+			expect, list = false, false
+		default:
+			if expect && isName(tok) {
+				name := strings.Replace(tok, "`", "", -1)
+				if !seen[name] {
+					seen[name] = true
+					tables = append(tables, name)
+				}
+			}
+			expect = false
+		}
+		prev = word
+	}
+	return tables
+}
+
+// tokenize splits the query into names (possibly qualified, e.g. `db`.`t`),
+// words, and punctuation.  Quoted strings, comments, and whitespace are
+// skipped.
+func tokenize(query string) []string {
+	tokens := []string{}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			i = quoteEnd(query, i)
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += 2 + end + 2
+		case c == '#' || (c == '-' && strings.HasPrefix(query[i:], "-- ")):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return tokens
+			}
+			i += end + 1
+		case c == '`' || isNameChar(c):
+			start := i
+			i = nameEnd(query, i)
+			// Qualified name: name . name, with or without spaces around
+			// the dot (perf schema digest texts have them).
+			for {
+				j := i
+				for j < len(query) && query[j] == ' ' {
+					j++
+				}
+				if j >= len(query) || query[j] != '.' {
+					break
+				}
+				j++
+				for j < len(query) && query[j] == ' ' {
+					j++
+				}
+				if j >= len(query) || !(query[j] == '`' || isNameChar(query[j])) {
+					break
+				}
+				i = nameEnd(query, j)
+			}
+			tokens = append(tokens, strings.Replace(query[start:i], " ", "", -1))
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// isName returns true if the token is an identifier, not a number, ? placeholder,
+// or punctuation.
+func isName(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	c := tok[0]
+	return c == '`' || c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// nameEnd returns the index after the name or `quoted name` starting at i.
+func nameEnd(query string, i int) int {
+	if query[i] == '`' {
+		return quoteEnd(query, i)
+	}
+	for i < len(query) && isNameChar(query[i]) {
+		i++
+	}
+	return i
+}
+
+// quoteEnd returns the index after the closing quote of the string starting
+// at i, or the end of the query if it's not closed.  Quotes are escaped by
+// doubling them or, except for backticks, by a backslash.
+func quoteEnd(query string, i int) int {
+	q := query[i]
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if q != '`' {
+				i++
+			}
+		case q:
+			if i+1 < len(query) && query[i+1] == q {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan_test
+
+import (
+	"github.com/percona/percona-agent/qan"
+	. "gopkg.in/check.v1"
+)
+
+type QueryTestSuite struct{}
+
+var _ = Suite(&QueryTestSuite{})
+
+func (s *QueryTestSuite) TestStripComments(t *C) {
+	tests := map[string]string{
+		"select c from t where id=1":                           "select c from t where id=1",
+		"/* controller:users req:1234 */ select c from t":      "select c from t",
+		"select /* a */ c from t /* b */ where id=1":           "select   c from t   where id=1",
+		"select c from t where s='/* not a comment */'":        "select c from t where s='/* not a comment */'",
+		"select c from t where s='it''s /* x */' /* y */":      "select c from t where s='it''s /* x */'",
+		"select /*+ MAX_EXECUTION_TIME(1000) */ c from t":      "select /*+ MAX_EXECUTION_TIME(1000) */ c from t",
+		"/*!40001 SQL_NO_CACHE */ select c from t /* req:1 */": "/*!40001 SQL_NO_CACHE */ select c from t",
+		"select c from t /* unterminated":                      "select c from t /* unterminated",
+		"select c from `t/*1*/` /* x */":                       "select c from `t/*1*/`",
+		`select c from t where s="a\" /* x */" /* req:2 */`:    `select c from t where s="a\" /* x */"`,
+	}
+	for q, expect := range tests {
+		t.Check(qan.StripComments(q), Equals, expect, Commentf(q))
+	}
+}
+
+func (s *QueryTestSuite) TestTables(t *C) {
+	tests := map[string][]string{
+		"select 1":                   []string{},
+		"SELECT c FROM t WHERE id=1": []string{"t"},
+		"select c from db1.t1 a, `db2`.`t2` as b, t3 where a.id=b.id":     []string{"db1.t1", "db2.t2", "t3"},
+		"select * from t1 left join t2 using (id) join t3 on t3.id=t1.id": []string{"t1", "t2", "t3"},
+		"select c from t1 where id in (select id from t2) for update":     []string{"t1", "t2"},
+		"INSERT INTO t1 (a, b) VALUES (1, 2) ON DUPLICATE KEY UPDATE b=2": []string{"t1"},
+		"insert ignore into t1 select * from t2":                          []string{"t1", "t2"},
+		"UPDATE t1, t2 SET t1.c=t2.c WHERE t1.id=t2.id":                   []string{"t1", "t2"},
+		"delete from t where id=1":                                        []string{"t"},
+		"drop table if exists t":                                          []string{"t"},
+		"LOCK TABLES t1 READ, t2 WRITE":                                   []string{"t1", "t2"},
+		"select 'from x' from t /* from y */":                             []string{"t"},
+		"select c from t1 union select c from t1":                         []string{"t1"},
+		// perf schema digest text
+		"SELECT `c` FROM `db1` . `t1` JOIN `t2` ON `t1` . `id` = `t2` . `id` WHERE `a` = ? ": []string{"db1.t1", "t2"},
+	}
+	for q, expect := range tests {
+		t.Check(qan.Tables(q), DeepEquals, expect, Commentf(q))
+	}
+}
@@ -36,6 +36,17 @@ type Result struct {
 	RunTime    float64             // seconds parsing data, hopefully < interval
 	StopOffset int64               // slow log offset where parsing stopped, should be <= end offset
 	Error      string              `json:",omitempty"`
+	Group      []*GroupClass       `json:",omitempty"` // Config.GroupBy
+	Tables     map[string][]string `json:",omitempty"` // keyed on class ID
+}
+
+// A GroupClass is a query class's metrics for one value of Config.GroupBy,
+// e.g. the class's queries in one schema, so multi-tenant databases can
+// attribute load to tenants.  The class metrics in Result.Class are for
+// all values.
+type GroupClass struct {
+	Group string // schema or user
+	*event.QueryClass
 }
 
 // Final QAN data struct, composed of a Result{} and metatdata, sent to the
@@ -54,6 +65,17 @@ type Report struct {
 	StartOffset     int64  `json:",omitempty"` // parsing starts
 	EndOffset       int64  `json:",omitempty"` // parsing stops, but...
 	StopOffset      int64  `json:",omitempty"` // ...parsing didn't complete if stop < end
+	// Config.ExplainTop:
+	Explain map[string]*Explain `json:",omitempty"` // keyed on class ID
+	// Tables of classes, except LRQ:
+	Tables map[string][]string `json:",omitempty"` // keyed on class ID
+	// Config.SamplePercent:
+	Sampled int `json:",omitempty"` // low-impact classes not sampled, in LRQ
+	// Config.GroupBy:
+	GroupBy string        `json:",omitempty"` // "schema" or "user"
+	Group   []*GroupClass `json:",omitempty"` // of classes in Class, except LRQ
+	// Config.ContextInterval:
+	Context *Context `json:",omitempty"` // server status during the interval
 }
 
 type ByQueryTime []*event.QueryClass
@@ -66,6 +88,15 @@ func (a ByQueryTime) Less(i, j int) bool {
 	return a[i].Metrics.TimeMetrics["Query_time"].Sum > a[j].Metrics.TimeMetrics["Query_time"].Sum
 }
 
+type GroupByQueryTime []*GroupClass
+
+func (a GroupByQueryTime) Len() int      { return len(a) }
+func (a GroupByQueryTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a GroupByQueryTime) Less(i, j int) bool {
+	// descending order
+	return a[i].Metrics.TimeMetrics["Query_time"].Sum > a[j].Metrics.TimeMetrics["Query_time"].Sum
+}
+
 func MakeReport(config Config, interval *Interval, result *Result) *Report {
 	// Sort classes by Query_time_sum, descending.
 	sort.Sort(ByQueryTime(result.Class))
@@ -93,19 +124,36 @@ func MakeReport(config Config, interval *Interval, result *Result) *Report {
 		report.StopOffset = result.StopOffset
 	}
 
+	// Sample low-impact classes; those not sampled are reported in the LRQ.
+	classes := result.Class
+	lrqClasses := []*event.QueryClass{}
+	if config.SamplePercent > 0 && config.SamplePercent < 100 {
+		classes, lrqClasses = sampleClasses(classes, config.SamplePercent, config.LowImpactTime)
+		report.Sampled = len(lrqClasses)
+	}
+
 	// Return all query classes if there's no limit or number of classes is
-	// less than the limit.
-	n := len(result.Class)
-	if config.ReportLimit == 0 || n <= int(config.ReportLimit) {
+	// less than the limit, and none were left out by sampling.
+	n := len(classes)
+	if (config.ReportLimit == 0 || n <= int(config.ReportLimit)) && len(lrqClasses) == 0 {
+		report.groupClasses(config.GroupBy, result.Group)
+		report.classTables(result.Tables)
 		return report // all classes, no LRQ
 	}
 
 	// Top queries
-	report.Class = result.Class[0:config.ReportLimit]
+	if config.ReportLimit > 0 && n > int(config.ReportLimit) {
+		lrqClasses = append(lrqClasses, classes[config.ReportLimit:n]...)
+		classes = classes[0:config.ReportLimit]
+	}
+	report.Class = make([]*event.QueryClass, len(classes), len(classes)+1)
+	copy(report.Class, classes)
+	report.groupClasses(config.GroupBy, result.Group)
+	report.classTables(result.Tables)
 
 	// Low-ranking Queries
 	lrq := event.NewQueryClass("0", "", false, 0*time.Second)
-	for _, query := range result.Class[config.ReportLimit:n] {
+	for _, query := range lrqClasses {
 		addQuery(lrq, query)
 	}
 	report.Class = append(report.Class, lrq)
@@ -132,3 +180,39 @@ func addQuery(dst, src *event.QueryClass) {
 		}
 	}
 }
+
+// groupClasses sets the report's group classes to those of its classes.
+// Groups of low-ranking queries are not reported: they're only in the LRQ.
+func (r *Report) groupClasses(groupBy string, groups []*GroupClass) {
+	if groupBy == "" || len(groups) == 0 {
+		return
+	}
+	reported := make(map[string]bool, len(r.Class))
+	for _, class := range r.Class {
+		reported[class.Id] = true
+	}
+	r.GroupBy = groupBy
+	r.Group = []*GroupClass{}
+	for _, g := range groups {
+		if reported[g.Id] {
+			r.Group = append(r.Group, g)
+		}
+	}
+	sort.Sort(GroupByQueryTime(r.Group))
+}
+
+// classTables sets the report's tables to those of its classes.
+func (r *Report) classTables(tables map[string][]string) {
+	if len(tables) == 0 {
+		return
+	}
+	r.Tables = make(map[string][]string)
+	for _, class := range r.Class {
+		if t := tables[class.Id]; len(t) > 0 {
+			r.Tables[class.Id] = t
+		}
+	}
+	if len(r.Tables) == 0 {
+		r.Tables = nil
+	}
+}
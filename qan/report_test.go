@@ -19,10 +19,12 @@ package qan_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/go-mysql/event"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/qan"
 	"github.com/percona/percona-agent/qan/slowlog"
@@ -127,3 +129,202 @@ func (s *ReportTestSuite) TestResult014(t *C) {
 	// This query required improving the log parser to get the correct checksum ID:
 	t.Check(report.Class[0].Id, Equals, "DB9EF18846547B8C")
 }
+
+func groupClass(group, id string, queryTime float64) *qan.GroupClass {
+	class := event.NewQueryClass(id, "", false, 0)
+	class.Metrics.TimeMetrics["Query_time"] = &event.TimeStats{Sum: queryTime}
+	return &qan.GroupClass{Group: group, QueryClass: class}
+}
+
+func (s *ReportTestSuite) TestGroupBy(t *C) {
+	data, err := ioutil.ReadFile(outputDir + "/result001.json")
+	t.Assert(err, IsNil)
+
+	result := &qan.Result{}
+	err = json.Unmarshal(data, result)
+	t.Assert(err, IsNil)
+	result.Group = []*qan.GroupClass{
+		groupClass("db1", "3000000000000003", 0.9),
+		groupClass("db1", "5000000000000005", 0.101001), // in LRQ
+		groupClass("db2", "3000000000000003", 2),
+		groupClass("db2", "2000000000000002", 1.5),
+	}
+
+	interval := &qan.Interval{
+		Filename:  "slow.log",
+		StartTime: time.Now().Add(-1 * time.Second),
+		StopTime:  time.Now(),
+	}
+	config := qan.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		ReportLimit:     2,
+	}
+
+	// No GroupBy, no groups.
+	report := qan.MakeReport(config, interval, result)
+	t.Check(report.GroupBy, Equals, "")
+	t.Check(report.Group, IsNil)
+
+	// Groups of top classes sorted by query time, none of LRQ classes.
+	config.GroupBy = qan.GROUP_BY_SCHEMA
+	report = qan.MakeReport(config, interval, result)
+	t.Check(report.GroupBy, Equals, "schema")
+	got := []string{}
+	for _, g := range report.Group {
+		got = append(got, g.Group+" "+g.Id)
+	}
+	t.Check(got, DeepEquals, []string{
+		"db2 3000000000000003",
+		"db2 2000000000000002",
+		"db1 3000000000000003",
+	})
+}
+
+func (s *ReportTestSuite) TestSample(t *C) {
+	data, err := ioutil.ReadFile(outputDir + "/result001.json")
+	t.Assert(err, IsNil)
+
+	result := &qan.Result{}
+	err = json.Unmarshal(data, result)
+	t.Assert(err, IsNil)
+
+	interval := &qan.Interval{
+		Filename:  "slow.log",
+		StartTime: time.Now().Add(-1 * time.Second),
+		StopTime:  time.Now(),
+	}
+	config := qan.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		ReportLimit:     10,
+		SamplePercent:   80,
+		LowImpactTime:   1.5,
+	}
+
+	// Classes 1, 4, and 5 are low-impact (< 1.5s). Sampling is by class ID:
+	// 1 and 5 are sampled, 4 is not so it's reported in the LRQ.
+	report := qan.MakeReport(config, interval, result)
+	t.Check(report.Sampled, Equals, 1)
+	got := []string{}
+	for _, class := range report.Class {
+		got = append(got, class.Id)
+	}
+	t.Check(got, DeepEquals, []string{
+		"3000000000000003",
+		"2000000000000002",
+		"1000000000000001",
+		"5000000000000005",
+		"0",
+	})
+	lrq := report.Class[4]
+	t.Check(int(lrq.TotalQueries), Equals, 1) // classes, see addQuery()
+	t.Check(lrq.Metrics.TimeMetrics["Query_time"].Sum, Equals, float64(1))
+
+	// Sampled and ReportLimit overflow classes are both in the LRQ.
+	config.ReportLimit = 2
+	report = qan.MakeReport(config, interval, result)
+	t.Check(report.Sampled, Equals, 1)
+	t.Assert(report.Class, HasLen, 3)
+	t.Check(report.Class[2].Id, Equals, "0")
+	t.Check(int(report.Class[2].TotalQueries), Equals, 3)
+	t.Check(report.Class[2].Metrics.TimeMetrics["Query_time"].Sum, Equals, float64(1+1+0.101001))
+
+	// 100% samples every class.
+	config.ReportLimit = 10
+	config.SamplePercent = 100
+	report = qan.MakeReport(config, interval, result)
+	t.Check(report.Sampled, Equals, 0)
+	t.Check(report.Class, HasLen, 5)
+}
+
+func (s *ReportTestSuite) TestTables(t *C) {
+	data, err := ioutil.ReadFile(outputDir + "/result001.json")
+	t.Assert(err, IsNil)
+
+	result := &qan.Result{}
+	err = json.Unmarshal(data, result)
+	t.Assert(err, IsNil)
+	result.Tables = map[string][]string{
+		"3000000000000003": []string{"db1.t1"},
+		"2000000000000002": []string{},
+		"1000000000000001": []string{"t2", "t3"}, // in LRQ
+	}
+
+	interval := &qan.Interval{
+		Filename:  "slow.log",
+		StartTime: time.Now().Add(-1 * time.Second),
+		StopTime:  time.Now(),
+	}
+	config := qan.Config{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		ReportLimit:     2,
+	}
+
+	// Tables of top classes that have tables.
+	report := qan.MakeReport(config, interval, result)
+	t.Check(report.Tables, DeepEquals, map[string][]string{
+		"3000000000000003": []string{"db1.t1"},
+	})
+
+	config.ReportLimit = 0
+	report = qan.MakeReport(config, interval, result)
+	t.Check(report.Tables, HasLen, 2)
+	t.Check(report.Tables["1000000000000001"], DeepEquals, []string{"t2", "t3"})
+}
+
+func (s *ReportTestSuite) TestBlacklist(t *C) {
+	b, err := qan.NewBlacklist([]string{"^select @@version", "heartbeat"})
+	t.Assert(err, IsNil)
+	t.Check(b.Match("select @@version_comment limit ?"), Equals, true)
+	t.Check(b.Match("SELECT @@version_comment LIMIT ?"), Equals, true) // perf schema digest text
+	t.Check(b.Match("update percona.heartbeat set ts=?"), Equals, true)
+	t.Check(b.Match("select c from t where id=?"), Equals, false)
+
+	// No patterns, no matches.
+	var none qan.Blacklist
+	t.Check(none.Match("select ?"), Equals, false)
+
+	_, err = qan.NewBlacklist([]string{"select ("})
+	t.Check(err, NotNil)
+}
+
+type explainer struct {
+	queries []string
+}
+
+func (e *explainer) Explain(db, query string) (*proto.ExplainResult, error) {
+	e.queries = append(e.queries, db+": "+query)
+	if query == "select bad" {
+		return nil, fmt.Errorf("EXPLAIN failed: syntax error")
+	}
+	return &proto.ExplainResult{JSON: `{"query_block": {}}`}, nil
+}
+
+func (s *ReportTestSuite) TestExplainTop(t *C) {
+	classes := []*event.QueryClass{
+		event.NewQueryClass("1", "select c from t", true, 0),
+		event.NewQueryClass("2", "select ?", false, 0), // no example
+		event.NewQueryClass("3", "select bad", true, 0),
+		event.NewQueryClass("4", "select d from u", true, 0),
+		event.NewQueryClass("0", "", false, 0), // LRQ
+	}
+	classes[0].Example = &event.Example{Db: "db1", Query: "select c from t"}
+	classes[2].Example = &event.Example{Db: "db1", Query: "select bad"}
+	classes[3].Example = &event.Example{Db: "db2", Query: "select d from u"}
+
+	// Top 2 that have examples.
+	e := &explainer{}
+	got := qan.ExplainTop(e, classes, 2)
+	t.Check(e.queries, DeepEquals, []string{"db1: select c from t", "db1: select bad"})
+	t.Assert(got, HasLen, 2)
+	t.Check(got["1"].Db, Equals, "db1")
+	t.Check(got["1"].Result.JSON, Equals, `{"query_block": {}}`)
+	t.Check(got["1"].Error, Equals, "")
+	t.Check(got["3"].Result, IsNil)
+	t.Check(got["3"].Error, Equals, "EXPLAIN failed: syntax error")
+
+	// More than there are.
+	e = &explainer{}
+	got = qan.ExplainTop(e, classes, 10)
+	t.Check(got, HasLen, 3)
+	t.Check(e.queries, HasLen, 3)
+}
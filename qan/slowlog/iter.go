@@ -20,8 +20,10 @@ package slowlog
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/percona/cloud-protocol/proto/v1"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/qan"
 )
@@ -36,6 +38,8 @@ type Iter struct {
 	intervalNo   int
 	intervalChan chan *qan.Interval
 	sync         *pct.SyncChan
+	cur          *qan.Interval // start of the next interval, see Next()
+	resume       *qan.Interval // from the previous agent, see Resume()
 }
 
 func NewIter(logger *pct.Logger, filename FilenameFunc, tickChan chan time.Time) *Iter {
@@ -68,6 +72,24 @@ func (i *Iter) TickChan() chan time.Time {
 	return i.tickChan
 }
 
+// Next returns the start of the next interval.  Call after Stop().
+func (i *Iter) Next() *qan.Interval {
+	if i.cur == nil || i.cur.StartTime.IsZero() {
+		return nil
+	}
+	return &qan.Interval{
+		StartTime:   i.cur.StartTime,
+		Filename:    i.cur.Filename,
+		StartOffset: i.cur.StartOffset,
+	}
+}
+
+// Resume makes the first interval start at next, i.e. where the previous
+// agent stopped, if the slow log is the same.  Call before Start().
+func (i *Iter) Resume(next *qan.Interval) {
+	i.resume = next
+}
+
 // --------------------------------------------------------------------------
 
 func (i *Iter) run() {
@@ -79,7 +101,8 @@ func (i *Iter) run() {
 	}()
 
 	var prevFileInfo os.FileInfo
-	cur := &qan.Interval{}
+	watchdog := pct.NewFileWatchdog()
+	i.cur = &qan.Interval{}
 
 	for {
 		i.logger.Debug("run:idle")
@@ -92,7 +115,7 @@ func (i *Iter) run() {
 			curFile, err := i.filename()
 			if err != nil {
 				i.logger.Warn(err)
-				cur = new(qan.Interval)
+				i.cur = new(qan.Interval)
 				continue
 			}
 
@@ -101,53 +124,85 @@ func (i *Iter) run() {
 			curSize, err := pct.FileSize(curFile)
 			if err != nil {
 				i.logger.Warn(err)
-				cur = new(qan.Interval)
+				i.cur = new(qan.Interval)
 				continue
 			}
 			i.logger.Debug(fmt.Sprintf("run:%s:%d", curFile, curSize))
 
-			// File changed if prev file not same as current file.
-			// @todo: Normally this only changes when QAN manager rotates slow log
-			//        at interval.  If it changes for another reason (e.g. user
-			//        renames slow log) then StartOffset=0 may not be ideal.
+			// File changed if prev file not same as current file.  Normally
+			// this only changes when the worker rotates the slow log, which
+			// parses the old file to its end, so the new one starts at 0.
 			curFileInfo, _ := os.Stat(curFile)
 			fileChanged := !os.SameFile(prevFileInfo, curFileInfo)
 			prevFileInfo = curFileInfo
 
-			if !cur.StartTime.IsZero() { // StartTime is set
+			// If it changes for another reason, e.g. logrotate, the rest of
+			// the old file must be parsed too, see pct.FileWatchdog.
+			rotation, err := watchdog.Check(curFile, i.cur.StartOffset)
+			if err != nil {
+				i.logger.Warn(err)
+			}
+
+			if !i.cur.StartTime.IsZero() { // StartTime is set
 				i.logger.Debug("run:next")
 				i.intervalNo++
 
 				// End of current interval:
-				cur.Filename = curFile
+				i.cur.Filename = curFile
+				i.cur.EndOffset = curSize
+				nextOffset := curSize
 				if fileChanged {
 					// Start from beginning of new file.
 					i.logger.Info("File changed")
-					cur.StartOffset = 0
+					i.cur.StartOffset = 0
 				}
-				cur.EndOffset = curSize
-				cur.StopTime = now
-				cur.Number = i.intervalNo
+				if rotation != nil && !agentRotated.take(rotation.RotatedTo) {
+					rotation.Report(i.logger, proto.ServiceInstance{})
+					if finishRotated(i.cur, rotation) {
+						// This interval is the rest of the old file, so the
+						// next one starts at the beginning of the new file.
+						nextOffset = 0
+					}
+				}
+				i.cur.StopTime = now
+				i.cur.Number = i.intervalNo
 
 				// Send interval to manager which should be ready to receive it.
 				select {
-				case i.intervalChan <- cur:
+				case i.intervalChan <- i.cur:
 				case <-time.After(1 * time.Second):
-					i.logger.Warn(fmt.Sprintf("Lost interval: %+v", cur))
+					i.logger.Warn(fmt.Sprintf("Lost interval: %+v", i.cur))
 				}
 
 				// Next interval:
-				cur = &qan.Interval{
+				i.cur = &qan.Interval{
 					StartTime:   now,
-					StartOffset: curSize,
+					Filename:    curFile,
+					StartOffset: nextOffset,
 				}
 			} else {
 				// First interval, either due to first tick or because an error
 				// occurred earlier so a new interval was started.
 				i.logger.Debug("run:first")
-				cur.StartOffset = curSize
-				cur.StartTime = now
+				i.cur.Filename = curFile
+				i.cur.StartOffset = curSize
+				i.cur.StartTime = now
 				prevFileInfo, _ = os.Stat(curFile)
+				watchdog.Reset(curFile)
+
+				// If resuming where the previous agent stopped, start there
+				// instead so the interval includes what it didn't parse.  If
+				// the slow log is smaller, it was rotated or truncated since.
+				if r := i.resume; r != nil {
+					i.resume = nil
+					if r.Filename == curFile && r.StartOffset <= curSize {
+						i.logger.Info(fmt.Sprintf("Resuming at %s offset %d", r.Filename, r.StartOffset))
+						i.cur.StartOffset = r.StartOffset
+						i.cur.StartTime = r.StartTime
+					} else {
+						i.logger.Info(fmt.Sprintf("Cannot resume at %s offset %d: slow log changed", r.Filename, r.StartOffset))
+					}
+				}
 			}
 		case <-i.sync.StopChan:
 			i.logger.Debug("run:stop")
@@ -155,3 +210,52 @@ func (i *Iter) run() {
 		}
 	}
 }
+
+// finishRotated makes the interval the rest of the old slow log if it was
+// rotated and has bytes not read yet, and returns true, else it returns false.
+// If the slow log was truncated, the interval is what was written since.
+func finishRotated(interval *qan.Interval, r *pct.Rotation) bool {
+	if r.Truncated {
+		interval.StartOffset = 0
+		return false
+	}
+	if r.RotatedTo == "" || r.Size <= r.Offset {
+		return false
+	}
+	interval.Filename = r.RotatedTo
+	interval.StartOffset = r.Offset
+	interval.EndOffset = r.Size
+	return true
+}
+
+/**
+ * Slow logs rotated by the worker when they're larger than MaxSlowLogSize,
+ * see Worker.rotateSlowLog.  The worker parses them to the end, so the iter
+ * mustn't make an interval of the rest of them when it sees the rotation.
+ */
+type rotatedFiles struct {
+	mux   *sync.Mutex
+	files map[string]bool
+}
+
+var agentRotated = &rotatedFiles{
+	mux:   &sync.Mutex{},
+	files: make(map[string]bool),
+}
+
+func (r *rotatedFiles) add(file string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.files[file] = true
+}
+
+// take returns true if the agent rotated the slow log to file, once.
+func (r *rotatedFiles) take(file string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.files[file] {
+		return false
+	}
+	delete(r.files, file)
+	return true
+}
@@ -297,8 +297,8 @@ func (s *WorkerTestSuite) TestRotateAndRemoveSlowLog(t *C) {
 	 * to NAME-TS where NAME is the original name and TS is the current Unix
 	 * timestamp (UTC); and 2) it sets interval.StopOff = file size of NAME-TS
 	 * to finish parsing the log. Therefore, results for 2nd interval should
-	 * include our 3rd interval. -- The worker also calls Start and Stop so the
-	 * nullmysql conn should record the queries being set.
+	 * include our 3rd interval. -- The worker also flushes the slow log so
+	 * the nullmysql conn should record the FLUSH SLOW LOGS being set.
 	 */
 
 	// See TestStartService() for description of these startup tasks.
@@ -354,7 +354,9 @@ func (s *WorkerTestSuite) TestRotateAndRemoveSlowLog(t *C) {
 	}
 	w.Setup(i2)
 	gotSet = s.nullmysql.GetSet()
-	expectSet := append(config.Stop, config.Start...)
+	expectSet := []mysql.Query{
+		mysql.Query{Set: "FLUSH SLOW LOGS"},
+	}
 	if same, diff := IsDeeply(gotSet, expectSet); !same {
 		Dump(gotSet)
 		t.Error(diff)
@@ -466,7 +468,9 @@ func (s *WorkerTestSuite) TestRotateSlowLog(t *C) {
 	}
 	w.Setup(i2)
 	gotSet = s.nullmysql.GetSet()
-	expectSet := append(config.Stop, config.Start...)
+	expectSet := []mysql.Query{
+		mysql.Query{Set: "FLUSH SLOW LOGS"},
+	}
 	if same, diff := IsDeeply(gotSet, expectSet); !same {
 		Dump(gotSet)
 		t.Error(diff)
@@ -513,6 +517,73 @@ func (s *WorkerTestSuite) TestRotateSlowLog(t *C) {
 	}
 }
 
+func (s *WorkerTestSuite) TestRetainSlowLogs(t *C) {
+	// Same as TestRotateAndRemoveSlowLog but keep the 2 newest rotated slow
+	// logs: the one rotated by the test and the newer of 2 older ones.
+	slowlogFile := "slow006.log"
+	files, _ := filepath.Glob("/tmp/" + slowlogFile + "-[0-9]*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+	for _, ts := range []string{"1400000000", "1400000300"} {
+		err := ioutil.WriteFile("/tmp/"+slowlogFile+"-"+ts, []byte{}, 0644)
+		t.Assert(err, IsNil)
+	}
+	defer func() {
+		files, _ := filepath.Glob("/tmp/" + slowlogFile + "-[0-9]*")
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	config := qan.Config{
+		ServiceInstance:   s.mysqlInstance,
+		Interval:          300,
+		MaxSlowLogSize:    1000,
+		RemoveOldSlowLogs: true,
+		RetainSlowLogs:    2, // <-- HERE
+		ExampleQueries:    false,
+		WorkerRunTime:     600,
+		Start: []mysql.Query{
+			mysql.Query{Set: "-- start"},
+		},
+		Stop: []mysql.Query{
+			mysql.Query{Set: "-- stop"},
+		},
+		CollectFrom: "slowlog",
+	}
+	w := slowlog.NewWorker(s.logger, config, s.nullmysql)
+
+	cp := exec.Command("cp", inputDir+slowlogFile, "/tmp/"+slowlogFile)
+	cp.Run()
+
+	now := time.Now()
+	i := &qan.Interval{
+		Filename:    "/tmp/" + slowlogFile,
+		StartOffset: 0,
+		EndOffset:   1833,
+		StartTime:   now,
+		StopTime:    now,
+	}
+	w.Setup(i)
+	t.Check(i.EndOffset, Equals, int64(2200))
+	rotated := i.Filename
+	t.Check(rotated, Not(Equals), "/tmp/"+slowlogFile)
+
+	res, err := w.Run()
+	t.Assert(err, IsNil)
+	t.Check(res, NotNil)
+
+	// Nothing is purged until the rotated slow log has been parsed.
+	files, _ = filepath.Glob("/tmp/" + slowlogFile + "-[0-9]*")
+	t.Check(files, HasLen, 3)
+
+	w.Cleanup()
+	files, _ = filepath.Glob("/tmp/" + slowlogFile + "-[0-9]*")
+	sort.Strings(files)
+	t.Check(files, DeepEquals, []string{"/tmp/" + slowlogFile + "-1400000300", rotated})
+}
+
 func (s *WorkerTestSuite) TestStop(t *C) {
 	config := qan.Config{
 		ServiceInstance:   s.mysqlInstance,
@@ -710,3 +781,118 @@ func (s *IterTestSuite) TestIterFile(t *C) {
 
 	i.Stop()
 }
+
+func (s *IterTestSuite) TestIterResume(t *C) {
+	tickChan := make(chan time.Time)
+
+	tmpFile, _ := ioutil.TempFile("/tmp", "interval_test.")
+	tmpFile.Close()
+	fileName = tmpFile.Name()
+	_ = ioutil.WriteFile(fileName, []byte("123"), 0777)
+	defer func() { os.Remove(fileName) }()
+
+	// The previous agent's iter starts an interval at offset 3, then the
+	// agent restarts before the interval ends.
+	i := slowlog.NewIter(s.logger, getFilename, tickChan)
+	t.Check(i.Next(), IsNil)
+	i.Start()
+	t1 := time.Now()
+	tickChan <- t1
+	i.Stop()
+	next := i.Next()
+	t.Check(next, test.DeepEquals, &qan.Interval{
+		Filename:    fileName,
+		StartTime:   t1,
+		StartOffset: 3,
+	})
+
+	// MySQL writes more while the agent restarts.
+	_ = ioutil.WriteFile(fileName, []byte("123456"), 0777)
+
+	// The new agent's iter resumes at offset 3, so the data written
+	// during the restart is in its first interval.
+	i = slowlog.NewIter(s.logger, getFilename, tickChan)
+	i.Resume(next)
+	i.Start()
+	defer i.Stop()
+	tickChan <- time.Now()
+
+	_ = ioutil.WriteFile(fileName, []byte("123456789"), 0777)
+	t3 := time.Now()
+	tickChan <- t3
+
+	got := <-i.IntervalChan()
+	t.Check(got, test.DeepEquals, &qan.Interval{
+		Number:      1,
+		Filename:    fileName,
+		StartTime:   t1,
+		StopTime:    t3,
+		StartOffset: 3,
+		EndOffset:   9,
+	})
+}
+
+func (s *IterTestSuite) TestIterRotate(t *C) {
+	tickChan := make(chan time.Time)
+
+	tmpFile, _ := ioutil.TempFile("/tmp", "interval_test.")
+	tmpFile.Close()
+	fileName = tmpFile.Name()
+	_ = ioutil.WriteFile(fileName, []byte("123"), 0777)
+	defer func() { os.Remove(fileName) }()
+
+	i := slowlog.NewIter(s.logger, getFilename, tickChan)
+	i.Start()
+	defer i.Stop()
+	t1 := time.Now()
+	tickChan <- t1
+
+	// logrotate renames the slow log, MySQL writes more to it before it's
+	// flushed, then creates a new one and writes to it.
+	rotatedFile := fileName + ".1"
+	os.Rename(fileName, rotatedFile)
+	defer os.Remove(rotatedFile)
+	_ = ioutil.WriteFile(rotatedFile, []byte("123456"), 0777)
+	_ = ioutil.WriteFile(fileName, []byte("abcd"), 0777)
+
+	// The interval is the rest of the rotated slow log, not skipped.
+	t2 := time.Now()
+	tickChan <- t2
+	got := <-i.IntervalChan()
+	t.Check(got, test.DeepEquals, &qan.Interval{
+		Number:      1,
+		Filename:    rotatedFile,
+		StartTime:   t1,
+		StopTime:    t2,
+		StartOffset: 3,
+		EndOffset:   6,
+	})
+
+	// The next interval is the new slow log from its beginning.
+	t3 := time.Now()
+	tickChan <- t3
+	got = <-i.IntervalChan()
+	t.Check(got, test.DeepEquals, &qan.Interval{
+		Number:      2,
+		Filename:    fileName,
+		StartTime:   t2,
+		StopTime:    t3,
+		StartOffset: 0,
+		EndOffset:   4,
+	})
+
+	// logrotate copytruncate: the slow log is truncated, then MySQL writes
+	// to it again.  The interval is what was written since.
+	_ = ioutil.WriteFile(fileName, []byte("ab"), 0777)
+	t4 := time.Now()
+	tickChan <- t4
+	got = <-i.IntervalChan()
+	t.Check(got, test.DeepEquals, &qan.Interval{
+		Number:      3,
+		Filename:    fileName,
+		StartTime:   t3,
+		StopTime:    t4,
+		StartOffset: 0,
+		EndOffset:   2,
+	})
+}
@@ -20,6 +20,10 @@ package slowlog
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto/v1"
@@ -32,6 +36,11 @@ import (
 	"github.com/percona/percona-agent/qan"
 )
 
+// Makes MySQL close and reopen the slow log after it's renamed.
+var flushSlowLogs = []mysql.Query{
+	mysql.Query{Set: "FLUSH SLOW LOGS"},
+}
+
 type WorkerFactory interface {
 	Make(name string, config qan.Config, mysqlConn mysql.Connector) *Worker
 }
@@ -84,6 +93,7 @@ type Worker struct {
 	sync            *pct.SyncChan
 	running         bool
 	logParser       log.LogParser
+	blacklist       qan.Blacklist
 	// Diff against mysql tz and UTC. Used to calculate first_seen and last_seen
 	utcOffset time.Duration
 }
@@ -97,6 +107,11 @@ func NewWorker(logger *pct.Logger, config qan.Config, mysqlConn mysql.Connector)
 		logger.Warn(err.Error())
 	}
 
+	blacklist, err := qan.NewBlacklist(config.Blacklist)
+	if err != nil {
+		logger.Warn("Invalid Blacklist:", err)
+	}
+
 	name := logger.Service()
 	w := &Worker{
 		logger:    logger,
@@ -112,6 +127,7 @@ func NewWorker(logger *pct.Logger, config qan.Config, mysqlConn mysql.Connector)
 		oldSlowLogs:     make(map[int]string),
 		sync:            pct.NewSyncChan(),
 		utcOffset:       utcOffset,
+		blacklist:       blacklist,
 	}
 	return w
 }
@@ -120,7 +136,7 @@ func (w *Worker) Setup(interval *qan.Interval) error {
 	w.logger.Debug("Setup:call")
 	defer w.logger.Debug("Setup:return")
 	w.logger.Debug("Setup:", interval)
-	if interval.EndOffset >= w.config.MaxSlowLogSize {
+	if w.config.MaxSlowLogSize > 0 && interval.EndOffset >= w.config.MaxSlowLogSize {
 		w.logger.Info(fmt.Sprintf("Rotating slow log: %s >= %s",
 			pct.Bytes(uint64(interval.EndOffset)),
 			pct.Bytes(uint64(w.config.MaxSlowLogSize))))
@@ -194,12 +210,24 @@ func (w *Worker) Run() (*qan.Result, error) {
 	// queries, group, and aggregate.
 	a := event.NewEventAggregator(w.job.ExampleQueries, w.utcOffset)
 
+	// If grouping classes by schema or user, each group value has its own
+	// aggregator.  Examples are only in the main aggregator's classes.
+	groups := make(map[string]*event.EventAggregator)
+	newGroupAggregator := func() *event.EventAggregator {
+		return event.NewEventAggregator(false, w.utcOffset)
+	}
+
 	// Misc runtime meta data.
 	jobSize := w.job.EndOffset - w.job.StartOffset
 	runtime := time.Duration(0)
 	progress := "Not started"
 	rateType := ""
 	rateLimit := uint(0)
+	blacklisted := 0
+	var tables map[string][]string // keyed on class ID, if config.Tables
+	if w.config.Tables {
+		tables = make(map[string][]string)
+	}
 
 	// Do fingerprinting in a separate Go routine so we can recover in case
 	// query.Fingerprint() crashes. We don't want one bad fingerprint to stop
@@ -267,8 +295,28 @@ EVENT_LOOP:
 		w.queryChan <- event.Query
 		select {
 		case fingerprint = <-w.fingerprintChan:
+			if w.blacklist.Match(fingerprint) {
+				blacklisted++
+				continue EVENT_LOOP
+			}
 			id := query.Id(fingerprint)
 			a.AddEvent(event, id, fingerprint)
+			if _, ok := tables[id]; w.config.Tables && !ok {
+				// Tables of the first query: queries in a class differ only in values.
+				tables[id] = qan.Tables(event.Query)
+			}
+			if w.config.GroupBy != "" {
+				group := event.Db
+				if w.config.GroupBy == qan.GROUP_BY_USER {
+					group = event.User
+				}
+				ga, ok := groups[group]
+				if !ok {
+					ga = newGroupAggregator()
+					groups[group] = ga
+				}
+				ga.AddEvent(event, id, fingerprint)
+			}
 		case _ = <-w.errChan:
 			w.logger.Warn(fmt.Sprintf("Cannot fingerprint '%s'", event.Query))
 			go w.fingerprinter()
@@ -298,12 +346,21 @@ EVENT_LOOP:
 	}
 	result.Global = r.Global
 	result.Class = classes
+	result.Tables = tables
+	for group, ga := range groups {
+		for _, class := range ga.Finalize().Class {
+			result.Group = append(result.Group, &qan.GroupClass{Group: group, QueryClass: class})
+		}
+	}
 
 	// Zero the runtime for testing.
 	if !w.ZeroRunTime {
 		result.RunTime = time.Now().Sub(t0).Seconds()
 	}
 
+	if blacklisted > 0 {
+		progress += fmt.Sprintf(", %d blacklisted", blacklisted)
+	}
 	w.logger.Info(fmt.Sprintf("Parsed %s: %s", w.job, progress))
 	return result, nil
 }
@@ -322,13 +379,9 @@ func (w *Worker) Cleanup() error {
 	w.logger.Debug("Cleanup:call")
 	defer w.logger.Debug("Cleanup:return")
 	for i, file := range w.oldSlowLogs {
-		w.status.Update(w.name, "Removing slow log "+file)
-		if err := os.Remove(file); err != nil {
-			w.logger.Warn(err)
-			continue
-		}
+		// The rotated slow log was parsed, so it and older ones can be purged.
 		delete(w.oldSlowLogs, i)
-		w.logger.Info("Removed " + file)
+		w.purgeSlowLogs(file)
 	}
 	return nil
 }
@@ -365,6 +418,9 @@ func (w *Worker) fingerprinter() {
 	for {
 		select {
 		case q := <-w.queryChan:
+			if w.config.StripComments {
+				q = qan.StripComments(q)
+			}
 			f := query.Fingerprint(q)
 			w.fingerprintChan <- f
 		case <-w.doneChan:
@@ -385,25 +441,39 @@ func (w *Worker) rotateSlowLog(interval *qan.Interval) error {
 	}
 	defer w.mysqlConn.Close()
 
-	// Stop slow log so we don't move it while MySQL is using it.
-	if err := w.mysqlConn.Set(w.config.Stop); err != nil {
-		return err
-	}
-
-	// Move current slow log by renaming it.
+	/**
+	 * Move current slow log by renaming it.  MySQL keeps writing to the
+	 * renamed file until it's told to reopen the slow log, so no events
+	 * are lost: FLUSH SLOW LOGS makes MySQL close the renamed file and
+	 * create a new one, and the worker parses the renamed file to its end,
+	 * i.e. everything written before the flush.  The iter sees that the
+	 * file changed and starts the next interval at offset 0 of the new file.
+	 */
 	newSlowLogFile := fmt.Sprintf("%s-%d", interval.Filename, time.Now().UTC().Unix())
 	if err := os.Rename(interval.Filename, newSlowLogFile); err != nil {
 		return err
 	}
-
-	// Re-enable slow log.
-	if err := w.mysqlConn.Set(w.config.Start); err != nil {
-		return err
+	agentRotated.add(newSlowLogFile)
+
+	if err := w.mysqlConn.Set(flushSlowLogs); err != nil {
+		// MySQL < 5.5.3 doesn't have FLUSH SLOW LOGS, but stopping and
+		// starting the slow log makes it reopen the file, too.
+		w.logger.Warn("FLUSH SLOW LOGS failed, restarting slow log:", err)
+		if err := w.mysqlConn.Set(w.config.Stop); err != nil {
+			return err
+		}
+		if err := w.mysqlConn.Set(w.config.Start); err != nil {
+			return err
+		}
 	}
 
 	// Modify interval so worker parses the rest of the old slow log.
 	interval.Filename = newSlowLogFile
-	interval.EndOffset, _ = pct.FileSize(newSlowLogFile) // todo: handle err
+	size, err := pct.FileSize(newSlowLogFile)
+	if err != nil {
+		return err
+	}
+	interval.EndOffset = size
 
 	// Save old slow log and remove later if configured to do so.
 	if w.config.RemoveOldSlowLogs {
@@ -413,6 +483,45 @@ func (w *Worker) rotateSlowLog(interval *qan.Interval) error {
 	return nil
 }
 
+// purgeSlowLogs removes the slow logs rotated from the same slow log as
+// rotatedFile, oldest first, keeping the newest RetainSlowLogs.  Rotated
+// slow logs are named NAME-TS where TS is the Unix timestamp of rotation.
+func (w *Worker) purgeSlowLogs(rotatedFile string) {
+	w.status.Update(w.name, "Purging old slow logs")
+	defer w.status.Update(w.name, "Idle")
+
+	orig := rotatedFile[0:strings.LastIndex(rotatedFile, "-")]
+	matches, _ := filepath.Glob(orig + "-[0-9]*")
+	files := []rotatedSlowLog{}
+	for _, file := range matches {
+		ts, err := strconv.ParseInt(file[len(orig)+1:], 10, 64)
+		if err != nil {
+			continue // not a rotated slow log
+		}
+		files = append(files, rotatedSlowLog{file, ts})
+	}
+	sort.Sort(byRotation(files))
+
+	for i := 0; i < len(files)-w.config.RetainSlowLogs; i++ {
+		if err := os.Remove(files[i].file); err != nil {
+			w.logger.Warn(err) // try again next time
+			continue
+		}
+		w.logger.Info("Removed " + files[i].file)
+	}
+}
+
+type rotatedSlowLog struct {
+	file string
+	ts   int64
+}
+
+type byRotation []rotatedSlowLog
+
+func (a byRotation) Len() int           { return len(a) }
+func (a byRotation) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRotation) Less(i, j int) bool { return a[i].ts < a[j].ts }
+
 func GetutcOffset(mysqlConn mysql.Connector) (time.Duration, error) {
 	var hours int64
 	if mysqlConn == nil {
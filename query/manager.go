@@ -26,6 +26,7 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/qan"
 	mysqlExec "github.com/percona/percona-agent/query/mysql"
 )
 
@@ -166,7 +167,42 @@ func (m *Manager) handleMySQLQuery(cmd *proto.Cmd, si *proto.ServiceInstance) *p
 			return cmd.Reply(nil, fmt.Errorf("Table Info failed: %s", err))
 		}
 		return cmd.Reply(res, nil)
+	case "TableDeepDive":
+		m.status.Update(SERVICE_NAME, "Table deep dive on "+instanceName)
+		q := &mysqlExec.TableDeepDiveQuery{}
+		if err := json.Unmarshal(cmd.Data, q); err != nil {
+			return cmd.Reply(nil, err)
+		}
+		e.SetClassFunc(qanClassFunc(si.InstanceId))
+		res, err := e.TableDeepDive(q)
+		if err != nil {
+			return cmd.Reply(nil, fmt.Errorf("Table deep dive failed: %s", err))
+		}
+		return cmd.Reply(res, nil)
 	default:
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
 }
+
+// qanClassFunc returns a ClassFunc for the QAN reports kept locally for the
+// MySQL instance, see qan.History.
+func qanClassFunc(instanceId uint) mysqlExec.ClassFunc {
+	return func(db, table string, n int) ([]mysqlExec.DeepDiveClass, error) {
+		h := qan.NewHistory(qan.HistoryDir(instanceId), 0)
+		tableClasses, err := h.TableClasses(db, table, n)
+		if err != nil {
+			return nil, err
+		}
+		classes := make([]mysqlExec.DeepDiveClass, len(tableClasses))
+		for i, c := range tableClasses {
+			classes[i] = mysqlExec.DeepDiveClass{
+				Id:          c.Id,
+				Fingerprint: c.Fingerprint,
+				Queries:     c.Queries,
+				QueryTime:   c.QueryTime,
+				Intervals:   c.Intervals,
+			}
+		}
+		return classes, nil
+	}
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+)
+
+const (
+	DEFAULT_DEEP_DIVE_SIZE    = 256 * 1024 // bytes
+	DEFAULT_DEEP_DIVE_CLASSES = 10         // top QAN classes
+)
+
+var defaultLiteralRe = regexp.MustCompile(`(?i)(\bDEFAULT\s+)(?:_\w+\s*)?(?:[bxn]?'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*")`)
+
+// Data of a TableDeepDive cmd.
+type TableDeepDiveQuery struct {
+	proto.ServiceInstance
+	Table   string // db.table
+	MaxSize int    // max size of TableDeepDive as JSON (bytes), default DEFAULT_DEEP_DIVE_SIZE
+}
+
+// Everything known about a single table, for support workflows.
+type TableDeepDive struct {
+	Db        string
+	Table     string
+	Create    string                          // SHOW CREATE TABLE, DEFAULT literals redacted
+	Index     map[string][]proto.ShowIndexRow // SHOW INDEX, keyed on KeyName
+	Status    *proto.ShowTableStatus          // SHOW TABLE STATUS: size, rows, etc.
+	UserStats *TableUserStats                 // nil if userstat not available
+	Classes   []DeepDiveClass                 // top QAN classes using the table, see SetClassFunc
+	Truncated bool                            // true if parts were dropped to fit MaxSize
+	Errors    []string
+}
+
+// A QAN class that uses the table, summed over the QAN reports kept locally.
+type DeepDiveClass struct {
+	Id          string
+	Fingerprint string
+	Queries     uint64  // total
+	QueryTime   float64 // total (seconds)
+	Intervals   int     // reports with the class
+}
+
+// A ClassFunc returns the top n QAN classes that use db.table, by query time.
+type ClassFunc func(db, table string, n int) ([]DeepDiveClass, error)
+
+// Counters from INFORMATION_SCHEMA.TABLE_STATISTICS and INDEX_STATISTICS.
+type TableUserStats struct {
+	RowsRead            int64
+	RowsChanged         int64
+	RowsChangedXIndexes int64
+	IndexRowsRead       map[string]int64 // keyed on index name
+}
+
+func (e *QueryExecutor) TableDeepDive(q *TableDeepDiveQuery) (*TableDeepDive, error) {
+	db, table := splitDbTable(q.Table)
+	if db == "" || table == "" {
+		return nil, fmt.Errorf("Invalid table: '%s': expected db.table", q.Table)
+	}
+
+	res := &TableDeepDive{
+		Db:     db,
+		Table:  table,
+		Errors: []string{},
+	}
+
+	def, err := e.showCreate(Ident(db, table))
+	if err != nil {
+		// If we can't see the table at all, the rest is pointless.
+		return nil, fmt.Errorf("SHOW CREATE TABLE %s: %s", q.Table, err)
+	}
+	res.Create = RedactDefaults(def)
+
+	res.Index, err = e.showIndex(Ident(db, table))
+	if err != nil {
+		res.Errors = append(res.Errors, fmt.Sprintf("SHOW INDEX FROM %s: %s", q.Table, err))
+	}
+
+	res.Status, err = e.showStatus(Ident(db, ""), table)
+	if err != nil {
+		res.Errors = append(res.Errors, fmt.Sprintf("SHOW TABLE STATUS FROM %s LIKE %s: %s", db, table, err))
+	}
+
+	res.UserStats, err = e.tableUserStats(db, table)
+	if err != nil {
+		res.Errors = append(res.Errors, fmt.Sprintf("User statistics: %s", err))
+	}
+
+	if e.classFunc != nil {
+		res.Classes, err = e.classFunc(db, table, DEFAULT_DEEP_DIVE_CLASSES)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("QAN classes: %s", err))
+		}
+	}
+
+	maxSize := q.MaxSize
+	if maxSize <= 0 {
+		maxSize = DEFAULT_DEEP_DIVE_SIZE
+	}
+	if err := res.limit(maxSize); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// RedactDefaults replaces the string literals of DEFAULT clauses in a table
+// definition with '?' because default values can contain sensitive data.
+func RedactDefaults(def string) string {
+	return defaultLiteralRe.ReplaceAllString(def, "${1}'?'")
+}
+
+// --------------------------------------------------------------------------
+
+func splitDbTable(dbTable string) (string, string) {
+	parts := strings.SplitN(strings.Replace(dbTable, "`", "", -1), ".", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+func (e *QueryExecutor) tableUserStats(db, table string) (*TableUserStats, error) {
+	stats := &TableUserStats{
+		IndexRowsRead: make(map[string]int64),
+	}
+
+	err := e.conn.DB().QueryRow(
+		"SELECT ROWS_READ, ROWS_CHANGED, ROWS_CHANGED_X_INDEXES"+
+			" FROM INFORMATION_SCHEMA.TABLE_STATISTICS"+
+			" WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?", db, table).Scan(
+		&stats.RowsRead,
+		&stats.RowsChanged,
+		&stats.RowsChangedXIndexes,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		// No rows is ok: table not accessed since stats were flushed.
+		return nil, err
+	}
+
+	rows, err := e.conn.DB().Query(
+		"SELECT INDEX_NAME, ROWS_READ"+
+			" FROM INFORMATION_SCHEMA.INDEX_STATISTICS"+
+			" WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?", db, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var indexName string
+		var rowsRead int64
+		if err := rows.Scan(&indexName, &rowsRead); err != nil {
+			return nil, err
+		}
+		stats.IndexRowsRead[indexName] = rowsRead
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// limit drops the least important parts of the deep dive until its JSON
+// encoding fits in maxSize bytes: first per-index user stats, then the
+// lowest QAN classes, then the index details, then the end of the table
+// definition.
+func (d *TableDeepDive) limit(maxSize int) error {
+	size, err := d.size()
+	if err != nil {
+		return err
+	}
+	if size <= maxSize {
+		return nil
+	}
+	d.Truncated = true
+
+	if d.UserStats != nil && len(d.UserStats.IndexRowsRead) > 0 {
+		d.UserStats.IndexRowsRead = nil
+		if size, err = d.size(); err != nil || size <= maxSize {
+			return err
+		}
+	}
+
+	for len(d.Classes) > 0 {
+		d.Classes = d.Classes[0 : len(d.Classes)-1]
+		if size, err = d.size(); err != nil || size <= maxSize {
+			return err
+		}
+	}
+
+	if len(d.Index) > 0 {
+		d.Index = nil
+		if size, err = d.size(); err != nil || size <= maxSize {
+			return err
+		}
+	}
+
+	// JSON escaping can make the encoded def longer than the def itself,
+	// so cut the excess from the def and re-check until it fits.
+	for size > maxSize && d.Create != "" {
+		cut := len(d.Create) - (size - maxSize)
+		if cut < 0 {
+			cut = 0
+		}
+		d.Create = d.Create[0:cut]
+		if size, err = d.size(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *TableDeepDive) size() (int, error) {
+	bytes, err := json.Marshal(d)
+	if err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
+}
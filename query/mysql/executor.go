@@ -28,6 +28,8 @@ import (
 
 type QueryExecutor struct {
 	conn mysql.Connector
+	// --
+	classFunc ClassFunc
 }
 
 func NewQueryExecutor(conn mysql.Connector) *QueryExecutor {
@@ -37,6 +39,12 @@ func NewQueryExecutor(conn mysql.Connector) *QueryExecutor {
 	return e
 }
 
+// SetClassFunc sets the func that returns the QAN classes of TableDeepDive.
+// Without it, the deep dive has no classes.
+func (e *QueryExecutor) SetClassFunc(f ClassFunc) {
+	e.classFunc = f
+}
+
 func (e *QueryExecutor) Explain(db, query string) (*proto.ExplainResult, error) {
 	explain, err := e.explain(db, query)
 	if err != nil {
@@ -19,6 +19,7 @@ package mysql_test
 
 import (
 	"database/sql"
+	"encoding/json"
 	"os"
 	"strings"
 	"testing"
@@ -282,3 +283,64 @@ func (s *TestSuite) TestFullTableInfo(t *C) {
 	t.Check(index[0].ColumnName, Equals, "Host")
 	t.Check(index[1].ColumnName, Equals, "User")
 }
+
+func (s *TestSuite) TestRedactDefaults(t *C) {
+	def := "CREATE TABLE `t` (\n" +
+		"  `id` int(11) NOT NULL DEFAULT '0',\n" +
+		"  `name` varchar(64) DEFAULT 'it''s a secret',\n" +
+		"  `note` varchar(64) DEFAULT NULL,\n" +
+		"  `ts` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=latin1"
+	expect := "CREATE TABLE `t` (\n" +
+		"  `id` int(11) NOT NULL DEFAULT '?',\n" +
+		"  `name` varchar(64) DEFAULT '?',\n" +
+		"  `note` varchar(64) DEFAULT NULL,\n" +
+		"  `ts` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=latin1"
+	t.Check(mysqlExec.RedactDefaults(def), Equals, expect)
+}
+
+func (s *TestSuite) TestTableDeepDive(t *C) {
+	q := &mysqlExec.TableDeepDiveQuery{
+		Table: "mysql.user",
+	}
+	classes := []mysqlExec.DeepDiveClass{
+		{Id: "A", Fingerprint: "select * from mysql.user where user=?", Queries: 10, QueryTime: 1.5, Intervals: 2},
+	}
+	s.e.SetClassFunc(func(db, table string, n int) ([]mysqlExec.DeepDiveClass, error) {
+		t.Check(db, Equals, "mysql")
+		t.Check(table, Equals, "user")
+		t.Check(n, Equals, mysqlExec.DEFAULT_DEEP_DIVE_CLASSES)
+		return classes, nil
+	})
+	defer s.e.SetClassFunc(nil)
+
+	got, err := s.e.TableDeepDive(q)
+	t.Assert(err, IsNil)
+	t.Check(got.Db, Equals, "mysql")
+	t.Check(got.Table, Equals, "user")
+	t.Check(strings.HasPrefix(got.Create, "CREATE TABLE `user` ("), Equals, true)
+	t.Check(got.Status.Name, Equals, "user")
+	_, ok := got.Index["PRIMARY"]
+	t.Check(ok, Equals, true)
+	t.Check(got.Classes, DeepEquals, classes)
+	t.Check(got.Truncated, Equals, false)
+
+	// Limit the size: QAN classes and index details are dropped first, then
+	// the table def is cut to fit.
+	q.MaxSize = 1024
+	got, err = s.e.TableDeepDive(q)
+	t.Assert(err, IsNil)
+	t.Check(got.Truncated, Equals, true)
+	t.Check(got.Classes, HasLen, 0)
+	t.Check(got.Index, IsNil)
+	bytes, _ := json.Marshal(got)
+	t.Check(len(bytes) <= q.MaxSize, Equals, true)
+
+	// Table must be db-qualified.
+	q.Table = "user"
+	_, err = s.e.TableDeepDive(q)
+	t.Check(err, NotNil)
+}
@@ -18,10 +18,96 @@
 package sysconfig
 
 import (
+	"errors"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/pct"
+	"path"
+	"strings"
 )
 
 type Config struct {
 	proto.ServiceInstance
-	Report uint // how often to collect and send config (seconds)
+	Report   uint     // how often to collect and send config (seconds)
+	Groups   []Group  `json:",omitempty"` // settings to report more often, see Group
+	Blackout []string `json:",omitempty"` // cron expressions of minutes not to collect, see pct/blackout.go
+}
+
+/**
+ * A Group is a named group of settings that are reported every Group.Report
+ * seconds, more often than all settings (Config.Report), e.g. the global
+ * variables that affect replication.  Each group is a separate Report with
+ * System "<monitor system>: <group name>", so the API and latest.json keep the
+ * full dump and every group apart.  Settings are names or shell patterns like
+ * "slave_*", matched with path.Match against lowercase setting names.
+ */
+type Group struct {
+	Name     string
+	Settings []string // names or patterns, e.g. "gtid_mode", "slave_*"
+	Report   uint     // how often to collect and send the group (seconds)
+}
+
+func (c *Config) Validate() error {
+	if _, err := pct.NewBlackout(c.Blackout); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, g := range c.Groups {
+		if g.Name == "" {
+			return errors.New("Group has no name")
+		}
+		if names[g.Name] {
+			return errors.New("Duplicate group: " + g.Name)
+		}
+		names[g.Name] = true
+		if g.Report == 0 {
+			return fmt.Errorf("Group %s: Report must be > 0", g.Name)
+		}
+		if len(g.Settings) == 0 {
+			return fmt.Errorf("Group %s: no settings", g.Name)
+		}
+		for _, p := range g.Settings {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("Group %s: invalid setting pattern: %s", g.Name, p)
+			}
+		}
+	}
+	return nil
+}
+
+// Interval returns how often the monitor must collect: the shortest of
+// Report and the group Report intervals.
+func (c *Config) Interval() uint {
+	interval := c.Report
+	for _, g := range c.Groups {
+		if interval == 0 || g.Report < interval {
+			interval = g.Report
+		}
+	}
+	return interval
+}
+
+// Filter returns the settings in the group, in the given order.
+func (g Group) Filter(settings []Setting) []Setting {
+	in := []Setting{}
+	for _, s := range settings {
+		name := strings.ToLower(s[0])
+		for _, p := range g.Settings {
+			if ok, _ := path.Match(strings.ToLower(p), name); ok {
+				in = append(in, s)
+				break
+			}
+		}
+	}
+	return in
+}
+
+// Due returns true if a report collected every interval seconds, last at
+// lastTs, is due at ts.  Ticks every tick seconds aren't exact, so it's due up
+// to half a tick early, else a report could wait an extra tick.
+func Due(lastTs, ts int64, interval, tick uint) bool {
+	if lastTs == 0 {
+		return true
+	}
+	return ts-lastTs+int64(tick/2) >= int64(interval)
 }
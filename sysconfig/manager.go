@@ -31,7 +31,6 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/ticker"
-	"io/ioutil"
 	"path/filepath"
 	"sync"
 	"time"
@@ -45,11 +44,14 @@ type Manager struct {
 	im      *instance.Repo
 	// --
 	monitors       map[string]Monitor
+	hashes         map[string]string // pct.ConfigHash of monitors' StartService data
 	running        bool
-	mux            *sync.RWMutex // guards monitors and running
+	mux            *sync.RWMutex // guards monitors, hashes, blackouts, and running
 	reportChan     chan *Report  // <- Report from monitor
 	spoolerRunning bool
 	status         *pct.Status
+	collected      *pct.LastTs // keyed on monitor name, e.g. sysconfig-mysql-1
+	blackouts      map[string]*pct.BlackoutTicker
 }
 
 func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager, spool data.Spooler, im *instance.Repo) *Manager {
@@ -62,8 +64,11 @@ func NewManager(logger *pct.Logger, factory MonitorFactory, clock ticker.Manager
 		// --
 		reportChan: make(chan *Report, 3),
 		monitors:   make(map[string]Monitor),
+		hashes:     make(map[string]string),
 		status:     pct.NewStatus([]string{"sysconfig", "sysconfig-spooler"}),
 		mux:        &sync.RWMutex{},
+		collected:  pct.NewLastTs(pct.LAST_COLLECTED),
+		blackouts:  make(map[string]*pct.BlackoutTicker),
 	}
 	return m
 }
@@ -90,7 +95,7 @@ func (m *Manager) Start() error {
 	}
 
 	for _, configFile := range configFiles {
-		data, err := ioutil.ReadFile(configFile)
+		data, err := pct.Basedir.ReadConfigFile(configFile)
 		if err != nil {
 			m.logger.Error("Read " + configFile + ": " + err.Error())
 			continue
@@ -131,7 +136,13 @@ func (m *Manager) Stop() error {
 			continue
 		}
 		m.clock.Remove(monitor.TickChan())
+		if bt, ok := m.blackouts[name]; ok {
+			m.clock.Remove(bt.TickChan())
+			bt.Stop()
+			delete(m.blackouts, name)
+		}
 		delete(m.monitors, name)
+		delete(m.hashes, name)
 	}
 	m.running = false
 	m.logger.Info("Stopped")
@@ -150,16 +161,28 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		if err != nil {
 			return cmd.Reply(nil, err)
 		}
+		if err := c.Validate(); err != nil {
+			return cmd.Reply(nil, err)
+		}
 
 		m.status.UpdateRe("sysconfig", "Starting "+name, cmd)
 		m.logger.Info("Start", name, cmd)
 
-		// Monitors names must be unique.
+		// Monitors names must be unique, but the API re-sends StartService
+		// for running monitors to reconcile configs.  If the config is the
+		// same, there's nothing to do, else the monitor is restarted with
+		// the new config, after its new monitor is made.  Like mm.
+		hash, err := pct.ConfigHash(cmd.Data)
+		if err != nil {
+			return cmd.Reply(nil, err)
+		}
 		m.mux.RLock()
-		_, haveMonitor := m.monitors[name]
+		oldMonitor, haveMonitor := m.monitors[name]
+		sameConfig := haveMonitor && m.hashes[name] == hash
 		m.mux.RUnlock()
-		if haveMonitor {
-			return cmd.Reply(nil, errors.New("Duplicate monitor: "+name))
+		if sameConfig {
+			m.logger.Info(name, "is running with the same config")
+			return cmd.Reply(nil) // success
 		}
 
 		// Create the monitor based on its type.
@@ -168,19 +191,47 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 			return cmd.Reply(nil, errors.New("Factory: "+err.Error()))
 		}
 
+		if haveMonitor {
+			m.logger.Info("Restarting", name, "with new config")
+			if err := m.stopMonitor(name, oldMonitor); err != nil {
+				return cmd.Reply(nil, errors.New("Restart "+name+": "+err.Error()))
+			}
+		}
+
 		// Make unsynchronized (3rd arg=false) ticker for collect interval,
 		// it's unsynchronized because 1) we don't need sysconfig data to be
 		// synchronized, and 2) sysconfig monitors usually collect very slowly,
 		// e.g. 1h, so if we synced it it could wait awhile before 1st tick.
+		// It ticks at the shortest interval, Report or a group's Report,
+		// and the monitor reports what's due each tick.
 		tickChan := make(chan time.Time)
-		m.clock.Add(tickChan, c.Report, false)
+
+		// During a blackout, ticks are dropped so the monitor doesn't collect,
+		// and its start and end are reported, like mm.
+		clockChan := tickChan
+		var blackoutTicker *pct.BlackoutTicker
+		if len(c.Blackout) > 0 {
+			blackout, _ := pct.NewBlackout(c.Blackout) // already validated
+			blackoutTicker = pct.NewBlackoutTicker(blackout, tickChan, m.blackoutMarker(c.ServiceInstance))
+			blackoutTicker.Start()
+			clockChan = blackoutTicker.TickChan()
+		}
+		m.clock.Add(clockChan, c.Interval(), false)
 
 		// Start the monitor.
 		if err = monitor.Start(tickChan, m.reportChan); err != nil {
+			if blackoutTicker != nil {
+				m.clock.Remove(clockChan)
+				blackoutTicker.Stop()
+			}
 			return cmd.Reply(nil, errors.New("Start "+name+": "+err.Error()))
 		}
 		m.mux.Lock()
 		m.monitors[name] = monitor
+		m.hashes[name] = hash
+		if blackoutTicker != nil {
+			m.blackouts[name] = blackoutTicker
+		}
 		m.mux.Unlock()
 
 		// Save the monitor-specific config to disk so agent starts on restart.
@@ -202,30 +253,27 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		if !ok {
 			return cmd.Reply(nil, errors.New("Unknown monitor: "+name))
 		}
-		if err = monitor.Stop(); err != nil {
-			return cmd.Reply(nil, errors.New("Stop "+name+": "+err.Error()))
+		if err = m.stopMonitor(name, monitor); err != nil {
+			return cmd.Reply(nil, err)
 		}
-		m.clock.Remove(monitor.TickChan())
+		m.collected.Remove(name)
 		if err := pct.Basedir.RemoveConfig(name); err != nil {
 			return cmd.Reply(nil, errors.New("Remove "+name+": "+err.Error()))
 		}
-		m.mux.Lock()
-		delete(m.monitors, name)
-		m.mux.Unlock()
 		return cmd.Reply(nil) // success
 	case "GetConfig":
 		config, errs := m.GetConfig()
 		return cmd.Reply(config, errs...)
 	default:
 		// SetConfig does not work by design.  To re-configure a monitor,
-		// stop it then start it again with the new config.
+		// start it again with the new config: it's restarted if the config changed.
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
 }
 
 // @goroutine[1]
 func (m *Manager) Status() map[string]string {
-	status := m.status.All()
+	status := m.status.Merge(m.collected.Status())
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 	for _, monitor := range m.monitors {
@@ -237,6 +285,15 @@ func (m *Manager) Status() map[string]string {
 	return status
 }
 
+// Capabilities returns the monitors the factory can make, for agent cmd
+// Capabilities.
+func (m *Manager) Capabilities() []string {
+	if r, ok := m.factory.(pct.CapabilityReporter); ok {
+		return r.Capabilities()
+	}
+	return []string{}
+}
+
 func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	m.logger.Debug("GetConfig:call")
 	defer m.logger.Debug("GetConfig:return")
@@ -278,6 +335,12 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return configs, errs
 }
 
+// Reload applies changes to the monitors' saved configs: monitors with new or changed
+// configs are (re)started and monitors whose configs were removed are stopped.
+func (m *Manager) Reload() []error {
+	return pct.ReloadServices(m, "sysconfig-*.conf")
+}
+
 // --------------------------------------------------------------------------
 
 func (m *Manager) spooler() {
@@ -288,13 +351,70 @@ func (m *Manager) spooler() {
 		m.status.Update("sysconfig-spooler", "Stopped")
 	}()
 	m.status.Update("sysconfig-spooler", "Running")
+
+	// An instance can have several systems, e.g. mysql and its users and
+	// grants, so its latest.json has the latest report of each system.
+	latest := make(map[string]map[string]*Report) // keyed on instance, system
 	for s := range m.reportChan {
+		instance := m.im.Name(s.Service, s.InstanceId)
 		if err := m.spool.Write("sysconfig", s); err != nil {
 			m.logger.Warn("Lost report:", err)
+		} else if s.System != SYSTEM_BLACKOUT {
+			m.collected.Mark("sysconfig-"+instance, time.Unix(s.Ts, 0))
+		}
+		if _, ok := latest[instance]; !ok {
+			latest[instance] = make(map[string]*Report)
+		}
+		latest[instance][s.System] = s
+		if err := pct.Basedir.WriteLatest("sysconfig", s.ServiceInstance, latest[instance]); err != nil {
+			m.logger.Warn("Cannot write latest report:", err)
 		}
 	}
 }
 
+// blackoutMarker returns the pct.BlackoutTicker mark func for the instance:
+// it reports the start or end of the blackout, see SYSTEM_BLACKOUT, unless the
+// ticker is stopped first.
+func (m *Manager) blackoutMarker(si proto.ServiceInstance) func(time.Time, bool, chan bool) bool {
+	return func(t time.Time, in bool, stopChan chan bool) bool {
+		state := "started"
+		if !in {
+			state = "ended"
+		}
+		r := &Report{
+			ServiceInstance: si,
+			Ts:              t.Unix(),
+			System:          SYSTEM_BLACKOUT,
+			Settings:        []Setting{{"blackout", state}},
+		}
+		select {
+		case m.reportChan <- r:
+			return true
+		case <-stopChan:
+			return false
+		}
+	}
+}
+
+// stopMonitor stops the monitor and forgets it, for StopService and to restart
+// it with a new config.  Its config file is not removed.
+func (m *Manager) stopMonitor(name string, monitor Monitor) error {
+	if err := monitor.Stop(); err != nil {
+		return errors.New("Stop " + name + ": " + err.Error())
+	}
+	m.clock.Remove(monitor.TickChan())
+	m.mux.Lock()
+	if bt, ok := m.blackouts[name]; ok {
+		m.clock.Remove(bt.TickChan())
+		bt.Stop()
+		delete(m.blackouts, name)
+	}
+	delete(m.monitors, name)
+	delete(m.hashes, name)
+	m.mux.Unlock()
+	return nil
+}
+
 func (m *Manager) getMonitorConfig(cmd *proto.Cmd) (*Config, string, error) {
 	/**
 	 * cmd.Data is a monitor-specific config, e.g. mysql.Config.  But monitor-specific
@@ -37,6 +37,11 @@ type MonitorFactory interface {
 // ["variable", "value"]
 type Setting [2]string
 
+// SYSTEM_BLACKOUT is the Report.System of the start and end of a monitor's
+// blackout (see Config.Blackout and pct/blackout.go).  Its only setting is
+// ["blackout", "started"] or ["blackout", "ended"].
+const SYSTEM_BLACKOUT = "blackout"
+
 type Report struct {
 	proto.ServiceInstance
 	Ts       int64 // UTC Unix timestamp
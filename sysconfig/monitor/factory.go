@@ -72,3 +72,8 @@ func (f *Factory) Make(service string, instanceId uint, data []byte) (sysconfig.
 	}
 	return monitor, nil
 }
+
+// Capabilities returns the monitors Make can make, keep in sync with Make.
+func (f *Factory) Capabilities() []string {
+	return []string{"monitor:mysql"}
+}
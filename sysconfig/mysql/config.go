@@ -23,4 +23,9 @@ import (
 
 type Config struct {
 	sysconfig.Config
+	Grants         bool     // report users and grants changes, see grants.go
+	GrantsInterval uint     // how often to check users and grants (seconds)
+	Security       bool     // report SSL and auth settings with variables, see security.go
+	WatchFiles     bool     // report variables when option files change, see watch.go
+	OptionFiles    []string // to watch, default mysql.DefaultOptionFiles
 }
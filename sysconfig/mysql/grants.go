@@ -0,0 +1,202 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/sysconfig"
+)
+
+/**
+ * If Config.Grants is true, every Config.GrantsInterval seconds the monitor
+ * snapshots the MySQL users and their grants and reports what changed since
+ * the previous snapshot as a separate sysconfig.Report (System=GRANTS_SYSTEM).
+ * Password hashes are never read: users of password-based auth plugins are
+ * checked for an empty password in MySQL, and IDENTIFIED BY clauses are
+ * removed from SHOW GRANTS.  The first snapshot is reported in full (every
+ * user is new), so the API has a baseline.
+ */
+
+const (
+	GRANTS_SYSTEM           = "mysql users and grants"
+	DEFAULT_GRANTS_INTERVAL = 3600 // 1 hour
+)
+
+var identifiedRe = regexp.MustCompile(`(?i)\s+IDENTIFIED\s+(?:BY\s+PASSWORD|BY|WITH\s+\S+\s+AS|WITH\s+\S+\s+BY)\s+'(?:[^'\\]|\\.|'')*'`)
+
+// A MySQL user account and its grants.
+type UserGrants struct {
+	User       string
+	Host       string
+	NoPassword bool
+	Grants     []string // SHOW GRANTS, sorted, without IDENTIFIED BY clauses
+}
+
+// Account returns 'user'@'host'.
+func (u *UserGrants) Account() string {
+	return fmt.Sprintf("'%s'@'%s'", u.User, u.Host)
+}
+
+// quotedAccount returns `user`@`host` for SQL statements.  User and host are
+// quoted as identifiers, not strings, because backslash escapes in strings
+// depend on the sql_mode (NO_BACKSLASH_ESCAPES).
+func (u *UserGrants) quotedAccount() string {
+	return quoteIdent(u.User) + "@" + quoteIdent(u.Host)
+}
+
+func quoteIdent(s string) string {
+	return "`" + strings.Replace(s, "`", "``", -1) + "`"
+}
+
+// GetGrants returns all MySQL users and their grants keyed on Account().
+func (m *Monitor) GetGrants(conn *sql.DB) (map[string]*UserGrants, error) {
+	m.logger.Debug("Getting users and grants")
+	m.status.Update(m.name, "Getting users and grants")
+
+	// MySQL 5.7 renamed mysql.user.Password to authentication_string, and
+	// MySQL 5.1 has no plugin column.  An empty password only matters for
+	// password-based plugins: auth_socket, PAM, etc. never have one.
+	rows, err := conn.Query("SELECT User, Host, Password = '', IFNULL(plugin, '') FROM mysql.user")
+	if err != nil && mysql.MySQLErrorCode(err) == mysql.ER_BAD_FIELD_ERROR {
+		rows, err = conn.Query("SELECT User, Host, IFNULL(authentication_string, '') = '', IFNULL(plugin, '') FROM mysql.user")
+	}
+	if err != nil && mysql.MySQLErrorCode(err) == mysql.ER_BAD_FIELD_ERROR {
+		rows, err = conn.Query("SELECT User, Host, Password = '', '' FROM mysql.user")
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*UserGrants)
+	for rows.Next() {
+		u := &UserGrants{}
+		var emptyPassword bool
+		var plugin string
+		if err := rows.Scan(&u.User, &u.Host, &emptyPassword, &plugin); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		u.NoPassword = emptyPassword && PasswordPlugin(plugin)
+		users[u.Account()] = u
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, u := range users {
+		rows, err := conn.Query("SHOW GRANTS FOR " + u.quotedAccount())
+		if err != nil {
+			return nil, err
+		}
+		u.Grants = []string{}
+		for rows.Next() {
+			var grant string
+			if err := rows.Scan(&grant); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			u.Grants = append(u.Grants, RemoveIdentifiedBy(grant))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		sort.Strings(u.Grants)
+	}
+
+	return users, nil
+}
+
+// PasswordPlugin returns true if the auth plugin authenticates with the password
+// stored in mysql.user.  An empty plugin is the server default, which is
+// mysql_native_password (or mysql_old_password) before MySQL 5.7.
+func PasswordPlugin(plugin string) bool {
+	switch plugin {
+	case "", "mysql_native_password", "mysql_old_password", "sha256_password":
+		return true
+	}
+	return false
+}
+
+// RemoveIdentifiedBy removes IDENTIFIED BY [PASSWORD] '...' and IDENTIFIED
+// WITH plugin AS '...' clauses from a grant so hashes are never reported.
+func RemoveIdentifiedBy(grant string) string {
+	return identifiedRe.ReplaceAllString(grant, "")
+}
+
+// DiffGrants returns the security report settings for the changes from prev
+// to cur.  prev is nil for the first snapshot.  Users with a wildcard host or
+// no password are reported every time, not just when they change.
+func DiffGrants(prev, cur map[string]*UserGrants) []sysconfig.Setting {
+	settings := []sysconfig.Setting{
+		{"users", fmt.Sprintf("%d", len(cur))},
+	}
+
+	accounts := make([]string, 0, len(cur))
+	for account := range cur {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	for _, account := range accounts {
+		u := cur[account]
+		p, seen := prev[account]
+		switch {
+		case !seen:
+			settings = append(settings, sysconfig.Setting{"new_user", account})
+		case strings.Join(p.Grants, "\n") == strings.Join(u.Grants, "\n"):
+			continue // unchanged
+		default:
+			settings = append(settings, sysconfig.Setting{"grants_changed", account})
+		}
+		for _, grant := range u.Grants {
+			settings = append(settings, sysconfig.Setting{"grant", grant})
+		}
+	}
+
+	for _, account := range accounts {
+		if strings.ContainsAny(cur[account].Host, "%_") {
+			settings = append(settings, sysconfig.Setting{"wildcard_host", account})
+		}
+	}
+
+	for _, account := range accounts {
+		if cur[account].NoPassword {
+			settings = append(settings, sysconfig.Setting{"no_password", account})
+		}
+	}
+
+	dropped := []string{}
+	for account := range prev {
+		if _, ok := cur[account]; !ok {
+			dropped = append(dropped, account)
+		}
+	}
+	sort.Strings(dropped)
+	for _, account := range dropped {
+		settings = append(settings, sysconfig.Setting{"dropped_user", account})
+	}
+
+	return settings
+}
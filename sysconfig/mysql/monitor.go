@@ -29,6 +29,8 @@ import (
 	"time"
 )
 
+const VARIABLES_SYSTEM = "mysql global variables"
+
 type Monitor struct {
 	name   string
 	config *Config
@@ -40,6 +42,13 @@ type Monitor struct {
 	status     *pct.Status
 	sync       *pct.SyncChan
 	running    bool
+	grants     map[string]*UserGrants // last snapshot, nil until first
+	grantsTs   int64                  // when grants were last checked
+	reportTs   int64                  // when all variables were last reported
+	groupTs    map[string]int64       // when each group was last reported
+	// --
+	watcher    *Watcher                // nil unless Config.WatchFiles
+	changeChan <-chan OptionFileChange // from watcher, nil if none
 }
 
 func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Connector) *Monitor {
@@ -49,8 +58,9 @@ func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Conn
 		logger: logger,
 		conn:   conn,
 		// --
-		sync:   pct.NewSyncChan(),
-		status: pct.NewStatus([]string{name, name + "-mysql"}),
+		sync:    pct.NewSyncChan(),
+		status:  pct.NewStatus([]string{name, name + "-mysql"}),
+		groupTs: make(map[string]int64),
 	}
 	return m
 }
@@ -68,6 +78,9 @@ func (m *Monitor) Start(tickChan chan time.Time, reportChan chan *sysconfig.Repo
 	m.status.Update(m.name, "Starting")
 	m.tickChan = tickChan
 	m.reportChan = reportChan
+	if m.config.WatchFiles {
+		m.startWatcher()
+	}
 	go m.run()
 	m.running = true
 	m.logger.Info("Started")
@@ -84,6 +97,11 @@ func (m *Monitor) Stop() error {
 	m.status.Update(m.name, "Stopping")
 	m.sync.Stop()
 	m.sync.Wait()
+	if m.watcher != nil {
+		m.watcher.Stop()
+		m.watcher = nil
+		m.changeChan = nil
+	}
 	m.running = false
 	m.logger.Info("Stopped")
 	// Do not update status to "Stopped" here; run() does that on return.
@@ -110,6 +128,23 @@ func (m *Monitor) Config() interface{} {
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
 
+// startWatcher starts watching the option files.  Variables are still
+// reported every Report interval if it fails, so it's only a warning.
+// @goroutine[0]
+func (m *Monitor) startWatcher() {
+	files := m.config.OptionFiles
+	if len(files) == 0 {
+		files = mysql.DefaultOptionFiles
+	}
+	w := NewWatcher(m.logger, files)
+	if err := w.Start(); err != nil {
+		m.logger.Warn("Cannot watch MySQL option files: ", err)
+		return
+	}
+	m.watcher = w
+	m.changeChan = w.Changes()
+}
+
 // @goroutine[2]
 func (m *Monitor) run() {
 	defer func() {
@@ -130,47 +165,47 @@ func (m *Monitor) run() {
 			m.logger.Debug("run:collect:start")
 			m.status.Update(m.name, "Running")
 
-			// Connect to MySQL.
-			m.status.Update(m.name+"-mysql", "Connecting")
-			if err := m.conn.Connect(2); err != nil {
-				m.logger.Warn(err)
-				m.status.Update(m.name+"-mysql", "Error: "+err.Error())
+			// All variables are reported every Report seconds, groups of
+			// them every group Report seconds, see sysconfig.Group.
+			ts := now.UTC().Unix()
+			all := m.reportDue(ts)
+			groups := m.groupsDue(ts)
+			wantGrants := m.config.Grants && m.grantsDue(ts)
+			if !all && len(groups) == 0 && !wantGrants {
+				m.logger.Debug("run:nothing due")
 				continue
 			}
-			m.status.Update(m.name+"-mysql", "Connected")
-
-			c := &sysconfig.Report{
-				ServiceInstance: proto.ServiceInstance{
-					Service:    m.config.Service,
-					InstanceId: m.config.InstanceId,
-				},
-				Ts:       now.UTC().Unix(),
-				System:   "mysql global variables",
-				Settings: []sysconfig.Setting{},
+			if m.collect(ts, all, groups, wantGrants) {
+				lastTs = ts
 			}
 
-			// Get SHOW GLOBAL VARIABLES.
-			if err := m.GetGlobalVariables(m.conn.DB(), c); err != nil {
-				m.logger.Warn(err)
-			}
-
-			// Disconnect from MySQL.
-			m.conn.Close()
-			m.status.Update(m.name+"-mysql", "Disconnected (OK)")
+			m.logger.Debug("run:collect:stop")
+		case change := <-m.changeChan:
+			m.logger.Debug("run:change:start")
+			m.status.Update(m.name, "Running")
 
-			if len(c.Settings) > 0 {
+			// An option file changed: report the change, then all variables
+			// now rather than at the next Report interval.  One snapshot is
+			// enough for several changes, e.g. a package upgrade.
+			changes := []OptionFileChange{change}
+		DRAIN:
+			for {
 				select {
-				case m.reportChan <- c:
-					lastTs = c.Ts
-				case <-time.After(500 * time.Millisecond):
-					// lost sysconfig
-					m.logger.Debug("Lost MySQL settings; timeout spooling after 500ms")
+				case change := <-m.changeChan:
+					changes = append(changes, change)
+				default:
+					break DRAIN
 				}
-			} else {
-				m.logger.Debug("No settings") // shouldn't happen
+			}
+			for _, change := range changes {
+				m.send(m.changeReport(change), "option file change")
+			}
+			ts := changes[0].Ts.UTC().Unix()
+			if m.collect(ts, true, nil, false) {
+				lastTs = ts
 			}
 
-			m.logger.Debug("run:collect:stop")
+			m.logger.Debug("run:change:stop")
 		case <-m.sync.StopChan:
 			m.logger.Debug("run:stop")
 			return
@@ -178,6 +213,121 @@ func (m *Monitor) run() {
 	}
 }
 
+// collect gets and sends the reports, returning true if variables were sent.
+// @goroutine[2]
+func (m *Monitor) collect(ts int64, all bool, groups []sysconfig.Group, wantGrants bool) bool {
+	// Connect to MySQL.
+	m.status.Update(m.name+"-mysql", "Connecting")
+	if err := m.conn.Connect(2); err != nil {
+		m.logger.Warn(err)
+		m.status.Update(m.name+"-mysql", "Error: "+err.Error())
+		return false
+	}
+	m.status.Update(m.name+"-mysql", "Connected")
+
+	c := &sysconfig.Report{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:       ts,
+		System:   VARIABLES_SYSTEM,
+		Settings: []sysconfig.Setting{},
+	}
+
+	// Get SHOW GLOBAL VARIABLES.
+	if all || len(groups) > 0 {
+		if err := m.GetGlobalVariables(m.conn.DB(), c); err != nil {
+			m.logger.Warn(err)
+		}
+	}
+
+	// Security settings are reported with all variables.
+	var security *sysconfig.Report
+	if all && m.config.Security && len(c.Settings) > 0 {
+		security = m.securityReport(m.conn.DB(), c.Settings, c.Ts)
+	}
+
+	// Users and grants are checked less often than variables.
+	var grants *sysconfig.Report
+	if wantGrants {
+		grants = m.grantsReport(m.conn.DB(), c.Ts)
+	}
+
+	// Disconnect from MySQL.
+	m.conn.Close()
+	m.status.Update(m.name+"-mysql", "Disconnected (OK)")
+
+	sent := false
+	if all {
+		if len(c.Settings) > 0 {
+			if m.send(c, "settings") {
+				sent = true
+				m.reportTs = c.Ts
+			}
+		} else {
+			m.logger.Debug("No settings") // shouldn't happen
+		}
+	}
+
+	for _, g := range groups {
+		if len(c.Settings) == 0 {
+			break // error getting variables, warned above
+		}
+		r := &sysconfig.Report{
+			ServiceInstance: c.ServiceInstance,
+			Ts:              c.Ts,
+			System:          VARIABLES_SYSTEM + ": " + g.Name,
+			Settings:        g.Filter(c.Settings),
+		}
+		if m.send(r, "settings group "+g.Name) {
+			sent = true
+			m.groupTs[g.Name] = c.Ts
+		}
+	}
+
+	if security != nil {
+		m.send(security, "security settings")
+	}
+
+	if grants != nil {
+		m.send(grants, "users and grants")
+	}
+
+	return sent
+}
+
+// @goroutine[2]
+func (m *Monitor) send(r *sysconfig.Report, what string) bool {
+	select {
+	case m.reportChan <- r:
+		return true
+	case <-time.After(500 * time.Millisecond):
+		// lost sysconfig
+		m.logger.Debug("Lost MySQL " + what + "; timeout spooling after 500ms")
+		return false
+	}
+}
+
+// changeReport reports an option file change with the time it was detected,
+// which is more precise than the report Ts.
+// @goroutine[2]
+func (m *Monitor) changeReport(change OptionFileChange) *sysconfig.Report {
+	return &sysconfig.Report{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:     change.Ts.UTC().Unix(),
+		System: OPTION_FILES_SYSTEM,
+		Settings: []sysconfig.Setting{
+			{"file", change.File},
+			{"change", change.Op},
+			{"time", change.Ts.UTC().Format(time.RFC3339Nano)},
+		},
+	}
+}
+
 // @goroutine[2]
 func (m *Monitor) GetGlobalVariables(conn *sql.DB, c *sysconfig.Report) error {
 	m.logger.Debug("Getting global variables")
@@ -205,3 +355,52 @@ func (m *Monitor) GetGlobalVariables(conn *sql.DB, c *sysconfig.Report) error {
 	}
 	return nil
 }
+
+// @goroutine[2]
+func (m *Monitor) reportDue(ts int64) bool {
+	if len(m.config.Groups) == 0 {
+		return true // ticks every Report seconds
+	}
+	return sysconfig.Due(m.reportTs, ts, m.config.Report, m.config.Interval())
+}
+
+// @goroutine[2]
+func (m *Monitor) groupsDue(ts int64) []sysconfig.Group {
+	groups := []sysconfig.Group{}
+	for _, g := range m.config.Groups {
+		if sysconfig.Due(m.groupTs[g.Name], ts, g.Report, m.config.Interval()) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// @goroutine[2]
+func (m *Monitor) grantsDue(ts int64) bool {
+	interval := int64(m.config.GrantsInterval)
+	if interval == 0 {
+		interval = DEFAULT_GRANTS_INTERVAL
+	}
+	return m.grants == nil || ts-m.grantsTs >= interval
+}
+
+// @goroutine[2]
+func (m *Monitor) grantsReport(conn *sql.DB, ts int64) *sysconfig.Report {
+	grants, err := m.GetGrants(conn)
+	if err != nil {
+		m.logger.Warn("Cannot get users and grants: ", err)
+		return nil
+	}
+	r := &sysconfig.Report{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:       ts,
+		System:   GRANTS_SYSTEM,
+		Settings: DiffGrants(m.grants, grants),
+	}
+	m.grants = grants
+	m.grantsTs = ts
+	return r
+}
@@ -25,7 +25,9 @@ import (
 	"github.com/percona/percona-agent/sysconfig/mysql"
 	"github.com/percona/percona-agent/test"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -133,3 +135,265 @@ func (s *TestSuite) TestStartCollectStop(t *C) {
 		t.Fatal("Monitor has stopped")
 	}
 }
+
+func (s *TestSuite) TestGroups(t *C) {
+	config := &mysql.Config{
+		Config: sysconfig.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Report: 3600,
+			Groups: []sysconfig.Group{
+				{Name: "timeouts", Settings: []string{"wait_timeout", "net_*_timeout"}, Report: 60},
+			},
+		},
+	}
+	m := mysql.NewMonitor(s.name, config, s.logger, mysqlConn.NewConnection(dsn))
+	reportChan := make(chan *sysconfig.Report, 5)
+	err := m.Start(s.tickChan, reportChan)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	if ok := test.WaitStatusPrefix(5, m, s.name, "Idle"); !ok {
+		t.Fatal("Monitor is ready")
+	}
+
+	// First tick reports all variables and the group.
+	now := time.Now().UTC()
+	s.tickChan <- now
+	got := test.WaitSystemConfig(reportChan, 2)
+	t.Assert(got, HasLen, 2)
+	t.Check(got[0].System, Equals, mysql.VARIABLES_SYSTEM)
+	t.Check(len(got[0].Settings) > 100, Equals, true)
+	t.Check(got[1].System, Equals, mysql.VARIABLES_SYSTEM+": timeouts")
+	t.Check(got[1].Ts, Equals, now.Unix())
+	names := []string{}
+	for _, setting := range got[1].Settings {
+		names = append(names, setting[0])
+	}
+	t.Check(names, DeepEquals, []string{"net_read_timeout", "net_write_timeout", "wait_timeout"})
+
+	// A minute later, only the group is due.
+	s.tickChan <- now.Add(60 * time.Second)
+	got = test.WaitSystemConfig(reportChan, 0)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].System, Equals, mysql.VARIABLES_SYSTEM+": timeouts")
+}
+
+func (s *TestSuite) TestRemoveIdentifiedBy(t *C) {
+	got := mysql.RemoveIdentifiedBy("GRANT USAGE ON *.* TO 'bob'@'%' IDENTIFIED BY PASSWORD '*4ACFE3202A5FF5CF467898FC58AAB1D615029441'")
+	t.Check(got, Equals, "GRANT USAGE ON *.* TO 'bob'@'%'")
+
+	got = mysql.RemoveIdentifiedBy("GRANT USAGE ON *.* TO 'bob'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*4ACFE3202A5FF5CF467898FC58AAB1D615029441' WITH GRANT OPTION")
+	t.Check(got, Equals, "GRANT USAGE ON *.* TO 'bob'@'%' WITH GRANT OPTION")
+
+	got = mysql.RemoveIdentifiedBy("GRANT SELECT ON `db`.* TO 'bob'@'localhost'")
+	t.Check(got, Equals, "GRANT SELECT ON `db`.* TO 'bob'@'localhost'")
+}
+
+func (s *TestSuite) TestPasswordPlugin(t *C) {
+	for _, plugin := range []string{"", "mysql_native_password", "mysql_old_password", "sha256_password"} {
+		t.Check(mysql.PasswordPlugin(plugin), Equals, true, Commentf(plugin))
+	}
+	for _, plugin := range []string{"auth_socket", "unix_socket", "auth_pam", "authentication_ldap_simple"} {
+		t.Check(mysql.PasswordPlugin(plugin), Equals, false, Commentf(plugin))
+	}
+}
+
+func (s *TestSuite) TestDiffGrants(t *C) {
+	bob := &mysql.UserGrants{
+		User:   "bob",
+		Host:   "localhost",
+		Grants: []string{"GRANT USAGE ON *.* TO 'bob'@'localhost'"},
+	}
+	app := &mysql.UserGrants{
+		User:       "app",
+		Host:       "10.%",
+		NoPassword: true,
+		Grants:     []string{"GRANT SELECT ON `db`.* TO 'app'@'10.%'"},
+	}
+
+	// First snapshot: every user is new.
+	cur := map[string]*mysql.UserGrants{
+		bob.Account(): bob,
+		app.Account(): app,
+	}
+	got := mysql.DiffGrants(nil, cur)
+	expect := []sysconfig.Setting{
+		{"users", "2"},
+		{"new_user", "'app'@'10.%'"},
+		{"grant", "GRANT SELECT ON `db`.* TO 'app'@'10.%'"},
+		{"new_user", "'bob'@'localhost'"},
+		{"grant", "GRANT USAGE ON *.* TO 'bob'@'localhost'"},
+		{"wildcard_host", "'app'@'10.%'"},
+		{"no_password", "'app'@'10.%'"},
+	}
+	t.Check(got, DeepEquals, expect)
+
+	// bob gets a new grant, app is dropped, and eve is created.
+	prev := cur
+	bob2 := *bob
+	bob2.Grants = []string{"GRANT SELECT ON `db`.* TO 'bob'@'localhost'", "GRANT USAGE ON *.* TO 'bob'@'localhost'"}
+	eve := &mysql.UserGrants{
+		User:   "eve",
+		Host:   "%",
+		Grants: []string{"GRANT ALL PRIVILEGES ON *.* TO 'eve'@'%'"},
+	}
+	cur = map[string]*mysql.UserGrants{
+		bob2.Account(): &bob2,
+		eve.Account():  eve,
+	}
+	got = mysql.DiffGrants(prev, cur)
+	expect = []sysconfig.Setting{
+		{"users", "2"},
+		{"grants_changed", "'bob'@'localhost'"},
+		{"grant", "GRANT SELECT ON `db`.* TO 'bob'@'localhost'"},
+		{"grant", "GRANT USAGE ON *.* TO 'bob'@'localhost'"},
+		{"new_user", "'eve'@'%'"},
+		{"grant", "GRANT ALL PRIVILEGES ON *.* TO 'eve'@'%'"},
+		{"wildcard_host", "'eve'@'%'"},
+		{"dropped_user", "'app'@'10.%'"},
+	}
+	t.Check(got, DeepEquals, expect)
+
+	// No changes: only the user count and standing warnings.
+	got = mysql.DiffGrants(cur, cur)
+	expect = []sysconfig.Setting{
+		{"users", "2"},
+		{"wildcard_host", "'eve'@'%'"},
+	}
+	t.Check(got, DeepEquals, expect)
+}
+
+func (s *TestSuite) TestSecuritySettings(t *C) {
+	vars := []sysconfig.Setting{
+		{"autocommit", "ON"},
+		{"bind_address", "*"},
+		{"have_ssl", "DISABLED"},
+		{"port", "3306"},
+		{"skip_networking", "OFF"},
+		{"tls_version", "TLSv1,TLSv1.1,TLSv1.2"},
+		{"validate_password_length", "8"},
+		{"validate_password_policy", "MEDIUM"},
+	}
+	got := mysql.SecuritySettings(vars, "DISABLED", 2)
+	t.Check(got, DeepEquals, []sysconfig.Setting{
+		{"have_ssl", "DISABLED"},
+		{"tls_version", "TLSv1,TLSv1.1,TLSv1.2"},
+		{"skip_networking", "OFF"},
+		{"bind_address", "*"},
+		{"port", "3306"},
+		{"password_validation", "plugin disabled"},
+		{"validate_password_policy", "MEDIUM"},
+		{"validate_password_length", "8"},
+		{"anonymous_users", "2"},
+		{"issues", "SSL is not enabled, TLSv1 is allowed, TLSv1.1 is allowed, no active password validation, 2 anonymous users, listens on all interfaces"},
+	})
+
+	// MySQL 8 with the validate_password component, SSL, and TLSv1.2+ only.
+	vars = []sysconfig.Setting{
+		{"bind_address", "127.0.0.1"},
+		{"have_ssl", "YES"},
+		{"require_secure_transport", "ON"},
+		{"skip_networking", "OFF"},
+		{"tls_version", "TLSv1.2,TLSv1.3"},
+		{"validate_password.policy", "STRONG"},
+	}
+	got = mysql.SecuritySettings(vars, "", 0)
+	t.Check(got, DeepEquals, []sysconfig.Setting{
+		{"have_ssl", "YES"},
+		{"tls_version", "TLSv1.2,TLSv1.3"},
+		{"require_secure_transport", "ON"},
+		{"skip_networking", "OFF"},
+		{"bind_address", "127.0.0.1"},
+		{"password_validation", "component"},
+		{"validate_password.policy", "STRONG"},
+		{"anonymous_users", "0"},
+		{"issues", "none"},
+	})
+
+	// Agent user can't read mysql.user, so anonymous users are unknown,
+	// but the rest is reported.
+	got = mysql.SecuritySettings(vars, "", -1)
+	t.Check(got[len(got)-2], DeepEquals, sysconfig.Setting{"anonymous_users", "unknown"})
+	t.Check(got[len(got)-1], DeepEquals, sysconfig.Setting{"issues", "none"})
+}
+
+// --------------------------------------------------------------------------
+
+// The Watcher doesn't need MySQL, so it has its own suite.
+type WatcherTestSuite struct {
+	logChan chan *proto.LogEntry
+	logger  *pct.Logger
+	dir     string
+}
+
+var _ = Suite(&WatcherTestSuite{})
+
+func (s *WatcherTestSuite) SetUpSuite(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+	s.logger = pct.NewLogger(s.logChan, "sysconfig-mysql-watcher-test")
+}
+
+func (s *WatcherTestSuite) SetUpTest(t *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("/tmp", "percona-agent-test-")
+	t.Assert(err, IsNil)
+}
+
+func (s *WatcherTestSuite) TearDownTest(t *C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *WatcherTestSuite) waitChange(t *C, w *mysql.Watcher) mysql.OptionFileChange {
+	select {
+	case c := <-w.Changes():
+		return c
+	case <-time.After(2 * mysql.WATCH_POLL_INTERVAL):
+		t.Fatal("Timeout waiting for option file change")
+	}
+	return mysql.OptionFileChange{}
+}
+
+func (s *WatcherTestSuite) TestWatch(t *C) {
+	myCnf := filepath.Join(s.dir, "my.cnf")
+	confd := filepath.Join(s.dir, "conf.d")
+	t.Assert(os.Mkdir(confd, 0755), IsNil)
+	err := ioutil.WriteFile(myCnf, []byte("[mysqld]\nport = 3306\n!includedir "+confd+"\n"), 0644)
+	t.Assert(err, IsNil)
+
+	w := mysql.NewWatcher(s.logger, []string{myCnf})
+	t.Assert(w.Start(), IsNil)
+	defer w.Stop()
+
+	// Nothing changed yet.
+	select {
+	case c := <-w.Changes():
+		t.Fatalf("Got change before any: %+v", c)
+	case <-time.After(mysql.WATCH_SETTLE):
+	}
+
+	// Change my.cnf like an editor: write a new file and rename it over.
+	t0 := time.Now()
+	err = ioutil.WriteFile(myCnf+".tmp", []byte("[mysqld]\nport = 3307\n!includedir "+confd+"\n"), 0644)
+	t.Assert(err, IsNil)
+	t.Assert(os.Rename(myCnf+".tmp", myCnf), IsNil)
+	c := s.waitChange(t, w)
+	t.Check(c.File, Equals, myCnf)
+	t.Check(c.Op, Equals, "modified")
+	t.Check(c.Ts.Before(t0), Equals, false)
+
+	// A new file in the included dir.
+	newCnf := filepath.Join(confd, "new.cnf")
+	t.Assert(ioutil.WriteFile(newCnf, []byte("[mysqld]\nmax_connections = 500\n"), 0644), IsNil)
+	c = s.waitChange(t, w)
+	t.Check(c.File, Equals, newCnf)
+	t.Check(c.Op, Equals, "created")
+
+	// Files that aren't option files are ignored.
+	t.Assert(ioutil.WriteFile(filepath.Join(confd, "README"), []byte("hi"), 0644), IsNil)
+	t.Assert(os.Remove(newCnf), IsNil)
+	c = s.waitChange(t, w)
+	t.Check(c.File, Equals, newCnf)
+	t.Check(c.Op, Equals, "removed")
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/sysconfig"
+)
+
+/**
+ * If Config.Security is true, every time the monitor reports global variables
+ * it also reports a summary of the server's SSL and authentication settings
+ * as a separate sysconfig.Report (System=SECURITY_SYSTEM): whether SSL is
+ * enabled and which TLS versions are allowed, the password validation plugin
+ * or component, anonymous users, and what the server listens on.  The last
+ * setting, "issues", lists the problems found, or "none", so the API doesn't
+ * need to know every MySQL version's variables to flag a server.  Counting
+ * anonymous users requires SELECT on mysql.user which the agent user might
+ * not have, so if a query fails the report has what the agent could get,
+ * e.g. anonymous_users is "unknown", and the failure is logged.
+ */
+
+const SECURITY_SYSTEM = "mysql security"
+
+// Global variables copied as-is to the security report, if the server has them.
+var securityVariables = []string{
+	"have_ssl",
+	"tls_version",
+	"require_secure_transport",
+	"ssl_ca",
+	"ssl_cert",
+	"default_authentication_plugin",
+	"skip_networking",
+	"bind_address",
+	"port",
+}
+
+// GetSecurity returns the status of the validate_password plugin, or "" if
+// it's not installed or unknown, and the number of anonymous users, or -1 if
+// unknown.  Query errors are logged, not returned, see above.
+func (m *Monitor) GetSecurity(conn *sql.DB) (string, int) {
+	m.logger.Debug("Getting security settings")
+	m.status.Update(m.name, "Getting security settings")
+
+	var status string
+	err := conn.QueryRow("SELECT PLUGIN_STATUS FROM INFORMATION_SCHEMA.PLUGINS WHERE PLUGIN_NAME = 'validate_password'").Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		m.logger.Warn("Cannot get validate_password plugin status: ", err)
+		status = ""
+	}
+
+	anonymous := -1
+	if err := conn.QueryRow("SELECT COUNT(*) FROM mysql.user WHERE User = ''").Scan(&anonymous); err != nil {
+		m.logger.Warn("Cannot count anonymous users: ", err)
+		anonymous = -1
+	}
+
+	return status, anonymous
+}
+
+// SecuritySettings returns the security report settings for the global
+// variables, validate_password plugin status ("" if not installed), and number
+// of anonymous users (-1 if unknown).
+func SecuritySettings(vars []sysconfig.Setting, plugin string, anonymous int) []sysconfig.Setting {
+	val := make(map[string]string)
+	validateVars := []string{}
+	for _, v := range vars {
+		name := strings.ToLower(v[0])
+		val[name] = v[1]
+		// validate_password_* (plugin) or validate_password.* (MySQL 8 component)
+		if strings.HasPrefix(name, "validate_password") {
+			validateVars = append(validateVars, name)
+		}
+	}
+
+	settings := []sysconfig.Setting{}
+	for _, name := range securityVariables {
+		if v, ok := val[name]; ok {
+			settings = append(settings, sysconfig.Setting{name, v})
+		}
+	}
+
+	validation := "not installed"
+	switch {
+	case plugin != "":
+		validation = "plugin " + strings.ToLower(plugin)
+	case len(validateVars) > 0:
+		validation = "component"
+	}
+	settings = append(settings, sysconfig.Setting{"password_validation", validation})
+	for _, name := range []string{"validate_password_policy", "validate_password.policy", "validate_password_length", "validate_password.length"} {
+		if v, ok := val[name]; ok {
+			settings = append(settings, sysconfig.Setting{name, v})
+		}
+	}
+	if anonymous < 0 {
+		settings = append(settings, sysconfig.Setting{"anonymous_users", "unknown"})
+	} else {
+		settings = append(settings, sysconfig.Setting{"anonymous_users", fmt.Sprintf("%d", anonymous)})
+	}
+
+	issues := []string{}
+	if have, ok := val["have_ssl"]; ok && strings.ToUpper(have) != "YES" {
+		issues = append(issues, "SSL is not enabled")
+	}
+	for _, old := range []string{"TLSv1", "TLSv1.1"} {
+		for _, v := range strings.Split(val["tls_version"], ",") {
+			if strings.TrimSpace(v) == old {
+				issues = append(issues, old+" is allowed")
+			}
+		}
+	}
+	if validation != "plugin active" && validation != "component" {
+		issues = append(issues, "no active password validation")
+	}
+	if anonymous > 0 {
+		issues = append(issues, fmt.Sprintf("%d anonymous users", anonymous))
+	}
+	if strings.ToUpper(val["skip_networking"]) != "ON" {
+		// No bind_address (before MySQL 5.6.1) means all interfaces.
+		switch val["bind_address"] {
+		case "*", "0.0.0.0", "::", "":
+			issues = append(issues, "listens on all interfaces")
+		}
+	}
+	if len(issues) == 0 {
+		issues = append(issues, "none")
+	}
+	settings = append(settings, sysconfig.Setting{"issues", strings.Join(issues, ", ")})
+	return settings
+}
+
+// @goroutine[2]
+func (m *Monitor) securityReport(conn *sql.DB, vars []sysconfig.Setting, ts int64) *sysconfig.Report {
+	plugin, anonymous := m.GetSecurity(conn)
+	r := &sysconfig.Report{
+		ServiceInstance: proto.ServiceInstance{
+			Service:    m.config.Service,
+			InstanceId: m.config.InstanceId,
+		},
+		Ts:       ts,
+		System:   SECURITY_SYSTEM,
+		Settings: SecuritySettings(vars, plugin, anonymous),
+	}
+	return r
+}
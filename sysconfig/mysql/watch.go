@@ -0,0 +1,173 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+)
+
+const OPTION_FILES_SYSTEM = "mysql option files"
+
+const (
+	WATCH_SETTLE        = 500 * time.Millisecond // wait for more events after the first
+	WATCH_POLL_INTERVAL = 5 * time.Second        // if inotify isn't available
+)
+
+/**
+ * A Watcher watches MySQL option files, the files and dirs they include too,
+ * so the monitor reports variables when they change instead of at the next
+ * Report interval: config drift then has the time it happened.  On Linux it
+ * uses inotify on the dirs of the files, which also catches editors that
+ * write a new file and rename it over the old one, and files being created.
+ * Elsewhere it polls the files every WATCH_POLL_INTERVAL.
+ *
+ * Either way, the Watcher re-reads the includes and stats the files to see
+ * what changed, so inotify events are only a hint and events for other files
+ * in the same dirs (e.g. /etc) are ignored.
+ */
+type Watcher struct {
+	logger *pct.Logger
+	files  []string // option files to start from, e.g. /etc/my.cnf
+	// --
+	changeChan chan OptionFileChange
+	sync       *pct.SyncChan
+	state      map[string]fileState // nil until first scan
+	dirs       map[string]bool      // watched dirs
+	fd         int                  // inotify, see watch_linux.go
+	running    bool
+}
+
+// An OptionFileChange is sent by the Watcher for each option file that was
+// created, modified, or removed.  Ts is when the change was detected.
+type OptionFileChange struct {
+	Ts   time.Time
+	File string
+	Op   string // created, modified, or removed
+}
+
+type fileState struct {
+	exists bool
+	mtime  time.Time
+	size   int64
+}
+
+func NewWatcher(logger *pct.Logger, files []string) *Watcher {
+	w := &Watcher{
+		logger: logger,
+		files:  files,
+		// --
+		changeChan: make(chan OptionFileChange, 10),
+		sync:       pct.NewSyncChan(),
+		dirs:       make(map[string]bool),
+	}
+	return w
+}
+
+func (w *Watcher) Start() error {
+	w.logger.Debug("Watcher.Start:call")
+	defer w.logger.Debug("Watcher.Start:return")
+	if w.running {
+		return nil
+	}
+	if err := w.start(); err != nil {
+		return err
+	}
+	w.running = true
+	return nil
+}
+
+func (w *Watcher) Stop() {
+	w.logger.Debug("Watcher.Stop:call")
+	defer w.logger.Debug("Watcher.Stop:return")
+	if !w.running {
+		return
+	}
+	w.sync.Stop()
+	w.sync.Wait()
+	w.running = false
+}
+
+func (w *Watcher) Changes() <-chan OptionFileChange {
+	return w.changeChan
+}
+
+// scan re-reads the option files and their includes, sends a change for
+// every file that's different since the last scan, and returns the dirs to
+// watch: the dirs of the files and the included dirs.
+func (w *Watcher) scan(ts time.Time) []string {
+	files, includedDirs := mysql.OptionFiles(w.files)
+	state := make(map[string]fileState, len(files))
+	dirs := []string{}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		s := fileState{}
+		if fi, err := os.Stat(file); err == nil {
+			s = fileState{exists: true, mtime: fi.ModTime(), size: fi.Size()}
+		}
+		state[file] = s
+		if dir := filepath.Dir(file); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range includedDirs {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if w.state != nil {
+		for _, file := range files {
+			w.changed(ts, file, w.state[file], state[file])
+		}
+		// Files no longer included, e.g. removed from an !includedir.
+		for file, old := range w.state {
+			if _, ok := state[file]; !ok {
+				w.changed(ts, file, old, fileState{})
+			}
+		}
+	}
+	w.state = state
+	return dirs
+}
+
+func (w *Watcher) changed(ts time.Time, file string, old, cur fileState) {
+	op := ""
+	switch {
+	case !old.exists && cur.exists:
+		op = "created"
+	case old.exists && !cur.exists:
+		op = "removed"
+	case cur.exists && (!cur.mtime.Equal(old.mtime) || cur.size != old.size):
+		op = "modified"
+	default:
+		return
+	}
+	w.logger.Info("MySQL option file " + op + ": " + file)
+	select {
+	case w.changeChan <- OptionFileChange{Ts: ts, File: file, Op: op}:
+	default:
+		w.logger.Warn("Lost MySQL option file change: " + file + " " + op)
+	}
+}
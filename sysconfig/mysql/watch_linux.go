@@ -0,0 +1,135 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+func init() {
+	pct.RegisterFeature("mysql-option-file-watch:inotify")
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+func (w *Watcher) start() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	w.fd = fd
+	w.watch(w.scan(time.Now()))
+	if len(w.dirs) == 0 {
+		syscall.Close(fd)
+		return errors.New("No option file dirs to watch")
+	}
+	go w.run()
+	return nil
+}
+
+// @goroutine[3]
+func (w *Watcher) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			w.logger.Error("MySQL option file watcher crashed: ", err)
+		}
+		syscall.Close(w.fd)
+		w.sync.Done()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		// Wake up every second to check for Stop.
+		ready, err := w.wait(time.Second)
+		select {
+		case <-w.sync.StopChan:
+			return
+		default:
+		}
+		if err != nil {
+			w.logger.Warn("Waiting for inotify events: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !ready {
+			continue
+		}
+
+		// Editors, package managers, etc. make several events for one
+		// change, so read events until there are none for WATCH_SETTLE.
+		// The change is at the first event.
+		ts := time.Now()
+		for ready {
+			w.read(buf)
+			if ready, err = w.wait(WATCH_SETTLE); err != nil {
+				break
+			}
+		}
+
+		// Changed files can add or remove includes, so watch dirs again.
+		w.watch(w.scan(ts))
+	}
+}
+
+// watch adds an inotify watch for each dir not already watched.  Dirs that
+// don't exist aren't watched: their option files are ignored like mysqld does.
+func (w *Watcher) watch(dirs []string) {
+	for _, dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if _, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask); err != nil {
+			w.logger.Debug("Cannot watch " + dir + ": " + err.Error())
+			continue
+		}
+		w.dirs[dir] = true
+	}
+}
+
+// read reads and discards the available events; they only tell the Watcher
+// to scan the files.
+func (w *Watcher) read(buf []byte) {
+	for {
+		if n, err := syscall.Read(w.fd, buf); n <= 0 || err != nil {
+			return
+		}
+	}
+}
+
+// wait returns true if inotify events are ready to read.
+func (w *Watcher) wait(timeout time.Duration) (bool, error) {
+	var set syscall.FdSet
+	bits := 8 * int(unsafe.Sizeof(set.Bits[0]))
+	if w.fd >= bits*len(set.Bits) {
+		return false, errors.New("inotify fd too large for select")
+	}
+	set.Bits[w.fd/bits] |= 1 << uint(w.fd%bits)
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	n, err := syscall.Select(w.fd+1, &set, nil, nil, &tv)
+	if err == syscall.EINTR {
+		return false, nil
+	}
+	return n > 0, err
+}
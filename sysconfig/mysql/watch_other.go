@@ -0,0 +1,58 @@
+// +build !linux
+
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+func init() {
+	pct.RegisterFeature("mysql-option-file-watch:poll")
+}
+
+// Without inotify, scan the option files every WATCH_POLL_INTERVAL.
+func (w *Watcher) start() error {
+	w.scan(time.Now())
+	go w.run()
+	return nil
+}
+
+// @goroutine[3]
+func (w *Watcher) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			w.logger.Error("MySQL option file watcher crashed: ", err)
+		}
+		w.sync.Done()
+	}()
+
+	ticker := time.NewTicker(WATCH_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.scan(now)
+		case <-w.sync.StopChan:
+			return
+		}
+	}
+}
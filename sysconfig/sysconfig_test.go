@@ -339,3 +339,126 @@ func (s *ManagerTestSuite) TestGetConfig(t *C) {
 		t.Error(diff)
 	}
 }
+
+func (s *ManagerTestSuite) TestGroups(t *C) {
+	m := sysconfig.NewManager(s.logger, s.factory, s.clock, s.spool, s.im)
+	t.Assert(m, NotNil)
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// Replication variables every minute, everything else every hour.
+	sysconfigConfig := &mysql.Config{
+		Config: sysconfig.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Report: 3600,
+			Groups: []sysconfig.Group{
+				{Name: "replication", Settings: []string{"gtid_mode", "slave_*"}, Report: 60},
+				{Name: "buffers", Settings: []string{"*_buffer_size"}, Report: 600},
+			},
+		},
+	}
+	sysconfigConfigData, err := json.Marshal(sysconfigConfig)
+	t.Assert(err, IsNil)
+	s.mockMonitor.SetConfig(sysconfigConfig)
+
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "sysconfig",
+		Cmd:     "StartService",
+		Data:    sysconfigConfigData,
+	}
+	reply := m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+
+	// The monitor ticks at the shortest interval.
+	t.Check(s.clock.Added, DeepEquals, []uint{60})
+
+	// Groups must have a name, settings, and a report interval.
+	sysconfigConfig.InstanceId = 2
+	sysconfigConfig.Groups = []sysconfig.Group{{Name: "replication", Settings: []string{"slave_*"}}}
+	sysconfigConfigData, err = json.Marshal(sysconfigConfig)
+	t.Assert(err, IsNil)
+	cmd.Data = sysconfigConfigData
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "Group replication: Report must be > 0")
+}
+
+func (s *ManagerTestSuite) TestBlackout(t *C) {
+	m := sysconfig.NewManager(s.logger, s.factory, s.clock, s.spool, s.im)
+	t.Assert(m, NotNil)
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// An invalid blackout fails the cmd.
+	sysconfigConfig := &mysql.Config{
+		Config: sysconfig.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Report:   3600,
+			Blackout: []string{"* 25 * * *"},
+		},
+	}
+	sysconfigConfigData, err := json.Marshal(sysconfigConfig)
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		User:    "daniel",
+		Service: "sysconfig",
+		Cmd:     "StartService",
+		Data:    sysconfigConfigData,
+	}
+	reply := m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "Invalid blackout: * 25 * * *: hour: 25 out of range 0-23")
+	t.Check(s.clock.Added, HasLen, 0)
+
+	// The clock ticks the blackout ticker, not the monitor, so both are
+	// removed when the monitor is stopped.
+	sysconfigConfig.Blackout = []string{"* 1-3 * * 0"}
+	sysconfigConfigData, err = json.Marshal(sysconfigConfig)
+	t.Assert(err, IsNil)
+	s.mockMonitor.SetConfig(sysconfigConfig)
+	cmd.Data = sysconfigConfigData
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Added, DeepEquals, []uint{3600})
+
+	cmd.Cmd = "StopService"
+	reply = m.Handle(cmd)
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.clock.Removed, HasLen, 2)
+}
+
+func (s *ManagerTestSuite) TestGroupFilter(t *C) {
+	g := sysconfig.Group{Name: "replication", Settings: []string{"gtid_mode", "slave_*"}, Report: 60}
+	settings := []sysconfig.Setting{
+		{"autocommit", "ON"},
+		{"gtid_mode", "ON"},
+		{"slave_net_timeout", "3600"},
+		{"SLAVE_PARALLEL_WORKERS", "4"},
+		{"wait_timeout", "28800"},
+	}
+	t.Check(g.Filter(settings), DeepEquals, []sysconfig.Setting{
+		{"gtid_mode", "ON"},
+		{"slave_net_timeout", "3600"},
+		{"SLAVE_PARALLEL_WORKERS", "4"},
+	})
+
+	// Ticks every 60s aren't exact, so a report is due half a tick early.
+	t.Check(sysconfig.Due(0, 1000, 600, 60), Equals, true)
+	t.Check(sysconfig.Due(1000, 1540, 600, 60), Equals, false)
+	t.Check(sysconfig.Due(1000, 1575, 600, 60), Equals, true)
+	t.Check(sysconfig.Due(1000, 1600, 600, 60), Equals, true)
+}
@@ -62,6 +62,15 @@ func (f *FakeApi) AppendPing() {
 	})
 }
 
+// AppendLimit makes pattern respond like the API when the account limit of
+// a resource is reached, e.g. resource "OS" sets X-Percona-OS-Limit.
+func (f *FakeApi) AppendLimit(pattern, resource string, limit uint) {
+	f.Append(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Percona-"+resource+"-Limit", fmt.Sprintf("%d", limit))
+		w.WriteHeader(http.StatusForbidden)
+	})
+}
+
 func (f *FakeApi) AppendInstancesServer(id uint, serverInstance *proto.ServerInstance) {
 	f.Append("/instances/server", func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -27,6 +27,8 @@ type API struct {
 	apiKey    string
 	agentUuid string
 	links     map[string]string
+	Protocol  int
+	DataTypes []string
 	GetCode   []int
 	GetData   [][]byte
 	GetError  []error
@@ -39,6 +41,7 @@ func NewAPI(origin, hostname, apiKey, agentUuid string, links map[string]string)
 		apiKey:    apiKey,
 		agentUuid: agentUuid,
 		links:     links,
+		Protocol:  1,
 	}
 	return a
 }
@@ -112,3 +115,14 @@ func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, erro
 func (a *API) URL(paths ...string) string {
 	return ""
 }
+
+func (a *API) ProtocolVersion() int {
+	return a.Protocol
+}
+
+func (a *API) DataContentTypes() []string {
+	if len(a.DataTypes) == 0 {
+		return []string{"application/json"}
+	}
+	return a.DataTypes
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mock
+
+import (
+	"fmt"
+	"github.com/percona/cloud-protocol/proto/v1"
+	"github.com/percona/percona-agent/mm"
+	"time"
+)
+
+// LoadMonitor is an mm.Monitor that generates collections of any number of
+// metrics, e.g. 500k for a MySQL server with a huge schema, to benchmark and
+// load test the data pipeline: aggregator, serializer, and spool.  Half the
+// metrics are gauges and half are counters that increase every collection.
+type LoadMonitor struct {
+	si      proto.ServiceInstance
+	names   []string
+	n       int64 // collections made
+	running bool
+	stop    chan bool
+	done    chan bool
+}
+
+func NewLoadMonitor(service string, instanceId uint, metrics int) *LoadMonitor {
+	names := make([]string, metrics)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s/db%d/table%d/rows_read", service, i/100, i%100)
+	}
+	m := &LoadMonitor{
+		si:    proto.ServiceInstance{Service: service, InstanceId: instanceId},
+		names: names,
+	}
+	return m
+}
+
+// Collection returns the next collection, with timestamp ts.
+func (m *LoadMonitor) Collection(ts int64) *mm.Collection {
+	m.n++
+	c := &mm.Collection{
+		ServiceInstance: m.si,
+		Ts:              ts,
+		Metrics:         make([]mm.Metric, len(m.names)),
+	}
+	for i, name := range m.names {
+		if i%2 == 0 {
+			c.Metrics[i] = mm.Metric{Name: name, Type: "gauge", Number: float64((int64(i) + m.n) % 100)}
+		} else {
+			c.Metrics[i] = mm.Metric{Name: name, Type: "counter", Number: float64(int64(i) * m.n)}
+		}
+	}
+	return c
+}
+
+// Start sends a collection to collectionChan for every tick.
+func (m *LoadMonitor) Start(tickChan chan time.Time, collectionChan chan *mm.Collection) error {
+	m.stop = make(chan bool)
+	m.done = make(chan bool)
+	m.running = true
+	go func() {
+		defer close(m.done)
+		for {
+			select {
+			case now := <-tickChan:
+				select {
+				case collectionChan <- m.Collection(now.Unix()):
+				case <-m.stop:
+					return
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *LoadMonitor) Stop() error {
+	if m.running {
+		close(m.stop)
+		<-m.done
+		m.running = false
+	}
+	return nil
+}
+
+func (m *LoadMonitor) Status() map[string]string {
+	status := make(map[string]string)
+	if m.running {
+		status["monitor"] = "Running"
+	} else {
+		status["monitor"] = "Stopped"
+	}
+	return status
+}
+
+func (m *LoadMonitor) TickChan() chan time.Time {
+	return nil
+}
+
+func (m *LoadMonitor) Config() interface{} {
+	return nil
+}
@@ -27,6 +27,7 @@ type MmMonitorFactory struct {
 	monitors  map[string]mm.Monitor
 	monitorNo int
 	Made      []string
+	Estimates map[string]*mm.Estimate // test provides, keyed on service-id
 }
 
 func NewMmMonitorFactory(monitors map[string]mm.Monitor) *MmMonitorFactory {
@@ -46,13 +47,22 @@ func (f *MmMonitorFactory) Make(service string, id uint, data []byte) (mm.Monito
 	panic(fmt.Sprintf("Mock factory doesn't have monitor %s. Provide it via NewMmMonitorFactory(...) or Set(...).", name))
 }
 
+func (f *MmMonitorFactory) Estimate(service string, id uint, data []byte) (*mm.Estimate, error) {
+	name := fmt.Sprintf("%s-%d", service, id)
+	if e, ok := f.Estimates[name]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("Mock factory doesn't have estimate %s", name)
+}
+
 // --------------------------------------------------------------------------
 
 type MmMonitor struct {
-	tickChan  chan time.Time
-	ReadyChan chan bool
-	running   bool
-	config    interface{}
+	tickChan   chan time.Time
+	ReadyChan  chan bool
+	StartError error // returned once, by the next Start
+	running    bool
+	config     interface{}
 }
 
 func NewMmMonitor() *MmMonitor {
@@ -64,6 +74,10 @@ func (m *MmMonitor) Start(tickChan chan time.Time, collectionChan chan *mm.Colle
 	if m.ReadyChan != nil {
 		<-m.ReadyChan
 	}
+	if err := m.StartError; err != nil {
+		m.StartError = nil
+		return err
+	}
 	m.running = true
 	return nil
 }
@@ -32,6 +32,8 @@ type MockServiceManager struct {
 	IsRunningVal bool
 	status       *pct.Status
 	Cmds         []*proto.Cmd
+	Caps         []string
+	Configs      []proto.AgentConfig // returned by GetConfig if set
 }
 
 func NewMockServiceManager(name string, readyChan chan bool, traceChan chan string) *MockServiceManager {
@@ -70,7 +72,14 @@ func (m *MockServiceManager) Status() map[string]string {
 	return m.status.All()
 }
 
+func (m *MockServiceManager) Capabilities() []string {
+	return m.Caps
+}
+
 func (m *MockServiceManager) GetConfig() ([]proto.AgentConfig, []error) {
+	if m.Configs != nil {
+		return m.Configs, nil
+	}
 	configs := []proto.AgentConfig{
 		{
 			InternalService: m.name,
@@ -30,6 +30,9 @@ type Spooler struct {
 	DataIn        []interface{}
 	dataChan      chan interface{}
 	RejectedFiles []string
+	Taps          map[string]data.Tap
+	WriteErr      error // test provides, Write returns it and drops the data
+	WriteOk       uint  // test provides, Write ignores WriteErr this many times
 }
 
 func NewSpooler(dataChan chan interface{}) *Spooler {
@@ -37,6 +40,7 @@ func NewSpooler(dataChan chan interface{}) *Spooler {
 		dataChan:      dataChan,
 		DataIn:        []interface{}{},
 		RejectedFiles: []string{},
+		Taps:          make(map[string]data.Tap),
 	}
 	return s
 }
@@ -54,6 +58,15 @@ func (s *Spooler) Status() map[string]string {
 }
 
 func (s *Spooler) Write(service string, data interface{}) error {
+	if s.WriteErr != nil {
+		if s.WriteOk == 0 {
+			return s.WriteErr
+		}
+		s.WriteOk--
+	}
+	for _, tap := range s.Taps {
+		tap.Write(service, data)
+	}
 	if s.dataChan != nil {
 		s.dataChan <- data
 	} else {
@@ -73,6 +86,15 @@ func (s *Spooler) Files() <-chan string {
 	return filesChan
 }
 
+// Size returns the bytes of FilesOut in DataOut.
+func (s *Spooler) Size() uint64 {
+	n := 0
+	for _, file := range s.FilesOut {
+		n += len(s.DataOut[file])
+	}
+	return uint64(n)
+}
+
 func (s *Spooler) CancelFiles() {
 }
 
@@ -98,3 +120,11 @@ func (s *Spooler) Reset() {
 func (s *Spooler) Purge(now time.Time, limits proto.DataSpoolLimits) (int, map[string][]string) {
 	return 0, nil
 }
+
+func (s *Spooler) SetTap(name string, tap data.Tap) {
+	if tap == nil {
+		delete(s.Taps, name)
+		return
+	}
+	s.Taps[name] = tap
+}